@@ -0,0 +1,201 @@
+// Package bench measures the throughput and latency of the database operations under each concurrency mode, and
+// compares the results against a recorded baseline so that performance changes can be checked for regressions.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+// The workloads of a run. Each is run against every concurrency mode of the config.
+const (
+	WorkloadGet   = "get"   // Only reads of existing keys
+	WorkloadPut   = "put"   // Only overwrites of existing keys
+	WorkloadMixed = "mixed" // Nine reads for every overwrite
+)
+
+// Workloads are every workload, in the order they are run
+var Workloads = []string{WorkloadGet, WorkloadPut, WorkloadMixed}
+
+// sampleEvery is how many operations a worker makes for each one it times. Timing every operation would add the cost
+// of reading the clock to operations that take about as long.
+const sampleEvery = 16
+
+// Config is what a run measures
+type Config struct {
+	Duration    time.Duration `json:"duration"`    // How long each workload runs for
+	Concurrency int           `json:"concurrency"` // The number of goroutines making operations
+	Keys        int           `json:"keys"`        // The number of keys stored before each workload
+	ValueSize   int           `json:"valueSize"`   // The length of every value in bytes
+	Modes       []string      `json:"modes"`       // The concurrency modes to run the workloads against
+}
+
+// DefaultConfig returns the config of a run that takes a few seconds on every concurrency mode
+func DefaultConfig() Config {
+	return Config{
+		Duration:    time.Second / 2,
+		Concurrency: runtime.GOMAXPROCS(0),
+		Keys:        10000,
+		ValueSize:   64,
+		Modes:       []string{database.ConcurrencyRWMutex, database.ConcurrencySharded, database.ConcurrencyCOW},
+	}
+}
+
+// Result is the measurement of a workload on a concurrency mode
+type Result struct {
+	Name      string        `json:"name"` // The concurrency mode and the workload, e.g. cow/get
+	Ops       int64         `json:"ops"`
+	OpsPerSec float64       `json:"opsPerSec"`
+	P50       time.Duration `json:"p50"` // The median latency of an operation
+	P99       time.Duration `json:"p99"`
+}
+
+// Report is the outcome of a run, in the format baselines are recorded in
+type Report struct {
+	Time      time.Time `json:"time"`
+	GoVersion string    `json:"goVersion"`
+	GOOS      string    `json:"goos"`
+	GOARCH    string    `json:"goarch"`
+	NumCPU    int       `json:"numCPU"`
+	Config    Config    `json:"config"`
+	Results   []Result  `json:"results"`
+}
+
+// Result returns the result with the name, or false if the report has none
+func (r Report) Result(name string) (Result, bool) {
+	i := slices.IndexFunc(r.Results, func(result Result) bool { return result.Name == name })
+	if i < 0 {
+		return Result{}, false
+	}
+	return r.Results[i], true
+}
+
+// Run runs every workload against every concurrency mode of the config, one after the other. It stops early with the
+// error of the context if it is cancelled.
+func Run(ctx context.Context, cfg Config) (Report, error) {
+	if cfg.Duration <= 0 || cfg.Concurrency <= 0 || cfg.Keys <= 0 || cfg.ValueSize < 0 {
+		return Report{}, fmt.Errorf("invalid bench config %+v", cfg)
+	}
+
+	report := Report{
+		Time:      time.Now().UTC(),
+		GoVersion: runtime.Version(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		NumCPU:    runtime.NumCPU(),
+		Config:    cfg,
+	}
+	for _, mode := range cfg.Modes {
+		for _, workload := range Workloads {
+			result, err := runWorkload(ctx, cfg, mode, workload)
+			if err != nil {
+				return Report{}, err
+			}
+			report.Results = append(report.Results, result)
+		}
+	}
+	return report, nil
+}
+
+// runWorkload measures a workload on a new database with the concurrency mode
+func runWorkload(ctx context.Context, cfg Config, mode string, workload string) (Result, error) {
+	db, err := database.NewInMemoryDatabase(
+		database.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		database.WithConcurrencyMode(mode))
+	if err != nil {
+		return Result{}, err
+	}
+
+	keys := make([]string, cfg.Keys)
+	value := string(make([]byte, cfg.ValueSize))
+	for n := range keys {
+		keys[n] = "bench:" + strconv.Itoa(n)
+		if _, err = db.Put(putData(keys[n], value)); err != nil {
+			return Result{}, err
+		}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	ops := make([]int64, cfg.Concurrency)
+	samples := make([][]time.Duration, cfg.Concurrency)
+	start := time.Now()
+	for w := range cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Workers start at different keys so that they do not all write the same one
+			n := w * len(keys) / cfg.Concurrency
+			for runCtx.Err() == nil {
+				for range sampleEvery {
+					operate(db, workload, keys[n%len(keys)], value, n)
+					n++
+				}
+				opStart := time.Now()
+				operate(db, workload, keys[n%len(keys)], value, n)
+				samples[w] = append(samples[w], time.Since(opStart))
+				n++
+				ops[w] += sampleEvery + 1
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	db.Shutdown()
+	if err = ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Name: mode + "/" + workload}
+	var latencies []time.Duration
+	for w := range cfg.Concurrency {
+		result.Ops += ops[w]
+		latencies = append(latencies, samples[w]...)
+	}
+	result.OpsPerSec = float64(result.Ops) / elapsed.Seconds()
+	slices.Sort(latencies)
+	result.P50, result.P99 = percentile(latencies, 0.5), percentile(latencies, 0.99)
+	return result, nil
+}
+
+// operate makes the nth operation of a worker running the workload
+func operate(db *database.InMemoryDatabase, workload string, key string, value string, n int) {
+	if workload == WorkloadGet || (workload == WorkloadMixed && n%10 != 0) {
+		db.Get(key)
+		return
+	}
+	_, _ = db.Put(putData(key, value))
+}
+
+func putData(key string, value string) struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Ttl   *int64 `json:"ttl"`
+} {
+	return struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: key, Value: value}
+}
+
+// percentile returns the latency below which the fraction p of the sorted latencies are
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(int(math.Ceil(p*float64(len(sorted))))-1, len(sorted)-1)]
+}
@@ -0,0 +1,70 @@
+package bench
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+func TestRun(t *testing.T) {
+	cfg := Config{Duration: 20 * time.Millisecond, Concurrency: 2, Keys: 100, ValueSize: 8, Modes: []string{database.ConcurrencySharded}}
+	report, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != len(Workloads) {
+		t.Fatalf("results = %+v; want one per workload", report.Results)
+	}
+	for _, workload := range Workloads {
+		r, ok := report.Result(database.ConcurrencySharded + "/" + workload)
+		if !ok || r.Ops == 0 || r.OpsPerSec <= 0 || r.P50 <= 0 || r.P99 < r.P50 {
+			t.Errorf("result of %v = %+v, %v; want operations and latencies", workload, r, ok)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = Run(ctx, cfg); err == nil {
+		t.Error("expected an error for a cancelled run")
+	}
+	cfg.Concurrency = 0
+	if _, err = Run(context.Background(), cfg); err == nil {
+		t.Error("expected an error for an invalid config")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := Report{Results: []Result{
+		{Name: "same", OpsPerSec: 1000, P99: time.Microsecond},
+		{Name: "slower", OpsPerSec: 1000, P99: time.Microsecond},
+		{Name: "higher p99", OpsPerSec: 1000, P99: time.Microsecond},
+		{Name: "within thresholds", OpsPerSec: 1000, P99: time.Microsecond},
+		{Name: "missing", OpsPerSec: 1000, P99: time.Microsecond},
+	}}
+	current := Report{Results: []Result{
+		{Name: "same", OpsPerSec: 1000, P99: time.Microsecond},
+		{Name: "slower", OpsPerSec: 800, P99: time.Microsecond},
+		{Name: "higher p99", OpsPerSec: 1200, P99: 2 * time.Microsecond},
+		{Name: "within thresholds", OpsPerSec: 950, P99: 1200 * time.Nanosecond},
+		{Name: "new", OpsPerSec: 1000, P99: time.Microsecond},
+	}}
+
+	comparisons := Compare(baseline, current, Thresholds{Throughput: 0.1, Latency: 0.25})
+	if len(comparisons) != len(baseline.Results) {
+		t.Fatalf("comparisons = %+v; want one per baseline result", comparisons)
+	}
+	want := map[string]bool{"same": false, "slower": true, "higher p99": true, "within thresholds": false, "missing": true}
+	for _, c := range comparisons {
+		if c.Regressed != want[c.Name] {
+			t.Errorf("%v regressed = %v; want %v (%+v)", c.Name, c.Regressed, want[c.Name], c)
+		}
+	}
+	if c := comparisons[1]; c.ThroughputChange != -0.2 || c.LatencyChange != 0 {
+		t.Errorf("changes of slower = %v, %v; want -0.2, 0", c.ThroughputChange, c.LatencyChange)
+	}
+	if !comparisons[4].Missing {
+		t.Errorf("comparison of missing = %+v; want it missing", comparisons[4])
+	}
+}
@@ -0,0 +1,52 @@
+package bench
+
+// Thresholds are how much worse than the baseline a result may be before it counts as a regression, as fractions of
+// the baseline
+type Thresholds struct {
+	Throughput float64 // The largest drop in operations per second, e.g. 0.1 for 10%
+	Latency    float64 // The largest increase of the p99 latency, e.g. 0.25 for 25%
+}
+
+// DefaultThresholds are loose enough for the noise of runs on a shared machine
+var DefaultThresholds = Thresholds{Throughput: 0.15, Latency: 0.5}
+
+// Comparison is a result of the current run compared to the result of the same name in the baseline
+type Comparison struct {
+	Name             string
+	Baseline         Result
+	Current          Result
+	ThroughputChange float64 // The change in operations per second as a fraction of the baseline, negative if slower
+	LatencyChange    float64 // The change of the p99 latency as a fraction of the baseline, positive if slower
+	Missing          bool    // Whether the current run has no result for the baseline result
+	Regressed        bool    // Whether the result is worse than the thresholds allow, or missing
+}
+
+// Compare compares every result of the baseline to the result of the same name in current, in the order of the
+// baseline. Results that are only in current have nothing to be compared to and are left out.
+func Compare(baseline Report, current Report, t Thresholds) []Comparison {
+	comparisons := make([]Comparison, 0, len(baseline.Results))
+	for _, b := range baseline.Results {
+		c := Comparison{Name: b.Name, Baseline: b}
+		var ok bool
+		if c.Current, ok = current.Result(b.Name); !ok {
+			c.Missing, c.Regressed = true, true
+			comparisons = append(comparisons, c)
+			continue
+		}
+
+		c.ThroughputChange = change(b.OpsPerSec, c.Current.OpsPerSec)
+		c.LatencyChange = change(float64(b.P99), float64(c.Current.P99))
+		c.Regressed = c.ThroughputChange < -t.Throughput || c.LatencyChange > t.Latency
+		comparisons = append(comparisons, c)
+	}
+	return comparisons
+}
+
+// change returns the change from the baseline to the current value as a fraction of the baseline, or zero without a
+// baseline to compare to
+func change(baseline float64, current float64) float64 {
+	if baseline == 0 {
+		return 0
+	}
+	return (current - baseline) / baseline
+}
@@ -0,0 +1,235 @@
+// Package bridge connects the pub/sub broker to external message brokers and to other instances of the server. Of the
+// external brokers only NATS is supported. Its text protocol is small enough to speak directly, whereas Kafka and MQTT
+// would need client libraries.
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDialTimeout is how long to wait for the connection and handshake with an external broker
+const DefaultDialTimeout = 5 * time.Second
+
+// ErrClosed is returned when using a bridge whose connection has been closed
+var ErrClosed = errors.New("bridge connection closed")
+
+// NATS is a bridge to a NATS server. Channels map to subjects by adding the prefix. The connection is made with echo
+// disabled so that forwarded messages are not consumed again by the same bridge. The bridge does not reconnect, so
+// forwarding fails once the connection is lost.
+type NATS struct {
+	conn   net.Conn
+	prefix string // Added to channel names to form subjects
+
+	mu     sync.Mutex // Guards writes to the connection and the fields below
+	subs   map[string]natsSubscription
+	nextID int
+	err    error         // Why the connection was closed, if it was
+	closed chan struct{} // Closed when the read loop exits
+}
+
+// natsSubscription is a channel consumed from the server
+type natsSubscription struct {
+	channel string
+	deliver func(channel string, message string) int
+}
+
+// DialNATS connects to the NATS server at the nats:// URL. Credentials in the URL are sent when connecting, and a
+// prefix query parameter sets the prefix that is added to channel names to form subjects.
+func DialNATS(rawURL string) (*NATS, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nats url: %w", err)
+	}
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("invalid nats url scheme %v", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, DefaultDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	n := &NATS{
+		conn:   conn,
+		prefix: u.Query().Get("prefix"),
+		subs:   map[string]natsSubscription{},
+		closed: make(chan struct{}),
+	}
+	r := bufio.NewReader(conn)
+	if err = n.handshake(r, u.User); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go n.read(r)
+	return n, nil
+}
+
+// handshake reads the server's INFO, sends CONNECT, and waits for the PONG that confirms the connection was accepted
+func (n *NATS) handshake(r *bufio.Reader, user *url.Userinfo) error {
+	_ = n.conn.SetDeadline(time.Now().Add(DefaultDialTimeout))
+	defer n.conn.SetDeadline(time.Time{})
+
+	line, err := readLine(r)
+	if err != nil {
+		return fmt.Errorf("error reading nats info: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected nats greeting %q", line)
+	}
+
+	options := map[string]any{"verbose": false, "pedantic": false, "echo": false, "lang": "go", "name": "InMemoryDB", "protocol": 1}
+	if user != nil {
+		options["user"] = user.Username()
+		if pass, ok := user.Password(); ok {
+			options["pass"] = pass
+		}
+	}
+	connect, _ := json.Marshal(options)
+	if _, err = fmt.Fprintf(n.conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return err
+	}
+
+	for {
+		line, err = readLine(r)
+		if err != nil {
+			return fmt.Errorf("error connecting to nats: %w", err)
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats refused the connection: %v", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// subject returns the subject of a channel, or an error if the channel cannot be used as a subject
+func (n *NATS) subject(channel string) (string, error) {
+	subject := n.prefix + channel
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return "", fmt.Errorf("channel %q is not a valid nats subject", channel)
+	}
+	return subject, nil
+}
+
+// write sends a protocol message unless the connection has been closed
+func (n *NATS) write(b []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	_, err := n.conn.Write(b)
+	return err
+}
+
+// Forward publishes a message to the subject of the channel
+func (n *NATS) Forward(channel string, message string) error {
+	subject, err := n.subject(channel)
+	if err != nil {
+		return err
+	}
+	return n.write([]byte(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(message), message)))
+}
+
+// Consume subscribes to the subject of the channel and passes every message received on it to deliver
+func (n *NATS) Consume(channel string, deliver func(channel string, message string) int) error {
+	subject, err := n.subject(channel)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.nextID++
+	sid := strconv.Itoa(n.nextID)
+	n.subs[sid] = natsSubscription{channel: channel, deliver: deliver}
+	n.mu.Unlock()
+
+	return n.write([]byte(fmt.Sprintf("SUB %s %s\r\n", subject, sid)))
+}
+
+// read handles messages from the server until the connection is closed
+func (n *NATS) read(r *bufio.Reader) {
+	err := n.readMessages(r)
+	n.mu.Lock()
+	if n.err == nil {
+		n.err = fmt.Errorf("%w: %w", ErrClosed, err)
+	}
+	n.mu.Unlock()
+	_ = n.conn.Close()
+	close(n.closed)
+}
+
+// readMessages delivers messages to their subscriptions and answers pings, returning when reading fails
+func (n *NATS) readMessages(r *bufio.Reader) error {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "PING":
+			if err = n.write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats error: %v", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <size>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || len(fields) > 5 {
+				return fmt.Errorf("malformed nats message %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return fmt.Errorf("malformed nats message %q", line)
+			}
+			payload := make([]byte, size+2) // The payload is followed by CRLF
+			if _, err = io.ReadFull(r, payload); err != nil {
+				return err
+			}
+
+			n.mu.Lock()
+			sub, ok := n.subs[fields[2]]
+			n.mu.Unlock()
+			if ok {
+				sub.deliver(sub.channel, string(payload[:size]))
+			}
+		}
+	}
+}
+
+// Close closes the connection to the server
+func (n *NATS) Close() error {
+	n.mu.Lock()
+	if n.err == nil {
+		n.err = ErrClosed
+	}
+	n.mu.Unlock()
+	err := n.conn.Close()
+	<-n.closed
+	return err
+}
+
+// readLine reads a protocol line without its CRLF
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,143 @@
+package bridge
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNATS accepts one connection and speaks enough of the NATS protocol to test the bridge. Lines sent by the client
+// after connecting are passed to lines, and the server can send protocol messages by writing to the returned conn.
+func fakeNATS(t *testing.T, refuse bool) (string, chan string, chan net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	lines := make(chan string, 16)
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_, _ = conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case strings.HasPrefix(line, "CONNECT "):
+				lines <- line
+			case line == "PING" && refuse:
+				_, _ = conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+			case line == "PING":
+				_, _ = conn.Write([]byte("PONG\r\n"))
+				conns <- conn
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := r.ReadString('\n')
+				lines <- line + " " + strings.TrimRight(payload, "\r\n")
+			default:
+				lines <- line
+			}
+		}
+	}()
+	return "nats://user:secret@" + l.Addr().String() + "?prefix=db.", lines, conns
+}
+
+// next returns the next line received by the fake server
+func next(t *testing.T, lines chan string) string {
+	t.Helper()
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the bridge")
+		return ""
+	}
+}
+
+func TestNATS(t *testing.T) {
+	url, lines, conns := fakeNATS(t, false)
+	n, err := DialNATS(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-conns
+	if connect := next(t, lines); !strings.Contains(connect, `"echo":false`) || !strings.Contains(connect, `"pass":"secret"`) {
+		t.Errorf("CONNECT = %v; want echo disabled and the credentials", connect)
+	}
+
+	// Forwarding publishes to the prefixed subject
+	if err = n.Forward("news", "hello world"); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(t, lines); got != "PUB db.news 11 hello world" {
+		t.Errorf("forwarded %q", got)
+	}
+	if err = n.Forward("bad channel", "hello"); err == nil {
+		t.Error("forwarding to a channel that is not a valid subject succeeded")
+	}
+
+	// Consuming subscribes to the subject and delivers messages to the channel
+	delivered := make(chan string, 1)
+	err = n.Consume("alerts", func(channel string, message string) int {
+		delivered <- channel + ": " + message
+		return 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := next(t, lines); got != "SUB db.alerts 1" {
+		t.Errorf("subscribed with %q", got)
+	}
+	_, _ = conn.Write([]byte("PING\r\nMSG db.alerts 1 4\r\nfire\r\nMSG db.other 9 reply 2\r\nno\r\n"))
+	if got := next(t, lines); got != "PONG" {
+		t.Errorf("answered a ping with %q", got)
+	}
+	select {
+	case got := <-delivered:
+		if got != "alerts: fire" {
+			t.Errorf("delivered %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	if err = n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.Forward("news", "late"); err == nil {
+		t.Error("forwarding after closing succeeded")
+	}
+	if len(delivered) != 0 {
+		t.Errorf("delivered a message for an unknown subscription: %v", <-delivered)
+	}
+}
+
+func TestDialNATS(t *testing.T) {
+	url, _, _ := fakeNATS(t, true)
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "Wrong scheme", url: "kafka://localhost:9092"},
+		{name: "Refused", url: url},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DialNATS(tt.url); err == nil {
+				t.Errorf("DialNATS(%v) succeeded", tt.url)
+			}
+		})
+	}
+}
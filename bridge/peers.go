@@ -0,0 +1,150 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pthav/InMemoryDB/handler"
+)
+
+// DefaultPeerQueueSize is how many messages may wait to be relayed to a peer before new ones are dropped
+const DefaultPeerQueueSize = 1024
+
+// DefaultPeerTimeout is how long relaying a single message to a peer may take
+const DefaultPeerTimeout = 5 * time.Second
+
+// Peers relays published messages to other instances of the server through their publish endpoints, so that
+// subscribers connected to any instance receive them. Every instance should be given every other instance as a peer.
+// Relayed messages carry the node ID of the instance they were published on, and peers deliver them to their own
+// subscribers without relaying them again, so a full mesh never loops. An instance that finds itself in its peer
+// list ignores the messages it relays to itself.
+//
+// Each peer has a queue that is sent from in the background, so a slow or unreachable peer never holds up publishing.
+// Messages are sent once: those that fail are logged and dropped, as are new messages while a peer's queue is full.
+type Peers struct {
+	nodeID string
+	client *http.Client
+	logger *slog.Logger
+	peers  []*peer
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// peer is an instance that messages are relayed to
+type peer struct {
+	url   string // The base url, without a trailing slash or credentials
+	token string // The password of the url, sent as a bearer token for peers with restricted channels
+	queue chan relayedMessage
+}
+
+type relayedMessage struct {
+	channel string
+	message string
+}
+
+// NewPeers starts relaying to the instances at the http:// or https:// base URLs. The node ID identifies this
+// instance in relayed messages. The password of a url such as http://:token@host:8080 is sent as a bearer token, for
+// peers whose channels are restricted by a channel ACL.
+func NewPeers(nodeID string, urls []string, logger *slog.Logger) (*Peers, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Peers{
+		nodeID: nodeID,
+		client: &http.Client{Timeout: DefaultPeerTimeout},
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			cancel()
+			return nil, fmt.Errorf("invalid peer %v: expected an http:// or https:// url", rawURL)
+		}
+		token, _ := u.User.Password()
+		u.User = nil
+		p.peers = append(p.peers, &peer{url: strings.TrimSuffix(u.String(), "/"), token: token, queue: make(chan relayedMessage, DefaultPeerQueueSize)})
+	}
+	for _, pr := range p.peers {
+		p.wg.Add(1)
+		go p.relay(pr)
+	}
+	return p, nil
+}
+
+// Forward queues a message to be relayed to every peer. It returns an error naming the peers whose queue was full.
+func (p *Peers) Forward(channel string, message string) error {
+	if p.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	var full []string
+	for _, pr := range p.peers {
+		select {
+		case pr.queue <- relayedMessage{channel: channel, message: message}:
+		default:
+			full = append(full, pr.url)
+		}
+	}
+	if len(full) > 0 {
+		return fmt.Errorf("dropped a message for peers that are too far behind: %v", strings.Join(full, ", "))
+	}
+	return nil
+}
+
+// Close stops relaying, dropping the messages that have not been sent
+func (p *Peers) Close() error {
+	p.cancel()
+	p.wg.Wait()
+	return nil
+}
+
+// relay sends the queued messages of a peer until the relay is closed
+func (p *Peers) relay(pr *peer) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case m := <-pr.queue:
+			if err := p.send(pr, m); err != nil && p.ctx.Err() == nil {
+				p.logger.Warn("error relaying a published message to a peer", "peer", pr.url, "channel", m.channel, "error", err)
+			}
+		}
+	}
+}
+
+// send publishes a message on a peer, marked as relayed from this instance
+func (p *Peers) send(pr *peer, m relayedMessage) error {
+	body, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{Message: m.message})
+	req, err := http.NewRequestWithContext(p.ctx, "POST", pr.url+"/v1/publish/"+url.PathEscape(m.channel), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(handler.RelayHeader, p.nodeID)
+	if pr.token != "" {
+		req.Header.Set("Authorization", "Bearer "+pr.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("peer responded with " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package bridge
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pthav/InMemoryDB/handler"
+)
+
+func TestPeers(t *testing.T) {
+	received := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Method + " " + r.URL.EscapedPath() + " " + r.Header.Get(handler.RelayHeader) + " " + string(body)
+	}))
+	defer ts.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	p, err := NewPeers("node-1", []string{failing.URL, ts.URL + "/"}, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing peer does not hold up the others
+	for _, channel := range []string{"news", "a b"} {
+		if err = p.Forward(channel, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []string{
+		`POST /v1/publish/news node-1 {"message":"hello"}`,
+		`POST /v1/publish/a%20b node-1 {"message":"hello"}`,
+	} {
+		select {
+		case got := <-received:
+			if got != expected {
+				t.Errorf("peer received %q; want %q", got, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message was not relayed")
+		}
+	}
+
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Forward("news", "late"); err == nil {
+		t.Error("forwarding after closing succeeded")
+	}
+}
+
+func TestPeers_token(t *testing.T) {
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, basic := r.BasicAuth()
+		received <- r.Header.Get("Authorization") + " " + strconv.FormatBool(basic)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	u.User = url.UserPassword("", "secret")
+	p, err := NewPeers("node-1", []string{u.String()}, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err = p.Forward("news", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The password is sent as a bearer token instead of basic auth
+	select {
+	case got := <-received:
+		if got != "Bearer secret false" {
+			t.Errorf("peer received authorization %q; want %q", got, "Bearer secret false")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not relayed")
+	}
+}
+
+func TestNewPeers(t *testing.T) {
+	for _, rawURL := range []string{"nats://localhost:4222", "localhost:8080", "http://"} {
+		if _, err := NewPeers("node-1", []string{rawURL}, slog.New(slog.DiscardHandler)); err == nil {
+			t.Errorf("NewPeers(%v) = nil error; want an error", rawURL)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package client is a Go client for the InMemoryDB HTTP API. It covers publishing to channels and subscriptions that
+// survive dropped connections and server restarts.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is an error response of the server
+type Error struct {
+	Status     int           // The HTTP status of the response
+	Code       string        // The machine-readable error code, e.g. TOO_MANY_SUBSCRIBERS. Empty if the body had none.
+	Message    string        // The message of the error
+	RetryAfter time.Duration // How long the server asked the client to wait before retrying, or zero
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("server responded with %d: %v", e.Status, e.Message)
+	}
+	return fmt.Sprintf("server responded with %d %v: %v", e.Status, e.Code, e.Message)
+}
+
+// Temporary reports whether the request may succeed if it is retried: server errors, timeouts and rate limits
+func (e *Error) Temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusRequestTimeout || e.Status == http.StatusTooManyRequests
+}
+
+// Client sends requests to an InMemoryDB server. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+type Options func(*Client)
+
+// WithToken sends the token as a bearer token with every request, e.g. for channels restricted by --channel-acl
+func WithToken(token string) Options {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHTTPClient sends requests with the client instead of http.DefaultClient. Its Timeout must be zero, since it
+// would also cut subscriptions off; requests are bounded by their context instead.
+func WithHTTPClient(hc *http.Client) Options {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// New returns a client for the server at the http:// or https:// base URL
+func New(baseURL string, opts ...Options) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid server url scheme %v", u.Scheme)
+	}
+
+	c := &Client{baseURL: strings.TrimSuffix(baseURL, "/"), http: http.DefaultClient}
+	for _, o := range opts {
+		o(c)
+	}
+	return c, nil
+}
+
+// Publish sends a message to every subscriber of the channel with POST /v1/publish/{channel}
+func (c *Client) Publish(ctx context.Context, channel string, message string) error {
+	body, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{Message: message})
+	req, err := c.newRequest(ctx, "POST", "/v1/publish/"+url.PathEscape(channel), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// newRequest creates a request for the path of the API, carrying the token if there is one
+func (c *Client) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// responseError reads the error envelope of a failed response
+func responseError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	var envelope struct {
+		Error *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Error != nil {
+		e.Code, e.Message = envelope.Error.Code, envelope.Error.Message
+	}
+	return e
+}
+
+// temporary reports whether a failed request may succeed if it is retried. Anything but an error response of the
+// server, such as a refused or dropped connection, is assumed to be.
+func temporary(err error) bool {
+	var e *Error
+	return !errors.As(err, &e) || e.Temporary()
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database/dbtest"
+	"github.com/pthav/InMemoryDB/handler"
+)
+
+// receive waits for the next message of a subscription
+func receive(t *testing.T, sub *Subscription) Message {
+	t.Helper()
+	select {
+	case m, ok := <-sub.C:
+		if !ok {
+			t.Fatalf("subscription ended: %v", sub.Err())
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return Message{}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	h := handler.NewHandler(dbtest.New(t), slog.New(slog.DiscardHandler), handler.WithHeartbeatInterval(20*time.Millisecond))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	c, err := New(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan struct{}, 10)
+	disconnected := make(chan error, 10)
+	sub := c.SubscribeChan(ctx, "news", 10,
+		WithHeartbeatTimeout(100*time.Millisecond),
+		WithBackoff(10*time.Millisecond, 50*time.Millisecond),
+		WithConnectHook(func() { connected <- struct{}{} }),
+		WithDisconnectHook(func(err error, retryIn time.Duration) { disconnected <- err }),
+	)
+
+	<-connected
+	if err := c.Publish(ctx, "news", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, sub); m.Channel != "news" || m.Data != "first" || m.Received.IsZero() {
+		t.Errorf("received %+v; want first on news", m)
+	}
+
+	// Heartbeats keep a quiet subscription alive past the heartbeat timeout
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-disconnected:
+		t.Fatalf("quiet subscription with heartbeats was lost: %v", err)
+	default:
+	}
+
+	// A dropped connection is resubscribed, and receives the messages published after it is back
+	ts.CloseClientConnections()
+	if err := <-disconnected; err == nil {
+		t.Error("disconnect hook called without a reason")
+	}
+	<-connected
+	if err := c.Publish(ctx, "news", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, sub); m.Data != "second" {
+		t.Errorf("received %v after resubscribing; want second", m.Data)
+	}
+
+	cancel()
+	if _, ok := <-sub.C; ok {
+		t.Error("subscription channel still open after its context is done")
+	}
+	if err := sub.Err(); err != nil {
+		t.Errorf("Err() = %v after the context is done; want nil", err)
+	}
+}
+
+func TestClient_SubscribeErrors(t *testing.T) {
+	h := handler.NewHandler(dbtest.New(t), slog.New(slog.DiscardHandler), handler.WithChannelACL("s3cret", "orders.*", handler.ChannelPublish))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	// Subscribing without a permission fails for good instead of being retried
+	c, _ := New(ts.URL, WithToken("s3cret"))
+	err := c.Subscribe(context.Background(), "orders.eu", func(Message) {})
+	var e *Error
+	if !errors.As(err, &e) || e.Status != http.StatusForbidden || e.Code != handler.CodeForbidden || e.Temporary() {
+		t.Errorf("Subscribe to a forbidden channel = %v; want a 403 %v", err, handler.CodeForbidden)
+	}
+	if err := c.Publish(context.Background(), "orders.eu", "order"); err != nil {
+		t.Errorf("Publish with the token = %v; want nil", err)
+	}
+
+	if _, err := New("nats://localhost:4222"); err == nil {
+		t.Error("New accepted a url that is not http")
+	}
+}
+
+func TestClient_SubscribeReconnects(t *testing.T) {
+	// The server goes quiet on the first connection, disconnects the second as a slow consumer, turns the third away
+	// for a second and lets the fourth subscribe
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case 2:
+			_, _ = fmt.Fprint(w, "data: dropped\n\nevent: disconnect\ndata: slow consumer\n\n")
+		case 3:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprint(w, `{"data":null,"error":{"code":"TOO_MANY_SUBSCRIBERS","message":"Too many subscribers"}}`)
+		default:
+			_, _ = fmt.Fprint(w, ": heartbeat\n\ndata: multi\ndata: line\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer ts.Close()
+	c, _ := New(ts.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var reasons []error
+	var waits []time.Duration
+	sub := c.SubscribeChan(ctx, "news", 10,
+		WithHeartbeatTimeout(50*time.Millisecond),
+		WithBackoff(time.Millisecond, time.Millisecond),
+		WithDisconnectHook(func(err error, retryIn time.Duration) {
+			reasons = append(reasons, err)
+			waits = append(waits, retryIn)
+		}),
+	)
+
+	if m := receive(t, sub); m.Data != "dropped" {
+		t.Errorf("received %v; want dropped", m.Data)
+	}
+	if m := receive(t, sub); m.Data != "multi\nline" {
+		t.Errorf("received %q; want the data lines joined", m.Data)
+	}
+	cancel()
+	_ = sub.Err()
+
+	var e *Error
+	if len(reasons) < 3 || !errors.Is(reasons[0], ErrHeartbeatTimeout) || !errors.Is(reasons[1], ErrSlowConsumer) || !errors.As(reasons[2], &e) {
+		t.Fatalf("disconnect reasons = %v; want a heartbeat timeout, a slow consumer and an error response", reasons)
+	}
+	if e.Code != "TOO_MANY_SUBSCRIBERS" || waits[2] != time.Second {
+		t.Errorf("turned away with %v and retried in %v; want TOO_MANY_SUBSCRIBERS and the Retry-After of 1s", e.Code, waits[2])
+	}
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHeartbeatTimeout is how long a subscription may receive nothing, not even a heartbeat, before its connection
+// is assumed dead and replaced. It is three of the server's default heartbeat intervals.
+const DefaultHeartbeatTimeout = 45 * time.Second
+
+// The waits before resubscribing after a subscription is lost. The wait doubles with every failed attempt in a row.
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+var (
+	// ErrHeartbeatTimeout is passed to the disconnect hook when a connection went quiet for the heartbeat timeout
+	ErrHeartbeatTimeout = errors.New("no heartbeat received from the server")
+	// ErrSlowConsumer is passed to the disconnect hook when the server disconnected the subscription because messages
+	// were not read fast enough, which means some were dropped
+	ErrSlowConsumer = errors.New("disconnected by the server as a slow consumer")
+)
+
+// Message is a message received by a subscription
+type Message struct {
+	Channel  string    // The channel the message was published to
+	Data     string    // The message as it was published
+	Received time.Time // When the message was read from the connection
+}
+
+// HandlerFunc handles the messages of a subscription. It is called for one message at a time.
+type HandlerFunc func(Message)
+
+// subscribeSettings are the settings of a single subscription
+type subscribeSettings struct {
+	group            string
+	heartbeatTimeout time.Duration
+	minBackoff       time.Duration
+	maxBackoff       time.Duration
+	onConnect        func()
+	onDisconnect     func(err error, retryIn time.Duration)
+}
+
+type SubscribeOptions func(*subscribeSettings)
+
+// WithGroup joins the consumer group of the channel, whose members share its messages instead of each receiving every
+// one of them
+func WithGroup(name string) SubscribeOptions {
+	return func(s *subscribeSettings) {
+		s.group = name
+	}
+}
+
+// WithHeartbeatTimeout replaces the connection of a subscription that has received nothing for d. It should be a few
+// times the heartbeat interval of the server. Zero waits on a quiet connection forever.
+func WithHeartbeatTimeout(d time.Duration) SubscribeOptions {
+	return func(s *subscribeSettings) {
+		s.heartbeatTimeout = d
+	}
+}
+
+// WithBackoff sets the wait before the first attempt to resubscribe after the subscription is lost, and the longest
+// that the wait grows to while attempts keep failing
+func WithBackoff(minimum time.Duration, maximum time.Duration) SubscribeOptions {
+	return func(s *subscribeSettings) {
+		s.minBackoff = minimum
+		s.maxBackoff = max(minimum, maximum)
+	}
+}
+
+// WithConnectHook calls f every time the subscription is established, including after it was lost. Messages published
+// while it was lost are not received, so f can be used to catch up on them by other means.
+func WithConnectHook(f func()) SubscribeOptions {
+	return func(s *subscribeSettings) {
+		s.onConnect = f
+	}
+}
+
+// WithDisconnectHook calls f with the reason every time the subscription is lost or fails to be established, along
+// with how long it waits before trying again
+func WithDisconnectHook(f func(err error, retryIn time.Duration)) SubscribeOptions {
+	return func(s *subscribeSettings) {
+		s.onDisconnect = f
+	}
+}
+
+// Subscribe subscribes to the channel with GET /v1/subscribe/{channel} and calls handle with every message until ctx
+// is done. A subscription that is lost, e.g. because the connection dropped, the server restarted or stopped sending
+// heartbeats, is established again after a backoff. It returns nil once ctx is done, or the error response of the
+// server if subscribing fails in a way that retrying cannot fix, such as a 403 for a restricted channel.
+//
+// Messages are read from the connection only while handle is not running, so a slow handler makes the server buffer
+// the messages, and drop them once its buffer is full, rather than this client.
+func (c *Client) Subscribe(ctx context.Context, channel string, handle HandlerFunc, opts ...SubscribeOptions) error {
+	s := subscribeSettings{heartbeatTimeout: DefaultHeartbeatTimeout, minBackoff: DefaultMinBackoff, maxBackoff: DefaultMaxBackoff}
+	for _, o := range opts {
+		o(&s)
+	}
+
+	backoff := s.minBackoff
+	for {
+		connected, err := c.stream(ctx, channel, &s, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !temporary(err) {
+			return err
+		}
+
+		if connected {
+			backoff = s.minBackoff
+		}
+		wait := backoff
+		var e *Error
+		if errors.As(err, &e) {
+			wait = max(wait, e.RetryAfter)
+		}
+		if s.onDisconnect != nil {
+			s.onDisconnect(err, wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, s.maxBackoff)
+	}
+}
+
+// Subscription is a subscription whose messages are received from a channel
+type Subscription struct {
+	C    <-chan Message // The messages of the subscription, closed once it ends
+	done chan struct{}
+	err  error
+}
+
+// Err waits for the subscription to end and returns the error that ended it, which is nil if its context is done
+func (s *Subscription) Err() error {
+	<-s.done
+	return s.err
+}
+
+// SubscribeChan subscribes to the channel like Subscribe, sending the messages to the channel of the returned
+// subscription, which holds up to buffer of them. Messages are not read from the connection while it is full.
+func (c *Client) SubscribeChan(ctx context.Context, channel string, buffer int, opts ...SubscribeOptions) *Subscription {
+	messages := make(chan Message, buffer)
+	sub := &Subscription{C: messages, done: make(chan struct{})}
+	go func() {
+		defer close(sub.done)
+		sub.err = c.Subscribe(ctx, channel, func(m Message) {
+			select {
+			case messages <- m:
+			case <-ctx.Done():
+			}
+		}, opts...)
+		close(messages)
+	}()
+	return sub
+}
+
+// stream runs a single connection of a subscription until it fails or ctx is done. It reports whether the
+// subscription was established, and the reason it ended.
+func (c *Client) stream(ctx context.Context, channel string, s *subscribeSettings, handle HandlerFunc) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	path := "/v1/subscribe/" + url.PathEscape(channel)
+	if s.group != "" {
+		path += "?group=" + url.QueryEscape(s.group)
+	}
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The connection is cancelled once the response or a read takes longer than the heartbeat timeout
+	var timedOut atomic.Bool
+	watchdog := time.AfterFunc(time.Hour, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	watchdog.Stop()
+	defer watchdog.Stop()
+	watch := func() {
+		if s.heartbeatTimeout > 0 {
+			watchdog.Reset(s.heartbeatTimeout)
+		}
+	}
+
+	watch()
+	resp, err := c.http.Do(req)
+	watchdog.Stop()
+	if err != nil {
+		if timedOut.Load() {
+			return false, ErrHeartbeatTimeout
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, responseError(resp)
+	}
+	if s.onConnect != nil {
+		s.onConnect()
+	}
+
+	// Events are made of field lines and end with an empty line. Lines starting with a colon are comments, which the
+	// server sends as heartbeats.
+	reader := bufio.NewReader(resp.Body)
+	var event string
+	var data []string
+	for {
+		watch()
+		line, err := reader.ReadString('\n')
+		watchdog.Stop()
+		switch {
+		case timedOut.Load():
+			return true, ErrHeartbeatTimeout
+		case errors.Is(err, io.EOF):
+			return true, io.ErrUnexpectedEOF
+		case err != nil:
+			return true, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "" && event == "disconnect":
+			return true, ErrSlowConsumer
+		case line == "":
+			if data != nil {
+				handle(Message{Channel: channel, Data: strings.Join(data, "\n"), Received: time.Now()})
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				data = append(data, value)
+			}
+		}
+	}
+}
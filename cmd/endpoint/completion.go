@@ -0,0 +1,53 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// completionTimeout bounds how long key completion waits for the server so that a shell is never left hanging
+const completionTimeout = 2 * time.Second
+
+// completionLimit is the number of keys offered as completions
+const completionLimit = 100
+
+// completeKeys completes a key flag with the keys on the configured server that start with what has been typed so
+// far. Completion does not run the command or its hooks, so the profile is applied here and the request is made directly
+// rather than through getResponse.
+func completeKeys(o *options) cobra.CompletionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]cobra.Completion, cobra.ShellCompDirective) {
+		if err := o.applyProfile(cmd); err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		if o.embedded {
+			stop, err := o.startEmbedded()
+			if err != nil {
+				return nil, cobra.ShellCompDirectiveError
+			}
+			defer stop()
+		}
+
+		req, err := http.NewRequest("GET", scanURL(o.rootURL, toComplete, "", completionLimit), nil)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		o.authorize(req)
+
+		client := *o.httpClient()
+		client.Timeout = completionTimeout
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		defer resp.Body.Close()
+
+		var response httpScanResponse
+		if err = json.NewDecoder(resp.Body).Decode(&response); err != nil || response.Data == nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		return response.Data.Keys, cobra.ShellCompDirectiveNoFileComp
+	}
+}
@@ -0,0 +1,46 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+// httpConfigData is kept generic so that the command does not need to change whenever a setting is added
+type httpConfigData = map[string]any
+
+type httpConfigResponse = httpResponse[httpConfigData]
+
+func newConfigCmd(o *options) *cobra.Command {
+	// configCmd groups the commands for a server's configuration
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration of a running server",
+		Long: `This command contains sub commands for inspecting the configuration of a running server. config get will
+print the settings the server was started with.`,
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+
+	// configGetCmd gets the settings the server was started with
+	var configGetCmd = &cobra.Command{
+		Use:   "get",
+		Short: "Get the settings the server was started with",
+		Long: `This command fetches the server and database settings of a running server. These are the same settings
+that serve prints on startup.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Send request
+			var response httpConfigResponse
+			url := fmt.Sprintf("%v/v1/admin/config", o.rootURL)
+			status, err := o.getResponse("GET", url, nil, &response)
+			if err != nil {
+				return err
+			}
+			response.Status = status
+
+			return outputResponse(cmd, response)
+		},
+	}
+
+	configCmd.AddCommand(configGetCmd)
+
+	return configCmd
+}
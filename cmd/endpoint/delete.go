@@ -1,22 +1,54 @@
 package endpoint
 
 import (
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
+	"net/url"
 )
 
+type httpDeletePrefixData struct {
+	Prefix  string `json:"prefix"`
+	Deleted int    `json:"deleted"`
+	DryRun  bool   `json:"dryRun"`
+}
+
+type httpDeletePrefixResponse = httpResponse[httpDeletePrefixData]
+
 func newDeleteCmd(o *options) *cobra.Command {
+	var count bool
+
 	// deleteCmd will delete a key value pair from the database
 	var deleteCmd = &cobra.Command{
 		Use:   "delete",
 		Short: "Delete a key and its associated value.",
 		Long: `The key must be provided in order to delete the key value pair. The returned response code is printed
-to the console. delete -k=hello -u='localhost:8080'' will send a delete request for the key 'hello' to a server on port 8080.`,
+to the console. delete -k=hello -u='localhost:8080'' will send a delete request for the key 'hello' to a server on port 8080.
+delete --prefix=session: deletes every key starting with 'session:' instead, and adding --count only counts them.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.prefix != "" {
+				// Send request
+				var response httpDeletePrefixResponse
+				u := fmt.Sprintf("%v/v1/keys?prefix=%v", o.rootURL, url.QueryEscape(o.prefix))
+				if count {
+					u += "&dryRun=true"
+				}
+				status, err := o.getResponse("DELETE", u, nil, &response)
+				if err != nil {
+					return err
+				}
+				response.Status = status
+
+				return outputResponse(cmd, response)
+			}
+			if count {
+				return errors.New("--count requires --prefix")
+			}
+
 			// Send request
-			var response statusPlusErrorResponse
+			var response httpKeyResponse
 			url := fmt.Sprintf("%v/v1/keys/%v", o.rootURL, o.key)
-			status, err := getResponse("DELETE", url, nil, &response)
+			status, err := o.getResponse("DELETE", url, nil, &response)
 			if err != nil {
 				return err
 			}
@@ -27,7 +59,11 @@ to the console. delete -k=hello -u='localhost:8080'' will send a delete request
 	}
 
 	deleteCmd.Flags().StringVarP(&o.key, "key", "k", "", "The key to delete in the database")
-	_ = deleteCmd.MarkFlagRequired("key")
+	deleteCmd.Flags().StringVar(&o.prefix, "prefix", "", "Delete every key with this prefix instead of a single key")
+	deleteCmd.Flags().BoolVar(&count, "count", false, "Only count the keys with the prefix instead of deleting them")
+	deleteCmd.MarkFlagsOneRequired("key", "prefix")
+	deleteCmd.MarkFlagsMutuallyExclusive("key", "prefix")
+	_ = deleteCmd.RegisterFlagCompletionFunc("key", completeKeys(o))
 
 	return deleteCmd
 }
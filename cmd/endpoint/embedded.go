@@ -0,0 +1,81 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/pthav/InMemoryDB/database"
+	"github.com/pthav/InMemoryDB/handler"
+	"github.com/spf13/cobra"
+)
+
+// startEmbedded starts an in-process database and handler on a random loopback port and points the options at it.
+// When a file is given the database is loaded from it, if it exists, and persisted back to it as an AOF when stopped
+// so that state carries over between commands. The returned function stops the server and the database.
+func (o *options) startEmbedded() (func(), error) {
+	logger := slog.New(slog.DiscardHandler)
+	config := []database.Options{database.WithLogger(logger)}
+	if o.embeddedFile != "" {
+		_, err := os.Stat(o.embeddedFile)
+		switch {
+		case err == nil:
+			config = append(config, database.WithInitialData(o.embeddedFile, false))
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("error reading embedded database file: %w", err)
+		}
+		config = append(config, database.WithAofPersistence(), database.WithAofPersistenceFile(o.embeddedFile))
+	}
+
+	db, err := database.NewInMemoryDatabase(config...)
+	if err != nil {
+		return nil, fmt.Errorf("error starting embedded database: %w", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		db.Shutdown()
+		return nil, fmt.Errorf("error starting embedded server: %w", err)
+	}
+	srv := &http.Server{Handler: handler.NewHandler(db, logger)}
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	o.rootURL = "http://" + l.Addr().String()
+	o.client = http.DefaultClient
+	o.token = ""
+	return func() {
+		_ = srv.Close()
+		db.Shutdown()
+	}, nil
+}
+
+// withEmbedded wraps the RunE of c and its subcommands so that an embedded server is running for the duration of the
+// command when --embedded is set
+func withEmbedded(c *cobra.Command, o *options) {
+	if run := c.RunE; run != nil {
+		c.RunE = func(cmd *cobra.Command, args []string) error {
+			if !o.embedded {
+				return run(cmd, args)
+			}
+
+			stop, err := o.startEmbedded()
+			if err != nil {
+				return err
+			}
+			defer stop()
+			if o.verbose {
+				_, _ = io.WriteString(o.stderr, "Embedded server listening on "+o.rootURL+"\n")
+			}
+			return run(cmd, args)
+		}
+	}
+	for _, sub := range c.Commands() {
+		withEmbedded(sub, o)
+	}
+}
@@ -2,16 +2,23 @@ package endpoint
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
 	"io"
+	"maps"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // outputResponse is a helper function for outputting JSON to a command's out file and returning an error if there is
-// one.
+// one. A 4xx or 5xx response is still output, and then returned as a CommandError so that the command fails.
 func outputResponse(cmd *cobra.Command, response any) error {
 	out, err := json.MarshalIndent(response, "", "\t")
 	if err != nil {
@@ -22,36 +29,65 @@ func outputResponse(cmd *cobra.Command, response any) error {
 	if err != nil {
 		return err
 	}
+	if r, ok := response.(interface{ failure() error }); ok {
+		return r.failure()
+	}
 	return nil
 }
 
+// errDryRun is returned instead of sending a request when --dry-run is set. The endpoint command treats it as success.
+var errDryRun = errors.New("dry run")
+
 // getResponse is a helper function for sending a request and returning the status and an error
-// if there is any.
-func getResponse(method string, url string, requestBody any, response any) (int, error) {
-	// Create request body
-	jsonBody, err := json.Marshal(requestBody)
-	if err != nil {
-		return 0, errors.New(fmt.Sprintf("error marshalling request body in getResponse(): %v", err))
+// if there is any. With --dry-run the request is printed instead of sent, and with --verbose the timing and response
+// headers are printed as well.
+func (o *options) getResponse(method string, url string, requestBody any, response any) (int, error) {
+	// Create request body. Requests without one, like GET and DELETE, are sent without a body.
+	var jsonBody []byte
+	if requestBody != nil {
+		var err error
+		jsonBody, err = json.Marshal(requestBody)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("error marshalling request body in getResponse(): %v", err))
+		}
 	}
 
 	// Create the request
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequest(method, url, bytes.NewReader(jsonBody))
 	if err != nil {
 		return 0, errors.New(fmt.Sprintf("error creating request in getResponse(): %v", err))
 	}
+	if requestBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	o.authorize(req)
+	if o.idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", o.idempotencyKey)
+	}
+
+	if o.dryRun {
+		o.printRequest(o.stdout, req, jsonBody)
+		return 0, errDryRun
+	}
+	if o.verbose {
+		o.printRequest(o.stderr, req, jsonBody)
+	}
 
 	// Send the request
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	start := time.Now()
+	resp, err := o.sendRead(req)
 	if err != nil {
-		return 0, errors.New(fmt.Sprintf("error sending request in getResponse(): %v", err))
+		return 0, connectionError(err, "error sending request in getResponse()")
 	}
 	defer resp.Body.Close()
 
 	// Read the response
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return 0, errors.New(fmt.Sprintf("error reading response body in getResponse(): %v", err))
+		return 0, connectionError(err, "error reading response body in getResponse()")
+	}
+	if o.verbose {
+		o.printResponse(resp, time.Since(start))
 	}
 
 	err = json.Unmarshal(data, response)
@@ -62,22 +98,181 @@ func getResponse(method string, url string, requestBody any, response any) (int,
 	return resp.StatusCode, nil
 }
 
-// Generic HTTP method response
+// ndjsonContentType is the content type of streamed responses
+const ndjsonContentType = "application/x-ndjson"
+
+// stream requests an NDJSON stream and copies it to out as it arrives, so that it is never held in memory as a whole.
+// An error response is returned as an error since nothing has been written to out yet.
+func (o *options) stream(ctx context.Context, url string, out io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error creating request in stream(): %v", err))
+	}
+	req.Header.Set("Accept", ndjsonContentType)
+	o.authorize(req)
+
+	if o.dryRun {
+		o.printRequest(o.stdout, req, nil)
+		return errDryRun
+	}
+	if o.verbose {
+		o.printRequest(o.stderr, req, nil)
+	}
+
+	start := time.Now()
+	resp, err := o.sendRead(req)
+	if err != nil {
+		return connectionError(err, "error sending request in stream()")
+	}
+	defer resp.Body.Close()
+	if o.verbose {
+		o.printResponse(resp, time.Since(start))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if _, err = io.Copy(out, resp.Body); err != nil {
+		return connectionError(err, "error reading stream in stream()")
+	}
+	return nil
+}
+
+// retryBackoff is the wait before the first retry of a request. It doubles with every further retry.
+var retryBackoff = 200 * time.Millisecond
+
+// send sends a request, retrying it after connection errors and 5xx responses until the retries run out. The
+// response to the last attempt is returned.
+func (o *options) send(req *http.Request) (*http.Response, error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := o.httpClient().Do(req)
+		if attempt == o.retries || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		if o.verbose {
+			fmt.Fprintf(o.stderr, "Retrying in %v\n\n", backoff)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
 
-type statusPlusErrorResponse struct {
-	Status int    `json:"status"` // This isn't output as JSON from the external API it is added after.
-	Error  string `json:"error"`
+// httpClient returns the client for the connection settings
+func (o *options) httpClient() *http.Client {
+	if o.client == nil {
+		return http.DefaultClient
+	}
+	return o.client
 }
 
+// authorize adds the bearer token to a request if one is configured
+func (o *options) authorize(req *http.Request) {
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+}
+
+// printRequest writes the method, URL, headers and body of a request, e.g. for --dry-run
+func (o *options) printRequest(w io.Writer, req *http.Request, body []byte) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v %v\n", req.Method, req.URL)
+	writeHeaders(&sb, req.Header)
+	if len(body) > 0 {
+		fmt.Fprintf(&sb, "\n%s\n", body)
+	}
+	_, _ = io.WriteString(w, sb.String())
+}
+
+// printResponse writes the status, headers and timing of a response for --verbose
+func (o *options) printResponse(resp *http.Response, elapsed time.Duration) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v %v\n", resp.Proto, resp.Status)
+	writeHeaders(&sb, resp.Header)
+	fmt.Fprintf(&sb, "Took %v\n\n", elapsed)
+	_, _ = io.WriteString(o.stderr, sb.String())
+}
+
+// writeHeaders writes headers one per line, sorted by name so that the output is stable. Credentials are redacted so
+// that the output can be shared.
+func writeHeaders(sb *strings.Builder, h http.Header) {
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		for _, v := range h[name] {
+			if name == "Authorization" {
+				v = "<redacted>"
+			}
+			fmt.Fprintf(sb, "%v: %v\n", name, v)
+		}
+	}
+}
+
+// httpResponse mirrors the API's response envelope. Status isn't output as JSON from the external API, it is added
+// after.
+type httpResponse[T any] struct {
+	Status int        `json:"status"`
+	Data   *T         `json:"data"`
+	Error  *httpError `json:"error"`
+}
+
+// httpError is the error object of the API's response envelope
+type httpError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// httpKeyData is the data returned by endpoints that only report the affected key
+type httpKeyData struct {
+	Key string `json:"key"`
+}
+
+type httpKeyResponse = httpResponse[httpKeyData]
+
 // options defines configuration flags for endpoint and its subcommands.
 type options struct {
-	rootURL string
-	key     string
-	value   string
-	ttl     int
-	channel string
-	timeout int
-	message string
+	rootURL        string
+	profile        string       // The profile to take connection settings from
+	configFile     string       // The profiles file. Empty uses ~/.inmemorydb/config.yaml.
+	token          string       // Sent as a bearer token with every request
+	tls            tlsSettings  // Settings for the TLS client
+	client         *http.Client // The client for the connection settings, set before a command runs
+	embedded       bool         // Send requests to an in-process server instead of rootURL
+	embeddedFile   string       // The file the embedded database is loaded from and persisted to
+	retries        int          // How many times a request is retried after a connection error or a 5xx response
+	idempotencyKey string       // Sent as the Idempotency-Key header so that retried posts are not applied twice
+	dryRun         bool         // Print requests instead of sending them
+	verbose        bool         // Print requests, response headers and timing to stderr
+	output         string       // How errors are reported, text or json
+	stdout         io.Writer    // Where dry runs are printed
+	stderr         io.Writer    // Where verbose output is printed
+	key            string
+	keys           []string
+	prefix         string
+	value          string
+	valueFile      string // A file to read the value from instead of value
+	valueStdin     bool   // Whether to read the value from stdin instead of value
+	ttl            int
+	expiresAt      string
+	channel        string
+	group          string // The consumer group to subscribe with
+	timeout        int
+	message        string
+
+	reads readPreference // Where reads are sent
 }
 
 func NewEndpointsCmd() *cobra.Command {
@@ -93,17 +288,115 @@ listening on port 8080`,
 	o := options{}
 
 	endpointsCmd.PersistentFlags().StringVarP(&o.rootURL, "rootURL", "u", "http://localhost:8080", "The rootURL to use.")
+	endpointsCmd.PersistentFlags().BoolVar(&o.dryRun, "dry-run", false, "Print the request that would be sent without sending it.")
+	endpointsCmd.PersistentFlags().BoolVar(&o.verbose, "verbose", false, "Print the request, response headers and timing to stderr.")
+	endpointsCmd.PersistentFlags().StringVar(&o.profile, "profile", "", "The profile to take the rootURL, token and TLS settings from.")
+	endpointsCmd.PersistentFlags().StringVar(&o.configFile, "config", "", "The profiles file. Defaults to ~/.inmemorydb/config.yaml.")
+	endpointsCmd.PersistentFlags().StringVar(&o.token, "token", "", "A bearer token to send with every request.")
+	endpointsCmd.PersistentFlags().StringVar(&o.tls.caFile, "tls-ca", "", "A PEM file of CAs to trust instead of the system pool.")
+	endpointsCmd.PersistentFlags().StringVar(&o.tls.certFile, "tls-cert", "", "A PEM client certificate for mutual TLS.")
+	endpointsCmd.PersistentFlags().StringVar(&o.tls.keyFile, "tls-key", "", "The PEM key for --tls-cert.")
+	endpointsCmd.PersistentFlags().BoolVar(&o.tls.insecureSkipVerify, "tls-insecure", false, "Skip verification of the server certificate.")
+	endpointsCmd.PersistentFlags().BoolVar(&o.embedded, "embedded", false, "Send requests to an in-process database instead of a server.")
+	endpointsCmd.PersistentFlags().StringVar(&o.embeddedFile, "embedded-file", "", "A file to load the embedded database from and persist it to.")
+	endpointsCmd.PersistentFlags().StringVar(&o.output, "output", outputText, "How errors are reported: text, or json to write them to stderr as JSON.")
+	endpointsCmd.PersistentFlags().StringVar(&o.reads.readFrom, "read-from", readFromPrimary, "Where reads are sent: primary for the rootURL, replica for a --replica-url, or nearest for whichever of them answers fastest. Failed reads fall back to the rootURL.")
+	endpointsCmd.PersistentFlags().StringSliceVar(&o.reads.replicaURLs, "replica-url", nil, "The url of a replica to read from, such as a server the rootURL mirrors its writes to. May be repeated or comma separated.")
+	endpointsCmd.MarkFlagsMutuallyExclusive("embedded", "rootURL")
+	endpointsCmd.MarkFlagsMutuallyExclusive("embedded", "replica-url")
+	endpointsCmd.MarkFlagsMutuallyExclusive("embedded", "profile")
+	endpointsCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		o.stdout = cmd.OutOrStdout()
+		o.stderr = cmd.ErrOrStderr()
+		if o.output != outputText && o.output != outputJSON {
+			return fmt.Errorf("--output must be text or json, got %q", o.output)
+		}
+		if o.embeddedFile != "" && !o.embedded {
+			return errors.New("--embedded-file requires --embedded")
+		}
+		switch o.reads.readFrom {
+		case readFromPrimary:
+		case readFromReplica, readFromNearest:
+			if len(o.reads.replicaURLs) == 0 {
+				return fmt.Errorf("--read-from=%v requires --replica-url", o.reads.readFrom)
+			}
+		default:
+			return fmt.Errorf("--read-from must be primary, replica or nearest, got %q", o.reads.readFrom)
+		}
+		return o.applyProfile(cmd)
+	}
 
 	endpointsCmd.AddCommand(newGetTTLCmd(&o))
+	endpointsCmd.AddCommand(newGetTTLsCmd(&o))
 	endpointsCmd.AddCommand(newPublishCmd(&o))
 	endpointsCmd.AddCommand(newSubscribeCmd(&o))
 	endpointsCmd.AddCommand(newGetCmd(&o))
 	endpointsCmd.AddCommand(newDeleteCmd(&o))
 	endpointsCmd.AddCommand(newPutCmd(&o))
 	endpointsCmd.AddCommand(newPostCmd(&o))
+	endpointsCmd.AddCommand(newExpirePrefixCmd(&o))
+	endpointsCmd.AddCommand(newInfoCmd(&o))
+	endpointsCmd.AddCommand(newTTLHistogramCmd(&o))
+	endpointsCmd.AddCommand(newConfigCmd(&o))
+	endpointsCmd.AddCommand(newTUICmd(&o))
+	endpointsCmd.AddCommand(newScanCmd(&o))
+	endpointsCmd.AddCommand(newExportCmd(&o))
+
+	// A dry run stops a command before its request is sent, which is not a failure
+	for _, c := range endpointsCmd.Commands() {
+		skipDryRun(c)
+		withEmbedded(c, &o)
+		withErrorOutput(c, &o)
+	}
 
 	return endpointsCmd
 }
 
+// addValueFlags adds the flags for a put or post value, which may be given inline, read from a file or read from stdin
+func addValueFlags(c *cobra.Command, o *options, usage string) {
+	c.Flags().StringVarP(&o.value, "value", "v", "", usage)
+	c.Flags().StringVar(&o.valueFile, "value-file", "", "A file to read the value from, sent exactly as read")
+	c.Flags().BoolVar(&o.valueStdin, "stdin", false, "Read the value from stdin, sent exactly as read")
+	c.MarkFlagsOneRequired("value", "value-file", "stdin")
+	c.MarkFlagsMutuallyExclusive("value", "value-file", "stdin")
+}
+
+// readValue returns the value given by the value flags. Values read from a file or stdin are not trimmed so that
+// they are stored exactly. Values are sent as JSON strings, so they must be valid UTF-8.
+func (o *options) readValue(cmd *cobra.Command) (string, error) {
+	var data []byte
+	var err error
+	switch {
+	case o.valueFile != "":
+		data, err = os.ReadFile(o.valueFile)
+	case o.valueStdin:
+		data, err = io.ReadAll(cmd.InOrStdin())
+	default:
+		return o.value, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading value: %w", err)
+	}
+	if !utf8.Valid(data) {
+		return "", errors.New("the value is not valid UTF-8")
+	}
+	return string(data), nil
+}
+
+// skipDryRun wraps the RunE of c and its subcommands so that errDryRun is not reported as an error
+func skipDryRun(c *cobra.Command) {
+	if run := c.RunE; run != nil {
+		c.RunE = func(cmd *cobra.Command, args []string) error {
+			if err := run(cmd, args); !errors.Is(err, errDryRun) {
+				return err
+			}
+			return nil
+		}
+	}
+	for _, sub := range c.Commands() {
+		skipDryRun(sub)
+	}
+}
+
 func init() {
 }
@@ -8,10 +8,15 @@ import (
 	"github.com/spf13/cobra"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testCase struct {
@@ -20,6 +25,7 @@ type testCase struct {
 	key              string   // Key for the request
 	value            string   // Value for the request
 	ttl              *int64   // TTL value for the request
+	expiresAt        string   // Absolute expiration for the request
 	returnStatus     int      // What the handler should set the status to
 	response         any      // The response the handler should return
 	writeBadJSON     bool     // Whether the server should write bad JSON
@@ -73,6 +79,9 @@ func handlerHelper(url string, returnStatus int, response any, badJSON bool, t *
 		case "post":
 			var data httpPostRequest
 			_ = json.NewDecoder(r.Body).Decode(&data)
+			if (tt.expiresAt == "") != (data.ExpiresAt == nil) || (data.ExpiresAt != nil && *data.ExpiresAt != tt.expiresAt) {
+				t.Errorf("expected expiresAt to be %v, got %v", tt.expiresAt, data.ExpiresAt)
+			}
 			if tt.ttl == nil && data.Ttl != nil {
 				t.Errorf("expected ttl to be %v, got %v", tt.ttl, data.Ttl)
 			} else if tt.ttl != nil && *data.Ttl != *tt.ttl {
@@ -82,6 +91,10 @@ func handlerHelper(url string, returnStatus int, response any, badJSON bool, t *
 			if data.Value != tt.value {
 				t.Errorf("expected value to be %v, got %v", tt.value, data.Value)
 			}
+
+			if data.Key != tt.key {
+				t.Errorf("expected key to be %v, got %v", tt.key, data.Key)
+			}
 		case "get":
 			k := mux.Vars(r)["key"]
 			if k != tt.key {
@@ -104,6 +117,22 @@ func handlerHelper(url string, returnStatus int, response any, badJSON bool, t *
 			if data.Value != tt.value {
 				t.Errorf("expected value to be %v, got %v", tt.value, data.Value)
 			}
+		case "expirePrefix":
+			var data httpExpirePrefixRequest
+			_ = json.NewDecoder(r.Body).Decode(&data)
+			if data.Prefix != tt.key || tt.ttl == nil || data.Ttl != *tt.ttl {
+				t.Errorf("expected prefix %v and ttl %v, got %v and %v", tt.key, tt.ttl, data.Prefix, data.Ttl)
+			}
+		case "getTTLs":
+			var data httpGetTTLsRequest
+			_ = json.NewDecoder(r.Body).Decode(&data)
+			if !reflect.DeepEqual(data.Keys, strings.Split(tt.key, ",")) {
+				t.Errorf("expected keys to be %v, got %v", tt.key, data.Keys)
+			}
+		case "scan":
+			if prefix := r.URL.Query().Get("prefix"); prefix != tt.key {
+				t.Errorf("expected prefix to be %v, got %v", tt.key, prefix)
+			}
 		case "getTTL":
 			k := mux.Vars(r)["key"]
 			if k != tt.key {
@@ -156,42 +185,15 @@ func testHelper(t *testing.T, tt testCase, url string, args []string) {
 	}
 
 	if !tt.shouldError {
-		// Type switch to make result the correct type
-		var result any
-		switch tt.response.(type) {
-		case httpGetResponse:
-			result = new(httpGetResponse)
-		case httpPostResponse:
-			result = new(httpPostResponse)
-		case httpGetTTLResponse:
-			result = new(httpGetTTLResponse)
-		case statusPlusErrorResponse:
-			result = new(statusPlusErrorResponse)
-		}
-
-		err = json.Unmarshal([]byte(out), &result)
+		// Decode the output into a new value of the expected response's type
+		result := reflect.New(reflect.TypeOf(tt.response))
+		err = json.Unmarshal([]byte(out), result.Interface())
 		if err != nil {
 			t.Error(err)
 		}
 
-		// Type switch to make the correct comparison with the reflect package
-		switch expected := tt.response.(type) {
-		case httpGetResponse:
-			if !reflect.DeepEqual(result, &expected) {
-				t.Errorf("got %v\nwant %v", result, &expected)
-			}
-		case httpPostResponse:
-			if !reflect.DeepEqual(result, &expected) {
-				t.Errorf("got %v\nwant %v", result, &expected)
-			}
-		case httpGetTTLResponse:
-			if !reflect.DeepEqual(result, &expected) {
-				t.Errorf("got %v\nwant %v", result, &expected)
-			}
-		case statusPlusErrorResponse:
-			if !reflect.DeepEqual(result, &expected) {
-				t.Errorf("got %v\nwant %v", result, &expected)
-			}
+		if !reflect.DeepEqual(result.Elem().Interface(), tt.response) {
+			t.Errorf("got %v\nwant %v", result.Elem().Interface(), tt.response)
 		}
 	}
 }
@@ -200,6 +202,10 @@ func intToPtr(i int64) *int64 {
 	return &i
 }
 
+func strPtr(s string) *string {
+	return &s
+}
+
 func TestCommand_get(t *testing.T) {
 	tests := []testCase{
 		{
@@ -207,11 +213,29 @@ func TestCommand_get(t *testing.T) {
 			commandName:  "get",
 			key:          "hello",
 			returnStatus: 200,
-			response:     httpGetResponse{Status: 200, Key: "hello", Value: "world", Error: "null"},
+			response:     httpGetResponse{Status: 200, Data: &httpGetData{Key: "hello", Value: "world"}},
 			writeBadJSON: false,
 			badURL:       false,
 			shouldError:  false,
 		},
+		{
+			name:          "Test forwards error response",
+			commandName:   "get",
+			key:           "hello",
+			returnStatus:  404,
+			response:      httpGetResponse{Status: 404, Error: &httpError{Code: "KEY_NOT_FOUND", Message: "Key not found"}},
+			shouldError:   true,
+			expectedError: "404 Not Found: Key not found",
+		},
+		{
+			name:             "Test forwards a projected response",
+			commandName:      "get",
+			key:              "hello",
+			alternateArgs:    []string{"get", "-k", "hello", "--path", "$.user.name"},
+			useAlternateArgs: true,
+			returnStatus:     200,
+			response:         httpGetResponse{Status: 200, Data: &httpGetData{Key: "hello", Value: `"Ada"`}},
+		},
 		{
 			name:             "Missing the key flag",
 			commandName:      "get",
@@ -244,7 +268,7 @@ func TestCommand_delete(t *testing.T) {
 			commandName:  "delete",
 			key:          "hello",
 			returnStatus: 200,
-			response:     statusPlusErrorResponse{Status: 200, Error: "null"},
+			response:     httpKeyResponse{Status: 200, Data: &httpKeyData{Key: "hello"}},
 			writeBadJSON: false,
 			badURL:       false,
 			shouldError:  false,
@@ -273,6 +297,54 @@ func TestCommand_delete(t *testing.T) {
 	}
 }
 
+func TestCommand_deletePrefix(t *testing.T) {
+	tests := []testCase{
+		{
+			name:         "Test forwards response",
+			commandName:  "delete",
+			returnStatus: 200,
+			response:     httpDeletePrefixResponse{Status: 200, Data: &httpDeletePrefixData{Prefix: "session:", Deleted: 3}},
+		},
+		{
+			name:             "Test counts in a dry run",
+			commandName:      "delete",
+			returnStatus:     200,
+			response:         httpDeletePrefixResponse{Status: 200, Data: &httpDeletePrefixData{Prefix: "session:", Deleted: 3, DryRun: true}},
+			alternateArgs:    []string{"delete", "--prefix", "session:", "--count"},
+			useAlternateArgs: true,
+		},
+		{
+			name:             "Test the key and prefix are exclusive",
+			commandName:      "delete",
+			alternateArgs:    []string{"delete", "--prefix", "session:", "-k", "hello"},
+			useAlternateArgs: true,
+			shouldError:      true,
+			expectedError:    "none of the others can be",
+		},
+		{
+			name:             "Test counting requires a prefix",
+			commandName:      "delete",
+			alternateArgs:    []string{"delete", "-k", "hello", "--count"},
+			useAlternateArgs: true,
+			shouldError:      true,
+			expectedError:    "--count requires --prefix",
+		},
+		badURLTest,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := "/v1/keys"
+			args := []string{"delete", "--prefix", "session:"}
+			if tt.useAlternateArgs {
+				testHelper(t, tt, url, tt.alternateArgs)
+			} else {
+				testHelper(t, tt, url, args)
+			}
+		})
+	}
+}
+
 func TestCommand_put(t *testing.T) {
 	tests := []testCase{
 		{
@@ -281,7 +353,7 @@ func TestCommand_put(t *testing.T) {
 			key:          "hello",
 			value:        "world",
 			returnStatus: 200,
-			response:     statusPlusErrorResponse{Status: 200, Error: "null"},
+			response:     httpPutResponse{Status: 200, Data: &httpPutData{Key: "hello", Version: 2}},
 			writeBadJSON: false,
 			badURL:       false,
 			shouldError:  false,
@@ -292,8 +364,10 @@ func TestCommand_put(t *testing.T) {
 			key:          "hello",
 			value:        "world",
 			ttl:          intToPtr(10),
-			returnStatus: 200,
-			response:     statusPlusErrorResponse{Status: 200, Error: "null"},
+			returnStatus: 201,
+			response: httpPutResponse{Status: 201, Data: &httpPutData{
+				Key: "hello", Created: true, TTL: intToPtr(10), ExpiresAt: strPtr("2026-01-02T15:04:05Z"), Version: 3,
+			}},
 			writeBadJSON: false,
 			badURL:       false,
 			shouldError:  false,
@@ -333,6 +407,9 @@ func TestCommand_put(t *testing.T) {
 	}
 }
 
+// worldHash is the hex encoded SHA-256 of "world"
+const worldHash = "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7"
+
 func TestCommand_post(t *testing.T) {
 	tests := []testCase{
 		{
@@ -340,7 +417,7 @@ func TestCommand_post(t *testing.T) {
 			commandName:  "post",
 			returnStatus: 200,
 			value:        "world",
-			response:     httpPostResponse{Status: 200, Key: "postKey", Error: "null"},
+			response:     httpKeyResponse{Status: 200, Data: &httpKeyData{Key: "postKey"}},
 			writeBadJSON: false,
 			badURL:       false,
 			shouldError:  false,
@@ -351,11 +428,50 @@ func TestCommand_post(t *testing.T) {
 			returnStatus: 200,
 			value:        "world",
 			ttl:          intToPtr(10),
-			response:     httpPostResponse{Status: 200, Key: "postKey", Error: "null"},
+			response: httpPostResponse{Status: 200, Data: &httpPostData{
+				Key: "postKey", ExpiresAt: strPtr("2030-01-01T00:00:10Z"), ValueHash: worldHash,
+			}},
 			writeBadJSON: false,
 			badURL:       false,
 			shouldError:  false,
 		},
+		{
+			name:             "Test forwards expiresAt",
+			commandName:      "post",
+			returnStatus:     200,
+			value:            "world",
+			expiresAt:        "2030-01-01T00:00:00Z",
+			response:         httpPostResponse{Status: 200, Data: &httpPostData{Key: "postKey", ExpiresAt: strPtr("2030-01-01T00:00:00Z"), ValueHash: worldHash}},
+			alternateArgs:    []string{"post", "-v", "world", "--expires-at", "2030-01-01T00:00:00Z"},
+			useAlternateArgs: true,
+		},
+		{
+			name:             "Test forwards a client-supplied key",
+			commandName:      "post",
+			returnStatus:     201,
+			key:              "clientKey",
+			value:            "world",
+			response:         httpKeyResponse{Status: 201, Data: &httpKeyData{Key: "clientKey"}},
+			alternateArgs:    []string{"post", "-v", "world", "-k", "clientKey"},
+			useAlternateArgs: true,
+		},
+		{
+			name:          "The server stored a different value",
+			commandName:   "post",
+			returnStatus:  201,
+			value:         "world",
+			response:      httpPostResponse{Status: 201, Data: &httpPostData{Key: "postKey", ValueHash: "0000"}},
+			shouldError:   true,
+			expectedError: "the server stored a value with hash 0000",
+		},
+		{
+			name:             "Both ttl and expiresAt",
+			commandName:      "post",
+			alternateArgs:    []string{"post", "-v", "world", "--ttl", "10", "--expires-at", "2030-01-01T00:00:00Z"},
+			useAlternateArgs: true,
+			shouldError:      true,
+			expectedError:    "none of the others can be",
+		},
 		{
 			name:             "Missing the value flag",
 			commandName:      "post",
@@ -394,7 +510,7 @@ func TestCommand_getTTL(t *testing.T) {
 			commandName:  "getTTL",
 			returnStatus: 200,
 			key:          "hello",
-			response:     httpGetTTLResponse{Status: 200, Key: "hello", TTL: intPtr(100), Error: "null"},
+			response:     httpGetTTLResponse{Status: 200, Data: &httpGetTTLData{Key: "hello", TTL: intPtr(100)}},
 			writeBadJSON: false,
 			badURL:       false,
 			shouldError:  false,
@@ -423,3 +539,782 @@ func TestCommand_getTTL(t *testing.T) {
 		})
 	}
 }
+
+func TestCommand_getTTLs(t *testing.T) {
+	tests := []testCase{
+		{
+			name:         "Test forwards response",
+			commandName:  "getTTLs",
+			key:          "hello,world",
+			returnStatus: 200,
+			response: httpGetTTLsResponse{Status: 200, Data: &httpGetTTLsData{Results: []httpGetTTLsResult{
+				{Key: "hello", Exists: true, TTL: intToPtr(100)},
+				{Key: "world", Exists: false},
+			}}},
+		},
+		{
+			name:             "Missing the keys flag",
+			commandName:      "getTTLs",
+			alternateArgs:    []string{"getTTLs"},
+			useAlternateArgs: true,
+			shouldError:      true,
+			expectedError:    "required",
+		},
+		badJSONTest,
+		badURLTest,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := "/v1/ttl/batch"
+			args := []string{"getTTLs", "-k", tt.key}
+			if tt.useAlternateArgs {
+				testHelper(t, tt, url, tt.alternateArgs)
+			} else {
+				testHelper(t, tt, url, args)
+			}
+		})
+	}
+}
+
+func TestCommand_expirePrefix(t *testing.T) {
+	tests := []testCase{
+		{
+			name:         "Test forwards response",
+			commandName:  "expirePrefix",
+			key:          "v1:",
+			ttl:          intToPtr(60),
+			returnStatus: 200,
+			response:     httpExpirePrefixResponse{Status: 200, Data: &httpExpirePrefixData{Prefix: "v1:", Expired: 2}},
+		},
+		{
+			name:             "Missing the ttl flag",
+			commandName:      "expirePrefix",
+			alternateArgs:    []string{"expirePrefix", "--prefix", "v1:"},
+			useAlternateArgs: true,
+			shouldError:      true,
+			expectedError:    "required",
+		},
+		badURLTest,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := "/v1/admin/expire-prefix"
+			args := []string{"expirePrefix", "--prefix", tt.key, "--ttl", "60"}
+			if tt.useAlternateArgs {
+				testHelper(t, tt, url, tt.alternateArgs)
+			} else {
+				testHelper(t, tt, url, args)
+			}
+		})
+	}
+}
+
+func TestCommand_info(t *testing.T) {
+	tests := []testCase{
+		{
+			name:         "Test forwards response",
+			commandName:  "info",
+			returnStatus: 200,
+			response:     httpInfoResponse{Status: 200, Data: &httpInfoData{Keys: 2, Seq: 42, NodeID: "node-1"}},
+		},
+		badJSONTest,
+		badURLTest,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHelper(t, tt, "/v1/admin/info", []string{"info"})
+		})
+	}
+}
+
+func TestCommand_ttlHistogram(t *testing.T) {
+	tests := []testCase{
+		{
+			name:         "Test forwards response",
+			commandName:  "ttl-histogram",
+			returnStatus: 200,
+			response: httpTTLHistogramResponse{Status: 200, Data: &httpTTLHistogramData{
+				Buckets: []httpTTLBucket{
+					{Within: "minute", Seconds: 60, Keys: 1, Bytes: 10},
+					{Within: "hour", Seconds: 3600, Keys: 3, Bytes: 25},
+					{Within: "day", Seconds: 86400, Keys: 4, Bytes: 40},
+				},
+				Keys:  5,
+				Bytes: 52,
+			}},
+		},
+		badJSONTest,
+		badURLTest,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHelper(t, tt, "/v1/admin/ttl-histogram", []string{"ttl-histogram"})
+		})
+	}
+}
+
+func TestCommand_configGet(t *testing.T) {
+	tests := []testCase{
+		{
+			name:         "Test forwards response",
+			commandName:  "config",
+			returnStatus: 200,
+			response: httpConfigResponse{Status: 200, Data: &httpConfigData{
+				"host":            "127.0.0.1:8080",
+				"idScheme":        "uuid",
+				"concurrencyMode": "rwmutex",
+				"maxKeyLength":    float64(256),
+			}},
+		},
+		badJSONTest,
+		badURLTest,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHelper(t, tt, "/v1/admin/config", []string{"config", "get"})
+		})
+	}
+}
+
+func TestCommand_dryRun(t *testing.T) {
+	// Nothing listens on this URL, so any request that is actually sent fails the command
+	rootURL := "http://127.0.0.1:1"
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{
+			name:     "Get",
+			args:     []string{"get", "-k", "hello"},
+			expected: "GET http://127.0.0.1:1/v1/keys/hello",
+		},
+		{
+			name:     "Put",
+			args:     []string{"put", "-k", "hello", "-v", "world", "--ttl", "10"},
+			expected: "PUT http://127.0.0.1:1/v1/keys/hello\nContent-Type: application/json\n\n{\"value\":\"world\",\"ttl\":10}",
+		},
+		{
+			name:     "Delete",
+			args:     []string{"delete", "-k", "hello"},
+			expected: "DELETE http://127.0.0.1:1/v1/keys/hello",
+		},
+		{
+			name:     "Subscribe",
+			args:     []string{"subscribe", "-c", "news"},
+			expected: "GET http://127.0.0.1:1/v1/subscribe/news",
+		},
+		{
+			name:     "Config get",
+			args:     []string{"config", "get"},
+			expected: "GET http://127.0.0.1:1/v1/admin/config",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := execute(t, NewEndpointsCmd(), append(tt.args, "--dry-run", "-u", rootURL)...)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if out != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, out)
+			}
+		})
+	}
+}
+
+func TestCommand_verbose(t *testing.T) {
+	tt := testCase{
+		commandName:  "get",
+		key:          "hello",
+		returnStatus: 200,
+		response:     httpGetResponse{Status: 200, Data: &httpGetData{Key: "hello", Value: "world"}},
+	}
+	ts := httptest.NewServer(handlerHelper("/v1/keys/{key}", tt.returnStatus, tt.response, false, t, tt))
+	defer ts.Close()
+
+	// Verbose output goes to stderr so that stdout stays valid JSON
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	c := NewEndpointsCmd()
+	c.SetOut(stdout)
+	c.SetErr(stderr)
+	c.SetArgs([]string{"get", "-k", "hello", "--verbose", "-u", ts.URL})
+	if err := c.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	var result httpGetResponse
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		t.Errorf("expected stdout to be JSON, got %v: %v", stdout.String(), err)
+	}
+	for _, s := range []string{"GET " + ts.URL + "/v1/keys/hello", "HTTP/1.1 200 OK", "Content-Length: ", "Took "} {
+		if !strings.Contains(stderr.String(), s) {
+			t.Errorf("expected stderr to contain %q, got:\n%v", s, stderr.String())
+		}
+	}
+}
+
+func TestCommand_valueSources(t *testing.T) {
+	dir := t.TempDir()
+	valueFile := filepath.Join(dir, "value")
+	value := "line one\nline \"two\" with 'quotes'\n"
+	if err := os.WriteFile(valueFile, []byte(value), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalidFile := filepath.Join(dir, "invalid")
+	if err := os.WriteFile(invalidFile, []byte{0xff, 0xfe}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		stdin         string
+		expected      string // The value the server should receive
+		expectedError string
+	}{
+		{
+			name:     "Put a value from a file",
+			args:     []string{"put", "-k", "hello", "--value-file", valueFile},
+			expected: value,
+		},
+		{
+			name:     "Put a value from stdin",
+			args:     []string{"put", "-k", "hello", "--stdin"},
+			stdin:    value,
+			expected: value,
+		},
+		{
+			name:     "Post a value from a file",
+			args:     []string{"post", "--value-file", valueFile},
+			expected: value,
+		},
+		{
+			name:     "Post a value from stdin",
+			args:     []string{"post", "--stdin"},
+			stdin:    value,
+			expected: value,
+		},
+		{
+			name:          "A missing file",
+			args:          []string{"put", "-k", "hello", "--value-file", filepath.Join(dir, "missing")},
+			expectedError: "error reading value",
+		},
+		{
+			name:          "A value that is not UTF-8",
+			args:          []string{"post", "--value-file", invalidFile},
+			expectedError: "not valid UTF-8",
+		},
+		{
+			name:          "Both a value and stdin",
+			args:          []string{"post", "-v", "world", "--stdin"},
+			expectedError: "none of the others",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received *string
+			r := mux.NewRouter()
+			r.PathPrefix("/v1/keys").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var data httpPostRequest
+				_ = json.NewDecoder(r.Body).Decode(&data)
+				received = &data.Value
+				_, _ = fmt.Fprint(w, `{"data":{"key":"hello"},"error":null}`)
+			})
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			c := NewEndpointsCmd()
+			c.SetIn(strings.NewReader(tt.stdin))
+			_, err := execute(t, c, append(tt.args, "-u", ts.URL)...)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Errorf("expected error to contain %v, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if received == nil || *received != tt.expected {
+				t.Errorf("expected the server to receive %q, got %v", tt.expected, received)
+			}
+		})
+	}
+}
+
+func TestCommand_scan(t *testing.T) {
+	tests := []testCase{
+		{
+			name:         "Test forwards response",
+			commandName:  "scan",
+			key:          "user:",
+			returnStatus: 200,
+			response:     httpScanResponse{Status: 200, Data: &httpScanData{Keys: []string{"user:a", "user:b"}, Cursor: "user:b"}},
+		},
+		badJSONTest,
+		badURLTest,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testHelper(t, tt, "/v1/keys", []string{"scan", "--prefix", tt.key, "--limit", "2"})
+		})
+	}
+}
+
+func TestCommand_keyCompletion(t *testing.T) {
+	db, ts := newTUIServer(t)
+	for _, key := range []string{"user:a", "user:b", "session:a"} {
+		db.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: key, Value: "value"})
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{
+			name:     "Get completes keys with the typed prefix",
+			args:     []string{"__complete", "get", "-u", ts.URL, "-k", "user:"},
+			expected: "user:a\nuser:b\n:4",
+		},
+		{
+			name:     "Delete completes every key",
+			args:     []string{"__complete", "delete", "-u", ts.URL, "-k", ""},
+			expected: "session:a\nuser:a\nuser:b\n:4",
+		},
+		{
+			name:     "GetTTL completes nothing without a match",
+			args:     []string{"__complete", "getTTL", "-u", ts.URL, "-k", "missing"},
+			expected: ":4",
+		},
+		{
+			name:     "An unreachable server is an error",
+			args:     []string{"__complete", "get", "-u", "http://127.0.0.1:1", "-k", ""},
+			expected: ":1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := execute(t, NewEndpointsCmd(), tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Cobra follows the completions with a line describing the directive
+			out, _, _ = strings.Cut(out, "\nCompletion ended")
+			if out != tt.expected {
+				t.Errorf("expected completions %q, got %q", tt.expected, out)
+			}
+		})
+	}
+}
+
+func TestCommand_embedded(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "embedded.aof")
+
+	tests := []struct {
+		name          string
+		args          []string
+		stdin         string
+		expected      []string // Substrings the output should contain
+		expectedError string
+	}{
+		{
+			name:     "Put to an embedded database",
+			args:     []string{"put", "-k", "hello", "-v", "world", "--embedded", "--embedded-file", file},
+			expected: []string{`"status": 201`},
+		},
+		{
+			name:     "The embedded file carries state between commands",
+			args:     []string{"get", "-k", "hello", "--embedded", "--embedded-file", file},
+			expected: []string{`"value": "world"`},
+		},
+		{
+			name:          "Without a file the embedded database starts empty",
+			args:          []string{"get", "-k", "hello", "--embedded"},
+			expectedError: "404 Not Found",
+		},
+		{
+			name:     "The tui can browse an embedded database",
+			args:     []string{"tui", "--no-clear", "--embedded"},
+			stdin:    "put hello world\nwatch hello\nquit\n",
+			expected: []string{"hello", "world"},
+		},
+		{
+			name:          "The embedded file requires --embedded",
+			args:          []string{"get", "-k", "hello", "--embedded-file", file},
+			expectedError: "--embedded-file requires --embedded",
+		},
+		{
+			name:          "A root URL cannot be used with --embedded",
+			args:          []string{"get", "-k", "hello", "--embedded", "-u", "http://localhost:8080"},
+			expectedError: "if any flags in the group [embedded rootURL] are set none of the others can be",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewEndpointsCmd()
+			c.SetIn(strings.NewReader(tt.stdin))
+			out, err := execute(t, c, tt.args...)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.expected {
+				if !strings.Contains(out, s) {
+					t.Errorf("expected output to contain %q, got:\n%v", s, out)
+				}
+			}
+		})
+	}
+}
+
+func TestCommand_postRetries(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = backoff })
+
+	tests := []struct {
+		name           string
+		args           []string
+		failures       int    // The number of requests the server fails before succeeding
+		expectedStatus int    // The status output by the command
+		expectedTries  int    // The number of requests the server should receive
+		idempotencyKey string // The idempotency key every request should carry, or * for any generated key
+	}{
+		{
+			name:           "Succeeds after retrying",
+			args:           []string{"--retries", "2"},
+			failures:       2,
+			expectedStatus: http.StatusCreated,
+			expectedTries:  3,
+			idempotencyKey: "*",
+		},
+		{
+			name:           "Outputs the last response once retries run out",
+			args:           []string{"--retries", "1"},
+			failures:       3,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedTries:  2,
+			idempotencyKey: "*",
+		},
+		{
+			name:           "Does not retry by default",
+			failures:       1,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedTries:  1,
+		},
+		{
+			name:           "Forwards a given idempotency key",
+			args:           []string{"--retries", "1", "--idempotency-key", "order-42"},
+			failures:       1,
+			expectedStatus: http.StatusCreated,
+			expectedTries:  2,
+			idempotencyKey: "order-42",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				keys = append(keys, r.Header.Get("Idempotency-Key"))
+				if len(keys) <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					_, _ = fmt.Fprint(w, `{"data":null,"error":{"code":"INTERNAL_ERROR","message":"unavailable"}}`)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				_, _ = fmt.Fprint(w, `{"data":{"key":"generated"},"error":null}`)
+			}))
+			defer ts.Close()
+
+			out, err := execute(t, NewEndpointsCmd(), append([]string{"post", "-v", "world", "-u", ts.URL}, tt.args...)...)
+			if tt.expectedStatus >= 500 && ExitCode(err) != ExitServerError {
+				t.Fatalf("expected a server error, got %v", err)
+			} else if tt.expectedStatus < 500 && err != nil {
+				t.Fatal(err)
+			}
+
+			// The response is output before any error
+			var response httpKeyResponse
+			if err = json.NewDecoder(strings.NewReader(out)).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Status != tt.expectedStatus {
+				t.Errorf("expected status %v, got %v", tt.expectedStatus, response.Status)
+			}
+			if len(keys) != tt.expectedTries {
+				t.Fatalf("expected %v requests, got %v", tt.expectedTries, len(keys))
+			}
+			for _, key := range keys {
+				matches := key == tt.idempotencyKey || (tt.idempotencyKey == "*" && key != "")
+				if key != keys[0] || !matches {
+					t.Errorf("expected every request to carry idempotency key %q, got %q", tt.idempotencyKey, keys)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestCommand_stream(t *testing.T) {
+	db, ts := newTUIServer(t)
+	for _, key := range []string{"user:b", "user:a", "session:a"} {
+		db.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: key, Value: "value of " + key})
+	}
+	output := filepath.Join(t.TempDir(), "export.ndjson")
+
+	tests := []struct {
+		name          string
+		args          []string
+		file          string // Where the output is written, if not to stdout
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "Scan streams every key",
+			args:     []string{"scan", "--stream"},
+			expected: "{\"key\":\"session:a\"}\n{\"key\":\"user:a\"}\n{\"key\":\"user:b\"}",
+		},
+		{
+			name:     "Scan streams keys after the cursor with the prefix",
+			args:     []string{"scan", "--stream", "--prefix", "user:", "--cursor", "user:a"},
+			expected: "{\"key\":\"user:b\"}",
+		},
+		{
+			name:     "Export entries with a prefix",
+			args:     []string{"export", "--prefix", "user:"},
+			expected: "{\"key\":\"user:a\",\"value\":\"value of user:a\",\"ttl\":null}\n{\"key\":\"user:b\",\"value\":\"value of user:b\",\"ttl\":null}",
+		},
+		{
+			name:     "Export to a file",
+			args:     []string{"export", "--cursor", "user:a", "-o", output},
+			file:     output,
+			expected: "{\"key\":\"user:b\",\"value\":\"value of user:b\",\"ttl\":null}",
+		},
+		{
+			name:          "A limit cannot be streamed",
+			args:          []string{"scan", "--stream", "--limit", "1"},
+			expectedError: "none of the others can be",
+		},
+		{
+			name:          "Error responses are errors",
+			args:          []string{"scan", "--stream", "--prefix", "a", "-u", ts.URL + "/missing"},
+			expectedError: "404 Not Found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if !slices.Contains(args, "-u") {
+				args = append(args, "-u", ts.URL)
+			}
+			out, err := execute(t, NewEndpointsCmd(), args...)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.file != "" {
+				data, err := os.ReadFile(tt.file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out = strings.TrimSpace(string(data))
+			}
+			if out != tt.expected {
+				t.Errorf("expected:\n%v\ngot:\n%v", tt.expected, out)
+			}
+		})
+	}
+}
+
+func TestCommand_errorOutput(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The key is the status to respond with
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/v1/keys/"))
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, `{"data":null,"error":{"code":"CODE_%d","message":"failed"}}`, status)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedExit int
+		expected     CommandError // The error written as JSON
+	}{
+		{
+			name:         "A connection failure",
+			args:         []string{"get", "-k", "hello", "-u", "http://127.0.0.1:1"},
+			expectedExit: ExitConnection,
+			expected:     CommandError{Kind: ErrorKindConnection, ExitCode: ExitConnection},
+		},
+		{
+			name:         "A 4xx response",
+			args:         []string{"get", "-k", "404", "-u", ts.URL},
+			expectedExit: ExitClientError,
+			expected:     CommandError{Kind: ErrorKindClient, Status: 404, Code: "CODE_404", ExitCode: ExitClientError},
+		},
+		{
+			name:         "A 5xx response",
+			args:         []string{"get", "-k", "500", "-u", ts.URL},
+			expectedExit: ExitServerError,
+			expected:     CommandError{Kind: ErrorKindServer, Status: 500, Code: "CODE_500", ExitCode: ExitServerError},
+		},
+		{
+			name:         "Any other failure",
+			args:         []string{"put", "-k", "hello", "--value-file", filepath.Join(t.TempDir(), "missing"), "-u", ts.URL},
+			expectedExit: ExitFailure,
+			expected:     CommandError{Kind: ErrorKindOther, ExitCode: ExitFailure},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewEndpointsCmd()
+			stderr := new(bytes.Buffer)
+			c.SetOut(new(bytes.Buffer))
+			c.SetErr(stderr)
+			c.SetArgs(append(tt.args, "--output", "json"))
+
+			err := c.Execute()
+			if code := ExitCode(err); code != tt.expectedExit {
+				t.Fatalf("expected exit code %v, got %v for %v", tt.expectedExit, code, err)
+			}
+
+			var out struct {
+				Error CommandError `json:"error"`
+			}
+			if err = json.Unmarshal(stderr.Bytes(), &out); err != nil {
+				t.Fatalf("expected stderr to be a JSON error, got %q", stderr.String())
+			}
+			if out.Error.Message == "" {
+				t.Error("expected the error to have a message")
+			}
+			out.Error.Message = ""
+			if out.Error != tt.expected {
+				t.Errorf("expected error %+v, got %+v", tt.expected, out.Error)
+			}
+		})
+	}
+}
+
+func TestCommand_readFrom(t *testing.T) {
+	// server answers reads with its name, and counts the requests it receives other than readiness probes
+	server := func(name string, status int, readyDelay time.Duration, requests *[]string) *httptest.Server {
+		var mu sync.Mutex
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/readyz" {
+				time.Sleep(readyDelay)
+				w.WriteHeader(status)
+				return
+			}
+			mu.Lock()
+			*requests = append(*requests, r.Method)
+			mu.Unlock()
+			w.WriteHeader(status)
+			_, _ = fmt.Fprintf(w, `{"data":{"key":"hello","value":%q},"error":null}`, name)
+		}))
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		noReplica     bool          // Whether to leave out --replica-url
+		replicaStatus int           // The status the replica responds with. Zero makes the replica unreachable.
+		primaryDelay  time.Duration // How long the primary takes to answer a readiness probe
+		expectedValue string        // The value output by get
+		expectedError string
+	}{
+		{name: "Reads go to the primary by default", replicaStatus: http.StatusOK, expectedValue: "primary"},
+		{name: "Reads go to the replica", args: []string{"--read-from", "replica"}, replicaStatus: http.StatusOK, expectedValue: "replica"},
+		{name: "A failing replica falls back to the primary", args: []string{"--read-from", "replica"}, replicaStatus: http.StatusInternalServerError, expectedValue: "primary"},
+		{name: "An unreachable replica falls back to the primary", args: []string{"--read-from", "replica"}, expectedValue: "primary"},
+		{name: "Nearest picks a faster replica", args: []string{"--read-from", "nearest"}, replicaStatus: http.StatusOK, primaryDelay: 50 * time.Millisecond, expectedValue: "replica"},
+		{name: "Nearest skips a replica that is not ready", args: []string{"--read-from", "nearest"}, replicaStatus: http.StatusServiceUnavailable, primaryDelay: 50 * time.Millisecond, expectedValue: "primary"},
+		{name: "A replica is required", noReplica: true, args: []string{"--read-from", "replica"}, expectedError: "requires --replica-url"},
+		{name: "Unknown preference", args: []string{"--read-from", "random"}, expectedError: "must be primary, replica or nearest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var primaryRequests, replicaRequests []string
+			primary := server("primary", http.StatusOK, tt.primaryDelay, &primaryRequests)
+			defer primary.Close()
+			replica := server("replica", tt.replicaStatus, 0, &replicaRequests)
+			defer replica.Close()
+			if tt.replicaStatus == 0 {
+				replica.Close()
+			}
+
+			args := append([]string{"get", "-k", "hello", "-u", primary.URL}, tt.args...)
+			if !tt.noReplica {
+				args = append(args, "--replica-url", replica.URL)
+			}
+			out, err := execute(t, NewEndpointsCmd(), args...)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Errorf("expected an error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var response httpGetResponse
+			if err = json.Unmarshal([]byte(out), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Data == nil || response.Data.Value != tt.expectedValue {
+				t.Errorf("got %+v; want the value %v", response.Data, tt.expectedValue)
+			}
+		})
+	}
+
+	// Writes always go to the primary
+	var primaryRequests, replicaRequests []string
+	primary := server("primary", http.StatusOK, 0, &primaryRequests)
+	defer primary.Close()
+	replica := server("replica", http.StatusOK, 0, &replicaRequests)
+	defer replica.Close()
+	if _, err := execute(t, NewEndpointsCmd(), "put", "-k", "hello", "-v", "world", "-u", primary.URL, "--replica-url", replica.URL, "--read-from", "replica"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(primaryRequests, []string{"PUT"}) || len(replicaRequests) != 0 {
+		t.Errorf("primary received %v and replica %v; want only the put on the primary", primaryRequests, replicaRequests)
+	}
+}
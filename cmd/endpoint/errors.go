@@ -0,0 +1,134 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the endpoint commands, so that scripts can branch on the kind of failure
+const (
+	ExitFailure     = 1 // Any other failure, such as invalid flags or unreadable files
+	ExitConnection  = 3 // The server could not be reached
+	ExitClientError = 4 // The server responded with a 4xx
+	ExitServerError = 5 // The server responded with a 5xx
+)
+
+// Kinds of CommandError
+const (
+	ErrorKindConnection = "connection"
+	ErrorKindClient     = "client"
+	ErrorKindServer     = "server"
+	ErrorKindOther      = "other"
+)
+
+// Output formats of the --output flag
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// CommandError is a failed endpoint command. Its kind determines the exit code, and it is written to stderr as JSON
+// when --output=json is set.
+type CommandError struct {
+	Kind     string `json:"kind"`             // One of connection, client, server or other
+	Status   int    `json:"status,omitempty"` // The status the server responded with
+	Code     string `json:"code,omitempty"`   // The error code from the response envelope
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode"`
+	err      error
+}
+
+func (e *CommandError) Error() string {
+	return e.Message
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.err
+}
+
+// connectionError is returned when a request could not be sent or its response could not be read
+func connectionError(err error, msg string) *CommandError {
+	return &CommandError{Kind: ErrorKindConnection, Message: fmt.Sprintf("%v: %v", msg, err), ExitCode: ExitConnection, err: err}
+}
+
+// statusError describes a 4xx or 5xx response, returning nil for any other status
+func statusError(status int, apiErr *httpError) error {
+	if status < 400 {
+		return nil
+	}
+	e := &CommandError{Kind: ErrorKindClient, Status: status, ExitCode: ExitClientError}
+	if status >= 500 {
+		e.Kind = ErrorKindServer
+		e.ExitCode = ExitServerError
+	}
+	e.Message = fmt.Sprintf("server responded with %v %v", status, http.StatusText(status))
+	if apiErr != nil {
+		e.Code = apiErr.Code
+		e.Message += ": " + apiErr.Message
+	}
+	return e
+}
+
+// responseError returns the CommandError for a 4xx or 5xx response whose body has not been read
+func responseError(resp *http.Response) error {
+	var response httpResponse[any]
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		response.Error = nil
+	}
+	return statusError(resp.StatusCode, response.Error)
+}
+
+// failure reports a 4xx or 5xx response as an error once it has been output
+func (r httpResponse[T]) failure() error {
+	return statusError(r.Status, r.Error)
+}
+
+// ExitCode returns the exit code for an error returned by a command. Errors that are not a CommandError exit with
+// ExitFailure.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var e *CommandError
+	if errors.As(err, &e) {
+		return e.ExitCode
+	}
+	return ExitFailure
+}
+
+// withErrorOutput wraps the RunE of c and its subcommands so that a failed request does not print the usage, and so
+// that errors are written to stderr as {"error": {...}} instead of cobra's error line when --output=json is set
+func withErrorOutput(c *cobra.Command, o *options) {
+	if run := c.RunE; run != nil {
+		c.RunE = func(cmd *cobra.Command, args []string) error {
+			err := run(cmd, args)
+			if err == nil {
+				return nil
+			}
+
+			var e *CommandError
+			if errors.As(err, &e) {
+				cmd.SilenceUsage = true
+			}
+			if o.output == outputJSON {
+				if e == nil {
+					e = &CommandError{Kind: ErrorKindOther, Message: err.Error(), ExitCode: ExitFailure, err: err}
+				}
+				out, _ := json.Marshal(struct {
+					Error *CommandError `json:"error"`
+				}{Error: e})
+				_, _ = fmt.Fprintln(cmd.ErrOrStderr(), string(out))
+				cmd.SilenceErrors = true
+				cmd.SilenceUsage = true
+			}
+			return err
+		}
+	}
+	for _, sub := range c.Commands() {
+		withErrorOutput(sub, o)
+	}
+}
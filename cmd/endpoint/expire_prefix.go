@@ -0,0 +1,49 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+type httpExpirePrefixRequest struct {
+	Prefix string `json:"prefix"`
+	Ttl    int64  `json:"ttl"`
+}
+
+type httpExpirePrefixData struct {
+	Prefix  string `json:"prefix"`
+	Expired int    `json:"expired"`
+}
+
+type httpExpirePrefixResponse = httpResponse[httpExpirePrefixData]
+
+func newExpirePrefixCmd(o *options) *cobra.Command {
+	// expirePrefixCmd applies a TTL to every key with a prefix
+	var expirePrefixCmd = &cobra.Command{
+		Use:   "expirePrefix",
+		Short: "Apply a TTL to every key with a prefix",
+		Long: `This command applies a TTL to every key that starts with the given prefix, which allows a whole dataset
+generation to be retired at once. expirePrefix --prefix=v1: --ttl=60 will expire every key starting with 'v1:' in 60
+seconds. The response includes the number of keys that were given the TTL.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Send request
+			var response httpExpirePrefixResponse
+			url := fmt.Sprintf("%v/v1/admin/expire-prefix", o.rootURL)
+			requestBody := httpExpirePrefixRequest{Prefix: o.prefix, Ttl: int64(o.ttl)}
+			status, err := o.getResponse("POST", url, requestBody, &response)
+			if err != nil {
+				return err
+			}
+			response.Status = status
+
+			return outputResponse(cmd, response)
+		},
+	}
+
+	expirePrefixCmd.Flags().StringVar(&o.prefix, "prefix", "", "The prefix of the keys to expire")
+	expirePrefixCmd.Flags().IntVar(&o.ttl, "ttl", 0, "The ttl to apply to every matching key")
+	_ = expirePrefixCmd.MarkFlagRequired("prefix")
+	_ = expirePrefixCmd.MarkFlagRequired("ttl")
+
+	return expirePrefixCmd
+}
@@ -0,0 +1,54 @@
+package endpoint
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newExportCmd(o *options) *cobra.Command {
+	var cursor string
+	var output string
+
+	// exportCmd streams every entry in the database
+	var exportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export every entry as NDJSON",
+		Long: `This command outputs every entry as a {"key", "value", "ttl"} object per line in key order. Entries are
+written as the server streams them, so exports of any size use constant memory. export --prefix=user: -o=users.ndjson
+exports every key starting with 'user:' to users.ndjson. An interrupted export can be resumed with --cursor set to the
+last key received.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{}
+			if o.prefix != "" {
+				query.Set("prefix", o.prefix)
+			}
+			if cursor != "" {
+				query.Set("cursor", cursor)
+			}
+			u := fmt.Sprintf("%v/v1/export", o.rootURL)
+			if len(query) > 0 {
+				u += "?" + query.Encode()
+			}
+
+			out := cmd.OutOrStdout()
+			if output != "" && !o.dryRun {
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+			return o.stream(cmd.Context(), u, out)
+		},
+	}
+
+	exportCmd.Flags().StringVar(&o.prefix, "prefix", "", "Only export keys with this prefix")
+	exportCmd.Flags().StringVar(&cursor, "cursor", "", "Only export keys after this key")
+	exportCmd.Flags().StringVarP(&output, "output", "o", "", "Write the export to this file instead of stdout")
+
+	return exportCmd
+}
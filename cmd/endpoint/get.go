@@ -3,16 +3,19 @@ package endpoint
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"net/url"
 )
 
-type httpGetResponse struct {
-	Status int    `json:"status"`
-	Key    string `json:"key"`
-	Value  string `json:"value"`
-	Error  string `json:"error"`
+type httpGetData struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
+type httpGetResponse = httpResponse[httpGetData]
+
 func newGetCmd(o *options) *cobra.Command {
+	var path string
+
 	// getCmd gets a key value pair from the database
 	var getCmd = &cobra.Command{
 		Use:   "get",
@@ -20,12 +23,15 @@ func newGetCmd(o *options) *cobra.Command {
 		Long: `In order to get a stored key value pair from the database you must provide the key as a parameter.
 The returned response is printed to the console as json with the status code. For example, 
 get -k=hello -u='localhost:8080' will return the value associated with the hello key in the database listening
-on port 8080.`,
+on port 8080. With --path, only a member of a JSON value is returned, e.g. get -k=hello --path='$.user.name'.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			// Send request
 			var response httpGetResponse
-			url := fmt.Sprintf("%v/v1/keys/%s", o.rootURL, o.key)
-			status, err := getResponse("GET", url, nil, &response)
+			requestURL := fmt.Sprintf("%v/v1/keys/%s", o.rootURL, o.key)
+			if path != "" {
+				requestURL += "?" + url.Values{"path": {path}}.Encode()
+			}
+			status, err := o.getResponse("GET", requestURL, nil, &response)
 			if err != nil {
 				return err
 			}
@@ -36,7 +42,9 @@ on port 8080.`,
 	}
 
 	getCmd.Flags().StringVarP(&o.key, "key", "k", "", "The key to access in the database")
+	getCmd.Flags().StringVar(&path, "path", "", "Return only the member of a JSON value at this path, e.g. $.user.name")
 	_ = getCmd.MarkFlagRequired("key")
+	_ = getCmd.RegisterFlagCompletionFunc("key", completeKeys(o))
 
 	return getCmd
 }
@@ -5,25 +5,26 @@ import (
 	"github.com/spf13/cobra"
 )
 
-type httpGetTTLResponse struct {
-	Status int    `json:"status"`
-	Key    string `json:"key"`
-	TTL    *int64 `json:"ttl"`
-	Error  string `json:"error"`
+type httpGetTTLData struct {
+	Key       string  `json:"key"`
+	TTL       *int64  `json:"ttl"`
+	ExpiresAt *string `json:"expiresAt"`
 }
 
+type httpGetTTLResponse = httpResponse[httpGetTTLData]
+
 func newGetTTLCmd(o *options) *cobra.Command {
 	// getTTLCmd gets a key and its TTL from the database
 	var getTTLCmd = &cobra.Command{
 		Use:   "getTTL",
 		Short: "Get the remaining TTL for a key",
 		Long: `This command fetches the remaining TTL in seconds for a a key value pair. getTTL -k=hello will get the
-remaining TTL for key 'hello'. The returned TTL will be null if it is a non-expiring key value pair."`,
+remaining TTL for key 'hello'. The returned TTL and expiresAt will be null if it is a non-expiring key value pair."`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			// Send request
 			var response httpGetTTLResponse
 			url := fmt.Sprintf("%v/v1/ttl/%s", o.rootURL, o.key)
-			status, err := getResponse("GET", url, nil, &response)
+			status, err := o.getResponse("GET", url, nil, &response)
 			if err != nil {
 				return err
 			}
@@ -35,6 +36,7 @@ remaining TTL for key 'hello'. The returned TTL will be null if it is a non-expi
 
 	getTTLCmd.Flags().StringVarP(&o.key, "key", "k", "", "The key to access in the database")
 	_ = getTTLCmd.MarkFlagRequired("key")
+	_ = getTTLCmd.RegisterFlagCompletionFunc("key", completeKeys(o))
 
 	return getTTLCmd
 }
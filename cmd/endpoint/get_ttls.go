@@ -0,0 +1,54 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+type httpGetTTLsRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type httpGetTTLsResult struct {
+	Key       string  `json:"key"`
+	Exists    bool    `json:"exists"`
+	TTL       *int64  `json:"ttl"`
+	ExpiresAt *string `json:"expiresAt"`
+}
+
+type httpGetTTLsData struct {
+	Results []httpGetTTLsResult `json:"results"`
+}
+
+type httpGetTTLsResponse = httpResponse[httpGetTTLsData]
+
+func newGetTTLsCmd(o *options) *cobra.Command {
+	// getTTLsCmd gets the TTLs for many keys from the database
+	var getTTLsCmd = &cobra.Command{
+		Use:   "getTTLs",
+		Short: "Get the remaining TTLs for many keys",
+		Long: `This command fetches the remaining TTL in seconds for every given key in one request. 
+getTTLs -k=hello,world will get the remaining TTLs for keys 'hello' and 'world'. Each result reports whether the key
+exists, and the TTL and expiresAt are null for missing or non-expiring keys.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Send request
+			var response httpGetTTLsResponse
+			url := fmt.Sprintf("%v/v1/ttl/batch", o.rootURL)
+			status, err := o.getResponse("POST", url, httpGetTTLsRequest{Keys: o.keys}, &response)
+			if err != nil {
+				return err
+			}
+			response.Status = status
+
+			return outputResponse(cmd, response)
+		},
+	}
+
+	getTTLsCmd.Flags().StringSliceVarP(&o.keys, "keys", "k", nil, "The keys to access in the database")
+	_ = getTTLsCmd.MarkFlagRequired("keys")
+
+	return getTTLsCmd
+}
+
+func init() {
+}
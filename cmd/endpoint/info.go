@@ -0,0 +1,38 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+type httpInfoData struct {
+	Keys   int    `json:"keys"`
+	Seq    uint64 `json:"seq"`
+	NodeID string `json:"nodeId"`
+}
+
+type httpInfoResponse = httpResponse[httpInfoData]
+
+func newInfoCmd(o *options) *cobra.Command {
+	// infoCmd gets runtime statistics from the database
+	var infoCmd = &cobra.Command{
+		Use:   "info",
+		Short: "Get runtime statistics about the database",
+		Long: `This command fetches runtime statistics from a running server: the number of stored keys, the sequence
+number of the last write and the node ID recorded with every AOF operation.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Send request
+			var response httpInfoResponse
+			url := fmt.Sprintf("%v/v1/admin/info", o.rootURL)
+			status, err := o.getResponse("GET", url, nil, &response)
+			if err != nil {
+				return err
+			}
+			response.Status = status
+
+			return outputResponse(cmd, response)
+		},
+	}
+
+	return infoCmd
+}
@@ -1,33 +1,59 @@
 package endpoint
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
 )
 
-type httpPostResponse struct {
-	Status int    `json:"status"`
-	Key    string `json:"key"`
-	Error  string `json:"error"`
+type httpPostRequest struct {
+	Key       string  `json:"key,omitempty"`
+	Value     string  `json:"value"`
+	Ttl       *int64  `json:"ttl"`
+	ExpiresAt *string `json:"expiresAt,omitempty"`
 }
 
-type httpPostRequest struct {
-	Value string `json:"value"`
-	Ttl   *int64 `json:"ttl"`
+// httpPostData is the key a value was created under, when it expires and the hash of the stored value
+type httpPostData struct {
+	Key       string  `json:"key"`
+	ExpiresAt *string `json:"expiresAt"`
+	ValueHash string  `json:"valueSha256"`
 }
 
+type httpPostResponse = httpResponse[httpPostData]
+
 func newPostCmd(o *options) *cobra.Command {
 	// postCmd posts a value to the database
 	var postCmd = &cobra.Command{
 		Use:   "post",
 		Short: "Post a value to the database",
 		Long: `The value must be provided in order to post the value to the database. The response body alongside a 
-status code are printed to the console. The response body includes the key associated with the posted value.
+status code are printed to the console. The response body includes the key associated with the posted value, when
+it expires, and the hash of the stored value, which is checked against the value that was sent.
+A key may be provided, otherwise the server generates one. With --retries the post is retried after connection
+errors and server errors. Retries carry an idempotency key, generated unless --idempotency-key is given, so that a
+post the server already applied is not applied again.
 post -v=value -p=8080 will send a post request to the server on port 8080.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.retries < 0 {
+				return errors.New("--retries must not be negative")
+			}
+			if o.retries > 0 && o.idempotencyKey == "" {
+				o.idempotencyKey = rand.Text()
+			}
+
+			value, err := o.readValue(cmd)
+			if err != nil {
+				return err
+			}
+
 			// Create request body
 			requestBody := httpPostRequest{
-				Value: o.value,
+				Key:   o.key,
+				Value: value,
 			}
 
 			if cmd.Flags().Changed("ttl") {
@@ -35,22 +61,37 @@ post -v=value -p=8080 will send a post request to the server on port 8080.`,
 				requestBody.Ttl = &ttl
 			}
 
+			if cmd.Flags().Changed("expires-at") {
+				requestBody.ExpiresAt = &o.expiresAt
+			}
+
 			// Send request
 			var response httpPostResponse
 			url := fmt.Sprintf("%v/v1/keys", o.rootURL)
-			status, err := getResponse("POST", url, requestBody, &response)
+			status, err := o.getResponse("POST", url, requestBody, &response)
 			if err != nil {
 				return err
 			}
 			response.Status = status
 
-			return outputResponse(cmd, response)
+			if err = outputResponse(cmd, response); err != nil {
+				return err
+			}
+			sum := sha256.Sum256([]byte(value))
+			if hash := hex.EncodeToString(sum[:]); response.Data != nil && response.Data.ValueHash != "" && response.Data.ValueHash != hash {
+				return fmt.Errorf("the server stored a value with hash %v, expected %v", response.Data.ValueHash, hash)
+			}
+			return nil
 		},
 	}
 
-	postCmd.Flags().StringVarP(&o.value, "value", "v", "", "The value to post to the database")
+	addValueFlags(postCmd, o, "The value to post to the database")
+	postCmd.Flags().StringVarP(&o.key, "key", "k", "", "An optional key to post the value under. The post fails if the key already exists.")
 	postCmd.Flags().IntVar(&o.ttl, "ttl", 0, "The ttl to post to the database")
-	_ = postCmd.MarkFlagRequired("value")
+	postCmd.Flags().StringVar(&o.expiresAt, "expires-at", "", "The absolute expiration as an RFC3339 timestamp or unix seconds")
+	postCmd.MarkFlagsMutuallyExclusive("ttl", "expires-at")
+	postCmd.Flags().StringVar(&o.idempotencyKey, "idempotency-key", "", "Sent as the Idempotency-Key header. A repeated post with the same key returns the original result.")
+	postCmd.Flags().IntVar(&o.retries, "retries", 0, "How many times to retry the post after a connection error or server error")
 
 	return postCmd
 }
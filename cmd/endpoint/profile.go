@@ -0,0 +1,383 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// The profiles file has the form
+//
+//	default: local
+//	profiles:
+//	  local:
+//	    rootURL: http://localhost:8080
+//	  prod:
+//	    rootURL: https://db.example.com
+//	    token: secret
+//	    tls:
+//	      caFile: /etc/ssl/db-ca.pem
+//	      certFile: /etc/ssl/client.pem
+//	      keyFile: /etc/ssl/client-key.pem
+//	      insecureSkipVerify: false
+//
+// Only the YAML needed for this is supported: nested mappings of scalars, plain or quoted, and comments.
+
+// defaultConfigFile is the profiles file used when --config is not given, relative to the home directory
+var defaultConfigFile = filepath.Join(".inmemorydb", "config.yaml")
+
+// profile holds the connection settings for one server
+type profile struct {
+	rootURL string
+	token   string
+	tls     tlsSettings
+}
+
+// tlsSettings configures the TLS client used to reach a server
+type tlsSettings struct {
+	caFile             string // A PEM file of CAs to trust instead of the system pool
+	certFile           string // A PEM client certificate for mutual TLS
+	keyFile            string // The PEM key for certFile
+	insecureSkipVerify bool   // Skip verification of the server certificate
+}
+
+func (t tlsSettings) enabled() bool {
+	return t != tlsSettings{}
+}
+
+// config is a parsed profiles file
+type config struct {
+	defaultProfile string
+	profiles       map[string]profile
+}
+
+// applyProfile resolves the connection settings from the flags and the selected profile, with flags taking
+// precedence. The profile is the one named by --profile, or else the file's default. A missing profiles file is only an
+// error if a profile was asked for.
+func (o *options) applyProfile(cmd *cobra.Command) error {
+	path := o.configFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = filepath.Join(home, defaultConfigFile)
+		}
+	}
+
+	var p profile
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		c, err := parseConfig(string(data))
+		if err != nil {
+			return fmt.Errorf("error parsing %v: %w", path, err)
+		}
+
+		name := o.profile
+		if name == "" {
+			name = c.defaultProfile
+		}
+		if name != "" {
+			var ok bool
+			if p, ok = c.profiles[name]; !ok {
+				return fmt.Errorf("profile %q is not defined in %v", name, path)
+			}
+		}
+	case o.profile != "" || o.configFile != "":
+		return fmt.Errorf("error reading profiles: %w", err)
+	}
+
+	flags := cmd.Flags()
+	if !flags.Changed("rootURL") && p.rootURL != "" {
+		o.rootURL = p.rootURL
+	}
+	if !flags.Changed("token") {
+		o.token = p.token
+	}
+	if !flags.Changed("tls-ca") {
+		o.tls.caFile = p.tls.caFile
+	}
+	if !flags.Changed("tls-cert") {
+		o.tls.certFile = p.tls.certFile
+	}
+	if !flags.Changed("tls-key") {
+		o.tls.keyFile = p.tls.keyFile
+	}
+	if !flags.Changed("tls-insecure") {
+		o.tls.insecureSkipVerify = p.tls.insecureSkipVerify
+	}
+
+	o.client, err = newClient(o.tls)
+	return err
+}
+
+// newClient returns the HTTP client for the TLS settings, which is the default client when there are none
+func newClient(t tlsSettings) (*http.Client, error) {
+	if !t.enabled() {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: t.insecureSkipVerify}
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tls ca file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", t.caFile)
+		}
+	}
+	if t.certFile != "" || t.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// parseConfig parses a profiles file
+func parseConfig(data string) (config, error) {
+	c := config{profiles: map[string]profile{}}
+	doc, err := parseYAMLMapping(data)
+	if err != nil {
+		return c, err
+	}
+
+	for key, value := range doc {
+		switch key {
+		case "default":
+			s, ok := value.(string)
+			if !ok {
+				return c, errors.New("default must be a profile name")
+			}
+			c.defaultProfile = s
+		case "profiles":
+			profiles, ok := value.(map[string]any)
+			if !ok {
+				return c, errors.New("profiles must be a mapping of profile names to profiles")
+			}
+			for name, v := range profiles {
+				p, err := parseProfile(v)
+				if err != nil {
+					return c, fmt.Errorf("profile %q: %w", name, err)
+				}
+				c.profiles[name] = p
+			}
+		default:
+			return c, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	return c, nil
+}
+
+// parseProfile converts a parsed profile mapping into a profile
+func parseProfile(v any) (profile, error) {
+	var p profile
+	m, ok := v.(map[string]any)
+	if !ok {
+		return p, errors.New("a profile must be a mapping")
+	}
+
+	for key, value := range m {
+		if key == "tls" {
+			t, ok := value.(map[string]any)
+			if !ok {
+				return p, errors.New("tls must be a mapping")
+			}
+			for tlsKey, tlsValue := range t {
+				s, ok := tlsValue.(string)
+				if !ok {
+					return p, fmt.Errorf("tls.%v must be a scalar", tlsKey)
+				}
+				switch tlsKey {
+				case "caFile":
+					p.tls.caFile = s
+				case "certFile":
+					p.tls.certFile = s
+				case "keyFile":
+					p.tls.keyFile = s
+				case "insecureSkipVerify":
+					b, err := strconv.ParseBool(s)
+					if err != nil {
+						return p, fmt.Errorf("tls.insecureSkipVerify must be true or false, got %q", s)
+					}
+					p.tls.insecureSkipVerify = b
+				default:
+					return p, fmt.Errorf("unknown field tls.%v", tlsKey)
+				}
+			}
+			continue
+		}
+
+		s, ok := value.(string)
+		if !ok {
+			return p, fmt.Errorf("%v must be a scalar", key)
+		}
+		switch key {
+		case "rootURL":
+			p.rootURL = s
+		case "token":
+			p.token = s
+		default:
+			return p, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	return p, nil
+}
+
+// yamlLine is a significant line of a YAML document
+type yamlLine struct {
+	number int
+	indent int
+	key    string
+	value  string // Empty when the value is a nested mapping on the following lines
+}
+
+// parseYAMLMapping parses block mappings whose values are scalars or further mappings. Scalars are returned as
+// strings and mappings as map[string]any.
+func parseYAMLMapping(data string) (map[string]any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(data, "\n") {
+		raw = strings.TrimRight(raw, " \r")
+		content := strings.TrimLeft(raw, " ")
+		if content == "" || content[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %v: tabs cannot be used for indentation", i+1)
+		}
+		if content == "---" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(content, ":")
+		if !ok || (value != "" && value[0] != ' ') {
+			return nil, fmt.Errorf("line %v: expected key: value", i+1)
+		}
+		key, err := parseYAMLScalar(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+1, err)
+		}
+		value, err = parseYAMLValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+1, err)
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(raw) - len(content), key: key, value: value})
+	}
+
+	m, rest, err := parseYAMLBlock(lines, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("line %v: unexpected indentation", rest[0].number)
+	}
+	return m, nil
+}
+
+// parseYAMLBlock parses the mapping at the indentation of the first line, returning the lines that follow it
+func parseYAMLBlock(lines []yamlLine, minIndent int) (map[string]any, []yamlLine, error) {
+	m := map[string]any{}
+	if len(lines) == 0 {
+		return m, nil, nil
+	}
+
+	indent := lines[0].indent
+	if indent < minIndent {
+		return m, lines, nil
+	}
+	for len(lines) > 0 && lines[0].indent == indent {
+		line := lines[0]
+		lines = lines[1:]
+		if _, ok := m[line.key]; ok {
+			return nil, nil, fmt.Errorf("line %v: duplicate key %q", line.number, line.key)
+		}
+
+		// A key without a value starts a nested mapping, which must be indented further
+		if line.value != "" || len(lines) == 0 || lines[0].indent <= indent {
+			m[line.key] = line.value
+			continue
+		}
+		nested, rest, err := parseYAMLBlock(lines, indent+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		m[line.key] = nested
+		lines = rest
+	}
+
+	if len(lines) > 0 && lines[0].indent > indent {
+		return nil, nil, fmt.Errorf("line %v: unexpected indentation", lines[0].number)
+	}
+	return m, lines, nil
+}
+
+// parseYAMLValue parses a scalar value, which may be followed by a comment
+func parseYAMLValue(s string) (string, error) {
+	var scalar, rest string
+	switch {
+	case s == "":
+		return "", nil
+	case s[0] == '"':
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %v", s)
+		}
+		scalar, rest = quoted, s[len(quoted):]
+	case s[0] == '\'':
+		// A quote is escaped by doubling it, so the string ends at the first quote that is not doubled
+		end := 1
+		for {
+			i := strings.IndexByte(s[end:], '\'')
+			if i < 0 {
+				return "", fmt.Errorf("unterminated string %v", s)
+			}
+			end += i + 1
+			if end == len(s) || s[end] != '\'' {
+				break
+			}
+			end++
+		}
+		scalar, rest = s[:end], s[end:]
+	default:
+		scalar = s
+		if i := strings.Index(s, " #"); i >= 0 {
+			scalar = strings.TrimSpace(s[:i])
+		}
+	}
+
+	if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected %v after string", rest)
+	}
+	return parseYAMLScalar(scalar)
+}
+
+// parseYAMLScalar unquotes a single or double-quoted scalar. Plain scalars are returned as they are.
+func parseYAMLScalar(s string) (string, error) {
+	if len(s) < 2 {
+		return s, nil
+	}
+	switch s[0] {
+	case '"':
+		return strconv.Unquote(s)
+	case '\'':
+		if s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("unterminated string %v", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
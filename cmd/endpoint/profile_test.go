@@ -0,0 +1,198 @@
+package endpoint
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          string
+		expected      config
+		expectedError string
+	}{
+		{
+			name: "Parse profiles",
+			data: `# Servers
+default: local
+profiles:
+  local:
+    rootURL: http://localhost:8080
+  prod:
+    rootURL: "https://db.example.com" # The production server
+    token: 'it''s secret'
+    tls:
+      caFile: /etc/ssl/ca.pem
+      insecureSkipVerify: true
+`,
+			expected: config{
+				defaultProfile: "local",
+				profiles: map[string]profile{
+					"local": {rootURL: "http://localhost:8080"},
+					"prod": {
+						rootURL: "https://db.example.com",
+						token:   "it's secret",
+						tls:     tlsSettings{caFile: "/etc/ssl/ca.pem", insecureSkipVerify: true},
+					},
+				},
+			},
+		},
+		{
+			name:     "Parse an empty file",
+			data:     "",
+			expected: config{profiles: map[string]profile{}},
+		},
+		{
+			name:          "Unknown profile fields are an error",
+			data:          "profiles:\n  local:\n    rootUrl: http://localhost:8080\n",
+			expectedError: `unknown field "rootUrl"`,
+		},
+		{
+			name:          "Duplicate keys are an error",
+			data:          "default: a\ndefault: b\n",
+			expectedError: `duplicate key "default"`,
+		},
+		{
+			name:          "Unexpected indentation is an error",
+			data:          "default: a\n  profiles: b\n",
+			expectedError: "line 2: unexpected indentation",
+		},
+		{
+			name:          "Invalid booleans are an error",
+			data:          "profiles:\n  local:\n    tls:\n      insecureSkipVerify: maybe\n",
+			expectedError: "insecureSkipVerify must be true or false",
+		},
+		{
+			name:          "Lines without a key are an error",
+			data:          "profiles\n",
+			expectedError: "line 1: expected key: value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseConfig(tt.data)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, c)
+			}
+		})
+	}
+}
+
+func TestCommand_profile(t *testing.T) {
+	// The server is only reachable over TLS with its own certificate trusted, and records the token it was sent
+	var authorization string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"data":{"key":"hello","value":"world"},"error":null}`))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	configFile := filepath.Join(dir, "config.yaml")
+	data := "default: test\nprofiles:\n" +
+		"  test:\n    rootURL: " + ts.URL + "\n    token: secret\n    tls:\n      caFile: " + caFile + "\n" +
+		"  untrusted:\n    rootURL: " + ts.URL + "\n    token: secret\n"
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "empty.yaml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		authorization string // The Authorization header the server should receive
+		expectedError string
+	}{
+		{
+			name:          "Use the default profile",
+			args:          []string{"get", "-k", "hello", "--config", configFile},
+			authorization: "Bearer secret",
+		},
+		{
+			name:          "Select a profile by name",
+			args:          []string{"get", "-k", "hello", "--config", configFile, "--profile", "test"},
+			authorization: "Bearer secret",
+		},
+		{
+			name:          "Flags take precedence over the profile",
+			args:          []string{"get", "-k", "hello", "--config", configFile, "--token", "other"},
+			authorization: "Bearer other",
+		},
+		{
+			name:          "A profile without the CA does not trust the server",
+			args:          []string{"get", "-k", "hello", "--config", configFile, "--profile", "untrusted"},
+			expectedError: "certificate",
+		},
+		{
+			name: "TLS flags can be used without a profile",
+			args: []string{"get", "-k", "hello", "--config", filepath.Join(dir, "empty.yaml"), "-u", ts.URL, "--tls-insecure"},
+		},
+		{
+			name:          "Unknown profiles are an error",
+			args:          []string{"get", "-k", "hello", "--config", configFile, "--profile", "missing"},
+			expectedError: `profile "missing" is not defined`,
+		},
+		{
+			name:          "A missing profiles file is an error when a profile is asked for",
+			args:          []string{"get", "-k", "hello", "--config", filepath.Join(dir, "missing.yaml"), "--profile", "test"},
+			expectedError: "error reading profiles",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := execute(t, NewEndpointsCmd(), tt.args...)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, `"status": 200`) {
+				t.Errorf("expected a 200 response, got %v", out)
+			}
+			if authorization != tt.authorization {
+				t.Errorf("expected Authorization %q, got %q", tt.authorization, authorization)
+			}
+		})
+	}
+}
+
+func TestCommand_dryRunRedactsToken(t *testing.T) {
+	out, err := execute(t, NewEndpointsCmd(), "get", "-k", "hello", "--token", "secret", "--dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "secret") || !strings.Contains(out, "Authorization: <redacted>") {
+		t.Errorf("expected the token to be redacted, got:\n%v", out)
+	}
+}
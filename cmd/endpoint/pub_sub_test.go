@@ -7,6 +7,9 @@ import (
 	"github.com/gorilla/mux"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -97,7 +100,7 @@ func (h *testHandler) publish(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte(`{"error":"null"}`))
+	_, err := fmt.Fprintf(w, `{"data":{"channel":%q},"error":null}`, channel)
 	if err != nil {
 		return
 	}
@@ -249,6 +252,10 @@ func TestCommand_pubSubValidation(t *testing.T) {
 			name: "Test publish errors without message",
 			args: []string{"publish", "-c", "channel"},
 		},
+		{
+			name: "Test publish errors with both a message and stdin",
+			args: []string{"publish", "-c", "channel", "-m", "message", "--stdin"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -256,9 +263,103 @@ func TestCommand_pubSubValidation(t *testing.T) {
 			_, err := execute(t, NewEndpointsCmd(), tt.args...)
 			if err == nil {
 				t.Error("Expected err but got nil")
-			} else if !strings.Contains(err.Error(), "required") {
+			} else if !strings.Contains(err.Error(), "required") && !strings.Contains(err.Error(), "none of the others") {
 				t.Errorf("Expected error to contain %v, got %v", "required", err)
 			}
 		})
 	}
 }
+
+func TestCommand_publishLines(t *testing.T) {
+	dir := t.TempDir()
+	ndjsonFile := filepath.Join(dir, "events.ndjson")
+	err := os.WriteFile(ndjsonFile, []byte("{\"id\": 1}\nnot json\n\n[1, 2]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		expected []string // The published messages in order
+		summary  httpPublishStreamSummary
+		minTime  time.Duration // The least time publishing should take when rate limited
+	}{
+		{
+			name:     "Lines from stdin",
+			args:     []string{"--stdin"},
+			stdin:    "first\nsecond message\n\nthird",
+			expected: []string{"first", "second message", "third"},
+			summary:  httpPublishStreamSummary{Channel: "test", Published: 3, Skipped: 1},
+		},
+		{
+			name:     "NDJSON records from a file",
+			args:     []string{"--file", ndjsonFile, "--ndjson"},
+			expected: []string{`{"id":1}`, `[1,2]`},
+			summary:  httpPublishStreamSummary{Channel: "test", Published: 2, Skipped: 2},
+		},
+		{
+			name:     "Rejected messages are counted",
+			args:     []string{"--stdin"},
+			stdin:    "ok\nreject\n",
+			expected: []string{"ok"},
+			summary:  httpPublishStreamSummary{Channel: "test", Published: 1, Failed: 1},
+		},
+		{
+			name:     "Rate limited",
+			args:     []string{"--stdin", "--rate", "20"},
+			stdin:    "a\nb\nc\n",
+			expected: []string{"a", "b", "c"},
+			summary:  httpPublishStreamSummary{Channel: "test", Published: 3},
+			minTime:  100 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Record every published message, rejecting the message "reject"
+			var mu sync.Mutex
+			var published []string
+			r := mux.NewRouter()
+			r.HandleFunc("/v1/publish/{channel}", func(w http.ResponseWriter, r *http.Request) {
+				var pData publishRequest
+				_ = json.NewDecoder(r.Body).Decode(&pData)
+				if pData.Message == "reject" {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = fmt.Fprint(w, `{"data":null,"error":{"code":"VALIDATION_FAILED","message":"rejected"}}`)
+					return
+				}
+
+				mu.Lock()
+				published = append(published, pData.Message)
+				mu.Unlock()
+				_, _ = fmt.Fprintf(w, `{"data":{"channel":%q},"error":null}`, mux.Vars(r)["channel"])
+			})
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			c := NewEndpointsCmd()
+			c.SetIn(strings.NewReader(tt.stdin))
+			start := time.Now()
+			out, err := execute(t, c, append([]string{"publish", "-c", "test", "-u", ts.URL}, tt.args...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minTime {
+				t.Errorf("expected publishing to take at least %v, took %v", tt.minTime, elapsed)
+			}
+
+			var summary httpPublishStreamSummary
+			if err = json.Unmarshal([]byte(out), &summary); err != nil {
+				t.Fatalf("expected a JSON summary, got %v: %v", out, err)
+			}
+			if summary != tt.summary {
+				t.Errorf("expected summary %+v, got %+v", tt.summary, summary)
+			}
+			if !slices.Equal(published, tt.expected) {
+				t.Errorf("expected messages %q, got %q", tt.expected, published)
+			}
+		})
+	}
+}
@@ -1,46 +1,181 @@
 package endpoint
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"time"
+
 	"github.com/spf13/cobra"
 )
 
+// maxPublishLineLength bounds the length of a single line read by publish --stdin or --file
+const maxPublishLineLength = 64 << 20
+
+type httpPublishData struct {
+	Channel string `json:"channel"`
+}
+
+type httpPublishResponse = httpResponse[httpPublishData]
+
+// httpPublishStreamSummary is output once every line read by publish --stdin or --file has been published
+type httpPublishStreamSummary struct {
+	Channel   string `json:"channel"`
+	Published int    `json:"published"` // Messages the server accepted
+	Failed    int    `json:"failed"`    // Messages the server rejected, e.g. for being too long
+	Skipped   int    `json:"skipped"`   // Empty lines, or lines that are not JSON when --ndjson is set
+}
+
 func newPublishCmd(o *options) *cobra.Command {
+	var fromStdin bool
+	var file string
+	var ndjson bool
+	var rate float64
+
 	// publishCmd publishes a message to a channel in the database
 	var publishCmd = &cobra.Command{
 		Use:   "publish",
 		Short: "Publish a message to a channel",
 		Long: `This command publishes a message to a channel such that all listening subscribers will receive that
-message. publish -c=hello -m=world will publish 'world' to the channel 'hello' `,
+message. publish -c=hello -m=world will publish 'world' to the channel 'hello'. With --stdin or --file each line is
+published as a separate message instead, and --rate limits how many are published per second, which turns the CLI
+into a producer for testing subscribers. publish -c=hello --file=events.ndjson --ndjson --rate=10 publishes each JSON
+record in events.ndjson at 10 messages per second.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Create request body
-			payload := struct {
-				Message string `json:"message"`
-			}{
-				Message: o.message,
+			if rate < 0 {
+				return errors.New("--rate must not be negative")
 			}
 
-			// Send Request
-			var response statusPlusErrorResponse
-			url := fmt.Sprintf("%v/v1/publish/%s", o.rootURL, o.channel)
-			status, err := getResponse("POST", url, payload, &response)
+			if !fromStdin && file == "" {
+				response, err := publish(o, o.message)
+				if err != nil {
+					return err
+				}
+				return outputResponse(cmd, response)
+			}
+
+			in := cmd.InOrStdin()
+			if file != "" {
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+
+			summary, err := publishLines(cmd, o, in, ndjson, rate)
 			if err != nil {
 				return err
 			}
-			response.Status = status
-
-			return outputResponse(cmd, response)
+			return outputResponse(cmd, summary)
 		},
 	}
 
 	publishCmd.Flags().StringVarP(&o.message, "message", "m", "", "The message to publish")
 	publishCmd.Flags().StringVarP(&o.channel, "channel", "c", "", "The channel to post a message to")
+	publishCmd.Flags().BoolVar(&fromStdin, "stdin", false, "Publish each line read from stdin as a message")
+	publishCmd.Flags().StringVarP(&file, "file", "f", "", "Publish each line of a file as a message")
+	publishCmd.Flags().BoolVar(&ndjson, "ndjson", false, "Treat each line as a JSON record, skipping lines that are not JSON")
+	publishCmd.Flags().Float64Var(&rate, "rate", 0, "The maximum number of messages to publish per second. Zero is unlimited.")
 
-	_ = publishCmd.MarkFlagRequired("message")
 	_ = publishCmd.MarkFlagRequired("channel")
+	publishCmd.MarkFlagsOneRequired("message", "stdin", "file")
+	publishCmd.MarkFlagsMutuallyExclusive("message", "stdin", "file")
 
 	return publishCmd
 }
 
+// publish sends a single message to the channel
+func publish(o *options, message string) (httpPublishResponse, error) {
+	// Create request body
+	payload := struct {
+		Message string `json:"message"`
+	}{
+		Message: message,
+	}
+
+	// Send Request
+	var response httpPublishResponse
+	url := fmt.Sprintf("%v/v1/publish/%s", o.rootURL, o.channel)
+	status, err := o.getResponse("POST", url, payload, &response)
+	if err != nil {
+		return response, err
+	}
+	response.Status = status
+	return response, nil
+}
+
+// publishLines publishes each line of in as a separate message, waiting between messages when a rate is given
+func publishLines(cmd *cobra.Command, o *options, in io.Reader, ndjson bool, rate float64) (httpPublishStreamSummary, error) {
+	summary := httpPublishStreamSummary{Channel: o.channel}
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxPublishLineLength)
+	first := true
+	dryRun := false
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			summary.Skipped++
+			continue
+		}
+
+		// Records are compacted so that a record spread over spaces is published as one canonical message
+		if ndjson {
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, line); err != nil {
+				summary.Skipped++
+				continue
+			}
+			line = buf.Bytes()
+		}
+
+		// The first message goes out immediately and later ones wait for the next tick
+		if tick != nil && !first && !o.dryRun {
+			select {
+			case <-cmd.Context().Done():
+				return summary, cmd.Context().Err()
+			case <-tick:
+			}
+		}
+		first = false
+
+		// A dry run prints every request rather than stopping at the first
+		response, err := publish(o, string(line))
+		if errors.Is(err, errDryRun) {
+			dryRun = true
+			continue
+		}
+		if err != nil {
+			return summary, err
+		}
+		if response.Error != nil {
+			summary.Failed++
+			continue
+		}
+		summary.Published++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return summary, err
+	}
+	if dryRun {
+		return summary, errDryRun
+	}
+	return summary, nil
+}
+
 func init() {
 }
@@ -6,22 +6,40 @@ import (
 )
 
 type httpPutRequest struct {
-	Value string `json:"value"`
-	Ttl   *int64 `json:"ttl"`
+	Value     string  `json:"value"`
+	Ttl       *int64  `json:"ttl"`
+	ExpiresAt *string `json:"expiresAt,omitempty"`
 }
 
+// httpPutData is the state of the key after a put
+type httpPutData struct {
+	Key       string  `json:"key"`
+	Created   bool    `json:"created"`
+	TTL       *int64  `json:"ttl"`
+	ExpiresAt *string `json:"expiresAt"`
+	Version   uint64  `json:"version,omitempty"`
+}
+
+type httpPutResponse = httpResponse[httpPutData]
+
 func newPutCmd(o *options) *cobra.Command {
 	// putCmd puts a key value pair to the database
 	var putCmd = &cobra.Command{
 		Use:   "put",
 		Short: "Put a key value pair into the database",
 		Long: `Put will update the key if it exists in the database or create a new one and attach the passed value to it.
-The value and key are required for the put request. The response status code is printed to the console. 
+The value and key are required for the put request. The response status code is printed to the console along with
+whether the key was created, its ttl and its version. 
 put -k=hello -v=world -p=8080 will put the key value pair (hello,world) into the database listening on port 8080.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			value, err := o.readValue(cmd)
+			if err != nil {
+				return err
+			}
+
 			// Create request body
 			requestBody := httpPutRequest{
-				Value: o.value,
+				Value: value,
 			}
 
 			if cmd.Flags().Changed("ttl") {
@@ -29,10 +47,14 @@ put -k=hello -v=world -p=8080 will put the key value pair (hello,world) into the
 				requestBody.Ttl = &ttl
 			}
 
+			if cmd.Flags().Changed("expires-at") {
+				requestBody.ExpiresAt = &o.expiresAt
+			}
+
 			// Send request
-			var response statusPlusErrorResponse
+			var response httpPutResponse
 			url := fmt.Sprintf("%v/v1/keys/%v", o.rootURL, o.key)
-			status, err := getResponse("PUT", url, requestBody, &response)
+			status, err := o.getResponse("PUT", url, requestBody, &response)
 			if err != nil {
 				return err
 			}
@@ -43,10 +65,11 @@ put -k=hello -v=world -p=8080 will put the key value pair (hello,world) into the
 	}
 
 	putCmd.Flags().StringVarP(&o.key, "key", "k", "", "The key to put into the database")
-	putCmd.Flags().StringVarP(&o.value, "value", "v", "", "The value to put into the database")
+	addValueFlags(putCmd, o, "The value to put into the database")
 	putCmd.Flags().IntVar(&o.ttl, "ttl", 0, "The ttl to post to the database")
+	putCmd.Flags().StringVar(&o.expiresAt, "expires-at", "", "The absolute expiration as an RFC3339 timestamp or unix seconds")
+	putCmd.MarkFlagsMutuallyExclusive("ttl", "expires-at")
 	_ = putCmd.MarkFlagRequired("key")
-	_ = putCmd.MarkFlagRequired("value")
 
 	return putCmd
 }
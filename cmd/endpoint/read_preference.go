@@ -0,0 +1,141 @@
+package endpoint
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read preferences of the --read-from flag
+const (
+	readFromPrimary = "primary" // Every request goes to the rootURL
+	readFromReplica = "replica" // Reads go to a replica, starting from a random one to spread the load
+	readFromNearest = "nearest" // Reads go to whichever of the rootURL and the replicas answers /readyz fastest
+)
+
+// probeTimeout bounds how long the readiness probes of --read-from=nearest wait for a server
+const probeTimeout = 2 * time.Second
+
+// readPreference routes reads to replicas, such as servers that the primary forwards its writes to with --mirror-url
+type readPreference struct {
+	readFrom    string
+	replicaURLs []string
+
+	once  sync.Once
+	order []string // The replicas to try before the rootURL, resolved once per command
+}
+
+// isRead reports whether a request may be served by a replica
+func isRead(req *http.Request) bool {
+	return req.Method == "GET" || req.Method == "HEAD"
+}
+
+// replicaOrder returns the replicas that reads are tried on, in order, before falling back to the rootURL. It is
+// resolved on the first read so that every request of a command, like the polls of the tui, goes to the same server.
+func (o *options) replicaOrder(ctx context.Context) []string {
+	p := &o.reads
+	p.once.Do(func() {
+		switch p.readFrom {
+		case readFromReplica:
+			start := rand.IntN(len(p.replicaURLs))
+			p.order = append(slices.Clone(p.replicaURLs[start:]), p.replicaURLs[:start]...)
+		case readFromNearest:
+			p.order = o.nearest(ctx)
+		}
+	})
+	return p.order
+}
+
+// nearest probes /readyz of the rootURL and every replica concurrently, and returns the ready replicas that answered
+// faster than the rootURL, fastest first. Replicas that are not ready, such as ones still warming up, are left out.
+func (o *options) nearest(ctx context.Context) []string {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	type probe struct {
+		url     string
+		elapsed time.Duration
+		ready   bool
+	}
+	urls := append([]string{o.rootURL}, o.reads.replicaURLs...)
+	probes := make([]probe, len(urls))
+	var wg sync.WaitGroup
+	for n, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probes[n] = probe{url: url}
+			req, err := http.NewRequestWithContext(ctx, "GET", url+"/readyz", nil)
+			if err != nil {
+				return
+			}
+			start := time.Now()
+			resp, err := o.httpClient().Do(req)
+			if err != nil {
+				return
+			}
+			_ = resp.Body.Close()
+			probes[n].elapsed = time.Since(start)
+			probes[n].ready = resp.StatusCode == http.StatusOK
+		}()
+	}
+	wg.Wait()
+
+	primary := probes[0]
+	var order []string
+	replicas := probes[1:]
+	slices.SortStableFunc(replicas, func(a, b probe) int { return cmp.Compare(a.elapsed, b.elapsed) })
+	for _, p := range replicas {
+		if p.ready && (!primary.ready || p.elapsed < primary.elapsed) {
+			order = append(order, p.url)
+		}
+	}
+	if o.verbose {
+		for _, p := range probes {
+			fmt.Fprintf(o.stderr, "Probed %v in %v, ready: %v\n", p.url, p.elapsed, p.ready)
+		}
+	}
+	return order
+}
+
+// sendRead sends a request with the read preference. Reads are tried once on each replica in order, moving on after a
+// connection error or a 5xx response, and fall back to the rootURL, which is sent with the usual retries. Replicas may
+// lag behind the rootURL, so a 404 from a replica is returned as it is.
+func (o *options) sendRead(req *http.Request) (*http.Response, error) {
+	if o.reads.readFrom == readFromPrimary || o.reads.readFrom == "" || !isRead(req) ||
+		!strings.HasPrefix(req.URL.String(), o.rootURL) {
+		return o.send(req)
+	}
+
+	for _, replica := range o.replicaOrder(req.Context()) {
+		replicaReq := req.Clone(req.Context())
+		u, err := replicaReq.URL.Parse(replica + strings.TrimPrefix(req.URL.String(), o.rootURL))
+		if err != nil {
+			continue
+		}
+		replicaReq.URL = u
+		replicaReq.Host = ""
+
+		resp, err := o.httpClient().Do(replicaReq)
+		if err == nil && resp.StatusCode < 500 {
+			if o.verbose {
+				fmt.Fprintf(o.stderr, "Read from replica %v\n\n", replica)
+			}
+			return resp, nil
+		}
+		if err == nil {
+			_ = resp.Body.Close()
+			err = fmt.Errorf("%v", resp.Status)
+		}
+		if o.verbose {
+			fmt.Fprintf(o.stderr, "Replica %v failed (%v), falling back\n\n", replica, err)
+		}
+	}
+	return o.send(req)
+}
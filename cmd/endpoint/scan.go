@@ -0,0 +1,74 @@
+package endpoint
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+type httpScanData struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor"`
+}
+
+type httpScanResponse = httpResponse[httpScanData]
+
+// scanURL returns the url for a page of keys with the prefix after the cursor
+func scanURL(rootURL string, prefix string, cursor string, limit int) string {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if len(query) == 0 {
+		return fmt.Sprintf("%v/v1/keys", rootURL)
+	}
+	return fmt.Sprintf("%v/v1/keys?%v", rootURL, query.Encode())
+}
+
+func newScanCmd(o *options) *cobra.Command {
+	var cursor string
+	var limit int
+	var stream bool
+
+	// scanCmd gets a page of keys from the database
+	var scanCmd = &cobra.Command{
+		Use:   "scan",
+		Short: "Get a page of keys",
+		Long: `This command fetches a page of keys in lexicographic order. scan --prefix=user: --limit=10 will get the
+first 10 keys starting with 'user:'. The response includes a cursor which is passed back with --cursor to get the next
+page. The cursor is empty once every key has been returned. With --stream every key after the cursor is output
+instead, one {"key": ...} object per line as the server sends them, which iterates millions of keys without holding
+them in memory. scan --prefix=user: --stream lists every key starting with 'user:'.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if stream {
+				return o.stream(cmd.Context(), scanURL(o.rootURL, o.prefix, cursor, 0), cmd.OutOrStdout())
+			}
+
+			// Send request
+			var response httpScanResponse
+			status, err := o.getResponse("GET", scanURL(o.rootURL, o.prefix, cursor, limit), nil, &response)
+			if err != nil {
+				return err
+			}
+			response.Status = status
+
+			return outputResponse(cmd, response)
+		},
+	}
+
+	scanCmd.Flags().StringVar(&o.prefix, "prefix", "", "Only get keys with this prefix")
+	scanCmd.Flags().StringVar(&cursor, "cursor", "", "The cursor returned by the previous page")
+	scanCmd.Flags().IntVar(&limit, "limit", 0, "The maximum number of keys to get. Zero uses the server default.")
+	scanCmd.Flags().BoolVar(&stream, "stream", false, "Output every key as NDJSON as it is received instead of a page")
+	scanCmd.MarkFlagsMutuallyExclusive("limit", "stream")
+
+	return scanCmd
+}
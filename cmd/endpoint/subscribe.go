@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -19,25 +20,43 @@ func newSubscribeCmd(o *options) *cobra.Command {
 		Use:   "subscribe",
 		Short: "Subscribe to a channel",
 		Long: `Subscribing to a channel allows receival of published messages to that channel. subscribe -c=hello -t=30
-will subscribe to channel 'hello' for up to 30 seconds.`,
+will subscribe to channel 'hello' for up to 30 seconds. Subscribers started with the same --group share the messages
+of the channel, each receiving a part of them.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			// Create an http request for subscription that will automatically disconnect after the expiration
-			client := http.Client{}
-
 			ctx, cancel := context.WithTimeout(cmd.Context(), time.Duration(o.timeout)*time.Second)
 			defer cancel()
 
-			url := fmt.Sprintf("%v/v1/subscribe/%s", o.rootURL, o.channel)
-			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			u := fmt.Sprintf("%v/v1/subscribe/%s", o.rootURL, o.channel)
+			if o.group != "" {
+				u += "?group=" + url.QueryEscape(o.group)
+			}
+			req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 			if err != nil {
 				return err
 			}
 
-			resp, err := client.Do(req)
+			o.authorize(req)
+			if o.dryRun {
+				o.printRequest(o.stdout, req, nil)
+				return nil
+			}
+			if o.verbose {
+				o.printRequest(o.stderr, req, nil)
+			}
+
+			start := time.Now()
+			resp, err := o.httpClient().Do(req)
 			if err != nil {
-				return errors.New(fmt.Sprintf("error sending request to server: %v", err))
+				return connectionError(err, "error sending request to server")
 			}
 			defer resp.Body.Close()
+			if o.verbose {
+				o.printResponse(resp, time.Since(start))
+			}
+			if resp.StatusCode != http.StatusOK {
+				return responseError(resp)
+			}
 
 			reader := bufio.NewReader(resp.Body)
 
@@ -65,6 +84,7 @@ will subscribe to channel 'hello' for up to 30 seconds.`,
 
 	subscribeCmd.Flags().StringVarP(&o.channel, "channel", "c", "", "The channel to subscribe to")
 	subscribeCmd.Flags().IntVarP(&o.timeout, "timeout", "t", 60, "How long to subscribe for")
+	subscribeCmd.Flags().StringVarP(&o.group, "group", "g", "", "The consumer group to join, whose members share the messages of the channel")
 	_ = subscribeCmd.MarkFlagRequired("channel")
 
 	return subscribeCmd
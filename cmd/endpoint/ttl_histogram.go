@@ -0,0 +1,45 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+type httpTTLBucket struct {
+	Within  string `json:"within"`
+	Seconds int64  `json:"seconds"`
+	Keys    int    `json:"keys"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type httpTTLHistogramData struct {
+	Buckets []httpTTLBucket `json:"buckets"`
+	Keys    int             `json:"keys"`
+	Bytes   int64           `json:"bytes"`
+}
+
+type httpTTLHistogramResponse = httpResponse[httpTTLHistogramData]
+
+func newTTLHistogramCmd(o *options) *cobra.Command {
+	// ttlHistogramCmd gets the expiration forecast from the database
+	var ttlHistogramCmd = &cobra.Command{
+		Use:   "ttl-histogram",
+		Short: "Get how many keys expire within the next minute, hour and day",
+		Long: `This command fetches an expiration forecast from a running server: how many keys expire within the next
+minute, hour and day, and how many bytes they free, so that mass expirations can be anticipated.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Send request
+			var response httpTTLHistogramResponse
+			url := fmt.Sprintf("%v/v1/admin/ttl-histogram", o.rootURL)
+			status, err := o.getResponse("GET", url, nil, &response)
+			if err != nil {
+				return err
+			}
+			response.Status = status
+
+			return outputResponse(cmd, response)
+		},
+	}
+
+	return ttlHistogramCmd
+}
@@ -0,0 +1,423 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// tuiMaxMessages is the number of channel messages kept on screen
+const tuiMaxMessages = 10
+
+// tuiMaxValueWidth is the number of characters of a value shown before it is truncated
+const tuiMaxValueWidth = 40
+
+const tuiHelp = `commands:
+  watch <key>...           show keys with a live ttl countdown
+  unwatch <key>...         stop showing keys
+  put <key> <value> [ttl]  put a value, with an optional ttl in seconds
+  del <key>                delete a key
+  tail <channel>           show messages published to a channel
+  untail <channel>         stop showing a channel
+  help                     show this help
+  quit                     exit`
+
+// keyState is what the browser last fetched for a watched key
+type keyState struct {
+	value     string
+	ttl       *int64    // The remaining ttl when fetched, or nil if the key never expires
+	fetchedAt time.Time // When the key was fetched, so that the ttl can count down between polls
+	missing   bool      // The key does not exist or has expired
+	err       error     // The error from the last fetch, if any
+}
+
+// browser is an interactive view of a running server. Commands are read a line at a time and the screen is redrawn
+// with ANSI escape codes so that it works in any terminal without a TUI library.
+type browser struct {
+	o        *options
+	out      io.Writer
+	ansi     bool           // Whether to clear the screen before each redraw
+	wg       sync.WaitGroup // Background goroutines, which are waited for on close so nothing draws afterwards
+	mu       sync.Mutex
+	keys     []string // Watched keys in the order they were added
+	entries  map[string]keyState
+	channels map[string]context.CancelFunc
+	messages []string
+	status   string
+}
+
+func newBrowser(o *options, out io.Writer, ansi bool) *browser {
+	return &browser{
+		o:        o,
+		out:      out,
+		ansi:     ansi,
+		entries:  map[string]keyState{},
+		channels: map[string]context.CancelFunc{},
+	}
+}
+
+func newTUICmd(o *options) *cobra.Command {
+	var refresh int
+	var poll int
+	var noClear bool
+
+	// tuiCmd opens an interactive key browser
+	var tuiCmd = &cobra.Command{
+		Use:   "tui",
+		Short: "Browse keys and channels interactively",
+		Long: `This command opens an interactive browser for a running server. Watched keys are shown with their values
+and a live TTL countdown, values can be put and deleted inline, and published messages are tailed as they arrive.
+Type help once it is open for the list of commands. tui --refresh=1 --poll=5 redraws every second and fetches the
+watched keys every 5 seconds.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if refresh <= 0 || poll <= 0 {
+				return errors.New("--refresh and --poll must be positive")
+			}
+			if o.dryRun {
+				return errors.New("--dry-run is not supported by tui")
+			}
+
+			ctx, cancel := context.WithCancel(cmd.Context())
+			b := newBrowser(o, cmd.OutOrStdout(), !noClear)
+			defer b.close(cancel)
+			b.setStatus("type help for a list of commands")
+			b.render()
+
+			// Redraw and poll in the background while commands are read
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				redraw := time.NewTicker(time.Duration(refresh) * time.Second)
+				defer redraw.Stop()
+				fetch := time.NewTicker(time.Duration(poll) * time.Second)
+				defer fetch.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-fetch.C:
+						b.refresh()
+					case <-redraw.C:
+						b.render()
+					}
+				}
+			}()
+
+			scanner := bufio.NewScanner(cmd.InOrStdin())
+			for scanner.Scan() {
+				if !b.exec(ctx, scanner.Text()) {
+					break
+				}
+				b.render()
+			}
+			return scanner.Err()
+		},
+	}
+
+	tuiCmd.Flags().IntVar(&refresh, "refresh", 1, "Seconds between redraws")
+	tuiCmd.Flags().IntVar(&poll, "poll", 5, "Seconds between fetches of the watched keys")
+	tuiCmd.Flags().BoolVar(&noClear, "no-clear", false, "Append each redraw instead of clearing the screen")
+
+	return tuiCmd
+}
+
+// exec runs a single command line and reports whether the browser should keep running
+func (b *browser) exec(ctx context.Context, line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+
+	args := fields[1:]
+	switch fields[0] {
+	case "watch", "w":
+		if len(args) == 0 {
+			b.setStatus("usage: watch <key>...")
+			return true
+		}
+		for _, key := range args {
+			b.watch(key)
+		}
+		b.setStatus(fmt.Sprintf("watching %v", strings.Join(args, ", ")))
+	case "unwatch":
+		for _, key := range args {
+			b.unwatch(key)
+		}
+	case "put", "p":
+		if len(args) < 2 || len(args) > 3 {
+			b.setStatus("usage: put <key> <value> [ttl]")
+			return true
+		}
+		var ttl *int64
+		if len(args) == 3 {
+			t, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				b.setStatus(fmt.Sprintf("invalid ttl %q", args[2]))
+				return true
+			}
+			ttl = &t
+		}
+		b.put(args[0], args[1], ttl)
+	case "del", "d":
+		if len(args) != 1 {
+			b.setStatus("usage: del <key>")
+			return true
+		}
+		b.del(args[0])
+	case "tail", "t":
+		if len(args) != 1 {
+			b.setStatus("usage: tail <channel>")
+			return true
+		}
+		b.tail(ctx, args[0])
+	case "untail":
+		for _, channel := range args {
+			b.untail(channel)
+		}
+	case "help", "h", "?":
+		b.setStatus(tuiHelp)
+	case "quit", "q", "exit":
+		return false
+	default:
+		b.setStatus(fmt.Sprintf("unknown command %q, type help for a list of commands", fields[0]))
+	}
+	return true
+}
+
+func (b *browser) setStatus(s string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status = s
+}
+
+// keyURL returns the url for a key under the given route prefix
+func (b *browser) keyURL(route string, key string) string {
+	return fmt.Sprintf("%v/v1/%v/%v", b.o.rootURL, route, url.PathEscape(key))
+}
+
+// fetch gets the value and remaining ttl of a key
+func (b *browser) fetch(key string) keyState {
+	var response httpGetResponse
+	status, err := b.o.getResponse("GET", b.keyURL("keys", key), nil, &response)
+	if err != nil {
+		return keyState{err: err}
+	}
+	if status == http.StatusNotFound {
+		return keyState{missing: true}
+	}
+	if response.Data == nil {
+		return keyState{err: fmt.Errorf("unexpected status %v", status)}
+	}
+
+	state := keyState{value: response.Data.Value, fetchedAt: time.Now()}
+	var ttlResponse httpGetTTLResponse
+	status, err = b.o.getResponse("GET", b.keyURL("ttl", key), nil, &ttlResponse)
+	if err != nil {
+		state.err = err
+	} else if status == http.StatusOK && ttlResponse.Data != nil {
+		state.ttl = ttlResponse.Data.TTL
+	}
+	return state
+}
+
+// watch adds a key to the view and fetches it
+func (b *browser) watch(key string) {
+	state := b.fetch(key)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.entries[key]; !ok {
+		b.keys = append(b.keys, key)
+	}
+	b.entries[key] = state
+}
+
+func (b *browser) unwatch(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entries, key)
+	for i, k := range b.keys {
+		if k == key {
+			b.keys = append(b.keys[:i], b.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// refresh fetches every watched key. Requests are made without the lock so that redraws are not held up.
+func (b *browser) refresh() {
+	b.mu.Lock()
+	keys := append([]string(nil), b.keys...)
+	b.mu.Unlock()
+
+	for _, key := range keys {
+		state := b.fetch(key)
+		b.mu.Lock()
+		if _, ok := b.entries[key]; ok {
+			b.entries[key] = state
+		}
+		b.mu.Unlock()
+	}
+}
+
+// put puts a value and starts watching its key
+func (b *browser) put(key string, value string, ttl *int64) {
+	var response httpKeyResponse
+	status, err := b.o.getResponse("PUT", b.keyURL("keys", key), httpPutRequest{Value: value, Ttl: ttl}, &response)
+	switch {
+	case err != nil:
+		b.setStatus(err.Error())
+		return
+	case response.Error != nil:
+		b.setStatus(fmt.Sprintf("put %v failed with %v: %v", key, status, response.Error.Message))
+		return
+	}
+	b.watch(key)
+	b.setStatus(fmt.Sprintf("put %v", key))
+}
+
+// del deletes a key. A watched key stays on screen as missing.
+func (b *browser) del(key string) {
+	var response httpKeyResponse
+	status, err := b.o.getResponse("DELETE", b.keyURL("keys", key), nil, &response)
+	switch {
+	case err != nil:
+		b.setStatus(err.Error())
+		return
+	case response.Error != nil:
+		b.setStatus(fmt.Sprintf("delete %v failed with %v: %v", key, status, response.Error.Message))
+		return
+	}
+
+	b.mu.Lock()
+	if _, ok := b.entries[key]; ok {
+		b.entries[key] = keyState{missing: true}
+	}
+	b.mu.Unlock()
+	b.setStatus(fmt.Sprintf("deleted %v", key))
+}
+
+// tail subscribes to a channel until it is untailed or the browser is closed
+func (b *browser) tail(ctx context.Context, channel string) {
+	b.mu.Lock()
+	if _, ok := b.channels[channel]; ok {
+		b.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	b.channels[channel] = cancel
+	b.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%v/v1/subscribe/%v", b.o.rootURL, url.PathEscape(channel)), nil)
+	if err != nil {
+		b.untail(channel)
+		b.setStatus(err.Error())
+		return
+	}
+	b.o.authorize(req)
+	resp, err := b.o.httpClient().Do(req)
+	if err != nil {
+		b.untail(channel)
+		b.setStatus(fmt.Sprintf("error subscribing to %v: %v", channel, err))
+		return
+	}
+	b.setStatus(fmt.Sprintf("tailing %v", channel))
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer resp.Body.Close()
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if msg, ok := strings.CutPrefix(line, "data: "); ok {
+				b.mu.Lock()
+				b.messages = append(b.messages, fmt.Sprintf("[%v] %v", channel, strings.TrimRight(msg, "\n")))
+				if len(b.messages) > tuiMaxMessages {
+					b.messages = b.messages[len(b.messages)-tuiMaxMessages:]
+				}
+				b.mu.Unlock()
+				b.render()
+			}
+		}
+	}()
+}
+
+func (b *browser) untail(channel string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cancel, ok := b.channels[channel]; ok {
+		cancel()
+		delete(b.channels, channel)
+	}
+}
+
+// close cancels the browser context, which ends every subscription, and waits for the background goroutines
+func (b *browser) close(cancel context.CancelFunc) {
+	cancel()
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.channels)
+}
+
+// render redraws the screen. The ttl counts down from the last fetch so that it stays live between polls.
+func (b *browser) render() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var sb strings.Builder
+	if b.ansi {
+		sb.WriteString("\033[H\033[2J")
+	}
+	fmt.Fprintf(&sb, "InMemoryDB %v\n\n", b.o.rootURL)
+
+	fmt.Fprintf(&sb, "%-24v %-10v %v\n", "KEY", "TTL", "VALUE")
+	for _, key := range b.keys {
+		state := b.entries[key]
+		ttl, value := "-", state.value
+		switch {
+		case state.err != nil:
+			ttl, value = "?", fmt.Sprintf("error: %v", state.err)
+		case state.missing:
+			value = "(missing)"
+		case state.ttl != nil:
+			remaining := *state.ttl - int64(time.Since(state.fetchedAt).Seconds())
+			if remaining <= 0 {
+				ttl, value = "0s", "(expired)"
+			} else {
+				ttl = (time.Duration(remaining) * time.Second).String()
+			}
+		}
+		if len(value) > tuiMaxValueWidth {
+			value = value[:tuiMaxValueWidth-3] + "..."
+		}
+		fmt.Fprintf(&sb, "%-24v %-10v %v\n", key, ttl, value)
+	}
+
+	if len(b.channels) > 0 || len(b.messages) > 0 {
+		sb.WriteString("\nMESSAGES\n")
+		for _, msg := range b.messages {
+			sb.WriteString(msg)
+			sb.WriteString("\n")
+		}
+	}
+
+	fmt.Fprintf(&sb, "\n%v\n> ", b.status)
+	_, _ = io.WriteString(b.out, sb.String())
+}
@@ -0,0 +1,119 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"github.com/pthav/InMemoryDB/database"
+	"github.com/pthav/InMemoryDB/handler"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTUIServer serves a real database so that the browser is tested against the actual API
+func newTUIServer(t *testing.T) (*database.InMemoryDatabase, *httptest.Server) {
+	t.Helper()
+	logger := slog.New(slog.DiscardHandler)
+	db, err := database.NewInMemoryDatabase(database.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Shutdown)
+
+	ts := httptest.NewServer(handler.NewHandler(db, logger))
+	t.Cleanup(ts.Close)
+	return db, ts
+}
+
+func TestCommand_tui(t *testing.T) {
+	db, ts := newTUIServer(t)
+	ttl := int64(100)
+	db.Put(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: "hello", Value: "world", Ttl: &ttl})
+
+	c := NewEndpointsCmd()
+	c.SetIn(strings.NewReader("watch hello missing\nput edited value 60\ndel hello\nbogus\nquit\nwatch ignored\n"))
+	out, err := execute(t, c, "tui", "--no-clear", "-u", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each command redraws the screen, so check the redraw that followed each of them
+	screens := strings.Split(out, "InMemoryDB ")
+	if len(screens) < 6 {
+		t.Fatalf("expected a redraw per command, got %v:\n%v", len(screens)-1, out)
+	}
+	expected := []struct {
+		screen   int
+		contains []string
+	}{
+		{screen: 2, contains: []string{"hello", "world", "1m", "missing", "(missing)", "watching hello, missing"}},
+		{screen: 3, contains: []string{"edited", "value", "put edited"}},
+		{screen: 4, contains: []string{"deleted hello"}},
+		{screen: 5, contains: []string{`unknown command "bogus"`}},
+	}
+	for _, e := range expected {
+		for _, s := range e.contains {
+			if !strings.Contains(screens[e.screen], s) {
+				t.Errorf("expected redraw %v to contain %q, got:\n%v", e.screen, s, screens[e.screen])
+			}
+		}
+	}
+	if strings.Contains(out, "ignored") {
+		t.Errorf("expected commands after quit to be ignored")
+	}
+
+	// The edits should have reached the database
+	if _, ok := db.Get("hello"); ok {
+		t.Errorf("expected hello to be deleted")
+	}
+	if v, ok := db.Get("edited"); !ok || v != "value" {
+		t.Errorf("expected edited to be put, got %v, %v", v, ok)
+	}
+	if remaining, ok := db.GetTTL("edited"); !ok || remaining == nil || *remaining > 60 {
+		t.Errorf("expected edited to have a ttl of at most 60, got %v", remaining)
+	}
+}
+
+func TestBrowser_tail(t *testing.T) {
+	_, ts := newTUIServer(t)
+	out := &bytes.Buffer{}
+	b := newBrowser(&options{rootURL: ts.URL}, out, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer b.close(cancel)
+
+	b.tail(ctx, "news")
+
+	// Publish until the subscription has been registered and the message arrives
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Post(ts.URL+"/v1/publish/news", "application/json", strings.NewReader(`{"message":"extra"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		b.mu.Lock()
+		n := len(b.messages)
+		b.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a tailed message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.messages[0] != "[news] extra" {
+		t.Errorf("expected the tailed message, got %v", b.messages[0])
+	}
+}
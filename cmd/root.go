@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/pthav/InMemoryDB/cmd/server"
+	"github.com/pthav/InMemoryDB/cmd/tools"
 	"os"
 
 	"github.com/pthav/InMemoryDB/cmd/endpoint"
@@ -20,14 +21,16 @@ to send requests to the already served database.`,
 	}
 	rootCmd.AddCommand(endpoint.NewEndpointsCmd())
 	rootCmd.AddCommand(server.NewServerCmd())
+	rootCmd.AddCommand(tools.NewToolsCmd())
 
 	return rootCmd
 }
 
+// Execute runs the root command, exiting with the code for the kind of error if it fails
 func Execute() {
 	err := NewRootCmd().Execute()
 	if err != nil {
-		os.Exit(1)
+		os.Exit(endpoint.ExitCode(err))
 	}
 }
 
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pthav/InMemoryDB/handler"
+)
+
+// channelGrant is a channel ACL entry given on the command line as token:pattern:permissions
+type channelGrant struct {
+	token       string
+	pattern     string
+	permissions handler.ChannelPermission
+}
+
+// parseChannelGrant parses a channel ACL flag such as "s3cret:orders.*:publish,subscribe". The token ends at the first
+// colon and the permissions start after the last one, so patterns may contain colons.
+func parseChannelGrant(s string) (channelGrant, error) {
+	token, rest, found := strings.Cut(s, ":")
+	i := strings.LastIndex(rest, ":")
+	if !found || i < 0 || token == "" {
+		return channelGrant{}, fmt.Errorf("invalid channel acl %q: expected token:pattern:permissions", s)
+	}
+
+	g := channelGrant{token: token, pattern: rest[:i]}
+	for _, p := range strings.Split(rest[i+1:], ",") {
+		switch p {
+		case "publish":
+			g.permissions |= handler.ChannelPublish
+		case "subscribe":
+			g.permissions |= handler.ChannelSubscribe
+		default:
+			return channelGrant{}, fmt.Errorf("invalid channel acl %q: unknown permission %q, expected publish or subscribe", s, p)
+		}
+	}
+	return g, nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pthav/InMemoryDB/bridge"
+	"github.com/pthav/InMemoryDB/handler"
+)
+
+// externalBridge is a bridge to an external broker that published messages are forwarded to and that channels can be
+// consumed from
+type externalBridge interface {
+	handler.Bridge
+	Consume(channel string, deliver func(channel string, message string) int) error
+	Close() error
+}
+
+// dialBridge connects to the external broker given on the command line. The URL scheme picks the broker.
+func dialBridge(rawURL string) (externalBridge, error) {
+	scheme, _, _ := strings.Cut(rawURL, "://")
+	switch scheme {
+	case "nats":
+		b, err := bridge.DialNATS(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting bridge %v: %w", redactURL(rawURL), err)
+		}
+		return b, nil
+	case "kafka", "mqtt":
+		return nil, fmt.Errorf("invalid bridge %v: %v bridges are not supported, only nats", redactURL(rawURL), scheme)
+	default:
+		return nil, fmt.Errorf("invalid bridge %v: expected a nats:// url", redactURL(rawURL))
+	}
+}
+
+// redactURL hides the password of a URL so that it can be logged and reported by the config endpoint
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid url>"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// listen returns the listener that the server should accept connections on. A listener inherited through systemd
+// socket activation takes precedence, followed by a unix domain socket, and finally the TCP host.
+func listen(host string, unixSocket string) (net.Listener, error) {
+	l, err := inheritedListener()
+	if err != nil || l != nil {
+		return l, err
+	}
+
+	if unixSocket != "" {
+		// Remove a stale socket left behind by a previous run that did not shut down cleanly
+		if info, err := os.Stat(unixSocket); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			if err = os.Remove(unixSocket); err != nil {
+				return nil, fmt.Errorf("error removing stale unix socket: %w", err)
+			}
+		}
+		return net.Listen("unix", unixSocket)
+	}
+
+	return net.Listen("tcp", host)
+}
+
+// inheritedListener returns the first listener passed to this process through systemd socket activation. It returns
+// a nil listener if no listeners were passed.
+func inheritedListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+
+	// The environment is only meant for this process
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(uintptr(listenFdsStart), "systemd-socket")
+	if file == nil {
+		return nil, errors.New("inherited socket file descriptor is invalid")
+	}
+	defer file.Close()
+
+	l, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("error using inherited socket: %w", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pthav/InMemoryDB/database"
+	"github.com/pthav/InMemoryDB/mirror"
+)
+
+// mirrorTarget is a target that every write is forwarded to while migrating to it
+type mirrorTarget interface {
+	database.MirrorTarget
+	Close() error
+}
+
+// dialMirror connects to the mirror target given on the command line. The URL scheme picks the kind of target.
+func dialMirror(rawURL string) (mirrorTarget, error) {
+	scheme, _, _ := strings.Cut(rawURL, "://")
+	switch scheme {
+	case "http", "https":
+		m, err := mirror.NewHTTP(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror %v: %w", redactURL(rawURL), err)
+		}
+		return m, nil
+	case "redis":
+		m, err := mirror.DialRedis(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting mirror %v: %w", redactURL(rawURL), err)
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("invalid mirror %v: expected an http://, https:// or redis:// url", redactURL(rawURL))
+	}
+}
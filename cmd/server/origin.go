@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pthav/InMemoryDB/handler"
+)
+
+// maxOriginValueBytes bounds how much of an origin response is read. Values over the maximum value length are served
+// but not stored, so this only protects the server from an unbounded response.
+const maxOriginValueBytes = 64 << 20
+
+// httpOrigin returns an origin that GETs the URL formed by replacing {key} in the template with the escaped key. A
+// 200 response body is the value, a 404 means the origin does not have the key, and anything else is an error.
+func httpOrigin(template string) (handler.Origin, error) {
+	if !strings.Contains(template, "{key}") {
+		return nil, errors.New("the origin url must contain {key}")
+	}
+	if u, err := url.Parse(strings.ReplaceAll(template, "{key}", "key")); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid origin url %v: expected an http:// or https:// url", redactOriginURL(template))
+	}
+
+	client := &http.Client{Timeout: handler.DefaultOriginTimeout}
+	return func(ctx context.Context, key string) (string, bool, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", strings.ReplaceAll(template, "{key}", url.PathEscape(key)), nil)
+		if err != nil {
+			return "", false, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", false, err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			value, err := io.ReadAll(io.LimitReader(resp.Body, maxOriginValueBytes))
+			if err != nil {
+				return "", false, err
+			}
+			return string(value), true, nil
+		case http.StatusNotFound:
+			return "", false, nil
+		default:
+			return "", false, fmt.Errorf("origin responded with %v", resp.Status)
+		}
+	}, nil
+}
+
+// redactOriginURL hides the password of an origin url template, keeping the {key} placeholder readable
+func redactOriginURL(template string) string {
+	return strings.ReplaceAll(redactURL(template), "%7Bkey%7D", "{key}")
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+// namespaceQuota is a quota given on the command line as namespace:keys=N,bytes=N,ops=N
+type namespaceQuota struct {
+	namespace    string
+	quota        database.NamespaceQuota
+	opsPerSecond float64
+}
+
+// parseNamespaceQuota parses a namespace quota flag. Every limit is optional and zero means unlimited, so
+// "tenant:keys=1000" only limits the number of keys. The default namespace is given with an empty name, e.g. ":ops=10".
+func parseNamespaceQuota(s string) (namespaceQuota, error) {
+	namespace, limits, found := strings.Cut(s, database.NamespaceSeparator)
+	if !found {
+		return namespaceQuota{}, fmt.Errorf("invalid namespace quota %q: expected namespace:limit=value,...", s)
+	}
+
+	q := namespaceQuota{namespace: namespace}
+	for _, limit := range strings.Split(limits, ",") {
+		name, value, _ := strings.Cut(limit, "=")
+		var err error
+		switch name {
+		case "keys":
+			q.quota.MaxKeys, err = strconv.Atoi(value)
+		case "bytes":
+			q.quota.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		case "ops":
+			q.opsPerSecond, err = strconv.ParseFloat(value, 64)
+			if err == nil && q.opsPerSecond < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		default:
+			return namespaceQuota{}, fmt.Errorf("invalid namespace quota %q: unknown limit %q, expected keys, bytes or ops", s, name)
+		}
+		if err != nil {
+			return namespaceQuota{}, fmt.Errorf("invalid namespace quota %q: %v: %w", s, name, err)
+		}
+	}
+	return q, nil
+}
+
+// parseNamespaceDefaultTTL parses a namespace default ttl flag given as namespace:duration, e.g. "sessions:30m". The
+// default namespace is given with an empty name, e.g. ":1h".
+func parseNamespaceDefaultTTL(s string) (string, time.Duration, error) {
+	namespace, value, found := strings.Cut(s, database.NamespaceSeparator)
+	if !found {
+		return "", 0, fmt.Errorf("invalid namespace default ttl %q: expected namespace:duration", s)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid namespace default ttl %q: %w", s, err)
+	}
+	if d < 0 {
+		return "", 0, fmt.Errorf("invalid namespace default ttl %q: must not be negative", s)
+	}
+	return namespace, d, nil
+}
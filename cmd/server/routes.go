@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pthav/InMemoryDB/handler"
+)
+
+// parseRouteTimeout parses a route timeout flag given as class=duration, e.g. "write=2s"
+func parseRouteTimeout(s string) (string, time.Duration, error) {
+	class, value, found := strings.Cut(s, "=")
+	if !found {
+		return "", 0, fmt.Errorf("invalid route timeout %q: expected class=duration", s)
+	}
+	if !slices.Contains(handler.RouteClasses, class) {
+		return "", 0, fmt.Errorf("invalid route timeout %q: unknown class %q, expected one of %v", s, class, strings.Join(handler.RouteClasses, ", "))
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid route timeout %q: %w", s, err)
+	}
+	if d < 0 {
+		return "", 0, fmt.Errorf("invalid route timeout %q: must not be negative", s)
+	}
+	return class, d, nil
+}
+
+// parseLogSample parses a log sampling flag given as class=rate, e.g. "read=0.01"
+func parseLogSample(s string) (string, float64, error) {
+	class, value, found := strings.Cut(s, "=")
+	if !found {
+		return "", 0, fmt.Errorf("invalid log sample %q: expected class=rate", s)
+	}
+	if !slices.Contains(handler.RouteClasses, class) {
+		return "", 0, fmt.Errorf("invalid log sample %q: unknown class %q, expected one of %v", s, class, strings.Join(handler.RouteClasses, ", "))
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid log sample %q: %w", s, err)
+	}
+	if rate < 0 || rate > 1 {
+		return "", 0, fmt.Errorf("invalid log sample %q: rate must be between 0 and 1", s)
+	}
+	return class, rate, nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/pthav/InMemoryDB/bridge"
 	"github.com/pthav/InMemoryDB/database"
 	"github.com/pthav/InMemoryDB/handler"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"sync"
 	"syscall"
 	"time"
@@ -23,15 +25,62 @@ import (
 
 // Settings define user-configurable Settings for the database and http server
 type Settings struct {
-	Host                      string        `json:"host"`                      // The router's Host
-	AofStartupFile            string        `json:"aofStartupFile"`            // The aof startup file
-	ShouldAofPersist          bool          `json:"shouldAofPersist"`          // Whether there should be aof persistence or not
-	AofPersistFile            string        `json:"aofPersistFile"`            // The file to output aof persistence to
-	AofPersistencePeriod      time.Duration `json:"aofPersistencePeriod"`      // How long in between the aof persistence cycles
-	DbStartupFile             string        `json:"dbStartupFile"`             // The database startup file
-	ShouldDatabasePersist     bool          `json:"shouldDatabasePersist"`     // Whether there should be database persistence or not
-	DatabasePersistFile       string        `json:"databasePersistFile"`       // The file name for which to output database persistence to
-	DatabasePersistencePeriod time.Duration `json:"databasePersistencePeriod"` // How long in between database persistence cycles
+	Host              string                   `json:"host"`    // The router's Host
+	Network           string                   `json:"network"` // The network the router listens on (tcp or unix)
+	database.Settings                          // The database settings
+	ReadTimeout       time.Duration            `json:"readTimeout"`                 // The maximum duration for reading an entire request
+	ReadHeaderTimeout time.Duration            `json:"readHeaderTimeout"`           // The maximum duration for reading request headers
+	WriteTimeout      time.Duration            `json:"writeTimeout"`                // The maximum duration before timing out writes of a response
+	IdleTimeout       time.Duration            `json:"idleTimeout"`                 // The maximum time to wait for the next request on a keep-alive connection
+	MaxHeaderBytes    int                      `json:"maxHeaderBytes"`              // The maximum size of request headers
+	MaxSubscribers    int                      `json:"maxSubscribers"`              // The maximum number of concurrent SSE subscriptions
+	SubscribersPerIP  int                      `json:"subscribersPerIP"`            // The maximum number of concurrent SSE subscriptions from one client address
+	SlowConsumer      time.Duration            `json:"slowConsumerTimeout"`         // How long a subscriber may drop messages before it is disconnected
+	FanOutWorkers     int                      `json:"fanOutWorkers,omitempty"`     // The workers that deliver messages to channels with many subscribers. Zero means one per CPU.
+	KeepAlives        bool                     `json:"keepAlives"`                  // Whether HTTP keep-alives are enabled
+	HTTP2             bool                     `json:"http2"`                       // Whether unencrypted HTTP/2 (h2c) is enabled
+	CoalesceReads     bool                     `json:"coalesceReads"`               // Whether identical concurrent reads share a database read
+	MaxKeyLength      int                      `json:"maxKeyLength"`                // The maximum key length in bytes
+	MaxValueLength    int                      `json:"maxValueLength"`              // The maximum value length in bytes
+	MaxMessageLength  int                      `json:"maxMessageLength"`            // The maximum published message length in bytes
+	MinTTL            int64                    `json:"minTTL"`                      // The minimum ttl in seconds
+	MaxTTL            int64                    `json:"maxTTL"`                      // The maximum ttl in seconds. Zero means unlimited.
+	ClampTTL          bool                     `json:"clampTTL"`                    // Whether ttls outside of the bounds are clamped to them instead of rejected
+	DefaultTTL        time.Duration            `json:"defaultTTL,omitempty"`        // The ttl of writes that give none. Zero means that they never expire.
+	NamespaceTTLs     map[string]time.Duration `json:"namespaceTTLs,omitempty"`     // The default ttl of each namespace that overrides DefaultTTL
+	KeyPattern        string                   `json:"keyPattern"`                  // The pattern that keys must match
+	IdempotencyTTL    time.Duration            `json:"idempotencyTTL"`              // How long the results of posts with an idempotency key are remembered
+	NamespaceOpsLimit map[string]float64       `json:"namespaceOpsLimit,omitempty"` // The key operations per second allowed for each namespace with a quota. Zero means unlimited.
+	WebhookAttempts   int                      `json:"webhookAttempts"`             // How many times a webhook delivery is attempted
+	WebhookBackoff    time.Duration            `json:"webhookBackoff"`              // The wait before the first retry of a webhook delivery
+	Warmup            string                   `json:"warmup,omitempty"`            // The warmup url with its password redacted, or "command"
+	Bridges           []string                 `json:"bridges,omitempty"`           // The external brokers published messages are forwarded to, with passwords redacted
+	BridgeConsume     []string                 `json:"bridgeConsume,omitempty"`     // The channels consumed from the external brokers
+	Peers             []string                 `json:"peers,omitempty"`             // The instances published messages are relayed to, with passwords redacted
+	Mirror            string                   `json:"mirror,omitempty"`            // The url every write is forwarded to, with its password redacted
+	Origin            string                   `json:"origin,omitempty"`            // The url template keys that are not stored are fetched from, with its password redacted
+	OriginTTL         int64                    `json:"originTtl,omitempty"`         // The ttl in seconds values fetched from the origin are stored with
+	RouteTimeouts     map[string]time.Duration `json:"routeTimeouts,omitempty"`     // The deadline of each route class that has one
+	LogRedact         []string                 `json:"logRedact,omitempty"`         // The fields whose values are redacted from logged request bodies
+	LogBodyLimit      int                      `json:"logBodyLimit,omitempty"`      // The length in bytes after which logged request bodies are cut off
+	LogSampleRates    map[string]float64       `json:"logSampleRates,omitempty"`    // The fraction of the successful requests of each route class that is logged
+	BreakerThreshold  int                      `json:"breakerThreshold,omitempty"`  // Consecutive failures of a route class that open its circuit. Zero disables the breakers.
+	BreakerCooldown   time.Duration            `json:"breakerCooldown,omitempty"`   // How long an open circuit rejects requests
+	WriteLanes        int                      `json:"writeLanes,omitempty"`        // The write and admin requests run at once. Zero means unlimited.
+	PriorityWeight    int                      `json:"priorityWeight,omitempty"`    // The priority requests admitted for every waiting client write
+	AdminAuth         bool                     `json:"adminAuth,omitempty"`         // Whether the admin routes require the admin token, which is never printed
+	AdminDisabled     bool                     `json:"adminDisabled,omitempty"`     // Whether the admin routes are disabled
+	ChannelACL        []string                 `json:"channelAcl,omitempty"`        // The channel patterns and permissions granted to tokens, which are never printed
+	Startup           *StartupSummary          `json:"startup,omitempty"`           // What was loaded from the startup file, if any
+}
+
+// StartupSummary describes what was loaded from the startup file
+type StartupSummary struct {
+	Loaded     int `json:"loaded"`     // Records applied to the database
+	Skipped    int `json:"skipped"`    // Malformed and duplicate records that were ignored
+	Malformed  int `json:"malformed"`  // Records that could not be parsed
+	Duplicates int `json:"duplicates"` // Records of operations that were already replayed
+	Expired    int `json:"expired"`    // Records that had already expired and were dropped
 }
 
 // shutdown is called when the http server is shutting down gracefully
@@ -55,7 +104,9 @@ func shutdown(db *database.InMemoryDatabase, c *cobra.Command) {
 
 func newServeCmd() *cobra.Command {
 	var host string
+	var unixSocket string
 	var aofStartupFile string
+	var persistDir string
 	var shouldAofPersist bool
 	var aofPersistFile string
 	var aofPersistencePeriod int
@@ -64,13 +115,76 @@ func newServeCmd() *cobra.Command {
 	var databasePersistFile string
 	var databasePersistencePeriod int
 	var noLog bool
+	var readTimeout int
+	var readHeaderTimeout int
+	var writeTimeout int
+	var idleTimeout int
+	var maxHeaderBytes int
+	var maxSubscribers int
+	var maxSubscribersPerIP int
+	var slowConsumerTimeout time.Duration
+	var fanOutWorkers int
+	var keepAlives bool
+	var enableHTTP2 bool
+	var coalesceReads bool
+	var idScheme string
+	var concurrencyMode string
+	var writeStallPolicy string
+	var loadProgressInterval int
+	var persistAlertPeriods int
+	var persistFailurePolicy string
+	var minFreeDisk uint64
+	var replayUntil string
+	var nodeID string
+	var ttlJitter float64
+	var compressionThreshold int
+	var maxKeyLength int
+	var maxValueLength int
+	var maxMessageLength int
+	var minTTL int64
+	var maxTTL int64
+	var clampTTL bool
+	var defaultTTL time.Duration
+	var namespaceTTLFlags []string
+	var keyPattern string
+	var idempotencyTTL int64
+	var namespaceQuotas []string
+	var webhookAttempts int
+	var webhookBackoff time.Duration
+	var warmupURL string
+	var warmupCommand string
+	var bridgeURLs []string
+	var bridgeConsume []string
+	var peerURLs []string
+	var mirrorURL string
+	var originURL string
+	var originTTL int64
+	var routeTimeoutFlags []string
+	var breakerThreshold int
+	var writeLanes int
+	var priorityWeight int
+	var breakerCooldown time.Duration
+	var adminToken string
+	var disableAdmin bool
+	var channelACLFlags []string
+	var changeLogSize int
+	var searchIndex bool
+	var historySize int
+	var keyStats bool
+	var compactionRatio float64
+	var memoryLimit int64
+	var evictionPolicy string
+	var logRedact []string
+	var logBodyLimit int
+	var logSampleFlags []string
 
 	// serveCmd serves up a database
 	var serveCmd = &cobra.Command{
 		Use:   "serve",
 		Short: "Serve the database",
 		Long: `Serve will spin up an in memory database instance and listen for localhost requests on the given port.
-Flags can be provided to configure the database`,
+Flags can be provided to configure the database. When started through systemd socket activation, the inherited socket
+is used instead of the host or unix socket.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
@@ -80,48 +194,338 @@ Flags can be provided to configure the database`,
 				logger = slog.New(slog.NewTextHandler(io.Discard, nil))
 			}
 			config = append(config, database.WithLogger(logger))
+			config = append(config, database.WithIDScheme(idScheme))
+			config = append(config, database.WithConcurrencyMode(concurrencyMode))
+			config = append(config, database.WithWriteStallPolicy(writeStallPolicy))
+			config = append(config, database.WithLoadProgressInterval(loadProgressInterval))
+			config = append(config, database.WithTTLJitter(ttlJitter))
+			config = append(config, database.WithCompression(compressionThreshold))
+			config = append(config, database.WithMaxKeyLength(maxKeyLength))
+			config = append(config, database.WithMaxValueSize(maxValueLength))
+			config = append(config, database.WithPersistenceAlert(persistAlertPeriods, nil))
+			config = append(config, database.WithPersistenceFailurePolicy(persistFailurePolicy))
+			config = append(config, database.WithMinFreeDisk(minFreeDisk))
+			config = append(config, database.WithChangeLog(changeLogSize))
+			if historySize > 0 {
+				config = append(config, database.WithHistory(historySize))
+			}
+			if keyStats {
+				config = append(config, database.WithKeyStats())
+			}
+			if compactionRatio != 0 {
+				config = append(config, database.WithAutoCompaction(compactionRatio))
+			}
+			if evictionPolicy != "" {
+				config = append(config, database.WithEviction(memoryLimit, evictionPolicy))
+			}
+			if searchIndex {
+				config = append(config, database.WithSearchIndex())
+			}
+			if nodeID != "" {
+				config = append(config, database.WithNodeID(nodeID))
+			}
+			var opsLimits map[string]float64
+			var handlerOpts []handler.Options
+			for _, flag := range namespaceQuotas {
+				q, err := parseNamespaceQuota(flag)
+				if err != nil {
+					return err
+				}
+				if opsLimits == nil {
+					opsLimits = map[string]float64{}
+				}
+				opsLimits[q.namespace] = q.opsPerSecond
+				config = append(config, database.WithNamespaceQuota(q.namespace, q.quota))
+				handlerOpts = append(handlerOpts, handler.WithNamespaceQuota(q.namespace, q.opsPerSecond))
+			}
+
+			// A persistence directory names the files that are not named by their own flag
+			switch {
+			case databasePersistFile != "" && !shouldDatabasePersist:
+				return errors.New("--db-persist-file is missing --db-persist")
+			case aofPersistFile != "" && !shouldAofPersist:
+				return errors.New("--aof-persist-file is missing --aof-persist")
+			case shouldDatabasePersist && databasePersistFile == "" && persistDir == "":
+				return errors.New("--db-persist is missing --db-persist-file or --persist-dir")
+			case shouldAofPersist && aofPersistFile == "" && persistDir == "":
+				return errors.New("--aof-persist is missing --aof-persist-file or --persist-dir")
+			}
+			if persistDir != "" {
+				config = append(config, database.WithPersistenceDir(persistDir))
+			}
 
 			config = append(config, database.WithDatabasePersistencePeriod(time.Duration(databasePersistencePeriod)*time.Second))
 			if shouldDatabasePersist {
 				config = append(config, database.WithDatabasePersistence())
-				config = append(config, database.WithDatabasePersistenceFile(databasePersistFile))
+				if databasePersistFile != "" {
+					config = append(config, database.WithDatabasePersistenceFile(databasePersistFile))
+				}
 			}
 			if databaseStartupFile != "" {
 				config = append(config, database.WithInitialData(databaseStartupFile, true))
 			}
+			var warmup string
+			switch {
+			case warmupURL != "":
+				warmup = redactURL(warmupURL)
+				config = append(config, database.WithWarmupFetcher(httpWarmupFetcher(warmupURL)))
+			case warmupCommand != "":
+				warmup = "command"
+				config = append(config, database.WithWarmupFetcher(commandWarmupFetcher(warmupCommand)))
+			}
 
 			config = append(config, database.WithAofPersistencePeriod(time.Duration(aofPersistencePeriod)*time.Second))
 			if shouldAofPersist {
-				config = append(config, database.WithAofPersistenceFile(aofPersistFile))
-				config = append(config, database.WithDatabasePersistenceFile(databasePersistFile))
+				config = append(config, database.WithAofPersistence())
+				if aofPersistFile != "" {
+					config = append(config, database.WithAofPersistenceFile(aofPersistFile))
+				}
 			}
 			if aofStartupFile != "" {
 				config = append(config, database.WithInitialData(aofStartupFile, false))
 			}
+			if replayUntil != "" {
+				if aofStartupFile == "" {
+					return errors.New("--replay-until requires --aof-startup-file")
+				}
+				until, err := time.Parse(time.RFC3339, replayUntil)
+				if err != nil {
+					return fmt.Errorf("invalid replay point: %w", err)
+				}
+				config = append(config, database.WithReplayUntil(until))
+			}
+
+			var keyRegexp *regexp.Regexp
+			if keyPattern != "" {
+				var err error
+				if keyRegexp, err = regexp.Compile(keyPattern); err != nil {
+					return fmt.Errorf("invalid key pattern: %w", err)
+				}
+			}
+			if idempotencyTTL <= 0 {
+				return errors.New("--idempotency-ttl must be positive")
+			}
+			if webhookAttempts < 1 {
+				return errors.New("--webhook-attempts must be at least 1")
+			}
+			if len(bridgeConsume) > 0 && len(bridgeURLs) == 0 {
+				return errors.New("--bridge-consume requires --bridge")
+			}
+			if originTTL < 0 {
+				return errors.New("--origin-ttl must not be negative")
+			}
+			var routeTimeouts map[string]time.Duration
+			for _, flag := range routeTimeoutFlags {
+				class, d, err := parseRouteTimeout(flag)
+				if err != nil {
+					return err
+				}
+				if routeTimeouts == nil {
+					routeTimeouts = map[string]time.Duration{}
+				}
+				routeTimeouts[class] = d
+				handlerOpts = append(handlerOpts, handler.WithRouteTimeout(class, d))
+			}
+			if clampTTL {
+				handlerOpts = append(handlerOpts, handler.WithTTLClamping())
+			}
+			if defaultTTL < 0 {
+				return errors.New("--default-ttl must not be negative")
+			}
+			var namespaceTTLs map[string]time.Duration
+			for _, flag := range namespaceTTLFlags {
+				namespace, d, err := parseNamespaceDefaultTTL(flag)
+				if err != nil {
+					return err
+				}
+				if namespaceTTLs == nil {
+					namespaceTTLs = map[string]time.Duration{}
+				}
+				namespaceTTLs[namespace] = d
+				handlerOpts = append(handlerOpts, handler.WithNamespaceDefaultTTL(namespace, d))
+			}
+			if breakerThreshold < 0 {
+				return errors.New("--breaker-threshold must not be negative")
+			}
+			if breakerThreshold > 0 && breakerCooldown <= 0 {
+				return errors.New("--breaker-cooldown must be positive")
+			}
+			if breakerThreshold > 0 {
+				handlerOpts = append(handlerOpts, handler.WithCircuitBreaker(breakerThreshold, breakerCooldown))
+			}
+			if writeLanes < 0 {
+				return errors.New("--write-lanes must not be negative")
+			}
+			if writeLanes > 0 && priorityWeight <= 0 {
+				return errors.New("--priority-weight must be positive")
+			}
+			if writeLanes > 0 {
+				handlerOpts = append(handlerOpts, handler.WithWriteLanes(writeLanes, priorityWeight))
+			}
+			if fanOutWorkers < 0 {
+				return errors.New("--fan-out-workers must not be negative")
+			}
+			if fanOutWorkers > 0 {
+				handlerOpts = append(handlerOpts, handler.WithFanOutWorkers(fanOutWorkers))
+			}
+			if len(logRedact) > 0 {
+				handlerOpts = append(handlerOpts, handler.WithLogRedaction(logRedact...))
+			}
+			if logBodyLimit < 0 {
+				return errors.New("--log-body-limit must not be negative")
+			}
+			handlerOpts = append(handlerOpts, handler.WithLogBodyLimit(logBodyLimit))
+			var logSampleRates map[string]float64
+			for _, flag := range logSampleFlags {
+				class, rate, err := parseLogSample(flag)
+				if err != nil {
+					return err
+				}
+				if logSampleRates == nil {
+					logSampleRates = map[string]float64{}
+				}
+				logSampleRates[class] = rate
+				handlerOpts = append(handlerOpts, handler.WithLogSampling(class, rate))
+			}
+			switch {
+			case disableAdmin:
+				handlerOpts = append(handlerOpts, handler.WithoutAdmin())
+			case adminToken != "":
+				handlerOpts = append(handlerOpts, handler.WithAdminToken(adminToken))
+			}
+			var channelACL []string
+			for _, flag := range channelACLFlags {
+				g, err := parseChannelGrant(flag)
+				if err != nil {
+					return err
+				}
+				channelACL = append(channelACL, g.pattern+":"+g.permissions.String())
+				handlerOpts = append(handlerOpts, handler.WithChannelACL(g.token, g.pattern, g.permissions))
+			}
+			if originURL != "" {
+				o, err := httpOrigin(originURL)
+				if err != nil {
+					return err
+				}
+				handlerOpts = append(handlerOpts, handler.WithOrigin(o, originTTL))
+			}
+
+			var bridges []externalBridge
+			defer func() {
+				for _, b := range bridges {
+					_ = b.Close()
+				}
+			}()
+			var redactedBridges []string
+			for _, u := range bridgeURLs {
+				b, err := dialBridge(u)
+				if err != nil {
+					return err
+				}
+				bridges = append(bridges, b)
+				redactedBridges = append(redactedBridges, redactURL(u))
+				handlerOpts = append(handlerOpts, handler.WithBridges(b))
+			}
+
+			if mirrorURL != "" {
+				m, err := dialMirror(mirrorURL)
+				if err != nil {
+					return err
+				}
+				defer m.Close() // Deferred calls run after the database has shut down and drained its queued writes
+				config = append(config, database.WithMirror(m))
+			}
 
 			db, err := database.NewInMemoryDatabase(config...) // Configure database
 			if err != nil {
 				return err
 			}
 
-			dbSettings := db.GetSettings()
+			// Peers identify this instance by the node ID of the database, which is only known once it exists
+			var redactedPeers []string
+			if len(peerURLs) > 0 {
+				p, err := bridge.NewPeers(db.GetInfo().NodeID, peerURLs, logger)
+				if err != nil {
+					return err
+				}
+				defer p.Close()
+				for _, u := range peerURLs {
+					redactedPeers = append(redactedPeers, redactURL(u))
+				}
+				handlerOpts = append(handlerOpts, handler.WithBridges(p))
+			}
+
+			// Listen before printing the settings so that the actual address is known when binding to port 0
+			listener, err := listen(host, unixSocket)
+			if err != nil {
+				return err
+			}
+
 			s := Settings{
-				Host:                      host,
-				AofStartupFile:            dbSettings.AofStartupFile,
-				ShouldAofPersist:          shouldAofPersist,
-				AofPersistFile:            dbSettings.AofPersistFile,
-				AofPersistencePeriod:      dbSettings.AofPersistencePeriod,
-				DbStartupFile:             dbSettings.DatabaseStartupFile,
-				ShouldDatabasePersist:     dbSettings.ShouldDatabasePersist,
-				DatabasePersistFile:       dbSettings.DatabasePersistFile,
-				DatabasePersistencePeriod: dbSettings.DatabasePersistencePeriod,
+				Host:              listener.Addr().String(),
+				Network:           listener.Addr().Network(),
+				Settings:          db.GetSettings(),
+				ReadTimeout:       time.Duration(readTimeout) * time.Second,
+				ReadHeaderTimeout: time.Duration(readHeaderTimeout) * time.Second,
+				WriteTimeout:      time.Duration(writeTimeout) * time.Second,
+				IdleTimeout:       time.Duration(idleTimeout) * time.Second,
+				MaxHeaderBytes:    maxHeaderBytes,
+				MaxSubscribers:    maxSubscribers,
+				SubscribersPerIP:  maxSubscribersPerIP,
+				SlowConsumer:      slowConsumerTimeout,
+				FanOutWorkers:     fanOutWorkers,
+				KeepAlives:        keepAlives,
+				HTTP2:             enableHTTP2,
+				CoalesceReads:     coalesceReads,
+				MaxKeyLength:      maxKeyLength,
+				MaxValueLength:    maxValueLength,
+				MaxMessageLength:  maxMessageLength,
+				MinTTL:            minTTL,
+				MaxTTL:            maxTTL,
+				ClampTTL:          clampTTL,
+				DefaultTTL:        defaultTTL,
+				NamespaceTTLs:     namespaceTTLs,
+				KeyPattern:        keyPattern,
+				IdempotencyTTL:    time.Duration(idempotencyTTL) * time.Second,
+				NamespaceOpsLimit: opsLimits,
+				WebhookAttempts:   webhookAttempts,
+				WebhookBackoff:    webhookBackoff,
+				Warmup:            warmup,
+				Bridges:           redactedBridges,
+				BridgeConsume:     bridgeConsume,
+				Peers:             redactedPeers,
+				Mirror:            redactURL(mirrorURL),
+				RouteTimeouts:     routeTimeouts,
+				LogRedact:         logRedact,
+				LogBodyLimit:      logBodyLimit,
+				LogSampleRates:    logSampleRates,
+				AdminAuth:         adminToken != "",
+				AdminDisabled:     disableAdmin,
+				ChannelACL:        channelACL,
+			}
+			if originURL != "" {
+				s.Origin = redactOriginURL(originURL)
+				s.OriginTTL = originTTL
+			}
+			if breakerThreshold > 0 {
+				s.BreakerThreshold = breakerThreshold
+				s.BreakerCooldown = breakerCooldown
+			}
+			if writeLanes > 0 {
+				s.WriteLanes = writeLanes
+				s.PriorityWeight = priorityWeight
+			}
+			if databaseStartupFile != "" || aofStartupFile != "" {
+				summary := db.GetStartupSummary()
+				s.Startup = &StartupSummary{Loaded: summary.Loaded, Skipped: summary.Skipped, Malformed: summary.Malformed,
+					Duplicates: summary.Duplicates, Expired: summary.Expired}
 			}
 			out, err := json.MarshalIndent(s, "", "\t")
 			if err != nil {
 				return errors.New(fmt.Sprintf("error marshalling response: %v", err))
 			}
 
-			out = []byte(fmt.Sprintf("STARTING DATABASE\nSTART_JSON_SETTINGS\n%s\nEND_JSON_SETTINGS\n", string(out)))
+			out = []byte(fmt.Sprintf("STARTING DATABASE\nSTART_JSON_SETTINGS\n%s\nEND_JSON_SETTINGS\nLISTENING_ON %s\n", string(out), s.Host))
 			_, err = cmd.OutOrStdout().Write(out)
 			if err != nil {
 				return err
@@ -131,13 +535,52 @@ Flags can be provided to configure the database`,
 			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
 			defer stop()
 
+			// Persist whatever is possible if a handler panics so that unsaved data survives a later crash
+			handlerOpts = append(handlerOpts,
+				handler.WithMaxSubscribers(maxSubscribers),
+				handler.WithMaxSubscribersPerIP(maxSubscribersPerIP),
+				handler.WithSlowConsumerTimeout(slowConsumerTimeout),
+				handler.WithPanicHook(db.Persist),
+				handler.WithMaxKeyLength(maxKeyLength),
+				handler.WithMaxValueLength(maxValueLength),
+				handler.WithMaxMessageLength(maxMessageLength),
+				handler.WithTTLBounds(minTTL, maxTTL),
+				handler.WithDefaultTTL(defaultTTL),
+				handler.WithKeyPattern(keyRegexp),
+				handler.WithIdempotencyTTL(s.IdempotencyTTL),
+				handler.WithWebhookRetries(webhookAttempts, webhookBackoff),
+				handler.WithConfig(s))
+			if coalesceReads {
+				handlerOpts = append(handlerOpts, handler.WithReadCoalescing())
+			}
+			hd := handler.NewHandler(db, logger, handlerOpts...)
+
+			// Consume from the bridges once the handler can deliver to its subscribers
+			for _, b := range bridges {
+				for _, channel := range bridgeConsume {
+					if err = b.Consume(channel, hd.Deliver); err != nil {
+						return err
+					}
+				}
+			}
+
 			h := &http.Server{
-				Addr:    host,
-				Handler: handler.NewHandler(db, logger),
+				Handler:           hd,
+				ReadTimeout:       s.ReadTimeout,
+				ReadHeaderTimeout: s.ReadHeaderTimeout,
+				WriteTimeout:      s.WriteTimeout,
+				IdleTimeout:       s.IdleTimeout,
+				MaxHeaderBytes:    s.MaxHeaderBytes,
 				BaseContext: func(listener net.Listener) context.Context {
 					return ctx
 				},
 			}
+			h.SetKeepAlivesEnabled(keepAlives)
+			if enableHTTP2 {
+				h.Protocols = new(http.Protocols)
+				h.Protocols.SetHTTP1(true)
+				h.Protocols.SetUnencryptedHTTP2(true)
+			}
 
 			shutdownWG := &sync.WaitGroup{} // Force server shutdown to wait
 			shutdownWG.Add(1)
@@ -150,7 +593,11 @@ Flags can be provided to configure the database`,
 
 			g, gCtx := errgroup.WithContext(ctx)
 			g.Go(func() error {
-				return h.ListenAndServe()
+				return h.Serve(listener)
+			})
+			g.Go(func() error { // Run schedules until the server shuts down
+				hd.RunScheduler(gCtx)
+				return nil
 			})
 			g.Go(func() error { // Allow server shutdown with a set context
 				<-gCtx.Done()
@@ -166,22 +613,89 @@ Flags can be provided to configure the database`,
 		},
 	}
 
-	serveCmd.Flags().StringVarP(&host, "host", "", "localhost:8080", "Host to listen for requests on")
+	serveCmd.Flags().StringVarP(&host, "host", "", "localhost:8080", "Host to listen for requests on. Use port 0 to pick a random free port.")
+	serveCmd.Flags().StringVar(&unixSocket, "unix-socket", "", "Path of a unix domain socket to listen on instead of the host.")
+	serveCmd.MarkFlagsMutuallyExclusive("host", "unix-socket")
 	serveCmd.Flags().BoolVar(&noLog, "no-log", false, "Disables logging output.")
+	serveCmd.Flags().StringSliceVar(&logRedact, "log-redact", nil, "The names of JSON fields whose values are replaced with [REDACTED] wherever they appear in logged request bodies, e.g. password,token. Names are matched without regard to case.")
+	serveCmd.Flags().IntVar(&logBodyLimit, "log-body-limit", 0, "Log request bodies longer than this many bytes cut off, along with their length. Zero logs every body in full.")
+	serveCmd.Flags().StringArrayVar(&logSampleFlags, "log-sample", nil, "The fraction of the successful requests of a class of routes that is logged as class=rate, e.g. read=0.01. The classes are read, scan, write and admin. Failed requests are always logged. May be repeated.")
+
+	serveCmd.Flags().IntVar(&readTimeout, "read-timeout", 30, "Maximum time in seconds to read an entire request. Zero disables the timeout.")
+	serveCmd.Flags().IntVar(&readHeaderTimeout, "read-header-timeout", 10, "Maximum time in seconds to read request headers. Zero disables the timeout.")
+	serveCmd.Flags().IntVar(&writeTimeout, "write-timeout", 30, "Maximum time in seconds to write a response. Subscriptions are exempt. Zero disables the timeout.")
+	serveCmd.Flags().IntVar(&idleTimeout, "idle-timeout", 120, "Maximum time in seconds to keep an idle keep-alive connection open. Zero disables the timeout.")
+	serveCmd.Flags().IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers in bytes.")
+	serveCmd.Flags().IntVar(&maxSubscribers, "max-subscribers", 0, "Maximum number of concurrent subscriptions. Zero means unlimited.")
+	serveCmd.Flags().IntVar(&maxSubscribersPerIP, "max-subscribers-per-ip", 0, "Maximum number of concurrent subscriptions from a single client address. Zero means unlimited.")
+	serveCmd.Flags().DurationVar(&slowConsumerTimeout, "slow-consumer-timeout", 0, "Disconnect subscribers that have been dropping messages because they cannot keep up for longer than this. Zero keeps them connected.")
+	serveCmd.Flags().IntVar(&fanOutWorkers, "fan-out-workers", 0, "Number of workers that deliver published messages to channels with more than 64 subscribers, in batches of 64. Zero starts one per CPU.")
+	serveCmd.Flags().BoolVar(&keepAlives, "keep-alives", true, "Enables HTTP keep-alives.")
+	serveCmd.Flags().BoolVar(&enableHTTP2, "http2", false, "Enables unencrypted HTTP/2 (h2c) alongside HTTP/1.1.")
+	serveCmd.Flags().StringVar(&adminToken, "admin-token", "", "Require this bearer token for the /v1/admin routes. Without it the admin routes are open to anyone who can reach the server. Every admin request is audit logged either way.")
+	serveCmd.Flags().BoolVar(&disableAdmin, "disable-admin", false, "Do not serve the /v1/admin routes at all, for hardened deployments.")
+	serveCmd.MarkFlagsMutuallyExclusive("admin-token", "disable-admin")
+	serveCmd.Flags().StringArrayVar(&channelACLFlags, "channel-acl", nil, "Grant a bearer token permissions on the channels matching a pattern, as token:pattern:publish,subscribe, e.g. s3cret:orders.*:publish. Channels matching any pattern require a token with the permission to publish or subscribe; other channels stay open. May be repeated.")
+	serveCmd.Flags().StringArrayVar(&routeTimeoutFlags, "route-timeout", nil, "A deadline for a class of routes as class=duration, e.g. write=2s. The classes are read, scan, write and admin, and subscriptions are exempt. Requests over the deadline have their context canceled and receive a 504. The --write-timeout still cuts off longer responses. May be repeated.")
+	serveCmd.Flags().IntVar(&breakerThreshold, "breaker-threshold", 0, "Open the circuit of a class of routes after this many consecutive requests fail with a 5xx, rejecting its requests with a 503 for the --breaker-cooldown. Zero disables the circuit breakers.")
+	serveCmd.Flags().DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "How long an open circuit rejects requests before letting a single request through to test whether the routes have recovered.")
+	serveCmd.Flags().IntVar(&writeLanes, "write-lanes", 0, "Run at most this many write and admin requests at once. The rest wait in a priority lane, for admin requests and writes sent with a Write-Priority: high header, or in a client lane for other writes. Zero runs every request at once.")
+	serveCmd.Flags().IntVar(&priorityWeight, "priority-weight", handler.DefaultPriorityWeight, "How many waiting priority requests are admitted for every waiting client write once --write-lanes are full.")
+	serveCmd.Flags().BoolVar(&coalesceReads, "coalesce-reads", false, "Makes identical concurrent GET requests for a key or its ttl share a single database read. Coalesced requests are counted by the db_coalesced_requests_total metric.")
+	serveCmd.Flags().IntVar(&maxKeyLength, "max-key-length", handler.DefaultMaxKeyLength, "Maximum key length in bytes.")
+	serveCmd.Flags().IntVar(&maxValueLength, "max-value-length", handler.DefaultMaxValueLength, "Maximum value length in bytes.")
+	serveCmd.Flags().IntVar(&maxMessageLength, "max-message-length", handler.DefaultMaxMessageLength, "Maximum published message length in bytes. Longer messages receive a 413.")
+	serveCmd.Flags().Int64Var(&minTTL, "min-ttl", 0, "Minimum ttl in seconds.")
+	serveCmd.Flags().Int64Var(&maxTTL, "max-ttl", 0, "Maximum ttl in seconds. Zero means unlimited.")
+	serveCmd.Flags().BoolVar(&clampTTL, "clamp-ttl", false, "Clamp ttls outside of --min-ttl and --max-ttl to the nearest bound instead of rejecting the request.")
+	serveCmd.Flags().DurationVar(&defaultTTL, "default-ttl", 0, "The ttl of keys written without a ttl or expiresAt, so that every key eventually expires. A write with \"ttl\": null still never expires. Zero means that keys written without a ttl never expire.")
+	serveCmd.Flags().StringArrayVar(&namespaceTTLFlags, "namespace-default-ttl", nil, "The default ttl of the keys before the first colon as namespace:duration, e.g. sessions:30m, overriding --default-ttl. Zero makes the keys of the namespace never expire by default. May be repeated.")
+	serveCmd.Flags().StringVar(&keyPattern, "key-pattern", "", "Regular expression that keys must match. Keys of any characters are accepted without one.")
+	serveCmd.Flags().Int64Var(&idempotencyTTL, "idempotency-ttl", int64(handler.DefaultIdempotencyTTL.Seconds()), "How long in seconds to remember the result of a post with an Idempotency-Key header.")
+	serveCmd.Flags().StringArrayVar(&namespaceQuotas, "namespace-quota", nil, "A quota for the keys before the first colon, as namespace:keys=N,bytes=N,ops=N. Writes over the keys or bytes quota receive a 507 and operations over the ops per second receive a 429. May be repeated.")
+	serveCmd.Flags().IntVar(&webhookAttempts, "webhook-attempts", handler.DefaultWebhookAttempts, "How many times a webhook delivery is attempted before it is dropped.")
+	serveCmd.Flags().DurationVar(&webhookBackoff, "webhook-backoff", handler.DefaultWebhookBackoff, "How long to wait before the first retry of a webhook delivery. The wait doubles for each later retry.")
+	serveCmd.Flags().StringArrayVar(&bridgeURLs, "bridge", nil, "An external broker that published messages are forwarded to, as nats://[user:pass@]host:port[?prefix=subject.prefix.]. Channels map to subjects by adding the prefix. May be repeated.")
+	serveCmd.Flags().StringArrayVar(&bridgeConsume, "bridge-consume", nil, "A channel to consume from the bridges, delivering the messages received on its subject to local subscribers. May be repeated.")
+	serveCmd.Flags().StringSliceVar(&peerURLs, "peers", nil, "The http:// urls of the other instances of the server, so that messages published on any of them reach subscribers connected to all of them. Give every instance the same list; an instance ignores the messages it relays to itself. May be repeated or comma separated.")
+	serveCmd.Flags().StringVar(&concurrencyMode, "concurrency-mode", database.ConcurrencyRWMutex, "How the database store is synchronized. One of rwmutex, sharded or cow.")
+	serveCmd.Flags().Float64Var(&ttlJitter, "ttl-jitter", 0, "Randomly spread stored ttls by up to this percentage in either direction so that keys written together do not expire together.")
+	serveCmd.Flags().IntVar(&compressionThreshold, "compression-threshold", 0, "Compress values of at least this many bytes in memory, trading CPU for memory. Zero disables compression.")
+	serveCmd.Flags().StringVar(&nodeID, "node-id", "", "The node ID recorded with every AOF operation. It should be stable across restarts. A random ID is used by default.")
+	serveCmd.Flags().StringVar(&idScheme, "id-scheme", database.IDSchemeUUIDv4, "The scheme used to generate keys for posted values. One of uuid, uuidv7, nanoid or sequential.")
 
+	serveCmd.Flags().IntVar(&loadProgressInterval, "load-progress-interval", database.DefaultLoadProgressInterval, "How many startup records to load between progress log lines. Zero disables progress logging.")
 	serveCmd.Flags().StringVar(&databaseStartupFile, "db-startup-file", "", "File containing json data to initialize the database with.")
 	serveCmd.Flags().BoolVar(&shouldDatabasePersist, "db-persist", false, "Enables database persistence.")
-	serveCmd.Flags().StringVar(&databasePersistFile, "db-persist-file", "", "File to persist the database to.")
+	serveCmd.Flags().StringVar(&databasePersistFile, "db-persist-file", "", "File to persist the database to. Required with --db-persist unless --persist-dir is given.")
 	serveCmd.Flags().IntVarP(&databasePersistencePeriod, "db-persist-cycle", "", 60, "How long the database persistence cycle should be in seconds.")
-	serveCmd.MarkFlagsRequiredTogether("db-persist-file", "db-persist")
+	serveCmd.Flags().StringVar(&writeStallPolicy, "write-stall-policy", database.WriteStallBlock, "What writes do while a snapshot holds the database. One of block (wait for it), fail (respond with a 503 and Retry-After) or buffer (append puts to the aof and apply them after the snapshot).")
 
 	serveCmd.Flags().StringVar(&aofStartupFile, "aof-startup-file", "", "File containing aof data to initialize the database with.")
+	serveCmd.Flags().StringVar(&replayUntil, "replay-until", "", "Stop replaying the aof startup file at this RFC 3339 timestamp to recover to a point in time.")
 	serveCmd.Flags().BoolVar(&shouldAofPersist, "aof-persist", false, "Enables aof persistence.")
-	serveCmd.Flags().StringVar(&aofPersistFile, "aof-persist-file", "", "File to persist aof data to.")
+	serveCmd.Flags().StringVar(&aofPersistFile, "aof-persist-file", "", "File to persist aof data to. Required with --aof-persist unless --persist-dir is given.")
 	serveCmd.Flags().IntVarP(&aofPersistencePeriod, "aof-persist-cycle", "", 1, "How long the aof persistence cycle should be in seconds.")
-	serveCmd.MarkFlagsRequiredTogether("aof-persist-file", "aof-persist")
+	serveCmd.Flags().StringVar(&persistDir, "persist-dir", "", "Directory to keep the persistence files in, as snapshot.db and appendonly.aof, for the kinds enabled by --db-persist and --aof-persist. A file named with --db-persist-file or --aof-persist-file is used as it is for that kind instead of the file in the directory. The directory must exist and be writable.")
 
+	serveCmd.Flags().IntVar(&persistAlertPeriods, "persist-alert-periods", database.DefaultPersistenceAlertPeriods, "Log a warning when aof or database persistence has not succeeded for this many of its cycles. Zero disables the warning.")
+	serveCmd.Flags().StringVar(&persistFailurePolicy, "persist-failure-policy", database.PersistenceFailureContinue, "What writes do once persistence has not succeeded for --persist-alert-periods. One of continue (keep them in memory) or reject (respond with a 503 and fail /readyz until persistence succeeds).")
+	serveCmd.Flags().Uint64Var(&minFreeDisk, "min-free-disk", 0, "Fail aof syncs and snapshots that would leave less than this many bytes free on the disk of their file. Snapshots always need their own size free.")
 	serveCmd.MarkFlagsMutuallyExclusive("db-startup-file", "aof-startup-file")
+	serveCmd.Flags().IntVar(&changeLogSize, "change-log", 0, fmt.Sprintf("Retain this many mutations for GET /v1/changes, e.g. %d. Consumers that fall further behind have to resync. Zero disables the change feed.", database.DefaultChangeLogSize))
+	serveCmd.Flags().StringVar(&evictionPolicy, "eviction-policy", "", "Evict keys once the heap grows over --memory-limit to avoid running out of memory. One of volatile-ttl or lru.")
+	serveCmd.Flags().Int64Var(&memoryLimit, "memory-limit", 0, "The heap size in bytes over which keys are evicted. Zero uses GOMEMLIMIT.")
+	serveCmd.Flags().Float64Var(&compactionRatio, "auto-compact", 0, "Compact the database to reclaim memory once this fraction of its keys were deleted, e.g. 0.5. Zero only compacts on POST /v1/admin/compact.")
+	serveCmd.Flags().BoolVar(&keyStats, "key-stats", false, "Count the reads and writes of every key for GET /v1/keys/{key}/stats. Counting slows reads and writes down a little.")
+	serveCmd.Flags().IntVar(&historySize, "history", 0, "Retain the last N versions of every key for GET /v1/keys/{key}/history and restores. Zero disables the history.")
+	serveCmd.Flags().BoolVar(&searchIndex, "search-index", false, "Index the words of every value for GET /v1/search. The index costs memory and slows writes down.")
+
+	serveCmd.Flags().StringVar(&warmupURL, "warmup-url", "", "URL to GET NDJSON entries from once the startup files are loaded, such as /v1/export of another server. /readyz responds with 503 until warmup finishes.")
+	serveCmd.Flags().StringVar(&warmupCommand, "warmup-command", "", "Shell command whose NDJSON output is loaded once the startup files are loaded. /readyz responds with 503 until warmup finishes.")
+	serveCmd.MarkFlagsMutuallyExclusive("warmup-url", "warmup-command")
+	serveCmd.Flags().StringVar(&originURL, "origin-url", "", "Fetch keys that are not stored from this url, turning the server into a read-through cache. {key} is replaced with the key, e.g. http://api:8080/items/{key}. A 200 response body is the value and a 404 means the key does not exist.")
+	serveCmd.Flags().Int64Var(&originTTL, "origin-ttl", 300, "The ttl in seconds that values fetched from the origin are stored with. Zero stores them without a ttl.")
+	serveCmd.Flags().StringVar(&mirrorURL, "mirror-url", "", "Forward every write to another server while serving reads locally, for migrating between instances. Either the http:// url of an InMemoryDB server or redis://[user:pass@]host:port[/db]. Lag is reported by the db_mirror_ metrics.")
 
 	return serveCmd
 }
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+// httpWarmupFetcher returns a fetcher that GETs NDJSON entries from the URL, such as the output of /v1/export
+func httpWarmupFetcher(url string) database.WarmupFetcher {
+	return func(ctx context.Context) ([]database.Entry, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("warmup url responded with %v", resp.Status)
+		}
+		return readWarmupEntries(resp.Body)
+	}
+}
+
+// commandWarmupFetcher returns a fetcher that runs the shell command and reads NDJSON entries from its output
+func commandWarmupFetcher(command string) database.WarmupFetcher {
+	return func(ctx context.Context) ([]database.Entry, error) {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("warmup command failed: %w: %v", err, msg)
+			}
+			return nil, fmt.Errorf("warmup command failed: %w", err)
+		}
+		return readWarmupEntries(bytes.NewReader(out))
+	}
+}
+
+// readWarmupEntries reads one {"key", "value", "ttl"} object per line, the same format /v1/export writes. Blank lines
+// are skipped, and a malformed line fails the whole warmup so that a broken source is noticed.
+func readWarmupEntries(r io.Reader) ([]database.Entry, error) {
+	var entries []database.Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var e database.Entry
+		if err := json.Unmarshal(text, &e); err != nil {
+			return nil, fmt.Errorf("invalid warmup entry on line %v: %w", line, err)
+		}
+		if e.Key == "" {
+			return nil, fmt.Errorf("invalid warmup entry on line %v: %w", line, errors.New("missing key"))
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,532 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+	"github.com/spf13/cobra"
+)
+
+func newAofCmd() *cobra.Command {
+	var aofCmd = &cobra.Command{
+		Use:   "aof",
+		Short: "Verify, dump, tail or replay an AOF",
+		Long: `This command contains sub commands for debugging AOF persistence. aof verify checks that every line
+of an AOF parses, aof dump prints its records, aof tail prints the last ones and follows those appended, and aof replay
+sends them to a running server.`,
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+
+	aofCmd.AddCommand(newAofVerifyCmd())
+	aofCmd.AddCommand(newAofDumpCmd())
+	aofCmd.AddCommand(newAofTailCmd())
+	aofCmd.AddCommand(newAofReplayCmd())
+
+	return aofCmd
+}
+
+// readAof calls f for every record of the AOF file in order, stopping at the first error f returns. Lines that cannot
+// be parsed are passed to f with an *database.AofSyntaxError.
+func readAof(file string, f func(r database.AofRecord, err error) error) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	for r, err := range database.ReadAof(in) {
+		var syntaxErr *database.AofSyntaxError
+		if err != nil && !errors.As(err, &syntaxErr) {
+			return fmt.Errorf("reading %v: %w", file, err)
+		}
+		if err = f(r, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequences tracks the last sequence number of every node to find the operations that were already seen, which
+// startup skips as duplicates
+type sequences map[string]uint64
+
+// duplicate reports whether the record repeats an operation that was already seen, recording it if it does not.
+// Legacy records without a sequence number are never duplicates.
+func (s sequences) duplicate(r database.AofRecord) bool {
+	if r.Seq == 0 {
+		return false
+	}
+	if r.Seq <= s[r.Node] {
+		return true
+	}
+	s[r.Node] = r.Seq
+	return false
+}
+
+func newAofVerifyCmd() *cobra.Command {
+	// verifyCmd checks an AOF
+	var verifyCmd = &cobra.Command{
+		Use:   "verify FILE",
+		Short: "Check that every line of an AOF is valid",
+		Long: `This command reads an AOF and reports every line that startup would skip: lines that do not parse and
+operations whose sequence number is not above the last one of their node, which are duplicates or out of order. The AOF
+format has no checksums, so a line corrupted into another valid line cannot be detected. A summary of the records, the
+nodes that wrote them and the keys that would be loaded is printed, and the command fails if any problem was found.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out := cmd.OutOrStdout()
+			var puts, deletes, problems int
+			var first, last time.Time
+			seqs := sequences{}
+			live := map[string]time.Time{} // The keys at the end of the AOF and when they expire
+			err := readAof(args[0], func(r database.AofRecord, err error) error {
+				switch {
+				case err != nil:
+					problems++
+					_, _ = fmt.Fprintf(out, "line %d: %v\n", r.Line, errors.Unwrap(err))
+					return nil
+				case seqs.duplicate(r):
+					problems++
+					_, _ = fmt.Fprintf(out, "line %d: sequence number %d of node %q is not above %d\n", r.Line, r.Seq, r.Node, seqs[r.Node])
+					return nil
+				}
+
+				if !r.Time.IsZero() {
+					if first.IsZero() {
+						first = r.Time
+					}
+					last = r.Time
+				}
+				if r.Op == "PUT" {
+					puts++
+					live[r.Key] = r.ExpiresAt()
+				} else {
+					deletes++
+					delete(live, r.Key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+			keys := 0
+			for _, expiresAt := range live {
+				if expiresAt.IsZero() || expiresAt.After(now) {
+					keys++
+				}
+			}
+			_, _ = fmt.Fprintf(out, "%d records: %d puts, %d deletes\n", puts+deletes, puts, deletes)
+			for node, seq := range seqs {
+				_, _ = fmt.Fprintf(out, "node %q: last sequence number %d\n", node, seq)
+			}
+			if !first.IsZero() {
+				_, _ = fmt.Fprintf(out, "written from %v to %v\n", first.UTC().Format(time.RFC3339Nano), last.UTC().Format(time.RFC3339Nano))
+			}
+			_, _ = fmt.Fprintf(out, "%d keys would be loaded now\n", keys)
+			if problems > 0 {
+				return fmt.Errorf("%d problems found", problems)
+			}
+			_, _ = fmt.Fprintln(out, "no problems found")
+			return nil
+		},
+	}
+
+	return verifyCmd
+}
+
+// dumpRecord is the JSON form of a record printed by dump --json
+type dumpRecord struct {
+	Line  int        `json:"line"`
+	Op    string     `json:"op"`
+	Key   string     `json:"key"`
+	Value *string    `json:"value,omitempty"`
+	TTL   *int64     `json:"ttl,omitempty"` // As written, so relative to time unless the record is a legacy record
+	Time  *time.Time `json:"time,omitempty"`
+	Seq   uint64     `json:"seq,omitempty"`
+	Node  string     `json:"node,omitempty"`
+}
+
+// printRecord prints a record on a line of its own, as JSON or as its line number, time, node and sequence number
+// followed by the operation with its quoted key, value and ttl
+func printRecord(out io.Writer, r database.AofRecord, asJSON bool) error {
+	if asJSON {
+		d := dumpRecord{Line: r.Line, Op: r.Op, Key: r.Key, Seq: r.Seq, Node: r.Node}
+		if r.Op == "PUT" {
+			d.Value, d.TTL = &r.Value, &r.TTL
+		}
+		if !r.Time.IsZero() {
+			d.Time = &r.Time
+		}
+		return json.NewEncoder(out).Encode(d)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-6d ", r.Line)
+	if r.Time.IsZero() {
+		fmt.Fprintf(&sb, "%-24s ", "-")
+	} else {
+		sb.WriteString(r.Time.UTC().Format("2006-01-02T15:04:05.000Z") + " ")
+	}
+	if r.Seq != 0 {
+		fmt.Fprintf(&sb, "%s:%d ", r.Node, r.Seq)
+	}
+	sb.WriteString(r.Op + " " + strconv.Quote(r.Key))
+	if r.Op == "PUT" {
+		sb.WriteString(" " + strconv.Quote(r.Value))
+		switch {
+		case r.TTL == -1:
+		case r.Time.IsZero():
+			fmt.Fprintf(&sb, " expires=%v", r.ExpiresAt().UTC().Format(time.RFC3339))
+		default:
+			fmt.Fprintf(&sb, " ttl=%d", r.TTL)
+		}
+	}
+	_, err := fmt.Fprintln(out, sb.String())
+	return err
+}
+
+func newAofDumpCmd() *cobra.Command {
+	var prefix string
+	var asJSON bool
+
+	// dumpCmd prints the records of an AOF
+	var dumpCmd = &cobra.Command{
+		Use:   "dump FILE",
+		Short: "Print the records of an AOF",
+		Long: `This command prints one line per record of an AOF: its line number, when it was written, the node and
+sequence number that identify it, and the operation with its quoted key, value and ttl. aof dump --prefix=user: FILE
+only prints the records of keys starting with 'user:', and --json prints every record as a JSON object instead. Lines
+that do not parse are reported on stderr.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out := cmd.OutOrStdout()
+			return readAof(args[0], func(r database.AofRecord, err error) error {
+				if err != nil {
+					_, _ = fmt.Fprintln(cmd.ErrOrStderr(), err)
+					return nil
+				}
+				if !strings.HasPrefix(r.Key, prefix) {
+					return nil
+				}
+
+				return printRecord(out, r, asJSON)
+			})
+		},
+	}
+
+	dumpCmd.Flags().StringVar(&prefix, "prefix", "", "Only print the records of keys with this prefix")
+	dumpCmd.Flags().BoolVar(&asJSON, "json", false, "Print every record as a JSON object per line")
+
+	return dumpCmd
+}
+
+// aofFollower reads the lines appended to an AOF since it last read it
+type aofFollower struct {
+	file   string
+	in     *os.File
+	offset int64 // The bytes of complete lines read so far
+	line   int   // The complete lines read so far
+}
+
+// open opens the file to read it from its start
+func (f *aofFollower) open() error {
+	in, err := os.Open(f.file)
+	if err != nil {
+		return err
+	}
+	f.close()
+	f.in, f.offset, f.line = in, 0, 0
+	return nil
+}
+
+func (f *aofFollower) close() {
+	if f.in != nil {
+		_ = f.in.Close()
+	}
+}
+
+// replaced reports whether the file was truncated, or replaced by another file, since it was opened. A file that is
+// missing for now is not, so that it is followed again once it is back.
+func (f *aofFollower) replaced() bool {
+	opened, err := f.in.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(f.file)
+	if err != nil {
+		return false
+	}
+	return !os.SameFile(opened, current) || current.Size() < f.offset
+}
+
+// next calls fn for every record on the complete lines appended since the last call, stopping at the first error fn
+// returns. A line that is still being written is left for the next call. Lines that cannot be parsed are passed to fn
+// with an *database.AofSyntaxError, like readAof does.
+func (f *aofFollower) next(fn func(r database.AofRecord, err error) error) error {
+	if _, err := f.in.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(f.in)
+	if err != nil {
+		return fmt.Errorf("reading %v: %w", f.file, err)
+	}
+	end := bytes.LastIndexByte(b, '\n')
+	if end < 0 {
+		return nil
+	}
+	b = b[:end+1]
+	base := f.line
+	f.offset += int64(len(b))
+	f.line += bytes.Count(b, []byte{'\n'})
+
+	// ReadAof numbers the lines from the start of what was read, so they are offset by the lines read before
+	for r, err := range database.ReadAof(bytes.NewReader(b)) {
+		var syntaxErr *database.AofSyntaxError
+		if errors.As(err, &syntaxErr) {
+			syntaxErr.Line += base
+		} else if err != nil {
+			return fmt.Errorf("reading %v: %w", f.file, err)
+		}
+		r.Line += base
+		if err = fn(r, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newAofTailCmd() *cobra.Command {
+	var lines int
+	var follow bool
+	var interval time.Duration
+	var prefix string
+	var asJSON bool
+
+	// tailCmd prints the last records of an AOF and follows the ones appended to it
+	var tailCmd = &cobra.Command{
+		Use:   "tail FILE",
+		Short: "Print the last records of an AOF and follow new ones",
+		Long: `This command prints the last records of an AOF like aof dump does, 10 by default. aof tail --follow FILE
+keeps checking the file and prints records as they are appended, like tail -f, until it is interrupted, so that the
+writes of a running server can be watched live. A record is printed once its line is complete. If the file is
+truncated or replaced it is followed again from its start. --prefix and --json work like they do for aof dump, and
+lines that do not parse are reported on stderr.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if lines < 0 {
+				return errors.New("--lines must not be negative")
+			}
+			if follow && interval <= 0 {
+				return errors.New("--interval must be positive")
+			}
+			// Lines that do not parse are always shown, on stderr
+			shown := func(r database.AofRecord, err error) bool {
+				return err != nil || strings.HasPrefix(r.Key, prefix)
+			}
+			show := func(r database.AofRecord, err error) error {
+				if err != nil {
+					_, _ = fmt.Fprintln(cmd.ErrOrStderr(), err)
+					return nil
+				}
+				return printRecord(cmd.OutOrStdout(), r, asJSON)
+			}
+
+			f := &aofFollower{file: args[0]}
+			if err := f.open(); err != nil {
+				return err
+			}
+			defer f.close()
+
+			// Only the last records of what was written before the command started are printed
+			type tailed struct {
+				r   database.AofRecord
+				err error
+			}
+			var last []tailed
+			err := f.next(func(r database.AofRecord, err error) error {
+				if !shown(r, err) {
+					return nil
+				}
+				last = append(last, tailed{r: r, err: err})
+				if len(last) > lines {
+					last = last[1:]
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, t := range last {
+				if err = show(t.r, t.err); err != nil {
+					return err
+				}
+			}
+			if !follow {
+				return nil
+			}
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-cmd.Context().Done():
+					return nil
+				case <-ticker.C:
+				}
+
+				if f.replaced() {
+					_, _ = fmt.Fprintf(cmd.ErrOrStderr(), "%v was truncated or replaced, following it from the start\n", f.file)
+					if err = f.open(); err != nil {
+						return err
+					}
+				}
+				err = f.next(func(r database.AofRecord, err error) error {
+					if !shown(r, err) {
+						return nil
+					}
+					return show(r, err)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		},
+	}
+
+	tailCmd.Flags().IntVarP(&lines, "lines", "n", 10, "Print this many of the last records before following")
+	tailCmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep printing records as they are appended until interrupted")
+	tailCmd.Flags().DurationVar(&interval, "interval", 250*time.Millisecond, "How often to check the file for appended records with --follow")
+	tailCmd.Flags().StringVar(&prefix, "prefix", "", "Only print the records of keys with this prefix")
+	tailCmd.Flags().BoolVar(&asJSON, "json", false, "Print every record as a JSON object per line")
+
+	return tailCmd
+}
+
+// replayer sends the records of an AOF to a running server
+type replayer struct {
+	rootURL string
+	token   string
+	dryRun  bool
+	out     io.Writer
+	client  *http.Client
+}
+
+// send sends a request for a record, failing unless the server responds with a 2xx
+func (p *replayer) send(method string, key string, body any) error {
+	u := fmt.Sprintf("%v/v1/keys/%v", p.rootURL, url.PathEscape(key))
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	if p.dryRun {
+		_, err := fmt.Fprintf(p.out, "%v %v %s\n", method, u, b)
+		return err
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Deleting a key that does not exist is what the AOF asked for
+	if resp.StatusCode/100 == 2 || (method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("server responded with %v: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func newAofReplayCmd() *cobra.Command {
+	p := replayer{client: &http.Client{Timeout: 30 * time.Second}}
+	var until string
+
+	// replayCmd sends the records of an AOF to a server
+	var replayCmd = &cobra.Command{
+		Use:   "replay FILE",
+		Short: "Replay an AOF into a running server",
+		Long: `This command sends every record of an AOF to a running server in the order they were written, as a PUT
+or DELETE of /v1/keys/{key}, so that the server ends up with the keys that starting from the AOF would load. Like
+startup, it skips lines that do not parse and duplicate operations, and --until stops at the first record written
+after an RFC 3339 timestamp. Puts that have already expired are sent as deletes and the remaining ttl of the others is
+sent. Internal keys containing a slash cannot be addressed by /v1/keys and are skipped. Replay stops at the first
+request that fails, reporting its line so that it can be fixed and the replay run again.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p.out = cmd.OutOrStdout()
+			var stop time.Time
+			if until != "" {
+				var err error
+				if stop, err = time.Parse(time.RFC3339Nano, until); err != nil {
+					return fmt.Errorf("invalid --until: %w", err)
+				}
+			}
+
+			var sent, skipped int
+			errStop := errors.New("stop")
+			seqs := sequences{}
+			err := readAof(args[0], func(r database.AofRecord, err error) error {
+				if err != nil || seqs.duplicate(r) || strings.Contains(r.Key, "/") {
+					skipped++
+					return nil
+				}
+				if !stop.IsZero() && r.Time.After(stop) {
+					return errStop
+				}
+
+				expiresAt := r.ExpiresAt()
+				switch {
+				case r.Op == "DELETE", !expiresAt.IsZero() && !expiresAt.After(time.Now()):
+					err = p.send(http.MethodDelete, r.Key, nil)
+				case expiresAt.IsZero():
+					err = p.send(http.MethodPut, r.Key, map[string]any{"value": r.Value})
+				default:
+					ttl := int64(time.Until(expiresAt).Seconds())
+					err = p.send(http.MethodPut, r.Key, map[string]any{"value": r.Value, "ttl": max(ttl, 1)})
+				}
+				if err != nil {
+					return fmt.Errorf("line %d: %v %q: %w", r.Line, r.Op, r.Key, err)
+				}
+				sent++
+				return nil
+			})
+			if err != nil && !errors.Is(err, errStop) {
+				return err
+			}
+			if !p.dryRun {
+				_, _ = fmt.Fprintf(p.out, "replayed %d records, skipped %d\n", sent, skipped)
+			}
+			return nil
+		},
+	}
+
+	replayCmd.Flags().StringVarP(&p.rootURL, "rootURL", "u", "http://localhost:8080", "The rootURL of the server to replay into.")
+	replayCmd.Flags().StringVar(&p.token, "token", "", "A bearer token to send with every request.")
+	replayCmd.Flags().StringVar(&until, "until", "", "Stop at the first record written after this RFC 3339 timestamp.")
+	replayCmd.Flags().BoolVar(&p.dryRun, "dry-run", false, "Print the requests that would be sent without sending them.")
+
+	return replayCmd
+}
@@ -0,0 +1,282 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeAof writes the lines to an AOF in a temporary directory, returning its path
+func writeAof(t *testing.T, lines ...string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "aof")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// execute runs the tools command with the arguments, returning its output
+func execute(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := NewToolsCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestAofVerify(t *testing.T) {
+	now := time.Now().UnixMilli()
+	good := writeAof(t,
+		`PUT "a" "1" -1 ts=1700000000000 seq=1 node=n1`,
+		`PUT "b" "2" 60 ts=`+itoa(now)+` seq=2 node=n1`,
+		`DELETE "a" ts=`+itoa(now)+` seq=3 node=n1`,
+		`PUT legacy value 1`,
+	)
+	out, err := execute(t, "aof", "verify", good)
+	if err != nil {
+		t.Fatalf("verify failed: %v\n%v", err, out)
+	}
+	for _, want := range []string{"4 records: 3 puts, 1 deletes", `node "n1": last sequence number 3`, "1 keys would be loaded now", "no problems found"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%v", want, out)
+		}
+	}
+
+	bad := writeAof(t,
+		`PUT "a" "1" -1 ts=1700000000000 seq=2 node=n1`,
+		`PUT "a" "1" nope ts=1700000000000 seq=3 node=n1`,
+		`PUT "a" "1" -1 ts=1700000000000 seq=2 node=n1`,
+		`PUT "a" "1" -1 ts=1700000000000 seq=2 node=n2`,
+	)
+	out, err = execute(t, "aof", "verify", bad)
+	if err == nil || err.Error() != "2 problems found" {
+		t.Errorf("err = %v; want 2 problems found", err)
+	}
+	for _, want := range []string{"line 2: invalid ttl", `line 3: sequence number 2 of node "n1" is not above 2`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%v", want, out)
+		}
+	}
+
+	if _, err = execute(t, "aof", "verify", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("verifying a missing file succeeded")
+	}
+}
+
+func TestAofDump(t *testing.T) {
+	file := writeAof(t,
+		`PUT "user:1" "a b" 30 ts=1700000000000 seq=1 node=n1`,
+		`not a record`,
+		`DELETE "user:1" ts=1700000001000 seq=2 node=n1`,
+		`PUT "other" "c" -1 ts=1700000002000 seq=3 node=n1`,
+		`PUT legacy value 1700000100`,
+	)
+
+	out, err := execute(t, "aof", "dump", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`1      2023-11-14T22:13:20.000Z n1:1 PUT "user:1" "a b" ttl=30`,
+		`3      2023-11-14T22:13:21.000Z n1:2 DELETE "user:1"`,
+		`4      2023-11-14T22:13:22.000Z n1:3 PUT "other" "c"`,
+		`5      -                        PUT "legacy" "value" expires=2023-11-14T22:15:00Z`,
+	}
+	if got := strings.Split(strings.TrimSpace(out), "\n"); !slices.Equal(got, want) {
+		t.Errorf("dump =\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	out, err = execute(t, "aof", "dump", "--json", "--prefix", "user:", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []dumpRecord
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var d dumpRecord
+		if err = dec.Decode(&d); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, d)
+	}
+	if len(records) != 2 || records[0].Value == nil || *records[0].Value != "a b" || *records[0].TTL != 30 ||
+		records[1].Op != "DELETE" || records[1].Value != nil || records[1].Seq != 2 {
+		t.Errorf("json dump = %+v; want the put and delete of user:1", records)
+	}
+}
+
+// syncBuffer is a buffer that a command can write to while the test reads it
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestAofTail(t *testing.T) {
+	file := writeAof(t,
+		`PUT "a" "1" -1 ts=1700000000000 seq=1 node=n1`,
+		`PUT "b" "2" -1 ts=1700000001000 seq=2 node=n1`,
+		`DELETE "a" ts=1700000002000 seq=3 node=n1`,
+	)
+	out, err := execute(t, "aof", "tail", "-n", "2", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`2      2023-11-14T22:13:21.000Z n1:2 PUT "b" "2"`,
+		`3      2023-11-14T22:13:22.000Z n1:3 DELETE "a"`,
+	}
+	if got := strings.Split(strings.TrimSpace(out), "\n"); !slices.Equal(got, want) {
+		t.Errorf("tail =\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Following prints the records as their lines are completed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := NewToolsCmd()
+	var followed syncBuffer
+	cmd.SetOut(&followed)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"aof", "tail", "-f", "-n", "0", "--interval", "10ms", "--prefix", "user:", file})
+	done := make(chan error)
+	go func() { done <- cmd.ExecuteContext(ctx) }()
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(followed.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("followed output %q does not contain %q", followed.String(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	appendAof := func(text string) {
+		t.Helper()
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.WriteString(text)
+		_ = f.Close()
+	}
+
+	appendAof(`PUT "other" "x" -1 ts=1700000003000 seq=4 node=n1` + "\n" + `PUT "user:1" "half`)
+	time.Sleep(50 * time.Millisecond)
+	if out := followed.String(); out != "" {
+		t.Errorf("followed output = %q before any matching line was complete; want none", out)
+	}
+	appendAof(`way" -1 ts=1700000004000 seq=5 node=n1` + "\n")
+	waitFor(`5      2023-11-14T22:13:24.000Z n1:5 PUT "user:1" "halfway"`)
+
+	// A replaced file is followed from its start
+	replacement := file + ".new"
+	if err = os.WriteFile(replacement, []byte(`DELETE "user:1" ts=1700000005000 seq=6 node=n1`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(replacement, file); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(`1      2023-11-14T22:13:25.000Z n1:6 DELETE "user:1"`)
+
+	cancel()
+	if err = <-done; err != nil {
+		t.Errorf("tail --follow = %v once interrupted; want nil", err)
+	}
+}
+
+func TestAofReplay(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath()+" "+string(b))
+		if r.URL.Path == "/v1/keys/fail" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	recent := itoa(now.UnixMilli())
+	file := writeAof(t,
+		`PUT "a b" "1" -1 ts=1700000000000 seq=1 node=n1`,
+		`PUT "ttl" "2" 600 ts=`+recent+` seq=2 node=n1`,
+		`garbage`,
+		`PUT "a b" "dup" -1 ts=1700000000000 seq=1 node=n1`,
+		`DELETE "gone" ts=`+recent+` seq=3 node=n1`,
+		`PUT "_ratelimit/x" "{}" 60 ts=`+recent+` seq=4 node=n1`,
+		`PUT "expired" "v" 10 ts=1700000000000 seq=5 node=n1`,
+		`PUT "late" "v" -1 ts=`+itoa(now.Add(time.Hour).UnixMilli())+` seq=6 node=n1`,
+	)
+
+	out, err := execute(t, "aof", "replay", "-u", server.URL, "--until", now.Add(time.Minute).Format(time.RFC3339), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`PUT /v1/keys/a%20b {"value":"1"}`,
+		`PUT /v1/keys/ttl {"ttl":600,"value":"2"}`,
+		`DELETE /v1/keys/gone `,
+		`DELETE /v1/keys/expired `,
+	}
+	// The remaining ttl may have ticked over a second
+	if len(requests) == 4 {
+		requests[1] = strings.Replace(requests[1], `"ttl":599`, `"ttl":600`, 1)
+	}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests =\n%v\nwant\n%v", strings.Join(requests, "\n"), strings.Join(want, "\n"))
+	}
+	if !strings.Contains(out, "replayed 4 records, skipped 3") {
+		t.Errorf("output = %q; want 4 replayed and 3 skipped", out)
+	}
+
+	// A failed request stops the replay at its line
+	requests = nil
+	file = writeAof(t, `PUT "fail" "1" -1`, `PUT "next" "1" -1`)
+	if _, err = execute(t, "aof", "replay", "-u", server.URL, file); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("err = %v; want the failure of line 1", err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("requests = %v; want the replay to stop at the failure", requests)
+	}
+
+	// A dry run only prints the requests
+	requests = nil
+	out, err = execute(t, "aof", "replay", "-u", server.URL, "--dry-run", file)
+	if err != nil || len(requests) != 0 || !strings.Contains(out, "PUT "+server.URL+`/v1/keys/next {"value":"1"}`) {
+		t.Errorf("dry run = %q, %v with %v requests; want the requests printed", out, err, len(requests))
+	}
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,162 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pthav/InMemoryDB/bench"
+	"github.com/spf13/cobra"
+)
+
+func newBenchCmd() *cobra.Command {
+	var benchCmd = &cobra.Command{
+		Use:   "bench",
+		Short: "Benchmark the database and check for regressions",
+		Long: `This command contains sub commands for measuring the throughput and latency of the database under each
+concurrency mode. bench run records a report, and bench compare checks a report against a baseline, such as the one
+recorded in bench/baseline.json, so that performance changes can be validated before they are merged.`,
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+
+	benchCmd.AddCommand(newBenchRunCmd())
+	benchCmd.AddCommand(newBenchCompareCmd())
+
+	return benchCmd
+}
+
+// readReport reads a report written by bench run
+func readReport(file string) (bench.Report, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return bench.Report{}, err
+	}
+	defer in.Close()
+
+	var report bench.Report
+	if err = json.NewDecoder(in).Decode(&report); err != nil {
+		return bench.Report{}, fmt.Errorf("reading %v: %w", file, err)
+	}
+	return report, nil
+}
+
+// printResults prints the results as a table
+func printResults(w io.Writer, results []bench.Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "NAME\tOPS/S\tP50\tP99")
+	for _, r := range results {
+		_, _ = fmt.Fprintf(tw, "%v\t%.0f\t%v\t%v\n", r.Name, r.OpsPerSec, r.P50, r.P99)
+	}
+	_ = tw.Flush()
+}
+
+func newBenchRunCmd() *cobra.Command {
+	cfg := bench.DefaultConfig()
+	var out string
+
+	// runCmd runs the benchmarks and records a report
+	var runCmd = &cobra.Command{
+		Use:   "run",
+		Short: "Run the benchmarks and write a report",
+		Long: `This command runs a read only, a write only and a mixed workload against a database in every concurrency
+mode, one after the other, and writes a JSON report of the throughput and the p50 and p99 latencies of each. The
+report can be kept as a baseline for bench compare. Results are only comparable between runs on the same machine with
+the same flags, which the report records. A table of the results is printed to stderr.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report, err := bench.Run(cmd.Context(), cfg)
+			if err != nil {
+				return err
+			}
+			printResults(cmd.ErrOrStderr(), report.Results)
+
+			w, err := output(cmd, out)
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(report)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		},
+	}
+
+	runCmd.Flags().DurationVar(&cfg.Duration, "duration", cfg.Duration, "How long each workload runs for")
+	runCmd.Flags().IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "The number of goroutines making operations")
+	runCmd.Flags().IntVar(&cfg.Keys, "keys", cfg.Keys, "The number of keys stored before each workload")
+	runCmd.Flags().IntVar(&cfg.ValueSize, "value-size", cfg.ValueSize, "The length of every value in bytes")
+	runCmd.Flags().StringSliceVar(&cfg.Modes, "mode", cfg.Modes, "The concurrency modes to run the workloads against")
+	runCmd.Flags().StringVarP(&out, "output", "o", "", "Write the report to a file instead of STDOUT")
+
+	return runCmd
+}
+
+func newBenchCompareCmd() *cobra.Command {
+	t := bench.DefaultThresholds
+
+	// compareCmd checks a report against a baseline
+	var compareCmd = &cobra.Command{
+		Use:   "compare BASELINE [CURRENT]",
+		Short: "Compare a report against a baseline",
+		Long: `This command compares every result of the BASELINE report to the result of the same name in the CURRENT
+report, or in a new run with the config of the baseline if there is no CURRENT. It prints the change in throughput
+and p99 latency of each, and fails if any result is slower than --max-throughput-drop or --max-latency-increase allow
+or is missing, so it can gate changes in scripts and CI. The thresholds are fractions of the baseline, e.g. 0.1 for
+10%.`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			baseline, err := readReport(args[0])
+			if err != nil {
+				return err
+			}
+			var current bench.Report
+			if len(args) == 2 {
+				current, err = readReport(args[1])
+			} else {
+				current, err = bench.Run(cmd.Context(), baseline.Config)
+			}
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(tw, "NAME\tOPS/S\tCHANGE\tP99\tCHANGE\tRESULT")
+			regressions := 0
+			for _, c := range bench.Compare(baseline, current, t) {
+				verdict := "ok"
+				if c.Regressed {
+					verdict = "REGRESSED"
+					regressions++
+				}
+				if c.Missing {
+					_, _ = fmt.Fprintf(tw, "%v\t%.0f -> missing\t\t%v -> missing\t\t%v\n", c.Name, c.Baseline.OpsPerSec, c.Baseline.P99, verdict)
+					continue
+				}
+				_, _ = fmt.Fprintf(tw, "%v\t%.0f -> %.0f\t%+.1f%%\t%v -> %v\t%+.1f%%\t%v\n", c.Name, c.Baseline.OpsPerSec,
+					c.Current.OpsPerSec, c.ThroughputChange*100, c.Baseline.P99, c.Current.P99, c.LatencyChange*100, verdict)
+			}
+			if err = tw.Flush(); err != nil {
+				return err
+			}
+
+			if regressions > 0 {
+				// The regressions are the result, not a misuse of the command
+				cmd.SilenceUsage = true
+				return errors.New("performance regressed")
+			}
+			return nil
+		},
+	}
+
+	compareCmd.Flags().Float64Var(&t.Throughput, "max-throughput-drop", t.Throughput, "The largest drop in operations per second that is not a regression, as a fraction of the baseline")
+	compareCmd.Flags().Float64Var(&t.Latency, "max-latency-increase", t.Latency, "The largest increase of the p99 latency that is not a regression, as a fraction of the baseline")
+
+	return compareCmd
+}
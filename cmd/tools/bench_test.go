@@ -0,0 +1,68 @@
+package tools
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pthav/InMemoryDB/bench"
+)
+
+// writeReport writes the report to a temporary directory, returning its path
+func writeReport(t *testing.T, name string, report bench.Report) string {
+	t.Helper()
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), name)
+	if err = os.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestBenchRunAndCompare(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "baseline.json")
+	if _, err := execute(t, "bench", "run", "--duration", "10ms", "--keys", "10", "--mode", "rwmutex", "-o", file); err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := readReport(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(baseline.Results) != len(bench.Workloads) || baseline.Config.Keys != 10 {
+		t.Fatalf("report = %+v; want a result per workload of the flags", baseline)
+	}
+
+	// A report compared to itself has not regressed
+	out, err := execute(t, "bench", "compare", file, file)
+	if err != nil {
+		t.Fatalf("comparing a report to itself: %v\n%v", err, out)
+	}
+	if strings.Count(out, " ok\n") != len(bench.Workloads) {
+		t.Errorf("compare =\n%v\nwant every result ok", out)
+	}
+
+	slower := baseline
+	slower.Results = []bench.Result{baseline.Results[0], baseline.Results[1]}
+	slower.Results[0].OpsPerSec /= 2
+	slower.Results[1].P99 += time.Second
+	out, err = execute(t, "bench", "compare", file, writeReport(t, "slower.json", slower))
+	if err == nil || err.Error() != "performance regressed" {
+		t.Errorf("err = %v; want performance regressed", err)
+	}
+	if strings.Count(out, "REGRESSED") != 3 || !strings.Contains(out, "missing") {
+		t.Errorf("compare =\n%v\nwant the slower, higher p99 and missing results regressed", out)
+	}
+
+	// Loose enough thresholds allow the slower results once none are missing
+	slower.Results = append(slower.Results, baseline.Results[2])
+	if out, err = execute(t, "bench", "compare", "--max-throughput-drop", "0.6", "--max-latency-increase", "1e12",
+		file, writeReport(t, "slower.json", slower)); err != nil {
+		t.Errorf("comparing within the thresholds: %v\n%v", err, out)
+	}
+}
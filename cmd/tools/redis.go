@@ -0,0 +1,175 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pthav/InMemoryDB/redisfile"
+	"github.com/spf13/cobra"
+)
+
+func newRedisCmd() *cobra.Command {
+	var redisCmd = &cobra.Command{
+		Use:   "redis",
+		Short: "Convert between Redis files and snapshots",
+		Long: `This command contains sub commands for migrating between Redis and InMemoryDB. redis import converts the
+string keys of a Redis RDB or AOF into a JSON startup file, and redis export converts a snapshot into the commands of
+a Redis AOF.`,
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+
+	redisCmd.AddCommand(newRedisImportCmd())
+	redisCmd.AddCommand(newRedisExportCmd())
+
+	return redisCmd
+}
+
+// output returns the file to write to, or the output of the command if there is none
+func output(cmd *cobra.Command, file string) (io.WriteCloser, error) {
+	if file == "" {
+		return nopCloser{cmd.OutOrStdout()}, nil
+	}
+	return os.Create(file)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// snapshotEntry is an entry of a JSON startup file, whose ttl is the unix time in seconds at which it expires
+type snapshotEntry struct {
+	Value string `json:"value"`
+	TTL   *int64 `json:"ttl,omitempty"`
+}
+
+func newRedisImportCmd() *cobra.Command {
+	var db int
+	var out string
+
+	// importCmd converts a Redis file into a startup file
+	var importCmd = &cobra.Command{
+		Use:   "import FILE",
+		Short: "Convert a Redis RDB or AOF into a startup file",
+		Long: `This command reads the string keys of a database of a Redis RDB file, AOF, or AOF with an RDB preamble,
+and writes them as a JSON startup file that a server can be started from with --startup-file. The files of a Redis 7
+appendonly directory can be imported by concatenating them in the order of their manifest. Keys of other types,
+commands that are not understood, the keys they name, and keys that have already expired are skipped and counted on
+stderr. Expirations of commands such as SETEX, which are relative to when they were written, are taken as relative
+to now.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			result, err := redisfile.Read(in, db)
+			if err != nil {
+				return fmt.Errorf("reading %v: %w", args[0], err)
+			}
+
+			store := make(map[string]snapshotEntry, len(result.Entries))
+			for _, e := range result.Entries {
+				s := snapshotEntry{Value: e.Value}
+				if !e.ExpiresAt.IsZero() {
+					// Round up so that the key never expires before it would have in Redis
+					ttl := e.ExpiresAt.Add(time.Second - 1).Unix()
+					s.TTL = &ttl
+				}
+				store[e.Key] = s
+			}
+
+			w, err := output(cmd, out)
+			if err != nil {
+				return err
+			}
+			err = json.NewEncoder(w).Encode(map[string]any{"dbStore": store})
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+
+			stderr := cmd.ErrOrStderr()
+			_, _ = fmt.Fprintf(stderr, "imported %d keys\n", len(result.Entries))
+			for _, reason := range slices.Sorted(maps.Keys(result.Skipped)) {
+				_, _ = fmt.Fprintf(stderr, "skipped %d: %v\n", result.Skipped[reason], reason)
+			}
+			return nil
+		},
+	}
+
+	importCmd.Flags().IntVar(&db, "db", 0, "The Redis database to import")
+	importCmd.Flags().StringVarP(&out, "output", "o", "", "Write the startup file to a file instead of STDOUT")
+
+	return importCmd
+}
+
+func newRedisExportCmd() *cobra.Command {
+	var prefix, out string
+
+	// exportCmd converts a snapshot into Redis commands
+	var exportCmd = &cobra.Command{
+		Use:   "export SNAPSHOT",
+		Short: "Convert a snapshot into a Redis AOF",
+		Long: `This command reads a snapshot, either a JSON startup file or a file written by persistence, and writes
+every key as a SET followed by a PEXPIREAT if it expires. The output can be loaded as the appendonly file of a Redis
+server, or sent to a running one with redis-cli --pipe. Keys that have already expired and internal keys containing
+a slash are skipped, and --prefix only exports the keys with a prefix.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := readSnapshot(args[0])
+			if err != nil {
+				return err
+			}
+
+			f, err := output(cmd, out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			now := time.Now()
+			w := redisfile.NewWriter(f)
+			var exported, skipped int
+			for _, key := range slices.Sorted(maps.Keys(entries)) {
+				e := entries[key]
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				if strings.Contains(key, "/") || (!e.ExpiresAt.IsZero() && !e.ExpiresAt.After(now)) {
+					skipped++
+					continue
+				}
+				if err = w.Write(redisfile.Entry{Key: key, Value: e.Value, ExpiresAt: e.ExpiresAt}); err != nil {
+					return err
+				}
+				exported++
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+			if err = f.Close(); err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(cmd.ErrOrStderr(), "exported %d keys, skipped %d\n", exported, skipped)
+			return nil
+		},
+	}
+
+	exportCmd.Flags().StringVar(&prefix, "prefix", "", "Only export the keys with this prefix")
+	exportCmd.Flags().StringVarP(&out, "output", "o", "", "Write the commands to a file instead of STDOUT")
+
+	return exportCmd
+}
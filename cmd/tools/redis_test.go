@@ -0,0 +1,81 @@
+package tools
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pthav/InMemoryDB/redisfile"
+)
+
+// respCommand encodes a command as a Redis AOF holds it
+func respCommand(args ...string) string {
+	s := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		s += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return s
+}
+
+func TestRedisImport(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	file := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof := respCommand("SET", "a", "1") +
+		respCommand("SET", "b", "2", "PXAT", strconv.FormatInt(later.UnixMilli(), 10)) +
+		respCommand("LPUSH", "list", "x") +
+		respCommand("SELECT", "1") +
+		respCommand("SET", "other", "3")
+	if err := os.WriteFile(file, []byte(aof), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "startup.json")
+	if _, err := execute(t, "redis", "import", "-o", out, file); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readSnapshot(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries["a"].Value != "1" || !entries["a"].ExpiresAt.IsZero() ||
+		entries["b"].Value != "2" || entries["b"].ExpiresAt.Unix() != later.Add(time.Second-1).Unix() {
+		t.Errorf("entries = %+v; want a and b from database 0", entries)
+	}
+
+	stdout, err := execute(t, "redis", "import", "--db", "1", file)
+	if err != nil || !strings.Contains(stdout, `"other":{"value":"3"}`) {
+		t.Errorf("import of database 1 = %q, %v; want the other key", stdout, err)
+	}
+}
+
+func TestRedisExport(t *testing.T) {
+	later := time.Now().Add(time.Hour).Unix()
+	snapshot := writeSnapshot(t, map[string][2]any{
+		"user:1":        {"a", int64(0)},
+		"user:2":        {"b", later},
+		"other":         {"c", int64(0)},
+		"expired":       {"d", int64(1700000000)},
+		"_ratelimit/id": {"{}", int64(0)},
+	})
+
+	out, err := execute(t, "redis", "export", snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := redisfile.Read(strings.NewReader(out), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 3 || result.Entries[0].Key != "other" || result.Entries[2].Key != "user:2" ||
+		result.Entries[2].ExpiresAt.Unix() != later {
+		t.Errorf("entries = %+v; want other, user:1 and user:2", result.Entries)
+	}
+
+	out, err = execute(t, "redis", "export", "--prefix", "user:", snapshot)
+	if err != nil || strings.Contains(out, "other") || !strings.Contains(out, "user:1") {
+		t.Errorf("export with a prefix = %q, %v; want only the user keys", out, err)
+	}
+}
@@ -0,0 +1,195 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+	"github.com/spf13/cobra"
+)
+
+func newSnapshotCmd() *cobra.Command {
+	var snapshotCmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Compare snapshots",
+		Long: `This command contains sub commands for working with snapshots, either JSON startup files or files written
+by persistence. snapshot diff compares the keys of two snapshots.`,
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+
+	snapshotCmd.AddCommand(newSnapshotDiffCmd())
+
+	return snapshotCmd
+}
+
+// readSnapshot reads the entries of the snapshot file
+func readSnapshot(file string) (map[string]database.SnapshotEntry, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	entries, _, err := database.ReadSnapshot(in)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %w", file, err)
+	}
+	return entries, nil
+}
+
+// The changes to a key reported by snapshot diff
+const (
+	changeAdded   = "added"   // The key is only in the second snapshot
+	changeRemoved = "removed" // The key is only in the first snapshot
+	changeValue   = "changed" // The key has a different value, and possibly a different expiration
+	changeTTL     = "ttl"     // The key has the same value but a different expiration
+)
+
+// diffEntry is the JSON form of an entry printed by snapshot diff --json
+type diffEntry struct {
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// diffRecord is the JSON form of a change printed by snapshot diff --json
+type diffRecord struct {
+	Key    string     `json:"key"`
+	Change string     `json:"change"`
+	Old    *diffEntry `json:"old,omitempty"`
+	New    *diffEntry `json:"new,omitempty"`
+}
+
+func newDiffEntry(e database.SnapshotEntry, ok bool) *diffEntry {
+	if !ok {
+		return nil
+	}
+	d := diffEntry{Value: e.Value}
+	if !e.ExpiresAt.IsZero() {
+		d.ExpiresAt = &e.ExpiresAt
+	}
+	return &d
+}
+
+// formatExpiry returns when the entry expires as printed by snapshot diff
+func formatExpiry(e database.SnapshotEntry) string {
+	if e.ExpiresAt.IsZero() {
+		return "never"
+	}
+	return e.ExpiresAt.UTC().Format(time.RFC3339)
+}
+
+func newSnapshotDiffCmd() *cobra.Command {
+	var asJSON, includeExpired bool
+	var tolerance time.Duration
+
+	// diffCmd compares two snapshots
+	var diffCmd = &cobra.Command{
+		Use:   "diff A B",
+		Short: "Print the keys that differ between two snapshots",
+		Long: `This command compares the keys of two snapshots, such as a backup and the file it was taken from, or the
+files of two nodes that should have converged. It prints one line per key that differs, sorted by key: '+' for keys
+that were added in B, '-' for keys that were removed from it, '~' for keys whose value changed and 'ttl' for keys whose
+value is the same but which expire at a different time. Expirations within --ttl-tolerance of each other, such as
+those of a node that applied the same write a second later, are the same. Entries that have expired by now are ignored
+unless --include-expired is set, since neither snapshot would load them. Versions and update times are not compared.
+--json prints every change as a JSON object instead. Like diff, the command fails if the snapshots differ.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := readSnapshot(args[0])
+			if err != nil {
+				return err
+			}
+			b, err := readSnapshot(args[1])
+			if err != nil {
+				return err
+			}
+			if !includeExpired {
+				now := time.Now()
+				expired := func(_ string, e database.SnapshotEntry) bool {
+					return !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(now)
+				}
+				maps.DeleteFunc(a, expired)
+				maps.DeleteFunc(b, expired)
+			}
+
+			keys := slices.Collect(maps.Keys(a))
+			for key := range b {
+				if _, ok := a[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			slices.Sort(keys)
+
+			out := cmd.OutOrStdout()
+			enc := json.NewEncoder(out)
+			counts := map[string]int{}
+			for _, key := range keys {
+				old, inA := a[key]
+				cur, inB := b[key]
+				var change string
+				switch {
+				case !inA:
+					change = changeAdded
+				case !inB:
+					change = changeRemoved
+				case old.Value != cur.Value:
+					change = changeValue
+				case old.ExpiresAt.IsZero() != cur.ExpiresAt.IsZero(), old.ExpiresAt.Sub(cur.ExpiresAt).Abs() > tolerance:
+					change = changeTTL
+				default:
+					continue
+				}
+				counts[change]++
+
+				if asJSON {
+					if err = enc.Encode(diffRecord{Key: key, Change: change, Old: newDiffEntry(old, inA), New: newDiffEntry(cur, inB)}); err != nil {
+						return err
+					}
+					continue
+				}
+
+				var sb strings.Builder
+				switch change {
+				case changeAdded:
+					fmt.Fprintf(&sb, "+ %s %s expires=%s", strconv.Quote(key), strconv.Quote(cur.Value), formatExpiry(cur))
+				case changeRemoved:
+					fmt.Fprintf(&sb, "- %s %s expires=%s", strconv.Quote(key), strconv.Quote(old.Value), formatExpiry(old))
+				case changeValue:
+					fmt.Fprintf(&sb, "~ %s %s -> %s", strconv.Quote(key), strconv.Quote(old.Value), strconv.Quote(cur.Value))
+					if formatExpiry(old) != formatExpiry(cur) {
+						fmt.Fprintf(&sb, " expires=%s -> %s", formatExpiry(old), formatExpiry(cur))
+					}
+				case changeTTL:
+					fmt.Fprintf(&sb, "ttl %s expires=%s -> %s", strconv.Quote(key), formatExpiry(old), formatExpiry(cur))
+				}
+				if _, err = fmt.Fprintln(out, sb.String()); err != nil {
+					return err
+				}
+			}
+
+			if !asJSON {
+				_, _ = fmt.Fprintf(out, "%d added, %d removed, %d changed, %d ttl changed\n",
+					counts[changeAdded], counts[changeRemoved], counts[changeValue], counts[changeTTL])
+			}
+			if len(counts) > 0 {
+				// The differences are the result, not a misuse of the command
+				cmd.SilenceUsage = true
+				return errors.New("snapshots differ")
+			}
+			return nil
+		},
+	}
+
+	diffCmd.Flags().BoolVar(&asJSON, "json", false, "Print every change as a JSON object per line")
+	diffCmd.Flags().BoolVar(&includeExpired, "include-expired", false, "Compare entries that have already expired")
+	diffCmd.Flags().DurationVar(&tolerance, "ttl-tolerance", 0, "Treat expirations this close to each other as the same")
+
+	return diffCmd
+}
@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+// writeSnapshot writes a JSON snapshot of the entries to a temporary directory, returning its path. Entries map keys to
+// their value and to when they expire in unix seconds, or zero if they never do.
+func writeSnapshot(t *testing.T, entries map[string][2]any) string {
+	t.Helper()
+	store := map[string]map[string]any{}
+	for key, e := range entries {
+		s := map[string]any{"value": e[0]}
+		if e[1].(int64) != 0 {
+			s["ttl"] = e[1]
+		}
+		store[key] = s
+	}
+	b, err := json.Marshal(map[string]any{"dbStore": store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "snapshot.json")
+	if err = os.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	later := time.Now().Add(time.Hour).Unix()
+	a := writeSnapshot(t, map[string][2]any{
+		"same":    {"1", int64(0)},
+		"removed": {"2", int64(0)},
+		"changed": {"3", int64(0)},
+		"ttl":     {"4", later},
+		"close":   {"5", later},
+		"expired": {"6", int64(1700000000)},
+	})
+	b := writeSnapshot(t, map[string][2]any{
+		"same":    {"1", int64(0)},
+		"added":   {"7", later},
+		"changed": {"8", int64(0)},
+		"ttl":     {"4", int64(0)},
+		"close":   {"5", later + 2},
+	})
+
+	out, err := execute(t, "snapshot", "diff", "--ttl-tolerance", "5s", a, b)
+	if err == nil || err.Error() != "snapshots differ" {
+		t.Errorf("err = %v; want snapshots differ", err)
+	}
+	expiry := time.Unix(later, 0).UTC().Format(time.RFC3339)
+	want := []string{
+		`+ "added" "7" expires=` + expiry,
+		`~ "changed" "3" -> "8"`,
+		`- "removed" "2" expires=never`,
+		`ttl "ttl" expires=` + expiry + ` -> never`,
+		`1 added, 1 removed, 1 changed, 1 ttl changed`,
+	}
+	if got := strings.Split(strings.TrimSpace(out), "\n"); !slices.Equal(got, want) {
+		t.Errorf("diff =\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Without a tolerance the close expirations differ, and expired entries can be compared
+	out, _ = execute(t, "snapshot", "diff", "--json", "--include-expired", a, b)
+	var changes []string
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var d diffRecord
+		if err = dec.Decode(&d); err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, d.Key+" "+d.Change)
+	}
+	want = []string{"added added", "changed changed", "close ttl", "expired removed", "removed removed", "ttl ttl"}
+	if !slices.Equal(changes, want) {
+		t.Errorf("json diff = %v; want %v", changes, want)
+	}
+
+	// A file written by persistence compares equal to the JSON snapshot it was loaded from
+	db, err := database.NewInMemoryDatabase(database.WithInitialData(b, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Shutdown()
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(db); err != nil {
+		t.Fatal(err)
+	}
+	persisted := filepath.Join(t.TempDir(), "persist")
+	if err = os.WriteFile(persisted, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = execute(t, "snapshot", "diff", b, persisted); err != nil {
+		t.Errorf("diff of the persisted snapshot failed: %v\n%v", err, out)
+	}
+
+	if _, err = execute(t, "snapshot", "diff", a, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("diffing a missing file succeeded")
+	}
+}
@@ -0,0 +1,24 @@
+package tools
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// NewToolsCmd returns the command grouping the offline tools, which work on the files of a database rather than a
+// running server
+func NewToolsCmd() *cobra.Command {
+	var toolsCmd = &cobra.Command{
+		Use:   "tools",
+		Short: "Inspect and repair database files",
+		Long: `This command contains sub commands for working with the files a database persists to, such as
+checking an AOF before starting a server from it.`,
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+
+	toolsCmd.AddCommand(newAofCmd())
+	toolsCmd.AddCommand(newSnapshotCmd())
+	toolsCmd.AddCommand(newRedisCmd())
+	toolsCmd.AddCommand(newBenchCmd())
+
+	return toolsCmd
+}
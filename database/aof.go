@@ -0,0 +1,223 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AOF lines have the form
+//
+//	PUT "key" "value" ttl ts=1712345678901 seq=42 node=a1b2c3
+//	DELETE "key" ts=1712345678901 seq=43 node=a1b2c3
+//
+// Keys and values are Go quoted strings so that they may contain spaces. The ttl is relative to ts, or -1 when the
+// entry never expires. Together, seq and node uniquely identify an operation: seq increases monotonically on the
+// node that wrote the record, which lets replay, replication and compaction skip operations they have already seen.
+// Trailing attributes are written as name=value and unknown attributes are ignored so that the format can grow.
+// Legacy lines without attributes are still read, with unquoted fields and an absolute ttl.
+
+// aofRecord is a single AOF line
+type aofRecord struct {
+	op    string // PUT or DELETE
+	key   string
+	value string
+	ttl   int64  // The ttl in seconds, or -1 when the entry never expires
+	ts    int64  // Unix milliseconds at which the record was written. Zero for legacy records.
+	seq   uint64 // The sequence number of the operation on its node. Zero for legacy records.
+	node  string // The ID of the node that performed the operation. Empty for legacy records.
+}
+
+// aofFields is the number of fields following the operation for each operation
+var aofFields = map[string]int{
+	"PUT":    3,
+	"DELETE": 1,
+}
+
+// expiresAt returns the Unix seconds at which a PUT record expires, or zero if it never expires
+func (r aofRecord) expiresAt() int64 {
+	if r.ttl == -1 {
+		return 0
+	}
+	if r.ts == 0 {
+		return r.ttl
+	}
+	return r.ts/1000 + r.ttl
+}
+
+// appendAofRecord appends the encoding of r to dst without a trailing newline
+func appendAofRecord(dst []byte, r aofRecord) []byte {
+	dst = append(dst, r.op...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendQuote(dst, r.key)
+	if r.op == "PUT" {
+		dst = append(dst, ' ')
+		dst = strconv.AppendQuote(dst, r.value)
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, r.ttl, 10)
+	}
+	dst = append(dst, " ts="...)
+	dst = strconv.AppendInt(dst, r.ts, 10)
+	if r.seq != 0 {
+		dst = append(dst, " seq="...)
+		dst = strconv.AppendUint(dst, r.seq, 10)
+	}
+	if r.node != "" {
+		dst = append(dst, " node="...)
+		dst = append(dst, r.node...)
+	}
+	return dst
+}
+
+// parseAofRecord parses a single AOF line
+func parseAofRecord(line string) (aofRecord, error) {
+	var r aofRecord
+	op, rest, _ := strings.Cut(line, " ")
+	n, ok := aofFields[op]
+	if !ok {
+		return r, fmt.Errorf("unknown operation %q", op)
+	}
+	r.op = op
+
+	// Read the positional fields, which are quoted unless the line is a legacy line
+	fields := make([]string, 0, n)
+	for len(fields) < n {
+		if rest == "" {
+			return r, errors.New("too few fields")
+		}
+
+		var field string
+		if rest[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return r, err
+			}
+			field, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+			if rest != "" && rest[0] != ' ' {
+				return r, errors.New("missing space after quoted field")
+			}
+		} else {
+			field, rest, _ = strings.Cut(rest, " ")
+		}
+		fields = append(fields, field)
+		rest = strings.TrimPrefix(rest, " ")
+	}
+
+	r.key = fields[0]
+	r.ttl = -1
+	if op == "PUT" {
+		r.value = fields[1]
+		ttl, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return r, fmt.Errorf("invalid ttl: %w", err)
+		}
+		r.ttl = ttl
+	}
+
+	// Everything after the positional fields is an attribute
+	for _, attr := range strings.Fields(rest) {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return r, fmt.Errorf("invalid attribute %q", attr)
+		}
+
+		switch name {
+		case "ts":
+			ts, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return r, fmt.Errorf("invalid timestamp: %w", err)
+			}
+			r.ts = ts
+		case "seq":
+			seq, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return r, fmt.Errorf("invalid sequence number: %w", err)
+			}
+			r.seq = seq
+		case "node":
+			r.node = value
+		}
+	}
+
+	return r, nil
+}
+
+// AofRecord is an operation read from an AOF by ReadAof, for tools that inspect or replay AOFs
+type AofRecord struct {
+	Line  int       // The line number in the file, from 1
+	Op    string    // PUT or DELETE
+	Key   string    // The key of the operation
+	Value string    // The value of a PUT. Empty for DELETE.
+	TTL   int64     // The ttl in seconds relative to Time, or -1 when the entry never expires. Absolute for legacy records.
+	Time  time.Time // When the record was written. Zero for legacy records.
+	Seq   uint64    // The sequence number of the operation on its node. Zero for legacy records.
+	Node  string    // The ID of the node that performed the operation. Empty for legacy records.
+}
+
+// ExpiresAt returns when a PUT record expires, or the zero time if it never expires
+func (r AofRecord) ExpiresAt() time.Time {
+	switch {
+	case r.TTL == -1:
+		return time.Time{}
+	case r.Time.IsZero():
+		return time.Unix(r.TTL, 0)
+	default:
+		return time.Unix(r.Time.Unix()+r.TTL, 0)
+	}
+}
+
+// AofSyntaxError describes an AOF line that could not be parsed
+type AofSyntaxError struct {
+	Line int // The line number in the file, from 1
+	Err  error
+}
+
+func (e *AofSyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *AofSyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// ReadAof returns an iterator over the records of an AOF in the order they were written, reading lines of the same
+// length that startup does. Lines that cannot be parsed are yielded with an *AofSyntaxError and reading continues,
+// while an error reading r is yielded last. Empty lines are skipped. Unlike startup, duplicate records and records
+// after a replay point are yielded as they are, for the caller to judge.
+func ReadAof(r io.Reader) iter.Seq2[AofRecord, error] {
+	return func(yield func(AofRecord, error) bool) {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64<<10), maxAofLineLength)
+		for n := 1; scanner.Scan(); n++ {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+
+			record, err := parseAofRecord(line)
+			if err != nil {
+				if !yield(AofRecord{Line: n}, &AofSyntaxError{Line: n, Err: err}) {
+					return
+				}
+				continue
+			}
+
+			out := AofRecord{Line: n, Op: record.op, Key: record.key, Value: record.value, TTL: record.ttl, Seq: record.seq, Node: record.node}
+			if record.ts != 0 {
+				out.Time = time.UnixMilli(record.ts)
+			}
+			if !yield(out, nil) {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			yield(AofRecord{}, err)
+		}
+	}
+}
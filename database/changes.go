@@ -0,0 +1,136 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Change operations
+const (
+	ChangePut    = "put"    // A key was written, including a new ttl for an existing key
+	ChangeDelete = "delete" // A key was deleted or expired
+)
+
+// DefaultChangeLogSize is the number of changes the change feed retains once enabled, as served by the change-log flag
+const DefaultChangeLogSize = 10_000
+
+var (
+	ErrChangeFeedDisabled = errors.New("the change feed is disabled")
+	ErrChangesTruncated   = errors.New("the changes after the sequence number are no longer retained")
+)
+
+// ChangeFeedError is returned by ReadChanges when changes cannot be read. Err is ErrChangeFeedDisabled or
+// ErrChangesTruncated.
+type ChangeFeedError struct {
+	Err   error
+	Floor uint64 // The lowest sequence number changes can still be read after
+}
+
+func (e *ChangeFeedError) Error() string {
+	if e.Err == ErrChangesTruncated {
+		return fmt.Sprintf("%v, the oldest retained change follows %d", e.Err, e.Floor)
+	}
+	return e.Err.Error()
+}
+
+func (e *ChangeFeedError) Unwrap() error {
+	return e.Err
+}
+
+// Truncated reports whether the changes were dropped from the log rather than the feed being disabled. It lets
+// packages that do not import this one, like the handler, tell the two apart.
+func (e *ChangeFeedError) Truncated() bool {
+	return e.Err == ErrChangesTruncated
+}
+
+// change is a mutation in the change feed. It is an alias of an unnamed struct so that packages consuming changes,
+// like the handler, can describe it without importing this package.
+type change = struct {
+	Seq       uint64    // The sequence number of the mutation, matching the AOF
+	Op        string    // ChangePut or ChangeDelete
+	Key       string    // The key that changed
+	Value     string    // The written value. Empty for deletes.
+	ExpiresAt int64     // Unix seconds at which the written key expires. Zero if it never expires.
+	Time      time.Time // When the change happened
+}
+
+// changeLog retains the most recent changes in a ring buffer so that consumers can resume from a sequence number
+type changeLog struct {
+	mu      sync.Mutex
+	entries []change      // The ring buffer. Nil while the change feed is disabled.
+	start   int           // The index of the oldest change
+	n       int           // The number of retained changes
+	floor   uint64        // The sequence number before the oldest change that can still be read
+	wake    chan struct{} // Closed and replaced whenever a change is appended
+}
+
+// WithChangeLog retains the last size mutations for the change feed, which ReadChanges serves in sequence order.
+// Consumers that fall further behind than size changes have to resync, e.g. from an export. Zero disables the feed.
+func WithChangeLog(size int) Options {
+	return func(db *InMemoryDatabase) error {
+		if size < 0 {
+			return fmt.Errorf("change log size must not be negative, got %d", size)
+		}
+		db.s.ChangeLogSize = size
+		return nil
+	}
+}
+
+// startChangeLog enables the change feed once the startup files are loaded, so that it starts after the loaded data
+func (i *InMemoryDatabase) startChangeLog() {
+	if i.s.ChangeLogSize == 0 {
+		return
+	}
+	i.changes.entries = make([]change, i.s.ChangeLogSize)
+	i.changes.floor = i.seq
+	i.changes.wake = make(chan struct{})
+}
+
+// appendChange adds a mutation to the change log. The database mutex must be held so that changes are appended in
+// sequence order.
+func (i *InMemoryDatabase) appendChange(c change) {
+	l := &i.changes
+	if l.entries == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n == len(l.entries) {
+		l.floor = l.entries[l.start].Seq
+		l.start = (l.start + 1) % len(l.entries)
+		l.n--
+	}
+	l.entries[(l.start+l.n)%len(l.entries)] = c
+	l.n++
+
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// ReadChanges returns up to limit changes with a sequence number after since, in sequence order, and a channel that is
+// closed once another change has been made, so that consumers can wait for more. It returns a ChangeFeedError wrapping
+// ErrChangesTruncated if changes after since have already been dropped from the log, and ErrChangeFeedDisabled if
+// there is no change log.
+func (i *InMemoryDatabase) ReadChanges(since uint64, limit int) ([]change, <-chan struct{}, error) {
+	l := &i.changes
+	if l.entries == nil {
+		return nil, nil, &ChangeFeedError{Err: ErrChangeFeedDisabled}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if since < l.floor {
+		return nil, nil, &ChangeFeedError{Err: ErrChangesTruncated, Floor: l.floor}
+	}
+
+	// Sequence numbers are consecutive, so the position of the first change after since is known
+	skip := int(min(since-l.floor, uint64(l.n)))
+	var changes []change
+	for k := skip; k < l.n && len(changes) < limit; k++ {
+		changes = append(changes, l.entries[(l.start+k)%len(l.entries)])
+	}
+	return changes, l.wake, nil
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjectedFailure is returned by writes that were made to fail by failure injection
+var ErrInjectedFailure = errors.New("injected failure")
+
+// FailureInjection describes the faults injected into the database to test how clients and replication cope with
+// them. It is an alias of an unnamed struct so that the handler can change it without importing this package.
+type FailureInjection = struct {
+	WriteFailureRate float64       // The probability from 0 to 1 that a Create, Put, PutLeased or Update fails with ErrInjectedFailure
+	Latency          time.Duration // Added to key reads, writes, deletes and scans before they run, outside the database lock
+	ClockSkew        time.Duration // Added to the time of the clock, which shifts ttls, expirations and AOF timestamps
+}
+
+// WithFailureInjection injects faults into the database from the start. They are meant for tests and can be changed
+// later with SetFailureInjection.
+func WithFailureInjection(f FailureInjection) Options {
+	return func(db *InMemoryDatabase) error {
+		return db.SetFailureInjection(f)
+	}
+}
+
+// SetFailureInjection replaces the faults injected into the database. The zero FailureInjection turns them off.
+func (i *InMemoryDatabase) SetFailureInjection(f FailureInjection) error {
+	if f.WriteFailureRate < 0 || f.WriteFailureRate > 1 {
+		return fmt.Errorf("write failure rate must be between 0 and 1, got %v", f.WriteFailureRate)
+	}
+	if f.Latency < 0 {
+		return fmt.Errorf("injected latency must not be negative, got %v", f.Latency)
+	}
+	if f == (FailureInjection{}) {
+		i.chaos.Store(nil)
+		return nil
+	}
+	i.chaos.Store(&f)
+	return nil
+}
+
+// GetFailureInjection returns the faults currently injected into the database
+func (i *InMemoryDatabase) GetFailureInjection() FailureInjection {
+	if f := i.chaos.Load(); f != nil {
+		return *f
+	}
+	return FailureInjection{}
+}
+
+// injectFailure waits out the injected latency and, for writes, returns ErrInjectedFailure with the injected
+// probability. It must be called without the database lock held.
+func (i *InMemoryDatabase) injectFailure(write bool) error {
+	f := i.chaos.Load()
+	if f == nil {
+		return nil
+	}
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	const precision = 1_000_000
+	if write && float64(i.s.randN(precision)) < f.WriteFailureRate*precision {
+		return ErrInjectedFailure
+	}
+	return nil
+}
+
+// skewedClock adds the injected clock skew to the time of a clock
+type skewedClock struct {
+	Clock
+	chaos *atomic.Pointer[FailureInjection]
+}
+
+func (c skewedClock) Now() time.Time {
+	if f := c.chaos.Load(); f != nil {
+		return c.Clock.Now().Add(f.ClockSkew)
+	}
+	return c.Clock.Now()
+}
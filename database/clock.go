@@ -0,0 +1,169 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for TTL computation and the ttl cleaner. Injecting a Clock through WithClock allows
+// tests to control time instead of sleeping.
+type Clock interface {
+	Now() time.Time                 // The current time
+	NewTimer(d time.Duration) Timer // A timer that fires once d has elapsed on this clock
+}
+
+// Timer is a single-use timer created by a Clock
+type Timer interface {
+	C() <-chan time.Time // The channel the time is delivered on when the timer fires
+	Stop() bool          // Stop the timer, returning false if it has already fired or been stopped
+}
+
+// realClock is the default Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// realTimer adapts a *time.Timer to the Timer interface
+type realTimer struct {
+	t *time.Timer
+}
+
+func (r realTimer) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTimer) Stop() bool {
+	return r.t.Stop()
+}
+
+// Now returns the current time of the clock that ttls are measured with, so that callers converting between ttls and
+// absolute expiration times agree with the database when it is given a clock or the clock is skewed
+func (i *InMemoryDatabase) Now() time.Time {
+	return i.s.clock.Now()
+}
+
+// ManualClock is a Clock whose time only moves when it is advanced or set, so that ttls can be tested without
+// sleeping. Tests outside this module get it as dbtest.Clock. The zero value is not usable; create one with
+// NewManualClock.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// manualTimer is a timer of a ManualClock, which fires once the clock reaches its deadline
+type manualTimer struct {
+	c        *ManualClock
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewManualClock returns a clock that stands at start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{c: c, deadline: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer whose deadline is reached
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set moves the clock to t, firing every timer whose deadline is reached. Moving it backwards fires nothing.
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(t)
+}
+
+// set moves the clock with its mutex held
+func (c *ManualClock) set(t time.Time) {
+	c.now = t
+
+	var pending []*manualTimer
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// Timers returns the number of timers waiting to fire, which tells a test that a routine is waiting on the clock
+func (c *ManualClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *manualTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for n, timer := range t.c.timers {
+		if timer == t {
+			t.c.timers = append(t.c.timers[:n], t.c.timers[n+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// WithManualTTLCleanup does not start the ttl cleaner, so that expired keys are only removed when StepTTLCleaner is
+// called. Together with a Clock injected through WithClock, this lets tests and simulations decide exactly when keys
+// expire and check the order they expire in without sleeping. Expired keys are hidden from reads either way.
+func WithManualTTLCleanup() Options {
+	return func(db *InMemoryDatabase) error {
+		db.s.ManualTTLCleanup = true
+		return nil
+	}
+}
+
+// StepTTLCleaner runs the ttl cleaner once, removing every key that has expired by the time of the clock, and returns
+// their keys in the order they expired. Keys expire at the start of the second their ttl runs out, as ttls are kept
+// in whole seconds, and keys that expire in the same second are returned in key order. Removed keys are written to the
+// AOF and reported as expired events, as they are by the background cleaner.
+func (i *InMemoryDatabase) StepTTLCleaner() []string {
+	return i.removeExpired()
+}
+
+// NextExpiry returns when the earliest ttl runs out, which is when StepTTLCleaner next has a key to remove, or false if
+// no key has a ttl. A key whose ttl was changed or removed since may be reported until the cleaner steps past it.
+func (i *InMemoryDatabase) NextExpiry() (time.Time, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(*i.ttl) == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(i.ttl.Peak().(ttlHeapData).ttl, 0), true
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec converts the values of GetAs and PutAs to and from the strings the database stores, so that embedded users
+// can use the database as a typed cache
+type Codec interface {
+	Encode(v any) (string, error)
+	Decode(data string, v any) error
+}
+
+// JSONCodec stores values as JSON, which keeps them readable over HTTP and through every kind of persistence. It is
+// the codec of a database unless WithCodec gives another.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func (JSONCodec) Decode(data string, v any) error {
+	return json.Unmarshal([]byte(data), v)
+}
+
+// MsgpackCodec stores values as MessagePack, which is smaller and faster to encode than JSON. The values are binary,
+// so they are mangled by JSON snapshots and by HTTP responses, which hold text. Use it with AOF or gob persistence.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Encode(v any) (string, error) {
+	b, err := msgpack.Marshal(v)
+	return string(b), err
+}
+
+func (MsgpackCodec) Decode(data string, v any) error {
+	return msgpack.Unmarshal([]byte(data), v)
+}
+
+// WithCodec sets the codec that GetAs and PutAs convert values with. JSONCodec is used by default.
+func WithCodec(c Codec) Options {
+	return func(db *InMemoryDatabase) error {
+		if c == nil {
+			return errors.New("codec must not be nil")
+		}
+		db.s.codec = c
+		return nil
+	}
+}
+
+// GetAs gets the value of the key decoded into a T with the codec of the database. It returns false if the key does
+// not exist or has expired, and the error of the codec if the value cannot be decoded into a T.
+func GetAs[T any](i *InMemoryDatabase, key string) (T, bool, error) {
+	var v T
+	value, ok := i.Get(key)
+	if !ok {
+		return v, false, nil
+	}
+	if err := i.s.codec.Decode(value, &v); err != nil {
+		return v, true, fmt.Errorf("decoding %v: %w", key, err)
+	}
+	return v, true, nil
+}
+
+// PutAs puts v encoded with the codec of the database under the key, with the ttl in seconds or without one if it is
+// nil. Like Put, it returns whether the key already existed and the *LimitErrors of a value that is too large.
+func PutAs[T any](i *InMemoryDatabase, key string, v T, ttl *int64) (bool, error) {
+	value, err := i.s.codec.Encode(v)
+	if err != nil {
+		return false, fmt.Errorf("encoding %v: %w", key, err)
+	}
+	return i.Put(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: key, Value: value, Ttl: ttl})
+}
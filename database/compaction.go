@@ -0,0 +1,172 @@
+package database
+
+import (
+	"container/heap"
+	"fmt"
+	"maps"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCompactionInterval is how often the deleted keys are checked against the compaction ratio
+const DefaultCompactionInterval = time.Minute
+
+// minCompactionDeletes is how many keys must have been deleted before automatic compaction runs, so that a small
+// database is not compacted over a handful of deletions
+const minCompactionDeletes = 10000
+
+// compaction is the outcome of a compaction. Like change, it is an alias of an unnamed struct so that the handler can
+// describe it without importing this package.
+type compaction = struct {
+	Keys      int           // The keys left in the database
+	Reclaimed uint64        // The bytes of heap freed by rebuilding the maps
+	Duration  time.Duration // How long the compaction took
+}
+
+// compactionStats describes the compactions since the database started. It is an alias of an unnamed struct like
+// compaction.
+type compactionStats = struct {
+	Runs      uint64 // Compactions that finished
+	Reclaimed uint64 // The bytes of heap freed by every compaction
+}
+
+// compactor tracks the deleted keys that compaction reclaims the memory of
+type compactor struct {
+	mu        sync.Mutex    // Serializes compactions
+	deleted   atomic.Int64  // Keys deleted since the last compaction
+	runs      atomic.Uint64 // Compactions that finished
+	reclaimed atomic.Uint64 // The bytes freed by every compaction
+}
+
+// WithAutoCompaction compacts the database once the keys deleted since the last compaction make up ratio of the keys
+// there were, e.g. 0.5 once half of them are gone. Deletions are checked every minute, and at least 10000 keys must
+// have been deleted, so that small databases are left alone. Compact can be called whether or not it is enabled.
+func WithAutoCompaction(ratio float64) Options {
+	return func(db *InMemoryDatabase) error {
+		if ratio <= 0 || ratio > 1 {
+			return fmt.Errorf("compaction ratio must be in (0, 1], got %v", ratio)
+		}
+		db.s.CompactionRatio = ratio
+		return nil
+	}
+}
+
+// compactMap returns a copy of m allocated for its current size
+func compactMap[M ~map[K]V, K comparable, V any](m M) M {
+	c := make(M, len(m))
+	maps.Copy(c, m)
+	return c
+}
+
+// startCompaction starts checking the deleted keys against the compaction ratio
+func (i *InMemoryDatabase) startCompaction() {
+	if i.s.CompactionRatio == 0 {
+		return
+	}
+	// Compaction is stopped on shutdown like persistence, so that it does not run after the final persistence pass
+	i.goPersist("compaction", func() {
+		for {
+			select {
+			case <-i.stopping.Done():
+				return
+			case <-time.After(DefaultCompactionInterval):
+			}
+			i.maybeCompact()
+		}
+	})
+}
+
+// maybeCompact compacts the database if enough keys were deleted since the last compaction, returning whether it did
+func (i *InMemoryDatabase) maybeCompact() bool {
+	deleted := i.compactor.deleted.Load()
+	if deleted < minCompactionDeletes {
+		return false
+	}
+	i.mu.RLock()
+	keys := int64(i.database.len())
+	i.mu.RUnlock()
+	if float64(deleted) < i.s.CompactionRatio*float64(keys+deleted) {
+		return false
+	}
+
+	i.Compact()
+	return true
+}
+
+// Compact rebuilds the maps and the ttl heap of the database at the size of their contents. Go maps never shrink, so
+// the memory taken by keys that were deleted is only reclaimed by rebuilding them. The store is rebuilt a part at a
+// time, so with the sharded concurrency mode writes are only held up while the shard they go to is copied. Writes made
+// while a part is copied follow the write stall policy, like writes made during a snapshot. Garbage is collected
+// before and after to measure the memory reclaimed, which is then returned to the operating system.
+func (i *InMemoryDatabase) Compact() compaction {
+	i.compactor.mu.Lock()
+	defer i.compactor.mu.Unlock()
+
+	start := time.Now()
+	runtime.GC()
+	before := i.s.memoryUsage()
+	parts := i.database.parts()
+	i.s.logger.Info("compacting database", "deleted", i.compactor.deleted.Load(), "parts", parts)
+
+	for n := range parts {
+		i.lockForPersistence(PersistenceCompaction)
+		i.database.compactPart(n)
+		i.unlockForPersistence()
+		if parts > 1 {
+			i.s.logger.Info("compaction progress", "compacted", n+1, "parts", parts)
+		}
+	}
+
+	i.lockForPersistence(PersistenceCompaction)
+	i.compactIndexes()
+	keys := i.database.len()
+	i.compactor.deleted.Store(0)
+	i.unlockForPersistence()
+
+	debug.FreeOSMemory()
+	c := compaction{Keys: keys, Duration: time.Since(start)}
+	if after := i.s.memoryUsage(); after < before {
+		c.Reclaimed = before - after
+	}
+	i.compactor.runs.Add(1)
+	i.compactor.reclaimed.Add(c.Reclaimed)
+	i.s.logger.Info("compacted database", "keys", c.Keys, "reclaimed", c.Reclaimed, "duration", c.Duration)
+	return c
+}
+
+// compactIndexes rebuilds the ttl heap without its stale items, and the maps kept alongside the store under the
+// database mutex. The LRU and key stats maps are left alone since reads use them without it. The database mutex must
+// be held.
+func (i *InMemoryDatabase) compactIndexes() {
+	// Heap items whose key was deleted or given another ttl are dropped like the ttl cleaner does
+	live := 0
+	for _, item := range *i.ttl {
+		if dbEntry, loaded := i.load(item.key); loaded && dbEntry.expiresAt == item.ttl {
+			live++
+		}
+	}
+	ttl := make(ttlHeap, 0, live)
+	for _, item := range *i.ttl {
+		if dbEntry, loaded := i.load(item.key); loaded && dbEntry.expiresAt == item.ttl {
+			ttl = append(ttl, item)
+		}
+	}
+	heap.Init(&ttl)
+	*i.ttl = ttl
+
+	if i.history != nil {
+		i.history = compactMap(i.history)
+	}
+	if i.search != nil {
+		i.search.postings = compactMap(i.search.postings)
+		i.search.docs = compactMap(i.search.docs)
+	}
+}
+
+// GetCompactionStats describes the compactions since the database started
+func (i *InMemoryDatabase) GetCompactionStats() compactionStats {
+	return compactionStats{Runs: i.compactor.runs.Load(), Reclaimed: i.compactor.reclaimed.Load()}
+}
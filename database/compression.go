@@ -0,0 +1,76 @@
+package database
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// flateWriters pools compressors since each one allocates several hundred kilobytes of state
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// WithCompression compresses values of at least threshold bytes with DEFLATE, trading CPU on writes and reads for
+// memory when storing large values like JSON documents. Values are only kept compressed when that makes them smaller,
+// and are decompressed transparently on read, so the AOF and snapshots always hold the original values. Zero, the
+// default, disables compression.
+func WithCompression(threshold int) Options {
+	return func(db *InMemoryDatabase) error {
+		if threshold < 0 {
+			return fmt.Errorf("compression threshold must not be negative, got %d", threshold)
+		}
+		db.s.CompressionThreshold = threshold
+		return nil
+	}
+}
+
+// compress returns the value to store for a value, and whether it is compressed
+func (i *InMemoryDatabase) compress(value string) (string, bool) {
+	if i.s.CompressionThreshold == 0 || len(value) < i.s.CompressionThreshold {
+		return value, false
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(value) / 2)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := io.WriteString(w, value); err != nil {
+		return value, false
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return value, false
+	}
+	return buf.String(), true
+}
+
+// compressEntry compresses the value of an entry that is not already compressed
+func (i *InMemoryDatabase) compressEntry(e databaseEntry) databaseEntry {
+	if !e.compressed {
+		e.value, e.compressed = i.compress(e.value)
+	}
+	return e
+}
+
+// plainValue returns the original value of the entry, decompressing it if needed. Decompression can only fail if the
+// stored value was corrupted, in which case the stored value is returned as it is.
+func (e databaseEntry) plainValue() string {
+	if !e.compressed {
+		return e.value
+	}
+
+	r := flate.NewReader(strings.NewReader(e.value))
+	defer r.Close()
+	var b strings.Builder
+	if _, err := io.Copy(&b, r); err != nil {
+		return e.value
+	}
+	return b.String()
+}
@@ -2,17 +2,41 @@ package database
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/gob"
 	"encoding/json"
+	"io"
+	"time"
 )
 
+// ttlPtr returns the expiration in the snapshot encoding, where nil means that the entry never expires
+func (e databaseEntry) ttlPtr() *int64 {
+	if e.expiresAt == 0 {
+		return nil
+	}
+	t := e.expiresAt
+	return &t
+}
+
+// setTTLPtr sets the expiration from the snapshot encoding
+func (e *databaseEntry) setTTLPtr(t *int64) {
+	e.expiresAt = 0
+	if t != nil {
+		e.expiresAt = *t
+	}
+}
+
 func (e databaseEntry) GobEncode() ([]byte, error) {
 	temp := struct {
-		Value string
-		TTL   *int64
+		Value     string
+		TTL       *int64
+		UpdatedAt int64
+		Version   uint64
 	}{
-		e.value,
-		e.ttl,
+		e.plainValue(),
+		e.ttlPtr(),
+		e.updatedAt,
+		e.version,
 	}
 
 	var buf bytes.Buffer
@@ -25,8 +49,10 @@ func (e databaseEntry) GobEncode() ([]byte, error) {
 
 func (e *databaseEntry) GobDecode(b []byte) error {
 	var E struct {
-		Value string `json:"value"`
-		TTL   *int64 `json:"ttl"`
+		Value     string `json:"value"`
+		TTL       *int64 `json:"ttl"`
+		UpdatedAt int64  `json:"updatedAt"`
+		Version   uint64 `json:"version"`
 	}
 
 	buf := bytes.NewBuffer(b)
@@ -36,7 +62,9 @@ func (e *databaseEntry) GobDecode(b []byte) error {
 	}
 
 	e.value = E.Value
-	e.ttl = E.TTL
+	e.setTTLPtr(E.TTL)
+	e.updatedAt = E.UpdatedAt
+	e.version = E.Version
 
 	return nil
 }
@@ -80,9 +108,11 @@ func (i *InMemoryDatabase) GobEncode() ([]byte, error) {
 	temp := struct {
 		DbStore dbStore  `json:"dbStore"`
 		TTL     *ttlHeap `json:"ttlHeap"`
+		Seq     uint64   `json:"seq"`
 	}{
-		DbStore: i.database,
+		DbStore: i.database.entries(),
 		TTL:     i.ttl,
+		Seq:     i.seq,
 	}
 
 	var buf bytes.Buffer
@@ -97,6 +127,7 @@ func (i *InMemoryDatabase) GobDecode(b []byte) error {
 	var I struct {
 		DbStore dbStore
 		TTL     *ttlHeap
+		Seq     uint64
 	}
 
 	buf := bytes.NewBuffer(b)
@@ -105,26 +136,39 @@ func (i *InMemoryDatabase) GobDecode(b []byte) error {
 		return err
 	}
 
-	i.database = I.DbStore
+	// Decoding into a zero value database falls back on the default store
+	if i.database == nil {
+		i.database = &dbStore{}
+	}
+	i.database.reset(I.DbStore)
+	i.resetUsage()
+	i.resetSearchIndex()
 	i.ttl = I.TTL
+	i.seq = I.Seq
 
 	return nil
 }
 
 func (e databaseEntry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Value string `json:"value"`
-		TTL   *int64 `json:"ttl"`
+		Value     string `json:"value"`
+		TTL       *int64 `json:"ttl"`
+		UpdatedAt int64  `json:"updatedAt,omitempty"`
+		Version   uint64 `json:"version,omitempty"`
 	}{
-		Value: e.value,
-		TTL:   e.ttl,
+		Value:     e.plainValue(),
+		TTL:       e.ttlPtr(),
+		UpdatedAt: e.updatedAt,
+		Version:   e.version,
 	})
 }
 
 func (e *databaseEntry) UnmarshalJSON(data []byte) error {
 	var E struct {
-		Value string `json:"value"`
-		TTL   *int64 `json:"ttl"`
+		Value     string `json:"value"`
+		TTL       *int64 `json:"ttl"`
+		UpdatedAt int64  `json:"updatedAt"`
+		Version   uint64 `json:"version"`
 	}
 
 	if err := json.Unmarshal(data, &E); err != nil {
@@ -132,7 +176,9 @@ func (e *databaseEntry) UnmarshalJSON(data []byte) error {
 	}
 
 	e.value = E.Value
-	e.ttl = E.TTL
+	e.setTTLPtr(E.TTL)
+	e.updatedAt = E.UpdatedAt
+	e.version = E.Version
 
 	return nil
 }
@@ -167,9 +213,11 @@ func (i *InMemoryDatabase) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
 		DbStore dbStore  `json:"dbStore"`
 		TTL     *ttlHeap `json:"ttlHeap"`
+		Seq     uint64   `json:"seq"`
 	}{
-		DbStore: i.database,
+		DbStore: i.database.entries(),
 		TTL:     i.ttl,
+		Seq:     i.seq,
 	})
 }
 
@@ -177,14 +225,65 @@ func (i *InMemoryDatabase) UnmarshalJSON(data []byte) error {
 	var I struct {
 		DbStore dbStore  `json:"dbStore"`
 		TTL     *ttlHeap `json:"ttlHeap"`
+		Seq     uint64   `json:"seq"`
 	}
 
 	if err := json.Unmarshal(data, &I); err != nil {
 		return err
 	}
 
-	i.database = I.DbStore
+	// Decoding into a zero value database falls back on the default store
+	if i.database == nil {
+		i.database = &dbStore{}
+	}
+	i.database.reset(I.DbStore)
+	i.resetUsage()
+	i.resetSearchIndex()
 	i.ttl = I.TTL
+	i.seq = I.Seq
 
 	return nil
 }
+
+// SnapshotEntry is an entry read from a snapshot by ReadSnapshot
+type SnapshotEntry struct {
+	Value     string
+	ExpiresAt time.Time // The zero time if the entry never expires
+	UpdatedAt time.Time // The zero time if unknown
+	Version   uint64    // Zero if unknown
+}
+
+// ReadSnapshot reads every entry of a snapshot, whether a JSON startup file or a file written by database
+// persistence, along with the sequence number of the last write it contains. Entries are returned as they were
+// stored, including those that have expired since. Unlike startup, the whole snapshot is held in memory.
+func ReadSnapshot(r io.Reader) (map[string]SnapshotEntry, uint64, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Persistence writes the database as gob, which is tried when the snapshot is not a JSON object
+	var db InMemoryDatabase
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		err = json.Unmarshal(b, &db)
+	}
+	if err != nil || db.database == nil {
+		if gobErr := gob.NewDecoder(bytes.NewReader(b)).Decode(&db); gobErr != nil {
+			return nil, 0, cmp.Or(err, gobErr)
+		}
+	}
+
+	store := db.database.entries()
+	entries := make(map[string]SnapshotEntry, len(store))
+	for key, e := range store {
+		s := SnapshotEntry{Value: e.plainValue(), Version: e.version}
+		if e.expiresAt != 0 {
+			s.ExpiresAt = time.Unix(e.expiresAt, 0)
+		}
+		if e.updatedAt != 0 {
+			s.UpdatedAt = time.Unix(e.updatedAt, 0)
+		}
+		entries[key] = s
+	}
+	return entries, db.seq, nil
+}
@@ -1,34 +1,118 @@
 package database
 
 import (
-	"bufio"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
-	"os"
-	"strconv"
-	"strings"
 	"time"
 )
 
-// settings define user-configurable settings for the database in a single struct
+// Settings are the user-configurable database settings that can be reported, e.g. by serve or an admin endpoint
+type Settings struct {
+	AofStartupFile            string                    `json:"aofStartupFile"`            // The aof startup file
+	ShouldAofPersist          bool                      `json:"shouldAofPersist"`          // Whether there should be AOF persistence or not
+	AofPersistFile            string                    `json:"aofPersistFile"`            // The file name for which to output AOF persistence to
+	AofPersistencePeriod      time.Duration             `json:"aofPersistencePeriod"`      // How long in between AOF persistence cycles
+	DatabaseStartupFile       string                    `json:"dbStartupFile"`             // The database startup file
+	ShouldDatabasePersist     bool                      `json:"shouldDatabasePersist"`     // Whether there should be database persistence or not
+	DatabasePersistFile       string                    `json:"databasePersistFile"`       // The file name for which to output database persistence to
+	DatabasePersistencePeriod time.Duration             `json:"databasePersistencePeriod"` // How long in between database persistence cycles
+	PersistenceDir            string                    `json:"persistenceDir,omitempty"`  // The directory the persistence files are named after. Empty if each was named.
+	IDScheme                  string                    `json:"idScheme"`                  // The scheme used to generate keys for created values
+	ConcurrencyMode           string                    `json:"concurrencyMode"`           // How the key value store is synchronized
+	LoadProgressInterval      int                       `json:"loadProgressInterval"`      // The number of startup records between progress log lines
+	ReplayUntil               time.Time                 `json:"replayUntil,omitzero"`      // AOF replay stops after this point in time. Zero replays everything.
+	NodeID                    string                    `json:"nodeId"`                    // Identifies this database in the operation IDs written to the AOF
+	TTLJitter                 float64                   `json:"ttlJitter"`                 // The percentage by which stored ttls are randomly spread
+	NamespaceQuotas           map[string]NamespaceQuota `json:"namespaceQuotas,omitempty"` // The quotas of namespaces that have one
+	CompressionThreshold      int                       `json:"compressionThreshold"`      // Values of at least this many bytes are compressed. Zero disables compression.
+	MaxKeyBytes               int                       `json:"maxKeyBytes"`               // The maximum key length in bytes. Zero means unlimited.
+	MaxValueBytes             int                       `json:"maxValueBytes"`             // The maximum value length in bytes. Zero means unlimited.
+	PersistenceAlertPeriods   int                       `json:"persistenceAlertPeriods"`   // Persistence periods without a success before an alert. Zero disables alerts.
+	PersistenceFailurePolicy  string                    `json:"persistenceFailurePolicy"`  // What writes do once persistence has failed for the alert periods
+	MinFreeDiskBytes          uint64                    `json:"minFreeDiskBytes"`          // The free disk space that AOF syncs and snapshots must leave
+	ChangeLogSize             int                       `json:"changeLogSize"`             // The number of changes retained for the change feed. Zero disables the feed.
+	SearchIndex               bool                      `json:"searchIndex"`               // Whether values are indexed for Search
+	WriteStallPolicy          string                    `json:"writeStallPolicy"`          // What writes do while a snapshot holds the database
+	HistorySize               int                       `json:"historySize"`               // The number of versions of each key retained. Zero disables the history.
+	MemoryLimit               int64                     `json:"memoryLimit"`               // The heap size in bytes over which keys are evicted. Zero without eviction.
+	EvictionPolicy            string                    `json:"evictionPolicy"`            // Which keys are evicted under memory pressure. Empty without eviction.
+	TrackKeyStats             bool                      `json:"trackKeyStats"`             // Whether the reads and writes of every key are counted for KeyStats
+	CompactionRatio           float64                   `json:"compactionRatio"`           // The fraction of keys deleted that triggers compaction. Zero disables it.
+	ManualTTLCleanup          bool                      `json:"manualTtlCleanup"`          // Whether expired keys are only removed by StepTTLCleaner
+}
+
+// settings adds the settings that cannot be reported to Settings
 type settings struct {
-	aofStartupFile            string        // The aof startup file
-	shouldAofPersist          bool          // Whether there should be AOF persistence or not
-	aofPersistenceFile        string        // The file name for which to output AOF persistence to
-	aofPersistencePeriod      time.Duration // How long in between AOF persistence cycles
-	databaseStartupFile       string        // The database startup file
-	shouldDatabasePersist     bool          // Whether there should be database persistence or not
-	databasePersistenceFile   string        // The file name for which to output database persistence to
-	databasePersistencePeriod time.Duration // How long in between database persistence cycles
-	logger                    *slog.Logger  // Logging
+	Settings
+	logger        *slog.Logger        // Logging
+	clock         Clock               // The source of time for TTLs and the ttl cleaner
+	newID         func() string       // Generates a key using the id scheme
+	sequentialIDs *sequentialIDs      // The counter of the sequential id scheme, or nil with another scheme
+	randN         func(n int64) int64 // Returns a random number in [0, n) for ttl jitter
+	codec         Codec               // Converts the values of GetAs and PutAs
+
+	memoryUsage    func() uint64                    // Returns the memory used by the heap, which eviction keeps under the memory limit
+	diskFree       func(dir string) (uint64, error) // Returns the free disk space for the persistence files in dir
+	restartBackoff time.Duration                    // The wait before restarting a routine that panicked, doubled on every restart
+
+	persistenceAlert PersistenceAlert // Called when persistence has not succeeded for the alert periods
 }
 
 type Options func(*InMemoryDatabase) error
 
+// validate checks that the settings make sense together. It runs once every option has been applied so that errors
+// are reported by NewInMemoryDatabase instead of surfacing later at runtime. Every problem found is reported.
+func (s settings) validate() error {
+	var errs []error
+
+	if s.ShouldAofPersist && s.AofPersistFile == "" {
+		errs = append(errs, errors.New("aof persistence is enabled but the aof persistence file is empty"))
+	}
+	if s.AofPersistencePeriod < 0 || (s.ShouldAofPersist && s.AofPersistencePeriod == 0) {
+		errs = append(errs, fmt.Errorf("aof persistence period must be positive, got %v", s.AofPersistencePeriod))
+	}
+
+	if s.ShouldDatabasePersist && s.DatabasePersistFile == "" {
+		errs = append(errs, errors.New("database persistence is enabled but the database persistence file is empty"))
+	}
+	if s.DatabasePersistencePeriod < 0 || (s.ShouldDatabasePersist && s.DatabasePersistencePeriod == 0) {
+		errs = append(errs, fmt.Errorf("database persistence period must be positive, got %v", s.DatabasePersistencePeriod))
+	}
+
+	// Both kinds of persistence writing to the same file would corrupt it
+	if s.ShouldAofPersist && s.ShouldDatabasePersist && s.AofPersistFile == s.DatabasePersistFile {
+		errs = append(errs, fmt.Errorf("aof and database persistence cannot share the file %q", s.AofPersistFile))
+	}
+
+	if !s.ReplayUntil.IsZero() && s.AofStartupFile == "" {
+		errs = append(errs, errors.New("a replay point was given without an aof startup file"))
+	}
+
+	// Without alerts persistence is never considered failing, so writes would never be rejected
+	if s.PersistenceFailurePolicy == PersistenceFailureReject && s.PersistenceAlertPeriods == 0 {
+		errs = append(errs, errors.New("the reject persistence failure policy needs persistence alerts to be enabled"))
+	}
+
+	// Buffered puts are acknowledged before they could be checked against a quota
+	if s.WriteStallPolicy == WriteStallBuffer && len(s.NamespaceQuotas) > 0 {
+		errs = append(errs, errors.New("the buffer write stall policy cannot be combined with namespace quotas"))
+	}
+
+	if s.logger == nil {
+		errs = append(errs, errors.New("a logger is required"))
+	}
+	if s.clock == nil {
+		errs = append(errs, errors.New("a clock is required"))
+	}
+
+	return errors.Join(errs...)
+}
+
 // WithAofPersistence enables AOF persistence
 func WithAofPersistence() Options {
 	return func(db *InMemoryDatabase) error {
-		db.s.shouldAofPersist = true
+		db.s.ShouldAofPersist = true
 		return nil
 	}
 }
@@ -36,7 +120,7 @@ func WithAofPersistence() Options {
 // WithAofPersistenceFile sets the file name to persist the AOF to
 func WithAofPersistenceFile(s string) Options {
 	return func(db *InMemoryDatabase) error {
-		db.s.aofPersistenceFile = s
+		db.s.AofPersistFile = s
 		return nil
 	}
 }
@@ -44,7 +128,7 @@ func WithAofPersistenceFile(s string) Options {
 // WithAofPersistencePeriod sets the period between AOF persistence cycles
 func WithAofPersistencePeriod(d time.Duration) Options {
 	return func(db *InMemoryDatabase) error {
-		db.s.aofPersistencePeriod = d
+		db.s.AofPersistencePeriod = d
 		return nil
 	}
 }
@@ -52,7 +136,7 @@ func WithAofPersistencePeriod(d time.Duration) Options {
 // WithDatabasePersistence enables database persistence
 func WithDatabasePersistence() Options {
 	return func(db *InMemoryDatabase) error {
-		db.s.shouldDatabasePersist = true
+		db.s.ShouldDatabasePersist = true
 		return nil
 	}
 }
@@ -60,7 +144,7 @@ func WithDatabasePersistence() Options {
 // WithDatabasePersistenceFile sets the filename to persist the database to
 func WithDatabasePersistenceFile(s string) Options {
 	return func(db *InMemoryDatabase) error {
-		db.s.databasePersistenceFile = s
+		db.s.DatabasePersistFile = s
 		return nil
 	}
 }
@@ -68,7 +152,7 @@ func WithDatabasePersistenceFile(s string) Options {
 // WithDatabasePersistencePeriod sets the period between database persistence cycles
 func WithDatabasePersistencePeriod(d time.Duration) Options {
 	return func(db *InMemoryDatabase) error {
-		db.s.databasePersistencePeriod = d
+		db.s.DatabasePersistencePeriod = d
 		return nil
 	}
 }
@@ -81,67 +165,114 @@ func WithLogger(l *slog.Logger) Options {
 	}
 }
 
-// WithInitialData allows the provision of a .json file to initialize the database with. When persistenceType is true,
-// the file is specified to be a database persistence file. When it is false, the file is specified to be an AOF file.
+// WithClock sets the clock used for TTL computation and the ttl cleaner
+func WithClock(c Clock) Options {
+	return func(db *InMemoryDatabase) error {
+		db.s.clock = c
+		return nil
+	}
+}
+
+// WithInitialData allows the provision of a file to initialize the database with. When persistenceType is true,
+// the file is specified to be a JSON database persistence file. When it is false, the file is specified to be an AOF
+// file. Files are loaded once every option has been applied, with the database file loaded before the AOF file.
 func WithInitialData(filename string, persistenceType bool) Options {
 	return func(db *InMemoryDatabase) error {
 		if persistenceType {
-			db.s.databaseStartupFile = filename
-			data, err := os.ReadFile(filename)
-			if err != nil {
-				return err
-			}
-
-			err = json.Unmarshal(data, db)
-			if err != nil {
-				return err
-			}
-			return nil
+			db.s.DatabaseStartupFile = filename
+		} else {
+			db.s.AofStartupFile = filename
 		}
+		return nil
+	}
+}
 
-		db.s.aofStartupFile = filename
-		file, err := os.Open(filename)
+// WithLoadProgressInterval sets how many startup records are loaded between progress log lines. Zero disables
+// progress logging.
+func WithLoadProgressInterval(n int) Options {
+	return func(db *InMemoryDatabase) error {
+		if n < 0 {
+			return fmt.Errorf("load progress interval must not be negative, got %d", n)
+		}
+		db.s.LoadProgressInterval = n
+		return nil
+	}
+}
+
+// WithIDScheme sets the scheme used to generate keys for created values. One of uuid (v4), uuidv7, nanoid or
+// sequential.
+func WithIDScheme(scheme string) Options {
+	return func(db *InMemoryDatabase) error {
+		return db.s.setIDScheme(scheme)
+	}
+}
+
+// WithKeyGenerator generates the keys for created values with gen instead of an id scheme, e.g. to use ULIDs,
+// snowflake IDs or a deterministic generator in tests. gen is only called while the database lock is held, so it needs
+// no synchronization of its own, and should return keys that are valid keys, since the generated keys are not
+// validated. Keys that are already taken are skipped.
+func WithKeyGenerator(gen func() string) Options {
+	return func(db *InMemoryDatabase) error {
+		if gen == nil {
+			return errors.New("key generator must not be nil")
+		}
+		db.s.IDScheme = IDSchemeCustom
+		db.s.newID = gen
+		db.s.sequentialIDs = nil
+		return nil
+	}
+}
+
+// WithConcurrencyMode sets how the key value store is synchronized. One of rwmutex (the default), sharded or cow.
+// Sharded and cow let reads bypass the database mutex: sharded reads only wait on writes to the same shard, while cow
+// reads never wait but every write copies the whole store, so it suits small, read-dominant datasets.
+func WithConcurrencyMode(mode string) Options {
+	return func(db *InMemoryDatabase) error {
+		store, err := newStore(mode)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			args := strings.Split(line, " ")
-			switch args[0] {
-			case "PUT":
-				if len(args) != 4 {
-					continue
-				}
-				key := args[1]
-
-				d := databaseEntry{
-					value: args[2],
-					ttl:   nil,
-				}
-
-				if args[3] != "-1" {
-					ttlInt, err := strconv.Atoi(args[3])
-					if err != nil {
-						continue
-					}
-					var ttl int64
-					ttl = int64(ttlInt)
-					d.ttl = &ttl
-				}
-
-				db.store(key, d)
-			case "DELETE":
-				if len(args) != 2 {
-					continue
-				}
-
-				db.delete(args[1])
-			}
+
+		// Keep anything loaded by earlier options
+		store.storeAll(db.database.entries())
+		db.database = store
+		db.s.ConcurrencyMode = mode
+		return nil
+	}
+}
+
+// WithReplayUntil stops the replay of the AOF startup file at the given point in time, so that the database can be
+// recovered to a moment before a bad batch of writes. Records written before the AOF carried timestamps are always
+// replayed.
+func WithReplayUntil(t time.Time) Options {
+	return func(db *InMemoryDatabase) error {
+		db.s.ReplayUntil = t
+		return nil
+	}
+}
+
+// WithTTLJitter randomly spreads every stored ttl by up to percent of its length in either direction, so that keys
+// written together with the same ttl do not all expire in the same second. For example, a jitter of 10 stores a ttl
+// of 100 seconds as anything from 90 to 110 seconds. The jittered ttl is what is written to the AOF so that replay
+// restores the same expirations. A ttl is never jittered below one second.
+func WithTTLJitter(percent float64) Options {
+	return func(db *InMemoryDatabase) error {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("ttl jitter must be between 0 and 100 percent, got %v", percent)
 		}
+		db.s.TTLJitter = percent
+		return nil
+	}
+}
 
+// WithNodeID sets the ID recorded alongside the sequence number of every AOF record. IDs must be stable across
+// restarts and unique between databases whose AOFs may be combined. A random ID is used by default.
+func WithNodeID(id string) Options {
+	return func(db *InMemoryDatabase) error {
+		if !nodeIDPattern.MatchString(id) {
+			return fmt.Errorf("invalid node id %q: must match %s", id, nodeIDPattern)
+		}
+		db.s.NodeID = id
 		return nil
 	}
 }
@@ -3,50 +3,113 @@ package database
 import (
 	"bytes"
 	"container/heap"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"github.com/google/uuid"
 	"log/slog"
+	"math/rand/v2"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// databaseEntry is stored by value in the map. Values are immutable strings so reads share them without copying, and
+// the expiration is a plain integer so that writes do not allocate a separate ttl.
 type databaseEntry struct {
-	value string
-	ttl   *int64
+	value      string
+	expiresAt  int64  // Unix seconds at which the entry expires. Zero if it never expires.
+	updatedAt  int64  // Unix seconds of the last Create or Put. Zero if unknown.
+	version    uint64 // The sequence number of the last write. Zero if unknown.
+	compressed bool   // Whether the value is compressed. Use plainValue to read it.
+}
+
+// expired reports whether the entry has expired at now
+func (e databaseEntry) expired(now int64) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now
+}
+
+// expiredNow reports whether the entry has expired, only reading the clock for entries with a ttl
+func (e databaseEntry) expiredNow(c Clock) bool {
+	return e.expiresAt != 0 && e.expiresAt <= c.Now().Unix()
 }
 
 type dbStore map[string]databaseEntry
 
-// InMemoryDatabase stores data in memory using a sync map to ensure thread safety. Receiver methods for
+// InMemoryDatabase stores data in memory in a store chosen by the concurrency mode. Receiver methods for
 // InMemoryDatabase assume already validated inputs. For example, in Put, the key and value should not be empty.
 type InMemoryDatabase struct {
-	database dbStore       // Store the database key, value pairs
-	ttl      *ttlHeap      // Store TTLs on a heap
-	mu       sync.RWMutex  // Mutex for coordinating ttlHeap cleaner and other operations
-	newItem  chan struct{} // This channel tells the cleaner routine when a ttl has been created/updated
-	s        settings      // Database settings
+	database kvStore                          // Store the database key, value pairs
+	ttl      *ttlHeap                         // Store TTLs on a heap
+	mu       sync.RWMutex                     // Mutex for coordinating ttlHeap cleaner and other operations
+	newItem  chan struct{}                    // This channel tells the cleaner routine when a ttl has been created/updated
+	s        settings                         // Database settings
+	startup  startupSummary                   // What was loaded from the startup files
+	seq      uint64                           // The sequence number of the last write. Only modified with the mutex held.
+	events   notifier                         // Subscribers to key events
+	usage    map[string]*namespaceUsage       // The size of each namespace with a quota. Only modified with the mutex held.
+	leases   map[string]*lease                // Leases by name. Only accessed with the mutex held.
+	warmup   warmup                           // Warming from the warmup fetcher after the startup files are loaded
+	mirror   mirror                           // Writes waiting to be forwarded to the mirror target
+	chaos    atomic.Pointer[FailureInjection] // The faults injected for testing. Nil when there are none.
+
+	persistence  persistenceTracker // The outcome of the AOF syncs and snapshots
+	aofAppendErr error              // The last append to the AOF that failed since it was synced. Only accessed with the mutex held.
+	changes      changeLog          // The recent mutations served by the change feed
+	search       *searchIndex       // The index searched by Search. Nil without WithSearchIndex.
+	stall        writeStall         // The persistence holding the mutex and the writes it stalled
+
+	history   map[string]*versionRing // The recent versions of each key. Nil without WithHistory. Only accessed with the mutex held.
+	evictor   evictor                 // When keys were last used, for evicting them under memory pressure
+	stats     accessCounter           // The reads and writes of every key for KeyStats
+	compactor compactor               // The deleted keys whose memory compaction reclaims
+
+	stopping   context.Context    // Done once Shutdown stops the background routines
+	stop       context.CancelFunc // Stops the background routines
+	persisting sync.WaitGroup     // The routines that Shutdown waits for, which have not stopped
 }
 
 // NewInMemoryDatabase returns a new InMemoryDatabase instance
 func NewInMemoryDatabase(opts ...Options) (db *InMemoryDatabase, err error) {
 	db = &InMemoryDatabase{
-		database: dbStore{},
+		database: &dbStore{},
 		ttl:      &ttlHeap{},
 		mu:       sync.RWMutex{},
 		newItem:  make(chan struct{}, 1),
 		s: settings{
-			shouldAofPersist:          false,
-			aofPersistenceFile:        "persistAof",
-			aofPersistencePeriod:      time.Second,
-			shouldDatabasePersist:     false,
-			databasePersistenceFile:   "persistDatabase.json",
-			databasePersistencePeriod: 5 * time.Minute,
-			logger:                    slog.New(slog.NewTextHandler(os.Stdout, nil)),
+			Settings: Settings{
+				ShouldAofPersist:          false,
+				AofPersistFile:            "persistAof",
+				AofPersistencePeriod:      time.Second,
+				ShouldDatabasePersist:     false,
+				DatabasePersistFile:       "persistDatabase.json",
+				DatabasePersistencePeriod: 5 * time.Minute,
+				IDScheme:                  IDSchemeUUIDv4,
+				ConcurrencyMode:           ConcurrencyRWMutex,
+				LoadProgressInterval:      DefaultLoadProgressInterval,
+				NodeID:                    newNodeID(),
+				PersistenceAlertPeriods:   DefaultPersistenceAlertPeriods,
+				PersistenceFailurePolicy:  PersistenceFailureContinue,
+				WriteStallPolicy:          WriteStallBlock,
+			},
+			logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+			clock:  realClock{},
+			newID: func() string {
+				return uuid.New().String()
+			},
+			randN:          rand.Int64N,
+			codec:          JSONCodec{},
+			memoryUsage:    heapObjects,
+			diskFree:       freeDiskSpace,
+			restartBackoff: defaultRestartBackoff,
 		},
+		persistence: persistenceTracker{started: time.Now(), statuses: map[string]*persistenceStatus{}},
 	}
 	heap.Init(db.ttl)
+	db.stopping, db.stop = context.WithCancel(context.Background())
 
 	for _, c := range opts {
 		err = c(db)
@@ -55,79 +118,189 @@ func NewInMemoryDatabase(opts ...Options) (db *InMemoryDatabase, err error) {
 		}
 	}
 
-	go db.ttlCleanup()
-	if db.s.shouldAofPersist {
-		go db.persistAofCycle()
+	err = db.s.validate()
+	if err == nil {
+		err = db.s.checkPersistenceDirs()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid database settings: %w", err)
+	}
+	db.s.clock = skewedClock{Clock: db.s.clock, chaos: &db.chaos}
+
+	err = db.loadStartupFiles()
+	if err != nil {
+		return
 	}
+	db.seedSequentialIDs()
+	db.resetUsage()
+	db.resetSearchIndex()
+	db.startChangeLog()
+	db.startHistory()
+	db.startEviction()
+	db.startKeyStats()
+	db.startCompaction()
 
-	if db.s.shouldDatabasePersist {
-		go db.persistDatabaseCycle()
+	if !db.s.ManualTTLCleanup {
+		db.goRecover("ttl cleanup", db.ttlCleanup)
 	}
+	db.startMirror()
+	db.startWarmup()
+	db.startPersistence()
 
 	return
 }
 
-// Shutdown will persistDatabase one last time if it is enabled.
-func (i *InMemoryDatabase) Shutdown() {
-	if i.s.shouldAofPersist {
-		i.persistAof()
+// startPersistence starts the routines of the enabled persistence methods, which run until Shutdown
+func (i *InMemoryDatabase) startPersistence() {
+	if i.s.ShouldAofPersist {
+		i.goPersist("aof persistence", func() { i.persistAofCycle(i.stopping) })
 	}
 
-	if i.s.shouldDatabasePersist {
-		i.persistDatabase()
+	if i.s.ShouldDatabasePersist {
+		i.goPersist("database persistence", func() { i.persistDatabaseCycle(i.stopping) })
 	}
 }
 
-// GetSettings returns the database settings so that the settings struct does not have to be an exported type
-func (i *InMemoryDatabase) GetSettings() struct {
-	AofStartupFile            string
-	ShouldAofPersist          bool
-	AofPersistFile            string
-	AofPersistencePeriod      time.Duration
-	DatabaseStartupFile       string
-	ShouldDatabasePersist     bool
-	DatabasePersistFile       string
-	DatabasePersistencePeriod time.Duration
+// goPersist runs the routine f like goRecover, tracking it until it stops so that Shutdown can wait for it. f should
+// return once i.stopping is done.
+func (i *InMemoryDatabase) goPersist(name string, f func()) {
+	i.persisting.Add(1)
+	go func() {
+		defer i.persisting.Done()
+		i.runRestarting(i.stopping, name, f)
+	}()
+}
+
+// Shutdown stops a warmup that is still running, gives queued writes a chance to reach the mirror target, and will
+// persistDatabase one last time if it is enabled. The persistence, eviction and compaction routines are stopped first,
+// so that nothing is written to the persistence files once it returns.
+func (i *InMemoryDatabase) Shutdown() {
+	i.stopWarmup()
+	i.stopMirror()
+	i.stop()
+	i.persisting.Wait()
+	i.Persist()
+}
+
+// GetInfo returns runtime statistics about the database
+func (i *InMemoryDatabase) GetInfo() struct {
+	Keys   int
+	Seq    uint64
+	NodeID string
 } {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
 	return struct {
-		AofStartupFile            string
-		ShouldAofPersist          bool
-		AofPersistFile            string
-		AofPersistencePeriod      time.Duration
-		DatabaseStartupFile       string
-		ShouldDatabasePersist     bool
-		DatabasePersistFile       string
-		DatabasePersistencePeriod time.Duration
+		Keys   int
+		Seq    uint64
+		NodeID string
 	}{
-		AofStartupFile:            i.s.aofStartupFile,
-		ShouldAofPersist:          i.s.shouldAofPersist,
-		AofPersistFile:            i.s.aofPersistenceFile,
-		AofPersistencePeriod:      i.s.aofPersistencePeriod,
-		DatabaseStartupFile:       i.s.databaseStartupFile,
-		ShouldDatabasePersist:     i.s.shouldDatabasePersist,
-		DatabasePersistFile:       i.s.databasePersistenceFile,
-		DatabasePersistencePeriod: i.s.databasePersistencePeriod,
+		Keys:   i.database.len(),
+		Seq:    i.seq,
+		NodeID: i.s.NodeID,
 	}
 }
 
-// Create a key value pair in the database
+// GetStartupSummary describes what was loaded from the startup files. Skipped counts the malformed and duplicate
+// records, and MalformedRecords says where the first few malformed ones are and why they could not be parsed, as they
+// are data that was not loaded.
+func (i *InMemoryDatabase) GetStartupSummary() struct {
+	Files            []string
+	Loaded           int
+	Skipped          int
+	Malformed        int
+	Duplicates       int
+	Expired          int
+	Duration         time.Duration
+	MalformedRecords []string
+} {
+	return struct {
+		Files            []string
+		Loaded           int
+		Skipped          int
+		Malformed        int
+		Duplicates       int
+		Expired          int
+		Duration         time.Duration
+		MalformedRecords []string
+	}{
+		Files:            slices.Clone(i.startup.files),
+		Loaded:           i.startup.loaded,
+		Skipped:          i.startup.skipped(),
+		Malformed:        i.startup.malformed,
+		Duplicates:       i.startup.duplicates,
+		Expired:          i.startup.expired,
+		Duration:         i.startup.duration,
+		MalformedRecords: slices.Clone(i.startup.malformedRecords),
+	}
+}
+
+// GetSettings returns a copy of the database settings
+func (i *InMemoryDatabase) GetSettings() Settings {
+	return i.s.Settings
+}
+
+// Create a key value pair in the database. If a key is supplied it is only used if it does not already exist.
+// Otherwise, a key is generated using the configured id scheme or key generator, and an error is returned if it keeps
+// generating keys that are already taken. A *LimitError is returned if the key or value is over its size limit or if
+// the write would take the namespace of the key over its quota.
 func (i *InMemoryDatabase) Create(data struct {
+	Key   string `json:"key"`
 	Value string `json:"value"`
 	Ttl   *int64 `json:"ttl"`
-}) (bool, string) {
-	i.mu.Lock()
+}) (bool, string, error) {
+	if err := i.injectFailure(true); err != nil {
+		return false, data.Key, err
+	}
+
+	if err := i.lockWrite(); err != nil {
+		return false, data.Key, err
+	}
 	defer i.mu.Unlock()
 
-	id := uuid.New().String()
-	newEntry := databaseEntry{value: data.Value}
-	var ttl int64
+	// Keys that have expired but that the cleaner has not removed yet are not taken
+	now := i.s.clock.Now().Unix()
+	taken := func(key string) bool {
+		dbEntry, loaded := i.load(key)
+		return loaded && !dbEntry.expired(now)
+	}
+
+	id := data.Key
+	if id == "" {
+		// Skip generated keys that are already taken, e.g. sequential ids colliding with client-supplied keys
+		for attempt := 0; ; attempt++ {
+			if attempt == maxIDAttempts && i.s.IDScheme == IDSchemeCustom {
+				return false, "", fmt.Errorf("generated %d keys that are already taken", maxIDAttempts)
+			}
+			id = i.s.newID()
+			if !taken(id) {
+				break
+			}
+		}
+	}
+	if taken(id) {
+		return false, id, nil
+	}
+	if err := i.checkLimits(id, data.Value); err != nil {
+		return false, id, err
+	}
+	stored, compressed := i.compress(data.Value)
+	if err := i.checkQuota(id, stored); err != nil {
+		return false, id, err
+	}
+
+	data.Ttl = i.jitter(data.Ttl)
+	i.aofPut(id, data.Value, data.Ttl)
+
+	newEntry := databaseEntry{value: stored, updatedAt: now, compressed: compressed, version: i.seq}
 	if data.Ttl != nil {
-		ttl = *data.Ttl + time.Now().Unix()
-		newEntry.ttl = &ttl
+		newEntry.expiresAt = *data.Ttl + now
 	}
-	_, loaded := i.loadOrStore(id, newEntry)
-	if data.Ttl != nil && !loaded {
-		heap.Push(i.ttl, ttlHeapData{id, ttl})
+	i.store(id, newEntry)
+
+	if data.Ttl != nil {
+		heap.Push(i.ttl, ttlHeapData{id, newEntry.expiresAt})
 
 		// Notify cleaner of new TTL
 		select {
@@ -136,69 +309,213 @@ func (i *InMemoryDatabase) Create(data struct {
 		}
 	}
 
-	if data.Ttl != nil {
-		i.appendToAof(fmt.Sprintf(`PUT %s %s %v`, id, data.Value, *data.Ttl))
-	} else {
-		i.appendToAof(fmt.Sprintf(`PUT %s %s %v`, id, data.Value, -1))
-	}
+	i.notify(EventCreated, id)
 
-	return !loaded, id
+	return true, id, nil
 }
 
 // Get a value from the database by key if it exists and is valid
 func (i *InMemoryDatabase) Get(key string) (string, bool) {
-	i.mu.RLock()
-	defer i.mu.RUnlock()
+	_ = i.injectFailure(false)
 
-	dbEntry, loaded := i.load(key)
-	if (loaded && dbEntry.ttl == nil) || (loaded && *dbEntry.ttl > time.Now().Unix()) {
-		return dbEntry.value, true
+	// Entries are copied out of the store so the clock is read after unlocking to keep the critical section short
+	dbEntry, loaded := i.readLoad(key)
+
+	if !loaded || dbEntry.expiredNow(i.s.clock) {
+		return "", false
+	}
+	i.recordAccess(key)
+	i.countAccess(key, false)
+	return dbEntry.plainValue(), true
+}
+
+// GetEntry returns a value alongside the time it was last modified and its version if it exists and is valid. The
+// modification time is the zero time and the version zero if they are unknown, e.g. for entries loaded from a snapshot
+// that predates them. The version is the sequence number of the last write to the key, so it changes on every write.
+func (i *InMemoryDatabase) GetEntry(key string) (struct {
+	Value     string
+	UpdatedAt time.Time
+	Version   uint64
+}, bool) {
+	_ = i.injectFailure(false)
+	dbEntry, loaded := i.readLoad(key)
+
+	var entry struct {
+		Value     string
+		UpdatedAt time.Time
+		Version   uint64
 	}
-	return "", false
+	if !loaded || dbEntry.expiredNow(i.s.clock) {
+		return entry, false
+	}
+	i.recordAccess(key)
+	i.countAccess(key, false)
+
+	entry.Value = dbEntry.plainValue()
+	entry.Version = dbEntry.version
+	if dbEntry.updatedAt != 0 {
+		entry.UpdatedAt = time.Unix(dbEntry.updatedAt, 0)
+	}
+	return entry, true
 }
 
 // GetTTL the remaining TTL for a given key
 func (i *InMemoryDatabase) GetTTL(key string) (*int64, bool) {
-	i.mu.RLock()
-	defer i.mu.RUnlock()
+	_ = i.injectFailure(false)
+	dbEntry, loaded := i.readLoad(key)
 
-	dbEntry, loaded := i.load(key)
-	if !loaded || (dbEntry.ttl != nil && *dbEntry.ttl <= time.Now().Unix()) {
+	if !loaded || dbEntry.expiresAt == 0 {
+		return nil, loaded
+	}
+
+	ttl := dbEntry.expiresAt - i.s.clock.Now().Unix()
+	if ttl <= 0 {
 		return nil, false
-	} else if dbEntry.ttl != nil {
-		var ttl int64
-		ttl = *dbEntry.ttl - time.Now().Unix()
-		return &ttl, true
 	}
-	return nil, true
+	return &ttl, true
 }
 
-// Put a key value pair into the database.
+// Put a key value pair into the database, returning whether the key already existed. A *LimitError is returned if the
+// key or value is over its size limit or if the write would take the namespace of the key over its quota.
 func (i *InMemoryDatabase) Put(data struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
 	Ttl   *int64 `json:"ttl"`
-}) bool {
-	i.mu.Lock()
+}) (bool, error) {
+	if err := i.injectFailure(true); err != nil {
+		return false, err
+	}
+	if err := i.checkLimits(data.Key, data.Value); err != nil {
+		return false, err
+	}
+	if err := i.rejectWrite(); err != nil {
+		return false, err
+	}
+	if loaded, ok := i.bufferPut(data.Key, data.Value, data.Ttl); ok {
+		return loaded, nil
+	}
+
+	if err := i.lockAdmitted(); err != nil {
+		return false, err
+	}
 	defer i.mu.Unlock()
 
-	if data.Ttl != nil {
-		i.appendToAof(fmt.Sprintf(`PUT %s %s %v`, data.Key, data.Value, *data.Ttl))
+	return i.put(data.Key, data.Value, i.jitter(data.Ttl))
+}
+
+// put stores the value under the key with the ttl, returning whether the key already existed. The key and value must
+// be within their size limits and the database mutex must be held.
+func (i *InMemoryDatabase) put(key string, value string, ttl *int64) (bool, error) {
+	stored, compressed := i.compress(value)
+	if err := i.checkQuota(key, stored); err != nil {
+		return false, err
+	}
+
+	i.aofPut(key, value, ttl)
+
+	_, loaded := i.load(key)
+	now := i.s.clock.Now().Unix()
+	newEntry := databaseEntry{value: stored, updatedAt: now, compressed: compressed, version: i.seq}
+	if ttl != nil {
+		newEntry.expiresAt = *ttl + now
+	}
+	i.store(key, newEntry)
+	if loaded {
+		i.notify(EventUpdated, key)
 	} else {
-		i.appendToAof(fmt.Sprintf(`PUT %s %s %v`, data.Key, data.Value, -1))
+		i.notify(EventCreated, key)
 	}
 
-	_, loaded := i.load(data.Key)
-	newEntry := databaseEntry{value: data.Value}
-	var ttl int64
-	if data.Ttl != nil {
-		ttl = *data.Ttl + time.Now().Unix()
-		newEntry.ttl = &ttl
+	if ttl != nil {
+		heap.Push(i.ttl, ttlHeapData{key, newEntry.expiresAt})
+
+		// Notify cleaner of new TTL
+		select {
+		case i.newItem <- struct{}{}:
+		default:
+		}
 	}
-	i.store(data.Key, newEntry)
 
-	if data.Ttl != nil {
-		heap.Push(i.ttl, ttlHeapData{data.Key, ttl})
+	return loaded, nil
+}
+
+// Update atomically replaces the value of an existing key with the result of calling f with its current value, keeping
+// its ttl. It returns false if the key does not exist or has expired. Errors from f are returned as they are and leave
+// the key unchanged, as do the *LimitErrors returned when the new value is over its size limit or would take the
+// namespace of the key over its quota. f is called with the database locked so it must not use the database.
+func (i *InMemoryDatabase) Update(key string, f func(value string) (string, error)) (bool, error) {
+	return i.update(key, false, nil, func(value string, _ bool) (string, error) {
+		return f(value)
+	})
+}
+
+// Upsert is Update for keys that may not exist yet. f is called with the current value and true, or with an empty
+// value and false if the key does not exist or has expired, in which case the result is stored without a ttl. It
+// returns whether the key existed. This is what data types stored in values, like bitmaps, build their operations on.
+func (i *InMemoryDatabase) Upsert(key string, f func(value string, exists bool) (string, error)) (bool, error) {
+	return i.update(key, true, nil, f)
+}
+
+// UpsertTTL is Upsert that also gives the key the ttl in seconds, so that state which is only useful while it is being
+// written, like the counters of a rate limiter, expires once it is left alone. The ttl is not jittered.
+func (i *InMemoryDatabase) UpsertTTL(key string, ttl int64, f func(value string, exists bool) (string, error)) (bool, error) {
+	return i.update(key, true, &ttl, f)
+}
+
+// update replaces the value of the key with the result of f under the lock, creating the key if create is set. The key
+// is given the ttl unless it is nil, in which case it keeps its own.
+func (i *InMemoryDatabase) update(key string, create bool, ttl *int64, f func(value string, exists bool) (string, error)) (bool, error) {
+	if err := i.injectFailure(true); err != nil {
+		return false, err
+	}
+
+	if err := i.lockWrite(); err != nil {
+		return false, err
+	}
+	defer i.mu.Unlock()
+
+	now := i.s.clock.Now().Unix()
+	dbEntry, loaded := i.load(key)
+	exists := loaded && !dbEntry.expired(now)
+	if !exists && !create {
+		return false, nil
+	}
+	if !exists {
+		dbEntry = databaseEntry{}
+	}
+
+	value, err := f(dbEntry.plainValue(), exists)
+	if err != nil {
+		return exists, err
+	}
+	if err = i.checkLimits(key, value); err != nil {
+		return exists, err
+	}
+	stored, compressed := i.compress(value)
+	if err = i.checkQuota(key, stored); err != nil {
+		return exists, err
+	}
+
+	// The AOF records the remaining ttl, which replays to the same expiration
+	expire := ttl != nil
+	if expire {
+		dbEntry.expiresAt = now + *ttl
+	} else if dbEntry.expiresAt != 0 {
+		remaining := dbEntry.expiresAt - now
+		ttl = &remaining
+	}
+	i.aofPut(key, value, ttl)
+
+	dbEntry.value, dbEntry.compressed, dbEntry.updatedAt, dbEntry.version = stored, compressed, now, i.seq
+	i.store(key, dbEntry)
+	if exists {
+		i.notify(EventUpdated, key)
+	} else {
+		i.notify(EventCreated, key)
+	}
+
+	if expire {
+		heap.Push(i.ttl, ttlHeapData{key, dbEntry.expiresAt})
 
 		// Notify cleaner of new TTL
 		select {
@@ -206,79 +523,389 @@ func (i *InMemoryDatabase) Put(data struct {
 		default:
 		}
 	}
+	return exists, nil
+}
+
+// ExpirePrefix applies a TTL to every key that starts with prefix in a single pass under the lock. It returns the
+// number of keys that were given the TTL. Like other writes that change ttls, it returns an error if the write stall
+// or persistence failure policy rejects it.
+func (i *InMemoryDatabase) ExpirePrefix(prefix string, ttl int64) (int, error) {
+	if err := i.injectFailure(true); err != nil {
+		return 0, err
+	}
+
+	if err := i.lockWrite(); err != nil {
+		return 0, err
+	}
+	defer i.mu.Unlock()
+
+	now := i.s.clock.Now().Unix()
+	updates := dbStore{}
+	for key, dbEntry := range i.database.rangeEntries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		// Entries that have already expired are left for the cleaner
+		if dbEntry.expired(now) {
+			continue
+		}
+
+		// Each key is jittered separately since a prefix is exactly the kind of batch that would otherwise expire together
+		keyTTL := *i.jitter(&ttl)
+		dbEntry.expiresAt = now + keyTTL
+		updates[key] = dbEntry
+		heap.Push(i.ttl, ttlHeapData{key, dbEntry.expiresAt})
+		i.aofPut(key, dbEntry.plainValue(), &keyTTL)
+		dbEntry.version = i.seq
+		i.notify(EventUpdated, key)
+	}
+
+	// Updates are stored together so that a copy-on-write store only copies once
+	i.database.storeAll(updates)
+
+	n := len(updates)
+	if n > 0 {
+		// Notify cleaner of new TTLs
+		select {
+		case i.newItem <- struct{}{}:
+		default:
+		}
+	}
+
+	return n, nil
+}
+
+// Touch gives an existing key the ttl in seconds without changing its value, e.g. to keep a heartbeat key alive. It
+// returns false if the key does not exist or has expired. The ttl is jittered like that of a Put, and touching a key
+// written under a lease takes it out of the lease like overwriting it does.
+func (i *InMemoryDatabase) Touch(key string, ttl int64) (bool, error) {
+	if err := i.injectFailure(true); err != nil {
+		return false, err
+	}
+
+	if err := i.lockWrite(); err != nil {
+		return false, err
+	}
+	defer i.mu.Unlock()
+
+	now := i.s.clock.Now().Unix()
+	dbEntry, loaded := i.load(key)
+	if !loaded || dbEntry.expired(now) {
+		return false, nil
+	}
+
+	keyTTL := *i.jitter(&ttl)
+	i.aofPut(key, dbEntry.plainValue(), &keyTTL)
+	dbEntry.expiresAt, dbEntry.version = now+keyTTL, i.seq
+	i.store(key, dbEntry)
+	i.notify(EventUpdated, key)
+	heap.Push(i.ttl, ttlHeapData{key, dbEntry.expiresAt})
+
+	// Notify cleaner of new TTL
+	select {
+	case i.newItem <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// deletePrefixBatch is the number of keys DeletePrefix deletes each time it takes the lock
+const deletePrefixBatch = 1000
+
+// DeletePrefix deletes every key that starts with prefix, returning the number of keys deleted. The matching keys are
+// found under a read lock and then deleted in batches, releasing the lock between batches so that other requests are
+// not blocked for the whole delete. Keys written with the prefix after the matching keys were found are kept. With
+// dryRun, nothing is deleted and the number of keys that would be deleted is returned. Expired keys are left for the
+// cleaner and are not counted.
+func (i *InMemoryDatabase) DeletePrefix(prefix string, dryRun bool) int {
+	_ = i.injectFailure(false)
+
+	i.mu.RLock()
+	now := i.s.clock.Now().Unix()
+	var keys []string
+	for key, dbEntry := range i.database.rangeEntries {
+		if strings.HasPrefix(key, prefix) && !dbEntry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	i.mu.RUnlock()
+
+	if dryRun {
+		return len(keys)
+	}
 
-	return loaded
+	n := 0
+	for batch := range slices.Chunk(keys, deletePrefixBatch) {
+		i.mu.Lock()
+		now = i.s.clock.Now().Unix()
+		for _, key := range batch {
+			// The key may have been deleted or expired since it was found
+			if dbEntry, loaded := i.load(key); !loaded || dbEntry.expired(now) {
+				continue
+			}
+			i.aofDelete(key)
+			i.delete(key)
+			i.notify(EventDeleted, key)
+			n++
+		}
+		i.mu.Unlock()
+	}
+	return n
+}
+
+// jitter returns the ttl spread randomly by up to the configured jitter percentage, or the ttl itself when there is no
+// jitter. Nil ttls never expire and are returned as they are.
+func (i *InMemoryDatabase) jitter(ttl *int64) *int64 {
+	if ttl == nil || i.s.TTLJitter == 0 {
+		return ttl
+	}
+
+	spread := int64(float64(*ttl) * i.s.TTLJitter / 100)
+	if spread <= 0 {
+		return ttl
+	}
+	jittered := max(*ttl+i.s.randN(2*spread+1)-spread, 1)
+	return &jittered
+}
+
+// Scan returns up to limit keys with the prefix in lexicographic order, starting after cursor. The returned cursor is
+// the last key returned, to be passed to the next call, or empty once there are no more keys. Expired keys are skipped.
+// A limit of zero or less returns an empty page.
+func (i *InMemoryDatabase) Scan(prefix string, cursor string, limit int) ([]string, string) {
+	_ = i.injectFailure(false)
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.scan(prefix, cursor, limit, i.s.clock.Now().Unix())
+}
+
+// ScanEntries is Scan for entries rather than keys. The ttl of each entry is the number of seconds remaining, or nil
+// if the entry never expires. Keys and values are read under the same lock, so a page is a consistent snapshot.
+func (i *InMemoryDatabase) ScanEntries(prefix string, cursor string, limit int) ([]struct {
+	Key   string
+	Value string
+	Ttl   *int64
+}, string) {
+	_ = i.injectFailure(false)
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	now := i.s.clock.Now().Unix()
+	keys, next := i.scan(prefix, cursor, limit, now)
+	entries := make([]struct {
+		Key   string
+		Value string
+		Ttl   *int64
+	}, len(keys))
+	for n, key := range keys {
+		dbEntry, _ := i.load(key)
+		entries[n].Key = key
+		entries[n].Value = dbEntry.plainValue()
+		if dbEntry.expiresAt != 0 {
+			ttl := dbEntry.expiresAt - now
+			entries[n].Ttl = &ttl
+		}
+	}
+	return entries, next
+}
+
+// scan finds the page of keys for Scan. Only the smallest limit+1 keys are kept while iterating, so memory is bounded
+// by the page size rather than by the number of matching keys. The extra key tells whether another page follows.
+func (i *InMemoryDatabase) scan(prefix string, cursor string, limit int, now int64) ([]string, string) {
+	if limit <= 0 {
+		return nil, ""
+	}
+
+	var keys []string
+	for key, dbEntry := range i.database.rangeEntries {
+		if key <= cursor || !strings.HasPrefix(key, prefix) || dbEntry.expired(now) {
+			continue
+		}
+		keys = append(keys, key)
+		if len(keys) >= 2*(limit+1) {
+			slices.Sort(keys)
+			keys = keys[:limit+1]
+		}
+	}
+	slices.Sort(keys)
+
+	if len(keys) <= limit {
+		return keys, ""
+	}
+	return keys[:limit], keys[limit-1]
 }
 
 // Delete a key value pair from the database
 func (i *InMemoryDatabase) Delete(key string) bool {
-	i.mu.Lock()
+	_ = i.injectFailure(false)
+
+	i.lockDelete()
 	defer i.mu.Unlock()
 
-	i.appendToAof(fmt.Sprintf(`DELETE %s`, key))
+	if _, loaded := i.load(key); !loaded {
+		return false
+	}
+
+	i.aofDelete(key)
+	i.delete(key)
+	i.notify(EventDeleted, key)
+	return true
+}
+
+// DeleteIf deletes the key if cond returns true for its value and version, checking and deleting atomically so that
+// a write that lands in between can never be lost. It returns whether the key was deleted and whether it existed, so
+// a key that exists but failed the condition returns false, true. Expired keys do not exist. cond is called with the
+// database locked so it must not use the database.
+func (i *InMemoryDatabase) DeleteIf(key string, cond func(value string, version uint64) bool) (bool, bool) {
+	_ = i.injectFailure(false)
+
+	i.lockDelete()
+	defer i.mu.Unlock()
+
+	dbEntry, loaded := i.load(key)
+	if !loaded || dbEntry.expired(i.s.clock.Now().Unix()) {
+		return false, false
+	}
+	if !cond(dbEntry.plainValue(), dbEntry.version) {
+		return false, true
+	}
 
-	_, loaded := i.loadAndDelete(key)
-	return loaded
+	i.aofDelete(key)
+	i.delete(key)
+	i.notify(EventDeleted, key)
+	return true, true
 }
 
 // ttlCleanup performs routine ttlHeap cleanup
 func (i *InMemoryDatabase) ttlCleanup() {
 	i.s.logger.Info("starting ttl cleanup routine")
 	for {
-		i.mu.Lock()
-
-		if len(*i.ttl) == 0 {
-			i.mu.Unlock()
+		// Get the earliest expiring ttl and a delay from now until it is expired
+		delay, ok := i.nextExpiry()
+		if !ok {
 			<-i.newItem
 			continue
 		}
 
-		// Get the earliest expiring ttl and a delay from now until it is expired
-		next := i.ttl.Peak().(ttlHeapData).ttl
-		now := time.Now().Unix()
-		delay := next - now
-
-		i.mu.Unlock()
-
 		// Wait until either a new item is created or the delay has finished
 		if delay > 0 {
+			timer := i.s.clock.NewTimer(time.Duration(delay) * time.Second)
 			select {
-			case <-time.After(time.Duration(delay) * time.Second):
+			case <-timer.C():
 			case <-i.newItem:
+				timer.Stop()
 				i.s.logger.Info("ttl cleanup routine new item")
 				continue
 			}
 		}
 
-		i.mu.Lock()
-		for len(*i.ttl) > 0 {
-			timeLeft := i.ttl.Peak().(ttlHeapData).ttl - time.Now().Unix()
-			if timeLeft > 0 {
-				break
-			}
+		i.removeExpired()
+	}
+}
 
-			heapData := heap.Pop(i.ttl).(ttlHeapData)
-			key := heapData.key
-			ttl := heapData.ttl
+// nextExpiry returns the number of seconds until the earliest ttl expires. It returns false if there are no ttls.
+func (i *InMemoryDatabase) nextExpiry() (int64, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(*i.ttl) == 0 {
+		return 0, false
+	}
+
+	return i.ttl.Peak().(ttlHeapData).ttl - i.s.clock.Now().Unix(), true
+}
 
-			// Delete only if it still exists and the ttl has not been modified
+// removeExpired deletes every entry whose ttl has expired, returning their keys in the order they were removed. Keys
+// that expire in the same second are removed in key order, so that the AOF and events are deterministic.
+func (i *InMemoryDatabase) removeExpired() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var removed []string
+	var batch []string
+	now := i.s.clock.Now().Unix()
+	for len(*i.ttl) > 0 {
+		ttl := i.ttl.Peak().(ttlHeapData).ttl
+		if ttl > now {
+			break
+		}
+
+		batch = batch[:0]
+		for len(*i.ttl) > 0 && i.ttl.Peak().(ttlHeapData).ttl == ttl {
+			batch = append(batch, heap.Pop(i.ttl).(ttlHeapData).key)
+		}
+		slices.Sort(batch)
+
+		// Delete only if it still exists and the ttl has not been modified
+		for _, key := range batch {
 			dbEntry, loaded := i.load(key)
-			if loaded && dbEntry.ttl != nil && *dbEntry.ttl == ttl {
-				i.appendToAof(fmt.Sprintf(`DELETE %s`, key))
+			if loaded && dbEntry.expiresAt == ttl {
+				i.aofDelete(key)
 				i.delete(key)
+				i.notify(EventExpired, key)
+				removed = append(removed, key)
 			}
 		}
-		i.mu.Unlock()
 	}
+	return removed
+}
+
+// aofPut assigns the next sequence number to a PUT, queues it for the mirror target and the change feed, records it
+// in the history and the stats of the key, and appends it to the AOF. The line is only built when AOF persistence is
+// enabled so that writes do not pay for formatting otherwise. A nil ttl is recorded as -1.
+func (i *InMemoryDatabase) aofPut(key string, value string, ttl *int64) {
+	i.seq++
+	i.countAccess(key, true)
+	if i.mirror.target != nil || i.changes.entries != nil || i.history != nil {
+		now := i.s.clock.Now()
+		var expiresAt int64
+		if ttl != nil {
+			expiresAt = now.Unix() + *ttl
+		}
+		if i.mirror.target != nil {
+			i.enqueueMirror(mirrorWrite{key: key, value: value, expiresAt: expiresAt, at: now})
+		}
+		i.appendChange(change{Seq: i.seq, Op: ChangePut, Key: key, Value: value, ExpiresAt: expiresAt, Time: now})
+		i.recordVersion(key, keyVersion{Version: i.seq, Value: value, ExpiresAt: expiresAt, Time: now})
+	}
+	if !i.s.ShouldAofPersist {
+		return
+	}
+
+	r := aofRecord{op: "PUT", key: key, value: value, ttl: -1, ts: i.s.clock.Now().UnixMilli(), seq: i.seq, node: i.s.NodeID}
+	if ttl != nil {
+		r.ttl = *ttl
+	}
+	i.appendToAof(string(appendAofRecord(nil, r)))
+}
+
+// aofDelete assigns the next sequence number to a DELETE, queues it for the mirror target and the change feed, drops
+// the history of the key, and appends it to the AOF
+func (i *InMemoryDatabase) aofDelete(key string) {
+	i.seq++
+	i.forgetVersions(key)
+	if i.mirror.target != nil {
+		i.enqueueMirror(mirrorWrite{delete: true, key: key, at: i.s.clock.Now()})
+	}
+	i.appendChange(change{Seq: i.seq, Op: ChangeDelete, Key: key, Time: i.s.clock.Now()})
+	if !i.s.ShouldAofPersist {
+		return
+	}
+
+	r := aofRecord{op: "DELETE", key: key, ts: i.s.clock.Now().UnixMilli(), seq: i.seq, node: i.s.NodeID}
+	i.appendToAof(string(appendAofRecord(nil, r)))
 }
 
-// appendToAof will append a line to the AOF file. This function assumes a lock has been acquired.
+// appendToAof will append a line to the AOF file. This function assumes a lock has been acquired. Nothing is appended
+// while buffered puts are applied, as they were appended when they were buffered.
 func (i *InMemoryDatabase) appendToAof(line string) {
-	if !i.s.shouldAofPersist {
+	if !i.s.ShouldAofPersist || i.stall.applying {
 		return
 	}
 
-	file, err := os.OpenFile(i.s.aofPersistenceFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	file, err := os.OpenFile(i.s.AofPersistFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		i.s.logger.Error("failed to open aof persistence file", "err", err)
 		return
@@ -294,33 +921,54 @@ func (i *InMemoryDatabase) appendToAof(line string) {
 	_, err = file.WriteString(line + "\n")
 	if err != nil {
 		i.s.logger.Error("failed to append to aof persistence file", "err", err)
+		i.aofAppendErr = err
 		return
 	}
 }
 
-// persistAofCycle will call the persistAof function based on a configured period
-func (i *InMemoryDatabase) persistAofCycle() {
+// persistAofCycle will call the persistAof function based on a configured period until ctx is done
+func (i *InMemoryDatabase) persistAofCycle(ctx context.Context) {
 	i.s.logger.Info("starting AOF persistence routine")
 	for {
-		<-time.After(time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
 		i.persistAof()
 	}
 }
 
-// persistAof will sync the AOF file to make sure all changes are up to date
+// persistAof will sync the AOF file to make sure all changes are up to date, recording the outcome
 func (i *InMemoryDatabase) persistAof() {
+	start := time.Now()
+	i.recordPersistence(PersistenceAOF, start, i.syncAof())
+}
+
+// syncAof syncs the AOF file, logging and returning the first error. Appends that failed since the last sync fail it
+// too, as records were lost.
+func (i *InMemoryDatabase) syncAof() error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
 	i.s.logger.Info("attempting to persist aof data")
 
-	file, err := os.OpenFile(i.s.aofPersistenceFile, os.O_SYNC|os.O_CREATE, 0644)
+	if err := i.aofAppendErr; err != nil {
+		i.aofAppendErr = nil
+		return fmt.Errorf("failed to append to the aof since the last sync: %w", err)
+	}
+	if err := i.checkDiskSpace(PersistenceAOF, i.s.AofPersistFile, 0); err != nil {
+		i.s.logger.Error("not syncing aof persistence file", "err", err)
+		return err
+	}
+
+	file, err := os.OpenFile(i.s.AofPersistFile, os.O_SYNC|os.O_CREATE, 0644)
 	if err != nil {
 		i.s.logger.Error("failed to open aof persistence file", "err", err)
-		return
+		return err
 	}
 	defer func() {
-		err = file.Close()
+		err := file.Close()
 		if err != nil {
 			i.s.logger.Error("error closing persistence file: ", "err", err)
 			return
@@ -330,54 +978,69 @@ func (i *InMemoryDatabase) persistAof() {
 	err = file.Sync()
 	if err != nil {
 		i.s.logger.Error("failed to sync aof persistence file", "err", err)
-		return
+		return err
 	}
+	return nil
 }
 
-// persistDatabaseCycle will call the persistDatabase function based on a configured period
-func (i *InMemoryDatabase) persistDatabaseCycle() {
+// persistDatabaseCycle will call the persistDatabase function based on a configured period until ctx is done
+func (i *InMemoryDatabase) persistDatabaseCycle(ctx context.Context) {
 	i.s.logger.Info("starting database persistence routine")
 	for {
-		<-time.After(i.s.databasePersistencePeriod)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(i.s.DatabasePersistencePeriod):
+		}
 		i.persistDatabase()
 	}
 }
 
-// persistDatabase will attempt to persistDatabase all storage data to the configured output file
+// persistDatabase will attempt to persistDatabase all storage data to the configured output file, recording the
+// outcome
 func (i *InMemoryDatabase) persistDatabase() {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+	start := time.Now()
+	i.recordPersistence(PersistenceSnapshot, start, i.writeSnapshot())
+}
 
+// writeSnapshot writes the database to its persistence file, logging and returning the first error. The database is
+// only held while it is encoded, with writes following the write stall policy.
+func (i *InMemoryDatabase) writeSnapshot() error {
 	i.s.logger.Info("attempting to persist database data")
 
-	// Make sure the file is open
-	file, err := os.Create(i.s.databasePersistenceFile)
-	defer func() {
-		err = file.Close()
-		if err != nil {
-			i.s.logger.Error("error closing persistence file: ", "err", err)
-			return
-		}
-	}()
-
-	if err != nil {
-		i.s.logger.Error("error opening/creating persistence file: ", "err", err)
-		return
-	}
-
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
-	err = enc.Encode(i)
+	i.lockForPersistence(PersistenceSnapshot)
+	err := enc.Encode(i)
+	i.unlockForPersistence()
 	if err != nil {
 		i.s.logger.Error("error marshaling database: ", "err", err)
-		return
+		return err
 	}
 
-	_, err = file.Write(buf.Bytes())
+	err = i.checkDiskSpace(PersistenceSnapshot, i.s.DatabasePersistFile, uint64(buf.Len()))
 	if err != nil {
-		i.s.logger.Error("error writing database json to file: ", "err", err)
-		return
+		i.s.logger.Error("not writing database to persistence file", "err", err)
+		return err
+	}
+	err = i.replaceSnapshot(buf.Bytes())
+	if err != nil {
+		i.s.logger.Error("error writing database to persistence file: ", "err", err)
+		return err
+	}
+	return nil
+}
+
+// readLoad loads an entry for a read-only operation. The database mutex is only taken when the store needs it, so
+// reads in the sharded and cow concurrency modes do not contend with writers on it.
+func (i *InMemoryDatabase) readLoad(key string) (databaseEntry, bool) {
+	if i.database.concurrentReads() {
+		return i.database.load(key)
 	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.database.load(key)
 }
 
 // These helper functions assume the caller has locked the database mutex
@@ -385,36 +1048,41 @@ func (i *InMemoryDatabase) persistDatabase() {
 // If the key exists in the database, return the associated entry alongside True.
 // Otherwise, return the zero value alongside False.
 func (i *InMemoryDatabase) load(key string) (databaseEntry, bool) {
-	d, loaded := i.database[key]
-	return d, loaded
+	return i.database.load(key)
 }
 
 // Delete the key value pair from the database
 func (i *InMemoryDatabase) delete(key string) {
-	delete(i.database, key)
-}
-
-// If the key exists in the database, delete it and return the deleted entry alongside True.
-// Otherwise, return a zero value alongside False.
-func (i *InMemoryDatabase) loadAndDelete(key string) (databaseEntry, bool) {
-	d, loaded := i.load(key)
-	i.delete(key)
-	return d, loaded
+	if i.usage != nil || i.search != nil {
+		if old, loaded := i.load(key); loaded {
+			if i.usage != nil {
+				i.trackUsage(key, &old, nil)
+			}
+			if i.search != nil {
+				i.indexEntry(key, &old, nil)
+			}
+		}
+	}
+	i.forgetAccess(key)
+	i.forgetStats(key)
+	i.database.delete(key)
+	i.compactor.deleted.Add(1)
 }
 
 // Store the key value pair in the database
 func (i *InMemoryDatabase) store(key string, d databaseEntry) {
-	i.database[key] = d
-}
-
-// If the key exists in the database storage, loadOrStore will return the existing entry and True.
-// Otherwise, it will return the new entry and False.
-func (i *InMemoryDatabase) loadOrStore(key string, d databaseEntry) (databaseEntry, bool) {
-	o, loaded := i.load(key)
-	if loaded {
-		return o, true
+	if i.usage != nil || i.search != nil {
+		var old *databaseEntry
+		if o, loaded := i.load(key); loaded {
+			old = &o
+		}
+		if i.usage != nil {
+			i.trackUsage(key, old, &d)
+		}
+		if i.search != nil {
+			i.indexEntry(key, old, &d)
+		}
 	}
-
-	i.store(key, d)
-	return d, false
+	i.recordAccess(key)
+	i.database.store(key, d)
 }
@@ -3,19 +3,46 @@ package database
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// testClockStart is the time the clocks of the tests start at
+var testClockStart = time.Unix(1_000_000_000, 0)
+
+// blockUntilTimers waits until at least n timers of the clock are waiting to fire
+func blockUntilTimers(t *testing.T, clock *ManualClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if clock.Timers() >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %v timers", n)
+}
+
 type createCall struct {
 	value string // value for the Create
 	ttl   int64  // TTL for the Create
@@ -37,6 +64,7 @@ func setupHelper(i *InMemoryDatabase, functions *[]any, expectedOrder *map[strin
 		switch function.(type) {
 		case *createCall:
 			arguments := struct {
+				Key   string `json:"key"`
 				Value string `json:"value"`
 				Ttl   *int64 `json:"ttl"`
 			}{
@@ -46,7 +74,7 @@ func setupHelper(i *InMemoryDatabase, functions *[]any, expectedOrder *map[strin
 				arguments.Ttl = &function.(*createCall).ttl
 			}
 
-			_, uuid := i.Create(arguments)
+			_, uuid, _ := i.Create(arguments)
 			if expectedOrder != nil {
 				(*expectedOrder)[uuid] = function.(*createCall).index
 			}
@@ -72,8 +100,10 @@ func setupHelper(i *InMemoryDatabase, functions *[]any, expectedOrder *map[strin
 
 func TestInMemoryDatabase_Create(t *testing.T) {
 	type test []struct {
+		key         string // The optional client-supplied key for the Create
 		value       string // The value for the Create
 		ttl         *int64 // The ttl for the Create
+		created     bool   // Whether the Create should succeed
 		loadedValue string // What value should be loaded after the Create
 	}
 
@@ -86,6 +116,24 @@ func TestInMemoryDatabase_Create(t *testing.T) {
 			cases: test{
 				{
 					value:       "value",
+					created:     true,
+					loadedValue: "value",
+				},
+			},
+		},
+		{
+			name: "Create with a client-supplied key",
+			cases: test{
+				{
+					key:         "key",
+					value:       "value",
+					created:     true,
+					loadedValue: "value",
+				},
+				{
+					key:         "key",
+					value:       "other",
+					created:     false,
 					loadedValue: "value",
 				},
 			},
@@ -101,14 +149,22 @@ func TestInMemoryDatabase_Create(t *testing.T) {
 
 			for _, testCase := range tt.cases {
 				data := struct {
+					Key   string `json:"key"`
 					Value string `json:"value"`
 					Ttl   *int64 `json:"ttl"`
 				}{
+					Key:   testCase.key,
 					Value: testCase.value,
 					Ttl:   testCase.ttl,
 				}
 
-				_, key := i.Create(data)
+				created, key, _ := i.Create(data)
+				if created != testCase.created {
+					t.Errorf("Create() created = %v, want %v", created, testCase.created)
+				}
+				if testCase.key != "" && key != testCase.key {
+					t.Errorf("Create() key = %v, want %v", key, testCase.key)
+				}
 				val, loaded := i.load(key)
 				if val.value != testCase.loadedValue {
 					t.Errorf("Error loading value: Create() = %v, want %v where loaded = %v", val, testCase.loadedValue, loaded)
@@ -118,6 +174,515 @@ func TestInMemoryDatabase_Create(t *testing.T) {
 	}
 }
 
+func TestInMemoryDatabase_CreateExpired(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock), WithManualTTLCleanup(), WithKeyGenerator(func() string {
+		return "generated"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl := int64(10)
+	for _, key := range []string{"key", ""} {
+		if created, _, err := i.Create(kv{Key: key, Value: "old", Ttl: &ttl}); !created || err != nil {
+			t.Fatalf("Create(%q) = %v, %v; want it created", key, created, err)
+		}
+	}
+	clock.Advance(10 * time.Second)
+
+	// Keys that have expired but were not removed yet can be created again, whether supplied or generated
+	for key, want := range map[string]string{"key": "key", "": "generated"} {
+		created, id, err := i.Create(kv{Key: key, Value: "new"})
+		if !created || err != nil || id != want {
+			t.Errorf("Create(%q) = %v, %v, %v; want %v created", key, created, id, err, want)
+		}
+		if v, ok := i.Get(want); !ok || v != "new" {
+			t.Errorf("Get(%q) = %v, %v; want new", want, v, ok)
+		}
+	}
+
+	// The stale ttls of the expired entries do not remove the new ones
+	if removed := i.StepTTLCleaner(); len(removed) != 0 {
+		t.Errorf("StepTTLCleaner() removed %v; want nothing", removed)
+	}
+}
+
+func TestInMemoryDatabase_IDScheme(t *testing.T) {
+	tests := []struct {
+		scheme string
+		valid  func(string) bool
+	}{
+		{
+			scheme: IDSchemeUUIDv4,
+			valid: func(id string) bool {
+				u, err := uuid.Parse(id)
+				return err == nil && u.Version() == 4
+			},
+		},
+		{
+			scheme: IDSchemeUUIDv7,
+			valid: func(id string) bool {
+				u, err := uuid.Parse(id)
+				return err == nil && u.Version() == 7
+			},
+		},
+		{
+			scheme: IDSchemeNanoID,
+			valid: func(id string) bool {
+				return len(id) == nanoIDLength && strings.Trim(id, nanoIDAlphabet) == ""
+			},
+		},
+		{
+			scheme: IDSchemeSequential,
+			valid: func(id string) bool {
+				_, err := strconv.ParseUint(id, 10, 64)
+				return err == nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			i, err := NewInMemoryDatabase(WithIDScheme(tt.scheme))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			seen := map[string]bool{}
+			for range 100 {
+				created, key, _ := i.Create(struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+					Ttl   *int64 `json:"ttl"`
+				}{Value: "value"})
+				if !created {
+					t.Fatalf("Create() created = false for generated key %v", key)
+				}
+				if !tt.valid(key) {
+					t.Errorf("Create() key %v is not a valid %v id", key, tt.scheme)
+				}
+				if seen[key] {
+					t.Errorf("Create() generated duplicate key %v", key)
+				}
+				seen[key] = true
+			}
+		})
+	}
+
+	t.Run("sequential skips taken keys", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(WithIDScheme(IDSchemeSequential))
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.Create(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: "1", Value: "client"})
+
+		_, key, _ := i.Create(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Value: "generated"})
+		if key != "2" {
+			t.Errorf("Create() key = %v; want %v", key, "2")
+		}
+	})
+
+	t.Run("sequential skips more taken keys than custom generators may", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(WithIDScheme(IDSchemeSequential))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := range maxIDAttempts + 1 {
+			i.Create(struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Ttl   *int64 `json:"ttl"`
+			}{Key: strconv.Itoa(n + 1), Value: "client"})
+		}
+
+		created, key, err := i.Create(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Value: "generated"})
+		if want := strconv.Itoa(maxIDAttempts + 2); !created || key != want || err != nil {
+			t.Errorf("Create() = %v, %v, %v; want true, %v, nil", created, key, err, want)
+		}
+	})
+
+	t.Run("sequential continues after the keys loaded at startup", func(t *testing.T) {
+		aof := filepath.Join(t.TempDir(), "aof")
+		var b []byte
+		for n, key := range []string{"7", "120", "abc", "35"} {
+			b = append(appendAofRecord(b, aofRecord{op: "PUT", key: key, value: "v", ttl: -1, ts: 1, seq: uint64(n + 1), node: "n"}), '\n')
+		}
+		if err := os.WriteFile(aof, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		i, err := NewInMemoryDatabase(WithIDScheme(IDSchemeSequential), WithInitialData(aof, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, key, _ := i.Create(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Value: "generated"})
+		if key != "121" {
+			t.Errorf("Create() key = %v; want %v", key, "121")
+		}
+	})
+
+	t.Run("unknown scheme", func(t *testing.T) {
+		if _, err := NewInMemoryDatabase(WithIDScheme("bogus")); err == nil {
+			t.Error("expected error for unknown id scheme")
+		}
+	})
+
+	t.Run("key generator", func(t *testing.T) {
+		ids := []string{"a", "a", "b"}
+		i, err := NewInMemoryDatabase(WithKeyGenerator(func() string {
+			id := ids[0]
+			ids = ids[1:]
+			return id
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.GetSettings().IDScheme != IDSchemeCustom {
+			t.Errorf("IDScheme = %v; want %v", i.GetSettings().IDScheme, IDSchemeCustom)
+		}
+
+		data := struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Value: "generated"}
+		for _, want := range []string{"a", "b"} {
+			if created, key, err := i.Create(data); !created || key != want || err != nil {
+				t.Errorf("Create() = %v, %v, %v; want true, %v, nil", created, key, err, want)
+			}
+		}
+	})
+
+	t.Run("key generator that keeps returning taken keys", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(WithKeyGenerator(func() string { return "same" }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Value: "generated"}
+		i.Create(data)
+		if created, _, err := i.Create(data); created || err == nil {
+			t.Errorf("Create() = %v, %v; want an error once the generated keys are taken", created, err)
+		}
+	})
+
+	t.Run("nil key generator", func(t *testing.T) {
+		if _, err := NewInMemoryDatabase(WithKeyGenerator(nil)); err == nil {
+			t.Error("expected error for a nil key generator")
+		}
+	})
+}
+
+func TestInMemoryDatabase_Codec(t *testing.T) {
+	type user struct {
+		Name  string
+		Age   int
+		Tags  []string
+		Admin bool
+	}
+	want := user{Name: "Ada", Age: 36, Tags: []string{"math", "engines"}}
+
+	for name, codec := range map[string]Codec{"json": JSONCodec{}, "msgpack": MsgpackCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			i, err := NewInMemoryDatabase(WithCodec(codec))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ttl := int64(60)
+			if existed, err := PutAs(i, "user:1", want, &ttl); existed || err != nil {
+				t.Fatalf("PutAs() = %v, %v; want false, nil", existed, err)
+			}
+			got, ok, err := GetAs[user](i, "user:1")
+			if !ok || err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("GetAs() = %+v, %v, %v; want %+v, true, nil", got, ok, err, want)
+			}
+			if ttl, _ := i.GetTTL("user:1"); ttl == nil {
+				t.Error("PutAs() did not give the key its ttl")
+			}
+
+			// Values that are not a T and missing keys
+			i.Put(struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Ttl   *int64 `json:"ttl"`
+			}{Key: "user:2", Value: "\xc1"})
+			if _, ok, err = GetAs[user](i, "user:2"); !ok || err == nil {
+				t.Errorf("GetAs() of an undecodable value = %v, %v; want true and an error", ok, err)
+			}
+			if _, ok, err = GetAs[user](i, "missing"); ok || err != nil {
+				t.Errorf("GetAs() of a missing key = %v, %v; want false, nil", ok, err)
+			}
+		})
+	}
+
+	// JSON is the default codec, so values stay readable
+	i, err := NewInMemoryDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = PutAs(i, "n", 42, nil); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := i.Get("n"); value != "42" {
+		t.Errorf("Get() = %v; want 42", value)
+	}
+	if _, err = NewInMemoryDatabase(WithCodec(nil)); err == nil {
+		t.Error("expected an error for a nil codec")
+	}
+}
+
+func TestInMemoryDatabase_Validation(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          func(dir string) []Options
+		expectedError []string // Substrings the error must contain. Empty if there should be no error.
+	}{
+		{
+			name: "Defaults are valid",
+		},
+		{
+			name: "Persistence with files and periods is valid",
+			opts: func(dir string) []Options {
+				return []Options{
+					WithAofPersistence(), WithAofPersistenceFile(filepath.Join(dir, "aof")), WithAofPersistencePeriod(time.Second),
+					WithDatabasePersistence(), WithDatabasePersistenceFile(filepath.Join(dir, "db")), WithDatabasePersistencePeriod(time.Minute),
+				}
+			},
+		},
+		{
+			name:          "Aof persistence with an empty file",
+			opts:          func(dir string) []Options { return []Options{WithAofPersistence(), WithAofPersistenceFile("")} },
+			expectedError: []string{"aof persistence file is empty"},
+		},
+		{
+			name: "Database persistence with an empty file",
+			opts: func(dir string) []Options {
+				return []Options{WithDatabasePersistence(), WithDatabasePersistenceFile("")}
+			},
+			expectedError: []string{"database persistence file is empty"},
+		},
+		{
+			name: "Negative periods",
+			opts: func(dir string) []Options {
+				return []Options{WithAofPersistencePeriod(-time.Second), WithDatabasePersistencePeriod(-time.Second)}
+			},
+			expectedError: []string{"aof persistence period must be positive", "database persistence period must be positive"},
+		},
+		{
+			name: "Zero period with persistence enabled",
+			opts: func(dir string) []Options {
+				return []Options{WithDatabasePersistence(), WithDatabasePersistencePeriod(0)}
+			},
+			expectedError: []string{"database persistence period must be positive"},
+		},
+		{
+			name:          "Ttl jitter above 100 percent",
+			opts:          func(dir string) []Options { return []Options{WithTTLJitter(150)} },
+			expectedError: []string{"ttl jitter must be between 0 and 100 percent"},
+		},
+		{
+			name: "Negative size limits",
+			opts: func(dir string) []Options {
+				return []Options{WithMaxKeyLength(-1), WithMaxValueSize(-1)}
+			},
+			expectedError: []string{"max key length must not be negative"},
+		},
+		{
+			name:          "Negative compression threshold",
+			opts:          func(dir string) []Options { return []Options{WithCompression(-1)} },
+			expectedError: []string{"compression threshold must not be negative"},
+		},
+		{
+			name: "Invalid namespace quotas",
+			opts: func(dir string) []Options {
+				return []Options{WithNamespaceQuota("a:b", NamespaceQuota{}), WithNamespaceQuota("a", NamespaceQuota{MaxKeys: -1})}
+			},
+			expectedError: []string{`namespace "a:b" must not contain ":"`},
+		},
+		{
+			name: "Zero period with persistence disabled",
+			opts: func(dir string) []Options { return []Options{WithDatabasePersistencePeriod(0)} },
+		},
+		{
+			name: "Both kinds of persistence sharing a file",
+			opts: func(dir string) []Options {
+				return []Options{
+					WithAofPersistence(), WithAofPersistenceFile("persist"),
+					WithDatabasePersistence(), WithDatabasePersistenceFile("persist"),
+				}
+			},
+			expectedError: []string{"cannot share the file"},
+		},
+		{
+			name: "Persistence directory names the files",
+			opts: func(dir string) []Options {
+				return []Options{WithPersistenceDir(dir), WithAofPersistence(), WithDatabasePersistence()}
+			},
+		},
+		{
+			name: "Missing persistence directories",
+			opts: func(dir string) []Options {
+				return []Options{
+					WithPersistenceDir(filepath.Join(dir, "missing")),
+					WithAofPersistence(), WithAofPersistenceFile(filepath.Join(dir, "gone", "aof")),
+				}
+			},
+			expectedError: []string{"missing: no such file or directory", "gone: no such file or directory"},
+		},
+		{
+			name: "Persistence directory that is a file",
+			opts: func(dir string) []Options {
+				file := filepath.Join(dir, "file")
+				_ = os.WriteFile(file, nil, 0644)
+				return []Options{WithPersistenceDir(file)}
+			},
+			expectedError: []string{"is not a directory"},
+		},
+		{
+			name: "Rejecting writes on persistence failures without alerts",
+			opts: func(dir string) []Options {
+				return []Options{WithPersistenceFailurePolicy(PersistenceFailureReject), WithPersistenceAlert(0, nil)}
+			},
+			expectedError: []string{"needs persistence alerts to be enabled"},
+		},
+		{
+			name:          "Replay point without an aof startup file",
+			opts:          func(dir string) []Options { return []Options{WithReplayUntil(time.Now())} },
+			expectedError: []string{"replay point was given without an aof startup file"},
+		},
+		{
+			name:          "Missing logger and clock",
+			opts:          func(dir string) []Options { return []Options{WithLogger(nil), WithClock(nil)} },
+			expectedError: []string{"a logger is required", "a clock is required"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Options{WithLogger(slog.New(slog.DiscardHandler))}
+			if tt.opts != nil {
+				opts = append(opts, tt.opts(t.TempDir())...)
+			}
+
+			_, err := NewInMemoryDatabase(opts...)
+			if len(tt.expectedError) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected an error containing %v", tt.expectedError)
+			}
+			for _, e := range tt.expectedError {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("expected error %q to contain %q", err, e)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_ConcurrencyMode(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	if _, err := NewInMemoryDatabase(WithConcurrencyMode("unknown")); err == nil {
+		t.Errorf("expected an error for an unknown concurrency mode")
+	}
+
+	for _, mode := range []string{ConcurrencyRWMutex, ConcurrencySharded, ConcurrencyCOW} {
+		t.Run(mode, func(t *testing.T) {
+			clock := NewManualClock(testClockStart)
+			i, err := NewInMemoryDatabase(WithClock(clock), WithConcurrencyMode(mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := i.GetSettings().ConcurrencyMode; got != mode {
+				t.Errorf("expected mode %v, got %v", mode, got)
+			}
+
+			i.Put(kv{Key: "a:1", Value: "1"})
+			i.Put(kv{Key: "a:2", Value: "2"})
+			i.Put(kv{Key: "b:1", Value: "3"})
+			if created, _, _ := i.Create(kv{Key: "a:1", Value: "other"}); created {
+				t.Errorf("expected create of an existing key to fail")
+			}
+			if v, ok := i.Get("a:1"); !ok || v != "1" {
+				t.Errorf("expected a:1 to be 1, got %v %v", v, ok)
+			}
+			if !i.Delete("b:1") {
+				t.Errorf("expected b:1 to be deleted")
+			}
+			if _, ok := i.Get("b:1"); ok {
+				t.Errorf("expected b:1 to be gone")
+			}
+
+			if n, _ := i.ExpirePrefix("a:", 5); n != 2 {
+				t.Errorf("expected 2 keys to expire, got %v", n)
+			}
+			if ttl, ok := i.GetTTL("a:2"); !ok || ttl == nil || *ttl != 5 {
+				t.Errorf("expected a:2 to have a ttl of 5, got %v %v", ttl, ok)
+			}
+
+			clock.Advance(5 * time.Second)
+			if _, ok := i.Get("a:1"); ok {
+				t.Errorf("expected a:1 to have expired")
+			}
+
+			// Readers may run alongside writers without the database mutex
+			var wg sync.WaitGroup
+			for r := 0; r < 4; r++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for n := 0; n < 200; n++ {
+						i.Get(strconv.Itoa(n))
+					}
+				}()
+			}
+			for n := 0; n < 200; n++ {
+				i.Put(kv{Key: strconv.Itoa(n), Value: "v"})
+			}
+			wg.Wait()
+
+			if v, ok := i.Get("199"); !ok || v != "v" {
+				t.Errorf("expected 199 to be v, got %v %v", v, ok)
+			}
+		})
+	}
+}
+
 func TestInMemoryDatabase_Get(t *testing.T) {
 	type test []struct {
 		key        string // The key for the Get
@@ -272,7 +837,7 @@ func TestInMemoryDatabase_Put(t *testing.T) {
 					Value: testCase.value,
 					Ttl:   testCase.ttl,
 				}
-				if loaded := i.Put(data); loaded != testCase.want {
+				if loaded, _ := i.Put(data); loaded != testCase.want {
 					t.Errorf("Put() = %v, want %v", loaded, testCase.want)
 				}
 
@@ -285,27 +850,340 @@ func TestInMemoryDatabase_Put(t *testing.T) {
 	}
 }
 
-func TestInMemoryDatabase_Delete(t *testing.T) {
-	type test []struct {
-		key  string // key for delete
-		want bool   // Expectation for whether it was deleted or not
+func TestInMemoryDatabase_StepTTLCleaner(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithClock(clock), WithManualTTLCleanup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := i.NextExpiry(); ok {
+		t.Error("NextExpiry reported a ttl without any keys")
+	}
+
+	events, unsubscribe := i.SubscribeEvents("")
+	defer unsubscribe()
+	for _, p := range []struct {
+		key string
+		ttl int64
+	}{{"c", 2}, {"b", 1}, {"a", 2}, {"replaced", 1}, {"d", 5}} {
+		i.Put(kv{Key: p.key, Value: "v", Ttl: &p.ttl})
+	}
+	i.Put(kv{Key: "replaced", Value: "v"})
+	i.Put(kv{Key: "forever", Value: "v"})
+	for range 7 {
+		<-events
+	}
+
+	start := clock.Now()
+	if next, ok := i.NextExpiry(); !ok || !next.Equal(start.Add(time.Second)) {
+		t.Errorf("NextExpiry() = %v, %v; want %v", next, ok, start.Add(time.Second))
+	}
+	if removed := i.StepTTLCleaner(); len(removed) != 0 {
+		t.Errorf("StepTTLCleaner() before any ttl ran out = %v; want none", removed)
+	}
+
+	// Keys are only removed when the cleaner is stepped, in the order they expired and in key order within a second
+	clock.Advance(2 * time.Second)
+	if _, ok := i.Get("a"); ok {
+		t.Error("expired key was read before the cleaner stepped")
+	}
+	if keys := i.GetInfo().Keys; keys != 6 {
+		t.Errorf("keys before stepping = %v; want 6, as nothing is removed without a step", keys)
+	}
+	if removed := i.StepTTLCleaner(); !slices.Equal(removed, []string{"b", "a", "c"}) {
+		t.Errorf("StepTTLCleaner() = %v; want [b a c]", removed)
+	}
+	for _, key := range []string{"b", "a", "c"} {
+		if e := <-events; e.Type != EventExpired || e.Key != key {
+			t.Errorf("event = %+v; want %v expired", e, key)
+		}
+	}
+	if next, ok := i.NextExpiry(); !ok || !next.Equal(start.Add(5*time.Second)) {
+		t.Errorf("NextExpiry() after stepping = %v, %v; want %v", next, ok, start.Add(5*time.Second))
+	}
+
+	clock.Advance(time.Hour)
+	if removed := i.StepTTLCleaner(); !slices.Equal(removed, []string{"d"}) {
+		t.Errorf("StepTTLCleaner() = %v; want [d]", removed)
+	}
+	if keys := i.GetInfo().Keys; keys != 2 {
+		t.Errorf("keys after stepping = %v; want replaced and forever", keys)
+	}
+}
+
+func TestInMemoryDatabase_Update(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
 	}
 
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock), WithMaxValueSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl, expired := int64(100), int64(1)
+	i.Put(kv{Key: "key", Value: "a", Ttl: &ttl})
+	i.Put(kv{Key: "expired", Value: "a", Ttl: &expired})
+	clock.mu.Lock()
+	clock.now = clock.now.Add(10 * time.Second)
+	clock.mu.Unlock()
+
+	appendB := func(v string) (string, error) { return v + "b", nil }
+	failed := errors.New("failed")
 	tests := []struct {
-		name  string
-		cases test
+		name          string
+		key           string
+		f             func(string) (string, error)
+		expectedFound bool
+		expectedErr   error
+		expectedValue string // The value of key afterwards
 	}{
+		{name: "Update an existing key", key: "key", f: appendB, expectedFound: true, expectedValue: "ab"},
+		{name: "Missing key", key: "missing", f: appendB, expectedValue: "ab"},
+		{name: "Expired key", key: "expired", f: appendB, expectedValue: "ab"},
 		{
-			name: "Delete an existing entry",
-			cases: test{
-				{
-					key:  "key",
-					want: true,
-				},
-			},
+			name:          "An error leaves the value unchanged",
+			key:           "key",
+			f:             func(string) (string, error) { return "", failed },
+			expectedFound: true,
+			expectedErr:   failed,
+			expectedValue: "ab",
 		},
 		{
-			name: "Delete a non-existing entry",
+			name:          "The new value is over the size limit",
+			key:           "key",
+			f:             func(v string) (string, error) { return strings.Repeat(v, 10), nil },
+			expectedFound: true,
+			expectedErr:   ErrValueTooLarge,
+			expectedValue: "ab",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := i.Update(tt.key, tt.f)
+			if found != tt.expectedFound || !errors.Is(err, tt.expectedErr) {
+				t.Errorf("Update() = %v, %v; want %v, %v", found, err, tt.expectedFound, tt.expectedErr)
+			}
+			if v, _ := i.Get("key"); v != tt.expectedValue {
+				t.Errorf("expected key to be %q, got %q", tt.expectedValue, v)
+			}
+			if remaining, _ := i.GetTTL("key"); remaining == nil || *remaining != 90 {
+				t.Errorf("expected key to keep its ttl of 90, got %v", remaining)
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_Upsert(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock), WithMaxValueSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttlPtr := func(seconds int64) *int64 { return &seconds }
+	ttl, expired := int64(100), int64(1)
+	i.Put(kv{Key: "key", Value: "a", Ttl: &ttl})
+	i.Put(kv{Key: "expired", Value: "a", Ttl: &expired})
+	clock.mu.Lock()
+	clock.now = clock.now.Add(10 * time.Second)
+	clock.mu.Unlock()
+
+	appendB := func(value string, exists bool) (string, error) {
+		if !exists && value != "" {
+			return "", fmt.Errorf("expected no value for a missing key, got %q", value)
+		}
+		return value + "b", nil
+	}
+	tests := []struct {
+		name          string
+		key           string
+		f             func(value string, exists bool) (string, error)
+		expectedValue string
+		expectedTTL   *int64
+		expectedFound bool
+		expectedError bool
+	}{
+		{name: "Existing key keeps its ttl", key: "key", f: appendB, expectedValue: "ab", expectedTTL: ttlPtr(90), expectedFound: true},
+		{name: "Missing key is created", key: "missing", f: appendB, expectedValue: "b"},
+		{name: "Expired key is created without a ttl", key: "expired", f: appendB, expectedValue: "b"},
+		{
+			name:          "Too long",
+			key:           "key",
+			f:             func(string, bool) (string, error) { return "123456789", nil },
+			expectedValue: "ab",
+			expectedTTL:   ttlPtr(90),
+			expectedFound: true,
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := i.Upsert(tt.key, tt.f)
+			if found != tt.expectedFound || (err != nil) != tt.expectedError {
+				t.Fatalf("Upsert() = %v, %v; want %v and an error: %v", found, err, tt.expectedFound, tt.expectedError)
+			}
+			if value, _ := i.Get(tt.key); value != tt.expectedValue {
+				t.Errorf("value = %q; want %q", value, tt.expectedValue)
+			}
+			if ttl, _ := i.GetTTL(tt.key); (ttl == nil) != (tt.expectedTTL == nil) || (ttl != nil && *ttl != *tt.expectedTTL) {
+				t.Errorf("ttl = %v; want %v", ttl, tt.expectedTTL)
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_UpsertTTL(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := int64(100)
+	i.Put(kv{Key: "key", Value: "a", Ttl: &ttl})
+	i.Put(kv{Key: "forever", Value: "a"})
+
+	appendB := func(value string, _ bool) (string, error) { return value + "b", nil }
+	for _, key := range []string{"key", "forever", "missing"} {
+		if _, err = i.UpsertTTL(key, 30, appendB); err != nil {
+			t.Fatal(err)
+		}
+		if ttl, _ := i.GetTTL(key); ttl == nil || *ttl != 30 {
+			t.Errorf("ttl of %v = %v; want 30", key, ttl)
+		}
+	}
+
+	// Writing again pushes the expiration back
+	clock.mu.Lock()
+	clock.now = clock.now.Add(20 * time.Second)
+	clock.mu.Unlock()
+	if _, err = i.UpsertTTL("key", 30, appendB); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(15 * time.Second)
+	if value, found := i.Get("key"); !found || value != "abb" {
+		t.Errorf("value = %q, %v; want abb", value, found)
+	}
+	if _, found := i.Get("missing"); found {
+		t.Errorf("missing was found after its ttl")
+	}
+}
+
+func TestInMemoryDatabase_DeleteIf(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every write gives the key a new version
+	i.Put(kv{Key: "key", Value: "a"})
+	first, _ := i.GetEntry("key")
+	i.Put(kv{Key: "key", Value: "a"})
+	entry, _ := i.GetEntry("key")
+	if first.Version == 0 || entry.Version <= first.Version {
+		t.Fatalf("expected the version to increase from %v, got %v", first.Version, entry.Version)
+	}
+	expired := int64(1)
+	i.Put(kv{Key: "expired", Value: "a", Ttl: &expired})
+	clock.mu.Lock()
+	clock.now = clock.now.Add(10 * time.Second)
+	clock.mu.Unlock()
+
+	tests := []struct {
+		name            string
+		key             string
+		version         uint64
+		expectedDeleted bool
+		expectedFound   bool
+	}{
+		{name: "Stale version", key: "key", version: first.Version, expectedFound: true},
+		{name: "Missing key", key: "missing", version: entry.Version},
+		{name: "Expired key", key: "expired", version: entry.Version},
+		{name: "Current version", key: "key", version: entry.Version, expectedDeleted: true, expectedFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted, found := i.DeleteIf(tt.key, func(value string, version uint64) bool {
+				return value == "a" && version == tt.version
+			})
+			if deleted != tt.expectedDeleted || found != tt.expectedFound {
+				t.Errorf("DeleteIf() = %v, %v; want %v, %v", deleted, found, tt.expectedDeleted, tt.expectedFound)
+			}
+			if _, ok := i.Get(tt.key); tt.expectedFound && ok == tt.expectedDeleted {
+				t.Errorf("expected %v to exist afterwards: %v, got %v", tt.key, !tt.expectedDeleted, ok)
+			}
+		})
+	}
+
+	// Versions survive a snapshot
+	i.Put(kv{Key: "key", Value: "b"})
+	entry, _ = i.GetEntry("key")
+	b, err := json.Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, restored); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := restored.GetEntry("key"); got.Version != entry.Version {
+		t.Errorf("expected the restored version to be %v, got %v", entry.Version, got.Version)
+	}
+}
+
+func TestInMemoryDatabase_Delete(t *testing.T) {
+	type test []struct {
+		key  string // key for delete
+		want bool   // Expectation for whether it was deleted or not
+	}
+
+	tests := []struct {
+		name  string
+		cases test
+	}{
+		{
+			name: "Delete an existing entry",
+			cases: test{
+				{
+					key:  "key",
+					want: true,
+				},
+			},
+		},
+		{
+			name: "Delete a non-existing entry",
 			cases: test{
 				{
 					key:  "yo",
@@ -331,9 +1209,67 @@ func TestInMemoryDatabase_Delete(t *testing.T) {
 				Value: "value",
 			})
 			for _, testCase := range tt.cases {
+				seq, deleted := i.seq, i.compactor.deleted.Load()
 				if loaded := i.Delete(testCase.key); loaded != testCase.want {
 					t.Errorf("Delete() = %v, want %v", loaded, testCase.want)
 				}
+
+				// Deleting a missing key must not be recorded as an operation
+				if !testCase.want && (i.seq != seq || i.compactor.deleted.Load() != deleted) {
+					t.Errorf("Delete() of a missing key advanced seq to %d and the deleted count to %d", i.seq, i.compactor.deleted.Load())
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_GetEntry(t *testing.T) {
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(key string, ttl *int64) {
+		i.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: key, Value: "value", Ttl: ttl})
+	}
+
+	created := clock.Now()
+	put("key", nil)
+	ttl := int64(5)
+	put("expiring", &ttl)
+
+	// Updating a key moves its modification time forward
+	clock.Advance(10 * time.Second)
+	put("updated", nil)
+	put("updated", nil)
+
+	tests := []struct {
+		key        string
+		wantLoaded bool
+		wantTime   time.Time
+	}{
+		{key: "key", wantLoaded: true, wantTime: created},
+		{key: "updated", wantLoaded: true, wantTime: clock.Now()},
+		{key: "expiring", wantLoaded: false},
+		{key: "missing", wantLoaded: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			entry, loaded := i.GetEntry(tt.key)
+			if loaded != tt.wantLoaded {
+				t.Fatalf("GetEntry() loaded = %v; want %v", loaded, tt.wantLoaded)
+			}
+			if !entry.UpdatedAt.Equal(tt.wantTime) {
+				t.Errorf("GetEntry() updatedAt = %v; want %v", entry.UpdatedAt, tt.wantTime)
+			}
+			if loaded && entry.Value != "value" {
+				t.Errorf("GetEntry() value = %v; want %v", entry.Value, "value")
 			}
 		})
 	}
@@ -344,7 +1280,7 @@ func TestInMemoryDatabase_GetTTL(t *testing.T) {
 		key        string // key for get
 		wantLoaded bool   // Expected loaded
 		wantNil    bool   // Whether the returned TTL pointer should be nil or not
-		delay      int64  // How long to delay before sending a GetTTL call
+		delay      int64  // How long to advance the clock before sending a GetTTL call
 	}
 
 	tests := []struct {
@@ -400,7 +1336,8 @@ func TestInMemoryDatabase_GetTTL(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var ttl int64 = 100
-			i, err := NewInMemoryDatabase()
+			clock := NewManualClock(testClockStart)
+			i, err := NewInMemoryDatabase(WithClock(clock))
 			if err != nil {
 				t.Error(err)
 			}
@@ -428,7 +1365,7 @@ func TestInMemoryDatabase_GetTTL(t *testing.T) {
 				})
 
 				// Wait
-				<-time.After(time.Duration(testCase.delay) * time.Second)
+				clock.Advance(time.Duration(testCase.delay) * time.Second)
 
 				val, loaded := i.GetTTL(testCase.key)
 				if loaded != testCase.wantLoaded {
@@ -442,8 +1379,8 @@ func TestInMemoryDatabase_GetTTL(t *testing.T) {
 				} else {
 					if val == nil {
 						t.Error("Get() = nil, want not nil")
-					} else if *val < testCase.delay {
-						t.Errorf("Get() = %v, want %v", *val, testCase.delay)
+					} else if *val != ttl-testCase.delay {
+						t.Errorf("Get() = %v, want %v", *val, ttl-testCase.delay)
 					}
 				}
 			}
@@ -453,7 +1390,7 @@ func TestInMemoryDatabase_GetTTL(t *testing.T) {
 
 func TestInMemoryDatabase_Cleanup(t *testing.T) {
 	type checkDeleted struct {
-		delay   int64 // Time after initialization to check in milliseconds
+		delay   int64 // Time after initialization to check in seconds
 		numLeft int   // How many should remain
 	}
 
@@ -475,10 +1412,10 @@ func TestInMemoryDatabase_Cleanup(t *testing.T) {
 			},
 			check: []checkDeleted{
 				{0, 4},
-				{1500, 3},
-				{2500, 2},
-				{3500, 1},
-				{4500, 0},
+				{1, 3},
+				{2, 2},
+				{3, 1},
+				{4, 0},
 			},
 			unique: 4,
 		},
@@ -490,8 +1427,8 @@ func TestInMemoryDatabase_Cleanup(t *testing.T) {
 			},
 			check: []checkDeleted{
 				{0, 2},
-				{1500, 1},
-				{2500, 0},
+				{1, 1},
+				{2, 0},
 			},
 			unique: 2,
 		},
@@ -503,8 +1440,8 @@ func TestInMemoryDatabase_Cleanup(t *testing.T) {
 			},
 			check: []checkDeleted{
 				{0, 2},
-				{1500, 1},
-				{2500, 0},
+				{1, 1},
+				{2, 0},
 			},
 			unique: 2,
 		},
@@ -512,17 +1449,18 @@ func TestInMemoryDatabase_Cleanup(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			i, err := NewInMemoryDatabase()
+			clock := NewManualClock(testClockStart)
+			i, err := NewInMemoryDatabase(WithClock(clock))
 			if err != nil {
 				t.Error(err)
 			}
 
 			setupHelper(i, &tt.functions, nil)
 
-			timeAfterCreation := time.Now().UnixMilli()
+			var elapsed int64
 
 			i.mu.RLock()
-			if len(i.database) != tt.unique {
+			if i.database.len() != tt.unique {
 				t.Errorf("Store is wrong size")
 			}
 			i.mu.RUnlock()
@@ -530,233 +1468,714 @@ func TestInMemoryDatabase_Cleanup(t *testing.T) {
 			// Check all deletions occur
 			for c := range tt.check {
 				next := tt.check[c].delay
-				delay := next - (time.Now().UnixMilli() - timeAfterCreation)
-				if delay > 0 {
-					<-time.After(time.Duration(delay) * time.Millisecond)
+				if delay := next - elapsed; delay > 0 {
+					// Only advance once the cleaner is waiting on the clock
+					blockUntilTimers(t, clock, 1)
+					clock.Advance(time.Duration(delay) * time.Second)
+					elapsed = next
 				}
 
-				i.mu.Lock()
+				// The cleaner runs asynchronously so give it a moment to catch up
+				remaining := -1
+				deadline := time.Now().Add(time.Second)
+				for time.Now().Before(deadline) {
+					i.mu.RLock()
+					remaining = i.database.len()
+					i.mu.RUnlock()
+					if remaining == tt.check[c].numLeft {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
 
 				// Check the number of remaining entries
-				if len(i.database) != tt.check[c].numLeft {
-					t.Errorf("Expected %v left after %v but got %v. Len(ttlHeap) = %v", tt.check[c].numLeft, next, len(i.database), len(*i.ttl))
+				if remaining != tt.check[c].numLeft {
+					i.mu.RLock()
+					t.Errorf("Expected %v left after %v but got %v. Len(ttlHeap) = %v", tt.check[c].numLeft, next, remaining, len(*i.ttl))
+					i.mu.RUnlock()
 				}
-
-				i.mu.Unlock()
 			}
 		})
 	}
 }
 
-func TestInMemoryDatabase_Persistence(t *testing.T) {
+func TestInMemoryDatabase_Allocations(t *testing.T) {
+	i, err := NewInMemoryDatabase(WithClock(NewManualClock(testClockStart)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl := int64(100)
+	put := struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: "key", Value: "value", Ttl: &ttl}
+	i.Put(put)
+
+	// Entries with a ttl are also pushed onto the ttl heap, which boxes them
+	put.Ttl = nil
+
 	tests := []struct {
-		name      string
-		functions []any
+		name string
+		f    func()
 	}{
-		{
-			name: "Test saving database",
-			functions: []any{
-				&putCall{"hello1", "hello1", 10},
-				&deleteCall{"hello1"},
-				&putCall{"hello2", "hello2", 20},
-				&putCall{"hello3", "hello3", 30},
-				&putCall{"hello4", "hello4", 40},
-				&deleteCall{"hello4"},
-				&putCall{"hello3", "hello3", 50},
-				&deleteCall{"hello20"},
-				&putCall{"noTTL", "noTTL", -1},
-				&createCall{"hello1", 10, 0},
-				&createCall{"hello1", -1, 0}},
-		},
+		{name: "Get hit", f: func() { i.Get("key") }},
+		{name: "Get miss", f: func() { i.Get("missing") }},
+		{name: "Put without ttl", f: func() { i.Put(put) }},
+		{name: "Delete missing key", f: func() { i.Delete("missing") }},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			fp := t.TempDir()
-
-			i, err := NewInMemoryDatabase(
-				WithAofPersistence(),
-				WithAofPersistencePeriod(1*time.Second),
-				WithAofPersistenceFile(filepath.Join(fp, "persist-aof")),
-				WithDatabasePersistence(),
-				WithDatabasePersistencePeriod(1*time.Second),
-				WithDatabasePersistenceFile(filepath.Join(fp, "persist-database.json")))
-			if err != nil {
-				t.Error(err)
+			tt.f()
+			if allocs := testing.AllocsPerRun(100, tt.f); allocs != 0 {
+				t.Errorf("expected no allocations, got %v", allocs)
 			}
-			setupHelper(i, &tt.functions, nil)
+		})
+	}
+}
 
-			i.Shutdown()
+func TestInMemoryDatabase_ExpirePrefix(t *testing.T) {
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			// Test AOF persistence
-			file, err := os.Open(filepath.Join(fp, "persist-aof"))
-			if err != nil {
-				t.Error(err)
-			}
-			defer file.Close()
+	setupHelper(i, &[]any{
+		&putCall{"v1:a", "a", -1},
+		&putCall{"v1:b", "b", 100},
+		&putCall{"v2:a", "a", -1},
+	}, nil)
 
-			scanner := bufio.NewScanner(file)
-			for i, function := range tt.functions {
-				scanner.Scan()
-				line := scanner.Text()
-				args := strings.Split(line, " ")
+	if n, _ := i.ExpirePrefix("v1:", 10); n != 2 {
+		t.Errorf("ExpirePrefix() = %v; want %v", n, 2)
+	}
 
-				switch function.(type) {
-				case *deleteCall:
-					if args[0] != "DELETE" {
-						t.Errorf("Expected delete command got %v", args[0])
-					}
+	for _, key := range []string{"v1:a", "v1:b"} {
+		ttl, loaded := i.GetTTL(key)
+		if !loaded || ttl == nil || *ttl != 10 {
+			t.Errorf("GetTTL(%v) = %v, %v; want 10, true", key, ttl, loaded)
+		}
+	}
+	if ttl, loaded := i.GetTTL("v2:a"); !loaded || ttl != nil {
+		t.Errorf("GetTTL(v2:a) = %v, %v; want nil, true", ttl, loaded)
+	}
 
-					if len(args) != 2 {
-						t.Errorf("For delete function at index %v, got incorrect number of args. Expected %v, but got %v", i, 2, len(args))
-					}
+	// The cleaner should remove the expired generation
+	blockUntilTimers(t, clock, 1)
+	clock.Advance(10 * time.Second)
+	remaining := -1
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		i.mu.RLock()
+		remaining = i.database.len()
+		i.mu.RUnlock()
+		if remaining == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if remaining != 1 {
+		t.Errorf("Expected %v left but got %v", 1, remaining)
+	}
 
-					if function.(*deleteCall).key != args[1] {
-						t.Errorf("For delete function at index %v, got incorrect key. Expected %v, but got %v", i, function.(*deleteCall).key, args[1])
-					}
-				case *putCall:
-					if args[0] != "PUT" {
-						t.Errorf("Expected put command got %v", args[0])
-					}
+	if n, _ := i.ExpirePrefix("missing:", 10); n != 0 {
+		t.Errorf("ExpirePrefix() = %v; want %v", n, 0)
+	}
+}
 
-					if len(args) != 4 {
-						t.Errorf("For put function at index %v, got incorrect number of args. Expected %v, but got %v", i, 4, len(args))
-					}
+func TestInMemoryDatabase_Touch(t *testing.T) {
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-					if function.(*putCall).key != args[1] {
-						t.Errorf("For put function at index %v, got incorrect key. Expected %v, but got %v", i, function.(*putCall).key, args[1])
-					}
+	setupHelper(i, &[]any{
+		&putCall{"a", "a", -1},
+		&putCall{"b", "b", 100},
+		&putCall{"c", "c", 1},
+	}, nil)
+	before, _ := i.GetEntry("a")
 
-					if function.(*putCall).value != args[2] {
-						t.Errorf("For put function at index %v, got incorrect value. Expected %v, but got %v", i, function.(*putCall).value, args[2])
-					}
+	for key, ttl := range map[string]int64{"a": 10, "b": 5} {
+		if found, err := i.Touch(key, ttl); !found || err != nil {
+			t.Errorf("Touch(%v) = %v, %v; want true, nil", key, found, err)
+		}
+		if got, loaded := i.GetTTL(key); !loaded || got == nil || *got != ttl {
+			t.Errorf("GetTTL(%v) = %v, %v; want %v, true", key, got, loaded, ttl)
+		}
+		if value, _ := i.Get(key); value != key {
+			t.Errorf("Get(%v) = %v; want %v", key, value, key)
+		}
+	}
+	if after, _ := i.GetEntry("a"); after.Version <= before.Version || !after.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Errorf("Touch(a) changed the entry from %+v to %+v; want a new version and the same update time", before, after)
+	}
 
-					if strconv.Itoa(int(function.(*putCall).ttl)) != args[3] {
-						t.Errorf("For put function at index %v, got incorrect ttl. Expected %v, but got %v", i, function.(*putCall).ttl, args[3])
-					}
-				case *createCall:
-					if args[0] != "PUT" {
-						t.Errorf("Expected put command got %v", args[0])
-					}
+	// Missing and expired keys are not brought back
+	clock.Advance(2 * time.Second)
+	for _, key := range []string{"c", "missing"} {
+		if found, err := i.Touch(key, 10); found || err != nil {
+			t.Errorf("Touch(%v) = %v, %v; want false, nil", key, found, err)
+		}
+	}
+}
 
-					if len(args) != 4 {
-						t.Errorf("For create function at index %v, got incorrect number of args. Expected %v, but got %v", i, 4, len(args))
-					}
+func TestInMemoryDatabase_History(t *testing.T) {
+	i, err := NewInMemoryDatabase(WithHistory(3))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-					if function.(*createCall).value != args[2] {
-						t.Errorf("For create function at index %v, got incorrect value. Expected %v, but got %v", i, function.(*createCall).value, args[2])
-					}
+	setupHelper(i, &[]any{
+		&putCall{"a", "1", -1},
+		&putCall{"a", "2", -1},
+		&putCall{"a", "3", 100},
+		&putCall{"a", "4", -1},
+		&putCall{"b", "b", -1},
+	}, nil)
 
-					if strconv.Itoa(int(function.(*createCall).ttl)) != args[3] {
-						t.Errorf("For create function at index %v, got incorrect ttl. Expected %v, but got %v", i, function.(*createCall).ttl, args[3])
-					}
+	// Only the last three versions are retained
+	versions, ok := i.History("a")
+	if !ok {
+		t.Fatal("History() reported that the history is disabled")
+	}
+	var values []string
+	for _, v := range versions {
+		values = append(values, v.Value)
+	}
+	if !slices.Equal(values, []string{"4", "3", "2"}) {
+		t.Fatalf("History(a) values = %v; want [4 3 2]", values)
+	}
+	if versions[1].ExpiresAt == 0 || versions[0].ExpiresAt != 0 || versions[0].Version <= versions[1].Version {
+		t.Errorf("History(a) = %+v; want the expiration of each version, newest first", versions)
+	}
+
+	// Restoring a version writes it as a new version, keeping the ttl
+	if exists, found, err := i.RestoreVersion("a", versions[2].Version); !exists || !found || err != nil {
+		t.Fatalf("RestoreVersion(a) = %v, %v, %v; want true, true, nil", exists, found, err)
+	}
+	if value, _ := i.Get("a"); value != "2" {
+		t.Errorf("Get(a) = %v; want 2", value)
+	}
+	if versions, _ = i.History("a"); len(versions) != 3 || versions[0].Value != "2" || versions[2].Value != "3" {
+		t.Errorf("History(a) after the restore = %+v; want 2, 4 and 3", versions)
+	}
+
+	for _, tt := range []struct {
+		key     string
+		version uint64
+		exists  bool
+	}{
+		{key: "a", version: 1, exists: true},
+		{key: "missing", version: 1},
+	} {
+		if exists, found, err := i.RestoreVersion(tt.key, tt.version); exists != tt.exists || found || err != nil {
+			t.Errorf("RestoreVersion(%v, %v) = %v, %v, %v; want %v, false, nil", tt.key, tt.version, exists, found, err, tt.exists)
+		}
+	}
+
+	// Deleting a key drops its history
+	i.Delete("b")
+	if versions, ok = i.History("b"); !ok || len(versions) != 0 {
+		t.Errorf("History(b) after a delete = %+v, %v; want none, true", versions, ok)
+	}
+
+	disabled, err := NewInMemoryDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = disabled.History("a"); ok {
+		t.Error("History() without WithHistory reported that the history is enabled")
+	}
+	if _, err = NewInMemoryDatabase(WithHistory(-1)); err == nil {
+		t.Error("expected an error for a negative history size")
+	}
+}
+
+func TestInMemoryDatabase_KeyStats(t *testing.T) {
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithKeyStats(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setupHelper(i, &[]any{
+		&putCall{"a", "1", -1},
+		&putCall{"a", "22", 100},
+		&putCall{"b", "b", -1},
+	}, nil)
+	clock.Advance(time.Minute)
+	i.Get("a")
+	i.GetEntry("a")
+	i.Get("missing")
+	i.ExpirePrefix("b", 100)
+
+	stats, exists, ok := i.KeyStats("a")
+	if !ok || !exists {
+		t.Fatalf("KeyStats(a) = %v, %v; want true, true", exists, ok)
+	}
+	if stats.Hits != 2 || stats.Updates != 2 || !stats.LastAccess.Equal(clock.Now()) || stats.Size != 3 {
+		t.Errorf("KeyStats(a) = %+v; want 2 hits, 2 updates, a last access of %v and a size of 3", stats, clock.Now())
+	}
+	if stats, _, _ = i.KeyStats("b"); stats.Hits != 0 || stats.Updates != 2 {
+		t.Errorf("KeyStats(b) = %+v; want 0 hits and 2 updates, counting the ttl change", stats)
+	}
+
+	// Getting the stats is not a read, and deleting a key drops its counts
+	if stats, _, _ = i.KeyStats("a"); stats.Hits != 2 {
+		t.Errorf("KeyStats(a) hits after getting the stats = %v; want 2", stats.Hits)
+	}
+	i.Delete("a")
+	setupHelper(i, &[]any{&putCall{"a", "1", -1}}, nil)
+	if stats, _, _ = i.KeyStats("a"); stats.Hits != 0 || stats.Updates != 1 {
+		t.Errorf("KeyStats(a) after it was recreated = %+v; want 0 hits and 1 update", stats)
+	}
+	if _, exists, ok = i.KeyStats("missing"); exists || !ok {
+		t.Errorf("KeyStats(missing) = %v, %v; want false, true", exists, ok)
+	}
+
+	disabled, err := NewInMemoryDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok = disabled.KeyStats("a"); ok {
+		t.Error("KeyStats() without WithKeyStats reported that stats are counted")
+	}
+}
+
+func TestInMemoryDatabase_Compact(t *testing.T) {
+	for _, mode := range []string{ConcurrencyRWMutex, ConcurrencySharded, ConcurrencyCOW} {
+		t.Run(mode, func(t *testing.T) {
+			usage := []uint64{1000, 400} // The heap before and after compacting
+			withUsage := func(db *InMemoryDatabase) error {
+				db.s.memoryUsage = func() uint64 {
+					u := usage[0]
+					usage = usage[1:]
+					return u
 				}
+				return nil
 			}
-
-			// Test database persistence
-			data, err := os.ReadFile(filepath.Join(fp, "persist-database.json"))
+			i, err := NewInMemoryDatabase(WithConcurrencyMode(mode), WithHistory(2), WithSearchIndex(), withUsage)
 			if err != nil {
-				t.Fatal("Failed to read persistDatabase.json")
+				t.Fatal(err)
 			}
 
-			var decodedData *InMemoryDatabase
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			if err := dec.Decode(&decodedData); err != nil {
-				log.Fatal("Decode error:", err)
+			var calls []any
+			for n := range 100 {
+				calls = append(calls, &putCall{fmt.Sprintf("key:%d", n), "value", 100})
 			}
+			for n := range 90 {
+				calls = append(calls, &deleteCall{fmt.Sprintf("key:%d", n)})
+			}
+			calls = append(calls, &putCall{"key:99", "renewed", 200})
+			setupHelper(i, &calls, nil)
 
-			if !reflect.DeepEqual(decodedData.ttl, i.ttl) {
-				t.Errorf("Actual ttl heap does not match persistDatabase.json")
+			c := i.Compact()
+			if c.Keys != 10 || c.Reclaimed != 600 {
+				t.Errorf("Compact() = %+v; want 10 keys and 600 bytes reclaimed", c)
+			}
+			if stats := i.GetCompactionStats(); stats.Runs != 1 || stats.Reclaimed != 600 {
+				t.Errorf("GetCompactionStats() = %+v; want 1 run and 600 bytes reclaimed", stats)
 			}
 
-			if !reflect.DeepEqual(decodedData.database, i.database) {
-				t.Errorf("Actual database does not match persistDatabase.json")
+			// Only the heap items of the remaining keys and their current ttls are kept
+			if len(*i.ttl) != 10 {
+				t.Errorf("ttl heap has %v items after compacting; want 10", len(*i.ttl))
+			}
+			if v, ok := i.Get("key:99"); !ok || v != "renewed" {
+				t.Errorf("Get(key:99) after compacting = %v, %v; want renewed", v, ok)
+			}
+			if _, ok := i.Get("key:0"); ok {
+				t.Error("Get(key:0) after compacting found a deleted key")
+			}
+			if versions, _ := i.History("key:99"); len(versions) != 2 {
+				t.Errorf("History(key:99) after compacting has %v versions; want 2", len(versions))
+			}
+			if results, _ := i.Search("renewed", "", 10); len(results) != 1 {
+				t.Errorf("Search(renewed) after compacting found %v keys; want 1", len(results))
 			}
 		})
 	}
 }
 
-func TestInMemoryDatabase_DatabaseStartJson(t *testing.T) {
-	tests := []struct {
-		name string
-		file string
+// compactHookStore calls compacting whenever a part of the store is compacted
+type compactHookStore struct {
+	kvStore
+	compacting func()
+}
+
+func (s compactHookStore) compactPart(n int) {
+	s.compacting()
+	s.kvStore.compactPart(n)
+}
+
+func TestInMemoryDatabase_CompactWriteStall(t *testing.T) {
+	i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithWriteStallPolicy(WriteStallFail),
+		func(db *InMemoryDatabase) error {
+			db.s.memoryUsage = func() uint64 { return 0 }
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes made while a part is compacted are failed fast by the fail write stall policy
+	var putErr error
+	i.database = compactHookStore{kvStore: i.database, compacting: func() {
+		_, putErr = i.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: "key", Value: "value"})
+	}}
+	i.Compact()
+
+	var stallErr *WriteStallError
+	if !errors.As(putErr, &stallErr) || stallErr.Kind != PersistenceCompaction {
+		t.Errorf("put err = %v; want a *WriteStallError for compaction", putErr)
+	}
+	if stats := i.GetPersistenceStats(PersistenceCompaction); stats.RejectedWrites != 1 {
+		t.Errorf("stats = %+v; want one rejected write", stats)
+	}
+}
+
+func TestInMemoryDatabase_autoCompaction(t *testing.T) {
+	i, err := NewInMemoryDatabase(WithAutoCompaction(0.5), func(db *InMemoryDatabase) error {
+		db.s.memoryUsage = func() uint64 { return 0 }
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []any
+	for n := range minCompactionDeletes + 10 {
+		calls = append(calls, &putCall{fmt.Sprintf("key:%d", n), "value", -1})
+	}
+	setupHelper(i, &calls, nil)
+
+	// Deleting a few keys is not worth compacting, however many are left
+	for n := range 10 {
+		i.Delete(fmt.Sprintf("key:%d", n))
+	}
+	if i.maybeCompact() {
+		t.Error("maybeCompact() compacted after 10 deletions")
+	}
+
+	// Nor is deleting many keys if most are left
+	calls = calls[:0]
+	for n := range minCompactionDeletes + 10 {
+		calls = append(calls, &putCall{fmt.Sprintf("more:%d", n), "value", -1})
+	}
+	setupHelper(i, &calls, nil)
+	for n := 10; n < minCompactionDeletes; n++ {
+		i.Delete(fmt.Sprintf("key:%d", n))
+	}
+	if i.maybeCompact() {
+		t.Error("maybeCompact() compacted with fewer keys deleted than left")
+	}
+
+	for n := range minCompactionDeletes + 10 {
+		i.Delete(fmt.Sprintf("more:%d", n))
+	}
+	if !i.maybeCompact() {
+		t.Error("maybeCompact() did not compact with most keys deleted")
+	}
+	if i.maybeCompact() {
+		t.Error("maybeCompact() compacted again without further deletions")
+	}
+
+	if _, err = NewInMemoryDatabase(WithAutoCompaction(1.5)); err == nil {
+		t.Error("WithAutoCompaction(1.5) did not fail")
+	}
+}
+
+func TestInMemoryDatabase_DeletePrefix(t *testing.T) {
+	i, err := NewInMemoryDatabase(WithChangeLog(2 * deletePrefixBatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough keys for more than one batch
+	var calls []any
+	for n := range deletePrefixBatch + 5 {
+		calls = append(calls, &putCall{fmt.Sprintf("session:%d", n), "a", -1})
+	}
+	calls = append(calls, &putCall{"user:a", "a", -1})
+	setupHelper(i, &calls, nil)
+	seq := i.GetInfo().Seq
+
+	if n := i.DeletePrefix("session:", true); n != deletePrefixBatch+5 {
+		t.Errorf("DeletePrefix() dry run = %v; want %v", n, deletePrefixBatch+5)
+	}
+	if keys := i.GetInfo().Keys; keys != deletePrefixBatch+6 {
+		t.Errorf("expected the dry run to keep every key, got %v keys", keys)
+	}
+
+	if n := i.DeletePrefix("session:", false); n != deletePrefixBatch+5 {
+		t.Errorf("DeletePrefix() = %v; want %v", n, deletePrefixBatch+5)
+	}
+	if keys := i.GetInfo().Keys; keys != 1 {
+		t.Errorf("expected only user:a to be left, got %v keys", keys)
+	}
+	if _, ok := i.Get("user:a"); !ok {
+		t.Errorf("expected user:a to be kept")
+	}
+
+	// Every deleted key is a change
+	changes, _, err := i.ReadChanges(seq, 2*deletePrefixBatch)
+	if err != nil || len(changes) != deletePrefixBatch+5 || changes[0].Op != ChangeDelete {
+		t.Errorf("expected %v delete changes, got %v, %v", deletePrefixBatch+5, len(changes), err)
+	}
+
+	if n := i.DeletePrefix("missing:", false); n != 0 {
+		t.Errorf("DeletePrefix() = %v; want %v", n, 0)
+	}
+}
+
+func TestInMemoryDatabase_Scan(t *testing.T) {
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setupHelper(i, &[]any{
+		&putCall{"user:c", "c", -1},
+		&putCall{"user:a", "a", -1},
+		&putCall{"user:b", "b", 100},
+		&putCall{"user:d", "d", 10},
+		&putCall{"session:a", "a", -1},
+	}, nil)
+
+	// Let user:d expire without the cleaner running so that Scan has to skip it
+	clock.mu.Lock()
+	clock.now = clock.now.Add(10 * time.Second)
+	clock.mu.Unlock()
+
+	tests := []struct {
+		name           string
+		prefix         string
+		cursor         string
+		limit          int
+		expectedKeys   []string
+		expectedCursor string
 	}{
 		{
-			name: "Test starting database with json",
-			file: "testDatabaseStartup.json",
+			name:         "Every key",
+			limit:        10,
+			expectedKeys: []string{"session:a", "user:a", "user:b", "user:c"},
+		},
+		{
+			name:           "First page of a prefix",
+			prefix:         "user:",
+			limit:          2,
+			expectedKeys:   []string{"user:a", "user:b"},
+			expectedCursor: "user:b",
+		},
+		{
+			name:         "Last page of a prefix",
+			prefix:       "user:",
+			cursor:       "user:b",
+			limit:        2,
+			expectedKeys: []string{"user:c"},
+		},
+		{
+			name:   "No matching keys",
+			prefix: "missing:",
+			limit:  2,
+		},
+		{
+			name:   "Zero limit",
+			prefix: "user:",
+		},
+		{
+			name:   "Negative limit",
+			prefix: "user:",
+			limit:  -1,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			i, err := NewInMemoryDatabase(WithInitialData(tt.file, true))
-			if err != nil {
-				t.Error(err)
-			}
-
-			data, err := os.ReadFile(tt.file)
-			if err != nil {
-				t.Errorf("Failed to read %v", tt.file)
+			keys, cursor := i.Scan(tt.prefix, tt.cursor, tt.limit)
+			if !slices.Equal(keys, tt.expectedKeys) || cursor != tt.expectedCursor {
+				t.Errorf("Scan() = %v, %q; want %v, %q", keys, cursor, tt.expectedKeys, tt.expectedCursor)
 			}
+		})
+	}
+}
 
-			var db *InMemoryDatabase
+func TestInMemoryDatabase_TTLJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		jitter   float64
+		randN    func(n int64) int64
+		ttl      int64
+		expected int64
+	}{
+		{
+			name:     "No jitter",
+			ttl:      100,
+			expected: 100,
+		},
+		{
+			name:     "Lowest jitter",
+			jitter:   10,
+			randN:    func(n int64) int64 { return 0 },
+			ttl:      100,
+			expected: 90,
+		},
+		{
+			name:     "Highest jitter",
+			jitter:   10,
+			randN:    func(n int64) int64 { return n - 1 },
+			ttl:      100,
+			expected: 110,
+		},
+		{
+			name:     "Ttls too short to spread are kept",
+			jitter:   10,
+			randN:    func(n int64) int64 { return 0 },
+			ttl:      5,
+			expected: 5,
+		},
+		{
+			name:     "Ttls are never jittered below a second",
+			jitter:   100,
+			randN:    func(n int64) int64 { return 0 },
+			ttl:      3,
+			expected: 1,
+		},
+	}
 
-			err = json.Unmarshal(data, &db)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewManualClock(testClockStart)
+			i, err := NewInMemoryDatabase(WithClock(clock), WithTTLJitter(tt.jitter))
 			if err != nil {
-				t.Errorf("Failed to unmarshal %v", tt.file)
+				t.Fatal(err)
 			}
-
-			if !reflect.DeepEqual(db.ttl, i.ttl) {
-				t.Errorf("Actual ttl heap does not match %v", tt.file)
+			if tt.randN != nil {
+				i.s.randN = tt.randN
 			}
 
-			if !reflect.DeepEqual(db.database, i.database) {
-				t.Errorf("Actual database does not match %v", tt.file)
+			setupHelper(i, &[]any{
+				&putCall{"put", "value", tt.ttl},
+				&putCall{"prefix", "value", -1},
+			}, nil)
+			i.Create(struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Ttl   *int64 `json:"ttl"`
+			}{Key: "create", Value: "value", Ttl: &tt.ttl})
+			i.ExpirePrefix("prefix", tt.ttl)
+
+			for _, key := range []string{"put", "create", "prefix"} {
+				if ttl, ok := i.GetTTL(key); !ok || ttl == nil || *ttl != tt.expected {
+					t.Errorf("expected %v to have a ttl of %v, got %v", key, tt.expected, ttl)
+				}
 			}
 		})
 	}
+
+	// With real randomness, keys written together spread out within the bounds
+	i, err := NewInMemoryDatabase(WithClock(NewManualClock(testClockStart)), WithTTLJitter(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int64]bool{}
+	for n := range 100 {
+		key := fmt.Sprintf("key:%d", n)
+		setupHelper(i, &[]any{&putCall{key, "value", 100}}, nil)
+		ttl, _ := i.GetTTL(key)
+		if *ttl < 50 || *ttl > 150 {
+			t.Errorf("expected a ttl between 50 and 150, got %v", *ttl)
+		}
+		seen[*ttl] = true
+	}
+	if len(seen) < 10 {
+		t.Errorf("expected ttls to be spread out, got %v distinct ttls", len(seen))
+	}
 }
 
-func TestInMemoryDatabase_AofStart(t *testing.T) {
-	type expectationCommand struct {
-		key    string // Key to GET
-		exists bool   // Whether it should exist
-		value  string // What value it should have
-		ttl    int64  // What TTL it should have
+func TestInMemoryDatabase_ScanEntries(t *testing.T) {
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough keys that scan has to trim its candidates several times per page
+	var expected []string
+	var calls []any
+	for n := range 50 {
+		key := fmt.Sprintf("key:%02d", n)
+		expected = append(expected, key)
+		ttl := int64(-1)
+		if n%2 == 0 {
+			ttl = 100
+		}
+		calls = append(calls, &putCall{key, "value " + key, ttl})
+	}
+	setupHelper(i, &calls, nil)
+
+	var got []string
+	cursor := ""
+	for {
+		var entries []struct {
+			Key   string
+			Value string
+			Ttl   *int64
+		}
+		entries, cursor = i.ScanEntries("key:", cursor, 7)
+		for _, e := range entries {
+			got = append(got, e.Key)
+			if e.Value != "value "+e.Key {
+				t.Errorf("expected value %q for %v, got %q", "value "+e.Key, e.Key, e.Value)
+			}
+			var n int
+			_, _ = fmt.Sscanf(e.Key, "key:%d", &n)
+			if (n%2 == 0) != (e.Ttl != nil) || (e.Ttl != nil && *e.Ttl != 100) {
+				t.Errorf("unexpected ttl %v for %v", e.Ttl, e.Key)
+			}
+		}
+		if cursor == "" {
+			break
+		}
+	}
+
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected every key in order, got %v", got)
+	}
+
+	if entries, cursor := i.ScanEntries("key:", "", 0); len(entries) != 0 || cursor != "" {
+		t.Errorf("expected an empty page for a zero limit, got %v, %q", entries, cursor)
 	}
+}
 
+func TestInMemoryDatabase_Persistence(t *testing.T) {
 	tests := []struct {
-		name     string
-		commands []string
-		expected []expectationCommand
+		name      string
+		functions []any
 	}{
 		{
-			name: "Test starting database with AOF",
-			commands: []string{
-				"PUT hello1 hello1 -1",
-				"PUT hello2 hello2 2751785118",
-				"DELETE hello1",
-				"PUT hello3 hello3 -1",
-				"DELETE doesn'tExist",
-			},
-			expected: []expectationCommand{
-				{
-					key:    "hello1",
-					exists: false,
-				},
-				{
-					key:    "hello2",
-					exists: true,
-					value:  "hello2",
-					ttl:    2751785118,
-				},
-				{
-					key:    "hello3",
-					exists: true,
-					value:  "hello3",
-					ttl:    -1,
-				},
-			},
+			name: "Test saving database",
+			functions: []any{
+				&putCall{"hello1", "hello1", 10},
+				&deleteCall{"hello1"},
+				&putCall{"hello2", "hello2", 20},
+				&putCall{"hello3", "hello3", 30},
+				&putCall{"hello4", "hello4", 40},
+				&deleteCall{"hello4"},
+				&putCall{"hello3", "hello3", 50},
+				&putCall{"noTTL", "noTTL", -1},
+				&createCall{"hello1", 10, 0},
+				&createCall{"hello1", -1, 0}},
 		},
 	}
 
@@ -764,50 +2183,2151 @@ func TestInMemoryDatabase_AofStart(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			fp := t.TempDir()
 
-			file, err := os.Create(filepath.Join(fp, "aof"))
+			i, err := NewInMemoryDatabase(
+				WithAofPersistence(),
+				WithAofPersistencePeriod(1*time.Second),
+				WithAofPersistenceFile(filepath.Join(fp, "persist-aof")),
+				WithDatabasePersistence(),
+				WithDatabasePersistencePeriod(1*time.Second),
+				WithDatabasePersistenceFile(filepath.Join(fp, "persist-database.json")))
 			if err != nil {
 				t.Error(err)
 			}
-			defer file.Close()
-
-			output := ""
-			for _, command := range tt.commands {
-				output += fmt.Sprintf("%v\n", command)
-			}
+			setupHelper(i, &tt.functions, nil)
 
-			_, err = file.WriteString(output)
-			if err != nil {
-				t.Error(err)
-			}
+			i.Shutdown()
 
-			db, err := NewInMemoryDatabase(WithInitialData(filepath.Join(fp, "aof"), false))
+			// Test AOF persistence
+			file, err := os.Open(filepath.Join(fp, "persist-aof"))
 			if err != nil {
 				t.Error(err)
 			}
+			defer file.Close()
 
-			for i, command := range tt.expected {
-				value, loaded := db.Get(command.key)
-				if loaded != command.exists {
-					t.Fatalf("For command at index %v, expected %v but got %v", i, command.exists, loaded)
+			nodeID := i.GetInfo().NodeID
+			scanner := bufio.NewScanner(file)
+			for i, function := range tt.functions {
+				scanner.Scan()
+				r, err := parseAofRecord(scanner.Text())
+				if err != nil {
+					t.Fatalf("For function at index %v, failed to parse %q: %v", i, scanner.Text(), err)
 				}
 
-				if loaded && value != command.value {
-					t.Errorf("For command at index %v, expected %v but got %v", i, command.value, value)
+				if r.ts == 0 {
+					t.Errorf("For function at index %v, expected a timestamp", i)
 				}
 
-				if !command.exists {
-					continue
+				if r.seq != uint64(i+1) || r.node != nodeID {
+					t.Errorf("For function at index %v, expected operation %v on %v, got %v on %v", i, i+1, nodeID, r.seq, r.node)
 				}
 
-				ttl, _ := db.GetTTL(command.key)
-				if command.ttl == -1 && ttl != nil {
-					t.Errorf("For command at index %v, expected nil ttl but got %v", i, *ttl)
-				} else if command.ttl != -1 && ttl == nil {
-					t.Errorf("For command at index %v, expected %v but got nil", i, command.ttl)
-				} else if command.ttl != -1 && *ttl != command.ttl-time.Now().Unix() {
-					t.Errorf("For command at index %v, expected %v but got %v", i, command.ttl, *ttl)
+				switch function.(type) {
+				case *deleteCall:
+					if r.op != "DELETE" {
+						t.Errorf("Expected delete command got %v", r.op)
+					}
+
+					if function.(*deleteCall).key != r.key {
+						t.Errorf("For delete function at index %v, got incorrect key. Expected %v, but got %v", i, function.(*deleteCall).key, r.key)
+					}
+				case *putCall:
+					if r.op != "PUT" {
+						t.Errorf("Expected put command got %v", r.op)
+					}
+
+					if function.(*putCall).key != r.key {
+						t.Errorf("For put function at index %v, got incorrect key. Expected %v, but got %v", i, function.(*putCall).key, r.key)
+					}
+
+					if function.(*putCall).value != r.value {
+						t.Errorf("For put function at index %v, got incorrect value. Expected %v, but got %v", i, function.(*putCall).value, r.value)
+					}
+
+					if function.(*putCall).ttl != r.ttl {
+						t.Errorf("For put function at index %v, got incorrect ttl. Expected %v, but got %v", i, function.(*putCall).ttl, r.ttl)
+					}
+				case *createCall:
+					if r.op != "PUT" {
+						t.Errorf("Expected put command got %v", r.op)
+					}
+
+					if function.(*createCall).value != r.value {
+						t.Errorf("For create function at index %v, got incorrect value. Expected %v, but got %v", i, function.(*createCall).value, r.value)
+					}
+
+					if function.(*createCall).ttl != r.ttl {
+						t.Errorf("For create function at index %v, got incorrect ttl. Expected %v, but got %v", i, function.(*createCall).ttl, r.ttl)
+					}
 				}
 			}
+
+			// Test database persistence
+			data, err := os.ReadFile(filepath.Join(fp, "persist-database.json"))
+			if err != nil {
+				t.Fatal("Failed to read persistDatabase.json")
+			}
+
+			var decodedData *InMemoryDatabase
+			dec := gob.NewDecoder(bytes.NewBuffer(data))
+			if err := dec.Decode(&decodedData); err != nil {
+				log.Fatal("Decode error:", err)
+			}
+
+			if !reflect.DeepEqual(decodedData.ttl, i.ttl) {
+				t.Errorf("Actual ttl heap does not match persistDatabase.json")
+			}
+
+			if !reflect.DeepEqual(decodedData.database, i.database) {
+				t.Errorf("Actual database does not match persistDatabase.json")
+			}
 		})
 	}
 }
+
+func TestInMemoryDatabase_PanicRecovery(t *testing.T) {
+	fp := t.TempDir()
+	persistFile := filepath.Join(fp, "persist-database")
+
+	i, err := NewInMemoryDatabase(
+		WithLogger(slog.New(slog.DiscardHandler)),
+		WithDatabasePersistence(),
+		WithDatabasePersistencePeriod(time.Hour),
+		WithDatabasePersistenceFile(persistFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Put(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: "key", Value: "value"})
+
+	// A panicking routine should be recovered, persisted and restarted
+	runs := 0
+	done := make(chan struct{})
+	i.goRecover("test", func() {
+		runs++
+		if runs == 1 {
+			panic("test panic")
+		}
+		close(done)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("routine was not restarted after panicking")
+	}
+
+	data, err := os.ReadFile(persistFile)
+	if err != nil {
+		t.Fatalf("expected the database to be persisted after the panic: %v", err)
+	}
+
+	var decodedData *InMemoryDatabase
+	if err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&decodedData); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedData.database, i.database) {
+		t.Errorf("persisted database = %v; want %v", decodedData.database, i.database)
+	}
+}
+
+func TestInMemoryDatabase_PanicRestarts(t *testing.T) {
+	// Without background routines, the restart backoff can be changed between the routines started below
+	i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithManualTTLCleanup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.s.restartBackoff = time.Millisecond
+
+	// A routine that panics every time is restarted with a growing wait and then given up on
+	var runs atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i.runRestarting(context.Background(), "test", func() {
+			runs.Add(1)
+			panic("test panic")
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("routine that keeps panicking was not given up on")
+	}
+	if n := runs.Load(); n != maxRestarts+1 {
+		t.Errorf("routine ran %v times; want %v", n, maxRestarts+1)
+	}
+
+	// Shutting down stops a routine that is waiting to be restarted
+	i.s.restartBackoff = time.Hour
+	runs.Store(0)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		i.runRestarting(i.stopping, "test", func() {
+			runs.Add(1)
+			panic("test panic")
+		})
+	}()
+	for runs.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	i.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("routine was restarted after shutdown")
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("routine ran %v times; want 1", n)
+	}
+}
+
+func TestInMemoryDatabase_DatabaseStartJson(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{
+			name: "Test starting database with json",
+			file: "testDatabaseStartup.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, err := NewInMemoryDatabase(WithInitialData(tt.file, true))
+			if err != nil {
+				t.Error(err)
+			}
+
+			data, err := os.ReadFile(tt.file)
+			if err != nil {
+				t.Errorf("Failed to read %v", tt.file)
+			}
+
+			var db *InMemoryDatabase
+
+			err = json.Unmarshal(data, &db)
+			if err != nil {
+				t.Errorf("Failed to unmarshal %v", tt.file)
+			}
+
+			// The heap is rebuilt from the entries, dropping stale items, so it holds exactly one item per expiring key
+			var expected ttlHeap
+			for key, e := range db.database.entries() {
+				if e.expiresAt != 0 {
+					expected = append(expected, ttlHeapData{key, e.expiresAt})
+				}
+			}
+			sortHeap := func(h ttlHeap) ttlHeap {
+				c := slices.Clone(h)
+				slices.SortFunc(c, func(a, b ttlHeapData) int {
+					return cmp.Or(cmp.Compare(a.ttl, b.ttl), strings.Compare(a.key, b.key))
+				})
+				return c
+			}
+			if !reflect.DeepEqual(sortHeap(expected), sortHeap(*i.ttl)) {
+				t.Errorf("Actual ttl heap does not match %v", tt.file)
+			}
+
+			if !reflect.DeepEqual(db.database, i.database) {
+				t.Errorf("Actual database does not match %v", tt.file)
+			}
+		})
+	}
+}
+
+func TestAofRecord(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		expected    aofRecord
+		shouldError bool
+	}{
+		{
+			name:     "Put",
+			line:     `PUT "key" "value" 10 ts=1000`,
+			expected: aofRecord{op: "PUT", key: "key", value: "value", ttl: 10, ts: 1000},
+		},
+		{
+			name:     "Put with spaces and quotes",
+			line:     `PUT "a key" "a \"quoted\" value\n" -1 ts=1000`,
+			expected: aofRecord{op: "PUT", key: "a key", value: "a \"quoted\" value\n", ttl: -1, ts: 1000},
+		},
+		{
+			name:     "Delete",
+			line:     `DELETE "key" ts=1000`,
+			expected: aofRecord{op: "DELETE", key: "key", ttl: -1, ts: 1000},
+		},
+		{
+			name:     "Operation ID",
+			line:     `PUT "key" "value" 10 ts=1000 seq=42 node=node-1`,
+			expected: aofRecord{op: "PUT", key: "key", value: "value", ttl: 10, ts: 1000, seq: 42, node: "node-1"},
+		},
+		{
+			name:        "Invalid sequence number",
+			line:        `DELETE "key" ts=1000 seq=-1`,
+			shouldError: true,
+		},
+		{
+			name:     "Unknown attributes are ignored",
+			line:     `DELETE "key" ts=1000 future=yes`,
+			expected: aofRecord{op: "DELETE", key: "key", ttl: -1, ts: 1000},
+		},
+		{
+			name:     "Legacy put",
+			line:     `PUT key value 2751785118`,
+			expected: aofRecord{op: "PUT", key: "key", value: "value", ttl: 2751785118},
+		},
+		{
+			name:     "Legacy delete",
+			line:     `DELETE key`,
+			expected: aofRecord{op: "DELETE", key: "key", ttl: -1},
+		},
+		{
+			name:        "Unknown operation",
+			line:        `GET "key"`,
+			shouldError: true,
+		},
+		{
+			name:        "Too few fields",
+			line:        `PUT "key" "value"`,
+			shouldError: true,
+		},
+		{
+			name:        "Unterminated quote",
+			line:        `PUT "key "value" 10`,
+			shouldError: true,
+		},
+		{
+			name:        "Invalid ttl",
+			line:        `PUT "key" "value" ten ts=1000`,
+			shouldError: true,
+		},
+		{
+			name:        "Invalid timestamp",
+			line:        `PUT "key" "value" 10 ts=now`,
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseAofRecord(tt.line)
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("expected an error parsing %q", tt.line)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, r)
+			}
+
+			// Timestamped records survive a round trip
+			if r.ts != 0 {
+				if line := string(appendAofRecord(nil, r)); line != tt.line && !strings.Contains(tt.line, "future") {
+					t.Errorf("expected %q, got %q", tt.line, line)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_ReplayUntil(t *testing.T) {
+	clock := NewManualClock(testClockStart)
+	start := clock.Now()
+	ts := func(offset time.Duration) int64 {
+		return start.Add(offset).UnixMilli()
+	}
+
+	aof := filepath.Join(t.TempDir(), "aof")
+	lines := []string{
+		"PUT legacy legacy -1",
+		fmt.Sprintf(`PUT "a" "first" -1 ts=%d`, ts(-3*time.Hour)),
+		fmt.Sprintf(`PUT "b" "with ttl" 14400 ts=%d`, ts(-3*time.Hour)),
+		fmt.Sprintf(`PUT "a" "second" -1 ts=%d`, ts(-2*time.Hour)),
+		fmt.Sprintf(`PUT "a" "bad write" -1 ts=%d`, ts(-1*time.Hour)),
+		fmt.Sprintf(`DELETE "legacy" ts=%d`, ts(-1*time.Hour)),
+	}
+	if err := os.WriteFile(aof, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		until    time.Time
+		expected map[string]string
+		ttl      *int64
+	}{
+		{
+			name:     "Replays everything without a point in time",
+			expected: map[string]string{"a": "bad write", "b": "with ttl"},
+		},
+		{
+			name:     "Stops before the bad write",
+			until:    start.Add(-90 * time.Minute),
+			expected: map[string]string{"legacy": "legacy", "a": "second", "b": "with ttl"},
+		},
+		{
+			name:     "Includes records written exactly at the point in time",
+			until:    start.Add(-3 * time.Hour),
+			expected: map[string]string{"legacy": "legacy", "a": "first", "b": "with ttl"},
+			ttl:      func() *int64 { ttl := int64(3600); return &ttl }(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, err := NewInMemoryDatabase(WithClock(clock), WithInitialData(aof, false), WithReplayUntil(tt.until))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range []string{"legacy", "a", "b"} {
+				value, ok := i.Get(key)
+				expected, shouldExist := tt.expected[key]
+				if ok != shouldExist || value != expected {
+					t.Errorf("expected %v to be %q (%v), got %q (%v)", key, expected, shouldExist, value, ok)
+				}
+			}
+
+			// The ttl is relative to when the record was written
+			if tt.ttl != nil {
+				ttl, _ := i.GetTTL("b")
+				if ttl == nil || *ttl != *tt.ttl {
+					t.Errorf("expected b to have a ttl of %v, got %v", *tt.ttl, ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_Seq(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	if _, err := NewInMemoryDatabase(WithNodeID("has space")); err == nil {
+		t.Errorf("expected an error for an invalid node id")
+	}
+
+	dir := t.TempDir()
+	aof := filepath.Join(dir, "aof")
+	i, err := NewInMemoryDatabase(WithNodeID("node-1"), WithAofPersistence(), WithAofPersistenceFile(aof))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i.Put(kv{Key: "a", Value: "1"})
+	i.Create(kv{Key: "b", Value: "2"})
+	i.Delete("a")
+	if info := i.GetInfo(); info.Seq != 3 || info.NodeID != "node-1" || info.Keys != 1 {
+		t.Errorf("expected seq 3 on node-1 with 1 key, got %+v", info)
+	}
+
+	// Replaying the same operations twice, e.g. from a retried copy, only applies them once
+	data, err := os.ReadFile(aof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicated := filepath.Join(dir, "duplicated")
+	if err = os.WriteFile(duplicated, append(data, data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := NewInMemoryDatabase(WithNodeID("node-1"), WithInitialData(duplicated, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary := replayed.GetStartupSummary(); summary.Loaded != 3 || summary.Skipped != 3 || summary.Duplicates != 3 || summary.Malformed != 0 {
+		t.Errorf("expected 3 loaded and 3 skipped as duplicates, got %+v", summary)
+	}
+
+	// The sequence continues from the replayed operations
+	replayed.Put(kv{Key: "c", Value: "3"})
+	if info := replayed.GetInfo(); info.Seq != 4 || info.Keys != 2 {
+		t.Errorf("expected seq 4 with 2 keys, got %+v", info)
+	}
+
+	// Snapshots carry the sequence number too
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(replayed); err != nil {
+		t.Fatal(err)
+	}
+	var decoded *InMemoryDatabase
+	if err = gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.seq != 4 {
+		t.Errorf("expected the snapshot to have seq 4, got %v", decoded.seq)
+	}
+}
+
+func TestInMemoryDatabase_StartupSummary(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "snapshot.json")
+	aof := filepath.Join(dir, "aof")
+
+	// The clock starts in 2000 so a ttl of 1e9 has already expired
+	err := os.WriteFile(snapshot, []byte(`{
+		"ttlHeap": [{"key": "expiring", "ttl": 2751785108}],
+		"dbStore": {
+			"plain": {"value": "plain", "ttl": null},
+			"expiring": {"value": "expiring", "ttl": 2751785108},
+			"expired": {"value": "expired", "ttl": 1000000000},
+			"malformed": {"value": 5, "ttl": null}
+		},
+		"unknown": {"nested": [1, 2, {"deep": true}]}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(aof, []byte("PUT fromAof fromAof -1\nPUT plain replaced 1000000000\nPUT bad\nUNKNOWN x\nPUT badTTL v notANumber\nDELETE expiring\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	// Startup files are loaded once every option is applied, so the clock given afterward is still used
+	i, err := NewInMemoryDatabase(
+		WithInitialData(snapshot, true),
+		WithInitialData(aof, false),
+		WithLoadProgressInterval(2),
+		WithLogger(logger),
+		WithClock(NewManualClock(testClockStart)),
+		WithManualTTLCleanup(),
+		WithConcurrencyMode(ConcurrencySharded),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := i.GetStartupSummary()
+	if summary.Loaded != 4 || summary.Skipped != 4 || summary.Malformed != 4 || summary.Duplicates != 0 || summary.Expired != 2 {
+		t.Errorf("expected 4 loaded, 4 skipped as malformed and 2 expired, got %+v", summary)
+	}
+	if !slices.Equal(summary.Files, []string{snapshot, aof}) {
+		t.Errorf("expected the snapshot and the aof to be reported as loaded, got %v", summary.Files)
+	}
+
+	// Malformed records are reported by where they are, as the key in a snapshot and the line in an AOF
+	var where []string
+	for _, r := range summary.MalformedRecords {
+		at, _, _ := strings.Cut(r, ": ")
+		where = append(where, at)
+	}
+	if want := []string{snapshot + `:"malformed"`, aof + ":3", aof + ":4", aof + ":5"}; !slices.Equal(where, want) {
+		t.Errorf("expected malformed records at %v, got %v", want, summary.MalformedRecords)
+	}
+	if !strings.Contains(logs.String(), "skipping malformed startup record") {
+		t.Error("expected the malformed records to be logged")
+	}
+
+	if v, ok := i.Get("fromAof"); !ok || v != "fromAof" {
+		t.Errorf("expected fromAof to be loaded, got %v %v", v, ok)
+	}
+	for _, key := range []string{"plain", "expiring", "expired", "malformed"} {
+		if _, ok := i.Get(key); ok {
+			t.Errorf("expected %v not to be loaded", key)
+		}
+	}
+	if len(*i.ttl) != 0 {
+		t.Errorf("expected the ttl heap to only hold loaded keys, got %v", *i.ttl)
+	}
+
+	if n := strings.Count(logs.String(), `"msg":"loading startup data"`); n != 5 {
+		t.Errorf("expected 5 progress lines, got %v", n)
+	}
+	if !strings.Contains(logs.String(), `"msg":"loaded startup data"`) {
+		t.Errorf("expected a startup summary to be logged")
+	}
+
+	if _, err = NewInMemoryDatabase(WithInitialData(filepath.Join(dir, "missing"), true)); err == nil {
+		t.Errorf("expected an error for a missing startup file")
+	}
+	if _, err = NewInMemoryDatabase(WithLoadProgressInterval(-1)); err == nil {
+		t.Errorf("expected an error for a negative progress interval")
+	}
+}
+
+func TestInMemoryDatabase_AofStart(t *testing.T) {
+	type expectationCommand struct {
+		key    string // Key to GET
+		exists bool   // Whether it should exist
+		value  string // What value it should have
+		ttl    int64  // What TTL it should have
+	}
+
+	tests := []struct {
+		name     string
+		commands []string
+		expected []expectationCommand
+	}{
+		{
+			name: "Test starting database with AOF",
+			commands: []string{
+				"PUT hello1 hello1 -1",
+				"PUT hello2 hello2 2751785118",
+				"DELETE hello1",
+				"PUT hello3 hello3 -1",
+				"DELETE doesn'tExist",
+			},
+			expected: []expectationCommand{
+				{
+					key:    "hello1",
+					exists: false,
+				},
+				{
+					key:    "hello2",
+					exists: true,
+					value:  "hello2",
+					ttl:    2751785118,
+				},
+				{
+					key:    "hello3",
+					exists: true,
+					value:  "hello3",
+					ttl:    -1,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := t.TempDir()
+
+			file, err := os.Create(filepath.Join(fp, "aof"))
+			if err != nil {
+				t.Error(err)
+			}
+			defer file.Close()
+
+			output := ""
+			for _, command := range tt.commands {
+				output += fmt.Sprintf("%v\n", command)
+			}
+
+			_, err = file.WriteString(output)
+			if err != nil {
+				t.Error(err)
+			}
+
+			db, err := NewInMemoryDatabase(WithInitialData(filepath.Join(fp, "aof"), false))
+			if err != nil {
+				t.Error(err)
+			}
+
+			for i, command := range tt.expected {
+				value, loaded := db.Get(command.key)
+				if loaded != command.exists {
+					t.Fatalf("For command at index %v, expected %v but got %v", i, command.exists, loaded)
+				}
+
+				if loaded && value != command.value {
+					t.Errorf("For command at index %v, expected %v but got %v", i, command.value, value)
+				}
+
+				if !command.exists {
+					continue
+				}
+
+				ttl, _ := db.GetTTL(command.key)
+				if command.ttl == -1 && ttl != nil {
+					t.Errorf("For command at index %v, expected nil ttl but got %v", i, *ttl)
+				} else if command.ttl != -1 && ttl == nil {
+					t.Errorf("For command at index %v, expected %v but got nil", i, command.ttl)
+				} else if command.ttl != -1 && *ttl != command.ttl-time.Now().Unix() {
+					t.Errorf("For command at index %v, expected %v but got %v", i, command.ttl, *ttl)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_SubscribeEvents(t *testing.T) {
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, unsubscribeAll := i.SubscribeEvents("")
+	defer unsubscribeAll()
+	users, unsubscribeUsers := i.SubscribeEvents("user:")
+
+	setupHelper(i, &[]any{
+		&putCall{"user:1", "a", -1},
+		&putCall{"user:1", "b", -1},
+		&putCall{"user:2", "a", 5},
+		&putCall{"other", "a", -1},
+		&deleteCall{"user:1"},
+		&deleteCall{"missing"},
+	}, nil)
+	i.Create(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: "user:3", Value: "a"})
+	i.ExpirePrefix("other", 10)
+
+	// The cleaner expires user:2 and then other
+	blockUntilTimers(t, clock, 1)
+	clock.Advance(5 * time.Second)
+	blockUntilTimers(t, clock, 1)
+	clock.Advance(5 * time.Second)
+
+	read := func(ch <-chan keyEvent, n int) []string {
+		var got []string
+		for range n {
+			select {
+			case e := <-ch:
+				got = append(got, e.Type+" "+e.Key)
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for events, got %v", got)
+			}
+		}
+		return got
+	}
+
+	expected := []string{
+		"created user:1", "updated user:1", "created user:2", "created other", "deleted user:1", "created user:3",
+		"updated other", "expired user:2", "expired other",
+	}
+	if got := read(all, len(expected)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected events %v, got %v", expected, got)
+	}
+	expected = []string{"created user:1", "updated user:1", "created user:2", "deleted user:1", "created user:3", "expired user:2"}
+	if got := read(users, len(expected)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected events %v, got %v", expected, got)
+	}
+
+	// Unsubscribing closes the channel and stops further events
+	unsubscribeUsers()
+	unsubscribeUsers()
+	setupHelper(i, &[]any{&putCall{"user:4", "a", -1}}, nil)
+	if e, ok := <-users; ok {
+		t.Errorf("expected the channel to be closed, got %v", e)
+	}
+	if got := read(all, 1); got[0] != "created user:4" {
+		t.Errorf("expected the remaining subscriber to see user:4, got %v", got)
+	}
+}
+
+func TestInMemoryDatabase_Eviction(t *testing.T) {
+	const limit = 500 // Going one byte over frees 51 bytes, which is a single entry
+	var used atomic.Uint64
+	withUsage := func(db *InMemoryDatabase) error {
+		db.s.memoryUsage = used.Load
+		return nil
+	}
+
+	tests := []struct {
+		name        string
+		policy      string
+		calls       []any
+		reads       []string // Keys read after the calls
+		used        uint64
+		wantEvicted []string
+	}{
+		{
+			name:        "volatile-ttl evicts the soonest to expire",
+			policy:      EvictVolatileTTL,
+			calls:       []any{&putCall{"a", "1", 100}, &putCall{"b", "2", 10}, &putCall{"c", "3", -1}},
+			used:        limit + 1,
+			wantEvicted: []string{"b"},
+		},
+		{
+			name:        "volatile-ttl keeps keys without a ttl",
+			policy:      EvictVolatileTTL,
+			calls:       []any{&putCall{"a", "1", 100}, &putCall{"b", "2", 10}, &putCall{"c", "3", -1}},
+			used:        10 * limit,
+			wantEvicted: []string{"b", "a"},
+		},
+		{
+			name:        "lru evicts the least recently used",
+			policy:      EvictLRU,
+			calls:       []any{&putCall{"a", "1", -1}, &putCall{"b", "2", -1}, &putCall{"c", "3", -1}},
+			reads:       []string{"a"},
+			used:        limit + 1,
+			wantEvicted: []string{"b"},
+		},
+		{
+			name:   "nothing is evicted under the limit",
+			policy: EvictLRU,
+			calls:  []any{&putCall{"a", "1", -1}},
+			used:   limit,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, err := NewInMemoryDatabase(WithEviction(limit, tt.policy), withUsage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupHelper(i, &tt.calls, nil)
+			for _, key := range tt.reads {
+				i.Get(key)
+			}
+			events, unsubscribe := i.SubscribeEvents("")
+			defer unsubscribe()
+
+			used.Store(tt.used)
+			if evicted := i.relieveMemoryPressure(); evicted != len(tt.wantEvicted) {
+				t.Fatalf("relieveMemoryPressure() = %v; want %v", evicted, len(tt.wantEvicted))
+			}
+			for _, key := range tt.wantEvicted {
+				if e := <-events; e.Type != EventEvicted || e.Key != key {
+					t.Errorf("event = %+v; want %v evicted", e, key)
+				}
+				if _, ok := i.Get(key); ok {
+					t.Errorf("%v is still stored after it was evicted", key)
+				}
+			}
+			if got := i.GetInfo().Keys; got != len(tt.calls)-len(tt.wantEvicted) {
+				t.Errorf("%v keys are left after evicting %v", got, tt.wantEvicted)
+			}
+		})
+	}
+
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(math.MaxInt64))
+	for name, opt := range map[string]Options{
+		"unknown policy":  WithEviction(limit, "random"),
+		"negative limit":  WithEviction(-1, EvictLRU),
+		"no memory limit": WithEviction(0, EvictLRU),
+	} {
+		if _, err := NewInMemoryDatabase(opt); err == nil {
+			t.Errorf("expected an error for %v", name)
+		}
+	}
+
+	// Without a limit, the soft memory limit of the runtime is used
+	debug.SetMemoryLimit(1 << 30)
+	i, err := NewInMemoryDatabase(WithEviction(0, EvictVolatileTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := i.GetSettings().MemoryLimit; got != 1<<30 {
+		t.Errorf("MemoryLimit = %v; want the runtime limit %v", got, 1<<30)
+	}
+}
+
+func TestInMemoryDatabase_NamespaceQuota(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	ttl := int64(5)
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock),
+		WithNamespaceQuota("small", NamespaceQuota{MaxKeys: 2}),
+		WithNamespaceQuota("tiny", NamespaceQuota{MaxBytes: 20}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		write   func(t *testing.T) error
+		wantErr string
+	}{
+		{
+			name:  "Writes within the key quota succeed",
+			write: func(t *testing.T) error { _, err := i.Put(kv{Key: "small:1", Value: "a"}); return err },
+		},
+		{
+			name:  "Creates within the key quota succeed",
+			write: func(t *testing.T) error { _, _, err := i.Create(kv{Key: "small:2", Value: "a", Ttl: &ttl}); return err },
+		},
+		{
+			name:    "New keys over the key quota fail",
+			write:   func(t *testing.T) error { _, err := i.Put(kv{Key: "small:3", Value: "a"}); return err },
+			wantErr: `namespace "small" is limited to 2 keys`,
+		},
+		{
+			name:    "Creates over the key quota fail",
+			write:   func(t *testing.T) error { _, _, err := i.Create(kv{Key: "small:3", Value: "a"}); return err },
+			wantErr: `namespace "small" is limited to 2 keys`,
+		},
+		{
+			name:  "Existing keys can be overwritten at the key quota",
+			write: func(t *testing.T) error { _, err := i.Put(kv{Key: "small:1", Value: "b"}); return err },
+		},
+		{
+			name:  "Other namespaces are unaffected",
+			write: func(t *testing.T) error { _, err := i.Put(kv{Key: "other:1", Value: "a"}); return err },
+		},
+		{
+			name: "Deleting frees the quota",
+			write: func(t *testing.T) error {
+				i.Delete("small:1")
+				_, err := i.Put(kv{Key: "small:3", Value: "a"})
+				return err
+			},
+		},
+		{
+			name: "Expiring frees the quota",
+			write: func(t *testing.T) error {
+				blockUntilTimers(t, clock, 1)
+				clock.Advance(5 * time.Second)
+				deadline := time.Now().Add(time.Second)
+				for time.Now().Before(deadline) {
+					i.mu.RLock()
+					keys := i.usage["small"].keys
+					i.mu.RUnlock()
+					if keys == 1 {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				_, err := i.Put(kv{Key: "small:4", Value: "a"})
+				return err
+			},
+		},
+		{
+			name:  "Writes within the byte quota succeed",
+			write: func(t *testing.T) error { _, err := i.Put(kv{Key: "tiny:1", Value: "0123456789"}); return err },
+		},
+		{
+			name:    "Writes over the byte quota fail",
+			write:   func(t *testing.T) error { _, err := i.Put(kv{Key: "tiny:2", Value: "0123"}); return err },
+			wantErr: `namespace "tiny" is limited to 20 bytes`,
+		},
+		{
+			name:    "Overwrites that grow over the byte quota fail",
+			write:   func(t *testing.T) error { _, err := i.Put(kv{Key: "tiny:1", Value: "0123456789abcdef"}); return err },
+			wantErr: `namespace "tiny" is limited to 20 bytes`,
+		},
+		{
+			name:  "Overwrites that shrink succeed",
+			write: func(t *testing.T) error { _, err := i.Put(kv{Key: "tiny:1", Value: "0"}); return err },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.write(t)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var limit *LimitError
+			if !errors.As(err, &limit) || !limit.Quota() || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected a quota error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	if _, ok := i.Get("small:3"); !ok {
+		t.Errorf("expected small:3 to have been written after the quota was freed")
+	}
+	if usage := *i.usage["small"]; usage != (namespaceUsage{keys: 2, bytes: int64(len("small:3a") + len("small:4a"))}) {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+func TestInMemoryDatabase_Compression(t *testing.T) {
+	large := strings.Repeat(`{"name":"value","list":[1,2,3]}`, 20)
+	random := make([]byte, 200)
+	for n := range random {
+		random[n] = byte(n * 7919 % 251)
+	}
+	incompressible := string(random)
+
+	fp := t.TempDir()
+	aof := filepath.Join(fp, "aof")
+	i, err := NewInMemoryDatabase(WithClock(NewManualClock(testClockStart)), WithCompression(100),
+		WithAofPersistence(), WithAofPersistenceFile(aof))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupHelper(i, &[]any{
+		&putCall{"large", large, -1},
+		&putCall{"small", "small", -1},
+		&putCall{"incompressible", incompressible, -1},
+	}, nil)
+	i.Create(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: "created", Value: large})
+	i.ExpirePrefix("large", 100)
+
+	tests := []struct {
+		key        string
+		value      string
+		compressed bool
+	}{
+		{key: "large", value: large, compressed: true},
+		{key: "created", value: large, compressed: true},
+		{key: "small", value: "small"},
+		{key: "incompressible", value: incompressible},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			i.mu.RLock()
+			e, _ := i.load(tt.key)
+			i.mu.RUnlock()
+			if e.compressed != tt.compressed {
+				t.Errorf("compressed = %v; want %v", e.compressed, tt.compressed)
+			}
+			if tt.compressed && len(e.value) >= len(tt.value) {
+				t.Errorf("expected the stored value to be smaller than %v bytes, got %v", len(tt.value), len(e.value))
+			}
+
+			if v, ok := i.Get(tt.key); !ok || v != tt.value {
+				t.Errorf("Get() = %q, %v; want the original value", v, ok)
+			}
+			if entry, ok := i.GetEntry(tt.key); !ok || entry.Value != tt.value {
+				t.Errorf("GetEntry() = %q, %v; want the original value", entry.Value, ok)
+			}
+			entries, _ := i.ScanEntries(tt.key, "", 1)
+			if len(entries) != 1 || entries[0].Value != tt.value {
+				t.Errorf("ScanEntries() = %v; want the original value", entries)
+			}
+		})
+	}
+
+	// Snapshots hold the original values
+	b, err := json.Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), strconv.Quote(large)[1:40]) {
+		t.Errorf("expected the JSON snapshot to hold the original value")
+	}
+	var decoded InMemoryDatabase
+	b, err = i.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = decoded.GobDecode(b); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := decoded.database.load("large"); e.compressed || e.value != large {
+		t.Errorf("expected the gob snapshot to hold the original value")
+	}
+
+	// So does the AOF, including the records written by ExpirePrefix, and replaying it compresses the values again
+	i.Shutdown()
+	replayed, err := NewInMemoryDatabase(WithClock(NewManualClock(testClockStart)), WithCompression(100), WithInitialData(aof, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := replayed.database.load("large"); !e.compressed || e.plainValue() != large {
+		t.Errorf("expected the replayed value to be compressed")
+	}
+	if ttl, ok := replayed.GetTTL("large"); !ok || ttl == nil {
+		t.Errorf("expected the replayed value to keep the ttl from ExpirePrefix")
+	}
+}
+
+func TestInMemoryDatabase_SizeLimits(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	// Compression is enabled to check that the value limit applies to the value as written
+	i, err := NewInMemoryDatabase(WithClock(NewManualClock(testClockStart)), WithMaxKeyLength(4), WithMaxValueSize(100), WithCompression(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr error
+	}{
+		{name: "Within the limits", key: "abcd", value: strings.Repeat("a", 100)},
+		{name: "Key too long", key: "abcde", value: "a", wantErr: ErrKeyTooLong},
+		{name: "Value too large", key: "abc", value: strings.Repeat("a", 101), wantErr: ErrValueTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writes := map[string]func() error{
+				"Put": func() error { _, err := i.Put(kv{Key: tt.key, Value: tt.value}); return err },
+				"Create": func() error {
+					i.Delete(tt.key)
+					_, _, err := i.Create(kv{Key: tt.key, Value: tt.value})
+					return err
+				},
+			}
+			for name, write := range writes {
+				err := write()
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("%v() error = %v; want %v", name, err, tt.wantErr)
+				}
+				_, stored := i.Get(tt.key)
+				if stored != (tt.wantErr == nil) {
+					t.Errorf("%v() stored = %v; want %v", name, stored, tt.wantErr == nil)
+				}
+
+				var limit *LimitError
+				if tt.wantErr != nil && (!errors.As(err, &limit) || limit.Quota()) {
+					t.Errorf("%v() error = %#v; want a size *LimitError", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestKVStore_rangeEntries(t *testing.T) {
+	for _, mode := range []string{ConcurrencyRWMutex, ConcurrencySharded, ConcurrencyCOW} {
+		t.Run(mode, func(t *testing.T) {
+			store, err := newStore(mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := dbStore{}
+			for n := range 100 {
+				want[strconv.Itoa(n)] = databaseEntry{value: "v" + strconv.Itoa(n)}
+			}
+			store.storeAll(want)
+
+			got := dbStore{}
+			for key, d := range store.rangeEntries {
+				got[key] = d
+			}
+			if !maps.Equal(got, want) {
+				t.Errorf("rangeEntries() = %v; want %v", got, want)
+			}
+
+			// Stopping early releases the shard locks, so the store can be written to afterward
+			n := 0
+			for range store.rangeEntries {
+				if n++; n == 10 {
+					break
+				}
+			}
+			store.store("after", databaseEntry{value: "v"})
+			if n != 10 || store.len() != 101 {
+				t.Errorf("ranged over %v entries and stored %v; want 10 and 101", n, store.len())
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_Range(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	for _, mode := range []string{ConcurrencyRWMutex, ConcurrencySharded, ConcurrencyCOW} {
+		t.Run(mode, func(t *testing.T) {
+			clock := NewManualClock(testClockStart)
+			i, err := NewInMemoryDatabase(WithClock(clock), WithConcurrencyMode(mode), WithCompression(16))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			long, expiring, expired := strings.Repeat("x", 64), int64(100), int64(10)
+			i.Put(kv{Key: "user:a", Value: "a"})
+			i.Put(kv{Key: "user:b", Value: long, Ttl: &expiring})
+			i.Put(kv{Key: "user:c", Value: "c", Ttl: &expired})
+			i.Put(kv{Key: "session:a", Value: "s"})
+
+			// Let user:c expire without the cleaner running so that Range has to skip it
+			clock.mu.Lock()
+			clock.now = clock.now.Add(10 * time.Second)
+			clock.mu.Unlock()
+
+			values := map[string]string{}
+			expirations := map[string]*time.Time{}
+			i.Range(func(key string, value string, expiresAt *time.Time) bool {
+				values[key] = value
+				expirations[key] = expiresAt
+				return true
+			})
+			expected := map[string]string{"user:a": "a", "user:b": long, "session:a": "s"}
+			if !maps.Equal(values, expected) {
+				t.Errorf("Range() visited %v, want %v", values, expected)
+			}
+			if expirations["user:a"] != nil {
+				t.Errorf("expected user:a to never expire, got %v", expirations["user:a"])
+			}
+			if e := expirations["user:b"]; e == nil || !e.Equal(clock.Now().Add(90*time.Second)) {
+				t.Errorf("expected user:b to expire in 90 seconds, got %v", e)
+			}
+
+			visited := 0
+			i.Range(func(string, string, *time.Time) bool {
+				visited++
+				return false
+			})
+			if visited != 1 {
+				t.Errorf("expected Range to stop after the first key, visited %v", visited)
+			}
+
+			keys := slices.Sorted(i.Keys("user:"))
+			if !slices.Equal(keys, []string{"user:a", "user:b"}) {
+				t.Errorf("Keys() = %v, want [user:a user:b]", keys)
+			}
+			for range i.Keys("") {
+				break
+			}
+
+			// No lock is held while the callback runs, so it may write to the database
+			i.Range(func(key string, _ string, _ *time.Time) bool {
+				if !strings.HasPrefix(key, "copy:") {
+					i.Put(kv{Key: "copy:" + key, Value: "v"})
+				}
+				return true
+			})
+			if _, ok := i.Get("copy:user:a"); !ok {
+				t.Errorf("expected writes from the callback to succeed")
+			}
+		})
+	}
+}
+
+func TestInMemoryDatabase_Lease(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	advance := func(d time.Duration) {
+		// The clock is moved without firing timers so that expirations are checked by reads rather than the cleaner
+		clock.mu.Lock()
+		clock.now = clock.now.Add(d)
+		clock.mu.Unlock()
+	}
+
+	id, ok := i.AcquireLease("worker", 10)
+	if !ok || id == "" {
+		t.Fatalf("AcquireLease() = %q, %v; want a lease", id, ok)
+	}
+	if _, ok = i.AcquireLease("worker", 10); ok {
+		t.Errorf("expected a held lease not to be acquired again")
+	}
+
+	if _, found, err := i.PutLeased("svc:a", "1", "worker", "wrong"); found || err != nil {
+		t.Errorf("PutLeased() with the wrong id = %v, %v; want no lease", found, err)
+	}
+	if loaded, found, err := i.PutLeased("svc:a", "1", "worker", id); loaded || !found || err != nil {
+		t.Errorf("PutLeased() = %v, %v, %v; want a new key under the lease", loaded, found, err)
+	}
+	i.PutLeased("svc:b", "2", "worker", id)
+
+	// Overwriting a key without the lease takes it out of the lease
+	i.Put(kv{Key: "svc:b", Value: "3"})
+
+	advance(8 * time.Second)
+	if !i.RenewLease("worker", id) {
+		t.Fatalf("expected the lease to be renewed")
+	}
+	if ttl, _ := i.GetTTL("svc:a"); ttl == nil || *ttl != 10 {
+		t.Errorf("expected svc:a to be renewed to a ttl of 10, got %v", ttl)
+	}
+	advance(8 * time.Second)
+	if _, ok = i.Get("svc:a"); !ok {
+		t.Errorf("expected svc:a to outlive the original lease")
+	}
+
+	if n, ok := i.ReleaseLease("worker", id); n != 1 || !ok {
+		t.Errorf("ReleaseLease() = %v, %v; want 1, true", n, ok)
+	}
+	if _, ok = i.Get("svc:a"); ok {
+		t.Errorf("expected svc:a to be deleted with the lease")
+	}
+	if v, _ := i.Get("svc:b"); v != "3" {
+		t.Errorf("expected svc:b to be kept, got %q", v)
+	}
+	if i.RenewLease("worker", id) {
+		t.Errorf("expected a released lease not to be renewed")
+	}
+
+	// Keys expire with their lease, after which it may be acquired again
+	id, _ = i.AcquireLease("expiring", 5)
+	i.PutLeased("svc:c", "4", "expiring", id)
+	advance(5 * time.Second)
+	if _, ok = i.Get("svc:c"); ok {
+		t.Errorf("expected svc:c to expire with its lease")
+	}
+	if i.RenewLease("expiring", id) {
+		t.Errorf("expected an expired lease not to be renewed")
+	}
+	if _, ok = i.AcquireLease("expiring", 5); !ok {
+		t.Errorf("expected an expired lease to be acquired again")
+	}
+}
+
+func TestInMemoryDatabase_Warmup(t *testing.T) {
+	ttl := int64(60)
+	tests := []struct {
+		name     string
+		entries  []Entry
+		err      error
+		expected map[string]string // The values expected once warmup finishes
+	}{
+		{
+			name:     "Warm new keys",
+			entries:  []Entry{{Key: "a", Value: "1"}, {Key: "b", Value: "2", Ttl: &ttl}},
+			expected: map[string]string{"a": "1", "b": "2", "existing": "fresh"},
+		},
+		{
+			name:     "Keep existing keys and skip entries without a key",
+			entries:  []Entry{{Key: "existing", Value: "stale"}, {Value: "no key"}},
+			expected: map[string]string{"existing": "fresh"},
+		},
+		{
+			name:     "Failed fetch",
+			err:      errors.New("source unavailable"),
+			expected: map[string]string{"existing": "fresh"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithWarmupFetcher(func(ctx context.Context) ([]Entry, error) {
+				<-release
+				return tt.entries, tt.err
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i.Ready() {
+				t.Error("Ready() before warmup = true; want false")
+			}
+
+			_, _ = i.Put(struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Ttl   *int64 `json:"ttl"`
+			}{Key: "existing", Value: "fresh"})
+			close(release)
+			<-i.warmup.done
+			if !i.Ready() {
+				t.Error("Ready() after warmup = false; want true")
+			}
+
+			got := map[string]string{}
+			i.Range(func(key string, value string, expiresAt *time.Time) bool {
+				got[key] = value
+				return true
+			})
+			if !maps.Equal(got, tt.expected) {
+				t.Errorf("entries = %v; want %v", got, tt.expected)
+			}
+			if remaining, ok := i.GetTTL("b"); tt.expected["b"] != "" && (!ok || remaining == nil || *remaining != ttl) {
+				t.Errorf("GetTTL(b) = %v, %v; want %v", remaining, ok, ttl)
+			}
+		})
+	}
+
+	t.Run("Shutdown cancels warmup", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithWarmupFetcher(func(ctx context.Context) ([]Entry, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.Shutdown()
+		if !i.Ready() {
+			t.Error("Ready() after shutdown = false; want true")
+		}
+	})
+
+	t.Run("Without a fetcher", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !i.Ready() {
+			t.Error("Ready() = false; want true")
+		}
+	})
+}
+
+// mirrorTargetTestImplementation records the writes applied to it, failing the first failures attempts
+type mirrorTargetTestImplementation struct {
+	mu       sync.Mutex
+	writes   []string
+	failures int
+	block    chan struct{} // When set, writes wait for it to be closed
+}
+
+func (m *mirrorTargetTestImplementation) apply(ctx context.Context, write string) error {
+	if m.block != nil {
+		select {
+		case <-m.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("target unavailable")
+	}
+	m.writes = append(m.writes, write)
+	return nil
+}
+
+func (m *mirrorTargetTestImplementation) Put(ctx context.Context, key string, value string, ttl *int64) error {
+	if ttl == nil {
+		return m.apply(ctx, fmt.Sprintf("PUT %v %v", key, value))
+	}
+	return m.apply(ctx, fmt.Sprintf("PUT %v %v %v", key, value, *ttl))
+}
+
+func (m *mirrorTargetTestImplementation) Delete(ctx context.Context, key string) error {
+	return m.apply(ctx, "DELETE "+key)
+}
+
+func TestInMemoryDatabase_Mirror(t *testing.T) {
+	ttl := int64(30)
+	tests := []struct {
+		name     string
+		failures int
+		expected []string
+		failed   uint64
+	}{
+		{
+			name:     "Writes are applied in order",
+			expected: []string{"PUT a 1", "PUT b 2 30", "PUT a 3", "DELETE b"},
+		},
+		{
+			name:     "Retry failed writes",
+			failures: mirrorAttempts - 1,
+			expected: []string{"PUT a 1", "PUT b 2 30", "PUT a 3", "DELETE b"},
+		},
+		{
+			name:     "Give up on a write",
+			failures: mirrorAttempts,
+			expected: []string{"PUT b 2 30", "PUT a 3", "DELETE b"},
+			failed:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &mirrorTargetTestImplementation{failures: tt.failures}
+			i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithClock(NewManualClock(testClockStart)), WithMirror(target))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range []struct {
+				key   string
+				value string
+				ttl   *int64
+			}{{"a", "1", nil}, {"b", "2", &ttl}, {"a", "3", nil}} {
+				_, _ = i.Put(struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+					Ttl   *int64 `json:"ttl"`
+				}{Key: e.key, Value: e.value, Ttl: e.ttl})
+			}
+			i.Delete("b")
+			i.Shutdown()
+
+			if !slices.Equal(target.writes, tt.expected) {
+				t.Errorf("writes = %q; want %q", target.writes, tt.expected)
+			}
+			stats := i.GetMirrorStats()
+			if !stats.Enabled || stats.Pending != 0 || stats.Failed != tt.failed || stats.Applied != uint64(len(tt.expected)) {
+				t.Errorf("GetMirrorStats() = %+v; want %v applied and %v failed", stats, len(tt.expected), tt.failed)
+			}
+		})
+	}
+
+	t.Run("Lag and remaining ttl", func(t *testing.T) {
+		clock := NewManualClock(testClockStart)
+		target := &mirrorTargetTestImplementation{block: make(chan struct{})}
+		i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithClock(clock), WithMirror(target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = i.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: "a", Value: "1", Ttl: &ttl})
+		clock.Advance(20 * time.Second)
+
+		stats := i.GetMirrorStats()
+		if stats.Pending != 1 || stats.Lag != 20*time.Second {
+			t.Errorf("GetMirrorStats() = %+v; want 1 pending with a lag of %v", stats, 20*time.Second)
+		}
+		close(target.block)
+		i.Shutdown()
+
+		// The write waited 20 seconds in the queue, so the target is given the 10 seconds the key has left
+		if expected := []string{"PUT a 1 10"}; !slices.Equal(target.writes, expected) {
+			t.Errorf("writes = %q; want %q", target.writes, expected)
+		}
+		if stats = i.GetMirrorStats(); stats.Pending != 0 || stats.Lag != 0 {
+			t.Errorf("GetMirrorStats() after catching up = %+v; want nothing pending", stats)
+		}
+	})
+
+	t.Run("Without a target", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.Delete("a")
+		i.Shutdown()
+		if stats := i.GetMirrorStats(); stats.Enabled || stats.Pending != 0 {
+			t.Errorf("GetMirrorStats() = %+v; want disabled", stats)
+		}
+	})
+}
+
+func TestInMemoryDatabase_FailureInjection(t *testing.T) {
+	ttl := int64(60)
+	tests := []struct {
+		name     string
+		f        FailureInjection
+		randN    func(n int64) int64
+		err      error
+		stored   bool
+		ttl      int64         // The remaining ttl read back, if stored
+		minDelay time.Duration // The least time the put should take
+	}{
+		{name: "No faults", stored: true, ttl: 60},
+		{name: "Every write fails", f: FailureInjection{WriteFailureRate: 1}, err: ErrInjectedFailure},
+		{name: "Write under the failure rate fails", f: FailureInjection{WriteFailureRate: 0.5}, randN: func(n int64) int64 { return n/2 - 1 }, err: ErrInjectedFailure},
+		{name: "Write over the failure rate succeeds", f: FailureInjection{WriteFailureRate: 0.5}, randN: func(n int64) int64 { return n / 2 }, stored: true, ttl: 60},
+		{name: "Latency", f: FailureInjection{Latency: 20 * time.Millisecond}, stored: true, ttl: 60, minDelay: 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithClock(NewManualClock(testClockStart)), WithFailureInjection(tt.f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer i.Shutdown()
+			if tt.randN != nil {
+				i.s.randN = tt.randN
+			}
+
+			start := time.Now()
+			_, err = i.Put(struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Ttl   *int64 `json:"ttl"`
+			}{Key: "k", Value: "v", Ttl: &ttl})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Put() = %v; want %v", err, tt.err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDelay {
+				t.Errorf("Put() took %v; want at least %v", elapsed, tt.minDelay)
+			}
+			got, ok := i.GetTTL("k")
+			if ok != tt.stored || (ok && *got != tt.ttl) {
+				t.Errorf("GetTTL() = %v, %v; want %v, %v", got, ok, tt.ttl, tt.stored)
+			}
+		})
+	}
+
+	t.Run("Clock skew", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithClock(NewManualClock(testClockStart)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer i.Shutdown()
+		_, _ = i.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: "k", Value: "v", Ttl: &ttl})
+
+		if err = i.SetFailureInjection(FailureInjection{ClockSkew: 20 * time.Second}); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := i.GetTTL("k"); !ok || *got != 40 {
+			t.Errorf("GetTTL() with a 20s skew = %v, %v; want 40, true", got, ok)
+		}
+		if err = i.SetFailureInjection(FailureInjection{ClockSkew: time.Minute}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := i.Get("k"); ok {
+			t.Error("Get() with a 1m skew found the key; want it expired")
+		}
+		if err = i.SetFailureInjection(FailureInjection{}); err != nil {
+			t.Fatal(err)
+		}
+		if got := i.GetFailureInjection(); got != (FailureInjection{}) {
+			t.Errorf("GetFailureInjection() after turning it off = %+v; want the zero value", got)
+		}
+	})
+
+	for _, f := range []FailureInjection{{WriteFailureRate: 1.5}, {WriteFailureRate: -0.1}, {Latency: -time.Second}} {
+		if _, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithFailureInjection(f)); err == nil {
+			t.Errorf("NewInMemoryDatabase() with %+v = nil error; want an error", f)
+		}
+	}
+}
+
+func TestInMemoryDatabase_PersistenceDir(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+	dir := t.TempDir()
+	i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithPersistenceDir(dir),
+		WithAofPersistence(), WithDatabasePersistence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := i.GetSettings(); s.AofPersistFile != filepath.Join(dir, AofFileName) || s.DatabasePersistFile != filepath.Join(dir, SnapshotFileName) {
+		t.Errorf("persistence files = %v and %v; want them named in %v", s.AofPersistFile, s.DatabasePersistFile, dir)
+	}
+
+	// Every snapshot replaces the current one, and only the last few that were replaced are kept
+	var written []time.Time
+	for n := range snapshotsKept + 2 {
+		i.Put(kv{Key: fmt.Sprintf("k%d", n), Value: "v"})
+		if err = i.writeSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, time.Now().Add(time.Duration(n-10)*time.Minute))
+		if err = os.Chtimes(filepath.Join(dir, SnapshotFileName), written[n], written[n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "snapshot-*.db"))
+	var want []string
+	for _, w := range written[len(written)-1-snapshotsKept : len(written)-1] {
+		want = append(want, filepath.Join(dir, "snapshot-"+w.UTC().Format(snapshotTimeFormat)+".db"))
+	}
+	if !slices.Equal(rotated, want) {
+		t.Errorf("rotated snapshots = %v; want %v", rotated, want)
+	}
+
+	// The current snapshot holds every key, and no temporary files are left behind
+	f, err := os.Open(filepath.Join(dir, SnapshotFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var restored InMemoryDatabase
+	if err = gob.NewDecoder(f).Decode(&restored); err != nil {
+		t.Fatal(err)
+	}
+	if n := restored.database.len(); n != snapshotsKept+2 {
+		t.Errorf("current snapshot has %v keys; want %v", n, snapshotsKept+2)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, ".*")); len(tmp) != 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+
+	// Rotating keeps the current snapshot in place, so failing before the new one is renamed over it loses nothing
+	current := filepath.Join(dir, SnapshotFileName)
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(current, later, later); err != nil {
+		t.Fatal(err)
+	}
+	i.rotateSnapshot()
+	if _, err = os.Stat(current); err != nil {
+		t.Errorf("current snapshot after rotating: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "snapshot-"+later.UTC().Format(snapshotTimeFormat)+".db")); err != nil {
+		t.Errorf("rotated snapshot: %v", err)
+	}
+}
+
+func TestInMemoryDatabase_Shutdown(t *testing.T) {
+	dir := t.TempDir()
+	i, err := NewInMemoryDatabase(WithLogger(slog.New(slog.DiscardHandler)), WithPersistenceDir(dir),
+		WithAofPersistence(), WithDatabasePersistence(), WithDatabasePersistencePeriod(time.Millisecond),
+		WithEviction(1<<40, EvictLRU), WithAutoCompaction(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutdown waits for the background routines to stop
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i.Shutdown()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return once the background routines were stopped")
+	}
+
+	// Once shut down, the persistence routines no longer write snapshots
+	snapshot := filepath.Join(dir, SnapshotFileName)
+	if err = os.Remove(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err = os.Stat(snapshot); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("snapshot was written after shutdown: %v", err)
+	}
+}
+
+func TestInMemoryDatabase_PersistenceAlert(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var alerts []string
+	i, err := NewInMemoryDatabase(
+		WithLogger(slog.New(slog.DiscardHandler)),
+		WithAofPersistence(),
+		WithAofPersistenceFile(filepath.Join(dir, "aof")),
+		WithAofPersistencePeriod(time.Millisecond),
+		WithPersistenceAlert(2, func(kind string, since time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			alerts = append(alerts, kind)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := i.GetPersistenceStats(PersistenceSnapshot); stats.Enabled {
+		t.Errorf("snapshot stats = %+v; want disabled", stats)
+	}
+
+	// The directory of the AOF is removed after startup, so every sync fails. The alert is raised once for the outage.
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	i.persistAof()
+	i.persistAof()
+	mu.Lock()
+	if !slices.Equal(alerts, []string{PersistenceAOF}) {
+		t.Errorf("alerts = %v; want one for the aof", alerts)
+	}
+	mu.Unlock()
+	if stats := i.GetPersistenceStats(PersistenceAOF); !stats.Enabled || stats.Failures < 2 || !stats.LastSuccess.IsZero() {
+		t.Errorf("stats after failing = %+v; want at least 2 failures and no success", stats)
+	}
+
+	// A success ends the outage
+	if err = os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	i.persistAof()
+	if stats := i.GetPersistenceStats(PersistenceAOF); stats.Failures != 0 || stats.LastSuccess.IsZero() {
+		t.Errorf("stats after succeeding = %+v; want no failures and a last success", stats)
+	}
+}
+
+func TestInMemoryDatabase_PersistenceFailurePolicy(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+	dir := t.TempDir()
+	i, err := NewInMemoryDatabase(
+		WithLogger(slog.New(slog.DiscardHandler)),
+		WithPersistenceDir(dir),
+		WithDatabasePersistence(),
+		WithDatabasePersistencePeriod(time.Millisecond),
+		WithPersistenceAlert(2, nil),
+		WithPersistenceFailurePolicy(PersistenceFailureReject),
+		WithMinFreeDisk(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Shutdown()
+	var free atomic.Uint64
+	i.s.diskFree = func(string) (uint64, error) { return free.Load(), nil }
+	if _, err = i.Put(kv{Key: "kept", Value: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshots fail without the minimum free disk space on top of their size, and writes are rejected once they have
+	// failed for the alert periods
+	free.Store(1000)
+	i.persistDatabase()
+	if _, err = i.Put(kv{Key: "key", Value: "a"}); err != nil {
+		t.Errorf("put after the first failure = %v; want nil", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	i.persistDatabase()
+	stats := i.GetPersistenceStats(PersistenceSnapshot)
+	if !stats.Failing || !stats.RejectingWrites || stats.FreeDiskBytes != 1000 {
+		t.Errorf("stats after failing = %+v; want failing, rejecting writes and 1000 bytes free", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dir, SnapshotFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("snapshot written without enough free disk space: %v", err)
+	}
+
+	_, err = i.Put(kv{Key: "key", Value: "b"})
+	var failed *PersistenceFailedError
+	if !errors.As(err, &failed) || failed.Kind != PersistenceSnapshot || !errors.Is(failed.Err, ErrInsufficientDiskSpace) || !errors.Is(err, ErrPersistenceFailed) {
+		t.Errorf("put while failing = %v; want a *PersistenceFailedError for the snapshot", err)
+	}
+	if _, _, err = i.Create(kv{Value: "c"}); !errors.Is(err, ErrPersistenceFailed) {
+		t.Errorf("create while failing = %v; want ErrPersistenceFailed", err)
+	}
+	if _, err = i.ExpirePrefix("kept", 10); !errors.Is(err, ErrPersistenceFailed) {
+		t.Errorf("expire prefix while failing = %v; want ErrPersistenceFailed", err)
+	}
+	if !i.Delete("kept") {
+		t.Error("delete while failing was not applied")
+	}
+	if stats = i.GetPersistenceStats(PersistenceSnapshot); stats.FailedWrites != 3 {
+		t.Errorf("failed writes = %v; want 3", stats.FailedWrites)
+	}
+
+	// A success accepts writes again
+	free.Store(1 << 20)
+	i.persistDatabase()
+	if stats = i.GetPersistenceStats(PersistenceSnapshot); stats.Failing || stats.RejectingWrites {
+		t.Errorf("stats after succeeding = %+v; want neither failing nor rejecting writes", stats)
+	}
+	if _, err = i.Put(kv{Key: "key", Value: "d"}); err != nil {
+		t.Errorf("put after succeeding = %v; want nil", err)
+	}
+}
+
+func TestInMemoryDatabase_WriteStallPolicy(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+	logger := WithLogger(slog.New(slog.DiscardHandler))
+
+	t.Run("block", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.lockForPersistence(PersistenceSnapshot)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, err := i.Put(kv{Key: "key", Value: "a"}); err != nil {
+				t.Errorf("put: %v", err)
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+		i.unlockForPersistence()
+		<-done
+
+		stats := i.GetPersistenceStats(PersistenceSnapshot)
+		if stats.StalledWrites != 1 || stats.StallTime < 20*time.Millisecond {
+			t.Errorf("stats = %+v; want one write stalled for at least 20ms", stats)
+		}
+		if value, _ := i.Get("key"); value != "a" {
+			t.Errorf("value = %q; want a", value)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		i, err := NewInMemoryDatabase(logger, WithWriteStallPolicy(WriteStallFail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.lockForPersistence(PersistenceSnapshot)
+		_, err = i.Put(kv{Key: "key", Value: "a"})
+		var stallErr *WriteStallError
+		if !errors.As(err, &stallErr) || !errors.Is(err, ErrWriteStalled) || stallErr.RetryAfter() < time.Second {
+			t.Errorf("put err = %v; want a *WriteStallError retrying after at least a second", err)
+		}
+		if _, err = i.Upsert("key", func(string, bool) (string, error) { return "a", nil }); !errors.Is(err, ErrWriteStalled) {
+			t.Errorf("upsert err = %v; want ErrWriteStalled", err)
+		}
+		i.unlockForPersistence()
+
+		if stats := i.GetPersistenceStats(PersistenceSnapshot); stats.RejectedWrites != 2 || stats.StalledWrites != 0 {
+			t.Errorf("stats = %+v; want two rejected writes", stats)
+		}
+		if _, err = i.Put(kv{Key: "key", Value: "a"}); err != nil {
+			t.Errorf("put after the snapshot: %v", err)
+		}
+	})
+
+	t.Run("buffer", func(t *testing.T) {
+		aof := filepath.Join(t.TempDir(), "aof")
+		i, err := NewInMemoryDatabase(logger, WithAofPersistence(), WithAofPersistenceFile(aof),
+			WithWriteStallPolicy(WriteStallBuffer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ttl := int64(100)
+		i.Put(kv{Key: "old", Value: "a"})
+
+		// Buffered puts report whether the key existed, counting earlier buffered puts
+		i.lockForPersistence(PersistenceSnapshot)
+		for _, tt := range []struct {
+			data    kv
+			existed bool
+		}{
+			{kv{Key: "old", Value: "b"}, true},
+			{kv{Key: "new", Value: "a", Ttl: &ttl}, false},
+			{kv{Key: "new", Value: "b", Ttl: &ttl}, true},
+		} {
+			existed, err := i.Put(tt.data)
+			if err != nil || existed != tt.existed {
+				t.Errorf("put %v = %v, %v; want %v", tt.data.Key, existed, err, tt.existed)
+			}
+		}
+		if _, err = os.Stat(aof); err != nil {
+			t.Errorf("buffered puts were not appended to the aof: %v", err)
+		}
+		i.unlockForPersistence()
+
+		if stats := i.GetPersistenceStats(PersistenceSnapshot); stats.BufferedWrites != 3 || stats.StalledWrites != 0 {
+			t.Errorf("stats = %+v; want three buffered writes", stats)
+		}
+		for key, want := range map[string]string{"old": "b", "new": "b"} {
+			if entry, _ := i.GetEntry(key); entry.Value != want {
+				t.Errorf("value of %v = %q; want %q", key, entry.Value, want)
+			}
+		}
+		if entry, _ := i.GetEntry("new"); entry.Version != 4 {
+			t.Errorf("version of new = %v; want 4", entry.Version)
+		}
+		if ttl, _ := i.GetTTL("new"); ttl == nil || *ttl != 100 {
+			t.Errorf("ttl of new = %v; want 100", ttl)
+		}
+
+		// Every put was appended once, so replaying the AOF restores the same database
+		b, err := os.ReadFile(aof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(b), "\n"); lines != 4 {
+			t.Errorf("aof has %v lines; want 4", lines)
+		}
+		replayed, err := NewInMemoryDatabase(logger, WithInitialData(aof, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"old", "new"} {
+			want, _ := i.GetEntry(key)
+			if got, _ := replayed.GetEntry(key); got.Value != want.Value || got.Version != want.Version {
+				t.Errorf("replayed %v = %+v; want %+v", key, got, want)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := NewInMemoryDatabase(logger, WithWriteStallPolicy("queue")); err == nil {
+			t.Errorf("an unknown policy was accepted")
+		}
+		_, err := NewInMemoryDatabase(logger, WithWriteStallPolicy(WriteStallBuffer),
+			WithNamespaceQuota("tenant", NamespaceQuota{MaxKeys: 1}))
+		if err == nil {
+			t.Errorf("the buffer policy was accepted with a namespace quota")
+		}
+	})
+}
+
+func TestInMemoryDatabase_ReadChanges(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	if _, err := NewInMemoryDatabase(WithChangeLog(-1)); err == nil {
+		t.Errorf("expected an error for a negative change log size")
+	}
+
+	i, err := NewInMemoryDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = i.ReadChanges(0, 10); !errors.Is(err, ErrChangeFeedDisabled) {
+		t.Errorf("expected the change feed to be disabled, got %v", err)
+	}
+
+	clock := NewManualClock(testClockStart)
+	i, err = NewInMemoryDatabase(WithClock(clock), WithChangeLog(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := int64(5)
+	i.Put(kv{Key: "a", Value: "1"})
+	i.Put(kv{Key: "b", Value: "2", Ttl: &ttl})
+	i.Delete("a")
+
+	changes, wake, err := i.ReadChanges(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(changes))
+	for _, c := range changes {
+		got = append(got, fmt.Sprintf("%d %s %s %s", c.Seq, c.Op, c.Key, c.Value))
+	}
+	if want := []string{"1 put a 1", "2 put b 2", "3 delete a "}; !slices.Equal(got, want) {
+		t.Errorf("changes = %q; want %q", got, want)
+	}
+	if want := clock.Now().Unix() + ttl; changes[1].ExpiresAt != want {
+		t.Errorf("expiresAt = %v; want %v", changes[1].ExpiresAt, want)
+	}
+
+	// Consumers resume after the last sequence number they read, and are woken by the next change
+	if changes, _, _ = i.ReadChanges(2, 10); len(changes) != 1 || changes[0].Seq != 3 {
+		t.Errorf("changes after 2 = %+v; want only 3", changes)
+	}
+	if changes, _, _ = i.ReadChanges(3, 10); len(changes) != 0 {
+		t.Errorf("changes after 3 = %+v; want none", changes)
+	}
+	select {
+	case <-wake:
+		t.Fatal("expected wake to stay open until the next change")
+	default:
+	}
+
+	// Expirations are deletes, and evict the oldest change from the full log
+	clock.Advance(time.Duration(ttl) * time.Second)
+	i.removeExpired()
+	select {
+	case <-wake:
+	default:
+		t.Fatal("expected wake to be closed by the expiration")
+	}
+	if changes, _, _ = i.ReadChanges(3, 10); len(changes) != 1 || changes[0].Op != ChangeDelete || changes[0].Key != "b" {
+		t.Errorf("changes after 3 = %+v; want the expiration of b", changes)
+	}
+
+	_, _, err = i.ReadChanges(0, 10)
+	var feedErr *ChangeFeedError
+	if !errors.As(err, &feedErr) || !feedErr.Truncated() || feedErr.Floor != 1 {
+		t.Errorf("expected changes after 0 to be truncated at 1, got %v", err)
+	}
+	if changes, _, _ = i.ReadChanges(1, 1); len(changes) != 1 || changes[0].Seq != 2 {
+		t.Errorf("changes after 1 = %+v; want 2 within the limit", changes)
+	}
+}
+
+func TestInMemoryDatabase_Search(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+
+	i, err := NewInMemoryDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := i.Search("a", "", 10); ok {
+		t.Errorf("expected search to be disabled without an index")
+	}
+
+	clock := NewManualClock(testClockStart)
+	i, err = NewInMemoryDatabase(WithClock(clock), WithSearchIndex(), WithCompression(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := int64(5)
+	i.Put(kv{Key: "user:1", Value: `{"name":"Ada Lovelace","role":"engineer"}`})
+	i.Put(kv{Key: "user:2", Value: `{"name":"Grace Hopper","role":"admiral, engineer and engineer again"}`})
+	i.Put(kv{Key: "doc:1", Value: "Notes on the analytical engine by Ada"})
+	i.Put(kv{Key: "tmp", Value: "ada", Ttl: &ttl})
+
+	keys := func(results []searchResult) []string {
+		var keys []string
+		for _, r := range results {
+			keys = append(keys, r.Key)
+		}
+		return keys
+	}
+	tests := []struct {
+		name   string
+		query  string
+		prefix string
+		limit  int
+		want   []string
+	}{
+		{name: "Terms are case insensitive", query: "ADA", limit: 10, want: []string{"tmp", "user:1", "doc:1"}},
+		{name: "Repeated terms rank higher", query: "engineer", limit: 10, want: []string{"user:2", "user:1"}},
+		{name: "Keys matching more terms rank higher", query: "ada engineer", limit: 10, want: []string{"user:1", "user:2", "tmp", "doc:1"}},
+		{name: "Prefix", query: "ada", prefix: "user:", limit: 10, want: []string{"user:1"}},
+		{name: "Limit", query: "ada", limit: 1, want: []string{"tmp"}},
+		{name: "No match", query: "babbage", limit: 10, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, ok := i.Search(tt.query, tt.prefix, tt.limit)
+			if !ok {
+				t.Fatal("expected search to be enabled")
+			}
+			if got := keys(results); !slices.Equal(got, tt.want) {
+				t.Errorf("Search(%q) = %v; want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+
+	// Overwrites and deletes update the index, and ttl changes keep it
+	i.Put(kv{Key: "doc:1", Value: "Notes on the difference engine"})
+	i.Delete("user:1")
+	i.ExpirePrefix("user:", 100)
+	clock.Advance(time.Duration(ttl) * time.Second)
+	if results, _ := i.Search("ada engineer", "", 10); !slices.Equal(keys(results), []string{"user:2"}) {
+		t.Errorf("results after writes = %v; want only user:2", keys(results))
+	}
+	if results, _ := i.Search("difference", "", 10); !slices.Equal(keys(results), []string{"doc:1"}) {
+		t.Errorf("results for the overwritten value = %v; want doc:1", keys(results))
+	}
+}
+
+func TestInMemoryDatabase_GetTTLHistogram(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+	ttl := func(seconds int64) *int64 { return &seconds }
+
+	clock := NewManualClock(testClockStart)
+	i, err := NewInMemoryDatabase(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Put(kv{Key: "persistent", Value: "1"})
+	i.Put(kv{Key: "soon", Value: "1", Ttl: ttl(30)})
+	i.Put(kv{Key: "hour", Value: "1", Ttl: ttl(1800)})
+	i.Put(kv{Key: "later", Value: "1", Ttl: ttl(100_000)})
+	i.Put(kv{Key: "changed", Value: "1", Ttl: ttl(10)})
+	i.Put(kv{Key: "changed", Value: "12", Ttl: ttl(3000)})
+	i.Put(kv{Key: "hour", Value: "1", Ttl: ttl(1800)})
+
+	histogram := i.GetTTLHistogram([]time.Duration{time.Minute, time.Hour, 24 * time.Hour})
+	want := []ttlBucket{
+		{Within: time.Minute, Keys: 1, Bytes: 5},
+		{Within: time.Hour, Keys: 3, Bytes: 5 + 5 + 9},
+		{Within: 24 * time.Hour, Keys: 3, Bytes: 5 + 5 + 9},
+	}
+	if !slices.Equal(histogram.Buckets, want) {
+		t.Errorf("buckets = %+v; want %+v", histogram.Buckets, want)
+	}
+	if histogram.Total.Keys != 4 || histogram.Total.Bytes != 5+5+9+6 {
+		t.Errorf("total = %+v; want 4 keys of 25 bytes", histogram.Total)
+	}
+}
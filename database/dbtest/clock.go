@@ -0,0 +1,17 @@
+package dbtest
+
+import (
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+// Clock is a database.Clock whose time only moves when a test moves it with Advance or Set, so that ttls can be
+// tested without sleeping. Pass it to New with database.WithClock, and with database.WithManualTTLCleanup to decide
+// when expired keys are removed by calling StepTTLCleaner. The zero value is not usable; create one with NewClock.
+type Clock = database.ManualClock
+
+// NewClock returns a clock that stands at start
+func NewClock(start time.Time) *Clock {
+	return database.NewManualClock(start)
+}
@@ -0,0 +1,254 @@
+// Package dbtest provides a database double for testing code built on the handler, such as embedded servers,
+// middleware and clients, without each test re-implementing the database interface.
+//
+// The Fake is backed by a real InMemoryDatabase without persistence, so reads, writes, ttls, leases, scans and events
+// behave exactly as they do in a server. On top of that, operations can be slowed down, made to fail and counted.
+// Operations are named after the methods of the database, e.g. "Put" or "GetEntry".
+package dbtest
+
+import (
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+// Fake is an in-memory database with controls for injecting latency and failures. It satisfies the database
+// interface that handler.NewHandler requires. The zero value is not usable; create one with New.
+type Fake struct {
+	*database.InMemoryDatabase
+
+	mu       sync.Mutex
+	latency  map[string]time.Duration // Added before the operation runs
+	failures map[string]error         // Returned instead of running the operation
+	calls    map[string]int           // How many times each operation was called
+	notReady bool                     // Whether Ready reports false regardless of the database
+}
+
+// New returns an empty Fake that is shut down when the test finishes. Options are applied to the underlying database
+// after a logger that discards its output, so a test can pass its own logger, clock or limits.
+func New(t testing.TB, opts ...database.Options) *Fake {
+	t.Helper()
+	db, err := database.NewInMemoryDatabase(append([]database.Options{database.WithLogger(slog.New(slog.DiscardHandler))}, opts...)...)
+	if err != nil {
+		t.Fatalf("error creating the fake database: %v", err)
+	}
+	t.Cleanup(db.Shutdown)
+	return &Fake{
+		InMemoryDatabase: db,
+		latency:          map[string]time.Duration{},
+		failures:         map[string]error{},
+		calls:            map[string]int{},
+	}
+}
+
+// SetLatency delays every later call of the operation by d. Zero removes the delay.
+func (f *Fake) SetLatency(op string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency[op] = d
+}
+
+// FailWith makes every later call of the operation return err without touching the database. Only operations that
+// return an error can fail: Create, Put, PutLeased, Update, Touch and RestoreVersion. A nil error makes the operation
+// succeed again.
+func (f *Fake) FailWith(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = err
+}
+
+// SetReady overrides whether the database reports being ready, e.g. to test how a client handles a server that is
+// still warming up
+func (f *Fake) SetReady(ready bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notReady = !ready
+}
+
+// Calls returns how many times the operation has been called, including calls that failed
+func (f *Fake) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// call counts a call of the operation, waits out its latency and returns the error it should fail with, if any
+func (f *Fake) call(op string) error {
+	f.mu.Lock()
+	f.calls[op]++
+	d, err := f.latency[op], f.failures[op]
+	f.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return err
+}
+
+func (f *Fake) Create(data struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Ttl   *int64 `json:"ttl"`
+}) (bool, string, error) {
+	if err := f.call("Create"); err != nil {
+		return false, "", err
+	}
+	return f.InMemoryDatabase.Create(data)
+}
+
+func (f *Fake) GetEntry(key string) (struct {
+	Value     string
+	UpdatedAt time.Time
+	Version   uint64
+}, bool) {
+	_ = f.call("GetEntry")
+	return f.InMemoryDatabase.GetEntry(key)
+}
+
+func (f *Fake) Put(data struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Ttl   *int64 `json:"ttl"`
+}) (bool, error) {
+	if err := f.call("Put"); err != nil {
+		return false, err
+	}
+	return f.InMemoryDatabase.Put(data)
+}
+
+func (f *Fake) PutLeased(key string, value string, name string, id string) (bool, bool, error) {
+	if err := f.call("PutLeased"); err != nil {
+		return false, false, err
+	}
+	return f.InMemoryDatabase.PutLeased(key, value, name, id)
+}
+
+func (f *Fake) AcquireLease(name string, ttl int64) (string, bool) {
+	_ = f.call("AcquireLease")
+	return f.InMemoryDatabase.AcquireLease(name, ttl)
+}
+
+func (f *Fake) RenewLease(name string, id string) bool {
+	_ = f.call("RenewLease")
+	return f.InMemoryDatabase.RenewLease(name, id)
+}
+
+func (f *Fake) ReleaseLease(name string, id string) (int, bool) {
+	_ = f.call("ReleaseLease")
+	return f.InMemoryDatabase.ReleaseLease(name, id)
+}
+
+func (f *Fake) Update(key string, fn func(value string) (string, error)) (bool, error) {
+	if err := f.call("Update"); err != nil {
+		return false, err
+	}
+	return f.InMemoryDatabase.Update(key, fn)
+}
+
+func (f *Fake) Delete(key string) bool {
+	_ = f.call("Delete")
+	return f.InMemoryDatabase.Delete(key)
+}
+
+func (f *Fake) DeleteIf(key string, cond func(value string, version uint64) bool) (bool, bool) {
+	_ = f.call("DeleteIf")
+	return f.InMemoryDatabase.DeleteIf(key, cond)
+}
+
+func (f *Fake) ExpirePrefix(prefix string, ttl int64) (int, error) {
+	if err := f.call("ExpirePrefix"); err != nil {
+		return 0, err
+	}
+	return f.InMemoryDatabase.ExpirePrefix(prefix, ttl)
+}
+
+func (f *Fake) Touch(key string, ttl int64) (bool, error) {
+	if err := f.call("Touch"); err != nil {
+		return false, err
+	}
+	return f.InMemoryDatabase.Touch(key, ttl)
+}
+
+func (f *Fake) History(key string) ([]struct {
+	Version   uint64
+	Value     string
+	ExpiresAt int64
+	Time      time.Time
+}, bool) {
+	_ = f.call("History")
+	return f.InMemoryDatabase.History(key)
+}
+
+func (f *Fake) KeyStats(key string) (struct {
+	Hits       uint64
+	Updates    uint64
+	LastAccess time.Time
+	Size       int
+}, bool, bool) {
+	_ = f.call("KeyStats")
+	return f.InMemoryDatabase.KeyStats(key)
+}
+
+func (f *Fake) Compact() struct {
+	Keys      int
+	Reclaimed uint64
+	Duration  time.Duration
+} {
+	_ = f.call("Compact")
+	return f.InMemoryDatabase.Compact()
+}
+
+func (f *Fake) RestoreVersion(key string, version uint64) (bool, bool, error) {
+	if err := f.call("RestoreVersion"); err != nil {
+		return false, false, err
+	}
+	return f.InMemoryDatabase.RestoreVersion(key, version)
+}
+
+func (f *Fake) Scan(prefix string, cursor string, limit int) ([]string, string) {
+	_ = f.call("Scan")
+	return f.InMemoryDatabase.Scan(prefix, cursor, limit)
+}
+
+func (f *Fake) ScanEntries(prefix string, cursor string, limit int) ([]struct {
+	Key   string
+	Value string
+	Ttl   *int64
+}, string) {
+	_ = f.call("ScanEntries")
+	return f.InMemoryDatabase.ScanEntries(prefix, cursor, limit)
+}
+
+func (f *Fake) GetTTL(key string) (*int64, bool) {
+	_ = f.call("GetTTL")
+	return f.InMemoryDatabase.GetTTL(key)
+}
+
+func (f *Fake) SubscribeEvents(prefix string) (<-chan struct {
+	Type string
+	Key  string
+	Time time.Time
+}, func()) {
+	_ = f.call("SubscribeEvents")
+	return f.InMemoryDatabase.SubscribeEvents(prefix)
+}
+
+func (f *Fake) GetInfo() struct {
+	Keys   int
+	Seq    uint64
+	NodeID string
+} {
+	_ = f.call("GetInfo")
+	return f.InMemoryDatabase.GetInfo()
+}
+
+func (f *Fake) Ready() bool {
+	_ = f.call("Ready")
+	f.mu.Lock()
+	notReady := f.notReady
+	f.mu.Unlock()
+	return !notReady && f.InMemoryDatabase.Ready()
+}
@@ -0,0 +1,159 @@
+package dbtest_test
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+	"github.com/pthav/InMemoryDB/database/dbtest"
+	"github.com/pthav/InMemoryDB/handler"
+)
+
+func TestFake(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(f *dbtest.Fake)
+		method  string
+		path    string
+		body    string
+		status  int
+		minTime time.Duration // The least time the request should take
+	}{
+		{name: "Put", method: "PUT", path: "/v1/keys/k", body: `{"value":"v"}`, status: http.StatusCreated},
+		{name: "Get", setup: putKey, method: "GET", path: "/v1/keys/k", status: http.StatusOK},
+		{name: "Get a missing key", method: "GET", path: "/v1/keys/k", status: http.StatusNotFound},
+		{name: "Delete", setup: putKey, method: "DELETE", path: "/v1/keys/k", status: http.StatusOK},
+		{
+			name:   "Injected failure",
+			setup:  func(f *dbtest.Fake) { f.FailWith("Put", errors.New("disk full")) },
+			method: "PUT", path: "/v1/keys/k", body: `{"value":"v"}`, status: http.StatusInternalServerError,
+		},
+		{
+			name: "Cleared failure",
+			setup: func(f *dbtest.Fake) {
+				f.FailWith("Put", errors.New("disk full"))
+				f.FailWith("Put", nil)
+			},
+			method: "PUT", path: "/v1/keys/k", body: `{"value":"v"}`, status: http.StatusCreated,
+		},
+		{
+			name:   "Injected latency",
+			setup:  func(f *dbtest.Fake) { f.SetLatency("GetEntry", 50*time.Millisecond) },
+			method: "GET", path: "/v1/keys/k", status: http.StatusNotFound, minTime: 50 * time.Millisecond,
+		},
+		{
+			name:   "Not ready",
+			setup:  func(f *dbtest.Fake) { f.SetReady(false) },
+			method: "GET", path: "/readyz", status: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := dbtest.New(t)
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			h := handler.NewHandler(f, slog.New(slog.DiscardHandler))
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.body != "" {
+				r.Header.Set("Content-Type", "application/json")
+			}
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v: %v", w.Code, tt.status, w.Body)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minTime {
+				t.Errorf("request took %v; want at least %v", elapsed, tt.minTime)
+			}
+		})
+	}
+}
+
+func TestFake_Calls(t *testing.T) {
+	f := dbtest.New(t)
+	f.FailWith("Create", errors.New("unavailable"))
+	for range 3 {
+		_, _, _ = f.Create(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: "k", Value: "v"})
+	}
+	if got := f.Calls("Create"); got != 3 {
+		t.Errorf("Calls(Create) = %v; want 3", got)
+	}
+	if _, ok := f.Get("k"); ok {
+		t.Error("failed creates stored the key")
+	}
+}
+
+// putKey stores k so that reads find it
+func putKey(f *dbtest.Fake) {
+	_, _ = f.Put(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: "k", Value: "v"})
+}
+
+func TestClock(t *testing.T) {
+	type kv = struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}
+	ttl := int64(10)
+
+	// With manual cleanup the test decides when expired keys are removed
+	clock := dbtest.NewClock(time.Unix(1_000_000_000, 0))
+	f := dbtest.New(t, database.WithClock(clock), database.WithManualTTLCleanup())
+	h := handler.NewHandler(f, slog.New(slog.DiscardHandler))
+	_, _ = f.Put(kv{Key: "k", Value: "v", Ttl: &ttl})
+
+	clock.Advance(4 * time.Second)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/ttl/k", nil))
+	if !strings.Contains(w.Body.String(), `"ttl":6`) {
+		t.Errorf("ttl after 4s = %v; want 6", w.Body.String())
+	}
+	clock.Advance(6 * time.Second)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/keys/k", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("response code for an expired key = %v; want %v", w.Code, http.StatusNotFound)
+	}
+	if removed := f.StepTTLCleaner(); len(removed) != 1 || removed[0] != "k" {
+		t.Errorf("StepTTLCleaner() = %v; want [k]", removed)
+	}
+
+	// The background cleaner wakes up when the clock passes a ttl. The clock keeps moving in case the cleaner read it
+	// just before it was advanced and set its timer after.
+	clock = dbtest.NewClock(time.Unix(1_000_000_000, 0))
+	f = dbtest.New(t, database.WithClock(clock))
+	events, unsubscribe := f.SubscribeEvents("")
+	defer unsubscribe()
+	_, _ = f.Put(kv{Key: "k", Value: "v", Ttl: &ttl})
+	<-events
+	timeout := time.After(5 * time.Second)
+	for {
+		clock.Advance(time.Minute)
+		select {
+		case e := <-events:
+			if e.Type != database.EventExpired {
+				t.Errorf("event = %+v; want an expiry", e)
+			}
+			return
+		case <-timeout:
+			t.Fatal("the cleaner did not remove the key once the clock passed its ttl")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package database
+
+import "errors"
+
+// freeDiskSpace is not supported outside of unix, so free disk space is not checked
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package database
+
+import "syscall"
+
+// freeDiskSpace returns the bytes available to the process on the file system of dir
+func freeDiskSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
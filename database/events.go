@@ -0,0 +1,91 @@
+package database
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key event types
+const (
+	EventCreated = "created" // A key that did not exist was written
+	EventUpdated = "updated" // An existing key was overwritten or given a new ttl
+	EventDeleted = "deleted" // A key was deleted
+	EventExpired = "expired" // A key was removed by the ttl cleaner
+	EventEvicted = "evicted" // A key was removed to free memory, see WithEviction
+)
+
+// DefaultEventBuffer is the number of events buffered for each subscriber before further events are dropped
+const DefaultEventBuffer = 256
+
+// keyEvent describes a change to a key. It is an alias of an unnamed struct so that packages consuming events, like
+// the handler, can describe it without importing this package.
+type keyEvent = struct {
+	Type string    // One of the Event types
+	Key  string    // The key that changed
+	Time time.Time // When the change happened
+}
+
+// eventSubscriber receives the events for keys with its prefix
+type eventSubscriber struct {
+	prefix  string
+	ch      chan keyEvent
+	dropped int // Events not delivered because the subscriber was too slow. Guarded by the notifier's mutex.
+}
+
+// notifier fans key events out to subscribers. Events are sent without blocking so that a slow subscriber can never
+// hold up a write, and are dropped for that subscriber instead.
+type notifier struct {
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+// SubscribeEvents returns a channel of events for keys with the prefix, or every key when the prefix is empty, and a
+// function that unsubscribes and closes the channel. Events are buffered, and events for a subscriber that falls more
+// than DefaultEventBuffer events behind are dropped. Loading the startup files does not produce events.
+func (i *InMemoryDatabase) SubscribeEvents(prefix string) (<-chan keyEvent, func()) {
+	sub := &eventSubscriber{prefix: prefix, ch: make(chan keyEvent, DefaultEventBuffer)}
+
+	n := &i.events
+	n.mu.Lock()
+	if n.subscribers == nil {
+		n.subscribers = map[*eventSubscriber]struct{}{}
+	}
+	n.subscribers[sub] = struct{}{}
+	n.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			delete(n.subscribers, sub)
+			close(sub.ch)
+			if sub.dropped > 0 {
+				i.s.logger.Warn("dropped key events for a slow subscriber", "prefix", sub.prefix, "dropped", sub.dropped)
+			}
+		})
+	}
+}
+
+// notify sends an event to every subscriber whose prefix matches the key
+func (i *InMemoryDatabase) notify(eventType string, key string) {
+	n := &i.events
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.subscribers) == 0 {
+		return
+	}
+
+	e := keyEvent{Type: eventType, Key: key, Time: i.s.clock.Now()}
+	for sub := range n.subscribers {
+		if !strings.HasPrefix(key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			sub.dropped++
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"cmp"
+	"container/heap"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The supported eviction policies, which pick the keys evicted under memory pressure
+const (
+	EvictVolatileTTL = "volatile-ttl" // Keys with a ttl, the soonest to expire first. Keys without a ttl are kept.
+	EvictLRU         = "lru"          // Any key, approximately the least recently read or written first
+)
+
+// DefaultEvictionInterval is how often the memory usage is checked for pressure
+const DefaultEvictionInterval = time.Second
+
+// evictionTarget is the fraction of the memory limit that eviction frees memory down to, so that it does not run
+// again as soon as a few more keys are written
+const evictionTarget = 0.9
+
+// entryOverhead estimates the memory an entry takes on top of its key and value, for the map slot, the entry and the
+// string headers
+const entryOverhead = 96
+
+// lruSamples is how many keys are compared for each LRU eviction. Like Redis, sampling approximates LRU without
+// keeping the keys in order on every read.
+const lruSamples = 5
+
+// heapObjectsMetric is the runtime metric for the memory held by heap objects, including dead ones not yet swept
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// evictor evicts keys while the memory usage is over the limit
+type evictor struct {
+	mu     sync.Mutex       // Guards access, which is updated by reads that do not hold the database mutex
+	access map[string]int64 // The tick of the last read or write of every key for LRU. Nil for other policies.
+	tick   int64            // Advanced on every access so that a larger tick is more recent
+}
+
+// WithEviction evicts keys once the heap grows over limit bytes, as picked by the policy, to avoid being killed for
+// running out of memory in a constrained container. A limit of zero uses the soft memory limit of the Go runtime, set
+// with GOMEMLIMIT. Every key evicted is deleted like an expired key, including from the AOF, and emits an evicted event.
+// Memory is checked every second, and each time the limit is exceeded keys are evicted until about 90% of it is used.
+// The lru policy tracks every read, which slows reads down a little.
+func WithEviction(limit int64, policy string) Options {
+	return func(db *InMemoryDatabase) error {
+		if policy != EvictVolatileTTL && policy != EvictLRU {
+			return fmt.Errorf("unknown eviction policy %q", policy)
+		}
+		if limit < 0 {
+			return fmt.Errorf("memory limit must not be negative, got %d", limit)
+		}
+		if limit == 0 {
+			// A negative limit reads the soft memory limit without changing it
+			if limit = debug.SetMemoryLimit(-1); limit == math.MaxInt64 {
+				return errors.New("eviction needs a memory limit, either given or set with GOMEMLIMIT")
+			}
+		}
+		db.s.MemoryLimit = limit
+		db.s.EvictionPolicy = policy
+		return nil
+	}
+}
+
+// heapObjects returns the memory held by heap objects
+func heapObjects() uint64 {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// startEviction starts checking for memory pressure once the startup files are loaded
+func (i *InMemoryDatabase) startEviction() {
+	if i.s.EvictionPolicy == "" {
+		return
+	}
+	if i.s.EvictionPolicy == EvictLRU {
+		// The loaded keys are ordered by when they were last written, as they have not been read yet
+		entries := i.database.entries()
+		keys := slices.SortedFunc(maps.Keys(entries), func(a, b string) int {
+			return cmp.Compare(entries[a].updatedAt, entries[b].updatedAt)
+		})
+		i.evictor.access = make(map[string]int64, len(keys))
+		for _, key := range keys {
+			i.evictor.tick++
+			i.evictor.access[key] = i.evictor.tick
+		}
+	}
+	// Eviction is stopped on shutdown like persistence, so that the database is not kept reachable once it is closed
+	i.goPersist("eviction", func() {
+		for {
+			select {
+			case <-i.stopping.Done():
+				return
+			case <-time.After(DefaultEvictionInterval):
+			}
+			i.relieveMemoryPressure()
+		}
+	})
+}
+
+// recordAccess marks the key as the most recently used for LRU eviction
+func (i *InMemoryDatabase) recordAccess(key string) {
+	if i.evictor.access == nil {
+		return
+	}
+	i.evictor.mu.Lock()
+	defer i.evictor.mu.Unlock()
+	i.evictor.tick++
+	i.evictor.access[key] = i.evictor.tick
+}
+
+// forgetAccess stops tracking the use of a deleted key
+func (i *InMemoryDatabase) forgetAccess(key string) {
+	if i.evictor.access == nil {
+		return
+	}
+	i.evictor.mu.Lock()
+	defer i.evictor.mu.Unlock()
+	delete(i.evictor.access, key)
+}
+
+// relieveMemoryPressure evicts keys if the memory usage is over the limit, returning how many were evicted. Garbage
+// is collected first, so that dead objects are not mistaken for pressure, and after evicting, so that the next check
+// sees the memory that was freed.
+func (i *InMemoryDatabase) relieveMemoryPressure() int {
+	used := i.s.memoryUsage()
+	if used <= uint64(i.s.MemoryLimit) {
+		return 0
+	}
+	runtime.GC()
+	if used = i.s.memoryUsage(); used <= uint64(i.s.MemoryLimit) {
+		return 0
+	}
+
+	evicted := i.evict(int64(used) - int64(float64(i.s.MemoryLimit)*evictionTarget))
+	runtime.GC()
+	i.s.logger.Warn("evicted keys under memory pressure", "evicted", evicted, "used", used, "limit", i.s.MemoryLimit,
+		"policy", i.s.EvictionPolicy)
+	return evicted
+}
+
+// evict evicts keys picked by the eviction policy until their estimated size adds up to excess bytes or there are no
+// more keys to evict, returning how many were evicted
+func (i *InMemoryDatabase) evict(excess int64) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	evicted := 0
+	for excess > 0 {
+		key, ok := i.nextEviction()
+		if !ok {
+			break
+		}
+		dbEntry, _ := i.load(key)
+		excess -= int64(len(key) + len(dbEntry.value) + entryOverhead)
+
+		i.aofDelete(key)
+		i.delete(key)
+		i.notify(EventEvicted, key)
+		evicted++
+	}
+	return evicted
+}
+
+// nextEviction returns the key that the eviction policy evicts next, or false if there is none. The database mutex
+// must be held.
+func (i *InMemoryDatabase) nextEviction() (string, bool) {
+	if i.s.EvictionPolicy == EvictVolatileTTL {
+		for len(*i.ttl) > 0 {
+			// Heap items whose key was deleted or given another ttl are stale and dropped like the ttl cleaner does
+			heapData := heap.Pop(i.ttl).(ttlHeapData)
+			if dbEntry, loaded := i.load(heapData.key); loaded && dbEntry.expiresAt == heapData.ttl {
+				return heapData.key, true
+			}
+		}
+		return "", false
+	}
+
+	i.evictor.mu.Lock()
+	defer i.evictor.mu.Unlock()
+	var oldest string
+	var oldestTick int64
+	samples := 0
+	// Map iteration starts at a random key, which samples the keys
+	for key, tick := range i.evictor.access {
+		if samples == 0 || tick < oldestTick {
+			oldest, oldestTick = key, tick
+		}
+		if samples++; samples == lruSamples {
+			break
+		}
+	}
+	return oldest, samples > 0
+}
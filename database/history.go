@@ -0,0 +1,126 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// keyVersion is a version of a key in its history. Like change, it is an alias of an unnamed struct so that the
+// handler can describe it without importing this package.
+type keyVersion = struct {
+	Version   uint64    // The sequence number of the write, which is also the version of the entry it wrote
+	Value     string    // The written value
+	ExpiresAt int64     // Unix seconds at which the written key expires. Zero if it never expires.
+	Time      time.Time // When the version was written
+}
+
+// versionRing retains the most recent versions of a key
+type versionRing struct {
+	versions []keyVersion // The ring buffer, which grows up to the history size
+	start    int          // The index of the oldest version once the ring is full
+}
+
+// add adds a version, replacing the oldest one once there are size versions
+func (r *versionRing) add(v keyVersion, size int) {
+	if len(r.versions) < size {
+		r.versions = append(r.versions, v)
+		return
+	}
+	r.versions[r.start] = v
+	r.start = (r.start + 1) % size
+}
+
+// newestFirst returns the versions from the newest to the oldest
+func (r *versionRing) newestFirst() []keyVersion {
+	versions := make([]keyVersion, 0, len(r.versions))
+	for k := len(r.versions) - 1; k >= 0; k-- {
+		versions = append(versions, r.versions[(r.start+k)%len(r.versions)])
+	}
+	return versions
+}
+
+// errVersionNotFound is returned from the update of RestoreVersion to leave the key unchanged
+var errVersionNotFound = errors.New("version not found")
+
+// WithHistory retains the last n versions of every key, including the current one, so that History can show how a key
+// changed and RestoreVersion can undo a write. Every write of a key is a version, including ones that only change its
+// ttl. Versions are kept in memory in addition to the keys, uncompressed and outside of namespace quotas, and are
+// dropped with the key when it is deleted or expires. Only writes made after the startup files are loaded are
+// retained. Zero disables the history.
+func WithHistory(n int) Options {
+	return func(db *InMemoryDatabase) error {
+		if n < 0 {
+			return fmt.Errorf("history size must not be negative, got %d", n)
+		}
+		db.s.HistorySize = n
+		return nil
+	}
+}
+
+// startHistory enables the history once the startup files are loaded
+func (i *InMemoryDatabase) startHistory() {
+	if i.s.HistorySize > 0 {
+		i.history = map[string]*versionRing{}
+	}
+}
+
+// recordVersion adds a write to the history of its key. The database mutex must be held.
+func (i *InMemoryDatabase) recordVersion(key string, v keyVersion) {
+	if i.history == nil {
+		return
+	}
+	r, ok := i.history[key]
+	if !ok {
+		r = &versionRing{}
+		i.history[key] = r
+	}
+	r.add(v, i.s.HistorySize)
+}
+
+// forgetVersions drops the history of a key that was deleted or expired. The database mutex must be held.
+func (i *InMemoryDatabase) forgetVersions(key string) {
+	if i.history != nil {
+		delete(i.history, key)
+	}
+}
+
+// History returns the retained versions of the key from the newest to the oldest, where the newest is its current
+// version. It returns no versions for a key that does not exist or has expired, and false if the database has no
+// history.
+func (i *InMemoryDatabase) History(key string) ([]keyVersion, bool) {
+	_ = i.injectFailure(false)
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.history == nil {
+		return nil, false
+	}
+	r, ok := i.history[key]
+	if dbEntry, loaded := i.load(key); !ok || !loaded || dbEntry.expired(i.s.clock.Now().Unix()) {
+		return nil, true
+	}
+	return r.newestFirst(), true
+}
+
+// RestoreVersion writes the value of a retained version of the key as its new current version, keeping its ttl, so
+// that the restore can itself be undone. It returns whether the key exists and whether the version was found. Like
+// Update, the *LimitErrors of a value that would take the namespace of the key over its quota are returned. A database
+// without a history finds no versions.
+func (i *InMemoryDatabase) RestoreVersion(key string, version uint64) (bool, bool, error) {
+	exists, err := i.update(key, false, nil, func(value string, _ bool) (string, error) {
+		if r, ok := i.history[key]; ok {
+			for _, v := range r.versions {
+				if v.Version == version {
+					return v.Value, nil
+				}
+			}
+		}
+		return "", errVersionNotFound
+	})
+	if errors.Is(err, errVersionNotFound) {
+		return exists, false, nil
+	}
+	return exists, exists, err
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// The supported ID schemes for keys generated by Create
+const (
+	IDSchemeUUIDv4     = "uuid"
+	IDSchemeUUIDv7     = "uuidv7"
+	IDSchemeNanoID     = "nanoid"
+	IDSchemeSequential = "sequential"
+	IDSchemeCustom     = "custom" // Reported as the scheme of a generator given with WithKeyGenerator
+)
+
+// maxIDAttempts is how many taken keys Create skips from a generator given with WithKeyGenerator before giving up, so
+// that a generator that keeps returning the same keys, such as a deterministic one in a test, cannot hang it. The id
+// schemes always reach a free key, so they are not capped.
+const maxIDAttempts = 100
+
+// nanoIDAlphabet is the URL-safe alphabet used by nanoid
+const nanoIDAlphabet = "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// nanoIDLength is the default nanoid length, giving a collision probability similar to a v4 UUID
+const nanoIDLength = 21
+
+// setIDScheme sets the scheme used to generate keys, along with its generator
+func (s *settings) setIDScheme(scheme string) error {
+	s.sequentialIDs = nil
+	switch scheme {
+	case IDSchemeUUIDv4:
+		s.newID = func() string {
+			return uuid.New().String()
+		}
+	case IDSchemeUUIDv7:
+		s.newID = func() string {
+			return uuid.Must(uuid.NewV7()).String()
+		}
+	case IDSchemeNanoID:
+		s.newID = newNanoID
+	case IDSchemeSequential:
+		s.sequentialIDs = &sequentialIDs{}
+		s.newID = s.sequentialIDs.next
+	default:
+		return fmt.Errorf("unknown id scheme %q", scheme)
+	}
+	s.IDScheme = scheme
+	return nil
+}
+
+// sequentialIDs generates the keys of the sequential id scheme. Generators are only called while the database lock is
+// held so the counter needs no synchronization.
+type sequentialIDs struct {
+	last uint64 // The last id that was generated or seen
+}
+
+// next returns the id after the last one
+func (s *sequentialIDs) next() string {
+	s.last++
+	return strconv.FormatUint(s.last, 10)
+}
+
+// seed moves the counter past key if it is a sequential id
+func (s *sequentialIDs) seed(key string) {
+	if n, err := strconv.ParseUint(key, 10, 64); err == nil && n > s.last {
+		s.last = n
+	}
+}
+
+// seedSequentialIDs moves the sequential id counter past the highest numeric key loaded at startup, so that the ids
+// continue from where they were rather than starting over on every restart
+func (i *InMemoryDatabase) seedSequentialIDs() {
+	if i.s.sequentialIDs == nil {
+		return
+	}
+	for key := range i.database.rangeEntries {
+		i.s.sequentialIDs.seed(key)
+	}
+}
+
+// newNanoID returns a random nanoid
+func newNanoID() string {
+	b := make([]byte, nanoIDLength)
+	_, _ = rand.Read(b)
+	for i := range b {
+		// The alphabet has 64 characters so masking keeps the distribution uniform
+		b[i] = nanoIDAlphabet[b[i]&63]
+	}
+	return string(b)
+}
+
+// nodeIDPattern restricts node IDs to characters that need no quoting in the AOF
+var nodeIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newNodeID returns a random node ID
+func newNodeID() string {
+	return newNanoID()[:12]
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"iter"
+	"strings"
+	"time"
+)
+
+// snapshots yields copies of the store one part at a time. The database is only locked while a part is copied, and
+// not at all for stores with concurrent reads, so walking a large dataset holds up writers for as short as possible.
+func (i *InMemoryDatabase) snapshots() iter.Seq[dbStore] {
+	return func(yield func(dbStore) bool) {
+		for n := range i.database.parts() {
+			var part dbStore
+			if i.database.concurrentReads() {
+				part = i.database.snapshotPart(n)
+			} else {
+				i.mu.RLock()
+				part = i.database.snapshotPart(n)
+				i.mu.RUnlock()
+			}
+			if !yield(part) {
+				return
+			}
+		}
+	}
+}
+
+// Range calls f for every key that has not expired, with its value and its expiration time, which is nil if the key
+// never expires. Iteration stops when f returns false. Keys are visited in no particular order and the walk is not a
+// consistent snapshot: it proceeds a part of the store at a time, so writes made while ranging may or may not be
+// seen, but no key is visited twice. No lock is held while f runs, so f may read and write the database.
+func (i *InMemoryDatabase) Range(f func(key string, value string, expiresAt *time.Time) bool) {
+	for part := range i.snapshots() {
+		now := i.s.clock.Now().Unix()
+		for key, e := range part {
+			if e.expired(now) {
+				continue
+			}
+			var expiresAt *time.Time
+			if e.expiresAt != 0 {
+				t := time.Unix(e.expiresAt, 0)
+				expiresAt = &t
+			}
+			if !f(key, e.plainValue(), expiresAt) {
+				return
+			}
+		}
+	}
+}
+
+// Keys returns an iterator over every key with the prefix that has not expired, or every key if the prefix is empty.
+// It walks the store like Range, so keys are yielded in no particular order. Use Scan for keys in order.
+func (i *InMemoryDatabase) Keys(prefix string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for part := range i.snapshots() {
+			now := i.s.clock.Now().Unix()
+			for key, e := range part {
+				if !strings.HasPrefix(key, prefix) || e.expired(now) {
+					continue
+				}
+				if !yield(key) {
+					return
+				}
+			}
+		}
+	}
+}
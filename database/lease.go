@@ -0,0 +1,154 @@
+package database
+
+import (
+	"container/heap"
+
+	"github.com/google/uuid"
+)
+
+// lease is a named lease held by the client that acquired it. Keys written under a lease are given its expiration, so
+// the ttl cleaner deletes them once the lease expires, and renewing the lease extends them.
+type lease struct {
+	id        string              // Identifies the holder, who must present it to use the lease
+	ttl       int64               // The ttl in seconds that the lease is renewed to
+	expiresAt int64               // Unix seconds at which the lease expires
+	keys      map[string]struct{} // Keys written under the lease. A key leaves the lease once it is overwritten.
+}
+
+// liveLease returns the lease with the name and id if it has not expired. The database mutex must be held.
+func (i *InMemoryDatabase) liveLease(name string, id string, now int64) (*lease, bool) {
+	l, ok := i.leases[name]
+	if !ok || l.id != id || l.expiresAt <= now {
+		return nil, false
+	}
+	return l, true
+}
+
+// leasedKeys returns the keys that still belong to the lease, dropping keys that have since been overwritten, deleted
+// or expired. A key belongs to the lease while its expiration matches the lease's. The database mutex must be held.
+func (i *InMemoryDatabase) leasedKeys(l *lease) map[string]databaseEntry {
+	entries := make(map[string]databaseEntry, len(l.keys))
+	for key := range l.keys {
+		e, loaded := i.load(key)
+		if !loaded || e.expiresAt != l.expiresAt {
+			delete(l.keys, key)
+			continue
+		}
+		entries[key] = e
+	}
+	return entries
+}
+
+// AcquireLease acquires the lease with the name for ttl seconds, returning the id that identifies the holder. It
+// returns false if the lease is held by someone else and has not expired. Leases are coordination state rather than
+// data, so they are not persisted: after a restart, holders must acquire their leases again, while the keys written
+// under them still expire when the leases would have.
+func (i *InMemoryDatabase) AcquireLease(name string, ttl int64) (string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := i.s.clock.Now().Unix()
+	if l, ok := i.leases[name]; ok && l.expiresAt > now {
+		return "", false
+	}
+
+	// Expired leases are only removed here, so sweep them all while the mutex is held anyway
+	for n, l := range i.leases {
+		if l.expiresAt <= now {
+			delete(i.leases, n)
+		}
+	}
+
+	if i.leases == nil {
+		i.leases = map[string]*lease{}
+	}
+	l := &lease{id: uuid.New().String(), ttl: ttl, expiresAt: now + ttl, keys: map[string]struct{}{}}
+	i.leases[name] = l
+	return l.id, true
+}
+
+// RenewLease extends the lease with the name and id, and every key written under it, by the lease's ttl. It returns
+// false if there is no such lease or it has expired, in which case the holder has lost it and its keys are gone.
+func (i *InMemoryDatabase) RenewLease(name string, id string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := i.s.clock.Now().Unix()
+	l, ok := i.liveLease(name, id, now)
+	if !ok {
+		return false
+	}
+
+	entries := i.leasedKeys(l)
+	l.expiresAt = now + l.ttl
+	updates := make(dbStore, len(entries))
+	for key, e := range entries {
+		i.aofPut(key, e.plainValue(), &l.ttl)
+		e.expiresAt, e.version = l.expiresAt, i.seq
+		updates[key] = e
+		heap.Push(i.ttl, ttlHeapData{key, e.expiresAt})
+		i.notify(EventUpdated, key)
+	}
+
+	// Updates are stored together so that a copy-on-write store only copies once
+	i.database.storeAll(updates)
+	if len(updates) > 0 {
+		select {
+		case i.newItem <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// ReleaseLease gives up the lease with the name and id, deleting every key written under it. It returns the number of
+// keys deleted, and false if there is no such lease or it has expired.
+func (i *InMemoryDatabase) ReleaseLease(name string, id string) (int, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	l, ok := i.liveLease(name, id, i.s.clock.Now().Unix())
+	if !ok {
+		return 0, false
+	}
+
+	entries := i.leasedKeys(l)
+	for key := range entries {
+		i.aofDelete(key)
+		i.delete(key)
+		i.notify(EventDeleted, key)
+	}
+	delete(i.leases, name)
+	return len(entries), true
+}
+
+// PutLeased puts a key value pair into the database under the lease with the name and id, so that the key expires
+// with the lease. It returns whether the key already existed and whether the lease exists. A *LimitError is returned
+// like for Put. Overwriting the key without the lease later takes it out of the lease.
+func (i *InMemoryDatabase) PutLeased(key string, value string, name string, id string) (bool, bool, error) {
+	if err := i.injectFailure(true); err != nil {
+		return false, true, err
+	}
+	if err := i.checkLimits(key, value); err != nil {
+		return false, true, err
+	}
+
+	if err := i.lockWrite(); err != nil {
+		return false, true, err
+	}
+	defer i.mu.Unlock()
+
+	now := i.s.clock.Now().Unix()
+	l, ok := i.liveLease(name, id, now)
+	if !ok {
+		return false, false, nil
+	}
+
+	ttl := l.expiresAt - now
+	loaded, err := i.put(key, value, &ttl)
+	if err != nil {
+		return false, true, err
+	}
+	l.keys[key] = struct{}{}
+	return loaded, true, nil
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors wrapped by a LimitError, to be checked with errors.Is
+var (
+	ErrKeyTooLong    = errors.New("key too long")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// LimitError is returned by writes that were rejected for exceeding a limit. It wraps ErrKeyTooLong,
+// ErrValueTooLarge or ErrQuotaExceeded.
+type LimitError struct {
+	Err    error  // The limit that was exceeded
+	Detail string // Describes the limit
+}
+
+func (e *LimitError) Error() string {
+	return e.Err.Error() + ": " + e.Detail
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// Quota reports whether the limit is a namespace quota rather than a limit on a single entry. It lets packages that do
+// not import this one, like the handler, tell the two apart.
+func (e *LimitError) Quota() bool {
+	return e.Err == ErrQuotaExceeded
+}
+
+// WithMaxKeyLength rejects writes to keys longer than n bytes with ErrKeyTooLong. Zero, the default, means unlimited.
+// Data loaded at startup is not checked.
+func WithMaxKeyLength(n int) Options {
+	return func(db *InMemoryDatabase) error {
+		if n < 0 {
+			return fmt.Errorf("max key length must not be negative, got %d", n)
+		}
+		db.s.MaxKeyBytes = n
+		return nil
+	}
+}
+
+// WithMaxValueSize rejects writes of values longer than n bytes with ErrValueTooLarge. The limit applies to the value
+// as written rather than as stored, so compression does not let larger values through. Zero, the default, means
+// unlimited. Data loaded at startup is not checked.
+func WithMaxValueSize(n int) Options {
+	return func(db *InMemoryDatabase) error {
+		if n < 0 {
+			return fmt.Errorf("max value size must not be negative, got %d", n)
+		}
+		db.s.MaxValueBytes = n
+		return nil
+	}
+}
+
+// checkLimits returns an error if the key or value is over its size limit
+func (i *InMemoryDatabase) checkLimits(key string, value string) error {
+	if i.s.MaxKeyBytes > 0 && len(key) > i.s.MaxKeyBytes {
+		return &LimitError{ErrKeyTooLong, fmt.Sprintf("keys are limited to %d bytes, got %d", i.s.MaxKeyBytes, len(key))}
+	}
+	if i.s.MaxValueBytes > 0 && len(value) > i.s.MaxValueBytes {
+		return &LimitError{ErrValueTooLarge, fmt.Sprintf("values are limited to %d bytes, got %d", i.s.MaxValueBytes, len(value))}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMirrorQueueSize    = 100_000          // The number of writes queued for the mirror target before further writes are dropped
+	DefaultMirrorDrainTimeout = 10 * time.Second // How long Shutdown waits for queued writes to reach the mirror target
+	mirrorAttempts            = 3                // Attempts at applying a write to the mirror target before giving up on it
+	mirrorBackoff             = 100 * time.Millisecond
+)
+
+// ErrMirrorRejected is wrapped by mirror targets when a write can never succeed, such as a key the target cannot
+// store. Rejected writes are not retried.
+var ErrMirrorRejected = errors.New("write rejected by the mirror target")
+
+// MirrorTarget receives every write made to the database, such as another instance that the data is being migrated
+// to. Writes are applied one at a time in the order they were made.
+type MirrorTarget interface {
+	Put(ctx context.Context, key string, value string, ttl *int64) error // Write the key with the ttl in seconds, or without a ttl if it is nil
+	Delete(ctx context.Context, key string) error                        // Delete the key
+}
+
+// mirrorWrite is a write waiting to be applied to the mirror target
+type mirrorWrite struct {
+	delete    bool
+	key       string
+	value     string
+	expiresAt int64     // Unix seconds at which the key expires. Zero if it never expires.
+	at        time.Time // When the write was made
+}
+
+// mirror queues writes for the mirror target so that a slow or unavailable target never holds up a write
+type mirror struct {
+	target  MirrorTarget
+	mu      sync.Mutex
+	queue   []mirrorWrite // The first write is removed once it has been applied
+	wake    chan struct{}
+	applied uint64 // Writes applied to the target
+	failed  uint64 // Writes rejected by the target or given up on after every attempt failed
+	dropped uint64 // Writes not queued because the queue was full
+	cancel  context.CancelFunc
+	done    chan struct{} // Closed once the mirror routine has stopped
+}
+
+// WithMirror forwards every write to the target in the background while reads are served locally, for migrating
+// between instances without downtime. Writes that cannot be applied after a few attempts or that the target rejects
+// are skipped, and writes are dropped while more than DefaultMirrorQueueSize of them are waiting.
+func WithMirror(target MirrorTarget) Options {
+	return func(db *InMemoryDatabase) error {
+		db.mirror.target = target
+		return nil
+	}
+}
+
+// startMirror starts applying queued writes to the mirror target, if there is one
+func (i *InMemoryDatabase) startMirror() {
+	if i.mirror.target == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i.mirror.wake = make(chan struct{}, 1)
+	i.mirror.cancel = cancel
+	i.mirror.done = make(chan struct{})
+	go func() {
+		defer close(i.mirror.done)
+		i.runRestarting(ctx, "mirror", func() { i.mirrorWrites(ctx) })
+	}()
+}
+
+// enqueueMirror queues a write for the mirror target. The database mutex must be held so that writes are queued in
+// the order they were made.
+func (i *InMemoryDatabase) enqueueMirror(w mirrorWrite) {
+	m := &i.mirror
+	if m.target == nil {
+		return
+	}
+
+	m.mu.Lock()
+	if len(m.queue) >= DefaultMirrorQueueSize {
+		m.dropped++
+		if m.dropped == 1 {
+			i.s.logger.Warn("mirror queue is full, dropping writes", "key", w.key)
+		}
+		m.mu.Unlock()
+		return
+	}
+	m.queue = append(m.queue, w)
+	m.mu.Unlock()
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// mirrorWrites applies queued writes to the mirror target until ctx is done
+func (i *InMemoryDatabase) mirrorWrites(ctx context.Context) {
+	m := &i.mirror
+	for {
+		m.mu.Lock()
+		pending := len(m.queue) > 0
+		var w mirrorWrite
+		if pending {
+			w = m.queue[0]
+		}
+		m.mu.Unlock()
+
+		if !pending {
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+				continue
+			}
+		}
+
+		ok := i.applyMirrorWrite(ctx, w)
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.mu.Lock()
+		m.queue[0] = mirrorWrite{}
+		m.queue = m.queue[1:]
+		if ok {
+			m.applied++
+		} else {
+			m.failed++
+		}
+		m.mu.Unlock()
+	}
+}
+
+// applyMirrorWrite applies a write to the mirror target, retrying with a doubling backoff. A key that has expired
+// while it was queued is deleted instead of written, and the remaining ttl is sent so that the key expires on the
+// target when it expires here.
+func (i *InMemoryDatabase) applyMirrorWrite(ctx context.Context, w mirrorWrite) bool {
+	backoff := mirrorBackoff
+	for attempt := 1; ; attempt++ {
+		var err error
+		if w.delete {
+			err = i.mirror.target.Delete(ctx, w.key)
+		} else if w.expiresAt == 0 {
+			err = i.mirror.target.Put(ctx, w.key, w.value, nil)
+		} else if ttl := w.expiresAt - i.s.clock.Now().Unix(); ttl > 0 {
+			err = i.mirror.target.Put(ctx, w.key, w.value, &ttl)
+		} else {
+			err = i.mirror.target.Delete(ctx, w.key)
+		}
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, ErrMirrorRejected) {
+			i.s.logger.Debug("mirror target rejected a write", "key", w.key, "delete", w.delete, "err", err)
+			return false
+		}
+		if attempt == mirrorAttempts {
+			i.s.logger.Error("giving up on mirroring a write", "key", w.key, "delete", w.delete, "err", err)
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// GetMirrorStats reports how far the mirror target is behind. Lag is the age of the oldest write that has not been
+// applied yet, and is zero once the target has caught up.
+func (i *InMemoryDatabase) GetMirrorStats() struct {
+	Enabled bool
+	Pending int
+	Applied uint64
+	Failed  uint64
+	Dropped uint64
+	Lag     time.Duration
+} {
+	m := &i.mirror
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := struct {
+		Enabled bool
+		Pending int
+		Applied uint64
+		Failed  uint64
+		Dropped uint64
+		Lag     time.Duration
+	}{
+		Enabled: m.target != nil,
+		Pending: len(m.queue),
+		Applied: m.applied,
+		Failed:  m.failed,
+		Dropped: m.dropped,
+	}
+	if len(m.queue) > 0 {
+		stats.Lag = max(i.s.clock.Now().Sub(m.queue[0].at), 0)
+	}
+	return stats
+}
+
+// stopMirror waits up to DefaultMirrorDrainTimeout for the queued writes to be applied and then stops the mirror
+// routine, logging the writes that were never applied
+func (i *InMemoryDatabase) stopMirror() {
+	m := &i.mirror
+	if m.done == nil {
+		return
+	}
+
+	deadline := time.Now().Add(DefaultMirrorDrainTimeout)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		pending := len(m.queue)
+		m.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.cancel()
+	<-m.done
+
+	if pending := i.GetMirrorStats().Pending; pending > 0 {
+		i.s.logger.Warn("shut down before every write reached the mirror target", "pending", pending)
+	}
+}
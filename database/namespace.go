@@ -0,0 +1,114 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NamespaceSeparator separates the namespace of a key from the rest of the key
+const NamespaceSeparator = ":"
+
+// NamespaceQuota limits the size of a namespace. Zero means unlimited.
+type NamespaceQuota struct {
+	MaxKeys  int   `json:"maxKeys"`  // The maximum number of keys
+	MaxBytes int64 `json:"maxBytes"` // The maximum total length of the keys and stored values in bytes
+}
+
+// namespaceUsage is the current size of a namespace with a quota
+type namespaceUsage struct {
+	keys  int
+	bytes int64
+}
+
+// Namespace returns the namespace of a key, which is everything before the first separator. Keys without a separator
+// belong to the default namespace, "".
+func Namespace(key string) string {
+	namespace, _, found := strings.Cut(key, NamespaceSeparator)
+	if !found {
+		return ""
+	}
+	return namespace
+}
+
+// WithNamespaceQuota limits the number of keys and bytes stored in a namespace, e.g. to share a database between
+// tenants. Values count towards the byte quota at their stored size, which is smaller than their length when they are
+// compressed. Writes that would take the namespace over its quota fail with ErrQuotaExceeded, while writes that shrink
+// an over-quota namespace, like overwriting a value with a shorter one, are still allowed. Expired keys count towards
+// the quota until the ttl cleaner removes them, and data loaded at startup is never rejected.
+func WithNamespaceQuota(namespace string, quota NamespaceQuota) Options {
+	return func(db *InMemoryDatabase) error {
+		if strings.Contains(namespace, NamespaceSeparator) {
+			return fmt.Errorf("namespace %q must not contain %q", namespace, NamespaceSeparator)
+		}
+		if quota.MaxKeys < 0 || quota.MaxBytes < 0 {
+			return fmt.Errorf("quota for namespace %q must not be negative", namespace)
+		}
+		if db.s.NamespaceQuotas == nil {
+			db.s.NamespaceQuotas = map[string]NamespaceQuota{}
+		}
+		db.s.NamespaceQuotas[namespace] = quota
+		return nil
+	}
+}
+
+// entrySize is the number of bytes an entry counts for towards a quota
+func entrySize(key string, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// checkQuota returns an error if writing the value to the key would take its namespace over quota. The database
+// mutex must be held.
+func (i *InMemoryDatabase) checkQuota(key string, value string) error {
+	namespace := Namespace(key)
+	quota, ok := i.s.NamespaceQuotas[namespace]
+	if !ok {
+		return nil
+	}
+
+	usage := i.usage[namespace]
+	keys, bytes := usage.keys+1, usage.bytes+entrySize(key, value)
+	if old, loaded := i.load(key); loaded {
+		keys--
+		bytes -= entrySize(key, old.value)
+	}
+
+	if quota.MaxKeys > 0 && keys > quota.MaxKeys && keys > usage.keys {
+		return &LimitError{ErrQuotaExceeded, fmt.Sprintf("namespace %q is limited to %d keys", namespace, quota.MaxKeys)}
+	}
+	if quota.MaxBytes > 0 && bytes > quota.MaxBytes && bytes > usage.bytes {
+		return &LimitError{ErrQuotaExceeded, fmt.Sprintf("namespace %q is limited to %d bytes", namespace, quota.MaxBytes)}
+	}
+	return nil
+}
+
+// trackUsage accounts for the entry under the key changing from old to new in the usage of its namespace, where a nil
+// entry means the key does not exist. The database mutex must be held.
+func (i *InMemoryDatabase) trackUsage(key string, old *databaseEntry, new *databaseEntry) {
+	usage, ok := i.usage[Namespace(key)]
+	if !ok {
+		return
+	}
+	if old != nil {
+		usage.keys--
+		usage.bytes -= entrySize(key, old.value)
+	}
+	if new != nil {
+		usage.keys++
+		usage.bytes += entrySize(key, new.value)
+	}
+}
+
+// resetUsage recounts the usage of every namespace with a quota from the store. The database mutex must be held.
+func (i *InMemoryDatabase) resetUsage() {
+	if len(i.s.NamespaceQuotas) == 0 {
+		return
+	}
+
+	i.usage = make(map[string]*namespaceUsage, len(i.s.NamespaceQuotas))
+	for namespace := range i.s.NamespaceQuotas {
+		i.usage[namespace] = &namespaceUsage{}
+	}
+	for key, d := range i.database.rangeEntries {
+		i.trackUsage(key, nil, &d)
+	}
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The kinds of persistence whose outcomes are tracked
+const (
+	PersistenceAOF      = "aof"      // Syncing the AOF to disk
+	PersistenceSnapshot = "snapshot" // Writing the database persistence file
+
+	// PersistenceCompaction is the kind that writes made while Compact holds the database are recorded against. Only
+	// the stall counts of its stats are used.
+	PersistenceCompaction = "compaction"
+)
+
+// DefaultPersistenceAlertPeriods is how many persistence periods may pass without a success before an alert is raised
+const DefaultPersistenceAlertPeriods = 3
+
+// PersistenceAlert is called when a kind of persistence has not succeeded for the alert periods, with how long it has
+// been since the last success, or since the database started if it never succeeded, and the latest error. It is
+// called once per outage, from the persistence routine.
+type PersistenceAlert func(kind string, since time.Duration, err error)
+
+// persistenceStatus is the outcome of the attempts of one kind of persistence
+type persistenceStatus struct {
+	lastSuccess  time.Time     // When the last successful attempt finished. Zero if none has.
+	lastDuration time.Duration // How long the last successful attempt took
+	failures     int           // Attempts that failed since the last success
+	lastErr      error         // The error of the last failed attempt
+	alerted      bool          // Whether the current outage has been alerted on
+	freeBytes    uint64        // The free disk space found by the last check
+	failedWrites uint64        // Writes rejected by the reject persistence failure policy during outages
+
+	stalledWrites  uint64        // Writes that waited for the persistence to release the database
+	stallTime      time.Duration // The total time writes waited
+	rejectedWrites uint64        // Writes failed fast by the fail write stall policy
+	bufferedWrites uint64        // Puts buffered by the buffer write stall policy
+}
+
+// The outcomes of a write made while persistence held the database
+const (
+	stallWaited = iota
+	stallRejected
+	stallBuffered
+)
+
+// persistenceTracker records the outcome of every persistence attempt
+type persistenceTracker struct {
+	mu       sync.Mutex
+	started  time.Time // When the database started, which outages without any success are measured from
+	statuses map[string]*persistenceStatus
+}
+
+// WithPersistenceAlert sets how many persistence periods may pass without a successful AOF sync or snapshot before a
+// warning is logged and f is called, if it is not nil. Zero disables the alerts.
+func WithPersistenceAlert(periods int, f PersistenceAlert) Options {
+	return func(db *InMemoryDatabase) error {
+		if periods < 0 {
+			return fmt.Errorf("persistence alert periods must not be negative, got %d", periods)
+		}
+		db.s.PersistenceAlertPeriods = periods
+		db.s.persistenceAlert = f
+		return nil
+	}
+}
+
+// status returns the status of the kind of persistence, creating it if needed. The tracker mutex must be held.
+func (t *persistenceTracker) status(kind string) *persistenceStatus {
+	status := t.statuses[kind]
+	if status == nil {
+		status = &persistenceStatus{}
+		t.statuses[kind] = status
+	}
+	return status
+}
+
+// recordStall records the outcome of a write made while persistence of the kind held the database, which waited for d
+func (i *InMemoryDatabase) recordStall(kind string, outcome int, d time.Duration) {
+	t := &i.persistence
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := t.status(kind)
+	switch outcome {
+	case stallWaited:
+		status.stalledWrites++
+		status.stallTime += d
+	case stallRejected:
+		status.rejectedWrites++
+	case stallBuffered:
+		status.bufferedWrites++
+	}
+}
+
+// recordPersistence records the outcome of a persistence attempt that started at start, alerting if the kind has not
+// succeeded for the alert periods
+func (i *InMemoryDatabase) recordPersistence(kind string, start time.Time, err error) {
+	t := &i.persistence
+	t.mu.Lock()
+	status := t.status(kind)
+	if err == nil {
+		recovered := status.alerted
+		status.lastSuccess = time.Now()
+		status.lastDuration = status.lastSuccess.Sub(start)
+		status.failures = 0
+		status.lastErr = nil
+		status.alerted = false
+		t.mu.Unlock()
+		if recovered {
+			i.s.logger.Info("persistence succeeded again", "kind", kind)
+		}
+		return
+	}
+
+	status.failures++
+	status.lastErr = err
+	since := t.started
+	if !status.lastSuccess.IsZero() {
+		since = status.lastSuccess
+	}
+	outage := time.Since(since)
+	alert := i.s.PersistenceAlertPeriods > 0 && !status.alerted && outage >= time.Duration(i.s.PersistenceAlertPeriods)*i.period(kind)
+	if alert {
+		status.alerted = true
+	}
+	failures := status.failures
+	t.mu.Unlock()
+
+	if alert {
+		i.s.logger.Warn("persistence has not succeeded", "kind", kind, "since", outage.String(), "failures", failures, "err", err)
+		if i.s.PersistenceFailurePolicy == PersistenceFailureReject {
+			i.s.logger.Warn("rejecting writes until persistence succeeds", "kind", kind)
+		}
+		if i.s.persistenceAlert != nil {
+			i.s.persistenceAlert(kind, outage, err)
+		}
+	}
+}
+
+// GetPersistenceStats reports the outcome of the AOF syncs or snapshots, depending on the kind. Failures counts the
+// attempts that failed since the last success, and Failing reports whether they have gone on for the alert periods,
+// with RejectingWrites set if writes are rejected because of it. The stall counts describe the writes made while the
+// persistence held the database, as handled by the write stall policy.
+func (i *InMemoryDatabase) GetPersistenceStats(kind string) struct {
+	Enabled         bool
+	LastSuccess     time.Time
+	LastDuration    time.Duration
+	Failures        int
+	Failing         bool
+	RejectingWrites bool
+	FailedWrites    uint64
+	FreeDiskBytes   uint64
+	StalledWrites   uint64
+	StallTime       time.Duration
+	RejectedWrites  uint64
+	BufferedWrites  uint64
+} {
+	t := &i.persistence
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := struct {
+		Enabled         bool
+		LastSuccess     time.Time
+		LastDuration    time.Duration
+		Failures        int
+		Failing         bool
+		RejectingWrites bool
+		FailedWrites    uint64
+		FreeDiskBytes   uint64
+		StalledWrites   uint64
+		StallTime       time.Duration
+		RejectedWrites  uint64
+		BufferedWrites  uint64
+	}{
+		Enabled: (kind == PersistenceAOF && i.s.ShouldAofPersist) || (kind == PersistenceSnapshot && i.s.ShouldDatabasePersist),
+	}
+	if status := t.statuses[kind]; status != nil {
+		stats.LastSuccess = status.lastSuccess
+		stats.LastDuration = status.lastDuration
+		stats.Failures = status.failures
+		stats.Failing = status.alerted
+		stats.RejectingWrites = status.alerted && i.s.PersistenceFailurePolicy == PersistenceFailureReject
+		stats.FailedWrites = status.failedWrites
+		stats.FreeDiskBytes = status.freeBytes
+		stats.StalledWrites = status.stalledWrites
+		stats.StallTime = status.stallTime
+		stats.RejectedWrites = status.rejectedWrites
+		stats.BufferedWrites = status.bufferedWrites
+	}
+	return stats
+}
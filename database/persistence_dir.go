@@ -0,0 +1,145 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The names of the persistence files in a persistence directory
+const (
+	SnapshotFileName = "snapshot.db"
+	AofFileName      = "appendonly.aof"
+)
+
+// snapshotsKept is how many replaced snapshots are kept in a persistence directory besides the current one
+const snapshotsKept = 3
+
+// snapshotTimeFormat timestamps the names of replaced snapshots so that they sort in the order they were written
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+// WithPersistenceDir keeps the persistence files in dir, as snapshot.db and appendonly.aof, instead of naming each
+// file. Only the kinds of persistence that are enabled write to it. Each snapshot replaces the previous one atomically,
+// and the 3 snapshots before it are kept alongside as snapshot-<time written>.db. The directory must exist and be
+// writable when the database starts. Files named by options applied after this one override the derived names.
+func WithPersistenceDir(dir string) Options {
+	return func(db *InMemoryDatabase) error {
+		if dir == "" {
+			return errors.New("persistence directory must not be empty")
+		}
+		db.s.PersistenceDir = dir
+		db.s.AofPersistFile = filepath.Join(dir, AofFileName)
+		db.s.DatabasePersistFile = filepath.Join(dir, SnapshotFileName)
+		return nil
+	}
+}
+
+// checkPersistenceDirs checks that the persistence directory and the directories of the enabled persistence files
+// exist and can be written to, so that a bad path fails startup rather than every persistence attempt
+func (s settings) checkPersistenceDirs() error {
+	var dirs []string
+	if s.PersistenceDir != "" {
+		dirs = append(dirs, filepath.Clean(s.PersistenceDir))
+	}
+	if s.ShouldAofPersist {
+		dirs = append(dirs, filepath.Dir(s.AofPersistFile))
+	}
+	if s.ShouldDatabasePersist {
+		dirs = append(dirs, filepath.Dir(s.DatabasePersistFile))
+	}
+	slices.Sort(dirs)
+
+	var errs []error
+	for _, dir := range slices.Compact(dirs) {
+		info, err := os.Stat(dir)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("persistence directory: %w", err))
+			continue
+		case !info.IsDir():
+			errs = append(errs, fmt.Errorf("persistence directory %v is not a directory", dir))
+			continue
+		}
+
+		f, err := os.CreateTemp(dir, ".write-check-*")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("persistence directory %v is not writable: %w", dir, err))
+			continue
+		}
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	return errors.Join(errs...)
+}
+
+// replaceSnapshot writes a snapshot to a temporary file next to the persistence file and renames it over the file, so
+// that a failed write never leaves a partial snapshot behind. In a persistence directory the snapshot it replaces is
+// kept under a timestamped name, and the oldest of those are removed.
+func (i *InMemoryDatabase) replaceSnapshot(b []byte) error {
+	file := i.s.DatabasePersistFile
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if i.s.PersistenceDir != "" {
+		i.rotateSnapshot()
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// rotateSnapshot keeps the current snapshot under the time it was written, and removes the rotated snapshots beyond the
+// ones kept. The current snapshot is hard linked, or copied where links are not supported, rather than moved, so that it
+// stays in place until the new one is renamed over it. Failing to rotate only loses the old snapshot, so errors are
+// logged and not returned.
+func (i *InMemoryDatabase) rotateSnapshot() {
+	file := i.s.DatabasePersistFile
+	ext := filepath.Ext(file)
+	stem := strings.TrimSuffix(file, ext)
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	rotated := stem + "-" + info.ModTime().UTC().Format(snapshotTimeFormat) + ext
+	if err = os.Link(file, rotated); err != nil && !errors.Is(err, os.ErrExist) {
+		if err = copySnapshot(file, rotated); err != nil {
+			i.s.logger.Warn("failed to rotate the previous snapshot", "file", file, "err", err)
+			return
+		}
+	}
+
+	old, err := filepath.Glob(stem + "-*" + ext)
+	if err != nil || len(old) <= snapshotsKept {
+		return
+	}
+	slices.Sort(old)
+	for _, f := range old[:len(old)-snapshotsKept] {
+		if err = os.Remove(f); err != nil {
+			i.s.logger.Warn("failed to remove an old snapshot", "file", f, "err", err)
+		}
+	}
+}
+
+// copySnapshot copies the snapshot in src to dst
+func copySnapshot(src string, dst string) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, b, 0644)
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// The policies for writes while persistence keeps failing, i.e. once it has not succeeded for the alert periods
+const (
+	PersistenceFailureContinue = "continue" // Writes are kept in memory and only the alert is raised
+	PersistenceFailureReject   = "reject"   // Writes that can fail return a *PersistenceFailedError until it succeeds
+)
+
+// ErrPersistenceFailed is returned, wrapped in a *PersistenceFailedError, by writes rejected by the reject persistence
+// failure policy
+var ErrPersistenceFailed = errors.New("writes are rejected while persistence is failing")
+
+// ErrInsufficientDiskSpace fails an AOF sync or snapshot that would leave less than the minimum free disk space
+var ErrInsufficientDiskSpace = errors.New("not enough free disk space")
+
+// PersistenceFailedError is returned by writes rejected by the reject persistence failure policy
+type PersistenceFailedError struct {
+	Kind  string        // The kind of persistence that is failing, as named by the persistence stats
+	Err   error         // The error of its latest attempt
+	Retry time.Duration // The period of the kind, after which it is attempted again
+}
+
+func (e *PersistenceFailedError) Error() string {
+	return fmt.Sprintf("%v: the %s has not succeeded: %v", ErrPersistenceFailed, e.Kind, e.Err)
+}
+
+func (e *PersistenceFailedError) Unwrap() error {
+	return ErrPersistenceFailed
+}
+
+// PersistenceKind returns the kind of persistence that is failing. It lets packages that do not import this one, like
+// the handler, tell these errors apart from other rejected writes.
+func (e *PersistenceFailedError) PersistenceKind() string {
+	return e.Kind
+}
+
+// RetryAfter returns how long until persistence is attempted again
+func (e *PersistenceFailedError) RetryAfter() time.Duration {
+	return e.Retry
+}
+
+// WithPersistenceFailurePolicy sets what writes do once an enabled kind of persistence has not succeeded for the alert
+// periods: continue (the default) keeps accepting them in memory, and reject returns a *PersistenceFailedError from
+// the writes that can return an error until the next success, so that clients stop sending writes that would be lost
+// on a restart. Deletes are still applied under either policy. Reject needs persistence alerts to be enabled.
+func WithPersistenceFailurePolicy(policy string) Options {
+	return func(db *InMemoryDatabase) error {
+		switch policy {
+		case PersistenceFailureContinue, PersistenceFailureReject:
+		default:
+			return fmt.Errorf("unknown persistence failure policy %q", policy)
+		}
+		db.s.PersistenceFailurePolicy = policy
+		return nil
+	}
+}
+
+// WithMinFreeDisk fails AOF syncs and snapshots that would leave less than bytes free on the disk of their file, so
+// that persistence fails early with a clear error rather than filling the disk. A snapshot needs its own size on top.
+// The failures count towards the alert and the persistence failure policy like any other. Zero, the default, only
+// checks that a snapshot fits. Free space is not checked on platforms other than unix.
+func WithMinFreeDisk(bytes uint64) Options {
+	return func(db *InMemoryDatabase) error {
+		db.s.MinFreeDiskBytes = bytes
+		return nil
+	}
+}
+
+// checkDiskSpace checks that writing need bytes for the kind of persistence to file leaves the minimum free disk space,
+// recording the free space it found. Free space that cannot be determined is not checked, as the write will fail on
+// its own if the file cannot be written.
+func (i *InMemoryDatabase) checkDiskSpace(kind string, file string, need uint64) error {
+	dir := filepath.Dir(file)
+	free, err := i.s.diskFree(dir)
+	if err != nil {
+		return nil
+	}
+
+	t := &i.persistence
+	t.mu.Lock()
+	t.status(kind).freeBytes = free
+	t.mu.Unlock()
+
+	if need += i.s.MinFreeDiskBytes; free < need {
+		return fmt.Errorf("%w for the %s in %v: %d bytes free, %d needed", ErrInsufficientDiskSpace, kind, dir, free, need)
+	}
+	return nil
+}
+
+// rejectWrite returns a *PersistenceFailedError under the reject persistence failure policy while an enabled kind of
+// persistence has not succeeded for the alert periods, counting the rejected write against it
+func (i *InMemoryDatabase) rejectWrite() error {
+	if i.s.PersistenceFailurePolicy != PersistenceFailureReject {
+		return nil
+	}
+
+	t := &i.persistence
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, kind := range []string{PersistenceAOF, PersistenceSnapshot} {
+		status := t.statuses[kind]
+		if status == nil || !status.alerted {
+			continue
+		}
+		status.failedWrites++
+		return &PersistenceFailedError{Kind: kind, Err: status.lastErr, Retry: max(i.period(kind), time.Second)}
+	}
+	return nil
+}
+
+// period returns the period between attempts of the kind of persistence
+func (i *InMemoryDatabase) period(kind string) time.Duration {
+	if kind == PersistenceSnapshot {
+		return i.s.DatabasePersistencePeriod
+	}
+	return i.s.AofPersistencePeriod
+}
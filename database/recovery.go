@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	defaultRestartBackoff = 100 * time.Millisecond // The wait before the first restart of a routine that panicked
+	maxRestartBackoff     = 30 * time.Second       // The longest wait between restarts
+	maxRestarts           = 10                     // The restarts after which a routine that keeps panicking is given up on
+)
+
+// Persist runs a persistence pass for every enabled persistence method. It is used on shutdown and as a final attempt
+// to save data after a panic.
+func (i *InMemoryDatabase) Persist() {
+	if i.s.ShouldAofPersist {
+		i.persistAof()
+	}
+
+	if i.s.ShouldDatabasePersist {
+		i.persistDatabase()
+	}
+}
+
+// goRecover runs f in a new goroutine. If f panics, the panic is logged, a final persistence pass is attempted, and
+// f is restarted so that a single bad iteration does not stop the background routine for good.
+func (i *InMemoryDatabase) goRecover(name string, f func()) {
+	go i.runRestarting(i.stopping, name, f)
+}
+
+// runRestarting calls f until it returns without panicking. The wait before each restart doubles, so that a panic
+// that happens every time does not turn into a loop of stack traces and persistence passes, and f is given up on after
+// maxRestarts restarts or once ctx is done.
+func (i *InMemoryDatabase) runRestarting(ctx context.Context, name string, f func()) {
+	backoff := i.s.restartBackoff
+	for restarts := 0; !i.runRecovered(name, f); restarts++ {
+		if restarts == maxRestarts {
+			i.s.logger.Error("background routine keeps panicking, not restarting it", "routine", name,
+				"restarts", restarts)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRestartBackoff)
+	}
+}
+
+// runRecovered calls f and reports whether it returned without panicking
+func (i *InMemoryDatabase) runRecovered(name string, f func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			i.s.logger.Error("recovered from panic in background routine", "routine", name, "panic", fmt.Sprint(r),
+				"stack", string(debug.Stack()))
+			i.persistAfterPanic()
+		}
+	}()
+
+	f()
+	return true
+}
+
+// persistAfterPanic attempts a final persistence pass, guarding against the persistence itself panicking
+func (i *InMemoryDatabase) persistAfterPanic() {
+	defer func() {
+		if r := recover(); r != nil {
+			i.s.logger.Error("panic during persistence after panic", "panic", fmt.Sprint(r))
+		}
+	}()
+
+	i.Persist()
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// BM25 parameters for ranking search results
+const (
+	searchK1 = 1.2  // How quickly repeated terms stop adding to the score
+	searchB  = 0.75 // How much longer values are penalized
+)
+
+// searchResult is a key matching a search. It is an alias of an unnamed struct so that packages consuming results,
+// like the handler, can describe it without importing this package.
+type searchResult = struct {
+	Key   string
+	Score float64 // The relevance of the key. Higher is more relevant.
+}
+
+// searchDoc is what the search index knows about the value of a key
+type searchDoc struct {
+	terms  []string // The distinct terms of the value, to remove the key from the postings
+	length int      // The number of terms in the value, counting repeats
+}
+
+// searchIndex is an inverted index from the terms of values to the keys holding them. It is only modified with the
+// database mutex held.
+type searchIndex struct {
+	postings map[string]map[string]int // The number of occurrences of each term by key
+	docs     map[string]searchDoc
+	length   int // The total length of every indexed value, for the average length
+}
+
+// WithSearchIndex maintains an inverted index over the values so that Search can find keys by the words in their
+// values. Values are tokenized into lower case runs of letters and digits, so JSON values are searchable by both their
+// field names and their values. The index costs memory in proportion to the number of words stored and slows writes
+// down, so it is meant for debugging and small search use cases.
+func WithSearchIndex() Options {
+	return func(db *InMemoryDatabase) error {
+		db.s.SearchIndex = true
+		return nil
+	}
+}
+
+// tokenize splits text into lower case terms of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// resetSearchIndex rebuilds the search index from the store. The database mutex must be held.
+func (i *InMemoryDatabase) resetSearchIndex() {
+	if !i.s.SearchIndex {
+		return
+	}
+
+	i.search = &searchIndex{postings: map[string]map[string]int{}, docs: map[string]searchDoc{}}
+	for key, d := range i.database.rangeEntries {
+		i.search.add(key, d.plainValue())
+	}
+}
+
+// indexEntry accounts for the entry under the key changing from old to new in the search index, where a nil entry
+// means the key does not exist. The database mutex must be held.
+func (i *InMemoryDatabase) indexEntry(key string, old *databaseEntry, new *databaseEntry) {
+	// Writes that only change the ttl keep the value
+	if old != nil && new != nil && old.value == new.value && old.compressed == new.compressed {
+		return
+	}
+	if old != nil {
+		i.search.remove(key)
+	}
+	if new != nil {
+		i.search.add(key, new.plainValue())
+	}
+}
+
+// add indexes the terms of the value under the key
+func (s *searchIndex) add(key string, value string) {
+	terms := tokenize(value)
+	if len(terms) == 0 {
+		return
+	}
+
+	doc := searchDoc{length: len(terms)}
+	for _, term := range terms {
+		keys, ok := s.postings[term]
+		if !ok {
+			keys = map[string]int{}
+			s.postings[term] = keys
+		}
+		if keys[key] == 0 {
+			doc.terms = append(doc.terms, term)
+		}
+		keys[key]++
+	}
+	s.docs[key] = doc
+	s.length += doc.length
+}
+
+// remove drops the key from the index
+func (s *searchIndex) remove(key string) {
+	doc, ok := s.docs[key]
+	if !ok {
+		return
+	}
+
+	for _, term := range doc.terms {
+		keys := s.postings[term]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(s.postings, term)
+		}
+	}
+	delete(s.docs, key)
+	s.length -= doc.length
+}
+
+// Search returns up to limit keys starting with the prefix whose values contain any term of the query, the most
+// relevant first. Keys are ranked with BM25, so values holding more of the query terms, and terms that are rare in the
+// database, rank higher. Ties are broken by key. It returns false if the database has no search index.
+func (i *InMemoryDatabase) Search(query string, prefix string, limit int) ([]searchResult, bool) {
+	_ = i.injectFailure(false)
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	s := i.search
+	if s == nil {
+		return nil, false
+	}
+	if len(s.docs) == 0 {
+		return nil, true
+	}
+
+	avgLength := float64(s.length) / float64(len(s.docs))
+	scores := map[string]float64{}
+	terms := tokenize(query)
+	slices.Sort(terms)
+	for _, term := range slices.Compact(terms) {
+		keys := s.postings[term]
+		idf := math.Log(1 + (float64(len(s.docs))-float64(len(keys))+0.5)/(float64(len(keys))+0.5))
+		for key, n := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			tf := float64(n)
+			norm := searchK1 * (1 - searchB + searchB*float64(s.docs[key].length)/avgLength)
+			scores[key] += idf * tf * (searchK1 + 1) / (tf + norm)
+		}
+	}
+
+	// Expired keys stay indexed until the ttl cleaner removes them
+	now := i.s.clock.Now().Unix()
+	results := make([]searchResult, 0, len(scores))
+	for key, score := range scores {
+		if d, ok := i.load(key); ok && !d.expired(now) {
+			results = append(results, searchResult{Key: key, Score: score})
+		}
+	}
+	slices.SortFunc(results, func(a, b searchResult) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, true
+}
@@ -0,0 +1,189 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The policies for writes made while persistence holds the database mutex, e.g. during a long snapshot
+const (
+	WriteStallBlock  = "block"  // Writes wait for the persistence to finish
+	WriteStallFail   = "fail"   // Writes that can fail return a *WriteStallError instead of waiting. Others wait.
+	WriteStallBuffer = "buffer" // Puts are appended to the AOF and applied once the persistence finishes. Others wait.
+)
+
+// ErrWriteStalled is returned, wrapped in a *WriteStallError, by writes failed fast by the fail write stall policy
+var ErrWriteStalled = errors.New("writes are stalled by persistence")
+
+// WriteStallError is returned by writes failed fast by the fail write stall policy
+type WriteStallError struct {
+	Kind  string        // The kind of persistence holding the database, as named by the persistence stats
+	Retry time.Duration // An estimate of how long until the persistence finishes, from how long it last took
+}
+
+func (e *WriteStallError) Error() string {
+	return fmt.Sprintf("%v: the %s is in progress, retry in %v", ErrWriteStalled, e.Kind, e.Retry)
+}
+
+func (e *WriteStallError) Unwrap() error {
+	return ErrWriteStalled
+}
+
+// RetryAfter returns how long until the write is likely to succeed. It lets packages that do not import this one, like
+// the handler, tell clients when to retry.
+func (e *WriteStallError) RetryAfter() time.Duration {
+	return e.Retry
+}
+
+// bufferedPut is a put made while persistence held the database mutex, waiting to be applied
+type bufferedPut struct {
+	key       string
+	value     string
+	expiresAt int64 // Unix seconds at which the entry expires. Zero if it never expires.
+}
+
+// writeStall tracks the persistence holding the database mutex, and the puts buffered until it releases it
+type writeStall struct {
+	mu       sync.Mutex
+	kind     string        // The kind of persistence holding the database mutex. Empty when none is.
+	started  time.Time     // When the persistence took the mutex
+	buffered []bufferedPut // In the order they were made
+
+	// applying is set while the buffered puts, which are already in the AOF, are applied. Only accessed with the
+	// database mutex held.
+	applying bool
+}
+
+// WithWriteStallPolicy sets what writes do while a snapshot holds the database: block (the default) waits for it,
+// fail returns a *WriteStallError from the writes that can return an error, and buffer appends puts to the AOF and
+// applies them in order once the snapshot finishes, so that they neither wait nor fail. Other writes wait under every
+// policy. Buffered puts cannot be checked against namespace quotas, so buffer cannot be combined with them.
+func WithWriteStallPolicy(policy string) Options {
+	return func(db *InMemoryDatabase) error {
+		switch policy {
+		case WriteStallBlock, WriteStallFail, WriteStallBuffer:
+		default:
+			return fmt.Errorf("unknown write stall policy %q", policy)
+		}
+		db.s.WriteStallPolicy = policy
+		return nil
+	}
+}
+
+// lockForPersistence locks the database mutex for persistence of the kind. Until unlockForPersistence, writes follow
+// the write stall policy.
+func (i *InMemoryDatabase) lockForPersistence(kind string) {
+	i.mu.Lock()
+	i.stall.mu.Lock()
+	i.stall.kind, i.stall.started = kind, time.Now()
+	i.stall.mu.Unlock()
+}
+
+// unlockForPersistence applies the puts buffered while persistence held the database mutex, then unlocks it. They are
+// applied before any other write can take the mutex so that the database ends up in the order of the AOF.
+func (i *InMemoryDatabase) unlockForPersistence() {
+	i.stall.mu.Lock()
+	buffered := i.stall.buffered
+	i.stall.kind, i.stall.buffered = "", nil
+	i.stall.mu.Unlock()
+
+	i.stall.applying = true
+	now := i.s.clock.Now().Unix()
+	for _, p := range buffered {
+		var ttl *int64
+		if p.expiresAt != 0 {
+			remaining := p.expiresAt - now
+			ttl = &remaining
+		}
+
+		// Without namespace quotas a put cannot fail
+		_, _ = i.put(p.key, p.value, ttl)
+	}
+	i.stall.applying = false
+	i.mu.Unlock()
+}
+
+// lockWrite locks the database mutex for a write that can fail. While persistence holds the mutex, the fail policy
+// returns a *WriteStallError instead, and any wait is recorded against the persistence. While persistence is failing,
+// the reject persistence failure policy returns a *PersistenceFailedError.
+func (i *InMemoryDatabase) lockWrite() error {
+	if err := i.rejectWrite(); err != nil {
+		return err
+	}
+	return i.lockAdmitted()
+}
+
+// lockAdmitted is lockWrite for a write that rejectWrite has already let through
+func (i *InMemoryDatabase) lockAdmitted() error {
+	i.stall.mu.Lock()
+	kind, started := i.stall.kind, i.stall.started
+	i.stall.mu.Unlock()
+
+	if kind != "" && i.s.WriteStallPolicy == WriteStallFail {
+		i.recordStall(kind, stallRejected, 0)
+		retry := i.GetPersistenceStats(kind).LastDuration - time.Since(started)
+		return &WriteStallError{Kind: kind, Retry: max(retry, time.Second)}
+	}
+	i.lockStalled(kind)
+	return nil
+}
+
+// lockStalled locks the database mutex, recording the wait against the persistence of the kind unless it is empty
+func (i *InMemoryDatabase) lockStalled(kind string) {
+	if kind == "" {
+		i.mu.Lock()
+		return
+	}
+	start := time.Now()
+	i.mu.Lock()
+	i.recordStall(kind, stallWaited, time.Since(start))
+}
+
+// lockDelete locks the database mutex for a write that cannot fail, which waits out persistence under every policy
+func (i *InMemoryDatabase) lockDelete() {
+	i.stall.mu.Lock()
+	kind := i.stall.kind
+	i.stall.mu.Unlock()
+	i.lockStalled(kind)
+}
+
+// bufferPut buffers a put with the jittered ttl if persistence holds the database mutex under the buffer policy,
+// returning whether the key already existed and whether the put was buffered. Buffered puts are appended to the AOF
+// straight away, with the sequence number they are given when they are applied.
+func (i *InMemoryDatabase) bufferPut(key string, value string, ttl *int64) (bool, bool) {
+	if i.s.WriteStallPolicy != WriteStallBuffer {
+		return false, false
+	}
+
+	i.stall.mu.Lock()
+	defer i.stall.mu.Unlock()
+	if i.stall.kind == "" {
+		return false, false
+	}
+
+	// Nothing writes to the store or the sequence number while persistence holds the mutex, so both can be read
+	_, loaded := i.load(key)
+	for _, p := range i.stall.buffered {
+		loaded = loaded || p.key == key
+	}
+
+	now := i.s.clock.Now()
+	p := bufferedPut{key: key, value: value}
+	ttl = i.jitter(ttl)
+	if ttl != nil {
+		p.expiresAt = now.Unix() + *ttl
+	}
+	if i.s.ShouldAofPersist {
+		r := aofRecord{op: "PUT", key: key, value: value, ttl: -1, ts: now.UnixMilli(), node: i.s.NodeID}
+		r.seq = i.seq + uint64(len(i.stall.buffered)) + 1
+		if ttl != nil {
+			r.ttl = *ttl
+		}
+		i.appendToAof(string(appendAofRecord(nil, r)))
+	}
+	i.stall.buffered = append(i.stall.buffered, p)
+	i.recordStall(i.stall.kind, stallBuffered, 0)
+	return loaded, true
+}
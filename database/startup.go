@@ -0,0 +1,350 @@
+package database
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DefaultLoadProgressInterval is the number of startup records between progress log lines
+const DefaultLoadProgressInterval = 100000
+
+// maxAofLineLength bounds the length of a single AOF line so that large values can still be replayed
+const maxAofLineLength = 64 << 20
+
+// maxReportedMalformed is how many malformed records are logged and reported by where they are
+const maxReportedMalformed = 10
+
+// startupSummary counts what happened to the records read from the startup files
+type startupSummary struct {
+	files      []string      // The startup files that were loaded, in the order they were loaded
+	loaded     int           // Records applied to the database
+	malformed  int           // Records that could not be parsed and were ignored
+	duplicates int           // Records of operations that were already replayed and were ignored
+	expired    int           // Records that had already expired and were dropped
+	duration   time.Duration // How long loading took
+
+	// Where the first malformed records are and why they could not be parsed, e.g. aof:12: too few fields
+	malformedRecords []string
+}
+
+// skipped returns the records that were ignored
+func (s *startupSummary) skipped() int {
+	return s.malformed + s.duplicates
+}
+
+// loader accumulates the startup files into a plain map so that the store is only replaced once
+type loader struct {
+	db      *InMemoryDatabase
+	file    string
+	entries dbStore
+	heap    ttlHeap
+	now     int64
+	summary *startupSummary
+	records int
+	seq     uint64            // The highest sequence number seen
+	lastSeq map[string]uint64 // The last sequence number replayed for each node
+}
+
+// loadStartupFiles loads the database startup file followed by the AOF startup file. It is called once all options
+// have been applied so that the logger, clock and concurrency mode are honored regardless of option order.
+func (i *InMemoryDatabase) loadStartupFiles() error {
+	if i.s.DatabaseStartupFile == "" && i.s.AofStartupFile == "" {
+		return nil
+	}
+
+	start := time.Now()
+	l := &loader{
+		db:      i,
+		entries: maps.Clone(i.database.entries()),
+		heap:    append(ttlHeap{}, *i.ttl...),
+		now:     i.s.clock.Now().Unix(),
+		summary: &i.startup,
+		seq:     i.seq,
+		lastSeq: map[string]uint64{},
+	}
+
+	if i.s.DatabaseStartupFile != "" {
+		l.file = i.s.DatabaseStartupFile
+		i.startup.files = append(i.startup.files, l.file)
+		if err := l.loadSnapshot(); err != nil {
+			return fmt.Errorf("loading %s: %w", l.file, err)
+		}
+	}
+
+	if i.s.AofStartupFile != "" {
+		l.file = i.s.AofStartupFile
+		i.startup.files = append(i.startup.files, l.file)
+		if err := l.loadAof(); err != nil {
+			return fmt.Errorf("loading %s: %w", l.file, err)
+		}
+	}
+
+	// Only keep heap entries that still match a loaded entry, then restore the heap invariant
+	valid := l.heap[:0]
+	for _, h := range l.heap {
+		if e, ok := l.entries[h.key]; ok && e.expiresAt == h.ttl {
+			valid = append(valid, h)
+		}
+	}
+	*i.ttl = valid
+	heap.Init(i.ttl)
+	if i.s.CompressionThreshold > 0 {
+		for key, e := range l.entries {
+			l.entries[key] = i.compressEntry(e)
+		}
+	}
+	i.database.reset(l.entries)
+
+	// Continue the sequence from where the startup files left off
+	i.seq = l.seq
+
+	i.startup.duration = time.Since(start)
+	i.s.logger.Info("loaded startup data",
+		"keys", i.database.len(),
+		"loaded", i.startup.loaded,
+		"skipped", i.startup.skipped(),
+		"malformed", i.startup.malformed,
+		"duplicates", i.startup.duplicates,
+		"expired", i.startup.expired,
+		"duration", i.startup.duration)
+	if i.startup.malformed > 0 {
+		i.s.logger.Warn("skipped malformed startup records, whose data was not loaded", "malformed", i.startup.malformed)
+	}
+	return nil
+}
+
+// record counts a processed record and periodically logs progress
+func (l *loader) record() {
+	l.records++
+	if l.db.s.LoadProgressInterval > 0 && l.records%l.db.s.LoadProgressInterval == 0 {
+		l.db.s.logger.Info("loading startup data",
+			"file", l.file,
+			"records", l.records,
+			"loaded", l.summary.loaded,
+			"skipped", l.summary.skipped(),
+			"expired", l.summary.expired)
+	}
+}
+
+// put applies a loaded entry, dropping it if it has already expired
+func (l *loader) put(key string, e databaseEntry) {
+	defer l.record()
+	if e.expired(l.now) {
+		// An expired record still replaces whatever was loaded before it
+		delete(l.entries, key)
+		l.summary.expired++
+		return
+	}
+
+	l.entries[key] = e
+	if e.expiresAt != 0 {
+		l.heap = append(l.heap, ttlHeapData{key, e.expiresAt})
+	}
+	l.summary.loaded++
+}
+
+// skipMalformed counts a record that could not be parsed, logging and reporting where it is if it is one of the first
+func (l *loader) skipMalformed(at string, err error) {
+	defer l.record()
+	l.summary.malformed++
+	if len(l.summary.malformedRecords) < maxReportedMalformed {
+		where := l.file + ":" + at
+		l.summary.malformedRecords = append(l.summary.malformedRecords, fmt.Sprintf("%s: %v", where, err))
+		l.db.s.logger.Warn("skipping malformed startup record", "at", where, "err", err)
+	}
+}
+
+// skipDuplicate counts a record of an operation that was already replayed
+func (l *loader) skipDuplicate() {
+	defer l.record()
+	l.summary.duplicates++
+}
+
+// loadSnapshot streams a JSON snapshot so that the file is never held in memory as a whole. Entries are decoded one
+// at a time and entries that do not match the expected shape are skipped.
+func (l *loader) loadSnapshot() error {
+	file, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(bufio.NewReaderSize(file, 1<<20))
+	if err = expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		name, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case "dbStore":
+			err = l.streamEntries(dec)
+		case "seq":
+			var seq uint64
+			err = dec.Decode(&seq)
+			l.seq = max(l.seq, seq)
+		default:
+			// The ttl heap is rebuilt from the entries so it is skipped along with any unknown fields
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, '}')
+}
+
+// streamEntries decodes the dbStore object one entry at a time
+func (l *loader) streamEntries(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("expected dbStore to be an object, got %v", tok)
+	}
+
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+
+		// A type error still consumes the value so decoding can carry on with the next entry
+		var e databaseEntry
+		err = dec.Decode(&e)
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			l.skipMalformed(strconv.Quote(key), err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		l.put(key, e)
+	}
+
+	return expectDelim(dec, '}')
+}
+
+// skipValue consumes the next value token by token so that large values are never buffered whole
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if d, ok := tok.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// expectDelim reads the next token and checks that it is the delimiter d
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if got, ok := tok.(json.Delim); !ok || got != d {
+		return fmt.Errorf("expected %v, got %v", d, tok)
+	}
+	return nil
+}
+
+// loadAof replays an AOF file line by line. Malformed and duplicate lines are skipped. When a replay point is set,
+// replay stops at the first timestamped record written after it. Legacy records carry no timestamp and are always
+// replayed.
+func (l *loader) loadAof() error {
+	file, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	until := int64(0)
+	if !l.db.s.ReplayUntil.IsZero() {
+		until = l.db.s.ReplayUntil.UnixMilli()
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxAofLineLength)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		r, err := parseAofRecord(line)
+		if err != nil {
+			l.skipMalformed(strconv.Itoa(lineNumber), err)
+			continue
+		}
+
+		// An operation that was already replayed for its node is a duplicate, e.g. from a combined or retried AOF
+		if r.seq != 0 {
+			if r.seq <= l.lastSeq[r.node] {
+				l.skipDuplicate()
+				continue
+			}
+			l.lastSeq[r.node] = r.seq
+			l.seq = max(l.seq, r.seq)
+		}
+
+		if until != 0 && r.ts > until {
+			l.db.s.logger.Info("stopped aof replay at point in time",
+				"until", l.db.s.ReplayUntil,
+				"next", time.UnixMilli(r.ts),
+				"records", l.records)
+			break
+		}
+
+		switch r.op {
+		case "PUT":
+			// Legacy records do not record when they were written so the replay time is used instead
+			d := databaseEntry{
+				value:     r.value,
+				expiresAt: r.expiresAt(),
+				updatedAt: l.now,
+				version:   r.seq,
+			}
+			if r.ts != 0 {
+				d.updatedAt = r.ts / 1000
+			}
+			l.put(r.key, d)
+		case "DELETE":
+			delete(l.entries, r.key)
+			l.summary.loaded++
+			l.record()
+		}
+	}
+
+	return scanner.Err()
+}
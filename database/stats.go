@@ -0,0 +1,94 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+// keyStats is the access statistics of a key. Like change, it is an alias of an unnamed struct so that the handler can
+// describe it without importing this package.
+type keyStats = struct {
+	Hits       uint64    // Reads of the key
+	Updates    uint64    // Writes of the key, including the one that created it
+	LastAccess time.Time // When the key was last read or written. The zero time if it has not been since it was loaded.
+	Size       int       // The length in bytes of the key and its stored value, which is compressed if it is large
+}
+
+// accessCounter counts the reads and writes of every key
+type accessCounter struct {
+	mu   sync.Mutex           // Guards keys, which is updated by reads that do not hold the database mutex
+	keys map[string]*keyStats // The statistics of every key read or written. Nil without WithKeyStats.
+}
+
+// WithKeyStats counts the reads and writes of every key and when it was last used, so that KeyStats can show which keys
+// earn their memory. Counting takes a lock on every read and write, which slows them down a little. Only reads and
+// writes made after the startup files are loaded are counted, and the counts of a key are dropped when it is deleted
+// or expires.
+func WithKeyStats() Options {
+	return func(db *InMemoryDatabase) error {
+		db.s.TrackKeyStats = true
+		return nil
+	}
+}
+
+// startKeyStats starts counting once the startup files are loaded
+func (i *InMemoryDatabase) startKeyStats() {
+	if i.s.TrackKeyStats {
+		i.stats.keys = map[string]*keyStats{}
+	}
+}
+
+// countAccess counts a read or a write of the key
+func (i *InMemoryDatabase) countAccess(key string, write bool) {
+	if i.stats.keys == nil {
+		return
+	}
+	now := i.s.clock.Now()
+
+	i.stats.mu.Lock()
+	defer i.stats.mu.Unlock()
+	s, ok := i.stats.keys[key]
+	if !ok {
+		s = &keyStats{}
+		i.stats.keys[key] = s
+	}
+	if write {
+		s.Updates++
+	} else {
+		s.Hits++
+	}
+	s.LastAccess = now
+}
+
+// forgetStats drops the counts of a key that was deleted or expired
+func (i *InMemoryDatabase) forgetStats(key string) {
+	if i.stats.keys == nil {
+		return
+	}
+	i.stats.mu.Lock()
+	defer i.stats.mu.Unlock()
+	delete(i.stats.keys, key)
+}
+
+// KeyStats returns the access statistics of the key and whether it exists, or false as the last value if the database
+// does not count them. Getting the statistics does not count as a read.
+func (i *InMemoryDatabase) KeyStats(key string) (keyStats, bool, bool) {
+	_ = i.injectFailure(false)
+
+	if i.stats.keys == nil {
+		return keyStats{}, false, false
+	}
+	dbEntry, loaded := i.readLoad(key)
+	if !loaded || dbEntry.expiredNow(i.s.clock) {
+		return keyStats{}, false, true
+	}
+
+	var s keyStats
+	i.stats.mu.Lock()
+	if counted, ok := i.stats.keys[key]; ok {
+		s = *counted
+	}
+	i.stats.mu.Unlock()
+	s.Size = len(key) + len(dbEntry.value)
+	return s, true, true
+}
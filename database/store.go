@@ -0,0 +1,313 @@
+package database
+
+import (
+	"fmt"
+	"hash/maphash"
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// The supported concurrency modes for the key value store
+const (
+	ConcurrencyRWMutex = "rwmutex" // A single map guarded by the database mutex. Reads and writes contend.
+	ConcurrencySharded = "sharded" // Maps split across shards with their own locks. Reads only contend with writes to their shard.
+	ConcurrencyCOW     = "cow"     // A copy-on-write map. Reads never lock but every write copies the whole map.
+)
+
+// kvStore holds the database key value pairs. Writes are always made with the database mutex held, so
+// implementations only need to synchronize writes against reads made without it.
+type kvStore interface {
+	load(key string) (databaseEntry, bool)
+	store(key string, d databaseEntry)
+	storeAll(m dbStore) // Store every entry of m, as a single write where possible
+	delete(key string)
+	len() int
+	entries() dbStore // The current contents. The result must not be modified.
+	reset(m dbStore)  // Replace the contents with m, which the store takes ownership of
+
+	// rangeEntries calls f for every entry until f returns false, without copying the contents, so that it can be
+	// ranged over. f must not write to the store, as parts of it may be locked while f runs.
+	rangeEntries(f func(key string, d databaseEntry) bool)
+
+	// concurrentReads reports whether load is safe to call without holding the database mutex
+	concurrentReads() bool
+
+	// parts is the number of parts that snapshotPart splits the contents into. Every key belongs to a single part.
+	parts() int
+	// snapshotPart returns the contents of part n. The result must not be modified but is not modified by later
+	// writes either. The database mutex must be held unless concurrentReads is true.
+	snapshotPart(n int) dbStore
+	// compactPart rebuilds the map of part n at the size of its contents, so that the memory left behind by deleted
+	// keys can be returned. The database mutex must be held.
+	compactPart(n int)
+}
+
+// newStore returns an empty store for the concurrency mode
+func newStore(mode string) (kvStore, error) {
+	switch mode {
+	case ConcurrencyRWMutex:
+		return &dbStore{}, nil
+	case ConcurrencySharded:
+		return newShardedStore(), nil
+	case ConcurrencyCOW:
+		return newCowStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown concurrency mode %q", mode)
+	}
+}
+
+func (s *dbStore) load(key string) (databaseEntry, bool) {
+	d, loaded := (*s)[key]
+	return d, loaded
+}
+
+func (s *dbStore) store(key string, d databaseEntry) {
+	(*s)[key] = d
+}
+
+func (s *dbStore) storeAll(m dbStore) {
+	maps.Copy(*s, m)
+}
+
+func (s *dbStore) delete(key string) {
+	delete(*s, key)
+}
+
+func (s *dbStore) len() int {
+	return len(*s)
+}
+
+func (s *dbStore) entries() dbStore {
+	return *s
+}
+
+func (s *dbStore) rangeEntries(f func(key string, d databaseEntry) bool) {
+	for k, d := range *s {
+		if !f(k, d) {
+			return
+		}
+	}
+}
+
+func (s *dbStore) reset(m dbStore) {
+	clear(*s)
+	maps.Copy(*s, m)
+}
+
+func (s *dbStore) concurrentReads() bool {
+	return false
+}
+
+func (s *dbStore) parts() int {
+	return 1
+}
+
+func (s *dbStore) snapshotPart(int) dbStore {
+	return maps.Clone(*s)
+}
+
+func (s *dbStore) compactPart(int) {
+	*s = compactMap(*s)
+}
+
+// shardCount is the number of shards used by shardedStore
+const shardCount = 32
+
+// shardedStore spreads keys across shards so that a read only waits on writes to the same shard
+type shardedStore struct {
+	seed   maphash.Seed
+	shards [shardCount]struct {
+		mu sync.RWMutex
+		m  dbStore
+	}
+}
+
+func newShardedStore() *shardedStore {
+	s := &shardedStore{seed: maphash.MakeSeed()}
+	for i := range s.shards {
+		s.shards[i].m = dbStore{}
+	}
+	return s
+}
+
+// shard returns the index of the shard holding key
+func (s *shardedStore) shard(key string) int {
+	return int(maphash.String(s.seed, key) % shardCount)
+}
+
+func (s *shardedStore) load(key string) (databaseEntry, bool) {
+	sh := &s.shards[s.shard(key)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.m.load(key)
+}
+
+func (s *shardedStore) store(key string, d databaseEntry) {
+	sh := &s.shards[s.shard(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.m.store(key, d)
+}
+
+func (s *shardedStore) storeAll(m dbStore) {
+	for k, d := range m {
+		s.store(k, d)
+	}
+}
+
+func (s *shardedStore) delete(key string) {
+	sh := &s.shards[s.shard(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.m.delete(key)
+}
+
+func (s *shardedStore) len() int {
+	n := 0
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+		n += len(s.shards[i].m)
+		s.shards[i].mu.RUnlock()
+	}
+	return n
+}
+
+// entries merges the shards into a new map. Writers hold the database mutex so the result is consistent.
+func (s *shardedStore) entries() dbStore {
+	m := make(dbStore, s.len())
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+		maps.Copy(m, s.shards[i].m)
+		s.shards[i].mu.RUnlock()
+	}
+	return m
+}
+
+// rangeEntries walks one shard at a time, holding only the lock of that shard
+func (s *shardedStore) rangeEntries(f func(key string, d databaseEntry) bool) {
+	for i := range s.shards {
+		if !s.rangeShard(i, f) {
+			return
+		}
+	}
+}
+
+// rangeShard calls f for every entry of shard n, reporting whether every call returned true
+func (s *shardedStore) rangeShard(n int, f func(key string, d databaseEntry) bool) bool {
+	s.shards[n].mu.RLock()
+	defer s.shards[n].mu.RUnlock()
+	for k, d := range s.shards[n].m {
+		if !f(k, d) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *shardedStore) reset(m dbStore) {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+		s.shards[i].m = dbStore{}
+		s.shards[i].mu.Unlock()
+	}
+	s.storeAll(m)
+}
+
+func (s *shardedStore) concurrentReads() bool {
+	return true
+}
+
+// parts snapshots one shard at a time so that only a single shard is locked while it is copied
+func (s *shardedStore) parts() int {
+	return shardCount
+}
+
+func (s *shardedStore) snapshotPart(n int) dbStore {
+	s.shards[n].mu.RLock()
+	defer s.shards[n].mu.RUnlock()
+	return maps.Clone(s.shards[n].m)
+}
+
+func (s *shardedStore) compactPart(n int) {
+	s.shards[n].mu.Lock()
+	defer s.shards[n].mu.Unlock()
+	s.shards[n].m = compactMap(s.shards[n].m)
+}
+
+// cowStore publishes an immutable map through an atomic pointer. Reads load the current map without locking and
+// writes replace it with a modified copy, which suits read-dominant workloads with small datasets.
+type cowStore struct {
+	m atomic.Pointer[dbStore]
+}
+
+func newCowStore() *cowStore {
+	s := &cowStore{}
+	s.m.Store(&dbStore{})
+	return s
+}
+
+func (s *cowStore) load(key string) (databaseEntry, bool) {
+	return s.m.Load().load(key)
+}
+
+// update publishes a modified copy of the current map
+func (s *cowStore) update(f func(m dbStore)) {
+	m := maps.Clone(*s.m.Load())
+	f(m)
+	s.m.Store(&m)
+}
+
+func (s *cowStore) store(key string, d databaseEntry) {
+	s.update(func(m dbStore) { m[key] = d })
+}
+
+func (s *cowStore) storeAll(m dbStore) {
+	s.update(func(c dbStore) { maps.Copy(c, m) })
+}
+
+func (s *cowStore) delete(key string) {
+	// Deleting a missing key does not need a copy
+	if _, ok := s.load(key); !ok {
+		return
+	}
+	s.update(func(m dbStore) { delete(m, key) })
+}
+
+func (s *cowStore) len() int {
+	return len(*s.m.Load())
+}
+
+func (s *cowStore) entries() dbStore {
+	return *s.m.Load()
+}
+
+func (s *cowStore) rangeEntries(f func(key string, d databaseEntry) bool) {
+	s.m.Load().rangeEntries(f)
+}
+
+func (s *cowStore) reset(m dbStore) {
+	if m == nil {
+		m = dbStore{}
+	}
+	s.m.Store(&m)
+}
+
+func (s *cowStore) concurrentReads() bool {
+	return true
+}
+
+func (s *cowStore) parts() int {
+	return 1
+}
+
+// snapshotPart does not need to copy since the current map is never modified
+func (s *cowStore) snapshotPart(int) dbStore {
+	return *s.m.Load()
+}
+
+// compactPart publishes a rebuilt copy of the current map
+func (s *cowStore) compactPart(int) {
+	m := compactMap(*s.m.Load())
+	s.m.Store(&m)
+}
@@ -0,0 +1,57 @@
+package database
+
+import "time"
+
+// ttlBucket counts the keys expiring within a duration from now. It is an alias of an unnamed struct so that packages
+// consuming histograms, like the handler, can describe it without importing this package.
+type ttlBucket = struct {
+	Within time.Duration // Keys expiring at most this long from now are counted
+	Keys   int
+	Bytes  int64 // The total length of the keys and their stored values, which is freed once they expire
+}
+
+// GetTTLHistogram counts the keys expiring within each of the bounds from now, so that operators can anticipate mass
+// expirations. Buckets are cumulative, and keys that have expired but not been removed by the ttl cleaner yet count
+// towards every bucket. The total covers every key with a ttl. It is computed from the ttl heap, so keys without a ttl
+// cost nothing.
+func (i *InMemoryDatabase) GetTTLHistogram(bounds []time.Duration) struct {
+	Buckets []ttlBucket
+	Total   ttlBucket
+} {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	histogram := struct {
+		Buckets []ttlBucket
+		Total   ttlBucket
+	}{Buckets: make([]ttlBucket, len(bounds))}
+	for n, bound := range bounds {
+		histogram.Buckets[n].Within = bound
+	}
+
+	// The heap keeps entries for ttls that have since been changed, and may hold the current ttl of a key twice
+	now := i.s.clock.Now()
+	seen := make(map[string]struct{}, len(*i.ttl))
+	for _, h := range *i.ttl {
+		dbEntry, loaded := i.load(h.key)
+		if !loaded || dbEntry.expiresAt != h.ttl {
+			continue
+		}
+		if _, ok := seen[h.key]; ok {
+			continue
+		}
+		seen[h.key] = struct{}{}
+
+		size := entrySize(h.key, dbEntry.value)
+		left := time.Duration(h.ttl-now.Unix()) * time.Second
+		for n := range histogram.Buckets {
+			if left <= histogram.Buckets[n].Within {
+				histogram.Buckets[n].Keys++
+				histogram.Buckets[n].Bytes += size
+			}
+		}
+		histogram.Total.Keys++
+		histogram.Total.Bytes += size
+	}
+	return histogram
+}
@@ -0,0 +1,113 @@
+package database
+
+import "context"
+
+// Entry is a key, value pair with an optional ttl in seconds
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Ttl   *int64 `json:"ttl"`
+}
+
+// WarmupFetcher returns the entries to warm the database with once the startup files have been loaded. The context is
+// canceled when the database shuts down.
+type WarmupFetcher func(ctx context.Context) ([]Entry, error)
+
+// warmup tracks the warmup that runs after the startup files have been loaded
+type warmup struct {
+	fetch  WarmupFetcher
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once warmup has finished, whether or not it succeeded
+}
+
+// WithWarmupFetcher sets a function whose entries are written to the database in the background once the startup
+// files have been loaded. Keys that already exist are left alone, since the startup files hold fresher data than a
+// cache warming source. Ready reports false until warmup has finished.
+func WithWarmupFetcher(f WarmupFetcher) Options {
+	return func(db *InMemoryDatabase) error {
+		db.warmup.fetch = f
+		return nil
+	}
+}
+
+// startWarmup runs the warmup fetcher in the background, if there is one
+func (i *InMemoryDatabase) startWarmup() {
+	i.warmup.done = make(chan struct{})
+	if i.warmup.fetch == nil {
+		close(i.warmup.done)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i.warmup.cancel = cancel
+	go func() {
+		defer close(i.warmup.done)
+		defer cancel()
+		defer func() {
+			if r := recover(); r != nil {
+				i.s.logger.Error("recovered from a panic during warmup", "panic", r)
+			}
+		}()
+		i.warm(ctx)
+	}()
+}
+
+// warm fetches the warmup entries and creates the ones that do not exist yet. Failed fetches and writes are logged and
+// the database becomes ready with whatever was loaded, since warming is an optimization rather than a source of truth.
+func (i *InMemoryDatabase) warm(ctx context.Context) {
+	i.s.logger.Info("warming the database")
+	entries, err := i.warmup.fetch(ctx)
+	if err != nil {
+		i.s.logger.Error("error fetching warmup entries", "err", err)
+		return
+	}
+
+	loaded, skipped := 0, 0
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			i.s.logger.Warn("warmup canceled", "loaded", loaded)
+			return
+		}
+		if e.Key == "" {
+			skipped++
+			continue
+		}
+		created, _, err := i.Create(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: e.Key, Value: e.Value, Ttl: e.Ttl})
+		if err != nil {
+			i.s.logger.Warn("skipping a warmup entry", "key", e.Key, "err", err)
+		}
+		if !created {
+			skipped++
+			continue
+		}
+		loaded++
+	}
+	i.s.logger.Info("warmed the database", "loaded", loaded, "skipped", skipped)
+}
+
+// Ready reports whether the database has finished loading, including any warmup
+func (i *InMemoryDatabase) Ready() bool {
+	if i.warmup.done == nil {
+		return true
+	}
+	select {
+	case <-i.warmup.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopWarmup cancels a warmup that is still running and waits for it to finish
+func (i *InMemoryDatabase) stopWarmup() {
+	if i.warmup.cancel != nil {
+		i.warmup.cancel()
+	}
+	if i.warmup.done != nil {
+		<-i.warmup.done
+	}
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// WithAdminToken requires requests to the /v1/admin routes to carry the token in an Authorization: Bearer header.
+// Without a token the admin routes are open to anyone who can reach the server.
+func WithAdminToken(token string) Options {
+	return func(h *Wrapper) {
+		h.s.adminToken = token
+	}
+}
+
+// WithoutAdmin leaves the /v1/admin routes unregistered so that they respond with a 404, for deployments where the
+// server must not be reconfigured or inspected over HTTP
+func WithoutAdmin() Options {
+	return func(h *Wrapper) {
+		h.s.adminDisabled = true
+	}
+}
+
+// isAdminPath reports whether a request path belongs to the admin route group
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/v1/admin/")
+}
+
+// authorizedAdmin reports whether a request carries the admin token, if one is required
+func (h *Wrapper) authorizedAdmin(r *http.Request) bool {
+	if h.s.adminToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.s.adminToken)) == 1
+}
+
+// adminMiddleware checks the admin token of requests to the admin route group and writes an audit record of each one,
+// including those that were refused
+func (h *Wrapper) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw, ok := w.(*statusResponseWriter)
+		if !ok {
+			sw = getStatusWriter(w)
+			defer putStatusWriter(sw)
+		}
+		authorized := h.authorizedAdmin(r)
+		if authorized {
+			next.ServeHTTP(sw, r)
+		} else {
+			sw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSONError(sw, http.StatusUnauthorized, CodeUnauthorized, "A valid admin token is required")
+		}
+
+		h.logger.Info("admin audit",
+			"method", r.Method,
+			"URI", r.RequestURI,
+			"remote", r.RemoteAddr,
+			"userAgent", r.UserAgent(),
+			"authorized", authorized,
+			"status", sw.statusCode)
+	})
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// errNotBitmap is returned from the update of a bit to leave the stored value unchanged
+var errNotBitmap = errors.New("the stored value is not a base64 encoded bitmap")
+
+type setBitRequest struct {
+	Value *int `json:"value" validate:"required,oneof=0 1"`
+}
+
+type bitResponse struct {
+	Key      string `json:"key"`
+	Offset   uint64 `json:"offset"`
+	Value    int    `json:"value"`
+	Previous *int   `json:"previous,omitempty"` // The bit before it was set
+}
+
+type bitCountResponse struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"` // The number of bits that are set
+}
+
+// decodeBitmap decodes a bitmap stored as standard base64, so that bitmaps survive snapshots and the AOF like any
+// other value. Bits are numbered from the most significant bit of the first byte, and an empty value has no bits set.
+func decodeBitmap(value string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errNotBitmap
+	}
+	return b, nil
+}
+
+// bitAt returns the bit at the offset, which is 0 past the end of the bitmap
+func bitAt(bitmap []byte, offset uint64) int {
+	if offset/8 >= uint64(len(bitmap)) {
+		return 0
+	}
+	return int(bitmap[offset/8]>>(7-offset%8)) & 1
+}
+
+// parseBitOffset reads the offset of a bit from the request, writing a 400 and returning false if it is not a valid
+// offset or addresses a byte that would put the bitmap over the maximum value length once encoded
+func (h *Wrapper) parseBitOffset(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	offset, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing bit offset: %v", err))
+		return 0, false
+	}
+	if maxBytes := uint64(h.s.maxValueLength / 4 * 3); offset/8 >= maxBytes {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed,
+			fmt.Sprintf("The bit offset must be below %v to stay within the maximum value length", maxBytes*8))
+		return 0, false
+	}
+	return offset, true
+}
+
+// setBitHandler sets or clears the bit at the offset of the bitmap stored under the request key, like SETBIT, growing
+// the bitmap with zero bytes as needed. Keys that don't exist are created as an empty bitmap without a ttl. The bit is
+// updated atomically by the database, so concurrent updates to different bits are never lost.
+func (h *Wrapper) setBitHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if err := h.validate.Var(key, "dbkey"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing bitmap key: %v", err))
+		return
+	}
+	offset, ok := h.parseBitOffset(w, r)
+	if !ok {
+		return
+	}
+
+	var rData setBitRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing set bit request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing set bit request: %v", err))
+		return
+	}
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+
+	var previous int
+	_, err := h.db.Upsert(key, func(value string, exists bool) (string, error) {
+		bitmap, err := decodeBitmap(value)
+		if err != nil {
+			return "", err
+		}
+		previous = bitAt(bitmap, offset)
+		if n := int(offset/8) + 1; n > len(bitmap) {
+			bitmap = append(bitmap, make([]byte, n-len(bitmap))...)
+		}
+		mask := byte(1) << (7 - offset%8)
+		if *rData.Value == 1 {
+			bitmap[offset/8] |= mask
+		} else {
+			bitmap[offset/8] &^= mask
+		}
+		return base64.StdEncoding.EncodeToString(bitmap), nil
+	})
+	switch {
+	case errors.Is(err, errNotBitmap):
+		writeJSONError(w, http.StatusConflict, CodeValueNotBitmap, "Cannot set a bit of "+key+": "+err.Error())
+	case err != nil:
+		h.writeFailed(w, key, err)
+	default:
+		writeJSON(w, http.StatusOK, bitResponse{Key: key, Offset: offset, Value: *rData.Value, Previous: &previous})
+	}
+}
+
+// getBitHandler returns the bit at the offset of the bitmap stored under the request key, like GETBIT. Bits past the
+// end of the bitmap and of keys that don't exist are 0.
+func (h *Wrapper) getBitHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	offset, ok := h.parseBitOffset(w, r)
+	if !ok {
+		return
+	}
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+	entry, _ := h.getEntry(key)
+	bitmap, err := decodeBitmap(entry.Value)
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, CodeValueNotBitmap, "Cannot get a bit of "+key+": "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, bitResponse{Key: key, Offset: offset, Value: bitAt(bitmap, offset)})
+}
+
+// bitCountHandler returns the number of bits that are set in the bitmap stored under the request key, like BITCOUNT.
+// Keys that don't exist have no bits set.
+func (h *Wrapper) bitCountHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+	entry, _ := h.getEntry(key)
+	bitmap, err := decodeBitmap(entry.Value)
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, CodeValueNotBitmap, "Cannot count the bits of "+key+": "+err.Error())
+		return
+	}
+
+	count := 0
+	for _, b := range bitmap {
+		count += bits.OnesCount8(b)
+	}
+	writeJSON(w, http.StatusOK, bitCountResponse{Key: key, Count: count})
+}
@@ -0,0 +1,50 @@
+package handler
+
+// RelayHeader marks a publish that was relayed from another instance of the server. Its value is the node ID of the
+// instance the message was published on.
+const RelayHeader = "X-InMemoryDB-Relayed"
+
+// Bridge forwards messages published to the broker to an external message broker such as NATS
+type Bridge interface {
+	Forward(channel string, message string) error // Send a message published to the channel to the external broker
+}
+
+// WithBridges sets the bridges that published messages are forwarded to. Messages are delivered to local subscribers
+// even if forwarding fails.
+func WithBridges(bridges ...Bridge) Options {
+	return func(h *Wrapper) {
+		h.bridges = append(h.bridges, bridges...)
+	}
+}
+
+// Deliver sends a message to the local subscribers and webhooks of a channel without forwarding it to the bridges.
+// Bridges use it to deliver messages consumed from external brokers, and it returns the number of subscribers the
+// message was sent to. A consumer group receives the message once, sent to one of its members. The broker lock is only
+// held to look up the subscribers, so subscribing and unsubscribing are never held up by a large fan-out.
+func (h *Wrapper) Deliver(channel string, message string) int {
+	h.publishToWebhooks(channel, message)
+
+	h.broker.mu.RLock()
+	c := h.broker.channels[channel]
+	h.broker.mu.RUnlock()
+	if c == nil {
+		return 0
+	}
+
+	sent := h.offerAll(c.subscribers, message)
+	for _, g := range c.groups {
+		if h.offerGroup(g, message) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// forward sends a published message to every bridge, logging the bridges that fail
+func (h *Wrapper) forward(channel string, message string) {
+	for _, b := range h.bridges {
+		if err := b.Forward(channel, message); err != nil {
+			h.logger.Warn("error forwarding a published message", "channel", channel, "error", err)
+		}
+	}
+}
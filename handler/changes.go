@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// change is a mutation in the change feed of the database. Like mirrorStats, it is an alias of an unnamed struct so
+// that the database satisfies the interface without either package importing the other.
+type change = struct {
+	Seq       uint64    // The sequence number of the mutation
+	Op        string    // put or delete
+	Key       string    // The key that changed
+	Value     string    // The written value. Empty for deletes.
+	ExpiresAt int64     // Unix seconds at which the written key expires. Zero if it never expires.
+	Time      time.Time // When the change happened
+}
+
+// changeFeedError is implemented by the database errors for changes that cannot be read. Truncated reports whether
+// the changes were dropped from the change log rather than the change feed being disabled.
+type changeFeedError interface {
+	error
+	Truncated() bool
+}
+
+// changeResponse is a line of the change feed
+type changeResponse struct {
+	Seq       uint64     `json:"seq"`
+	Op        string     `json:"op"`
+	Key       string     `json:"key"`
+	Value     *string    `json:"value,omitempty"` // The written value. Omitted for deletes.
+	ExpiresAt *time.Time `json:"expiresAt"`       // When the written key expires, or null if it does not
+	Time      time.Time  `json:"time"`
+}
+
+// changesHandler streams every mutation after the since query parameter as NDJSON, one {"seq", "op", "key", "value",
+// "expiresAt", "time"} object per line in sequence order. The stream then follows new changes until the client goes
+// away, unless follow=false is given, in which case it ends once it has caught up. Consumers resume by passing the seq
+// of the last line they processed. Changes that are no longer retained get a 410, after which consumers have to
+// resync, e.g. from an export whose X-DB-Generation header is the seq to follow from. The optional prefix parameter
+// limits the stream to keys with the prefix.
+func (h *Wrapper) changesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var since uint64
+	if s := query.Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing since: %v", err))
+			return
+		}
+	}
+	follow := query.Get("follow") != "false"
+	prefix := query.Get("prefix")
+
+	changes, wake, err := h.db.ReadChanges(since, streamPageSize)
+	var feedErr changeFeedError
+	switch {
+	case errors.As(err, &feedErr) && feedErr.Truncated():
+		writeJSONError(w, http.StatusGone, CodeChangesTruncated, err.Error())
+		return
+	case errors.As(err, &feedErr):
+		writeJSONError(w, http.StatusNotImplemented, CodeChangeFeedDisabled, err.Error())
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+
+	if follow {
+		remove, ok := h.addStreamSubscriber(w, r)
+		if !ok {
+			return
+		}
+		defer remove()
+	}
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", NDJSONContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		for _, c := range changes {
+			since = c.Seq
+			if isInternalKey(c.Key) || !strings.HasPrefix(c.Key, prefix) {
+				continue
+			}
+			line := changeResponse{Seq: c.Seq, Op: c.Op, Key: c.Key, Time: c.Time}
+			if c.Op == "put" {
+				line.Value = &c.Value
+			}
+			if c.ExpiresAt != 0 {
+				e := time.Unix(c.ExpiresAt, 0).UTC()
+				line.ExpiresAt = &e
+			}
+			if err = enc.Encode(line); err != nil {
+				return
+			}
+		}
+		_ = rc.Flush()
+
+		// Wait for more changes once caught up
+		if len(changes) < streamPageSize {
+			if !follow {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-wake:
+			}
+		}
+
+		// A consumer that fell too far behind ends the stream, and gets a 410 when it resumes from the last seq
+		if changes, wake, err = h.db.ReadChanges(since, streamPageSize); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// ChannelPermission is a set of operations a token may perform on a channel
+type ChannelPermission int
+
+const (
+	ChannelPublish   ChannelPermission = 1 << iota // Publish messages to the channel
+	ChannelSubscribe                               // Subscribe to the channel
+)
+
+// channelGrant gives a token permissions on the channels matching a pattern
+type channelGrant struct {
+	token       string
+	pattern     string
+	permissions ChannelPermission
+}
+
+// WithChannelACL gives the token the permissions on the channels matching the pattern. Patterns use the syntax of
+// path.Match, so "orders.*" matches every channel starting with "orders.". Once a channel matches the pattern of any
+// grant, publishing or subscribing to it requires an Authorization: Bearer header with a token granted that
+// permission. Channels that match no pattern stay open, so a "*" grant is needed to restrict every channel.
+func WithChannelACL(token string, pattern string, permissions ChannelPermission) Options {
+	return func(h *Wrapper) {
+		h.s.channelGrants = append(h.s.channelGrants, channelGrant{token: token, pattern: pattern, permissions: permissions})
+	}
+}
+
+// authorizeChannel checks that a request may perform the operation on the channel, writing a 401 if it needs a token
+// and carries none or an unknown one, and a 403 if its token lacks the permission. It reports whether the request may
+// continue.
+func (h *Wrapper) authorizeChannel(w http.ResponseWriter, r *http.Request, channel string, permission ChannelPermission) bool {
+	restricted := false
+	for _, g := range h.s.channelGrants {
+		if ok, _ := path.Match(g.pattern, channel); ok {
+			restricted = true
+			break
+		}
+	}
+	if !restricted {
+		return true
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	known := false
+	for _, g := range h.s.channelGrants {
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			continue
+		}
+		known = true
+		if ok, _ := path.Match(g.pattern, channel); ok && g.permissions&permission != 0 {
+			return true
+		}
+	}
+
+	if !known {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="channels"`)
+		writeJSONError(w, http.StatusUnauthorized, CodeUnauthorized, "A valid channel token is required for "+channel)
+		return false
+	}
+	writeJSONError(w, http.StatusForbidden, CodeForbidden, "The token may not "+permission.String()+" to "+channel)
+	return false
+}
+
+// String returns the operations in the set, joined by commas
+func (p ChannelPermission) String() string {
+	var ops []string
+	if p&ChannelPublish != 0 {
+		ops = append(ops, "publish")
+	}
+	if p&ChannelSubscribe != 0 {
+		ops = append(ops, "subscribe")
+	}
+	return strings.Join(ops, ",")
+}
@@ -0,0 +1,98 @@
+//go:build chaos
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// chaosPath is the admin route that changes the faults injected into the database. It is only served by builds with
+// the chaos tag, so it is left out of openapi.json.
+const chaosPath = "/v1" + chaosRoute
+
+// chaosRoute is chaosPath within its API version
+const chaosRoute = "/admin/chaos"
+
+// failureInjection is the FailureInjection of the database
+type failureInjection = struct {
+	WriteFailureRate float64
+	Latency          time.Duration
+	ClockSkew        time.Duration
+}
+
+// chaosDatabase is implemented by databases that faults can be injected into
+type chaosDatabase interface {
+	SetFailureInjection(f failureInjection) error
+	GetFailureInjection() failureInjection
+}
+
+// chaosRequest replaces the injected faults. Durations are given like "50ms" or "-2s", and omitted fields turn their
+// fault off.
+type chaosRequest struct {
+	WriteFailureRate float64 `json:"writeFailureRate" validate:"min=0,max=1"`
+	Latency          string  `json:"latency"`
+	ClockSkew        string  `json:"clockSkew"`
+}
+
+type chaosResponse struct {
+	WriteFailureRate float64 `json:"writeFailureRate"`
+	Latency          string  `json:"latency"`
+	ClockSkew        string  `json:"clockSkew"`
+}
+
+func newChaosResponse(f failureInjection) chaosResponse {
+	return chaosResponse{WriteFailureRate: f.WriteFailureRate, Latency: f.Latency.String(), ClockSkew: f.ClockSkew.String()}
+}
+
+// registerChaosRoutes serves the chaos route in the version if faults can be injected into the database
+func (h *Wrapper) registerChaosRoutes(v *apiVersion) {
+	db, ok := h.db.(chaosDatabase)
+	if !ok {
+		return
+	}
+	v.HandleFunc(chaosRoute, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newChaosResponse(db.GetFailureInjection()))
+	}).Methods("GET")
+	v.HandleFunc(chaosRoute, func(w http.ResponseWriter, r *http.Request) {
+		h.setChaosHandler(w, r, db)
+	}).Methods("PUT")
+}
+
+// setChaosHandler replaces the faults injected into the database
+func (h *Wrapper) setChaosHandler(w http.ResponseWriter, r *http.Request, db chaosDatabase) {
+	var rData chaosRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing chaos request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing chaos request: %v", err))
+		return
+	}
+
+	f := failureInjection{WriteFailureRate: rData.WriteFailureRate}
+	for _, d := range []struct {
+		field string
+		value string
+		dst   *time.Duration
+	}{{"latency", rData.Latency, &f.Latency}, {"clockSkew", rData.ClockSkew, &f.ClockSkew}} {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		if *d.dst, err = time.ParseDuration(d.value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Invalid %v: %v", d.field, err))
+			return
+		}
+	}
+	if err := db.SetFailureInjection(f); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, err.Error())
+		return
+	}
+
+	h.logger.Warn("changed the injected faults", "writeFailureRate", f.WriteFailureRate, "latency", f.Latency, "clockSkew", f.ClockSkew)
+	writeJSON(w, http.StatusOK, newChaosResponse(f))
+}
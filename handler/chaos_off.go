@@ -0,0 +1,9 @@
+//go:build !chaos
+
+package handler
+
+// chaosPath is only served by builds with the chaos tag
+const chaosPath = "/v1/admin/chaos"
+
+// registerChaosRoutes does nothing without the chaos build tag, so that production builds cannot inject faults
+func (h *Wrapper) registerChaosRoutes(*apiVersion) {}
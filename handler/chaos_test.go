@@ -0,0 +1,72 @@
+//go:build chaos
+
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chaosTestImplementation records the injected faults
+type chaosTestImplementation struct {
+	databaseTestImplementation
+	f failureInjection
+}
+
+func (db *chaosTestImplementation) SetFailureInjection(f failureInjection) error {
+	if f.Latency < 0 {
+		return errors.New("injected latency must not be negative")
+	}
+	db.f = f
+	return nil
+}
+
+func (db *chaosTestImplementation) GetFailureInjection() failureInjection {
+	return db.f
+}
+
+func TestWrapper_chaos(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		expected failureInjection
+	}{
+		{name: "Inject faults", body: `{"writeFailureRate":0.25,"latency":"50ms","clockSkew":"-2s"}`, status: http.StatusOK, expected: failureInjection{WriteFailureRate: 0.25, Latency: 50 * time.Millisecond, ClockSkew: -2 * time.Second}},
+		{name: "Turn faults off", body: `{}`, status: http.StatusOK},
+		{name: "Rate over 1", body: `{"writeFailureRate":2}`, status: http.StatusBadRequest},
+		{name: "Invalid duration", body: `{"latency":"soon"}`, status: http.StatusBadRequest},
+		{name: "Rejected by the database", body: `{"latency":"-1s"}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &chaosTestImplementation{}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("PUT", chaosPath, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v: %v", w.Code, tt.status, w.Body)
+			}
+			if db.f != tt.expected {
+				t.Errorf("injected faults = %+v; want %+v", db.f, tt.expected)
+			}
+		})
+	}
+
+	t.Run("Databases without failure injection", func(t *testing.T) {
+		h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", chaosPath, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("response code = %v; want %v", w.Code, http.StatusNotFound)
+		}
+	})
+}
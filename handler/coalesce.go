@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// storedEntry is a value as returned by GetEntry
+type storedEntry = struct {
+	Value     string
+	UpdatedAt time.Time
+	Version   uint64
+}
+
+// readCoalescer shares the result of a database read between identical requests that arrive while it is running
+type readCoalescer struct {
+	enabled bool
+	flights singleflight.Group
+}
+
+// WithReadCoalescing makes identical GET /v1/keys/{key} and GET /v1/ttl/{key} requests that arrive while one is
+// already reading the database share its result instead of each taking the lock. It helps under heavy fan-in on a few
+// hot keys, and costs a little for keys that are read by one client at a time. A shared result may miss a write that
+// completed while the read it came from was running.
+func WithReadCoalescing() Options {
+	return func(h *Wrapper) {
+		h.reads.enabled = true
+	}
+}
+
+// coalesce calls read, or waits for a call with the same key that is already running and shares its result. Requests
+// that were served by another request's call are counted by operation.
+func (h *Wrapper) coalesce(operation string, key string, read func() any) any {
+	if !h.reads.enabled {
+		return read()
+	}
+
+	leader := false
+	v, _, shared := h.reads.flights.Do(operation+"\x00"+key, func() (any, error) {
+		leader = true
+		return read(), nil
+	})
+	if shared && !leader {
+		h.m.dbCoalescedRequests.WithLabelValues(operation).Inc()
+	}
+	return v
+}
+
+// getEntry reads a key, coalescing concurrent reads of it when enabled
+func (h *Wrapper) getEntry(key string) (storedEntry, bool) {
+	type result struct {
+		entry  storedEntry
+		loaded bool
+	}
+	r := h.coalesce("get", key, func() any {
+		entry, loaded := h.db.GetEntry(key)
+		return result{entry, loaded}
+	}).(result)
+	return r.entry, r.loaded
+}
+
+// getTTL reads the ttl of a key, coalescing concurrent reads of it when enabled
+func (h *Wrapper) getTTL(key string) (*int64, bool) {
+	type result struct {
+		ttl    *int64
+		loaded bool
+	}
+	r := h.coalesce("ttl", key, func() any {
+		ttl, loaded := h.db.GetTTL(key)
+		return result{ttl, loaded}
+	}).(result)
+	return r.ttl, r.loaded
+}
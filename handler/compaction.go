@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+)
+
+// compaction is the outcome of a compaction. Like change, it is an alias of an unnamed struct so that the database
+// satisfies the interface without either package importing the other.
+type compaction = struct {
+	Keys      int           // The keys left in the database
+	Reclaimed uint64        // The bytes of heap freed by rebuilding the maps
+	Duration  time.Duration // How long the compaction took
+}
+
+// compactionStats describes the compactions since the database started. Like compaction it is an alias of an unnamed
+// struct.
+type compactionStats = struct {
+	Runs      uint64 // Compactions that finished
+	Reclaimed uint64 // The bytes of heap freed by every compaction
+}
+
+type compactResponse struct {
+	Keys           int     `json:"keys"`           // The keys left in the database
+	ReclaimedBytes uint64  `json:"reclaimedBytes"` // The bytes of heap freed by the compaction
+	Seconds        float64 `json:"seconds"`        // How long the compaction took
+}
+
+// compactHandler compacts the database, so that the memory taken by deleted keys is reclaimed without a restart. It
+// responds once the compaction has finished.
+func (h *Wrapper) compactHandler(w http.ResponseWriter, r *http.Request) {
+	c := h.db.Compact()
+	writeJSON(w, http.StatusOK, compactResponse{Keys: c.Keys, ReclaimedBytes: c.Reclaimed, Seconds: c.Duration.Seconds()})
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GenerationHeader carries the generation of the dataset on export and scan responses. It is the sequence number of
+// the last write, so it changes on every mutation, including expirations.
+const GenerationHeader = "X-DB-Generation"
+
+// entityTag returns the strong entity tag for a version of a value, or an empty string if the version is unknown
+func entityTag(version uint64) string {
+	if version == 0 {
+		return ""
+	}
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// matchesIfMatch reports whether a value with the version satisfies an If-Match header, which is either * for any
+// value or a comma separated list of entity tags. Tags are compared with the strong comparison of RFC 9110, so weak
+// tags never match, and neither does a value whose version is unknown.
+func matchesIfMatch(header string, version uint64) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	tag := entityTag(version)
+	if tag == "" {
+		return false
+	}
+	for candidate := range strings.SplitSeq(header, ",") {
+		if strings.TrimSpace(candidate) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGeneration sets the ETag and generation headers of a response that depends on the whole dataset. The ETag is
+// weak since the remaining ttls in the response change without a write, and it includes the node ID because, like the
+// AOF, a sequence number is only unique on its node. It writes a 304 and returns false if the request's If-None-Match
+// holds the current ETag, so that repeated exports of an unchanged database are free.
+func (h *Wrapper) checkGeneration(w http.ResponseWriter, r *http.Request) bool {
+	info := h.db.GetInfo()
+	tag := `W/"` + info.NodeID + "-" + strconv.FormatUint(info.Seq, 10) + `"`
+	w.Header().Set("ETag", tag)
+	w.Header().Set(GenerationHeader, strconv.FormatUint(info.Seq, 10))
+
+	if header := r.Header.Get("If-None-Match"); header != "" && matchesIfNoneMatch(header, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+	return true
+}
+
+// matchesIfNoneMatch reports whether an If-None-Match header, which is either * or a comma separated list of entity
+// tags, holds the tag. Tags are compared with the weak comparison of RFC 9110, which ignores the W/ prefix.
+func matchesIfNoneMatch(header string, tag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	tag = strings.TrimPrefix(tag, "W/")
+	for candidate := range strings.SplitSeq(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestAppendEnvelope_matchesEncodingJSON(t *testing.T) {
+	strs := []string{
+		"",
+		"plain",
+		`quote " and backslash \`,
+		"control \n\r\t\b\f\x00\x1f",
+		"<html> & friends",
+		"unicode é 世界 🙂",
+		"separators \u2028 \u2029",
+		"invalid \xff utf8 \xc3",
+	}
+
+	for _, s := range strs {
+		for _, data := range []any{keyResponse{Key: s}, getResponse{Key: s, Value: s}} {
+			var want bytes.Buffer
+			if err := json.NewEncoder(&want).Encode(envelope{Data: data}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok := appendEnvelope(nil, data)
+			if !ok {
+				t.Fatalf("expected %T to be encoded by hand", data)
+			}
+			if string(got) != want.String() {
+				t.Errorf("expected %q, got %q", want.String(), got)
+			}
+		}
+
+		var want bytes.Buffer
+		if err := json.NewEncoder(&want).Encode(envelope{Error: &apiError{Code: CodeKeyNotFound, Message: s}}); err != nil {
+			t.Fatal(err)
+		}
+		got := appendErrorEnvelope(nil, CodeKeyNotFound, s)
+		if string(got) != want.String() {
+			t.Errorf("expected %q, got %q", want.String(), got)
+		}
+	}
+
+	// Other types fall back on encoding/json
+	if _, ok := appendEnvelope(nil, publishResponse{}); ok {
+		t.Errorf("expected publishResponse to fall back on encoding/json")
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// eventTypes are the key lifecycle events that can be streamed from /v1/events
+var eventTypes = []string{"created", "updated", "deleted", "expired", "evicted"}
+
+// keyEventResponse is the data of a key lifecycle event
+type keyEventResponse struct {
+	Type string    `json:"type"`
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+// eventsHandler streams key lifecycle events as server-sent events. The optional query parameters are prefix, which
+// limits the stream to keys with the prefix, and types, a comma separated list of the event types to send. Each event
+// is sent with its type as the event name and a {"type", "key", "time"} object as the data. Events are not replayed,
+// and events for a client that falls too far behind are dropped, so consumers should treat the stream as a hint and
+// re-read keys they care about after reconnecting.
+func (h *Wrapper) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var types []string
+	if t := query.Get("types"); t != "" {
+		types = strings.Split(t, ",")
+		for _, eventType := range types {
+			if !slices.Contains(eventTypes, eventType) {
+				writeJSONError(w, http.StatusBadRequest, CodeBadRequest,
+					fmt.Sprintf("Unknown event type %q, expected one of %s", eventType, strings.Join(eventTypes, ", ")))
+				return
+			}
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Streaming unsupported")
+		return
+	}
+
+	remove, ok := h.addStreamSubscriber(w, r)
+	if !ok {
+		return
+	}
+	defer remove()
+
+	events, unsubscribe := h.db.SubscribeEvents(query.Get("prefix"))
+	defer unsubscribe()
+
+	startEventStream(w, flusher)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if isInternalKey(e.Key) || (types != nil && !slices.Contains(types, e.Type)) {
+				continue
+			}
+			data, _ := json.Marshal(keyEventResponse{Type: e.Type, Key: e.Key, Time: e.Time})
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// addStreamSubscriber counts an event stream towards the same limits as channel subscriptions. It writes a 503 and
+// returns false if a limit has been reached. Otherwise, it returns a function that removes the subscriber again.
+func (h *Wrapper) addStreamSubscriber(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	h.broker.mu.Lock()
+	defer h.broker.mu.Unlock()
+	ip, ok := h.admitSubscriber(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	return func() {
+		h.broker.mu.Lock()
+		h.releaseSubscriber(ip)
+		h.broker.mu.Unlock()
+	}, true
+}
+
+// startEventStream writes the headers of a server-sent event stream
+func startEventStream(w http.ResponseWriter, flusher http.Flusher) {
+	// Event streams are long-lived so they are exempt from the server's read and write timeouts
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// extraRoute is a route of the embedding application, registered by WithRoute
+type extraRoute struct {
+	method  string
+	path    string
+	handler http.Handler
+	route   *mux.Route // The route once registered
+}
+
+// WithMiddleware adds middleware of the embedding application, e.g. for authentication or tracing. It runs on every
+// route in the order given, after the built-in middleware, so the requests it rejects are still logged, measured and
+// recovered from panics, but before the middleware of the API version, so their responses carry no API-Version
+// header. It can be given more than once.
+func WithMiddleware(middleware ...func(http.Handler) http.Handler) Options {
+	return func(h *Wrapper) {
+		h.middleware = append(h.middleware, middleware...)
+	}
+}
+
+// WithRoute serves an extra route of the embedding application, e.g. WithRoute("GET", "/v1/app/status", handler). The
+// path may contain variables like {name}, which the handler reads with mux.Vars. A path under the prefix of an API
+// version joins that version, and one under /v1/admin/ requires the admin token like the admin routes. Built-in
+// routes take precedence over extra routes with the same method and path.
+func WithRoute(method string, path string, handler http.Handler) Options {
+	return func(h *Wrapper) {
+		h.extraRoutes = append(h.extraRoutes, extraRoute{method: method, path: path, handler: handler})
+	}
+}
+
+// registerExtraRoutes registers the routes of WithRoute, in the version their path is under if any
+func (h *Wrapper) registerExtraRoutes() {
+	for n, extra := range h.extraRoutes {
+		if v, path, ok := h.versionOf(extra.path); ok {
+			extra.route = v.HandleFunc(path, extra.handler.ServeHTTP)
+		} else {
+			extra.route = h.router.Handle(extra.path, extra.handler)
+		}
+		h.extraRoutes[n].route = extra.route.Methods(extra.method)
+	}
+}
+
+// versionOf returns the version whose prefix a path is under, along with the path within the version
+func (h *Wrapper) versionOf(path string) (*apiVersion, string, bool) {
+	for _, v := range h.versions {
+		if rest, ok := strings.CutPrefix(path, "/"+v.name+"/"); ok {
+			return v, "/" + rest, true
+		}
+	}
+	return nil, "", false
+}
+
+// isExtraRoute reports whether a request was routed to a route of WithRoute, returning the path of the route to label
+// its metrics with
+func (h *Wrapper) isExtraRoute(r *http.Request) (string, bool) {
+	if len(h.extraRoutes) == 0 {
+		return "", false
+	}
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", false
+	}
+	for _, extra := range h.extraRoutes {
+		if extra.route == route {
+			return extra.path, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// fanOutBatch is how many subscribers of a channel a message is offered to at a time. Channels with no more
+// subscribers than this are offered to by the publisher itself, and larger ones are split into batches that the
+// fan-out workers offer to in parallel.
+const fanOutBatch = 64
+
+// WithFanOutWorkers sets how many workers offer published messages to the subscribers of channels with more than 64 of
+// them. Zero, the default, starts one per CPU. The workers are started by the first publish that needs them.
+func WithFanOutWorkers(n int) Options {
+	return func(h *Wrapper) {
+		h.s.fanOutWorkers = n
+	}
+}
+
+// fanOutPool runs the batches of a large fan-out on a fixed set of workers, so that publishing to thousands of
+// subscribers does not start a goroutine per subscriber
+type fanOutPool struct {
+	start sync.Once
+	tasks chan func()
+}
+
+// runFanOut hands a batch to the workers, starting them the first time, and blocks while every worker is busy
+func (h *Wrapper) runFanOut(task func()) {
+	h.fanOut.start.Do(func() {
+		n := h.s.fanOutWorkers
+		if n <= 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		h.fanOut.tasks = make(chan func(), n)
+		for range n {
+			go func() {
+				for task := range h.fanOut.tasks {
+					task()
+				}
+			}()
+		}
+	})
+	h.fanOut.tasks <- task
+}
+
+// offerAll offers a message to every subscriber, in batches spread across the fan-out workers if there are many, and
+// returns how many accepted it. It returns once every subscriber was offered the message, so a full subscriber only
+// costs the drop of its message while the others are served.
+func (h *Wrapper) offerAll(subscribers []*subscriber, message string) int {
+	if len(subscribers) <= fanOutBatch {
+		return h.offerBatch(subscribers, message)
+	}
+
+	var wg sync.WaitGroup
+	var sent atomic.Int64
+	for batch := range slices.Chunk(subscribers, fanOutBatch) {
+		wg.Add(1)
+		h.runFanOut(func() {
+			defer wg.Done()
+			sent.Add(int64(h.offerBatch(batch, message)))
+		})
+	}
+	wg.Wait()
+	return int(sent.Load())
+}
+
+// offerBatch offers a message to each of the subscribers in turn and returns how many accepted it
+func (h *Wrapper) offerBatch(subscribers []*subscriber, message string) int {
+	sent := 0
+	for _, s := range subscribers {
+		if h.offer(s, message) {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultGeoSearchLimit is the number of members returned by a geo search when no limit is given
+const DefaultGeoSearchLimit = 100
+
+const (
+	geohashBase32    = "0123456789bcdefghjkmnpqrstuvwxyz"
+	geohashPrecision = 12             // The length of stored geohashes, which locate members within a few centimeters
+	earthRadius      = 6372797.560856 // The radius of the earth in meters, as used by Redis
+)
+
+// geoUnits are the units of the radius and distances of a geo search, in meters
+var geoUnits = map[string]float64{"m": 1, "km": 1000, "mi": 1609.34, "ft": 0.3048}
+
+// Errors returned from the update of a geo set to leave the stored value unchanged
+var (
+	errNotGeo      = errors.New("the stored value is not a geo set")
+	errGeoTooLarge = errors.New("the geo set would be over the maximum value length")
+)
+
+type geoMember struct {
+	Member string   `json:"member" validate:"required"`
+	Lat    *float64 `json:"lat" validate:"required,min=-90,max=90"`
+	Lon    *float64 `json:"lon" validate:"required,min=-180,max=180"`
+}
+
+type geoAddRequest struct {
+	Members []geoMember `json:"members" validate:"required,min=1,max=1000,dive"`
+}
+
+type geoAddResponse struct {
+	Key   string `json:"key"`
+	Added int    `json:"added"` // The number of members that were not in the set before, like the result of GEOADD
+}
+
+type geoSearchRequest struct {
+	Member string   // Search around this member instead of Lat and Lon
+	Lat    *float64 `validate:"required_without=Member,excluded_with=Member,omitnil,min=-90,max=90"`
+	Lon    *float64 `validate:"required_without=Member,excluded_with=Member,omitnil,min=-180,max=180"`
+	Radius float64  `validate:"gt=0"`
+	Unit   string   `validate:"oneof=m km mi ft"`
+	Limit  int      `validate:"min=1,max=1000"`
+}
+
+type geoSearchResult struct {
+	Member   string  `json:"member"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	Distance float64 `json:"distance"` // The distance from the center of the search in the unit of the search
+}
+
+type geoSearchResponse struct {
+	Results []geoSearchResult `json:"results"` // The nearest first
+}
+
+// geohashEncode encodes a location as a geohash of the given length by interleaving the bits of its longitude and
+// latitude, so that nearby locations share a prefix
+func geohashEncode(lat, lon float64, length int) string {
+	latRange, lonRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	hash := make([]byte, length)
+	for n := range hash {
+		var c byte
+		for bit := range 5 {
+			r, v := &latRange, lat
+			if (n*5+bit)%2 == 0 {
+				r, v = &lonRange, lon
+			}
+			mid := (r[0] + r[1]) / 2
+			c <<= 1
+			if v >= mid {
+				c |= 1
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+		}
+		hash[n] = geohashBase32[c]
+	}
+	return string(hash)
+}
+
+// geohashDecode decodes a geohash to the center of its cell, returning false if it is not a valid geohash
+func geohashDecode(hash string) (float64, float64, bool) {
+	latRange, lonRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	for n := range len(hash) {
+		c := strings.IndexByte(geohashBase32, hash[n])
+		if c < 0 {
+			return 0, 0, false
+		}
+		for bit := range 5 {
+			r := &latRange
+			if (n*5+bit)%2 == 0 {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if c&(1<<(4-bit)) != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+		}
+	}
+	return (latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2, hash != ""
+}
+
+// geohashCells returns the geohash cells that cover every location within the radius of the center: the cell of the
+// center and its neighbors, at the longest length whose cells are at least as large as the radius. It returns nil when
+// the radius is too large for any cell length, such as near the poles, and every member must be considered.
+func geohashCells(lat, lon, radius float64) []string {
+	latDegrees := radius / earthRadius * 180 / math.Pi
+	// A degree of longitude is shortest at the latitude of the circle closest to a pole
+	lonDegrees := latDegrees / math.Cos(math.Min(90, math.Abs(lat)+latDegrees)*math.Pi/180)
+	for length := geohashPrecision; length > 0; length-- {
+		height := 180 / math.Ldexp(1, length*5/2)
+		width := 360 / math.Ldexp(1, (length*5+1)/2)
+		if height < latDegrees || width < lonDegrees {
+			continue
+		}
+
+		var cells []string
+		for _, dLat := range []float64{-height, 0, height} {
+			if l := lat + dLat; l >= -90 && l <= 90 {
+				for _, dLon := range []float64{-width, 0, width} {
+					cells = append(cells, geohashEncode(l, math.Remainder(lon+dLon, 360), length))
+				}
+			}
+		}
+		return cells
+	}
+	return nil
+}
+
+// geoDistance returns the great-circle distance between two locations in meters with the haversine formula
+func geoDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	lat1, lon1, lat2, lon2 = lat1*math.Pi/180, lon1*math.Pi/180, lat2*math.Pi/180, lon2*math.Pi/180
+	u, v := math.Sin((lat2-lat1)/2), math.Sin((lon2-lon1)/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1)*math.Cos(lat2)*v*v))
+}
+
+// decodeGeo decodes a geo set, which is stored as a JSON object of members and their geohashes so that it persists
+// like any other value and can be read with /v1/keys
+func decodeGeo(value string) (map[string]string, error) {
+	var members map[string]string
+	if err := json.Unmarshal([]byte(value), &members); err != nil || members == nil {
+		return nil, errNotGeo
+	}
+	for _, hash := range members {
+		if _, _, ok := geohashDecode(hash); !ok {
+			return nil, errNotGeo
+		}
+	}
+	return members, nil
+}
+
+// geoAddHandler adds the members of the request body with their locations to the geo set stored under the request key,
+// like GEOADD. Members that are already in the set are moved. Keys that don't exist are created as an empty geo set
+// without a ttl. The members are added atomically by the database, so concurrent additions are never lost.
+func (h *Wrapper) geoAddHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if err := h.validate.Var(key, "dbkey"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing geo key: %v", err))
+		return
+	}
+
+	var rData geoAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing geo add request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing geo add request: %v", err))
+		return
+	}
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+
+	var added int
+	_, err := h.db.Upsert(key, func(value string, exists bool) (string, error) {
+		members := map[string]string{}
+		if exists {
+			var err error
+			if members, err = decodeGeo(value); err != nil {
+				return "", err
+			}
+		}
+
+		added = 0
+		for _, m := range rData.Members {
+			if _, ok := members[m.Member]; !ok {
+				added++
+			}
+			members[m.Member] = geohashEncode(*m.Lat, *m.Lon, geohashPrecision)
+		}
+		b, err := json.Marshal(members)
+		if err != nil {
+			return "", err
+		}
+		if h.validate.Var(string(b), "dbvalue") != nil {
+			return "", errGeoTooLarge
+		}
+		return string(b), nil
+	})
+	switch {
+	case errors.Is(err, errNotGeo):
+		writeJSONError(w, http.StatusConflict, CodeValueNotGeo, "Cannot add to "+key+": "+err.Error())
+	case errors.Is(err, errGeoTooLarge):
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, err.Error())
+	case err != nil:
+		h.writeFailed(w, key, err)
+	default:
+		writeJSON(w, http.StatusOK, geoAddResponse{Key: key, Added: added})
+	}
+}
+
+// geoSearchHandler returns the members of the geo set stored under the request key within a radius, nearest first,
+// like GEOSEARCH. The center is given by the lat and lon query parameters, or by the location of the member query
+// parameter. The query parameter radius is required, and unit and limit are optional. Missing keys have no members.
+func (h *Wrapper) geoSearchHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	query := r.URL.Query()
+	rData := geoSearchRequest{Member: query.Get("member"), Unit: "m", Limit: DefaultGeoSearchLimit}
+	if u := query.Get("unit"); u != "" {
+		rData.Unit = u
+	}
+	for name, dst := range map[string]**float64{"lat": &rData.Lat, "lon": &rData.Lon} {
+		if s := query.Get(name); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing geo search %v: %v", name, err))
+				return
+			}
+			*dst = &f
+		}
+	}
+	var err error
+	if rData.Radius, err = strconv.ParseFloat(query.Get("radius"), 64); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing geo search radius: %v", err))
+		return
+	}
+	if l := query.Get("limit"); l != "" {
+		if rData.Limit, err = strconv.Atoi(l); err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing geo search limit: %v", err))
+			return
+		}
+	}
+
+	if err = h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing geo search request: %v", err))
+		return
+	}
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+	entry, loaded := h.getEntry(key)
+	members := map[string]string{}
+	if loaded {
+		if members, err = decodeGeo(entry.Value); err != nil {
+			writeJSONError(w, http.StatusConflict, CodeValueNotGeo, "Cannot search "+key+": "+err.Error())
+			return
+		}
+	}
+
+	var lat, lon float64
+	if rData.Member != "" {
+		hash, ok := members[rData.Member]
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, CodeMemberNotFound, "Member not found")
+			return
+		}
+		lat, lon, _ = geohashDecode(hash)
+	} else {
+		lat, lon = *rData.Lat, *rData.Lon
+	}
+
+	// Only members in the cells around the center can be within the radius
+	radius := rData.Radius * geoUnits[rData.Unit]
+	cells := geohashCells(lat, lon, radius)
+	results := []geoSearchResult{}
+	for member, hash := range members {
+		if cells != nil && !slices.ContainsFunc(cells, func(cell string) bool { return strings.HasPrefix(hash, cell) }) {
+			continue
+		}
+		mLat, mLon, _ := geohashDecode(hash)
+		if d := geoDistance(lat, lon, mLat, mLon); d <= radius {
+			results = append(results, geoSearchResult{Member: member, Lat: mLat, Lon: mLon, Distance: d / geoUnits[rData.Unit]})
+		}
+	}
+	slices.SortFunc(results, func(a, b geoSearchResult) int {
+		return cmp.Or(cmp.Compare(a.Distance, b.Distance), strings.Compare(a.Member, b.Member))
+	})
+	if len(results) > rData.Limit {
+		results = results[:rData.Limit]
+	}
+	writeJSON(w, http.StatusOK, geoSearchResponse{Results: results})
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// settings define user-configurable settings for the handler in a single struct
+type settings struct {
+	maxSubscribers  int                // The maximum number of concurrent subscriptions. Zero means unlimited.
+	onPanic         func()             // Called after a handler panic is recovered, e.g. to persist the database
+	maxKeyLength    int                // The maximum key length in bytes
+	maxValueLength  int                // The maximum value length in bytes
+	minTTL          int64              // The minimum ttl in seconds
+	maxTTL          int64              // The maximum ttl in seconds. Zero means unlimited.
+	clampTTL        bool               // Whether ttls outside of the bounds are clamped to them instead of rejected
+	keyPattern      *regexp.Regexp     // The pattern that keys must match
+	config          any                // The configuration reported by the config endpoint
+	idempotencyTTL  time.Duration      // How long the results of posts with an idempotency key are remembered
+	namespaceRates  map[string]float64 // The operations per second allowed for each namespace with a quota. Zero means unlimited.
+	webhookAttempts int                // How many times a webhook delivery is attempted
+	webhookBackoff  time.Duration      // The wait before the first retry of a webhook delivery
+	webhookClient   *http.Client       // The client webhook deliveries are sent with
+
+	routeTimeouts    map[string]time.Duration // The deadline of each route class. Missing or zero means none.
+	breakerThreshold int                      // Consecutive failures of a route class that open its circuit. Zero disables the breakers.
+	breakerCooldown  time.Duration            // How long an open circuit rejects requests
+	writeLaneLimit   int                      // The write and admin requests run at once. Zero means unlimited.
+	priorityWeight   int                      // The priority requests admitted for every waiting client write
+
+	adminToken    string // The bearer token the admin routes require. Empty leaves them open.
+	adminDisabled bool   // Whether the admin routes are left unregistered
+
+	slowConsumerTimeout time.Duration      // How long a subscriber may drop messages before it is disconnected. Zero means never.
+	maxSubscribersPerIP int                // The maximum number of concurrent subscriptions from one client address. Zero means unlimited.
+	maxMessageLength    int                // The maximum published message length in bytes
+	messageValidators   []messageValidator // The checks of messages published to the channels matching a pattern
+	channelGrants       []channelGrant     // The tokens allowed to publish and subscribe to restricted channels
+	fanOutWorkers       int                // The workers that offer messages to the subscribers of large channels. Zero means one per CPU.
+	heartbeatInterval   time.Duration      // How often idle subscriptions are sent a heartbeat. Zero means never.
+
+	defaultTTL           time.Duration            // The ttl of writes that give no expiration. Zero means that they never expire.
+	namespaceDefaultTTLs map[string]time.Duration // The default ttl of each namespace that overrides defaultTTL
+
+	logRedact      map[string]bool    // The lower case names of the fields whose values are redacted from logged bodies
+	logBodyLimit   int                // The length in bytes after which logged bodies are cut off. Zero means unlimited.
+	logSampleRates map[string]float64 // The fraction of the successful requests of each route class that is logged. Missing means all.
+}
+
+type Options func(*Wrapper)
+
+// WithMaxSubscribers limits the number of concurrent SSE subscriptions. Zero means unlimited.
+func WithMaxSubscribers(n int) Options {
+	return func(h *Wrapper) {
+		h.s.maxSubscribers = n
+	}
+}
+
+// WithMaxSubscribersPerIP limits the number of concurrent SSE subscriptions from a single client address, so that one
+// client cannot use up the subscriber limit. Zero means unlimited.
+func WithMaxSubscribersPerIP(n int) Options {
+	return func(h *Wrapper) {
+		h.s.maxSubscribersPerIP = n
+	}
+}
+
+// WithSlowConsumerTimeout disconnects subscribers that have been dropping messages because their buffer is full for
+// longer than d. Zero keeps them connected, so they only miss the messages that do not fit.
+func WithSlowConsumerTimeout(d time.Duration) Options {
+	return func(h *Wrapper) {
+		h.s.slowConsumerTimeout = d
+	}
+}
+
+// WithHeartbeatInterval sets how often a subscription that has not been sent anything is sent a ": heartbeat" SSE
+// comment, which clients ignore as a message but can use to detect a dead connection. Zero sends no heartbeats.
+func WithHeartbeatInterval(d time.Duration) Options {
+	return func(h *Wrapper) {
+		h.s.heartbeatInterval = d
+	}
+}
+
+// WithPanicHook sets a function to be called after a panic in a handler has been recovered. This is intended for a
+// final persistence pass so that data is not lost if the process later goes down.
+func WithPanicHook(f func()) Options {
+	return func(h *Wrapper) {
+		h.s.onPanic = f
+	}
+}
+
+// WithMaxKeyLength sets the maximum key length in bytes
+func WithMaxKeyLength(n int) Options {
+	return func(h *Wrapper) {
+		h.s.maxKeyLength = n
+	}
+}
+
+// WithMaxValueLength sets the maximum length in bytes for values
+func WithMaxValueLength(n int) Options {
+	return func(h *Wrapper) {
+		h.s.maxValueLength = n
+	}
+}
+
+// WithMaxMessageLength sets the maximum length in bytes for published messages. Longer messages are rejected with a
+// 413 before they reach any subscriber.
+func WithMaxMessageLength(n int) Options {
+	return func(h *Wrapper) {
+		h.s.maxMessageLength = n
+	}
+}
+
+// WithTTLBounds sets the minimum and maximum ttl in seconds. A maximum of zero means unlimited. Requests with a ttl
+// outside of the bounds are rejected with VALIDATION_FAILED, unless WithTTLClamping is given.
+func WithTTLBounds(min int64, max int64) Options {
+	return func(h *Wrapper) {
+		h.s.minTTL = min
+		h.s.maxTTL = max
+	}
+}
+
+// WithTTLClamping makes ttls outside of the bounds of WithTTLBounds, including those derived from an expiresAt, be
+// clamped to the nearest bound instead of rejected, so that a misbehaving client gets a usable ttl rather than an
+// error. Clamped ttls are counted in the db_clamped_ttls_total metric.
+func WithTTLClamping() Options {
+	return func(h *Wrapper) {
+		h.s.clampTTL = true
+	}
+}
+
+// WithDefaultTTL sets the ttl of keys written by a POST or PUT that gives neither a ttl nor an expiresAt, so that every
+// key eventually expires unless a client asks otherwise. An explicit "ttl": null still writes a key that never
+// expires. Durations are rounded up to whole seconds, and zero, the default, leaves such keys without a ttl.
+func WithDefaultTTL(d time.Duration) Options {
+	return func(h *Wrapper) {
+		h.s.defaultTTL = d
+	}
+}
+
+// WithNamespaceDefaultTTL sets the default ttl of the keys of a namespace, overriding WithDefaultTTL. Zero makes the
+// keys of the namespace never expire by default. The default namespace is given with an empty name.
+func WithNamespaceDefaultTTL(namespace string, d time.Duration) Options {
+	return func(h *Wrapper) {
+		if h.s.namespaceDefaultTTLs == nil {
+			h.s.namespaceDefaultTTLs = map[string]time.Duration{}
+		}
+		h.s.namespaceDefaultTTLs[namespace] = d
+	}
+}
+
+// WithKeyPattern sets a pattern that client-supplied keys must match, e.g. ^[A-Za-z0-9._~:@+=-]+$ for keys that need
+// no escaping in paths. Without a pattern, the default, keys of any characters are accepted.
+func WithKeyPattern(re *regexp.Regexp) Options {
+	return func(h *Wrapper) {
+		h.s.keyPattern = re
+	}
+}
+
+// WithConfig sets the configuration reported by GET /v1/admin/config. It is encoded as JSON, so serve passes its own
+// settings which include the database settings.
+func WithConfig(config any) Options {
+	return func(h *Wrapper) {
+		h.s.config = config
+	}
+}
+
+// WithIdempotencyTTL sets how long the result of a POST with an Idempotency-Key header is remembered. Retries with the
+// same key within this time return the original result instead of creating another key.
+func WithIdempotencyTTL(d time.Duration) Options {
+	return func(h *Wrapper) {
+		h.s.idempotencyTTL = d
+	}
+}
+
+// WithNamespaceQuota registers a namespace with a quota so that its key operations are reported in the per-namespace
+// metrics, and limits it to opsPerSecond key operations. Zero means unlimited, e.g. for namespaces whose quota only
+// limits their size in the database. Operations over the limit receive a 429.
+func WithNamespaceQuota(namespace string, opsPerSecond float64) Options {
+	return func(h *Wrapper) {
+		if h.s.namespaceRates == nil {
+			h.s.namespaceRates = map[string]float64{}
+		}
+		h.s.namespaceRates[namespace] = opsPerSecond
+	}
+}
+
+// WithWebhookRetries sets how many times a webhook delivery is attempted and how long to wait before the first retry.
+// The wait doubles for each later retry.
+func WithWebhookRetries(attempts int, backoff time.Duration) Options {
+	return func(h *Wrapper) {
+		h.s.webhookAttempts = max(attempts, 1)
+		h.s.webhookBackoff = backoff
+	}
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// keyVersion is a retained version of a key. Like change, it is an alias of an unnamed struct so that the database
+// satisfies the interface without either package importing the other.
+type keyVersion = struct {
+	Version   uint64    // The sequence number of the write, which is also the version of the entry it wrote
+	Value     string    // The written value
+	ExpiresAt int64     // Unix seconds at which the written key expires. Zero if it never expires.
+	Time      time.Time // When the version was written
+}
+
+// versionResponse is a version in the history of a key
+type versionResponse struct {
+	Version   uint64     `json:"version"`
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expiresAt"` // When the written key expires, or null if it does not
+	Time      time.Time  `json:"time"`
+}
+
+type historyResponse struct {
+	Key      string            `json:"key"`
+	Versions []versionResponse `json:"versions"` // The newest first, which is the current version
+}
+
+type restoreRequest struct {
+	Version uint64 `json:"version" validate:"required"`
+}
+
+// historyHandler returns the retained versions of the request key, newest first. The history needs the database to
+// retain versions, and responds with a 501 otherwise.
+func (h *Wrapper) historyHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	versions, ok := h.db.History(key)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, CodeHistoryDisabled, "The database does not retain the history of keys")
+		return
+	}
+	if len(versions) == 0 {
+		writeJSONError(w, http.StatusNotFound, CodeKeyNotFound, "Key not found")
+		return
+	}
+
+	response := historyResponse{Key: key, Versions: make([]versionResponse, len(versions))}
+	for n, v := range versions {
+		response.Versions[n] = versionResponse{Version: v.Version, Value: v.Value, Time: v.Time}
+		if v.ExpiresAt != 0 {
+			e := time.Unix(v.ExpiresAt, 0).UTC()
+			response.Versions[n].ExpiresAt = &e
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// restoreHandler writes the value of a retained version of the request key as its new current version, keeping its
+// ttl. The restore is itself a version, so it can be undone the same way. The response is the state of the key, like
+// that of a PUT.
+func (h *Wrapper) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	var rData restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing restore request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing restore request: %v", err))
+		return
+	}
+
+	if _, ok := h.db.History(key); !ok {
+		writeJSONError(w, http.StatusNotImplemented, CodeHistoryDisabled, "The database does not retain the history of keys")
+		return
+	}
+	if !h.admitNamespace(w, key) {
+		return
+	}
+
+	exists, found, err := h.db.RestoreVersion(key, rData.Version)
+	switch {
+	case err != nil:
+		h.writeFailed(w, key, err)
+	case !exists:
+		writeJSONError(w, http.StatusNotFound, CodeKeyNotFound, "Key not found")
+	case !found:
+		writeJSONError(w, http.StatusNotFound, CodeVersionNotFound, fmt.Sprintf("Version %d of %v is not retained", rData.Version, key))
+	default:
+		writeJSON(w, http.StatusOK, h.putState(key, false))
+	}
+}
@@ -1,187 +1,771 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // database defines the contract that an injected database implementation must follow
 type database interface {
 	Create(data struct {
+		Key   string `json:"key"`
 		Value string `json:"value"`
 		Ttl   *int64 `json:"ttl"`
-	}) (bool, string) // Create a UUID for the value and add it if it doesn't exist
-	Get(key string) (string, bool) // Get the associated value if it exists and hasn't expired
+	}) (bool, string, error) // Create the value under the given key, or a generated key if none is given, if it doesn't exist
+	GetEntry(key string) (struct {
+		Value     string
+		UpdatedAt time.Time
+		Version   uint64
+	}, bool) // Get the associated value, its modification time and its version if it exists and hasn't expired
 	Put(data struct {
 		Key   string `json:"key"`
 		Value string `json:"value"`
 		Ttl   *int64 `json:"ttl"`
-	}) bool // Put a key, value pair
-	Delete(key string) bool           // Delete the key, value pair
+	}) (bool, error) // Put a key, value pair, returning whether the key existed
+	PutLeased(key string, value string, name string, id string) (bool, bool, error) // Put a key, value pair under a lease, returning whether the key and the lease existed
+	AcquireLease(name string, ttl int64) (string, bool)                             // Acquire the named lease, returning its id or false if it is held
+	RenewLease(name string, id string) bool                                         // Renew the lease and its keys, returning false if it is not held
+	ReleaseLease(name string, id string) (int, bool)                                // Release the lease, deleting its keys and returning how many there were
+	Update(key string, f func(value string) (string, error)) (bool, error)          // Atomically replace the value of an existing key with f(value), returning whether it existed
+	Delete(key string) bool                                                         // Delete the key, value pair
+	DeleteIf(key string, cond func(value string, version uint64) bool) (bool, bool) // Atomically delete the key if cond holds, returning whether it was deleted and existed
+	ExpirePrefix(prefix string, ttl int64) (int, error)                             // Apply a ttl to every key with the prefix, returning the number of keys
+	Touch(key string, ttl int64) (bool, error)                                      // Give an existing key the ttl without changing its value, returning whether it existed
+	DeletePrefix(prefix string, dryRun bool) int                                    // Delete every key with the prefix, or only count them in a dry run
+	Scan(prefix string, cursor string, limit int) ([]string, string)                // Get a page of keys with the prefix after the cursor
+	ScanEntries(prefix string, cursor string, limit int) ([]struct {
+		Key   string
+		Value string
+		Ttl   *int64
+	}, string) // Get a page of entries with the prefix after the cursor
 	GetTTL(key string) (*int64, bool) // Get the remaining TTL for a given key if it has a TTL
+	Now() time.Time                   // The current time of the clock that the database measures ttls with
+	SubscribeEvents(prefix string) (<-chan struct {
+		Type string
+		Key  string
+		Time time.Time
+	}, func()) // Subscribe to lifecycle events for keys with the prefix, returning a function that unsubscribes
+	GetInfo() struct {
+		Keys   int
+		Seq    uint64
+		NodeID string
+	} // Get runtime statistics, including the sequence number of the last write
+	Ready() bool                                      // Whether the database has finished loading, including any warmup
+	GetMirrorStats() mirrorStats                      // Get how far the mirror target that writes are forwarded to is behind
+	GetPersistenceStats(kind string) persistenceStats // Get the outcome of the AOF syncs or snapshots
+	// Get the changes after the sequence number, and a channel that is closed once there are more
+	ReadChanges(since uint64, limit int) ([]change, <-chan struct{}, error)
+	// Get the keys starting with the prefix whose values match the query, the most relevant first, or false without an index
+	Search(query string, prefix string, limit int) ([]searchResult, bool)
+	// Get the retained versions of the key, the newest first, or false without a history
+	History(key string) ([]keyVersion, bool)
+	// Write a retained version of the key as its current value, returning whether the key existed and the version was found
+	RestoreVersion(key string, version uint64) (bool, bool, error)
+	// Get the reads and writes of the key and its size, whether it exists, and false if they are not counted
+	KeyStats(key string) (keyStats, bool, bool)
+	Compact() compaction                 // Rebuild the maps of the database to reclaim the memory of deleted keys
+	GetCompactionStats() compactionStats // Get the compactions since the database started
+	GetStartupSummary() startupSummary   // Get what was loaded from the startup files
+	// Atomically replace the value of a key with f(value, exists), creating it without a ttl if it doesn't exist
+	Upsert(key string, f func(value string, exists bool) (string, error)) (bool, error)
+	// Upsert that also gives the key the ttl, so that it expires once it is left alone
+	UpsertTTL(key string, ttl int64, f func(value string, exists bool) (string, error)) (bool, error)
+	GetTTLHistogram(bounds []time.Duration) struct {
+		Buckets []ttlBucket
+		Total   ttlBucket
+	} // Count the keys expiring within each bound from now, and every key with a ttl
 }
 
-type postResponse struct {
+type keyResponse struct {
 	Key string `json:"key"`
 }
 
+// postResponse is the key a value was created under, with what was stored so that callers can verify it
+type postResponse struct {
+	Key       string     `json:"key"`
+	ExpiresAt *time.Time `json:"expiresAt"`   // When the key expires, or null if it does not
+	ValueHash string     `json:"valueSha256"` // The hex encoded SHA-256 of the stored value
+}
+
+// putResponse is the state of a key after a put, so that callers do not need to read it back
+type putResponse struct {
+	Key       string     `json:"key"`
+	Created   bool       `json:"created"`           // Whether the put created the key rather than updating it
+	TTL       *int64     `json:"ttl"`               // The remaining ttl, or null if the key does not expire
+	ExpiresAt *time.Time `json:"expiresAt"`         // When the key expires, or null if it does not
+	Version   uint64     `json:"version,omitempty"` // The version of the value, which is its ETag without the quotes
+}
+
 type getResponse struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
 }
 
+type publishResponse struct {
+	Channel string `json:"channel"`
+}
+
 type getTTLResponse struct {
-	Key string `json:"key"`
-	TTL *int64 `json:"ttl"`
+	Key       string     `json:"key"`
+	TTL       *int64     `json:"ttl"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// batchTTLResult is the ttl information for a single key in a batch ttl request. The ttl and expiresAt are null for
+// missing and non-expiring keys.
+type batchTTLResult struct {
+	Key       string     `json:"key"`
+	Exists    bool       `json:"exists"`
+	TTL       *int64     `json:"ttl"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type batchTTLResponse struct {
+	Results []batchTTLResult `json:"results"`
+}
+
+type batchTTLRequest struct {
+	Keys []string `json:"keys" validate:"required,min=1,max=1000,dive,required"`
+}
+
+// deleteRequest is the optional body of a delete, which makes the delete conditional on the current value
+type deleteRequest struct {
+	ExpectedValue *string `json:"expectedValue" validate:"required"`
+}
+
+type expirePrefixRequest struct {
+	Prefix string `json:"prefix" validate:"required"`
+	Ttl    *int64 `json:"ttl" validate:"required,dbttl"`
+}
+
+type expirePrefixResponse struct {
+	Prefix  string `json:"prefix"`
+	Expired int    `json:"expired"` // The number of keys that were given the ttl
+}
+
+type deletePrefixResponse struct {
+	Prefix  string `json:"prefix"`
+	Deleted int    `json:"deleted"` // The number of keys deleted, or that would be deleted in a dry run
+	DryRun  bool   `json:"dryRun"`
+}
+
+// DefaultScanLimit is the number of keys returned by a scan when no limit is given
+const DefaultScanLimit = 100
+
+type scanRequest struct {
+	Prefix string
+	Cursor string
+	Limit  int `validate:"min=1,max=1000"`
+}
+
+type scanResponse struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor"` // The cursor for the next page, or empty once every key has been returned
+}
+
+type infoResponse struct {
+	Keys   int    `json:"keys"`   // The number of stored keys, including expired keys not yet cleaned up
+	Seq    uint64 `json:"seq"`    // The sequence number of the last write
+	NodeID string `json:"nodeId"` // The node ID recorded with every AOF operation
+}
+
+type readyResponse struct {
+	Ready   bool     `json:"ready"`
+	Failing []string `json:"failingPersistence,omitempty"` // The kinds of persistence that have failed for the alert periods
 }
 
 type postRequest struct {
-	Value string `json:"value" validate:"required"`
-	Ttl   *int64 `json:"ttl"`
+	Key       string     `json:"key" validate:"omitempty,excludesall=/?#%,dbkey"` // Optional client-supplied key
+	Value     string     `json:"value" validate:"required,dbvalue"`
+	Ttl       *int64     `json:"ttl" validate:"omitnil,dbttl"`
+	ExpiresAt *expiresAt `json:"expiresAt" validate:"excluded_with=Ttl"`
+
+	expirationGiven bool // Whether the request has a ttl or expiresAt, even if it is null
+}
+
+// UnmarshalJSON records whether the request gives an expiration so that a null ttl can be told from a missing one
+func (p *postRequest) UnmarshalJSON(data []byte) error {
+	type plain postRequest
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	p.expirationGiven = hasExpiration(data)
+	return nil
 }
 
 type putRequest struct {
-	Key   string `json:"key"` // This is overwritten by the url parameter if passed in with the request body
-	Value string `json:"value" validate:"required"`
-	Ttl   *int64 `json:"ttl"`
+	Key       string     `json:"key" validate:"dbkey"` // This is overwritten by the url parameter if passed in with the request body
+	Value     string     `json:"value" validate:"required,dbvalue"`
+	Ttl       *int64     `json:"ttl" validate:"omitnil,dbttl"`
+	ExpiresAt *expiresAt `json:"expiresAt" validate:"excluded_with=Ttl"`
+	Lease     string     `json:"lease" validate:"required_with=LeaseID,excluded_with=Ttl ExpiresAt"` // Write the key under this lease so that it expires with it
+	LeaseID   string     `json:"leaseId" validate:"required_with=Lease"`                             // The id of the lease from when it was acquired
+
+	expirationGiven bool // Whether the request has a ttl or expiresAt, even if it is null
 }
 
-type publishRequest struct {
-	Message string `json:"message" validate:"required"`
+// UnmarshalJSON records whether the request gives an expiration so that a null ttl can be told from a missing one
+func (p *putRequest) UnmarshalJSON(data []byte) error {
+	type plain putRequest
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	p.expirationGiven = hasExpiration(data)
+	return nil
 }
 
-type pubSubBroker struct {
-	mu       sync.RWMutex
-	channels map[string][]chan string
+// hasExpiration reports whether a JSON object has a ttl or expiresAt field, including one that is null
+func hasExpiration(data []byte) bool {
+	var fields map[string]json.RawMessage
+	_ = json.Unmarshal(data, &fields)
+	for name := range fields {
+		if strings.EqualFold(name, "ttl") || strings.EqualFold(name, "expiresAt") {
+			return true
+		}
+	}
+	return false
 }
 
-type Wrapper struct {
-	db     database
-	router *mux.Router
-	logger *slog.Logger
-	broker pubSubBroker
-	m      *metrics
+// expiresAt is an absolute expiration time that may be given as either an RFC3339 string or unix seconds
+type expiresAt struct {
+	time.Time
 }
 
-// Helper function for writing JSON errors
-func writeJSONError(w http.ResponseWriter, status int, msg string) {
-	sw, ok := w.(*statusResponseWriter)
-	if ok {
-		sw.e = msg
+// UnmarshalJSON accepts both RFC3339 strings and unix second integers
+func (e *expiresAt) UnmarshalJSON(data []byte) error {
+	var unix int64
+	if err := json.Unmarshal(data, &unix); err == nil {
+		e.Time = time.Unix(unix, 0)
+		return nil
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	err := json.NewEncoder(w).Encode(map[string]string{
-		"error": msg,
-	})
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expiresAt must be an RFC3339 string or unix seconds: %w", err)
+	}
+
+	// Unix seconds are also accepted when sent as a string
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		e.Time = time.Unix(unix, 0)
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
 	if err != nil {
-		return
+		return fmt.Errorf("expiresAt must be an RFC3339 string or unix seconds: %w", err)
+	}
+	e.Time = t
+	return nil
+}
+
+// resolveTTL returns the relative TTL to forward to the database. An absolute expiration is converted into the
+// number of seconds remaining from the current time of the database clock.
+func (h *Wrapper) resolveTTL(ttl *int64, e *expiresAt) *int64 {
+	if e == nil {
+		return ttl
+	}
+
+	remaining := e.Unix() - h.db.Now().Unix()
+	return &remaining
+}
+
+// clampTTL clamps a ttl to the ttl bounds if they are clamped, counting the ttls that were. Otherwise the ttl has
+// already been validated against them and is returned as it is.
+func (h *Wrapper) clampTTL(ttl int64) int64 {
+	if !h.s.clampTTL {
+		return ttl
+	}
+	switch {
+	case ttl < h.s.minTTL:
+		h.m.dbClampedTTLs.WithLabelValues("min").Inc()
+		return h.s.minTTL
+	case h.s.maxTTL != 0 && ttl > h.s.maxTTL:
+		h.m.dbClampedTTLs.WithLabelValues("max").Inc()
+		return h.s.maxTTL
+	}
+	return ttl
+}
+
+// defaultTTL returns the ttl of a write to the key that gave no expiration: the default ttl of the namespace of the
+// key if it has one, or else the default ttl. Nil means that the key never expires.
+func (h *Wrapper) defaultTTL(key string) *int64 {
+	d, ok := h.s.namespaceDefaultTTLs[namespaceOf(key)]
+	if !ok {
+		d = h.s.defaultTTL
+	}
+	if d <= 0 {
+		return nil
 	}
+	ttl := int64(math.Ceil(d.Seconds()))
+	return &ttl
+}
+
+type publishRequest struct {
+	Message string `json:"message" validate:"required,dbmessage"`
+}
+
+type pubSubBroker struct {
+	mu          sync.RWMutex
+	channels    map[string]*channelSubscribers // The subscribers of each channel
+	subscribers int                            // The number of active subscriptions across all channels
+	perIP       map[string]int                 // The number of active subscriptions of each client address
+}
+
+type Wrapper struct {
+	db        database
+	router    *mux.Router
+	logger    *slog.Logger
+	broker    pubSubBroker
+	m         *metrics
+	s         settings
+	validate  *validator.Validate     // Shared validator with the custom rules registered
+	limiters  map[string]*tokenBucket // Rate limits of the namespaces with a quota. Nil for namespaces without a rate limit.
+	bridges   []Bridge                // External brokers that published messages are forwarded to
+	webhooks  webhookRegistry
+	schedules scheduler
+	origin    origin              // Where keys that are not stored are fetched from, if anywhere
+	reads     readCoalescer       // Shares database reads between identical concurrent requests
+	breakers  map[string]*breaker // The circuit breaker of each route class. Nil when the breakers are disabled.
+	lanes     *writeLanes         // Admits write and admin requests by lane. Nil without a write lane limit.
+	fanOut    fanOutPool          // Offers messages to the subscribers of channels with many of them
+	versions  []*apiVersion       // The versions of the API, oldest first
+
+	middleware  []func(http.Handler) http.Handler // Middleware of the embedding application, run after the built-in middleware
+	extraRoutes []extraRoute                      // Routes of the embedding application, registered after the built-in routes
 }
 
 // NewHandler Return a new HandlerWrapper instance with all routes set
-func NewHandler(db database, logger *slog.Logger) *Wrapper {
-	handler := &Wrapper{db: db, logger: logger, broker: pubSubBroker{channels: make(map[string][]chan string)}}
+func NewHandler(db database, logger *slog.Logger, opts ...Options) *Wrapper {
+	handler := &Wrapper{
+		db:        db,
+		logger:    logger,
+		broker:    pubSubBroker{channels: make(map[string]*channelSubscribers), perIP: make(map[string]int)},
+		schedules: scheduler{wake: make(chan struct{}, 1)},
+		s: settings{
+			maxKeyLength:      DefaultMaxKeyLength,
+			maxValueLength:    DefaultMaxValueLength,
+			maxMessageLength:  DefaultMaxMessageLength,
+			config:            struct{}{},
+			idempotencyTTL:    DefaultIdempotencyTTL,
+			webhookAttempts:   DefaultWebhookAttempts,
+			webhookBackoff:    DefaultWebhookBackoff,
+			webhookClient:     &http.Client{Timeout: DefaultWebhookTimeout},
+			priorityWeight:    DefaultPriorityWeight,
+			heartbeatInterval: DefaultHeartbeatInterval,
+		},
+	}
+	for _, o := range opts {
+		o(handler)
+	}
+	handler.validate = newValidator(handler.s)
+	if handler.s.breakerThreshold > 0 {
+		handler.breakers = make(map[string]*breaker, len(RouteClasses))
+		for _, class := range RouteClasses {
+			handler.breakers[class] = &breaker{}
+		}
+	}
+	for namespace, rate := range handler.s.namespaceRates {
+		if handler.limiters == nil {
+			handler.limiters = map[string]*tokenBucket{}
+		}
+		handler.limiters[namespace] = nil
+		if rate > 0 {
+			handler.limiters[namespace] = newTokenBucket(rate)
+		}
+	}
 	handler.router = mux.NewRouter()
-	handler.router.HandleFunc("/v1/keys", handler.postHandler).
+	v1 := handler.addVersion("v1")
+	v1.HandleFunc("/keys", handler.postHandler).
+		Methods("POST")
+	v1.HandleFunc("/keys", handler.scanHandler).
+		Methods("GET")
+	v1.HandleFunc("/keys", handler.deletePrefixHandler).
+		Methods("DELETE")
+	v1.HandleFunc("/keys/{key}", handler.getHandler).
+		Methods("GET")
+	v1.HandleFunc("/keys/{key}", handler.headHandler).
+		Methods("HEAD")
+	v1.HandleFunc("/keys/{key}", handler.putHandler).
+		Methods("PUT")
+	v1.HandleFunc("/keys/{key}", handler.deleteHandler).
+		Methods("DELETE")
+	v1.HandleFunc("/keys/{key}", handler.patchHandler).
+		Methods("PATCH")
+	v1.HandleFunc("/keys/{key}/touch", handler.touchHandler).
+		Methods("POST")
+	v1.HandleFunc("/keys/{key}/history", handler.historyHandler).
+		Methods("GET")
+	v1.HandleFunc("/keys/{key}/restore", handler.restoreHandler).
+		Methods("POST")
+	v1.HandleFunc("/keys/{key}/stats", handler.statsHandler).
+		Methods("GET")
+	v1.HandleFunc("/bitmaps/{key}/bits/{offset}", handler.getBitHandler).
+		Methods("GET")
+	v1.HandleFunc("/bitmaps/{key}/bits/{offset}", handler.setBitHandler).
+		Methods("PUT")
+	v1.HandleFunc("/bitmaps/{key}/count", handler.bitCountHandler).
+		Methods("GET")
+	v1.HandleFunc("/hyperloglogs/{key}/members", handler.addHyperLogLogHandler).
+		Methods("POST")
+	v1.HandleFunc("/hyperloglogs/{key}/count", handler.countHyperLogLogHandler).
+		Methods("GET")
+	v1.HandleFunc("/geo/{key}/members", handler.geoAddHandler).
 		Methods("POST")
-	handler.router.HandleFunc("/v1/keys/{key}", handler.getHandler).
+	v1.HandleFunc("/geo/{key}/search", handler.geoSearchHandler).
 		Methods("GET")
-	handler.router.HandleFunc("/v1/keys/{key}", handler.putHandler).
+	v1.HandleFunc("/ratelimit/{name}", handler.rateLimitHandler).
+		Methods("POST")
+	v1.HandleFunc("/leases", handler.acquireLeaseHandler).
+		Methods("POST")
+	v1.HandleFunc("/leases/{name}", handler.renewLeaseHandler).
 		Methods("PUT")
-	handler.router.HandleFunc("/v1/keys/{key}", handler.deleteHandler).
+	v1.HandleFunc("/leases/{name}", handler.releaseLeaseHandler).
 		Methods("DELETE")
-	handler.router.HandleFunc("/v1/ttl/{key}", handler.getTTLHandler).
+	v1.HandleFunc("/services/{service}/instances", handler.registerHandler).
+		Methods("POST")
+	v1.HandleFunc("/services/{service}/instances", handler.instancesHandler).
 		Methods("GET")
-	handler.router.HandleFunc("/v1/subscribe/{channel}", handler.subscribeHandler).
+	v1.HandleFunc("/services/{service}/instances/{id}", handler.heartbeatHandler).
+		Methods("PUT")
+	v1.HandleFunc("/services/{service}/instances/{id}", handler.deregisterHandler).
+		Methods("DELETE")
+	v1.HandleFunc("/services/{service}/watch", handler.watchHandler).
 		Methods("GET")
-	handler.router.HandleFunc("/v1/publish/{channel}", handler.publishHandler).
+	v1.HandleFunc("/ttl/batch", handler.batchTTLHandler).
 		Methods("POST")
+	v1.HandleFunc("/ttl/{key}", handler.getTTLHandler).
+		Methods("GET")
+	v1.HandleFunc("/subscribe/{channel}", handler.subscribeHandler).
+		Methods("GET")
+	v1.HandleFunc("/publish/{channel}", handler.publishHandler).
+		Methods("POST")
+	if !handler.s.adminDisabled {
+		v1.HandleFunc("/admin/expire-prefix", handler.expirePrefixHandler).
+			Methods("POST")
+		v1.HandleFunc("/admin/info", handler.infoHandler).
+			Methods("GET")
+		v1.HandleFunc("/admin/config", handler.configHandler).
+			Methods("GET")
+		v1.HandleFunc("/admin/ttl-histogram", handler.ttlHistogramHandler).
+			Methods("GET")
+		v1.HandleFunc("/admin/compact", handler.compactHandler).
+			Methods("POST")
+		v1.HandleFunc("/admin/startup-report", handler.startupReportHandler).
+			Methods("GET")
+		v1.HandleFunc("/admin/webhooks", handler.registerWebhookHandler).
+			Methods("POST")
+		v1.HandleFunc("/admin/webhooks", handler.listWebhooksHandler).
+			Methods("GET")
+		v1.HandleFunc("/admin/webhooks/{id}", handler.deleteWebhookHandler).
+			Methods("DELETE")
+		v1.HandleFunc("/admin/schedules", handler.registerScheduleHandler).
+			Methods("POST")
+		v1.HandleFunc("/admin/schedules", handler.listSchedulesHandler).
+			Methods("GET")
+		v1.HandleFunc("/admin/schedules/{id}", handler.deleteScheduleHandler).
+			Methods("DELETE")
+		v1.HandleFunc("/admin/import/redis", handler.redisImportHandler).
+			Methods("POST")
+		v1.HandleFunc("/admin/export/redis", handler.redisExportHandler).
+			Methods("GET")
+		handler.registerChaosRoutes(v1)
+	}
+	v1.HandleFunc("/export", handler.exportHandler).
+		Methods("GET")
+	v1.HandleFunc("/events", handler.eventsHandler).
+		Methods("GET")
+	v1.HandleFunc("/changes", handler.changesHandler).
+		Methods("GET")
+	v1.HandleFunc("/search", handler.searchHandler).
+		Methods("GET")
+	v1.HandleFunc("/openapi.json", handler.openAPIHandler).
+		Methods("GET")
+	handler.router.HandleFunc("/docs", handler.docsHandler).
+		Methods("GET")
+	handler.router.HandleFunc("/readyz", handler.readyHandler).
+		Methods("GET")
+	handler.registerExtraRoutes()
+
+	// Unmatched routes also respond with the error envelope
+	handler.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, CodeRouteNotFound, "Route not found")
+	})
+	handler.router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed")
+	})
 
 	// Prometheus metrics setup
-	p, m := newPromHandler()
+	p, m := newPromHandler(db.GetMirrorStats, db.GetPersistenceStats, db.GetCompactionStats)
 	handler.m = m
 	handler.router.Handle("/metrics", p)
+	if handler.s.writeLaneLimit > 0 {
+		handler.lanes = newWriteLanes(handler.s.writeLaneLimit, handler.s.priorityWeight, m.dbWriteQueueDepth)
+	}
 
 	handler.router.Use(handler.prometheusMiddleware)
 	handler.router.Use(handler.loggingMiddleware)
+	handler.router.Use(handler.recoveryMiddleware)
+	handler.router.Use(handler.adminMiddleware)
+	handler.router.Use(handler.routeMiddleware)
+	handler.router.Use(handler.laneMiddleware)
+	for _, m := range handler.middleware {
+		handler.router.Use(m)
+	}
 
 	return handler
 }
 
 func (h *Wrapper) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	request, ok := h.negotiateVersion(writer, request)
+	if !ok {
+		return
+	}
 	h.router.ServeHTTP(writer, request)
 }
 
-// postHandler uses request key and value from the request body to set the key value pair in the database
+// postHandler uses request key and value from the request body to set the key value pair in the database. With an
+// Idempotency-Key header, a retry of a successful request returns the original key instead of creating another. The
+// response carries when the key expires and the hash of the value.
 func (h *Wrapper) postHandler(w http.ResponseWriter, r *http.Request) {
 	var rData postRequest
 	err := json.NewDecoder(r.Body).Decode(&rData)
 	w.Header().Set("Content-Type", "application/json")
 
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, err.Error())
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
 		return
 	}
 
 	// Validate the input
-	validate := validator.New()
-	err = validate.Struct(rData)
+	err = h.validate.Struct(rData)
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Validation errors when parsing post request: %s", err.Error()))
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing post request: %s", err.Error()))
+		return
+	}
+	if isInternalKey(rData.Key) {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "Keys starting with "+idempotencyPrefix+" are reserved")
+		return
+	}
+
+	if !h.admitNamespace(w, rData.Key) {
 		return
 	}
 
+	// An absolute expiration is subject to the same bounds once converted into a ttl
+	ttl := h.resolveTTL(rData.Ttl, rData.ExpiresAt)
+	if rData.ExpiresAt != nil {
+		if err = h.validate.Var(*ttl, "dbttl"); err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "expiresAt is outside of the allowed ttl bounds")
+			return
+		}
+	}
+	if ttl != nil {
+		*ttl = h.clampTTL(*ttl)
+	}
+	if !rData.expirationGiven {
+		ttl = h.defaultTTL(rData.Key)
+	}
+
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("%v must be at most %d bytes", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+		return
+	}
+	var fingerprint string
+	if idempotencyKey != "" {
+		fingerprint = rData.fingerprint()
+		existing, claimed, err := h.claimIdempotencyKey(idempotencyKey, fingerprint)
+		switch {
+		case err != nil:
+			h.writeFailed(w, idempotencyRecordKey(idempotencyKey), err)
+			return
+		case claimed:
+		case existing.Fingerprint != fingerprint:
+			writeJSONError(w, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, "Idempotency key was already used with a different request")
+			return
+		case existing.Key == "":
+			writeJSONError(w, http.StatusConflict, CodeIdempotencyKeyInProgress, "A request with this idempotency key is still in progress")
+			return
+		default:
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, http.StatusCreated, h.postState(existing.Key, rData.Value))
+			return
+		}
+	}
+
 	// Forward the post request
-	set, key := h.db.Create(struct {
+	set, key, err := h.db.Create(struct {
+		Key   string `json:"key"`
 		Value string `json:"value"`
 		Ttl   *int64 `json:"ttl"`
-	}(rData))
+	}{
+		Key:   rData.Key,
+		Value: rData.Value,
+		Ttl:   ttl,
+	})
 
-	if !set {
-		writeJSONError(w, http.StatusInternalServerError, "Failed while adding key-value pair to store")
+	if !set && idempotencyKey != "" {
+		h.releaseIdempotencyKey(idempotencyKey)
+	}
+
+	if err != nil {
+		h.writeFailed(w, key, err)
+		return
+	}
+
+	if !set && rData.Key != "" {
+		writeJSONError(w, http.StatusConflict, CodeKeyExists, "Key already exists")
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	response := postResponse{Key: key}
+	if !set {
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Failed while adding key-value pair to store")
+		return
+	}
 
-	err = json.NewEncoder(w).Encode(response)
-	if err != nil {
-		h.logger.Error("Error occurred while encoding json to post request", "error: ", err)
+	if idempotencyKey != "" {
+		h.completeIdempotencyKey(idempotencyKey, fingerprint, key)
 	}
+	writeJSON(w, http.StatusCreated, h.postState(key, rData.Value))
 }
 
-// getHandler uses the request key and returns the associated value if it exists
+// postState describes a value that was just created under the key
+func (h *Wrapper) postState(key string, value string) postResponse {
+	sum := sha256.Sum256([]byte(value))
+	response := postResponse{Key: key, ValueHash: hex.EncodeToString(sum[:])}
+	_, response.ExpiresAt = h.expiration(key)
+	return response
+}
+
+// getHandler uses the request key and returns the associated value if it exists. Responses carry ETag and
+// Last-Modified headers, and a 304 is returned when the request's If-None-Match holds the ETag or, without an
+// If-None-Match, when the value has not changed since If-Modified-Since. HTTP dates only have second precision, so a
+// client that only sends If-Modified-Since misses a write made in the same second as the one it read. The optional
+// path query parameter projects a JSON value down to the JSON encoding of one of its members, e.g. ?path=$.user.name.
 func (h *Wrapper) getHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	value, loaded := h.db.Get(key)
-	response := getResponse{Key: key, Value: value}
+
+	var path []any
+	if r.URL.RawQuery != "" {
+		if p := r.URL.Query().Get("path"); p != "" {
+			var err error
+			if path, err = parsePath(p); err != nil {
+				writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, err.Error())
+				return
+			}
+		}
+	}
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+	entry, loaded := h.getEntry(key)
+	if !loaded && h.origin.fetch != nil {
+		value, found, err := h.fetchOrigin(r.Context(), key)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, CodeOriginFailed, err.Error())
+			return
+		}
+		if found {
+			// Read the stored value back for its version, falling back to the fetched value if it could not be stored
+			if entry, loaded = h.db.GetEntry(key); !loaded {
+				entry.Value, loaded = value, true
+			}
+		}
+	}
+	response := getResponse{Key: key, Value: entry.Value}
 	w.Header().Set("Content-Type", "application/json")
 
 	if !loaded {
-		writeJSONError(w, http.StatusNotFound, "Key not found")
+		writeJSONError(w, http.StatusNotFound, CodeKeyNotFound, "Key not found")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	tag := entityTag(entry.Version)
+	if tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+	if !entry.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", entry.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
 
-	err := json.NewEncoder(w).Encode(response)
-	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	// The ETag changes on every write, so it is preferred over If-Modified-Since, whose dates have second precision
+	if header := r.Header.Get("If-None-Match"); header != "" && tag != "" {
+		if matchesIfNoneMatch(header, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if !entry.UpdatedAt.IsZero() {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err == nil && !entry.UpdatedAt.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if path != nil {
+		var err error
+		response.Value, err = project(entry.Value, path)
+		switch {
+		case errors.Is(err, errNotJSON):
+			writeJSONError(w, http.StatusConflict, CodeValueNotJSON, "Cannot project the value of "+key+": "+err.Error())
+			return
+		case errors.Is(err, errPathNotFound):
+			writeJSONError(w, http.StatusNotFound, CodePathNotFound, err.Error())
+			return
+		case err != nil:
+			writeJSONError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// headHandler reports whether a key exists with a 200 or 404 and no body, for clients that poll for existence without
+// needing the value. The ETag and Last-Modified headers match a GET, and the TTL and Expires-At headers are set for
+// keys that expire. Unlike a GET, a missing key is not fetched from the origin.
+func (h *Wrapper) headHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if !h.admitNamespace(w, key) {
 		return
 	}
+
+	entry, loaded := h.getEntry(key)
+	if !loaded {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if tag := entityTag(entry.Version); tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+	if !entry.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", entry.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+	if ttl, loaded := h.getTTL(key); loaded && ttl != nil {
+		w.Header().Set("TTL", strconv.FormatInt(*ttl, 10))
+		w.Header().Set("Expires-At", time.Unix(h.db.Now().Unix()+*ttl, 0).UTC().Format(time.RFC3339))
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 // putHandler uses request key and value from the request body to set the key value pair in the database
-// Users are allowed to update the ttl through "PUT" operations.
+// Users are allowed to update the ttl through "PUT" operations. The response holds the resulting state of the key.
 func (h *Wrapper) putHandler(w http.ResponseWriter, r *http.Request) {
 	var rData putRequest
 	err := json.NewDecoder(r.Body).Decode(&rData)
@@ -189,123 +773,414 @@ func (h *Wrapper) putHandler(w http.ResponseWriter, r *http.Request) {
 	rData.Key = vars["key"]
 
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Error occurred when parsing put request: %v", err))
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing put request: %v", err))
 		return
 	}
 
 	// Validate the input
-	validate := validator.New()
-	err = validate.Struct(rData)
+	err = h.validate.Struct(rData)
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Validation errors when parsing put request: %v", err))
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing put request: %v", err))
+		return
+	}
+
+	// An absolute expiration is subject to the same bounds once converted into a ttl
+	ttl := h.resolveTTL(rData.Ttl, rData.ExpiresAt)
+	if rData.ExpiresAt != nil {
+		if err = h.validate.Var(*ttl, "dbttl"); err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "expiresAt is outside of the allowed ttl bounds")
+			return
+		}
+	}
+	if ttl != nil {
+		*ttl = h.clampTTL(*ttl)
+	}
+	if !rData.expirationGiven {
+		ttl = h.defaultTTL(rData.Key)
+	}
+
+	if !h.admitNamespace(w, rData.Key) {
 		return
 	}
 
 	// Forward the put request
-	set := h.db.Put(struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
-		Ttl   *int64 `json:"ttl"`
-	}(rData))
-	if set {
-		w.WriteHeader(http.StatusOK)
+	var set bool
+	if rData.Lease != "" {
+		var found bool
+		set, found, err = h.db.PutLeased(rData.Key, rData.Value, rData.Lease, rData.LeaseID)
+		if !found {
+			writeJSONError(w, http.StatusNotFound, CodeLeaseNotFound, "Lease not found")
+			return
+		}
 	} else {
-		w.WriteHeader(http.StatusCreated)
+		set, err = h.db.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{
+			Key:   rData.Key,
+			Value: rData.Value,
+			Ttl:   ttl,
+		})
 	}
-
-	_, err = w.Write([]byte("{}"))
 	if err != nil {
+		h.writeFailed(w, rData.Key, err)
 		return
 	}
+	response := h.putState(rData.Key, !set)
+	if tag := entityTag(response.Version); tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+	if set {
+		writeJSON(w, http.StatusOK, response)
+	} else {
+		writeJSON(w, http.StatusCreated, response)
+	}
+}
+
+// putState reads back the ttl and version of a key that was just put. Another write to the key may land in between,
+// in which case its state is reported instead.
+func (h *Wrapper) putState(key string, created bool) putResponse {
+	response := putResponse{Key: key, Created: created}
+	if entry, ok := h.db.GetEntry(key); ok {
+		response.Version = entry.Version
+	}
+	response.TTL, response.ExpiresAt = h.expiration(key)
+	return response
 }
 
-// deleteHandler uses the request key to delete the key value pair from the database
+// expiration reads back the remaining ttl of a key and when it expires, both of which are nil if it does not expire
+func (h *Wrapper) expiration(key string) (*int64, *time.Time) {
+	ttl, ok := h.db.GetTTL(key)
+	if !ok || ttl == nil {
+		return nil, nil
+	}
+	e := time.Unix(h.db.Now().Unix()+*ttl, 0).UTC()
+	return ttl, &e
+}
+
+// deleteHandler uses the request key to delete the key value pair from the database. The delete is conditional when
+// the request has an If-Match header with the ETag of the value from a GET, or a body with the expected value, so
+// that a key another writer has just updated is not deleted. A failed condition responds with 412.
 func (h *Wrapper) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	deleted := h.db.Delete(key)
-	if deleted {
-		w.WriteHeader(http.StatusOK)
+
+	var rData deleteRequest
+	if r.Body != nil {
+		err := json.NewDecoder(r.Body).Decode(&rData)
+		if err != nil && !errors.Is(err, io.EOF) {
+			writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing delete request: %v", err))
+			return
+		}
+		if err == nil {
+			if err = h.validate.Struct(rData); err != nil {
+				writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing delete request: %v", err))
+				return
+			}
+		}
+	}
+	ifMatch := r.Header.Get("If-Match")
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+
+	var deleted bool
+	if ifMatch == "" && rData.ExpectedValue == nil {
+		deleted = h.db.Delete(key)
 	} else {
-		writeJSONError(w, http.StatusNotFound, "Key not found")
+		var found bool
+		deleted, found = h.db.DeleteIf(key, func(value string, version uint64) bool {
+			return (ifMatch == "" || matchesIfMatch(ifMatch, version)) &&
+				(rData.ExpectedValue == nil || value == *rData.ExpectedValue)
+		})
+		if found && !deleted {
+			writeJSONError(w, http.StatusPreconditionFailed, CodePreconditionFailed, "The value of the key does not match the delete condition")
+			return
+		}
+	}
+	if !deleted {
+		writeJSONError(w, http.StatusNotFound, CodeKeyNotFound, "Key not found")
 		return
 	}
 
-	_, err := w.Write([]byte("{}"))
+	writeJSON(w, http.StatusOK, keyResponse{Key: key})
+}
+
+// expirePrefixHandler applies a ttl to every key with the requested prefix, e.g. to retire a dataset generation
+func (h *Wrapper) expirePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	var rData expirePrefixRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing expire prefix request: %v", err))
+		return
+	}
+
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing expire prefix request: %v", err))
+		return
+	}
+
+	n, err := h.db.ExpirePrefix(rData.Prefix, h.clampTTL(*rData.Ttl))
 	if err != nil {
+		h.writeFailed(w, rData.Prefix, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, expirePrefixResponse{Prefix: rData.Prefix, Expired: n})
+}
+
+// infoHandler returns runtime statistics about the database
+func (h *Wrapper) infoHandler(w http.ResponseWriter, r *http.Request) {
+	info := h.db.GetInfo()
+	writeJSON(w, http.StatusOK, infoResponse{Keys: info.Keys, Seq: info.Seq, NodeID: info.NodeID})
+}
+
+// readyHandler reports whether the database is ready to serve traffic. It responds with 503 until the startup files
+// have been loaded and any warmup has finished, so that load balancers only route to warm instances, and while writes
+// are rejected because persistence keeps failing. Failing persistence that writes are still accepted under is listed.
+func (h *Wrapper) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.db.Ready() {
+		writeJSONError(w, http.StatusServiceUnavailable, CodeNotReady, "Database is still warming up")
+		return
+	}
+
+	var failing []string
+	for _, kind := range persistenceKinds {
+		stats := h.db.GetPersistenceStats(kind)
+		switch {
+		case stats.RejectingWrites:
+			writeJSONError(w, http.StatusServiceUnavailable, CodePersistenceFailed, "Writes are rejected while the "+kind+" persistence is failing")
+			return
+		case stats.Failing:
+			failing = append(failing, kind)
+		}
+	}
+	writeJSON(w, http.StatusOK, readyResponse{Ready: true, Failing: failing})
+}
+
+// configHandler returns the configuration the server was started with
+func (h *Wrapper) configHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.s.config)
 }
 
 // getTTLHandler will get the remaining TTL for a key value pair
 func (h *Wrapper) getTTLHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	ttl, loaded := h.db.GetTTL(key)
+	if !h.admitNamespace(w, key) {
+		return
+	}
+	ttl, loaded := h.getTTL(key)
 	response := getTTLResponse{Key: key}
 	if loaded && ttl != nil {
 		response.TTL = ttl
+		e := time.Unix(h.db.Now().Unix()+*ttl, 0).UTC()
+		response.ExpiresAt = &e
 	}
 	w.Header().Set("Content-Type", "application/json")
 
 	if !loaded {
-		writeJSONError(w, http.StatusNotFound, "Key not found")
+		writeJSONError(w, http.StatusNotFound, CodeKeyNotFound, "Key not found")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, response)
+}
 
-	err := json.NewEncoder(w).Encode(response)
-	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
+// scanHandler returns a page of keys in lexicographic order. The query parameters prefix, cursor and limit are all
+// optional, and the returned cursor is passed back to get the next page. Requests that accept NDJSON instead get every
+// key after the cursor streamed one per line, so the limit is ignored. Like an export, a scan carries the ETag of the
+// dataset and responds with a 304 to a matching If-None-Match.
+func (h *Wrapper) scanHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	rData := scanRequest{Prefix: query.Get("prefix"), Cursor: query.Get("cursor"), Limit: DefaultScanLimit}
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing scan limit: %v", err))
+			return
+		}
+		rData.Limit = limit
+	}
+
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing scan request: %v", err))
+		return
+	}
+	if !h.checkGeneration(w, r) {
+		return
+	}
+
+	if wantsNDJSON(r) {
+		h.streamScan(w, r, rData.Prefix, rData.Cursor)
+		return
+	}
+
+	// Internal keys are left out, so a page may hold fewer keys than the limit while the cursor is still set
+	keys, cursor := h.db.Scan(rData.Prefix, rData.Cursor, rData.Limit)
+	keys = slices.DeleteFunc(keys, isInternalKey)
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, scanResponse{Keys: keys, Cursor: cursor})
+}
+
+// deletePrefixHandler deletes every key with the prefix query parameter, e.g. DELETE /v1/keys?prefix=session: to drop
+// every session. The prefix is required so that a bare DELETE cannot wipe the database, and prefixes that overlap the
+// internal namespaces are rejected so that handler state is never deleted. dryRun=true only counts the keys that
+// would be deleted.
+func (h *Wrapper) deletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	if prefix == "" {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "A prefix is required to delete keys by prefix")
+		return
 	}
+	dryRun := false
+	if d := query.Get("dryRun"); d != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(d); err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing dryRun: %v", err))
+			return
+		}
+	}
+	if overlapsInternalKeys(prefix) {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "The prefix overlaps a reserved internal namespace")
+		return
+	}
+	if !h.admitNamespace(w, prefix) {
+		return
+	}
+
+	n := h.db.DeletePrefix(prefix, dryRun)
+	writeJSON(w, http.StatusOK, deletePrefixResponse{Prefix: prefix, Deleted: n, DryRun: dryRun})
 }
 
-// subscribeHandler allows a client to subscribe to a specific channel and receive string messages over the channel
+// batchTTLHandler gets the remaining TTL for every key in the request body in one round trip. Results are returned in
+// the same order as the requested keys.
+func (h *Wrapper) batchTTLHandler(w http.ResponseWriter, r *http.Request) {
+	var rData batchTTLRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing batch ttl request: %v", err))
+		return
+	}
+
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing batch ttl request: %v", err))
+		return
+	}
+
+	response := batchTTLResponse{Results: make([]batchTTLResult, 0, len(rData.Keys))}
+	now := h.db.Now().Unix()
+	for _, key := range rData.Keys {
+		ttl, loaded := h.db.GetTTL(key)
+		result := batchTTLResult{Key: key, Exists: loaded}
+		if loaded && ttl != nil {
+			result.TTL = ttl
+			e := time.Unix(now+*ttl, 0).UTC()
+			result.ExpiresAt = &e
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// subscribeHandler allows a client to subscribe to a specific channel and receive string messages over the channel.
+// Subscribers that name a group share the messages with the other members of the group instead of each receiving
+// every message.
 func (h *Wrapper) subscribeHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	channel := vars["channel"]
+	if !h.authorizeChannel(w, r, channel, ChannelSubscribe) {
+		return
+	}
 
 	// Check if SSE is valid for the writer
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		writeJSONError(w, http.StatusInternalServerError, "Streaming unsupported")
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Streaming unsupported")
 		return
 	}
 
+	h.broker.mu.Lock()
+	ip, ok := h.admitSubscriber(w, r)
+	if !ok {
+		h.broker.mu.Unlock()
+		return
+	}
+	s := newSubscriber(ip)
+	s.group = r.URL.Query().Get("group")
+	h.subscribe(channel, s)
+	h.broker.mu.Unlock()
+
+	// Subscriptions are long-lived so they are exempt from the server's read and write timeouts
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
 	// SSE headers
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-	c := make(chan string, 10)
-
-	h.broker.mu.Lock()
-	h.broker.channels[channel] = append(h.broker.channels[channel], c)
-	h.broker.mu.Unlock()
-
-	// Run a go func to remove the subscriber from the channel when they disconnect
+	// Run a go func to remove the subscriber from the channel when they disconnect. A slow consumer is usually stuck
+	// writing to its connection, so it is given a write deadline to unblock it once it is disconnected.
 	ctx := r.Context()
 	go func() {
-		<-ctx.Done()
-		h.broker.mu.Lock()
-		for i, ch := range h.broker.channels[channel] {
-			if ch == c {
-				h.broker.channels[channel] = append(h.broker.channels[channel][:i], h.broker.channels[channel][i+1:]...)
-				break
-			}
+		select {
+		case <-ctx.Done():
+		case <-s.kick:
+			_ = rc.SetWriteDeadline(time.Now().Add(slowConsumerWriteTimeout))
+			<-ctx.Done()
 		}
-		close(c)
+		h.broker.mu.Lock()
+		h.unsubscribe(channel, s)
 		h.broker.mu.Unlock()
 	}()
 
-	for message := range c {
-		_, err := fmt.Fprintf(w, "data: %s\n\n", message)
-		if err != nil {
-			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Error writing message: %v", err))
+	// Idle subscriptions are sent heartbeats. The heartbeat channel is left nil without them, so that it never fires.
+	var ticker *time.Ticker
+	var heartbeat <-chan time.Time
+	if h.s.heartbeatInterval > 0 {
+		ticker = time.NewTicker(h.s.heartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	// Every message waiting when the subscriber wakes up is written before a single flush
+	var batch []string
+	for {
+		select {
+		case <-heartbeat:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-s.ready:
+			batch, ok = s.drain(batch[:0])
+			if !ok {
+				return
+			}
+			for _, message := range batch {
+				_, err := fmt.Fprintf(w, "data: %s\n\n", message)
+				if err != nil {
+					writeJSONError(w, http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Error writing message: %v", err))
+					return
+				}
+			}
+			flusher.Flush()
+			if ticker != nil {
+				ticker.Reset(h.s.heartbeatInterval)
+			}
+		case <-s.kick:
+			h.logger.Warn("disconnecting slow subscriber", "channel", channel, "lag", s.lag().String(), "dropped", s.dropped.Load())
+			_, _ = fmt.Fprint(w, "event: disconnect\ndata: slow consumer\n\n")
+			flusher.Flush()
 			return
 		}
-		flusher.Flush()
 	}
 }
 
@@ -313,34 +1188,49 @@ func (h *Wrapper) subscribeHandler(w http.ResponseWriter, r *http.Request) {
 func (h *Wrapper) publishHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	channel := vars["channel"]
+	if !h.authorizeChannel(w, r, channel, ChannelPublish) {
+		return
+	}
 
+	// The body is limited so that a huge message is rejected without being read into memory
 	var pData publishRequest
-	if err := json.NewDecoder(r.Body).Decode(&pData); err != nil {
-		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Publish request has bad body: %v", err))
+	body := http.MaxBytesReader(w, r.Body, 2*int64(h.s.maxMessageLength)+publishBodyOverhead)
+	if err := json.NewDecoder(body).Decode(&pData); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, CodeMessageTooLarge, fmt.Sprintf("Messages must be at most %d bytes", h.s.maxMessageLength))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Publish request has bad body: %v", err))
 		return
 	}
 
-	validate := validator.New()
-	err := validate.Struct(pData)
-	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Message required for publish request")
+	err := h.validate.Struct(pData)
+	switch {
+	case err != nil && isTooLarge(err):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, CodeMessageTooLarge, fmt.Sprintf("Messages must be at most %d bytes", h.s.maxMessageLength))
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "Message required for publish request")
 		return
 	}
-
-	h.broker.mu.RLock()
-	defer h.broker.mu.RUnlock()
-
-	for _, c := range h.broker.channels[channel] {
-		select {
-		case c <- pData.Message:
-		default:
-			// Drop message if the channel is full
-		}
+	if err = h.validateMessage(channel, pData.Message); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, CodeMessageInvalid, fmt.Sprintf("Message rejected for channel %v: %v", channel, err))
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte(`{}`))
-	if err != nil {
+	// A relayed message has already been forwarded by the instance it was published on. Messages an instance relays to
+	// itself are dropped so that listing every instance as a peer does not deliver them twice.
+	if from := r.Header.Get(RelayHeader); from != "" {
+		if from != h.db.GetInfo().NodeID {
+			h.Deliver(channel, pData.Message)
+		}
+		writeJSON(w, http.StatusOK, publishResponse{Channel: channel})
 		return
 	}
+
+	h.Deliver(channel, pData.Message)
+	h.forward(channel, pData.Message)
+
+	writeJSON(w, http.StatusOK, publishResponse{Channel: channel})
 }
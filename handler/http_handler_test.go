@@ -1,18 +1,34 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // databaseTestImplementation is an implementation of database used for test cases
@@ -26,17 +42,24 @@ type databaseTestImplementation struct {
 	}
 	createKey    string
 	createReturn bool
+	createErr    error
 	readCalls    []struct {
 		key string
 	}
-	readReturn bool
-	readString string
-	putCalls   []struct {
+	readReturn    bool
+	readString    string
+	readUpdatedAt time.Time
+	readVersion   uint64
+	putCalls      []struct {
 		key   string
 		value string
 		ttl   *int64
 	}
 	putReturn   bool
+	notReady    bool                        // Whether Ready reports that the database is still warming up
+	mirror      mirrorStats                 // Returned by GetMirrorStats
+	persistence map[string]persistenceStats // Returned by GetPersistenceStats
+	putErr      error
 	deleteCalls []struct {
 		key string
 	}
@@ -44,38 +67,120 @@ type databaseTestImplementation struct {
 	getTTLCalls  []struct {
 		key string
 	}
-	getTTLReturn bool
-	getTTLTime   *int64
+	getTTLReturn      bool
+	getTTLTime        *int64
+	now               time.Time // Returned by Now, or the real time if zero
+	expirePrefixCalls []struct {
+		prefix string
+		ttl    int64
+	}
+	expirePrefixReturn int
+	expirePrefixErr    error
+	touchCalls         []struct {
+		key string
+		ttl int64
+	}
+	touchReturn       bool
+	touchErr          error
+	deletePrefixCalls []struct {
+		prefix string
+		dryRun bool
+	}
+	deletePrefixReturn int
+	scanCalls          []struct {
+		prefix string
+		cursor string
+		limit  int
+	}
+	scanKeys    []string
+	scanCursor  string
+	scanEntries []struct {
+		Key   string
+		Value string
+		Ttl   *int64
+	}
+	info struct {
+		Keys   int
+		Seq    uint64
+		NodeID string
+	}
+	eventsCalls []struct {
+		prefix string
+	}
+	leaseCalls []struct {
+		method string
+		name   string
+		id     string
+	}
+	leaseID      string // The id of the lease, which must be presented to use it
+	leaseHeld    bool   // Whether the lease is held so that it cannot be acquired
+	leaseDeleted int    // The number of keys released with the lease
+	changes      []change
+	changesErr   error
+	search       []searchResult // The results of every search. Nil disables search.
+	ttlHistogram []ttlBucket    // The buckets of the ttl histogram, whatever the bounds
+	searchCalls  []struct {
+		query  string
+		prefix string
+		limit  int
+	}
+	history      map[string][]keyVersion // The versions of each key, newest first. Nil disables the history.
+	restoreCalls []uint64
+	restoreErr   error
+	keyStats     map[string]keyStats // The stats of each key. Nil disables the stats.
+	compactions  []compaction        // Returned by Compact, one per call
+	compacted    compactionStats     // The compactions returned so far
+	startup      startupSummary      // Returned by GetStartupSummary
+	events       []struct {
+		Type string
+		Key  string
+		Time time.Time
+	}
 }
 
 func (db *databaseTestImplementation) Create(data struct {
+	Key   string `json:"key"`
 	Value string `json:"value"`
 	Ttl   *int64 `json:"ttl"`
-}) (bool, string) {
+}) (bool, string, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+
+	// Client-supplied keys take the place of a generated key
+	key := db.createKey
+	if data.Key != "" {
+		key = data.Key
+	}
 	db.createCalls = append(db.createCalls, struct {
 		key   string
 		value string
 		ttl   *int64
-	}{db.createKey, data.Value, data.Ttl})
-	return db.createReturn, db.createKey
+	}{key, data.Value, data.Ttl})
+	return db.createReturn, key, db.createErr
 }
 
-func (db *databaseTestImplementation) Get(key string) (string, bool) {
+func (db *databaseTestImplementation) GetEntry(key string) (struct {
+	Value     string
+	UpdatedAt time.Time
+	Version   uint64
+}, bool) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	db.readCalls = append(db.readCalls, struct {
 		key string
 	}{key})
-	return db.readString, db.readReturn
+	return struct {
+		Value     string
+		UpdatedAt time.Time
+		Version   uint64
+	}{db.readString, db.readUpdatedAt, db.readVersion}, db.readReturn
 }
 
 func (db *databaseTestImplementation) Put(data struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
 	Ttl   *int64 `json:"ttl"`
-}) bool {
+}) (bool, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	db.putCalls = append(db.putCalls, struct {
@@ -83,7 +188,264 @@ func (db *databaseTestImplementation) Put(data struct {
 		value string
 		ttl   *int64
 	}{data.Key, data.Value, data.Ttl})
-	return db.putReturn
+	return db.putReturn, db.putErr
+}
+
+// PutLeased puts the key under the lease if the id matches leaseID
+func (db *databaseTestImplementation) PutLeased(key string, value string, name string, id string) (bool, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.leaseCalls = append(db.leaseCalls, struct {
+		method string
+		name   string
+		id     string
+	}{"PutLeased", name, id})
+	if id != db.leaseID {
+		return false, false, nil
+	}
+	db.putCalls = append(db.putCalls, struct {
+		key   string
+		value string
+		ttl   *int64
+	}{key, value, nil})
+	return db.putReturn, true, db.putErr
+}
+
+func (db *databaseTestImplementation) AcquireLease(name string, ttl int64) (string, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.leaseCalls = append(db.leaseCalls, struct {
+		method string
+		name   string
+		id     string
+	}{"AcquireLease", name, fmt.Sprint(ttl)})
+	if db.leaseHeld {
+		return "", false
+	}
+	return db.leaseID, true
+}
+
+func (db *databaseTestImplementation) RenewLease(name string, id string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.leaseCalls = append(db.leaseCalls, struct {
+		method string
+		name   string
+		id     string
+	}{"RenewLease", name, id})
+	return id == db.leaseID
+}
+
+func (db *databaseTestImplementation) ReleaseLease(name string, id string) (int, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.leaseCalls = append(db.leaseCalls, struct {
+		method string
+		name   string
+		id     string
+	}{"ReleaseLease", name, id})
+	if id != db.leaseID {
+		return 0, false
+	}
+	return db.leaseDeleted, true
+}
+
+// Update reports that the key does not exist
+func (db *databaseTestImplementation) Update(string, func(string) (string, error)) (bool, error) {
+	return false, nil
+}
+
+func (db *databaseTestImplementation) Upsert(string, func(string, bool) (string, error)) (bool, error) {
+	return false, nil
+}
+
+func (db *databaseTestImplementation) UpsertTTL(string, int64, func(string, bool) (string, error)) (bool, error) {
+	return false, nil
+}
+
+func (db *databaseTestImplementation) Scan(prefix string, cursor string, limit int) ([]string, string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.scanCalls = append(db.scanCalls, struct {
+		prefix string
+		cursor string
+		limit  int
+	}{prefix, cursor, limit})
+	return db.scanKeys, db.scanCursor
+}
+
+// ScanEntries pages through scanEntries, which must be sorted by key. The prefix is ignored.
+func (db *databaseTestImplementation) ScanEntries(prefix string, cursor string, limit int) ([]struct {
+	Key   string
+	Value string
+	Ttl   *int64
+}, string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.scanCalls = append(db.scanCalls, struct {
+		prefix string
+		cursor string
+		limit  int
+	}{prefix, cursor, limit})
+
+	entries := db.scanEntries
+	for len(entries) > 0 && entries[0].Key <= cursor {
+		entries = entries[1:]
+	}
+	if len(entries) <= limit {
+		return entries, ""
+	}
+	return entries[:limit], entries[limit-1].Key
+}
+
+// Ready reports false when notReady is set
+func (db *databaseTestImplementation) Ready() bool {
+	return !db.notReady
+}
+
+func (db *databaseTestImplementation) GetMirrorStats() mirrorStats {
+	return db.mirror
+}
+
+func (db *databaseTestImplementation) GetPersistenceStats(kind string) persistenceStats {
+	return db.persistence[kind]
+}
+
+// ReadChanges returns the changes after since. The returned channel is never closed since no changes are added.
+func (db *databaseTestImplementation) ReadChanges(since uint64, limit int) ([]change, <-chan struct{}, error) {
+	if db.changesErr != nil {
+		return nil, nil, db.changesErr
+	}
+	var changes []change
+	for _, c := range db.changes {
+		if c.Seq > since && len(changes) < limit {
+			changes = append(changes, c)
+		}
+	}
+	return changes, make(chan struct{}), nil
+}
+
+// Search returns up to limit of the configured results, whatever the query
+func (db *databaseTestImplementation) Search(query string, prefix string, limit int) ([]searchResult, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.searchCalls = append(db.searchCalls, struct {
+		query  string
+		prefix string
+		limit  int
+	}{query, prefix, limit})
+	if db.search == nil {
+		return nil, false
+	}
+	return db.search[:min(limit, len(db.search))], true
+}
+
+func (db *databaseTestImplementation) History(key string) ([]keyVersion, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.history == nil {
+		return nil, false
+	}
+	return db.history[key], true
+}
+
+func (db *databaseTestImplementation) KeyStats(key string) (keyStats, bool, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.keyStats == nil {
+		return keyStats{}, false, false
+	}
+	stats, exists := db.keyStats[key]
+	return stats, exists, true
+}
+
+// Compact returns the next of the configured compactions
+func (db *databaseTestImplementation) Compact() compaction {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	c := db.compactions[0]
+	db.compactions = db.compactions[1:]
+	db.compacted.Runs++
+	db.compacted.Reclaimed += c.Reclaimed
+	return c
+}
+
+func (db *databaseTestImplementation) GetCompactionStats() compactionStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.compacted
+}
+
+func (db *databaseTestImplementation) GetStartupSummary() startupSummary {
+	return db.startup
+}
+
+func (db *databaseTestImplementation) RestoreVersion(key string, version uint64) (bool, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.restoreCalls = append(db.restoreCalls, version)
+	if db.restoreErr != nil {
+		return true, false, db.restoreErr
+	}
+	versions, exists := db.history[key]
+	for _, v := range versions {
+		if v.Version == version {
+			return true, true, nil
+		}
+	}
+	return exists, false, nil
+}
+
+func (db *databaseTestImplementation) GetTTLHistogram(bounds []time.Duration) struct {
+	Buckets []ttlBucket
+	Total   ttlBucket
+} {
+	histogram := struct {
+		Buckets []ttlBucket
+		Total   ttlBucket
+	}{Buckets: db.ttlHistogram}
+	if len(db.ttlHistogram) > 0 {
+		histogram.Total = db.ttlHistogram[len(db.ttlHistogram)-1]
+	}
+	return histogram
+}
+
+func (db *databaseTestImplementation) GetInfo() struct {
+	Keys   int
+	Seq    uint64
+	NodeID string
+} {
+	return db.info
+}
+
+func (db *databaseTestImplementation) ExpirePrefix(prefix string, ttl int64) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expirePrefixCalls = append(db.expirePrefixCalls, struct {
+		prefix string
+		ttl    int64
+	}{prefix, ttl})
+	return db.expirePrefixReturn, db.expirePrefixErr
+}
+
+func (db *databaseTestImplementation) Touch(key string, ttl int64) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.touchCalls = append(db.touchCalls, struct {
+		key string
+		ttl int64
+	}{key, ttl})
+	return db.touchReturn, db.touchErr
+}
+
+func (db *databaseTestImplementation) DeletePrefix(prefix string, dryRun bool) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.deletePrefixCalls = append(db.deletePrefixCalls, struct {
+		prefix string
+		dryRun bool
+	}{prefix, dryRun})
+	return db.deletePrefixReturn
 }
 
 func (db *databaseTestImplementation) Delete(key string) bool {
@@ -95,6 +457,19 @@ func (db *databaseTestImplementation) Delete(key string) bool {
 	return db.deleteReturn
 }
 
+// DeleteIf deletes the key if deleteReturn reports that it exists and cond holds for readString and readVersion
+func (db *databaseTestImplementation) DeleteIf(key string, cond func(string, uint64) bool) (bool, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.deleteCalls = append(db.deleteCalls, struct {
+		key string
+	}{key})
+	if !db.deleteReturn {
+		return false, false
+	}
+	return cond(db.readString, db.readVersion), true
+}
+
 func (db *databaseTestImplementation) GetTTL(key string) (*int64, bool) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -104,6 +479,41 @@ func (db *databaseTestImplementation) GetTTL(key string) (*int64, bool) {
 	return db.getTTLTime, db.getTTLReturn
 }
 
+func (db *databaseTestImplementation) Now() time.Time {
+	if db.now.IsZero() {
+		return time.Now()
+	}
+	return db.now
+}
+
+// SubscribeEvents returns a channel holding events that is closed once they have been read, ending the stream
+func (db *databaseTestImplementation) SubscribeEvents(prefix string) (<-chan struct {
+	Type string
+	Key  string
+	Time time.Time
+}, func()) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.eventsCalls = append(db.eventsCalls, struct {
+		prefix string
+	}{prefix})
+	ch := make(chan struct {
+		Type string
+		Key  string
+		Time time.Time
+	}, len(db.events))
+	for _, e := range db.events {
+		ch <- e
+	}
+	close(ch)
+	return ch, func() {}
+}
+
+// decodeData decodes the data of a response envelope into v
+func decodeData(r io.Reader, v any) error {
+	return json.NewDecoder(r).Decode(&envelope{Data: v})
+}
+
 // Helper for making an int pointer from an r-value
 func intPtr(v int64) *int64 {
 	return &v
@@ -174,6 +584,16 @@ func TestWrapper_postHandler(t *testing.T) {
 			createReturn: true,
 			checkCalls:   true,
 		},
+		{
+			name:         "Create a key value pair that expires",
+			key:          "testKey",
+			value:        "testValue",
+			ttl:          intPtr(60),
+			status:       http.StatusCreated,
+			createReturn: true,
+			getTTLReturn: true,
+			checkCalls:   true,
+		},
 		{
 			name:       "Send a bad request body",
 			key:        "testKey",
@@ -197,12 +617,19 @@ func TestWrapper_postHandler(t *testing.T) {
 
 			if tt.checkCalls {
 				var body postResponse
-				err := json.NewDecoder(wBody).Decode(&body)
+				err := decodeData(wBody, &body)
 				if err != nil {
 					t.Errorf("Failed to decode response body JSON: %v", err)
 				}
 
-				expected := postResponse{Key: tt.key}
+				sum := sha256.Sum256([]byte(tt.value))
+				expected := postResponse{Key: tt.key, ValueHash: hex.EncodeToString(sum[:])}
+				if tt.getTTLReturn {
+					if body.ExpiresAt == nil || time.Until(*body.ExpiresAt) > time.Duration(*tt.ttl)*time.Second {
+						t.Errorf("expiresAt = %v; want within %vs", body.ExpiresAt, *tt.ttl)
+					}
+					expected.ExpiresAt = body.ExpiresAt
+				}
 
 				if !reflect.DeepEqual(expected, body) {
 					t.Errorf("response body = %v; want %v", body, expected)
@@ -228,6 +655,60 @@ func TestWrapper_postHandler(t *testing.T) {
 	}
 }
 
+func TestWrapper_postHandlerClientKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		createReturn bool
+		status       int
+		wantKey      string
+	}{
+		{
+			name:         "Create with a client-supplied key",
+			body:         `{"key": "clientKey", "value": "v"}`,
+			createReturn: true,
+			status:       http.StatusCreated,
+			wantKey:      "clientKey",
+		},
+		{
+			name:         "Create with a client-supplied key that already exists",
+			body:         `{"key": "clientKey", "value": "v"}`,
+			createReturn: false,
+			status:       http.StatusConflict,
+		},
+		{
+			name:         "Create without a key uses the generated key",
+			body:         `{"value": "v"}`,
+			createReturn: true,
+			status:       http.StatusCreated,
+			wantKey:      "generated",
+		},
+		{
+			name:   "Create with a key that is not url safe",
+			body:   `{"key": "a/b", "value": "v"}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wBody, _ := testHelper(t, testCase{status: tt.status, createReturn: tt.createReturn, key: "generated"},
+				"POST", "/v1/keys", tt.body)
+			if tt.wantKey == "" {
+				return
+			}
+
+			var body keyResponse
+			if err := decodeData(wBody, &body); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			if body.Key != tt.wantKey {
+				t.Errorf("response key = %v; want %v", body.Key, tt.wantKey)
+			}
+		})
+	}
+}
+
 func TestWrapper_getHandler(t *testing.T) {
 	tests := []testCase{
 		{
@@ -256,7 +737,7 @@ func TestWrapper_getHandler(t *testing.T) {
 
 			if tt.readReturn {
 				var body getResponse
-				err := json.NewDecoder(wBody).Decode(&body)
+				err := decodeData(wBody, &body)
 				if err != nil {
 					t.Errorf("Failed to decode response body JSON: %v", err)
 				}
@@ -281,6 +762,59 @@ func TestWrapper_getHandler(t *testing.T) {
 	}
 }
 
+func TestWrapper_headHandler(t *testing.T) {
+	updated := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		db       *databaseTestImplementation
+		status   int
+		expected map[string]string // Headers that should be set, or empty if they should not be
+	}{
+		{
+			name:   "An existing key that expires",
+			db:     &databaseTestImplementation{readReturn: true, readVersion: 3, readUpdatedAt: updated, getTTLReturn: true, getTTLTime: intPtr(30)},
+			status: http.StatusOK,
+			expected: map[string]string{
+				"ETag":          `"3"`,
+				"Last-Modified": updated.Format(http.TimeFormat),
+				"TTL":           "30",
+			},
+		},
+		{
+			name:     "An existing key without a ttl",
+			db:       &databaseTestImplementation{readReturn: true, readVersion: 3, getTTLReturn: true},
+			status:   http.StatusOK,
+			expected: map[string]string{"ETag": `"3"`, "TTL": "", "Expires-At": ""},
+		},
+		{
+			name:     "A missing key",
+			db:       &databaseTestImplementation{},
+			status:   http.StatusNotFound,
+			expected: map[string]string{"ETag": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(tt.db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("HEAD", "/v1/keys/testKey", nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("expected no body, got %q", w.Body.String())
+			}
+			for name, want := range tt.expected {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%v = %q; want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
 func TestWrapper_putHandler(t *testing.T) {
 	tests := []testCase{
 		{
@@ -353,6 +887,56 @@ func TestWrapper_putHandler(t *testing.T) {
 	}
 }
 
+func TestWrapper_putResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		existed  bool   // Whether the key existed before the put
+		ttl      *int64 // The ttl the database reports after the put
+		status   int
+		expected putResponse
+	}{
+		{
+			name:     "Created with a ttl",
+			ttl:      intPtr(40),
+			status:   http.StatusCreated,
+			expected: putResponse{Key: "testKey", Created: true, TTL: intPtr(40), Version: 7},
+		},
+		{
+			name:     "Updated without a ttl",
+			existed:  true,
+			status:   http.StatusOK,
+			expected: putResponse{Key: "testKey", Version: 7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{putReturn: tt.existed, readReturn: true, readVersion: 7, getTTLReturn: true, getTTLTime: tt.ttl}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("PUT", "/v1/keys/testKey", strings.NewReader(`{"value": "v"}`)))
+			if w.Code != tt.status {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if tag := w.Header().Get("ETag"); tag != `"7"` {
+				t.Errorf("ETag = %v; want \"7\"", tag)
+			}
+
+			var body putResponse
+			if err := decodeData(w.Body, &body); err != nil {
+				t.Fatal(err)
+			}
+			if (body.TTL == nil) != (body.ExpiresAt == nil) {
+				t.Errorf("expected ttl %v and expiresAt %v to both be set or null", body.TTL, body.ExpiresAt)
+			}
+			body.ExpiresAt = nil
+			if !reflect.DeepEqual(body, tt.expected) {
+				t.Errorf("response body = %+v; want %+v", body, tt.expected)
+			}
+		})
+	}
+}
+
 func TestWrapper_deleteHandler(t *testing.T) {
 	tests := []testCase{
 		{
@@ -426,7 +1010,7 @@ func TestWrapper_getTTLHandler(t *testing.T) {
 
 			if tt.getTTLReturn {
 				var body getTTLResponse
-				err := json.NewDecoder(wBody).Decode(&body)
+				err := decodeData(wBody, &body)
 				if err != nil {
 					t.Errorf("Failed to decode response body JSON: %v", err)
 				}
@@ -434,6 +1018,16 @@ func TestWrapper_getTTLHandler(t *testing.T) {
 				expected := getTTLResponse{Key: tt.key}
 				if tt.ttl != nil {
 					expected.TTL = tt.ttl
+
+					// The absolute expiration is derived from the current time so only check that it is close
+					if body.ExpiresAt == nil {
+						t.Fatalf("response expiresAt = nil; want non-nil")
+					}
+					want := time.Now().Add(time.Duration(*tt.ttl) * time.Second)
+					if diff := body.ExpiresAt.Sub(want); diff > time.Second || diff < -time.Second {
+						t.Errorf("response expiresAt = %v; want %v", body.ExpiresAt, want)
+					}
+					expected.ExpiresAt = body.ExpiresAt
 				}
 
 				if !reflect.DeepEqual(expected, body) {
@@ -539,3 +1133,4033 @@ func TestJsonValidationPut(t *testing.T) {
 
 	})
 }
+
+func TestWrapper_expiresAt(t *testing.T) {
+	future := time.Now().Add(100 * time.Second)
+
+	tests := []struct {
+		name    string // Test case name
+		method  string // HTTP method
+		path    string // Request path
+		body    string // Request body
+		status  int    // Desired return status
+		wantTTL *int64 // The TTL that should be forwarded to the database
+	}{
+		{
+			name:    "Post with an RFC3339 expiresAt",
+			method:  "POST",
+			path:    "/v1/keys",
+			body:    fmt.Sprintf(`{"value": "v", "expiresAt": "%s"}`, future.Format(time.RFC3339)),
+			status:  http.StatusCreated,
+			wantTTL: intPtr(100),
+		},
+		{
+			name:    "Put with a unix seconds expiresAt",
+			method:  "PUT",
+			path:    "/v1/keys/key",
+			body:    fmt.Sprintf(`{"value": "v", "expiresAt": %v}`, future.Unix()),
+			status:  http.StatusCreated,
+			wantTTL: intPtr(100),
+		},
+		{
+			name:   "Put with both ttl and expiresAt",
+			method: "PUT",
+			path:   "/v1/keys/key",
+			body:   fmt.Sprintf(`{"value": "v", "ttl": 10, "expiresAt": %v}`, future.Unix()),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "Post with a malformed expiresAt",
+			method: "POST",
+			path:   "/v1/keys",
+			body:   `{"value": "v", "expiresAt": "tomorrow"}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, db := testHelper(t, testCase{status: tt.status, createReturn: true, key: "key"}, tt.method, tt.path, tt.body)
+			if tt.wantTTL == nil {
+				return
+			}
+
+			var ttl *int64
+			if tt.method == "POST" && len(db.createCalls) == 1 {
+				ttl = db.createCalls[0].ttl
+			} else if tt.method == "PUT" && len(db.putCalls) == 1 {
+				ttl = db.putCalls[0].ttl
+			}
+
+			// Allow for the clock to tick over a second during the test
+			if ttl == nil || *ttl > *tt.wantTTL || *ttl < *tt.wantTTL-1 {
+				t.Errorf("forwarded ttl = %v; want %v", ttl, *tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestWrapper_expiresAtDatabaseClock(t *testing.T) {
+	// The database clock is far from the real time, as with an injected or skewed clock
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	db := &databaseTestImplementation{createReturn: true, getTTLReturn: true, getTTLTime: intPtr(50), now: now}
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/v1/keys/key", strings.NewReader(fmt.Sprintf(`{"value": "v", "expiresAt": %v}`, now.Unix()+100))))
+	if len(db.putCalls) != 1 || db.putCalls[0].ttl == nil || *db.putCalls[0].ttl != 100 {
+		t.Fatalf("put calls = %+v; want a ttl of 100 from the database clock", db.putCalls)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/ttl/key", nil))
+	var response struct {
+		Data getTTLResponse `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if e := response.Data.ExpiresAt; e == nil || !e.Equal(now.Add(50*time.Second)) {
+		t.Errorf("expiresAt = %v; want %v", e, now.Add(50*time.Second))
+	}
+}
+
+func TestWrapper_defaultTTL(t *testing.T) {
+	tests := []struct {
+		name    string // Test case name
+		method  string // HTTP method
+		path    string // Request path
+		body    string // Request body
+		wantTTL *int64 // The TTL that should be forwarded to the database
+	}{
+		{name: "Post without a ttl", method: "POST", path: "/v1/keys", body: `{"value": "v"}`, wantTTL: intPtr(60)},
+		{name: "Put without a ttl", method: "PUT", path: "/v1/keys/key", body: `{"value": "v"}`, wantTTL: intPtr(60)},
+		{name: "Put with a ttl", method: "PUT", path: "/v1/keys/key", body: `{"value": "v", "ttl": 5}`, wantTTL: intPtr(5)},
+		{name: "Put with a null ttl", method: "PUT", path: "/v1/keys/key", body: `{"value": "v", "ttl": null}`},
+		{name: "Post with a null expiresAt", method: "POST", path: "/v1/keys", body: `{"value": "v", "expiresAt": null}`},
+		{name: "Put in a namespace with a default", method: "PUT", path: "/v1/keys/sessions:a", body: `{"value": "v"}`, wantTTL: intPtr(2)},
+		{name: "Put in a namespace that never expires", method: "PUT", path: "/v1/keys/config:a", body: `{"value": "v"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{createReturn: true, createKey: "key"}
+			h := NewHandler(db, slog.New(slog.DiscardHandler),
+				WithDefaultTTL(time.Minute),
+				WithNamespaceDefaultTTL("sessions", 1500*time.Millisecond),
+				WithNamespaceDefaultTTL("config", 0))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("response code = %v; want %v", w.Code, http.StatusCreated)
+			}
+
+			var ttl *int64
+			if tt.method == "POST" {
+				ttl = db.createCalls[0].ttl
+			} else {
+				ttl = db.putCalls[0].ttl
+			}
+			if (ttl == nil) != (tt.wantTTL == nil) || (ttl != nil && *ttl != *tt.wantTTL) {
+				t.Errorf("forwarded ttl = %v; want %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestWrapper_maxSubscribers(t *testing.T) {
+	h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler), WithMaxSubscribers(1))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	// The first subscription occupies the only slot until it disconnects
+	resp, err := http.Get(server.URL + "/v1/subscribe/channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("first subscription code = %v; want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	second, err := http.Get(server.URL + "/v1/subscribe/channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = second.Body.Close()
+	if second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second subscription code = %v; want %v", second.StatusCode, http.StatusServiceUnavailable)
+	}
+	if retryAfter := second.Header.Get("Retry-After"); retryAfter == "" {
+		t.Errorf("second subscription has no Retry-After header")
+	}
+
+	// Closing the first subscription frees up its slot
+	_ = resp.Body.Close()
+	for i := 0; i < 50; i++ {
+		h.broker.mu.RLock()
+		n := h.broker.subscribers
+		h.broker.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, err := http.Get(server.URL + "/v1/subscribe/channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = third.Body.Close()
+	if third.StatusCode != http.StatusOK {
+		t.Errorf("third subscription code = %v; want %v", third.StatusCode, http.StatusOK)
+	}
+}
+
+func TestWrapper_maxSubscribersPerIP(t *testing.T) {
+	h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler), WithMaxSubscribersPerIP(1))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/subscribe/channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("first subscription code = %v; want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	// Event streams count towards the same limit
+	for _, path := range []string{"/v1/subscribe/other", "/v1/events"} {
+		second, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = second.Body.Close()
+		if second.StatusCode != http.StatusServiceUnavailable || second.Header.Get("Retry-After") == "" {
+			t.Errorf("%v from the same client = %v with Retry-After %q; want %v with a Retry-After",
+				path, second.StatusCode, second.Header.Get("Retry-After"), http.StatusServiceUnavailable)
+		}
+	}
+
+	// Other clients have slots of their own. The request is canceled so that the subscription ends right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/subscribe/channel", nil).WithContext(ctx)
+	r.RemoteAddr = "192.0.2.1:1234"
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("subscription from another client code = %v; want %v", w.Code, http.StatusOK)
+	}
+	h.broker.mu.RLock()
+	defer h.broker.mu.RUnlock()
+	if n := h.broker.perIP["192.0.2.1"]; n != 0 {
+		t.Errorf("subscriptions of the other client after it disconnected = %v; want 0", n)
+	}
+}
+
+// panickingDatabase panics on every read to exercise the recovery middleware
+type panickingDatabase struct {
+	*databaseTestImplementation
+}
+
+func (db panickingDatabase) GetEntry(string) (struct {
+	Value     string
+	UpdatedAt time.Time
+	Version   uint64
+}, bool) {
+	panic("test panic")
+}
+
+func TestWrapper_recovery(t *testing.T) {
+	hookCalls := 0
+	h := NewHandler(panickingDatabase{&databaseTestImplementation{}}, slog.New(slog.DiscardHandler),
+		WithPanicHook(func() { hookCalls++ }))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/keys/key", nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("response code = %v; want %v", w.Code, http.StatusInternalServerError)
+	}
+	if hookCalls != 1 {
+		t.Errorf("panic hook calls = %v; want %v", hookCalls, 1)
+	}
+
+	// The handler should keep serving requests after a panic
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/v1/ttl/key", nil)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("response code = %v; want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestWrapper_responseEnvelope(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		tc       testCase
+		wantData any
+		wantCode string
+	}{
+		{
+			name:     "Put returns the state of the key as data",
+			method:   "PUT",
+			path:     "/v1/keys/key",
+			body:     `{"value": "v"}`,
+			tc:       testCase{status: http.StatusCreated},
+			wantData: map[string]any{"key": "key", "created": true, "ttl": nil, "expiresAt": nil},
+		},
+		{
+			name:     "Delete returns the key as data",
+			method:   "DELETE",
+			path:     "/v1/keys/key",
+			tc:       testCase{status: http.StatusOK, deleteReturn: true},
+			wantData: map[string]any{"key": "key"},
+		},
+		{
+			name:     "Publish returns the channel as data",
+			method:   "POST",
+			path:     "/v1/publish/channel",
+			body:     `{"message": "m"}`,
+			tc:       testCase{status: http.StatusOK},
+			wantData: map[string]any{"channel": "channel"},
+		},
+		{
+			name:     "Missing key",
+			method:   "GET",
+			path:     "/v1/keys/key",
+			tc:       testCase{status: http.StatusNotFound},
+			wantCode: CodeKeyNotFound,
+		},
+		{
+			name:     "Failed validation",
+			method:   "POST",
+			path:     "/v1/keys",
+			body:     `{"ttl": 10}`,
+			tc:       testCase{status: http.StatusBadRequest},
+			wantCode: CodeValidationFailed,
+		},
+		{
+			name:     "Malformed body",
+			method:   "PUT",
+			path:     "/v1/keys/key",
+			body:     `{"value": 10}`,
+			tc:       testCase{status: http.StatusBadRequest},
+			wantCode: CodeBadRequest,
+		},
+		{
+			name:     "Unknown route",
+			method:   "GET",
+			path:     "/v1/unknown",
+			tc:       testCase{status: http.StatusNotFound},
+			wantCode: CodeRouteNotFound,
+		},
+		{
+			name:     "Unsupported method",
+			method:   "PATCH",
+			path:     "/v1/ttl/key",
+			tc:       testCase{status: http.StatusMethodNotAllowed},
+			wantCode: CodeMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wBody, _ := testHelper(t, tt.tc, tt.method, tt.path, tt.body)
+
+			var body struct {
+				Data  any       `json:"data"`
+				Error *apiError `json:"error"`
+			}
+			if err := json.NewDecoder(wBody).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+
+			if tt.wantCode == "" {
+				if body.Error != nil {
+					t.Errorf("response error = %v; want nil", body.Error)
+				}
+				if !reflect.DeepEqual(body.Data, tt.wantData) {
+					t.Errorf("response data = %v; want %v", body.Data, tt.wantData)
+				}
+				return
+			}
+
+			if body.Data != nil {
+				t.Errorf("response data = %v; want nil", body.Data)
+			}
+			if body.Error == nil || body.Error.Code != tt.wantCode || body.Error.Message == "" {
+				t.Errorf("response error = %v; want code %v with a message", body.Error, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWrapper_validationRules(t *testing.T) {
+	h := NewHandler(&databaseTestImplementation{createReturn: true}, slog.New(slog.DiscardHandler),
+		WithMaxKeyLength(8),
+		WithMaxValueLength(4),
+		WithMaxMessageLength(4),
+		WithTTLBounds(1, 100),
+		WithKeyPattern(regexp.MustCompile(`^[a-z]+$`)))
+
+	future := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "Valid put", method: "PUT", path: "/v1/keys/key", body: `{"value": "v", "ttl": 10}`, status: http.StatusCreated},
+		{name: "Key too long", method: "PUT", path: "/v1/keys/abcdefghi", body: `{"value": "v"}`, status: http.StatusBadRequest},
+		{name: "Key outside of charset", method: "PUT", path: "/v1/keys/KEY", body: `{"value": "v"}`, status: http.StatusBadRequest},
+		{name: "Client-supplied key outside of charset", method: "POST", path: "/v1/keys", body: `{"key": "a.b", "value": "v"}`, status: http.StatusBadRequest},
+		{name: "Value too long", method: "POST", path: "/v1/keys", body: `{"value": "value"}`, status: http.StatusBadRequest},
+		{name: "Message too long", method: "POST", path: "/v1/publish/channel", body: `{"message": "message"}`, status: http.StatusRequestEntityTooLarge},
+		{name: "Publish body too long", method: "POST", path: "/v1/publish/channel", body: `{"message": "` + strings.Repeat("m", 2048) + `"}`, status: http.StatusRequestEntityTooLarge},
+		{name: "Ttl below minimum", method: "POST", path: "/v1/keys", body: `{"value": "v", "ttl": 0}`, status: http.StatusBadRequest},
+		{name: "Ttl above maximum", method: "PUT", path: "/v1/keys/key", body: `{"value": "v", "ttl": 101}`, status: http.StatusBadRequest},
+		{name: "ExpiresAt above maximum", method: "POST", path: "/v1/keys", body: fmt.Sprintf(`{"value": "v", "expiresAt": %v}`, future), status: http.StatusBadRequest},
+		{name: "ExpiresAt in the past", method: "PUT", path: "/v1/keys/key", body: `{"value": "v", "expiresAt": 1}`, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestWrapper_defaultKeyRules(t *testing.T) {
+	h := NewHandler(&databaseTestImplementation{createReturn: true}, slog.New(slog.DiscardHandler))
+
+	// Without a key pattern, keys of any characters are accepted, except for the ones that cannot appear in a path
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "Put with a space, a comma and a percent sign", method: "PUT", path: "/v1/keys/a%20b,c%25", body: `{"value": "v"}`, status: http.StatusCreated},
+		{name: "Put with non-ASCII characters", method: "PUT", path: "/v1/keys/cl%C3%A9", body: `{"value": "v"}`, status: http.StatusCreated},
+		{name: "Post with a space", method: "POST", path: "/v1/keys", body: `{"key": "a b", "value": "v"}`, status: http.StatusCreated},
+		{name: "Post with a slash", method: "POST", path: "/v1/keys", body: `{"key": "a/b", "value": "v"}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v: %v", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWrapper_ttlClamping(t *testing.T) {
+	db := &databaseTestImplementation{createReturn: true, createKey: "key"}
+	h := NewHandler(db, slog.New(slog.DiscardHandler), WithTTLBounds(10, 100), WithTTLClamping())
+
+	future := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		wantTTL *int64
+	}{
+		{name: "Ttl below minimum", method: "POST", path: "/v1/keys", body: `{"value": "v", "ttl": 0}`, wantTTL: intPtr(10)},
+		{name: "Ttl above maximum", method: "PUT", path: "/v1/keys/key", body: `{"value": "v", "ttl": 315360000}`, wantTTL: intPtr(100)},
+		{name: "Ttl within bounds", method: "PUT", path: "/v1/keys/key", body: `{"value": "v", "ttl": 50}`, wantTTL: intPtr(50)},
+		{name: "ExpiresAt above maximum", method: "POST", path: "/v1/keys", body: fmt.Sprintf(`{"value": "v", "expiresAt": %v}`, future), wantTTL: intPtr(100)},
+		{name: "No ttl", method: "PUT", path: "/v1/keys/key", body: `{"value": "v"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.createCalls, db.putCalls = nil, nil
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("response code = %v; want %v", w.Code, http.StatusCreated)
+			}
+
+			var ttl *int64
+			if tt.method == "POST" {
+				ttl = db.createCalls[0].ttl
+			} else {
+				ttl = db.putCalls[0].ttl
+			}
+			if (ttl == nil) != (tt.wantTTL == nil) || (ttl != nil && *ttl != *tt.wantTTL) {
+				t.Errorf("forwarded ttl = %v; want %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	h.router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`db_clamped_ttls_total{bound="min"} 1`, `db_clamped_ttls_total{bound="max"} 2`} {
+		if !strings.Contains(rr.Body.String(), "\n"+line+"\n") {
+			t.Errorf("expected metrics to contain %q", line)
+		}
+	}
+}
+
+func TestWrapper_conditionalDelete(t *testing.T) {
+	tests := []struct {
+		name    string
+		exists  bool
+		ifMatch string
+		body    string
+		status  int
+		code    string
+	}{
+		{name: "Matching ETag", exists: true, ifMatch: `"7"`, status: http.StatusOK},
+		{name: "One of several ETags matches", exists: true, ifMatch: `"6", "7"`, status: http.StatusOK},
+		{name: "Any value", exists: true, ifMatch: "*", status: http.StatusOK},
+		{name: "Stale ETag", exists: true, ifMatch: `"6"`, status: http.StatusPreconditionFailed, code: CodePreconditionFailed},
+		{name: "Weak ETags never match", exists: true, ifMatch: `W/"7"`, status: http.StatusPreconditionFailed, code: CodePreconditionFailed},
+		{name: "Matching value", exists: true, body: `{"expectedValue":"value"}`, status: http.StatusOK},
+		{name: "Changed value", exists: true, body: `{"expectedValue":"other"}`, status: http.StatusPreconditionFailed, code: CodePreconditionFailed},
+		{name: "ETag and value must both match", exists: true, ifMatch: `"7"`, body: `{"expectedValue":"other"}`, status: http.StatusPreconditionFailed, code: CodePreconditionFailed},
+		{name: "Missing key", ifMatch: "*", status: http.StatusNotFound, code: CodeKeyNotFound},
+		{name: "Body without an expected value", exists: true, body: `{}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Malformed body", exists: true, body: `{"expectedValue":`, status: http.StatusBadRequest, code: CodeBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{deleteReturn: tt.exists, readString: "value", readVersion: 7}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("DELETE", "/v1/keys/key", strings.NewReader(tt.body))
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response envelope
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+		})
+	}
+}
+
+func TestWrapper_conditionalGet(t *testing.T) {
+	updatedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name            string
+		updatedAt       time.Time
+		ifModifiedSince string
+		ifNoneMatch     string
+		version         uint64
+		status          int
+		lastModified    string
+		etag            string
+	}{
+		{
+			name:    "Sets ETag",
+			version: 7,
+			status:  http.StatusOK,
+			etag:    `"7"`,
+		},
+		{
+			name:         "Sets Last-Modified",
+			updatedAt:    updatedAt,
+			status:       http.StatusOK,
+			lastModified: "Thu, 02 Jan 2025 03:04:05 GMT",
+		},
+		{
+			name:            "Not modified since the same time",
+			updatedAt:       updatedAt,
+			ifModifiedSince: "Thu, 02 Jan 2025 03:04:05 GMT",
+			status:          http.StatusNotModified,
+			lastModified:    "Thu, 02 Jan 2025 03:04:05 GMT",
+		},
+		{
+			name:            "Not modified since a later time",
+			updatedAt:       updatedAt,
+			ifModifiedSince: "Fri, 03 Jan 2025 00:00:00 GMT",
+			status:          http.StatusNotModified,
+			lastModified:    "Thu, 02 Jan 2025 03:04:05 GMT",
+		},
+		{
+			name:            "Modified since an earlier time",
+			updatedAt:       updatedAt,
+			ifModifiedSince: "Wed, 01 Jan 2025 00:00:00 GMT",
+			status:          http.StatusOK,
+			lastModified:    "Thu, 02 Jan 2025 03:04:05 GMT",
+		},
+		{
+			name:            "Malformed If-Modified-Since is ignored",
+			updatedAt:       updatedAt,
+			ifModifiedSince: "yesterday",
+			status:          http.StatusOK,
+			lastModified:    "Thu, 02 Jan 2025 03:04:05 GMT",
+		},
+		{
+			name:            "Unknown modification time",
+			ifModifiedSince: "Fri, 03 Jan 2025 00:00:00 GMT",
+			status:          http.StatusOK,
+		},
+		{
+			name:        "Not modified with a matching If-None-Match",
+			version:     7,
+			ifNoneMatch: `"6", "7"`,
+			status:      http.StatusNotModified,
+			etag:        `"7"`,
+		},
+		{
+			name:            "Modified in the same second is caught by If-None-Match",
+			updatedAt:       updatedAt,
+			version:         8,
+			ifModifiedSince: "Thu, 02 Jan 2025 03:04:05 GMT",
+			ifNoneMatch:     `"7"`,
+			status:          http.StatusOK,
+			lastModified:    "Thu, 02 Jan 2025 03:04:05 GMT",
+			etag:            `"8"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{readReturn: true, readString: "value", readUpdatedAt: tt.updatedAt, readVersion: tt.version}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/v1/keys/key", nil)
+			if tt.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if lm := w.Header().Get("Last-Modified"); lm != tt.lastModified {
+				t.Errorf("Last-Modified = %v; want %v", lm, tt.lastModified)
+			}
+			if etag := w.Header().Get("ETag"); etag != tt.etag {
+				t.Errorf("ETag = %v; want %v", etag, tt.etag)
+			}
+			if tt.status == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("response body = %v; want empty", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWrapper_batchTTLHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		tc       testCase
+		wantKeys []string
+	}{
+		{
+			name:     "Keys with a ttl",
+			body:     `{"keys": ["a", "b", "c"]}`,
+			tc:       testCase{status: http.StatusOK, getTTLReturn: true, ttl: intPtr(100)},
+			wantKeys: []string{"a", "b", "c"},
+		},
+		{
+			name:     "Keys without a ttl",
+			body:     `{"keys": ["a"]}`,
+			tc:       testCase{status: http.StatusOK, getTTLReturn: true},
+			wantKeys: []string{"a"},
+		},
+		{
+			name:     "Missing keys",
+			body:     `{"keys": ["a", "b"]}`,
+			tc:       testCase{status: http.StatusOK, getTTLReturn: false},
+			wantKeys: []string{"a", "b"},
+		},
+		{
+			name: "No keys",
+			body: `{"keys": []}`,
+			tc:   testCase{status: http.StatusBadRequest},
+		},
+		{
+			name: "Empty key",
+			body: `{"keys": ["a", ""]}`,
+			tc:   testCase{status: http.StatusBadRequest},
+		},
+		{
+			name: "Malformed body",
+			body: `{"keys": "a"}`,
+			tc:   testCase{status: http.StatusBadRequest},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wBody, db := testHelper(t, tt.tc, "POST", "/v1/ttl/batch", tt.body)
+			if tt.wantKeys == nil {
+				return
+			}
+
+			var body batchTTLResponse
+			if err := decodeData(wBody, &body); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			if len(body.Results) != len(tt.wantKeys) || len(db.getTTLCalls) != len(tt.wantKeys) {
+				t.Fatalf("got %v results from %v GetTTL() calls; want %v", len(body.Results), len(db.getTTLCalls), len(tt.wantKeys))
+			}
+
+			for i, result := range body.Results {
+				if result.Key != tt.wantKeys[i] {
+					t.Errorf("result %v key = %v; want %v", i, result.Key, tt.wantKeys[i])
+				}
+				if result.Exists != tt.tc.getTTLReturn {
+					t.Errorf("result %v exists = %v; want %v", i, result.Exists, tt.tc.getTTLReturn)
+				}
+
+				wantTTL := tt.tc.getTTLReturn && tt.tc.ttl != nil
+				if (result.TTL != nil) != wantTTL || (result.ExpiresAt != nil) != wantTTL {
+					t.Errorf("result %v ttl = %v, expiresAt = %v; want both set = %v", i, result.TTL, result.ExpiresAt, wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapper_expirePrefixHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "Expire a prefix", body: `{"prefix": "v1:", "ttl": 10}`, status: http.StatusOK},
+		{name: "Missing prefix", body: `{"ttl": 10}`, status: http.StatusBadRequest},
+		{name: "Missing ttl", body: `{"prefix": "v1:"}`, status: http.StatusBadRequest},
+		{name: "Negative ttl", body: `{"prefix": "v1:", "ttl": -1}`, status: http.StatusBadRequest},
+		{name: "Malformed body", body: `{"prefix": 1}`, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{expirePrefixReturn: 3}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/admin/expire-prefix", strings.NewReader(tt.body)))
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				if len(db.expirePrefixCalls) != 0 {
+					t.Errorf("ExpirePrefix() calls = %v; want none", db.expirePrefixCalls)
+				}
+				return
+			}
+
+			var body expirePrefixResponse
+			if err := decodeData(w.Body, &body); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			expected := expirePrefixResponse{Prefix: "v1:", Expired: 3}
+			if body != expected {
+				t.Errorf("response body = %v; want %v", body, expected)
+			}
+			if len(db.expirePrefixCalls) != 1 || db.expirePrefixCalls[0].prefix != "v1:" || db.expirePrefixCalls[0].ttl != 10 {
+				t.Errorf("ExpirePrefix() calls = %v; want one call with v1: and 10", db.expirePrefixCalls)
+			}
+		})
+	}
+}
+
+func TestWrapper_deletePrefixHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		dryRun bool
+	}{
+		{name: "Delete a prefix", query: "?prefix=session:", status: http.StatusOK},
+		{name: "Count a prefix in a dry run", query: "?prefix=session:&dryRun=true", status: http.StatusOK, dryRun: true},
+		{name: "Missing prefix", query: "", status: http.StatusBadRequest},
+		{name: "Invalid dry run", query: "?prefix=session:&dryRun=maybe", status: http.StatusBadRequest},
+		{name: "Prefix within an internal namespace", query: "?prefix=" + idempotencyPrefix, status: http.StatusBadRequest},
+		{name: "Prefix of an internal namespace", query: "?prefix=_", status: http.StatusBadRequest},
+		{name: "Dry run of an internal namespace", query: "?prefix=" + schedulePrefix + "a&dryRun=true", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{deletePrefixReturn: 3}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/keys"+tt.query, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				if len(db.deletePrefixCalls) != 0 {
+					t.Errorf("DeletePrefix() calls = %v; want none", db.deletePrefixCalls)
+				}
+				return
+			}
+
+			var body deletePrefixResponse
+			if err := decodeData(w.Body, &body); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			expected := deletePrefixResponse{Prefix: "session:", Deleted: 3, DryRun: tt.dryRun}
+			if body != expected {
+				t.Errorf("response body = %v; want %v", body, expected)
+			}
+			if len(db.deletePrefixCalls) != 1 || db.deletePrefixCalls[0].prefix != "session:" || db.deletePrefixCalls[0].dryRun != tt.dryRun {
+				t.Errorf("DeletePrefix() calls = %v; want one call with session: and %v", db.deletePrefixCalls, tt.dryRun)
+			}
+		})
+	}
+}
+
+func TestWrapper_touchHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		found   bool
+		err     error
+		status  int
+		code    string
+		wantTTL int64 // The ttl forwarded to the database, if any
+	}{
+		{name: "Touch with a ttl", path: "/v1/keys/heartbeat/touch", body: `{"ttl": 30}`, found: true, status: http.StatusOK, wantTTL: 30},
+		{name: "Touch with the default ttl", path: "/v1/keys/heartbeat/touch", found: true, status: http.StatusOK, wantTTL: 60},
+		{name: "Touch with the default ttl of a namespace", path: "/v1/keys/sessions:a/touch", body: `{}`, found: true, status: http.StatusOK, wantTTL: 5},
+		{name: "Touch without a ttl or default", path: "/v1/keys/config:a/touch", status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Touch a missing key", path: "/v1/keys/missing/touch", body: `{"ttl": 30}`, status: http.StatusNotFound, code: CodeKeyNotFound, wantTTL: 30},
+		{name: "Touch with a negative ttl", path: "/v1/keys/heartbeat/touch", body: `{"ttl": -1}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Touch with a malformed body", path: "/v1/keys/heartbeat/touch", body: `{"ttl": "soon"}`, status: http.StatusBadRequest, code: CodeBadRequest},
+		{name: "Touch during a failed write", path: "/v1/keys/heartbeat/touch", body: `{"ttl": 30}`, err: testStallError{retry: time.Second}, status: http.StatusServiceUnavailable, wantTTL: 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{touchReturn: tt.found, touchErr: tt.err, getTTLReturn: true, getTTLTime: intPtr(tt.wantTTL)}
+			h := NewHandler(db, slog.New(slog.DiscardHandler),
+				WithDefaultTTL(time.Minute),
+				WithNamespaceDefaultTTL("sessions", 5*time.Second),
+				WithNamespaceDefaultTTL("config", 0))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.status)
+			}
+
+			if tt.wantTTL == 0 {
+				if len(db.touchCalls) != 0 {
+					t.Errorf("expected no touch, got %+v", db.touchCalls)
+				}
+			} else if len(db.touchCalls) != 1 || db.touchCalls[0].ttl != tt.wantTTL {
+				t.Errorf("touch calls = %+v; want one with ttl %v", db.touchCalls, tt.wantTTL)
+			}
+
+			if tt.code != "" {
+				var body struct {
+					Error apiError `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error.Code != tt.code {
+					t.Errorf("error code = %v; want %v", body.Error.Code, tt.code)
+				}
+				return
+			}
+			if w.Code == http.StatusOK {
+				var response getTTLResponse
+				decodeData(w.Body, &response)
+				if response.TTL == nil || *response.TTL != tt.wantTTL || response.ExpiresAt == nil {
+					t.Errorf("response = %+v; want a ttl of %v", response, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapper_history(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	history := map[string][]keyVersion{
+		"a": {
+			{Version: 7, Value: "new", ExpiresAt: now.Add(time.Minute).Unix(), Time: now},
+			{Version: 3, Value: "old", Time: now.Add(-time.Minute)},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		history     map[string][]keyVersion
+		restoreErr  error
+		status      int
+		code        string
+		wantRestore bool // Whether a restore reaches the database
+	}{
+		{name: "History of a key", method: "GET", path: "/v1/keys/a/history", history: history, status: http.StatusOK},
+		{name: "History of a missing key", method: "GET", path: "/v1/keys/b/history", history: history, status: http.StatusNotFound, code: CodeKeyNotFound},
+		{name: "History while disabled", method: "GET", path: "/v1/keys/a/history", status: http.StatusNotImplemented, code: CodeHistoryDisabled},
+		{name: "Restore a version", method: "POST", path: "/v1/keys/a/restore", body: `{"version": 3}`, history: history, status: http.StatusOK, wantRestore: true},
+		{name: "Restore an unknown version", method: "POST", path: "/v1/keys/a/restore", body: `{"version": 1}`, history: history, status: http.StatusNotFound, code: CodeVersionNotFound, wantRestore: true},
+		{name: "Restore a missing key", method: "POST", path: "/v1/keys/b/restore", body: `{"version": 3}`, history: history, status: http.StatusNotFound, code: CodeKeyNotFound, wantRestore: true},
+		{name: "Restore without a version", method: "POST", path: "/v1/keys/a/restore", body: `{}`, history: history, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Restore with a malformed body", method: "POST", path: "/v1/keys/a/restore", body: `{"version": "3"}`, history: history, status: http.StatusBadRequest, code: CodeBadRequest},
+		{name: "Restore while disabled", method: "POST", path: "/v1/keys/a/restore", body: `{"version": 3}`, status: http.StatusNotImplemented, code: CodeHistoryDisabled},
+		{name: "Restore during a failed write", method: "POST", path: "/v1/keys/a/restore", body: `{"version": 3}`, history: history, restoreErr: testStallError{retry: time.Second}, status: http.StatusServiceUnavailable, wantRestore: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{history: tt.history, restoreErr: tt.restoreErr}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if tt.wantRestore != (len(db.restoreCalls) == 1) {
+				t.Errorf("restore calls = %v; want a restore: %v", db.restoreCalls, tt.wantRestore)
+			}
+
+			if tt.code != "" {
+				var body struct {
+					Error apiError `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error.Code != tt.code {
+					t.Errorf("error code = %v; want %v", body.Error.Code, tt.code)
+				}
+				return
+			}
+			if tt.method != "GET" {
+				return
+			}
+
+			var response historyResponse
+			if err := decodeData(w.Body, &response); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			expiresAt := now.Add(time.Minute)
+			want := historyResponse{Key: "a", Versions: []versionResponse{
+				{Version: 7, Value: "new", ExpiresAt: &expiresAt, Time: now},
+				{Version: 3, Value: "old", Time: now.Add(-time.Minute)},
+			}}
+			if response.Key != want.Key || len(response.Versions) != 2 ||
+				response.Versions[0].ExpiresAt == nil || !response.Versions[0].ExpiresAt.Equal(expiresAt) ||
+				response.Versions[1].ExpiresAt != nil || response.Versions[1].Value != "old" || !response.Versions[1].Time.Equal(want.Versions[1].Time) {
+				t.Errorf("response = %+v; want %+v", response, want)
+			}
+		})
+	}
+}
+
+func TestWrapper_keyStats(t *testing.T) {
+	lastAccess := time.Now().UTC().Truncate(time.Second)
+	stats := map[string]keyStats{
+		"a": {Hits: 5, Updates: 2, LastAccess: lastAccess, Size: 12},
+		"b": {Size: 3}, // Loaded and not used since
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		stats    map[string]keyStats
+		status   int
+		code     string
+		response statsResponse
+	}{
+		{name: "Stats of a key", path: "/v1/keys/a/stats", stats: stats, status: http.StatusOK,
+			response: statsResponse{Key: "a", Hits: 5, Updates: 2, LastAccess: &lastAccess, Size: 12}},
+		{name: "Stats of an unused key", path: "/v1/keys/b/stats", stats: stats, status: http.StatusOK,
+			response: statsResponse{Key: "b", Size: 3}},
+		{name: "Stats of a missing key", path: "/v1/keys/c/stats", stats: stats, status: http.StatusNotFound, code: CodeKeyNotFound},
+		{name: "Stats while disabled", path: "/v1/keys/a/stats", status: http.StatusNotImplemented, code: CodeStatsDisabled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&databaseTestImplementation{keyStats: tt.stats}, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.status)
+			}
+
+			if tt.code != "" {
+				var body struct {
+					Error apiError `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error.Code != tt.code {
+					t.Errorf("error code = %v; want %v", body.Error.Code, tt.code)
+				}
+				return
+			}
+
+			var response statsResponse
+			if err := decodeData(w.Body, &response); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			if (response.LastAccess == nil) != (tt.response.LastAccess == nil) ||
+				(response.LastAccess != nil && !response.LastAccess.Equal(*tt.response.LastAccess)) {
+				t.Errorf("lastAccess = %v; want %v", response.LastAccess, tt.response.LastAccess)
+			}
+			response.LastAccess, tt.response.LastAccess = nil, nil
+			if response != tt.response {
+				t.Errorf("response = %+v; want %+v", response, tt.response)
+			}
+		})
+	}
+}
+
+func TestWrapper_compact(t *testing.T) {
+	db := &databaseTestImplementation{compactions: []compaction{
+		{Keys: 10, Reclaimed: 4096, Duration: 1500 * time.Millisecond},
+		{Keys: 10, Reclaimed: 1024, Duration: time.Second},
+	}}
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+	for _, want := range []compactResponse{
+		{Keys: 10, ReclaimedBytes: 4096, Seconds: 1.5},
+		{Keys: 10, ReclaimedBytes: 1024, Seconds: 1},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/admin/compact", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+		}
+		var response compactResponse
+		if err := decodeData(w.Body, &response); err != nil {
+			t.Fatalf("Failed to decode response body JSON: %v", err)
+		}
+		if response != want {
+			t.Errorf("response = %+v; want %+v", response, want)
+		}
+	}
+
+	// The compactions are counted by the metrics
+	rr := httptest.NewRecorder()
+	h.router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, line := range []string{
+		"db_compactions_total 2",
+		"db_compaction_reclaimed_bytes_total 5120",
+		`db_http_requests_total{method="POST",status="200",uri="/v1/admin/compact"} 2`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected metrics to contain %q", line)
+		}
+	}
+}
+
+func TestWrapper_startupReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		summary  startupSummary
+		expected startupReportResponse
+	}{
+		{
+			name:     "Without startup files",
+			expected: startupReportResponse{Files: []string{}, MalformedRecords: []string{}},
+		},
+		{
+			name: "With malformed records",
+			summary: startupSummary{Files: []string{"snapshot.json", "aof"}, Loaded: 7, Skipped: 3, Malformed: 2, Duplicates: 1,
+				Expired: 4, Duration: 250 * time.Millisecond, MalformedRecords: []string{"aof:3: too few fields", "aof:9: invalid ttl"}},
+			expected: startupReportResponse{Files: []string{"snapshot.json", "aof"}, Loaded: 7, Skipped: 3, Malformed: 2, Duplicates: 1,
+				Expired: 4, Seconds: 0.25, MalformedRecords: []string{"aof:3: too few fields", "aof:9: invalid ttl"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&databaseTestImplementation{startup: tt.summary}, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/startup-report", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+			}
+			var response startupReportResponse
+			if err := decodeData(w.Body, &response); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			if !reflect.DeepEqual(response, tt.expected) {
+				t.Errorf("response = %+v; want %+v", response, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrapper_infoHandler(t *testing.T) {
+	db := &databaseTestImplementation{}
+	db.info.Keys = 2
+	db.info.Seq = 42
+	db.info.NodeID = "node-1"
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/info", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+	}
+
+	var body infoResponse
+	if err := decodeData(w.Body, &body); err != nil {
+		t.Fatalf("Failed to decode response body JSON: %v", err)
+	}
+	expected := infoResponse{Keys: 2, Seq: 42, NodeID: "node-1"}
+	if body != expected {
+		t.Errorf("response body = %v; want %v", body, expected)
+	}
+}
+
+func TestWrapper_ttlHistogramHandler(t *testing.T) {
+	db := &databaseTestImplementation{ttlHistogram: []ttlBucket{
+		{Within: time.Minute, Keys: 1, Bytes: 10},
+		{Within: time.Hour, Keys: 3, Bytes: 25},
+		{Within: 24 * time.Hour, Keys: 4, Bytes: 40},
+	}}
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/ttl-histogram", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+	}
+
+	var body ttlHistogramResponse
+	if err := decodeData(w.Body, &body); err != nil {
+		t.Fatalf("Failed to decode response body JSON: %v", err)
+	}
+	expected := ttlHistogramResponse{
+		Buckets: []ttlBucketResponse{
+			{Within: "minute", Seconds: 60, Keys: 1, Bytes: 10},
+			{Within: "hour", Seconds: 3600, Keys: 3, Bytes: 25},
+			{Within: "day", Seconds: 86400, Keys: 4, Bytes: 40},
+		},
+		Keys:  4,
+		Bytes: 40,
+	}
+	if !reflect.DeepEqual(body, expected) {
+		t.Errorf("response body = %+v; want %+v", body, expected)
+	}
+}
+
+func TestWrapper_readyHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		notReady    bool
+		persistence map[string]persistenceStats
+		status      int
+		expected    string
+	}{
+		{name: "Ready", status: http.StatusOK, expected: `{"ready":true}`},
+		{name: "Warming up", notReady: true, status: http.StatusServiceUnavailable, expected: CodeNotReady},
+		{
+			name:        "Persistence failing while writes are accepted",
+			persistence: map[string]persistenceStats{"snapshot": {Enabled: true, Failing: true}},
+			status:      http.StatusOK,
+			expected:    `{"ready":true,"failingPersistence":["snapshot"]}`,
+		},
+		{
+			name:        "Persistence failing while writes are rejected",
+			persistence: map[string]persistenceStats{"aof": {Enabled: true, Failing: true, RejectingWrites: true}},
+			status:      http.StatusServiceUnavailable,
+			expected:    CodePersistenceFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&databaseTestImplementation{notReady: tt.notReady, persistence: tt.persistence}, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if !strings.Contains(w.Body.String(), tt.expected) {
+				t.Errorf("response body = %v; want it to contain %v", w.Body.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrapper_configHandler(t *testing.T) {
+	type config struct {
+		Host     string `json:"host"`
+		IDScheme string `json:"idScheme"`
+	}
+
+	tests := []struct {
+		name     string
+		opts     []Options
+		expected string
+	}{
+		{
+			name:     "Without a configuration",
+			expected: `{}`,
+		},
+		{
+			name:     "With a configuration",
+			opts:     []Options{WithConfig(config{Host: "127.0.0.1:8080", IDScheme: "uuid"})},
+			expected: `{"host":"127.0.0.1:8080","idScheme":"uuid"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler), tt.opts...)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/config", nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+			}
+
+			var body json.RawMessage
+			if err := decodeData(w.Body, &body); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			if string(body) != tt.expected {
+				t.Errorf("response body = %s; want %s", body, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrapper_scanHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		keys           []string
+		cursor         string
+		expectedStatus int
+		expectedCode   string
+		expectedCall   struct {
+			prefix string
+			cursor string
+			limit  int
+		}
+		expected scanResponse
+	}{
+		{
+			name:           "Defaults",
+			keys:           []string{"a", "b"},
+			expectedStatus: http.StatusOK,
+			expectedCall: struct {
+				prefix string
+				cursor string
+				limit  int
+			}{"", "", DefaultScanLimit},
+			expected: scanResponse{Keys: []string{"a", "b"}},
+		},
+		{
+			name:           "Prefix, cursor and limit",
+			query:          "?prefix=user:&cursor=user:a&limit=1",
+			keys:           []string{"user:b"},
+			cursor:         "user:b",
+			expectedStatus: http.StatusOK,
+			expectedCall: struct {
+				prefix string
+				cursor string
+				limit  int
+			}{"user:", "user:a", 1},
+			expected: scanResponse{Keys: []string{"user:b"}, Cursor: "user:b"},
+		},
+		{
+			name:           "Internal keys are hidden",
+			keys:           []string{"_idempotency/abc", "a"},
+			expectedStatus: http.StatusOK,
+			expectedCall: struct {
+				prefix string
+				cursor string
+				limit  int
+			}{"", "", DefaultScanLimit},
+			expected: scanResponse{Keys: []string{"a"}},
+		},
+		{
+			name:           "No keys is an empty list",
+			expectedStatus: http.StatusOK,
+			expectedCall: struct {
+				prefix string
+				cursor string
+				limit  int
+			}{"", "", DefaultScanLimit},
+			expected: scanResponse{Keys: []string{}},
+		},
+		{
+			name:           "Limit that is not a number",
+			query:          "?limit=ten",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeBadRequest,
+		},
+		{
+			name:           "Limit that is too large",
+			query:          "?limit=1001",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeValidationFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{scanKeys: tt.keys, scanCursor: tt.cursor}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/keys"+tt.query, nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.expectedStatus)
+			}
+			if tt.expectedCode != "" {
+				var body struct {
+					Error *apiError `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+					t.Fatalf("Failed to decode response body JSON: %v", err)
+				}
+				if body.Error == nil || body.Error.Code != tt.expectedCode {
+					t.Errorf("response error = %v; want code %v", body.Error, tt.expectedCode)
+				}
+				if len(db.scanCalls) != 0 {
+					t.Errorf("Scan() calls = %v; want none", db.scanCalls)
+				}
+				return
+			}
+
+			var body scanResponse
+			if err := decodeData(w.Body, &body); err != nil {
+				t.Fatalf("Failed to decode response body JSON: %v", err)
+			}
+			if !reflect.DeepEqual(body, tt.expected) {
+				t.Errorf("response body = %v; want %v", body, tt.expected)
+			}
+			if len(db.scanCalls) != 1 || db.scanCalls[0] != tt.expectedCall {
+				t.Errorf("Scan() calls = %v; want %v", db.scanCalls, tt.expectedCall)
+			}
+		})
+	}
+}
+
+// kvTestImplementation is a database that keeps its entries, for tests of handlers that read back what they write
+type kvTestImplementation struct {
+	databaseTestImplementation
+	entries map[string]string
+	created int // The number of keys that have been generated
+}
+
+func (db *kvTestImplementation) Create(data struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Ttl   *int64 `json:"ttl"`
+}) (bool, string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := data.Key
+	if key == "" {
+		db.created++
+		key = fmt.Sprintf("generated-%d", db.created)
+	}
+	if _, ok := db.entries[key]; ok {
+		return false, key, nil
+	}
+	db.entries[key] = data.Value
+	return true, key, nil
+}
+
+func (db *kvTestImplementation) GetEntry(key string) (struct {
+	Value     string
+	UpdatedAt time.Time
+	Version   uint64
+}, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	v, ok := db.entries[key]
+	return struct {
+		Value     string
+		UpdatedAt time.Time
+		Version   uint64
+	}{Value: v}, ok
+}
+
+func (db *kvTestImplementation) Put(data struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Ttl   *int64 `json:"ttl"`
+}) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries[data.Key] = data.Value
+	return true, nil
+}
+
+func (db *kvTestImplementation) Update(key string, f func(string) (string, error)) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	v, ok := db.entries[key]
+	if !ok {
+		return false, nil
+	}
+	v, err := f(v)
+	if err != nil {
+		return true, err
+	}
+	db.entries[key] = v
+	return true, nil
+}
+
+func (db *kvTestImplementation) Upsert(key string, f func(string, bool) (string, error)) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	v, ok := db.entries[key]
+	v, err := f(v, ok)
+	if err != nil {
+		return ok, err
+	}
+	db.entries[key] = v
+	return ok, nil
+}
+
+func (db *kvTestImplementation) UpsertTTL(key string, _ int64, f func(string, bool) (string, error)) (bool, error) {
+	return db.Upsert(key, f)
+}
+
+// DeleteIf checks cond against the value of the key. Versions are not tracked so they are always zero.
+func (db *kvTestImplementation) DeleteIf(key string, cond func(string, uint64) bool) (bool, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	v, ok := db.entries[key]
+	if !ok || !cond(v, 0) {
+		return false, ok
+	}
+	delete(db.entries, key)
+	return true, true
+}
+
+func (db *kvTestImplementation) Delete(key string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, ok := db.entries[key]
+	delete(db.entries, key)
+	return ok
+}
+
+func TestWrapper_idempotency(t *testing.T) {
+	type request struct {
+		idempotencyKey string
+		body           string
+		expectedStatus int
+		expectedCode   string
+		expectedKey    string // The key in a successful response
+		replayed       bool   // Whether the response should be marked as a replay
+	}
+
+	tests := []struct {
+		name     string
+		requests []request
+		entries  map[string]string // Entries present before the requests
+		keys     int               // The number of keys outside of the internal namespace afterwards
+	}{
+		{
+			name: "A retry returns the original key",
+			requests: []request{
+				{idempotencyKey: "a", body: `{"value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "generated-1"},
+				{idempotencyKey: "a", body: `{"value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "generated-1", replayed: true},
+			},
+			keys: 1,
+		},
+		{
+			name: "Different idempotency keys create different keys",
+			requests: []request{
+				{idempotencyKey: "a", body: `{"value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "generated-1"},
+				{idempotencyKey: "b", body: `{"value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "generated-2"},
+			},
+			keys: 2,
+		},
+		{
+			name: "Posts without an idempotency key are not deduplicated",
+			requests: []request{
+				{body: `{"value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "generated-1"},
+				{body: `{"value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "generated-2"},
+			},
+			keys: 2,
+		},
+		{
+			name: "Reusing an idempotency key with a different request",
+			requests: []request{
+				{idempotencyKey: "a", body: `{"value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "generated-1"},
+				{idempotencyKey: "a", body: `{"value":"other"}`, expectedStatus: http.StatusUnprocessableEntity, expectedCode: CodeIdempotencyKeyReused},
+			},
+			keys: 1,
+		},
+		{
+			name:    "A request that is still in progress",
+			entries: map[string]string{idempotencyRecordKey("a"): `{"fingerprint":"` + postRequest{Value: "v"}.fingerprint() + `","key":""}`},
+			requests: []request{
+				{idempotencyKey: "a", body: `{"value":"v"}`, expectedStatus: http.StatusConflict, expectedCode: CodeIdempotencyKeyInProgress},
+			},
+		},
+		{
+			name:    "A failed request can be retried",
+			entries: map[string]string{"taken": "v"},
+			requests: []request{
+				{idempotencyKey: "a", body: `{"key":"taken","value":"v"}`, expectedStatus: http.StatusConflict, expectedCode: CodeKeyExists},
+				{idempotencyKey: "a", body: `{"key":"taken","value":"v"}`, expectedStatus: http.StatusConflict, expectedCode: CodeKeyExists},
+				{idempotencyKey: "a", body: `{"key":"free","value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "free"},
+			},
+			keys: 2,
+		},
+		{
+			name: "An expiresAt outside of the ttl bounds does not claim the idempotency key",
+			requests: []request{
+				{idempotencyKey: "a", body: `{"value":"v","expiresAt":946684800}`, expectedStatus: http.StatusBadRequest, expectedCode: CodeValidationFailed},
+				{idempotencyKey: "a", body: `{"value":"v"}`, expectedStatus: http.StatusCreated, expectedKey: "generated-1"},
+			},
+			keys: 1,
+		},
+		{
+			name: "Idempotency keys that are too long",
+			requests: []request{
+				{idempotencyKey: strings.Repeat("a", maxIdempotencyKeyLength+1), body: `{"value":"v"}`, expectedStatus: http.StatusBadRequest, expectedCode: CodeValidationFailed},
+			},
+		},
+		{
+			name: "Keys in the internal namespace cannot be posted",
+			requests: []request{
+				{body: `{"key":"_idempotency/a","value":"v"}`, expectedStatus: http.StatusBadRequest, expectedCode: CodeValidationFailed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &kvTestImplementation{entries: map[string]string{}}
+			for k, v := range tt.entries {
+				db.entries[k] = v
+			}
+			h := NewHandler(db, slog.New(slog.DiscardHandler), WithKeyPattern(regexp.MustCompile(`^[a-z_/]+$`)))
+
+			for i, req := range tt.requests {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("POST", "/v1/keys", strings.NewReader(req.body))
+				if req.idempotencyKey != "" {
+					r.Header.Set(IdempotencyKeyHeader, req.idempotencyKey)
+				}
+				h.ServeHTTP(w, r)
+
+				if w.Code != req.expectedStatus {
+					t.Fatalf("request %d: response code = %v; want %v", i, w.Code, req.expectedStatus)
+				}
+				var body struct {
+					Data  *keyResponse `json:"data"`
+					Error *apiError    `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+					t.Fatalf("Failed to decode response body JSON: %v", err)
+				}
+				if req.expectedCode != "" {
+					if body.Error == nil || body.Error.Code != req.expectedCode {
+						t.Errorf("request %d: expected error code %v, got %+v", i, req.expectedCode, body.Error)
+					}
+					continue
+				}
+				if body.Data == nil || body.Data.Key != req.expectedKey {
+					t.Errorf("request %d: expected key %v, got %+v", i, req.expectedKey, body.Data)
+				}
+				if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != req.replayed {
+					t.Errorf("request %d: expected replayed %v, got %v", i, req.replayed, replayed)
+				}
+			}
+
+			keys := 0
+			for k := range db.entries {
+				if !isInternalKey(k) {
+					keys++
+				}
+			}
+			if keys != tt.keys {
+				t.Errorf("expected %d keys, got %d", tt.keys, keys)
+			}
+		})
+	}
+}
+
+func TestWrapper_exportHandler(t *testing.T) {
+	// More entries than fit in a page so that the export has to continue from a cursor
+	var entries []struct {
+		Key   string
+		Value string
+		Ttl   *int64
+	}
+	for n := range streamPageSize + 500 {
+		e := struct {
+			Key   string
+			Value string
+			Ttl   *int64
+		}{Key: fmt.Sprintf("key:%05d", n), Value: fmt.Sprintf("value %d", n)}
+		if n%2 == 0 {
+			e.Ttl = intPtr(int64(n))
+		}
+		entries = append(entries, e)
+	}
+	entries = append(entries, struct {
+		Key   string
+		Value string
+		Ttl   *int64
+	}{Key: "_idempotency/a", Value: "internal"})
+	slices.SortFunc(entries, func(a, b struct {
+		Key   string
+		Value string
+		Ttl   *int64
+	}) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	tests := []struct {
+		name     string
+		query    string
+		cancel   bool // Whether the client has gone away before the export starts
+		expected int  // The number of lines expected
+		first    string
+	}{
+		{
+			name:     "Every entry across pages",
+			expected: streamPageSize + 500,
+			first:    "key:00000",
+		},
+		{
+			name:     "Resume from a cursor",
+			query:    "?cursor=key:01399",
+			expected: 100,
+			first:    "key:01400",
+		},
+		{
+			name:   "Stops when the client goes away",
+			cancel: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{scanEntries: entries}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/v1/export"+tt.query, nil)
+			if tt.cancel {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+			h.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != NDJSONContentType {
+				t.Errorf("expected content type %v, got %v", NDJSONContentType, ct)
+			}
+
+			var lines []exportLine
+			dec := json.NewDecoder(w.Body)
+			for dec.More() {
+				var line exportLine
+				if err := dec.Decode(&line); err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, line)
+			}
+			if len(lines) != tt.expected {
+				t.Fatalf("expected %d lines, got %d", tt.expected, len(lines))
+			}
+			if len(lines) > 0 && lines[0].Key != tt.first {
+				t.Errorf("expected the first key to be %v, got %v", tt.first, lines[0].Key)
+			}
+			for n, line := range lines {
+				if isInternalKey(line.Key) {
+					t.Errorf("internal key %v was exported", line.Key)
+				}
+				if n > 0 && lines[n-1].Key >= line.Key {
+					t.Errorf("keys are out of order: %v before %v", lines[n-1].Key, line.Key)
+				}
+			}
+			for _, line := range lines {
+				var n int64
+				_, _ = fmt.Sscanf(line.Key, "key:%d", &n)
+				if (n%2 == 0) != (line.Ttl != nil) || (line.Ttl != nil && *line.Ttl != n) {
+					t.Errorf("unexpected ttl %v for %v", line.Ttl, line.Key)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapper_redis(t *testing.T) {
+	command := func(args ...string) string {
+		s := "*" + strconv.Itoa(len(args)) + "\r\n"
+		for _, arg := range args {
+			s += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+		}
+		return s
+	}
+
+	importRequest := func(target string, body string) *http.Request {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.Header.Set("Content-Type", RedisContentType)
+		return r
+	}
+
+	t.Run("Import", func(t *testing.T) {
+		db := &databaseTestImplementation{}
+		h := NewHandler(db, slog.New(slog.DiscardHandler))
+		later := time.Now().Add(90 * time.Second).UnixMilli()
+		body := command("SET", "a", "1") +
+			command("SET", "b", "2", "PXAT", strconv.FormatInt(later, 10)) +
+			command("SET", "\xff", "invalid") +
+			command("HSET", "h", "f", "v") +
+			command("SELECT", "1") +
+			command("SET", "other", "3")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, importRequest("/v1/admin/import/redis", body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("response code = %v; want %v: %v", w.Code, http.StatusOK, w.Body)
+		}
+
+		var response redisImportResponse
+		if err := decodeData(w.Body, &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Imported != 2 || response.Skipped["invalid key"] != 1 || response.Skipped["command HSET"] != 1 {
+			t.Errorf("response = %+v; want 2 imported, an invalid key and a skipped command", response)
+		}
+		if len(db.putCalls) != 2 || db.putCalls[0].key != "a" || db.putCalls[0].ttl != nil ||
+			db.putCalls[1].key != "b" || db.putCalls[1].ttl == nil || *db.putCalls[1].ttl != 90 {
+			t.Errorf("puts = %+v; want a without a ttl and b with a ttl of 90", db.putCalls)
+		}
+
+		// Another database
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, importRequest("/v1/admin/import/redis?db=1", body))
+		if w.Code != http.StatusOK || db.putCalls[len(db.putCalls)-1].key != "other" {
+			t.Errorf("import of database 1 = %v; want the other key put", w.Code)
+		}
+
+		for name, request := range map[string]*http.Request{
+			"Invalid file": importRequest("/v1/admin/import/redis", "hello\r\n"),
+			"Invalid db":   importRequest("/v1/admin/import/redis?db=-1", body),
+		} {
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, request)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%v: response code = %v; want %v", name, w.Code, http.StatusBadRequest)
+			}
+		}
+
+		// Failed puts stop the import
+		db = &databaseTestImplementation{putErr: errors.New("boom")}
+		h = NewHandler(db, slog.New(slog.DiscardHandler))
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, importRequest("/v1/admin/import/redis", body))
+		if w.Code != http.StatusInternalServerError || len(db.putCalls) != 1 {
+			t.Errorf("response code = %v after %d puts; want %v after the first", w.Code, len(db.putCalls), http.StatusInternalServerError)
+		}
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		db := &databaseTestImplementation{scanEntries: []struct {
+			Key   string
+			Value string
+			Ttl   *int64
+		}{
+			{Key: "_idempotency/a", Value: "internal"},
+			{Key: "a", Value: "1"},
+			{Key: "b", Value: "2", Ttl: intPtr(60)},
+		}}
+		h := NewHandler(db, slog.New(slog.DiscardHandler))
+		w := httptest.NewRecorder()
+		before := time.Now()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/export/redis", nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != RedisContentType {
+			t.Fatalf("response = %v %v; want %v %v", w.Code, w.Header().Get("Content-Type"), http.StatusOK, RedisContentType)
+		}
+
+		body := w.Body.String()
+		prefix := command("SET", "a", "1") + command("SET", "b", "2")
+		expiresAt := strings.TrimPrefix(body, prefix)
+		if !strings.HasPrefix(body, prefix) || !strings.HasPrefix(expiresAt, "*3\r\n$9\r\nPEXPIREAT\r\n$1\r\nb\r\n") {
+			t.Fatalf("body = %q; want a, then b with an expiration", body)
+		}
+		ms, _ := strconv.ParseInt(strings.Fields(expiresAt)[6], 10, 64)
+		if ms < before.Add(time.Minute).UnixMilli() || ms > time.Now().Add(time.Minute).UnixMilli() {
+			t.Errorf("b expires at %v; want a minute from now", time.UnixMilli(ms))
+		}
+	})
+}
+
+func TestWrapper_datasetGeneration(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		ifNoneMatch string
+		status      int
+	}{
+		{
+			name:   "Export without a cached ETag",
+			path:   "/v1/export",
+			status: http.StatusOK,
+		},
+		{
+			name:        "Export of an unchanged dataset",
+			path:        "/v1/export",
+			ifNoneMatch: `W/"node-7"`,
+			status:      http.StatusNotModified,
+		},
+		{
+			name:        "Export of a changed dataset",
+			path:        "/v1/export",
+			ifNoneMatch: `W/"node-6"`,
+			status:      http.StatusOK,
+		},
+		{
+			name:        "Scan of an unchanged dataset with a strong tag in a list",
+			path:        "/v1/keys?prefix=a",
+			ifNoneMatch: `"other", "node-7"`,
+			status:      http.StatusNotModified,
+		},
+		{
+			name:        "Scan with a wildcard",
+			path:        "/v1/keys",
+			ifNoneMatch: "*",
+			status:      http.StatusNotModified,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{}
+			db.info.Seq, db.info.NodeID = 7, "node"
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if tag := w.Header().Get("ETag"); tag != `W/"node-7"` {
+				t.Errorf("ETag = %v; want W/\"node-7\"", tag)
+			}
+			if gen := w.Header().Get(GenerationHeader); gen != "7" {
+				t.Errorf("%v = %v; want 7", GenerationHeader, gen)
+			}
+			if tt.status == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("expected no body, got %q", w.Body.String())
+			}
+		})
+	}
+}
+func TestWrapper_scanHandlerStream(t *testing.T) {
+	db := &databaseTestImplementation{scanKeys: []string{"_idempotency/a", "a", "b"}}
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/keys?prefix=p&limit=1", nil)
+	r.Header.Set("Accept", NDJSONContentType+"; charset=utf-8, application/json")
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != NDJSONContentType {
+		t.Errorf("expected content type %v, got %v", NDJSONContentType, ct)
+	}
+	if body := w.Body.String(); body != "{\"key\":\"a\"}\n{\"key\":\"b\"}\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// Streams are fetched in pages of their own size regardless of the limit
+	if len(db.scanCalls) != 1 || db.scanCalls[0].prefix != "p" || db.scanCalls[0].limit != streamPageSize {
+		t.Errorf("unexpected scan calls %+v", db.scanCalls)
+	}
+}
+
+// testFeedError is a change feed error of the database
+type testFeedError struct {
+	truncated bool
+}
+
+func (e testFeedError) Error() string {
+	return "change feed error"
+}
+
+func (e testFeedError) Truncated() bool {
+	return e.truncated
+}
+
+func TestWrapper_changesHandler(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	changes := []change{
+		{Seq: 4, Op: "put", Key: "user:a", Value: "1", ExpiresAt: now.Unix() + 60, Time: now},
+		{Seq: 5, Op: "put", Key: "_idempotency/x", Value: "internal", Time: now},
+		{Seq: 6, Op: "delete", Key: "user:a", Time: now},
+		{Seq: 7, Op: "put", Key: "order:1", Value: "2", Time: now},
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		err      error
+		status   int
+		code     string
+		expected []uint64 // The seqs of the streamed changes
+	}{
+		{
+			name:     "Every change without internal keys",
+			query:    "?follow=false",
+			status:   http.StatusOK,
+			expected: []uint64{4, 6, 7},
+		},
+		{
+			name:     "Resume after a seq",
+			query:    "?since=6&follow=false",
+			status:   http.StatusOK,
+			expected: []uint64{7},
+		},
+		{
+			name:     "Only keys with the prefix",
+			query:    "?prefix=user:&follow=false",
+			status:   http.StatusOK,
+			expected: []uint64{4, 6},
+		},
+		{
+			name:   "An invalid seq",
+			query:  "?since=abc",
+			status: http.StatusBadRequest,
+			code:   CodeBadRequest,
+		},
+		{
+			name:   "Changes that are no longer retained",
+			query:  "?since=1",
+			err:    testFeedError{truncated: true},
+			status: http.StatusGone,
+			code:   CodeChangesTruncated,
+		},
+		{
+			name:   "The change feed is disabled",
+			err:    testFeedError{},
+			status: http.StatusNotImplemented,
+			code:   CodeChangeFeedDisabled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{changes: changes, changesErr: tt.err}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/changes"+tt.query, nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if tt.code != "" {
+				var body struct {
+					Error apiError `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error.Code != tt.code {
+					t.Errorf("error code = %v; want %v", body.Error.Code, tt.code)
+				}
+				return
+			}
+
+			var seqs []uint64
+			dec := json.NewDecoder(w.Body)
+			for dec.More() {
+				var line changeResponse
+				if err := dec.Decode(&line); err != nil {
+					t.Fatal(err)
+				}
+				seqs = append(seqs, line.Seq)
+				if line.Seq == 4 && (line.Value == nil || *line.Value != "1" || line.ExpiresAt == nil) {
+					t.Errorf("expected the put to carry its value and expiration, got %+v", line)
+				}
+				if line.Seq == 6 && line.Value != nil {
+					t.Errorf("expected the delete to have no value, got %v", *line.Value)
+				}
+			}
+			if !slices.Equal(seqs, tt.expected) {
+				t.Errorf("seqs = %v; want %v", seqs, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrapper_searchHandler(t *testing.T) {
+	results := []searchResult{{Key: "user:1", Score: 2.5}, {Key: "_idempotency/x", Score: 2}, {Key: "user:2", Score: 1}}
+
+	tests := []struct {
+		name     string
+		query    string
+		disabled bool
+		status   int
+		code     string
+		prefix   string
+		limit    int
+		expected []searchHit
+	}{
+		{
+			name:     "Search with the default limit without internal keys",
+			query:    "?q=ada",
+			status:   http.StatusOK,
+			limit:    DefaultSearchLimit,
+			expected: []searchHit{{Key: "user:1", Score: 2.5}, {Key: "user:2", Score: 1}},
+		},
+		{
+			name:     "Search with a prefix and limit",
+			query:    "?q=ada&prefix=user:&limit=1",
+			status:   http.StatusOK,
+			prefix:   "user:",
+			limit:    1,
+			expected: []searchHit{{Key: "user:1", Score: 2.5}},
+		},
+		{
+			name:   "A missing query",
+			query:  "?prefix=user:",
+			status: http.StatusBadRequest,
+			code:   CodeValidationFailed,
+		},
+		{
+			name:   "An invalid limit",
+			query:  "?q=ada&limit=abc",
+			status: http.StatusBadRequest,
+			code:   CodeBadRequest,
+		},
+		{
+			name:     "Search is disabled",
+			query:    "?q=ada",
+			disabled: true,
+			status:   http.StatusNotImplemented,
+			code:     CodeSearchDisabled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{search: results}
+			if tt.disabled {
+				db.search = nil
+			}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/search"+tt.query, nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var body struct {
+				Data  searchResponse `json:"data"`
+				Error apiError       `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" {
+				if body.Error.Code != tt.code {
+					t.Errorf("error code = %v; want %v", body.Error.Code, tt.code)
+				}
+				return
+			}
+
+			if !slices.Equal(body.Data.Results, tt.expected) {
+				t.Errorf("results = %v; want %v", body.Data.Results, tt.expected)
+			}
+			if len(db.searchCalls) != 1 || db.searchCalls[0].query != "ada" || db.searchCalls[0].prefix != tt.prefix || db.searchCalls[0].limit != tt.limit {
+				t.Errorf("search calls = %+v; want one for ada with prefix %q and limit %v", db.searchCalls, tt.prefix, tt.limit)
+			}
+		})
+	}
+}
+
+func TestWrapper_eventsHandler(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []struct {
+		Type string
+		Key  string
+		Time time.Time
+	}{
+		{Type: "created", Key: "user:1", Time: now},
+		{Type: "created", Key: "_idempotency/a", Time: now},
+		{Type: "updated", Key: "user:1", Time: now},
+		{Type: "expired", Key: "user:2", Time: now},
+		{Type: "deleted", Key: "user:1", Time: now},
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedCode   int
+		expectedPrefix string
+		expected       []string // The expected event types and keys, as type:key
+	}{
+		{
+			name:         "Stream every event",
+			expectedCode: http.StatusOK,
+			expected:     []string{"created:user:1", "updated:user:1", "expired:user:2", "deleted:user:1"},
+		},
+		{
+			name:           "Pass the prefix to the database",
+			query:          "?prefix=user:",
+			expectedCode:   http.StatusOK,
+			expectedPrefix: "user:",
+			expected:       []string{"created:user:1", "updated:user:1", "expired:user:2", "deleted:user:1"},
+		},
+		{
+			name:         "Filter by type",
+			query:        "?types=expired,deleted",
+			expectedCode: http.StatusOK,
+			expected:     []string{"expired:user:2", "deleted:user:1"},
+		},
+		{
+			name:         "Unknown types are rejected",
+			query:        "?types=created,renamed",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{events: events}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/events"+tt.query, nil))
+
+			if w.Code != tt.expectedCode {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.expectedCode)
+			}
+			if tt.expectedCode != http.StatusOK {
+				if len(db.eventsCalls) != 0 {
+					t.Errorf("expected no subscription, got %v", db.eventsCalls)
+				}
+				return
+			}
+			if len(db.eventsCalls) != 1 || db.eventsCalls[0].prefix != tt.expectedPrefix {
+				t.Errorf("expected a subscription to prefix %q, got %v", tt.expectedPrefix, db.eventsCalls)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("expected content type text/event-stream, got %v", ct)
+			}
+
+			var got []string
+			for _, block := range strings.Split(strings.TrimSpace(w.Body.String()), "\n\n") {
+				if block == "" {
+					continue
+				}
+				name, data, _ := strings.Cut(block, "\n")
+				var e keyEventResponse
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &e); err != nil {
+					t.Fatalf("error decoding %q: %v", data, err)
+				}
+				if name != "event: "+e.Type || !e.Time.Equal(now) {
+					t.Errorf("unexpected event %q", block)
+				}
+				got = append(got, e.Type+":"+e.Key)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected events %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// testLimitError mimics the errors the database returns for writes over a limit
+type testLimitError struct {
+	quota bool
+}
+
+func (e testLimitError) Error() string {
+	return "limit exceeded"
+}
+
+func (e testLimitError) Quota() bool {
+	return e.quota
+}
+
+// testStallError mimics the errors the database returns for writes failed fast while a snapshot holds it
+type testStallError struct {
+	retry time.Duration
+}
+
+func (e testStallError) Error() string {
+	return "writes are stalled by persistence"
+}
+
+func (e testStallError) RetryAfter() time.Duration {
+	return e.retry
+}
+
+// testPersistenceError mimics the errors the database returns for writes rejected while persistence keeps failing
+type testPersistenceError struct {
+	testStallError
+}
+
+func (e testPersistenceError) PersistenceKind() string {
+	return "snapshot"
+}
+
+func TestWrapper_namespaceQuota(t *testing.T) {
+	quotaErr := fmt.Errorf("wrapped: %w", testLimitError{quota: true})
+	tests := []struct {
+		name         string
+		db           *databaseTestImplementation
+		requests     []*http.Request
+		expectedCode int    // The response code of the last request
+		expectedErr  string // The error code of the last request
+		retryAfter   string
+		namespace    string  // The namespace whose metrics are checked
+		requested    float64 // The expected requests counted for the namespace
+		rejected     float64 // The expected rejections counted for the namespace
+		reason       string
+	}{
+		{
+			name: "Operations within the rate limit are allowed",
+			db:   &databaseTestImplementation{readReturn: true},
+			requests: []*http.Request{
+				httptest.NewRequest("GET", "/v1/keys/limited:a", nil),
+			},
+			expectedCode: http.StatusOK,
+			namespace:    "limited",
+			requested:    1,
+		},
+		{
+			name: "Operations over the rate limit are rejected",
+			db:   &databaseTestImplementation{readReturn: true},
+			requests: []*http.Request{
+				httptest.NewRequest("GET", "/v1/keys/limited:a", nil),
+				httptest.NewRequest("DELETE", "/v1/keys/limited:b", nil),
+			},
+			expectedCode: http.StatusTooManyRequests,
+			expectedErr:  CodeRateLimited,
+			retryAfter:   "1",
+			namespace:    "limited",
+			requested:    2,
+			rejected:     1,
+			reason:       "rate_limited",
+		},
+		{
+			name: "Namespaces without a rate limit are not limited",
+			db:   &databaseTestImplementation{readReturn: true},
+			requests: []*http.Request{
+				httptest.NewRequest("GET", "/v1/keys/full:a", nil),
+				httptest.NewRequest("GET", "/v1/keys/other:a", nil),
+				httptest.NewRequest("GET", "/v1/keys/other:a", nil),
+			},
+			expectedCode: http.StatusOK,
+			namespace:    "full",
+			requested:    1,
+		},
+		{
+			name: "Puts over the quota are rejected",
+			db:   &databaseTestImplementation{putErr: quotaErr},
+			requests: []*http.Request{
+				httptest.NewRequest("PUT", "/v1/keys/full:a", strings.NewReader(`{"value":"a"}`)),
+			},
+			expectedCode: http.StatusInsufficientStorage,
+			expectedErr:  CodeQuotaExceeded,
+			namespace:    "full",
+			requested:    1,
+			rejected:     1,
+			reason:       "quota_exceeded",
+		},
+		{
+			name: "Posts over the quota are rejected",
+			db:   &databaseTestImplementation{createErr: quotaErr},
+			requests: []*http.Request{
+				httptest.NewRequest("POST", "/v1/keys", strings.NewReader(`{"key":"full:a","value":"a"}`)),
+			},
+			expectedCode: http.StatusInsufficientStorage,
+			expectedErr:  CodeQuotaExceeded,
+			namespace:    "full",
+			requested:    1,
+			rejected:     1,
+			reason:       "quota_exceeded",
+		},
+		{
+			name: "Writes over a database size limit are invalid",
+			db:   &databaseTestImplementation{putErr: testLimitError{}},
+			requests: []*http.Request{
+				httptest.NewRequest("PUT", "/v1/keys/full:a", strings.NewReader(`{"value":"a"}`)),
+			},
+			expectedCode: http.StatusBadRequest,
+			expectedErr:  CodeValidationFailed,
+			namespace:    "full",
+			requested:    1,
+		},
+		{
+			name: "Writes stalled by a snapshot are unavailable",
+			db:   &databaseTestImplementation{putErr: testStallError{retry: 2500 * time.Millisecond}},
+			requests: []*http.Request{
+				httptest.NewRequest("PUT", "/v1/keys/full:a", strings.NewReader(`{"value":"a"}`)),
+			},
+			expectedCode: http.StatusServiceUnavailable,
+			expectedErr:  CodeWriteStalled,
+			retryAfter:   "3",
+			namespace:    "full",
+			requested:    1,
+		},
+		{
+			name: "Writes rejected while persistence is failing are unavailable",
+			db:   &databaseTestImplementation{putErr: testPersistenceError{testStallError{retry: 30 * time.Second}}},
+			requests: []*http.Request{
+				httptest.NewRequest("PUT", "/v1/keys/full:a", strings.NewReader(`{"value":"a"}`)),
+			},
+			expectedCode: http.StatusServiceUnavailable,
+			expectedErr:  CodePersistenceFailed,
+			retryAfter:   "30",
+			namespace:    "full",
+			requested:    1,
+		},
+		{
+			name: "Other write errors are internal errors",
+			db:   &databaseTestImplementation{createErr: errors.New("failed")},
+			requests: []*http.Request{
+				httptest.NewRequest("POST", "/v1/keys", strings.NewReader(`{"key":"full:a","value":"a"}`)),
+			},
+			expectedCode: http.StatusInternalServerError,
+			expectedErr:  CodeInternal,
+			namespace:    "full",
+			requested:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(tt.db, slog.New(slog.DiscardHandler),
+				WithNamespaceQuota("limited", 1),
+				WithNamespaceQuota("full", 0))
+
+			var w *httptest.ResponseRecorder
+			for _, r := range tt.requests {
+				w = httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+			}
+
+			if w.Code != tt.expectedCode {
+				t.Fatalf("response code = %v; want %v", w.Code, tt.expectedCode)
+			}
+			if tt.expectedErr != "" {
+				var e envelope
+				if err := json.NewDecoder(w.Body).Decode(&e); err != nil || e.Error == nil || e.Error.Code != tt.expectedErr {
+					t.Errorf("expected error code %v, got %+v (%v)", tt.expectedErr, e.Error, err)
+				}
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("expected Retry-After %q, got %q", tt.retryAfter, got)
+			}
+
+			if got := testutil.ToFloat64(h.m.dbNamespaceRequests.WithLabelValues(tt.namespace)); got != tt.requested {
+				t.Errorf("expected %v requests for %v, got %v", tt.requested, tt.namespace, got)
+			}
+			if tt.reason != "" {
+				if got := testutil.ToFloat64(h.m.dbNamespaceRejections.WithLabelValues(tt.namespace, tt.reason)); got != tt.rejected {
+					t.Errorf("expected %v rejections for %v, got %v", tt.rejected, tt.namespace, got)
+				}
+			}
+			if got := testutil.CollectAndCount(h.m.dbNamespaceRequests); got > 2 {
+				t.Errorf("expected only namespaces with a quota to be labelled, got %v series", got)
+			}
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2)
+	now := b.last
+	for n := range 2 {
+		if ok, _ := b.allow(now); !ok {
+			t.Fatalf("expected operation %d of the burst to be allowed", n)
+		}
+	}
+	if ok, wait := b.allow(now); ok || wait != 500*time.Millisecond {
+		t.Errorf("allow() = %v, %v; want false, 500ms", ok, wait)
+	}
+	if ok, _ := b.allow(now.Add(500 * time.Millisecond)); !ok {
+		t.Errorf("expected a token to have been added after 500ms")
+	}
+
+	// Unused tokens do not accumulate past the burst
+	now = now.Add(time.Hour)
+	for range 2 {
+		b.allow(now)
+	}
+	if ok, _ := b.allow(now); ok {
+		t.Errorf("expected the burst to be capped")
+	}
+}
+
+func TestWrapper_patchHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string // The stored value, or none if empty
+		contentType   string
+		body          string
+		status        int
+		code          string
+		expectedValue string // The stored value afterwards
+	}{
+		{
+			name:          "Merge a patch into a document",
+			value:         `{"name":"a","age":1,"address":{"city":"x","zip":"1"},"tags":["a"]}`,
+			contentType:   MergePatchContentType,
+			body:          `{"age":2,"address":{"zip":null,"street":"y"},"tags":["b"]}`,
+			status:        http.StatusOK,
+			expectedValue: `{"address":{"city":"x","street":"y"},"age":2,"name":"a","tags":["b"]}`,
+		},
+		{
+			name:          "Numbers keep their precision",
+			value:         `{"id":12345678901234567890,"n":1.50}`,
+			contentType:   MergePatchContentType + "; charset=utf-8",
+			body:          `{"n":null}`,
+			status:        http.StatusOK,
+			expectedValue: `{"id":12345678901234567890}`,
+		},
+		{
+			name:          "A patch that is not an object replaces the document",
+			value:         `{"a":1}`,
+			contentType:   MergePatchContentType,
+			body:          `[1,2]`,
+			status:        http.StatusOK,
+			expectedValue: `[1,2]`,
+		},
+		{
+			name:        "Missing key",
+			contentType: MergePatchContentType,
+			body:        `{"a":1}`,
+			status:      http.StatusNotFound,
+			code:        CodeKeyNotFound,
+		},
+		{
+			name:          "Stored value is not JSON",
+			value:         "plain text",
+			contentType:   MergePatchContentType,
+			body:          `{"a":1}`,
+			status:        http.StatusConflict,
+			code:          CodeValueNotJSON,
+			expectedValue: "plain text",
+		},
+		{
+			name:          "Invalid patch",
+			value:         `{"a":1}`,
+			contentType:   MergePatchContentType,
+			body:          `{"a":`,
+			status:        http.StatusBadRequest,
+			code:          CodeBadRequest,
+			expectedValue: `{"a":1}`,
+		},
+		{
+			name:          "JSON patch is not supported",
+			value:         `{"a":1}`,
+			contentType:   "application/json-patch+json",
+			body:          `[{"op":"remove","path":"/a"}]`,
+			status:        http.StatusUnsupportedMediaType,
+			code:          CodeUnsupportedMedia,
+			expectedValue: `{"a":1}`,
+		},
+		{
+			name:          "Patched value over the maximum length",
+			value:         `{"a":"` + strings.Repeat("x", 80) + `"}`,
+			contentType:   MergePatchContentType,
+			body:          `{"b":"` + strings.Repeat("x", 60) + `"}`,
+			status:        http.StatusBadRequest,
+			code:          CodeValidationFailed,
+			expectedValue: `{"a":"` + strings.Repeat("x", 80) + `"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &kvTestImplementation{entries: map[string]string{}}
+			if tt.value != "" {
+				db.entries["doc"] = tt.value
+			}
+			h := NewHandler(db, slog.New(slog.DiscardHandler), WithMaxValueLength(128))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("PATCH", "/v1/keys/doc", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response envelope
+			var data getResponse
+			response.Data = &data
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" {
+				if response.Error == nil || response.Error.Code != tt.code {
+					t.Errorf("error = %v; want code %v", response.Error, tt.code)
+				}
+			} else if data.Value != tt.expectedValue {
+				t.Errorf("patched value = %v; want %v", data.Value, tt.expectedValue)
+			}
+			if db.entries["doc"] != tt.expectedValue {
+				t.Errorf("stored value = %v; want %v", db.entries["doc"], tt.expectedValue)
+			}
+		})
+	}
+}
+
+func TestWrapper_bitmaps(t *testing.T) {
+	type request struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+		data   string // The expected data of the envelope
+		stored string // The expected value of the bitmap after the request
+	}
+	tests := []struct {
+		name     string
+		value    string
+		requests []request
+	}{
+		{
+			name: "Set, get and count bits of a new bitmap",
+			requests: []request{
+				{method: "PUT", path: "/bits/7", body: `{"value":1}`, status: http.StatusOK,
+					data: `{"key":"flags","offset":7,"value":1,"previous":0}`, stored: "AQ=="},
+				{method: "PUT", path: "/bits/0", body: `{"value":1}`, status: http.StatusOK,
+					data: `{"key":"flags","offset":0,"value":1,"previous":0}`, stored: "gQ=="},
+				{method: "GET", path: "/bits/0", status: http.StatusOK,
+					data: `{"key":"flags","offset":0,"value":1}`, stored: "gQ=="},
+				{method: "GET", path: "/bits/100", status: http.StatusOK,
+					data: `{"key":"flags","offset":100,"value":0}`, stored: "gQ=="},
+				{method: "GET", path: "/count", status: http.StatusOK,
+					data: `{"key":"flags","count":2}`, stored: "gQ=="},
+				{method: "PUT", path: "/bits/7", body: `{"value":0}`, status: http.StatusOK,
+					data: `{"key":"flags","offset":7,"value":0,"previous":1}`, stored: "gA=="},
+				{method: "PUT", path: "/bits/17", body: `{"value":1}`, status: http.StatusOK,
+					data: `{"key":"flags","offset":17,"value":1,"previous":0}`, stored: "gABA"},
+			},
+		},
+		{
+			name: "Missing bitmaps have no bits set",
+			requests: []request{
+				{method: "GET", path: "/bits/3", status: http.StatusOK, data: `{"key":"flags","offset":3,"value":0}`},
+				{method: "GET", path: "/count", status: http.StatusOK, data: `{"key":"flags","count":0}`},
+			},
+		},
+		{
+			name:  "Stored value is not a bitmap",
+			value: "plain text",
+			requests: []request{
+				{method: "PUT", path: "/bits/1", body: `{"value":1}`, status: http.StatusConflict, code: CodeValueNotBitmap, stored: "plain text"},
+				{method: "GET", path: "/bits/1", status: http.StatusConflict, code: CodeValueNotBitmap, stored: "plain text"},
+				{method: "GET", path: "/count", status: http.StatusConflict, code: CodeValueNotBitmap, stored: "plain text"},
+			},
+		},
+		{
+			name:  "Invalid requests",
+			value: "AQ==",
+			requests: []request{
+				{method: "PUT", path: "/bits/1", body: `{"value":2}`, status: http.StatusBadRequest, code: CodeValidationFailed, stored: "AQ=="},
+				{method: "PUT", path: "/bits/1", body: `{}`, status: http.StatusBadRequest, code: CodeValidationFailed, stored: "AQ=="},
+				{method: "PUT", path: "/bits/1", body: `{"value":`, status: http.StatusBadRequest, code: CodeBadRequest, stored: "AQ=="},
+				{method: "PUT", path: "/bits/-1", body: `{"value":1}`, status: http.StatusBadRequest, code: CodeBadRequest, stored: "AQ=="},
+				{method: "GET", path: "/bits/x", status: http.StatusBadRequest, code: CodeBadRequest, stored: "AQ=="},
+			},
+		},
+		{
+			name: "Offsets past the maximum value length",
+			requests: []request{
+				{method: "PUT", path: "/bits/767", body: `{"value":1}`, status: http.StatusOK,
+					data: `{"key":"flags","offset":767,"value":1,"previous":0}`, stored: base64.StdEncoding.EncodeToString(append(make([]byte, 95), 1))},
+				{method: "PUT", path: "/bits/768", body: `{"value":1}`, status: http.StatusBadRequest, code: CodeValidationFailed,
+					stored: base64.StdEncoding.EncodeToString(append(make([]byte, 95), 1))},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &kvTestImplementation{entries: map[string]string{}}
+			if tt.value != "" {
+				db.entries["flags"] = tt.value
+			}
+			h := NewHandler(db, slog.New(slog.DiscardHandler), WithMaxValueLength(128))
+
+			for n, req := range tt.requests {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest(req.method, "/v1/bitmaps/flags"+req.path, strings.NewReader(req.body)))
+				if w.Code != req.status {
+					t.Errorf("request %v: response code = %v; want %v", n, w.Code, req.status)
+				}
+				var response struct {
+					Data  json.RawMessage `json:"data"`
+					Error *apiError       `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+					t.Fatal(err)
+				}
+				if req.code != "" {
+					if response.Error == nil || response.Error.Code != req.code {
+						t.Errorf("request %v: error = %v; want code %v", n, response.Error, req.code)
+					}
+				} else if string(response.Data) != req.data {
+					t.Errorf("request %v: data = %s; want %v", n, response.Data, req.data)
+				}
+				if db.entries["flags"] != req.stored {
+					t.Errorf("request %v: stored value = %v; want %v", n, db.entries["flags"], req.stored)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapper_hyperLogLogs(t *testing.T) {
+	add := func(h *Wrapper, key string, members []string) (*httptest.ResponseRecorder, hyperLogLogAddResponse, *apiError) {
+		body, _ := json.Marshal(map[string][]string{"members": members})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/hyperloglogs/"+key+"/members", bytes.NewReader(body)))
+		var response envelope
+		var data hyperLogLogAddResponse
+		response.Data = &data
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return w, data, response.Error
+	}
+	count := func(h *Wrapper, key string) (*httptest.ResponseRecorder, uint64, *apiError) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/hyperloglogs/"+key+"/count", nil))
+		var response envelope
+		var data hyperLogLogCountResponse
+		response.Data = &data
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return w, data.Count, response.Error
+	}
+	members := func(from, to int) []string {
+		m := make([]string, 0, to-from)
+		for n := from; n < to; n++ {
+			m = append(m, fmt.Sprintf("visitor-%d", n))
+		}
+		return m
+	}
+
+	t.Run("Count distinct members", func(t *testing.T) {
+		db := &kvTestImplementation{entries: map[string]string{}}
+		h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+		if w, c, _ := count(h, "visitors"); w.Code != http.StatusOK || c != 0 {
+			t.Errorf("count of a missing key = %v, %v; want 200, 0", w.Code, c)
+		}
+		for from := 0; from < 20000; from += 1000 {
+			if w, data, _ := add(h, "visitors", members(from, from+1000)); w.Code != http.StatusOK || !data.Updated {
+				t.Fatalf("add = %v, %+v; want 200 and updated", w.Code, data)
+			}
+			// Adding members again must not change the count
+			if w, data, _ := add(h, "visitors", members(from, from+1000)); w.Code != http.StatusOK || data.Updated {
+				t.Fatalf("add again = %v, %+v; want 200 and not updated", w.Code, data)
+			}
+
+			w, c, _ := count(h, "visitors")
+			if w.Code != http.StatusOK {
+				t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+			}
+			if want := float64(from + 1000); math.Abs(float64(c)-want) > want*0.03 {
+				t.Errorf("count = %v; want %v within 3%%", c, want)
+			}
+		}
+		if length := len(db.entries["visitors"]); length != base64.StdEncoding.EncodedLen(len(hllMagic)+1+hllRegisters) {
+			t.Errorf("stored length = %v; want the dense encoding", length)
+		}
+	})
+
+	t.Run("Few members are stored sparsely", func(t *testing.T) {
+		db := &kvTestImplementation{entries: map[string]string{}}
+		h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+		if w, _, _ := add(h, "visitors", members(0, 10)); w.Code != http.StatusOK {
+			t.Fatalf("response code = %v; want %v", w.Code, http.StatusOK)
+		}
+		if length := len(db.entries["visitors"]); length > 64 {
+			t.Errorf("stored length = %v; want the sparse encoding", length)
+		}
+		if _, c, _ := count(h, "visitors"); c != 10 {
+			t.Errorf("count = %v; want 10", c)
+		}
+	})
+
+	t.Run("Stored value is not a HyperLogLog", func(t *testing.T) {
+		db := &kvTestImplementation{entries: map[string]string{"visitors": "AQ=="}}
+		h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+		if w, _, e := add(h, "visitors", members(0, 1)); w.Code != http.StatusConflict || e == nil || e.Code != CodeValueNotHLL {
+			t.Errorf("add = %v, %v; want 409 %v", w.Code, e, CodeValueNotHLL)
+		}
+		if w, _, e := count(h, "visitors"); w.Code != http.StatusConflict || e == nil || e.Code != CodeValueNotHLL {
+			t.Errorf("count = %v, %v; want 409 %v", w.Code, e, CodeValueNotHLL)
+		}
+		if db.entries["visitors"] != "AQ==" {
+			t.Errorf("stored value = %v; want it unchanged", db.entries["visitors"])
+		}
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		db := &kvTestImplementation{entries: map[string]string{}}
+		h := NewHandler(db, slog.New(slog.DiscardHandler), WithMaxValueLength(128))
+
+		if w, _, e := add(h, "visitors", nil); w.Code != http.StatusBadRequest || e == nil || e.Code != CodeValidationFailed {
+			t.Errorf("add without members = %v, %v; want 400 %v", w.Code, e, CodeValidationFailed)
+		}
+		if w, _, e := add(h, "visitors", members(0, 100)); w.Code != http.StatusBadRequest || e == nil || e.Code != CodeValidationFailed {
+			t.Errorf("add over the maximum value length = %v, %v; want 400 %v", w.Code, e, CodeValidationFailed)
+		}
+		if _, ok := db.entries["visitors"]; ok {
+			t.Errorf("stored value = %v; want none", db.entries["visitors"])
+		}
+	})
+}
+
+func TestGeohash(t *testing.T) {
+	if hash := geohashEncode(42.6, -5.6, 5); hash != "ezs42" {
+		t.Errorf("geohash = %v; want ezs42", hash)
+	}
+	lat, lon, ok := geohashDecode(geohashEncode(38.115556, 13.361389, geohashPrecision))
+	if !ok || math.Abs(lat-38.115556) > 1e-6 || math.Abs(lon-13.361389) > 1e-6 {
+		t.Errorf("decoded location = %v, %v, %v; want 38.115556, 13.361389", lat, lon, ok)
+	}
+	if _, _, ok := geohashDecode("ezs4a"); ok {
+		t.Errorf("decoding an invalid geohash succeeded")
+	}
+
+	// The cells around a center must hold every location within the radius
+	for _, radius := range []float64{1, 100, 10000, 1000000} {
+		for _, center := range [][2]float64{{0, 0}, {38.1, 13.4}, {-33.9, 151.2}, {60, 179.99}, {84, -120}} {
+			cells := geohashCells(center[0], center[1], radius)
+			for n := range 1000 {
+				bearing := float64(n) / 1000 * 2 * math.Pi
+				dLat := radius * 0.999 / earthRadius * math.Cos(bearing) * 180 / math.Pi
+				dLon := radius * 0.999 / earthRadius * math.Sin(bearing) * 180 / math.Pi / math.Cos(center[0]*math.Pi/180)
+				lat, lon := center[0]+dLat, math.Remainder(center[1]+dLon, 360)
+				if lat < -90 || lat > 90 || geoDistance(center[0], center[1], lat, lon) > radius {
+					continue
+				}
+				hash := geohashEncode(lat, lon, geohashPrecision)
+				if cells != nil && !slices.ContainsFunc(cells, func(cell string) bool { return strings.HasPrefix(hash, cell) }) {
+					t.Fatalf("location %v, %v within %vm of %v is not in the cells %v", lat, lon, radius, center, cells)
+				}
+			}
+		}
+	}
+}
+
+func TestWrapper_geo(t *testing.T) {
+	type request struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+		data   string // The expected data of the envelope
+	}
+	sicily := `{"members":[{"member":"Palermo","lat":38.115556,"lon":13.361389},{"member":"Catania","lat":37.502669,"lon":15.087269}]}`
+	tests := []struct {
+		name     string
+		value    string
+		requests []request
+	}{
+		{
+			name: "Add and search members",
+			requests: []request{
+				{method: "POST", path: "/members", body: sicily, status: http.StatusOK, data: `{"key":"cities","added":2}`},
+				{method: "POST", path: "/members", body: `{"members":[{"member":"Palermo","lat":38.115556,"lon":13.361389},{"member":"Rome","lat":41.9,"lon":12.5}]}`,
+					status: http.StatusOK, data: `{"key":"cities","added":1}`},
+				{method: "GET", path: "/search?lat=37&lon=15&radius=100&unit=km", status: http.StatusOK,
+					data: `{"results":[{"member":"Catania","lat":37.502669,"lon":15.087269,"distance":56.44}]}`},
+				{method: "GET", path: "/search?lat=37&lon=15&radius=200&unit=km", status: http.StatusOK,
+					data: `{"results":[{"member":"Catania","lat":37.502669,"lon":15.087269,"distance":56.44},{"member":"Palermo","lat":38.115556,"lon":13.361389,"distance":190.44}]}`},
+				{method: "GET", path: "/search?lat=37&lon=15&radius=200&unit=km&limit=1", status: http.StatusOK,
+					data: `{"results":[{"member":"Catania","lat":37.502669,"lon":15.087269,"distance":56.44}]}`},
+				{method: "GET", path: "/search?member=Palermo&radius=170&unit=km", status: http.StatusOK,
+					data: `{"results":[{"member":"Palermo","lat":38.115556,"lon":13.361389,"distance":0},{"member":"Catania","lat":37.502669,"lon":15.087269,"distance":166.27}]}`},
+				{method: "GET", path: "/search?member=Naples&radius=100", status: http.StatusNotFound, code: CodeMemberNotFound},
+			},
+		},
+		{
+			name: "Missing keys have no members",
+			requests: []request{
+				{method: "GET", path: "/search?lat=0&lon=0&radius=1", status: http.StatusOK, data: `{"results":[]}`},
+			},
+		},
+		{
+			name:  "Stored value is not a geo set",
+			value: `{"Palermo":"not a geohash"}`,
+			requests: []request{
+				{method: "POST", path: "/members", body: sicily, status: http.StatusConflict, code: CodeValueNotGeo},
+				{method: "GET", path: "/search?lat=0&lon=0&radius=1", status: http.StatusConflict, code: CodeValueNotGeo},
+			},
+		},
+		{
+			name: "Invalid requests",
+			requests: []request{
+				{method: "POST", path: "/members", body: `{"members":[]}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "POST", path: "/members", body: `{"members":[{"member":"a","lat":91,"lon":0}]}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "POST", path: "/members", body: `{"members":[{"member":"a","lat":0}]}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "POST", path: "/members", body: `{"members":`, status: http.StatusBadRequest, code: CodeBadRequest},
+				{method: "POST", path: "/members", body: `{"members":[{"member":"` + strings.Repeat("x", 128) + `","lat":0,"lon":0}]}`,
+					status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "GET", path: "/search?lat=0&lon=0", status: http.StatusBadRequest, code: CodeBadRequest},
+				{method: "GET", path: "/search?lat=0&radius=1", status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "GET", path: "/search?lat=0&lon=0&member=a&radius=1", status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "GET", path: "/search?lat=0&lon=181&radius=1", status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "GET", path: "/search?lat=0&lon=0&radius=-1", status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "GET", path: "/search?lat=0&lon=0&radius=1&unit=yd", status: http.StatusBadRequest, code: CodeValidationFailed},
+				{method: "GET", path: "/search?lat=x&lon=0&radius=1", status: http.StatusBadRequest, code: CodeBadRequest},
+			},
+		},
+	}
+
+	// Locations and distances are rounded so that the expected responses stay readable
+	round := func(data []byte) string {
+		var response geoSearchResponse
+		if json.Unmarshal(data, &response) != nil || response.Results == nil {
+			return string(data)
+		}
+		for n, r := range response.Results {
+			response.Results[n].Lat = math.Round(r.Lat*1e6) / 1e6
+			response.Results[n].Lon = math.Round(r.Lon*1e6) / 1e6
+			response.Results[n].Distance = math.Round(r.Distance*100) / 100
+		}
+		b, _ := json.Marshal(response)
+		return string(b)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &kvTestImplementation{entries: map[string]string{}}
+			if tt.value != "" {
+				db.entries["cities"] = tt.value
+			}
+			h := NewHandler(db, slog.New(slog.DiscardHandler), WithMaxValueLength(128))
+
+			for n, req := range tt.requests {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest(req.method, "/v1/geo/cities"+req.path, strings.NewReader(req.body)))
+				if w.Code != req.status {
+					t.Errorf("request %v: response code = %v; want %v", n, w.Code, req.status)
+				}
+				var response struct {
+					Data  json.RawMessage `json:"data"`
+					Error *apiError       `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+					t.Fatal(err)
+				}
+				if req.code != "" {
+					if response.Error == nil || response.Error.Code != req.code {
+						t.Errorf("request %v: error = %v; want code %v", n, response.Error, req.code)
+					}
+				} else if data := round(response.Data); data != req.data {
+					t.Errorf("request %v: data = %s; want %v", n, data, req.data)
+				}
+			}
+			if tt.value != "" && db.entries["cities"] != tt.value {
+				t.Errorf("stored value = %v; want it unchanged", db.entries["cities"])
+			}
+		})
+	}
+}
+
+func TestRateLimitState_take(t *testing.T) {
+	type check struct {
+		at        time.Duration // Since the first check
+		cost      int
+		allowed   bool
+		remaining int
+		wait      time.Duration
+	}
+	tests := []struct {
+		name      string
+		algorithm string
+		checks    []check
+	}{
+		{
+			name:      "Token bucket",
+			algorithm: RateLimitTokenBucket,
+			checks: []check{
+				{at: 0, cost: 3, allowed: true, remaining: 1},
+				{at: 0, cost: 1, allowed: true, remaining: 0},
+				{at: 0, cost: 1, allowed: false, wait: 2500 * time.Millisecond},
+				{at: 5 * time.Second, cost: 2, allowed: true, remaining: 0},
+				{at: 5 * time.Second, cost: 4, allowed: false, wait: 10 * time.Second},
+				{at: time.Hour, cost: 1, allowed: true, remaining: 3},
+			},
+		},
+		{
+			name:      "Sliding window",
+			algorithm: RateLimitSlidingWindow,
+			checks: []check{
+				{at: 0, cost: 3, allowed: true, remaining: 1},
+				{at: time.Second, cost: 1, allowed: true, remaining: 0},
+				{at: 2 * time.Second, cost: 1, allowed: false, wait: 10500 * time.Millisecond},
+				// Half of the previous window still counts
+				{at: 15 * time.Second, cost: 3, allowed: false, wait: 2500 * time.Millisecond},
+				{at: 15 * time.Second, cost: 2, allowed: true, remaining: 0},
+				{at: 20 * time.Second, cost: 1, allowed: true, remaining: 1},
+				{at: time.Hour, cost: 4, allowed: true, remaining: 0},
+			},
+		},
+	}
+
+	start := time.Unix(1000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := rateLimitState{Algorithm: tt.algorithm}
+			for n, c := range tt.checks {
+				r := rateLimitRequest{Algorithm: tt.algorithm, Limit: 4, Window: 10, Cost: c.cost}
+				allowed, remaining, wait := state.take(r, start.Add(c.at))
+				if allowed != c.allowed || remaining != c.remaining || wait.Round(time.Millisecond) != c.wait {
+					t.Errorf("check %v: take() = %v, %v, %v; want %v, %v, %v", n, allowed, remaining, wait, c.allowed, c.remaining, c.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapper_rateLimitHandler(t *testing.T) {
+	db := &kvTestImplementation{entries: map[string]string{}}
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+	check := func(name string, body string) (*httptest.ResponseRecorder, rateLimitResponse, *apiError) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/ratelimit/"+name, strings.NewReader(body)))
+		var response envelope
+		var data rateLimitResponse
+		response.Data = &data
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return w, data, response.Error
+	}
+
+	for n := range 3 {
+		w, data, _ := check("api", `{"limit":2,"window":3600}`)
+		if w.Code != http.StatusOK || data.Allowed != (n < 2) || data.Name != "api" {
+			t.Errorf("check %v = %v, %+v; want allowed: %v", n, w.Code, data, n < 2)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); (retryAfter != "") == data.Allowed {
+			t.Errorf("check %v: Retry-After = %q with allowed: %v", n, retryAfter, data.Allowed)
+		}
+	}
+	if _, ok := db.entries[rateLimitPrefix+"api"]; !ok {
+		t.Errorf("the state of the rate limiter was not stored")
+	}
+
+	// Limiters are independent of each other
+	if _, data, _ := check("other", `{"algorithm":"sliding_window","limit":1,"window":60}`); !data.Allowed {
+		t.Errorf("a new limiter denied the first request")
+	}
+	if w, _, e := check("api", `{"algorithm":"sliding_window","limit":2,"window":3600}`); w.Code != http.StatusConflict || e == nil || e.Code != CodeLimiterConflict {
+		t.Errorf("check with another algorithm = %v, %v; want 409 %v", w.Code, e, CodeLimiterConflict)
+	}
+
+	for _, body := range []string{`{"window":60}`, `{"limit":1}`, `{"limit":1,"window":60,"cost":2}`, `{"limit":1,"window":60,"algorithm":"leaky"}`} {
+		if w, _, e := check("api", body); w.Code != http.StatusBadRequest || e == nil || e.Code != CodeValidationFailed {
+			t.Errorf("check with %v = %v, %v; want 400 %v", body, w.Code, e, CodeValidationFailed)
+		}
+	}
+	if w, _, e := check("api", `{"limit":`); w.Code != http.StatusBadRequest || e == nil || e.Code != CodeBadRequest {
+		t.Errorf("check with a bad body = %v, %v; want 400 %v", w.Code, e, CodeBadRequest)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []any
+		wantErr  bool
+	}{
+		{path: "$", expected: nil},
+		{path: "$.user.name", expected: []any{"user", "name"}},
+		{path: "user.name", expected: []any{"user", "name"}},
+		{path: "$.users[0].name", expected: []any{"users", 0, "name"}},
+		{path: "[1][2]", expected: []any{1, 2}},
+		{path: `$["a.b"]['c']`, expected: []any{"a.b", "c"}},
+		{path: "$..name", wantErr: true},
+		{path: "$.users[*]", wantErr: true},
+		{path: "$.users[-1]", wantErr: true},
+		{path: "$.users[0", wantErr: true},
+		{path: "$.a.", wantErr: true},
+		{path: "$name", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			segments, err := parsePath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePath() error = %v; wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(segments, tt.expected) {
+				t.Errorf("parsePath() = %#v; want %#v", segments, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrapper_getHandlerPath(t *testing.T) {
+	document := `{"user":{"name":"Ada","id":12345678901234567890},"tags":["a","b"]}`
+	tests := []struct {
+		name          string
+		key           string
+		path          string
+		status        int
+		code          string
+		expectedValue string
+	}{
+		{name: "String member", key: "doc", path: "$.user.name", status: http.StatusOK, expectedValue: `"Ada"`},
+		{name: "Dotted path", key: "doc", path: "user.id", status: http.StatusOK, expectedValue: `12345678901234567890`},
+		{name: "Object member", key: "doc", path: "$.user", status: http.StatusOK, expectedValue: `{"id":12345678901234567890,"name":"Ada"}`},
+		{name: "Array index", key: "doc", path: "$.tags[1]", status: http.StatusOK, expectedValue: `"b"`},
+		{name: "Missing member", key: "doc", path: "$.user.email", status: http.StatusNotFound, code: CodePathNotFound},
+		{name: "Index out of range", key: "doc", path: "$.tags[2]", status: http.StatusNotFound, code: CodePathNotFound},
+		{name: "Invalid path", key: "doc", path: "$..name", status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Value is not JSON", key: "text", path: "$.a", status: http.StatusConflict, code: CodeValueNotJSON},
+		{name: "Missing key", key: "missing", path: "$.a", status: http.StatusNotFound, code: CodeKeyNotFound},
+	}
+
+	db := &kvTestImplementation{entries: map[string]string{"doc": document, "text": "plain text"}}
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/v1/keys/"+tt.key+"?path="+url.QueryEscape(tt.path), nil)
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response envelope
+			var data getResponse
+			response.Data = &data
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" {
+				if response.Error == nil || response.Error.Code != tt.code {
+					t.Errorf("error = %v; want code %v", response.Error, tt.code)
+				}
+			} else if data.Value != tt.expectedValue {
+				t.Errorf("projected value = %v; want %v", data.Value, tt.expectedValue)
+			}
+		})
+	}
+}
+
+func TestWrapper_leases(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		leaseHeld bool
+		status    int
+		code      string
+		expected  string // The expected response data
+		call      string // The expected database call, or none if empty
+	}{
+		{
+			name:     "Acquire a lease",
+			method:   "POST",
+			path:     "/v1/leases",
+			body:     `{"name":"worker","ttl":10}`,
+			status:   http.StatusCreated,
+			expected: `{"name":"worker","id":"lease-id"}`,
+			call:     "AcquireLease worker 10",
+		},
+		{
+			name:      "Acquire a held lease",
+			method:    "POST",
+			path:      "/v1/leases",
+			body:      `{"name":"worker","ttl":10}`,
+			leaseHeld: true,
+			status:    http.StatusConflict,
+			code:      CodeLeaseHeld,
+			call:      "AcquireLease worker 10",
+		},
+		{
+			name:   "Acquire a lease without a ttl",
+			method: "POST",
+			path:   "/v1/leases",
+			body:   `{"name":"worker"}`,
+			status: http.StatusBadRequest,
+			code:   CodeValidationFailed,
+		},
+		{
+			name:     "Renew a lease",
+			method:   "PUT",
+			path:     "/v1/leases/worker",
+			body:     `{"id":"lease-id"}`,
+			status:   http.StatusOK,
+			expected: `{"name":"worker","id":"lease-id"}`,
+			call:     "RenewLease worker lease-id",
+		},
+		{
+			name:   "Renew a lost lease",
+			method: "PUT",
+			path:   "/v1/leases/worker",
+			body:   `{"id":"other"}`,
+			status: http.StatusNotFound,
+			code:   CodeLeaseNotFound,
+			call:   "RenewLease worker other",
+		},
+		{
+			name:     "Release a lease",
+			method:   "DELETE",
+			path:     "/v1/leases/worker",
+			body:     `{"id":"lease-id"}`,
+			status:   http.StatusOK,
+			expected: `{"name":"worker","deleted":2}`,
+			call:     "ReleaseLease worker lease-id",
+		},
+		{
+			name:   "Release without an id",
+			method: "DELETE",
+			path:   "/v1/leases/worker",
+			body:   `{}`,
+			status: http.StatusBadRequest,
+			code:   CodeValidationFailed,
+		},
+		{
+			name:     "Put a key under a lease",
+			method:   "PUT",
+			path:     "/v1/keys/svc:a",
+			body:     `{"value":"v","lease":"worker","leaseId":"lease-id"}`,
+			status:   http.StatusCreated,
+			expected: `{"key":"svc:a","created":true,"ttl":null,"expiresAt":null}`,
+			call:     "PutLeased worker lease-id",
+		},
+		{
+			name:   "Put a key under a lost lease",
+			method: "PUT",
+			path:   "/v1/keys/svc:a",
+			body:   `{"value":"v","lease":"worker","leaseId":"other"}`,
+			status: http.StatusNotFound,
+			code:   CodeLeaseNotFound,
+			call:   "PutLeased worker other",
+		},
+		{
+			name:   "Put a key under a lease with a ttl",
+			method: "PUT",
+			path:   "/v1/keys/svc:a",
+			body:   `{"value":"v","ttl":10,"lease":"worker","leaseId":"lease-id"}`,
+			status: http.StatusBadRequest,
+			code:   CodeValidationFailed,
+		},
+		{
+			name:   "Put a key under a lease without its id",
+			method: "PUT",
+			path:   "/v1/keys/svc:a",
+			body:   `{"value":"v","lease":"worker"}`,
+			status: http.StatusBadRequest,
+			code:   CodeValidationFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{leaseID: "lease-id", leaseHeld: tt.leaseHeld, leaseDeleted: 2}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response struct {
+				Data  json.RawMessage `json:"data"`
+				Error *apiError       `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+			if tt.expected != "" && string(response.Data) != tt.expected {
+				t.Errorf("data = %s; want %s", response.Data, tt.expected)
+			}
+
+			var calls []string
+			for _, c := range db.leaseCalls {
+				calls = append(calls, c.method+" "+c.name+" "+c.id)
+			}
+			if tt.call == "" && len(calls) != 0 || tt.call != "" && !slices.Equal(calls, []string{tt.call}) {
+				t.Errorf("lease calls = %v; want %v", calls, tt.call)
+			}
+		})
+	}
+}
+
+func TestWrapper_webhooks(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "Register a key webhook", method: "POST", path: "/v1/admin/webhooks", body: `{"url":"http://localhost/hook","prefix":"a:","types":["created"]}`, status: http.StatusCreated},
+		{name: "Register a channel webhook", method: "POST", path: "/v1/admin/webhooks", body: `{"url":"https://localhost/hook","channel":"news"}`, status: http.StatusCreated},
+		{name: "Register without a url", method: "POST", path: "/v1/admin/webhooks", body: `{"prefix":"a:"}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Register a url that is not http", method: "POST", path: "/v1/admin/webhooks", body: `{"url":"ftp://localhost/hook"}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Register an unknown event type", method: "POST", path: "/v1/admin/webhooks", body: `{"url":"http://localhost/hook","types":["renamed"]}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Register a channel with a prefix", method: "POST", path: "/v1/admin/webhooks", body: `{"url":"http://localhost/hook","channel":"news","prefix":"a:"}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Delete an unknown webhook", method: "DELETE", path: "/v1/admin/webhooks/missing", status: http.StatusNotFound, code: CodeWebhookNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v: %v", w.Code, tt.status, w.Body)
+			}
+			var response struct {
+				Error *apiError `json:"error"`
+			}
+			_ = json.NewDecoder(w.Body).Decode(&response)
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+		})
+	}
+
+	t.Run("Deliveries", func(t *testing.T) {
+		// The receiver fails the first attempt of every delivery so that each one is retried
+		type delivery struct {
+			payload   webhookPayload
+			signature string
+		}
+		deliveries := make(chan delivery, 10)
+		var mu sync.Mutex
+		attempts := map[string]int{}
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			attempts[string(body)]++
+			first := attempts[string(body)] == 1
+			mu.Unlock()
+			if first {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var d delivery
+			_ = json.Unmarshal(body, &d.payload)
+			d.signature = r.Header.Get(SignatureHeader)
+			if d.signature != signWebhook("secret", body) {
+				t.Errorf("signature = %v; want the HMAC of the body", d.signature)
+			}
+			deliveries <- d
+		}))
+		defer receiver.Close()
+
+		now := time.Now()
+		db := &databaseTestImplementation{events: []struct {
+			Type string
+			Key  string
+			Time time.Time
+		}{
+			{Type: "created", Key: "a:1", Time: now},
+			{Type: "created", Key: "_idempotency/a", Time: now},
+			{Type: "updated", Key: "a:1", Time: now},
+			{Type: "deleted", Key: "a:1", Time: now},
+		}}
+		h := NewHandler(db, slog.New(slog.DiscardHandler), WithWebhookRetries(2, time.Millisecond))
+		register := func(body string) webhookResponse {
+			t.Helper()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/admin/webhooks", strings.NewReader(body)))
+			var response struct {
+				Data webhookResponse `json:"data"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusCreated {
+				t.Fatalf("register status = %v, error = %v", w.Code, err)
+			}
+			return response.Data
+		}
+		keys := register(`{"url":"` + receiver.URL + `","secret":"secret","prefix":"a:","types":["created","deleted"]}`)
+		if !keys.Signed || keys.Prefix != "a:" {
+			t.Errorf("registered %+v; want a signed webhook for the prefix", keys)
+		}
+		if len(db.eventsCalls) != 1 || db.eventsCalls[0].prefix != "a:" {
+			t.Errorf("event subscriptions = %v; want one for a:", db.eventsCalls)
+		}
+		channel := register(`{"url":"` + receiver.URL + `","secret":"secret","channel":"news"}`)
+
+		next := func() webhookPayload {
+			t.Helper()
+			select {
+			case d := <-deliveries:
+				return d.payload
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for a webhook delivery")
+				return webhookPayload{}
+			}
+		}
+		if p := next(); p.Webhook != keys.ID || p.Type != "created" || p.Key != "a:1" {
+			t.Errorf("first delivery = %+v; want the creation of a:1", p)
+		}
+		if p := next(); p.Type != "deleted" || p.Key != "a:1" {
+			t.Errorf("second delivery = %+v; want the deletion of a:1", p)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/publish/news", strings.NewReader(`{"message":"hello"}`)))
+		if p := next(); p.Webhook != channel.ID || p.Type != "published" || p.Channel != "news" || p.Message != "hello" {
+			t.Errorf("channel delivery = %+v; want the published message", p)
+		}
+
+		// Deliveries are counted once the receiver has responded
+		deadline := time.Now().Add(time.Second)
+		for testutil.ToFloat64(h.m.dbWebhookDeliveries.WithLabelValues("delivered")) != 3 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := testutil.ToFloat64(h.m.dbWebhookDeliveries.WithLabelValues("delivered")); got != 3 {
+			t.Errorf("delivered metric = %v; want 3", got)
+		}
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/webhooks", nil))
+		var list struct {
+			Data webhooksResponse `json:"data"`
+		}
+		_ = json.NewDecoder(w.Body).Decode(&list)
+		if len(list.Data.Webhooks) != 2 {
+			t.Errorf("listed %v webhooks; want 2", len(list.Data.Webhooks))
+		}
+
+		// Deleted webhooks receive nothing more
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/admin/webhooks/"+channel.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("delete status = %v; want %v", w.Code, http.StatusOK)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/publish/news", strings.NewReader(`{"message":"late"}`)))
+		select {
+		case d := <-deliveries:
+			t.Errorf("deleted webhook received %+v", d.payload)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2025, time.January, 31, 10, 30, 20, 0, time.UTC) // A Friday
+	tests := []struct {
+		name     string
+		expr     string
+		expected time.Time // The first run after from, or the zero time if the expression is invalid
+	}{
+		{name: "Every minute", expr: "* * * * *", expected: time.Date(2025, time.January, 31, 10, 31, 0, 0, time.UTC)},
+		{name: "Minute step", expr: "*/15 * * * *", expected: time.Date(2025, time.January, 31, 10, 45, 0, 0, time.UTC)},
+		{name: "List and range", expr: "0 8-9,12 * * *", expected: time.Date(2025, time.January, 31, 12, 0, 0, 0, time.UTC)},
+		{name: "Next month", expr: "0 0 1 * *", expected: time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "Day of week", expr: "0 9 * * 1", expected: time.Date(2025, time.February, 3, 9, 0, 0, 0, time.UTC)},
+		{name: "Sunday as 7", expr: "0 9 * * 7", expected: time.Date(2025, time.February, 2, 9, 0, 0, 0, time.UTC)},
+		{name: "Either day field", expr: "0 0 15 * 6", expected: time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "Leap day", expr: "0 0 29 2 *", expected: time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{name: "Descriptor", expr: "@hourly", expected: time.Date(2025, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{name: "Every duration", expr: "@every 90s", expected: from.Add(90 * time.Second)},
+		{name: "Too short an interval", expr: "@every 10ms"},
+		{name: "Too few fields", expr: "* * * *"},
+		{name: "Out of range", expr: "60 * * * *"},
+		{name: "Backwards range", expr: "* 5-1 * * *"},
+		{name: "Zero step", expr: "*/0 * * * *"},
+		{name: "Never matches", expr: "0 0 31 2 *"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if tt.expected.IsZero() {
+				if err == nil {
+					t.Errorf("parseCron(%q) succeeded; want an error", tt.expr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCron(%q) error = %v", tt.expr, err)
+			}
+			if next := c.next(from); !next.Equal(tt.expected) {
+				t.Errorf("next run = %v; want %v", next, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrapper_schedules(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "Schedule a publication", method: "POST", path: "/v1/admin/schedules", body: `{"cron":"@hourly","publish":{"channel":"heartbeat","message":"alive"}}`, status: http.StatusCreated},
+		{name: "Schedule a write", method: "POST", path: "/v1/admin/schedules", body: `{"cron":"*/5 * * * *","put":{"key":"warm","value":"v","ttl":60}}`, status: http.StatusCreated},
+		{name: "Schedule without an action", method: "POST", path: "/v1/admin/schedules", body: `{"cron":"@hourly"}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Schedule both actions", method: "POST", path: "/v1/admin/schedules", body: `{"cron":"@hourly","publish":{"channel":"c","message":"m"},"put":{"key":"k","value":"v"}}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Schedule an invalid cron expression", method: "POST", path: "/v1/admin/schedules", body: `{"cron":"every hour","publish":{"channel":"c","message":"m"}}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Schedule a write to an invalid key", method: "POST", path: "/v1/admin/schedules", body: `{"cron":"@hourly","put":{"key":"` + strings.Repeat("k", DefaultMaxKeyLength+1) + `","value":"v"}}`, status: http.StatusBadRequest, code: CodeValidationFailed},
+		{name: "Delete an unknown schedule", method: "DELETE", path: "/v1/admin/schedules/missing", status: http.StatusNotFound, code: CodeScheduleNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &databaseTestImplementation{}
+			h := NewHandler(db, slog.New(slog.DiscardHandler))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v: %v", w.Code, tt.status, w.Body)
+			}
+			var response struct {
+				Data  scheduleResponse `json:"data"`
+				Error *apiError        `json:"error"`
+			}
+			_ = json.NewDecoder(w.Body).Decode(&response)
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+
+			// Registered schedules are persisted under the internal namespace
+			if tt.status == http.StatusCreated {
+				if len(db.putCalls) != 1 || db.putCalls[0].key != schedulePrefix+response.Data.ID {
+					t.Errorf("put calls = %v; want the schedule to be persisted", db.putCalls)
+				}
+				if response.Data.NextRun.Before(time.Now()) {
+					t.Errorf("next run = %v; want a time in the future", response.Data.NextRun)
+				}
+			}
+		})
+	}
+
+	t.Run("Run schedules", func(t *testing.T) {
+		defer func(d time.Duration) { minScheduleInterval = d }(minScheduleInterval)
+		minScheduleInterval = 10 * time.Millisecond
+
+		// A schedule persisted by a previous run is loaded when the scheduler starts
+		persisted, _ := json.Marshal(scheduleRecord{ID: "old", Cron: "@every 10ms", Put: &schedulePut{Key: "warm", Value: "v"}})
+		db := &databaseTestImplementation{scanEntries: []struct {
+			Key   string
+			Value string
+			Ttl   *int64
+		}{{Key: schedulePrefix + "old", Value: string(persisted)}}}
+		h := NewHandler(db, slog.New(slog.DiscardHandler))
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.RunScheduler(ctx)
+		}()
+
+		req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/v1/subscribe/heartbeat", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/admin/schedules", strings.NewReader(`{"cron":"@every 10ms","publish":{"channel":"heartbeat","message":"alive"}}`)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("register status = %v; want %v", w.Code, http.StatusCreated)
+		}
+		reader := bufio.NewReader(resp.Body)
+		for i := 0; i < 2; i++ {
+			line, err := reader.ReadString('\n')
+			for err == nil && !strings.HasPrefix(line, "data: ") {
+				line, err = reader.ReadString('\n')
+			}
+			if err != nil || strings.TrimSpace(line) != "data: alive" {
+				t.Fatalf("heartbeat %v = %q, %v; want alive", i, line, err)
+			}
+		}
+
+		cancel()
+		<-done
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		var writes int
+		for _, c := range db.putCalls {
+			if c.key == "warm" {
+				writes++
+			}
+		}
+		if writes == 0 {
+			t.Error("the persisted schedule did not write its key")
+		}
+	})
+}
+
+func TestWrapper_mirrorMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		mirror   mirrorStats
+		expected []string // Lines expected in the scraped metrics
+		absent   bool     // Whether the mirror metrics should not be registered
+	}{
+		{
+			name:   "Mirroring",
+			mirror: mirrorStats{Enabled: true, Pending: 4, Applied: 10, Failed: 2, Dropped: 1, Lag: 1500 * time.Millisecond},
+			expected: []string{
+				"db_mirror_pending 4",
+				"db_mirror_lag_seconds 1.5",
+				"db_mirror_applied_total 10",
+				"db_mirror_failed_total 2",
+				"db_mirror_dropped_total 1",
+			},
+		},
+		{
+			name:   "Not mirroring",
+			absent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&databaseTestImplementation{mirror: tt.mirror}, slog.New(slog.DiscardHandler))
+			rr := httptest.NewRecorder()
+			h.router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			body := rr.Body.String()
+
+			for _, line := range tt.expected {
+				if !strings.Contains(body, "\n"+line+"\n") {
+					t.Errorf("expected metrics to contain %q", line)
+				}
+			}
+			if tt.absent && strings.Contains(body, "db_mirror_") {
+				t.Errorf("expected no mirror metrics, got %v", body)
+			}
+		})
+	}
+}
+
+func TestWrapper_persistenceMetrics(t *testing.T) {
+	db := &databaseTestImplementation{persistence: map[string]persistenceStats{
+		"aof": {Enabled: true, LastSuccess: time.Unix(1700000000, 500_000_000), LastDuration: 250 * time.Millisecond, Failures: 2,
+			Failing: true, FailedWrites: 4, FreeDiskBytes: 1 << 20, StalledWrites: 3, StallTime: 1500 * time.Millisecond, RejectedWrites: 1},
+	}}
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+	rr := httptest.NewRecorder()
+	h.router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+
+	for _, line := range []string{
+		`db_persistence_last_success_timestamp_seconds{kind="aof"} 1.7000000005e+09`,
+		`db_persistence_last_duration_seconds{kind="aof"} 0.25`,
+		`db_persistence_consecutive_failures{kind="aof"} 2`,
+		`db_persistence_failing{kind="aof"} 1`,
+		`db_persistence_failed_writes_total{kind="aof"} 4`,
+		`db_persistence_disk_free_bytes{kind="aof"} 1.048576e+06`,
+		`db_persistence_write_stall_seconds_total{kind="aof"} 1.5`,
+		`db_persistence_stalled_writes_total{kind="aof",outcome="waited"} 3`,
+		`db_persistence_stalled_writes_total{kind="aof",outcome="rejected"} 1`,
+		`db_persistence_stalled_writes_total{kind="aof",outcome="buffered"} 0`,
+	} {
+		if !strings.Contains(body, "\n"+line+"\n") {
+			t.Errorf("expected metrics to contain %q", line)
+		}
+	}
+	if strings.Contains(body, `kind="snapshot"`) {
+		t.Errorf("expected no metrics for snapshots, which are disabled, got %v", body)
+	}
+}
+
+func TestWrapper_origin(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   map[string]string
+		value    string
+		found    bool
+		err      error
+		status   int
+		code     string
+		expected string // The value in the response
+		calls    int    // Fetches expected from the origin
+	}{
+		{name: "Stored keys are not fetched", stored: map[string]string{"k": "local"}, status: http.StatusOK, expected: "local"},
+		{name: "Fetch a missing key", value: "remote", found: true, status: http.StatusOK, expected: "remote", calls: 1},
+		{name: "Missing from the origin", status: http.StatusNotFound, code: CodeKeyNotFound, calls: 1},
+		{name: "Origin failure", err: errors.New("connection refused"), status: http.StatusBadGateway, code: CodeOriginFailed, calls: 1},
+		{name: "Value over the maximum length is served without storing it", value: strings.Repeat("x", 200), found: true, status: http.StatusOK, expected: strings.Repeat("x", 200), calls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &kvTestImplementation{entries: map[string]string{}}
+			maps.Copy(db.entries, tt.stored)
+			calls := 0
+			h := NewHandler(db, slog.New(slog.DiscardHandler), WithMaxValueLength(128), WithOrigin(func(ctx context.Context, key string) (string, bool, error) {
+				calls++
+				return tt.value, tt.found, tt.err
+			}, 60))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/keys/k", nil))
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response envelope
+			var data getResponse
+			response.Data = &data
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+			if data.Value != tt.expected {
+				t.Errorf("value = %q; want %q", data.Value, tt.expected)
+			}
+			if calls != tt.calls {
+				t.Errorf("origin calls = %v; want %v", calls, tt.calls)
+			}
+
+			stored, ok := db.entries["k"]
+			if wantStored := tt.found && len(tt.value) <= 128; wantStored && stored != tt.value {
+				t.Errorf("stored value = %q, %v; want %q", stored, ok, tt.value)
+			} else if !wantStored && tt.stored == nil && ok {
+				t.Errorf("stored value = %q; want nothing stored", stored)
+			}
+		})
+	}
+
+	t.Run("Concurrent requests share a fetch", func(t *testing.T) {
+		db := &kvTestImplementation{entries: map[string]string{}}
+		var calls atomic.Int32
+		release := make(chan struct{})
+		h := NewHandler(db, slog.New(slog.DiscardHandler), WithOrigin(func(ctx context.Context, key string) (string, bool, error) {
+			calls.Add(1)
+			<-release
+			return "remote", true, nil
+		}, 0))
+
+		// Requests that arrive after the fetch find the stored value, so the origin is asked once however they interleave
+		var wg sync.WaitGroup
+		codes := make([]int, 10)
+		for i := range codes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/keys/k", nil))
+				codes[i] = w.Code
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if n := calls.Load(); n != 1 {
+			t.Errorf("origin calls = %v; want 1", n)
+		}
+		for _, code := range codes {
+			if code != http.StatusOK {
+				t.Errorf("response codes = %v; want all %v", codes, http.StatusOK)
+				break
+			}
+		}
+	})
+}
+
+// slowReadTestImplementation counts reads and holds each one until release is closed, so that concurrent requests
+// overlap
+type slowReadTestImplementation struct {
+	kvTestImplementation
+	reads   atomic.Int32
+	release chan struct{}
+}
+
+func (db *slowReadTestImplementation) GetEntry(key string) (struct {
+	Value     string
+	UpdatedAt time.Time
+	Version   uint64
+}, bool) {
+	db.reads.Add(1)
+	<-db.release
+	return db.kvTestImplementation.GetEntry(key)
+}
+
+func (db *slowReadTestImplementation) GetTTL(key string) (*int64, bool) {
+	db.reads.Add(1)
+	<-db.release
+	ttl := int64(60)
+	return &ttl, true
+}
+
+func TestWrapper_readCoalescing(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Options
+		path     string
+		op       string
+		coalesce bool
+	}{
+		{name: "Get", opts: []Options{WithReadCoalescing()}, path: "/v1/keys/k", op: "get", coalesce: true},
+		{name: "TTL", opts: []Options{WithReadCoalescing()}, path: "/v1/ttl/k", op: "ttl", coalesce: true},
+		{name: "Disabled", path: "/v1/keys/k", op: "get"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &slowReadTestImplementation{kvTestImplementation: kvTestImplementation{entries: map[string]string{"k": "v"}}, release: make(chan struct{})}
+			h := NewHandler(db, slog.New(slog.DiscardHandler), tt.opts...)
+
+			const requests = 10
+			var wg sync.WaitGroup
+			codes := make([]int, requests)
+			for i := range codes {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+					codes[i] = w.Code
+				}()
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(db.release)
+			wg.Wait()
+
+			for _, code := range codes {
+				if code != http.StatusOK {
+					t.Fatalf("response codes = %v; want all %v", codes, http.StatusOK)
+				}
+			}
+			reads := int(db.reads.Load())
+			coalesced := int(testutil.ToFloat64(h.m.dbCoalescedRequests.WithLabelValues(tt.op)))
+			if tt.coalesce && (reads+coalesced != requests || coalesced == 0) {
+				t.Errorf("%v reads and %v coalesced requests; want some of the %v requests coalesced", reads, coalesced, requests)
+			}
+			if !tt.coalesce && (reads != requests || coalesced != 0) {
+				t.Errorf("%v reads and %v coalesced requests; want a read for each of the %v requests", reads, coalesced, requests)
+			}
+		})
+	}
+}
+
+func TestWrapper_routeTimeouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Options
+		method string
+		path   string
+		status int
+		code   string
+	}{
+		{name: "Read over its deadline", opts: []Options{WithRouteTimeout(RouteRead, 20*time.Millisecond)}, method: "GET", path: "/v1/keys/missing", status: http.StatusGatewayTimeout, code: CodeTimeout},
+		{name: "Read within its deadline", opts: []Options{WithRouteTimeout(RouteRead, time.Second)}, method: "GET", path: "/v1/keys/k", status: http.StatusOK},
+		{name: "Deadline of another class", opts: []Options{WithRouteTimeout(RouteWrite, 20*time.Millisecond)}, method: "GET", path: "/v1/keys/k", status: http.StatusOK},
+		{name: "Handler error within its deadline", opts: []Options{WithRouteTimeout(RouteWrite, time.Second)}, method: "DELETE", path: "/v1/keys/missing", status: http.StatusNotFound, code: CodeKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &kvTestImplementation{entries: map[string]string{"k": "v"}}
+			release := make(chan struct{})
+			defer close(release)
+			opts := append([]Options{WithOrigin(func(ctx context.Context, key string) (string, bool, error) {
+				<-release
+				return "", false, nil
+			}, 0)}, tt.opts...)
+			h := NewHandler(db, slog.New(slog.DiscardHandler), opts...)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response envelope
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+			timeouts := testutil.ToFloat64(h.m.dbRouteTimeouts.WithLabelValues(RouteRead))
+			if want := tt.code == CodeTimeout; (timeouts == 1) != want {
+				t.Errorf("read timeouts = %v; want a timeout %v", timeouts, want)
+			}
+		})
+	}
+}
+
+func TestWrapper_circuitBreaker(t *testing.T) {
+	db := &kvTestImplementation{entries: map[string]string{}}
+	var failing atomic.Bool
+	failing.Store(true)
+	h := NewHandler(db, slog.New(slog.DiscardHandler), WithCircuitBreaker(2, 50*time.Millisecond),
+		WithOrigin(func(ctx context.Context, key string) (string, bool, error) {
+			if failing.Load() {
+				return "", false, errors.New("connection refused")
+			}
+			return "remote", true, nil
+		}, 0))
+
+	steps := []struct {
+		name   string
+		wait   time.Duration // How long to wait before the request
+		method string
+		status int
+	}{
+		{name: "First failure", method: "GET", status: http.StatusBadGateway},
+		{name: "Second failure opens the circuit", method: "GET", status: http.StatusBadGateway},
+		{name: "Rejected while open", method: "GET", status: http.StatusServiceUnavailable},
+		{name: "Other classes are unaffected", method: "DELETE", status: http.StatusNotFound},
+		{name: "Failed probe reopens the circuit", wait: 60 * time.Millisecond, method: "GET", status: http.StatusBadGateway},
+		{name: "Rejected after the failed probe", method: "GET", status: http.StatusServiceUnavailable},
+		{name: "Successful probe closes the circuit", wait: 60 * time.Millisecond, method: "GET", status: http.StatusOK},
+		{name: "Closed", method: "GET", status: http.StatusOK},
+	}
+	for i, step := range steps {
+		time.Sleep(step.wait)
+		if i == 6 {
+			failing.Store(false)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(step.method, "/v1/keys/k", nil))
+		if w.Code != step.status {
+			t.Fatalf("%v: response code = %v; want %v", step.name, w.Code, step.status)
+		}
+		if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%v: no Retry-After header", step.name)
+		}
+	}
+	if rejections := testutil.ToFloat64(h.m.dbCircuitRejections.WithLabelValues(RouteRead)); rejections != 2 {
+		t.Errorf("read rejections = %v; want 2", rejections)
+	}
+}
+
+func TestBreaker_halfOpen(t *testing.T) {
+	var b breaker
+	now := time.Now()
+	if !b.record(true, now, 1, time.Second) {
+		t.Fatal("record() = false; want the circuit to open")
+	}
+	if ok, wait := b.allow(now.Add(500 * time.Millisecond)); ok || wait != 500*time.Millisecond {
+		t.Errorf("allow() during the cooldown = %v, %v; want false, 500ms", ok, wait)
+	}
+	if ok, _ := b.allow(now.Add(2 * time.Second)); !ok {
+		t.Error("allow() after the cooldown = false; want the probe let through")
+	}
+	if ok, _ := b.allow(now.Add(2 * time.Second)); ok {
+		t.Error("allow() while probing = true; want false")
+	}
+}
+
+func TestWriteLanes_weightedScheduling(t *testing.T) {
+	depth := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "depth"}, []string{"lane"})
+	l := newWriteLanes(1, 2, depth)
+	if _, ok := l.enqueue(LaneClient); !ok {
+		t.Fatal("enqueue() with a free slot = false; want the request admitted")
+	}
+
+	waiting := map[string]chan struct{}{}
+	for _, name := range []string{"c1", "c2", "p1", "p2", "p3"} {
+		lane := LaneClient
+		if name[0] == 'p' {
+			lane = LanePriority
+		}
+		admit, ok := l.enqueue(lane)
+		if ok {
+			t.Fatalf("enqueue(%v) without a free slot = true; want it to wait", name)
+		}
+		waiting[name] = admit
+	}
+	if got := testutil.ToFloat64(depth.WithLabelValues(LanePriority)); got != 3 {
+		t.Errorf("priority lane depth = %v; want 3", got)
+	}
+
+	// Two priority requests go first, then a client write is let through before the next priority request
+	for _, want := range []string{"p1", "p2", "c1", "p3", "c2"} {
+		l.release()
+		select {
+		case <-waiting[want]:
+		default:
+			t.Fatalf("release() did not admit %v", want)
+		}
+		delete(waiting, want)
+		for name, admit := range waiting {
+			select {
+			case <-admit:
+				t.Fatalf("release() admitted %v before %v", name, want)
+			default:
+			}
+		}
+	}
+	l.release()
+	if _, ok := l.enqueue(LaneClient); !ok {
+		t.Error("enqueue() once every request finished = false; want the request admitted")
+	}
+}
+
+func TestWrapper_writeLanes(t *testing.T) {
+	started, finish := make(chan struct{}), make(chan struct{})
+	h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler), WithWriteLanes(1, 1), WithAdminToken("secret"),
+		WithRoute("POST", "/v1/app/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-finish
+			writeJSON(w, http.StatusOK, nil)
+		})))
+
+	lanes := []struct {
+		name   string
+		method string
+		path   string
+		header string // The Write-Priority header
+		auth   string // The Authorization header
+		lane   string
+	}{
+		{name: "Client write", method: "PUT", path: "/v1/keys/k", lane: LaneClient},
+		{name: "Admin request", method: "GET", path: "/v1/admin/info", lane: LanePriority},
+		{name: "Authorized priority write", method: "PUT", path: "/v1/keys/k", header: "high", auth: "Bearer secret", lane: LanePriority},
+		{name: "Unauthorized priority write", method: "PUT", path: "/v1/keys/k", header: "high", lane: LaneClient},
+		{name: "Read", method: "GET", path: "/v1/keys/k", lane: ""},
+	}
+	for _, tt := range lanes {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.header != "" {
+			r.Header.Set(WritePriorityHeader, tt.header)
+		}
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if got := h.writeLane(r, routeClass(r)); got != tt.lane {
+			t.Errorf("%v: writeLane() = %q; want %q", tt.name, got, tt.lane)
+		}
+	}
+
+	// A write that gives up waiting for the slot held by the slow request is answered without running
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/app/slow", nil))
+		done <- w.Code
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/keys/k", nil).WithContext(ctx))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("response code of the abandoned write = %v; want %v", w.Code, http.StatusServiceUnavailable)
+	}
+	var response envelope
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || response.Error == nil || response.Error.Code != CodeWriteQueueTimeout {
+		t.Errorf("error = %v; want code %v", response.Error, CodeWriteQueueTimeout)
+	}
+	if depth := testutil.ToFloat64(h.m.dbWriteQueueDepth.WithLabelValues(LaneClient)); depth != 0 {
+		t.Errorf("client lane depth after the write gave up = %v; want 0", depth)
+	}
+
+	// Reads do not wait for a slot
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/ttl/k", nil))
+	if w.Code == http.StatusServiceUnavailable {
+		t.Error("read waited for a write slot")
+	}
+
+	close(finish)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("response code of the slow request = %v; want %v", code, http.StatusOK)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/keys/k", nil))
+	if w.Code == http.StatusServiceUnavailable {
+		t.Error("write after the slot was released gave up waiting")
+	}
+}
+
+func TestWrapper_admin(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Options
+		path       string
+		auth       string // The Authorization header, if any
+		status     int
+		code       string
+		authorized string // The authorized attribute of the audit record. Empty if none is expected.
+	}{
+		{name: "Open without a token", path: "/v1/admin/info", status: http.StatusOK, authorized: "true"},
+		{name: "Valid token", opts: []Options{WithAdminToken("secret")}, path: "/v1/admin/info", auth: "Bearer secret", status: http.StatusOK, authorized: "true"},
+		{name: "Missing token", opts: []Options{WithAdminToken("secret")}, path: "/v1/admin/info", status: http.StatusUnauthorized, code: CodeUnauthorized, authorized: "false"},
+		{name: "Wrong token", opts: []Options{WithAdminToken("secret")}, path: "/v1/admin/info", auth: "Bearer guess", status: http.StatusUnauthorized, code: CodeUnauthorized, authorized: "false"},
+		{name: "Not a bearer token", opts: []Options{WithAdminToken("secret")}, path: "/v1/admin/info", auth: "Basic secret", status: http.StatusUnauthorized, code: CodeUnauthorized, authorized: "false"},
+		{name: "Other routes need no token", opts: []Options{WithAdminToken("secret")}, path: "/v1/ttl/k", status: http.StatusNotFound, code: CodeKeyNotFound},
+		{name: "Disabled", opts: []Options{WithoutAdmin()}, path: "/v1/admin/info", auth: "Bearer secret", status: http.StatusNotFound, code: CodeRouteNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			h := NewHandler(&databaseTestImplementation{}, slog.New(slog.NewTextHandler(&logs, nil)), tt.opts...)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response envelope
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+
+			audited := strings.Contains(logs.String(), `msg="admin audit"`)
+			if audited != (tt.authorized != "") {
+				t.Errorf("audit record written = %v; want %v", audited, tt.authorized != "")
+			}
+			if want := fmt.Sprintf("authorized=%v status=%v", tt.authorized, tt.status); audited && !strings.Contains(logs.String(), want) {
+				t.Errorf("audit record does not contain %q:\n%v", want, logs.String())
+			}
+		})
+	}
+}
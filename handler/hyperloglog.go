@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// HyperLogLogs use 2^14 registers like Redis, for a standard error of 0.81%
+const (
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+	hllSparseMax = 3000 // The length of the sparse encoding over which the dense encoding is used
+)
+
+// Encodings of the registers of a HyperLogLog, which follow hllMagic
+const (
+	hllDense  byte = 0 // One byte per register
+	hllSparse byte = 1 // Three bytes per non-zero register, its big-endian index and its value, by increasing index
+)
+
+// hllMagic starts every HyperLogLog so that other values are not mistaken for one
+var hllMagic = []byte("HYLL")
+
+// Errors returned from the update of a HyperLogLog to leave the stored value unchanged
+var (
+	errNotHyperLogLog      = errors.New("the stored value is not a HyperLogLog")
+	errHyperLogLogTooLarge = errors.New("the HyperLogLog would be over the maximum value length")
+)
+
+type hyperLogLogAddRequest struct {
+	Members []string `json:"members" validate:"required,min=1,max=1000"`
+}
+
+type hyperLogLogAddResponse struct {
+	Key     string `json:"key"`
+	Updated bool   `json:"updated"` // Whether the estimated count may have changed, like the result of PFADD
+}
+
+type hyperLogLogCountResponse struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"` // The estimated number of distinct members
+}
+
+// decodeHyperLogLog decodes the registers of a HyperLogLog stored as standard base64, so that it survives snapshots
+// and the AOF like any other value
+func decodeHyperLogLog(value string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(b) <= len(hllMagic) || !bytes.HasPrefix(b, hllMagic) {
+		return nil, errNotHyperLogLog
+	}
+
+	encoding, b := b[len(hllMagic)], b[len(hllMagic)+1:]
+	registers := make([]byte, hllRegisters)
+	switch {
+	case encoding == hllDense && len(b) == hllRegisters:
+		copy(registers, b)
+	case encoding == hllSparse && len(b)%3 == 0:
+		for n := 0; n < len(b); n += 3 {
+			index := binary.BigEndian.Uint16(b[n:])
+			if index >= hllRegisters {
+				return nil, errNotHyperLogLog
+			}
+			registers[index] = b[n+2]
+		}
+	default:
+		return nil, errNotHyperLogLog
+	}
+	return registers, nil
+}
+
+// encodeHyperLogLog encodes the registers of a HyperLogLog, sparsely while few registers are set
+func encodeHyperLogLog(registers []byte) string {
+	b := append(bytes.Clone(hllMagic), hllSparse)
+	for index, r := range registers {
+		if r == 0 {
+			continue
+		}
+		if len(b) > hllSparseMax {
+			b = append(append(bytes.Clone(hllMagic), hllDense), registers...)
+			break
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(index))
+		b = append(b, r)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// hllHash hashes a member, mixing the bits of its FNV-1a hash with the finalizer of MurmurHash3 so that the register
+// index and the run of zeros are independent
+func hllHash(member string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(member))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hllAdd adds a member to the registers, returning whether a register changed
+func hllAdd(registers []byte, member string) bool {
+	x := hllHash(member)
+	index := x >> (64 - hllPrecision)
+	rank := byte(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank <= registers[index] {
+		return false
+	}
+	registers[index] = rank
+	return true
+}
+
+// hllCount estimates the number of distinct members added to the registers, using linear counting while registers
+// are still empty as the raw estimate is biased for small counts
+func hllCount(registers []byte) uint64 {
+	const m = float64(hllRegisters)
+	sum, zeros := 0.0, 0
+	for _, r := range registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// addHyperLogLogHandler adds the members of the request body to the HyperLogLog stored under the request key, like
+// PFADD. Keys that don't exist are created as an empty HyperLogLog without a ttl. The members are added atomically by
+// the database, so concurrent additions are never lost.
+func (h *Wrapper) addHyperLogLogHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if err := h.validate.Var(key, "dbkey"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing HyperLogLog key: %v", err))
+		return
+	}
+
+	var rData hyperLogLogAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing HyperLogLog add request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing HyperLogLog add request: %v", err))
+		return
+	}
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+
+	var updated bool
+	_, err := h.db.Upsert(key, func(value string, exists bool) (string, error) {
+		registers := make([]byte, hllRegisters)
+		if exists {
+			var err error
+			if registers, err = decodeHyperLogLog(value); err != nil {
+				return "", err
+			}
+		}
+
+		updated = !exists
+		for _, member := range rData.Members {
+			if hllAdd(registers, member) {
+				updated = true
+			}
+		}
+		if !updated {
+			return value, nil
+		}
+		encoded := encodeHyperLogLog(registers)
+		if h.validate.Var(encoded, "dbvalue") != nil {
+			return "", errHyperLogLogTooLarge
+		}
+		return encoded, nil
+	})
+	switch {
+	case errors.Is(err, errNotHyperLogLog):
+		writeJSONError(w, http.StatusConflict, CodeValueNotHLL, "Cannot add to "+key+": "+err.Error())
+	case errors.Is(err, errHyperLogLogTooLarge):
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, err.Error())
+	case err != nil:
+		h.writeFailed(w, key, err)
+	default:
+		writeJSON(w, http.StatusOK, hyperLogLogAddResponse{Key: key, Updated: updated})
+	}
+}
+
+// countHyperLogLogHandler returns the estimated number of distinct members added to the HyperLogLog stored under the
+// request key, like PFCOUNT. Keys that don't exist count 0.
+func (h *Wrapper) countHyperLogLogHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+	entry, loaded := h.getEntry(key)
+	if !loaded {
+		writeJSON(w, http.StatusOK, hyperLogLogCountResponse{Key: key})
+		return
+	}
+	registers, err := decodeHyperLogLog(entry.Value)
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, CodeValueNotHLL, "Cannot count "+key+": "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, hyperLogLogCountResponse{Key: key, Count: hllCount(registers)})
+}
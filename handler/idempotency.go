@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header that makes a POST safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyTTL is how long the result of a POST with an idempotency key is remembered
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the length of an idempotency key
+const maxIdempotencyKeyLength = 255
+
+// idempotencyPrefix is the internal namespace that idempotency records are stored under. The slash keeps the records
+// out of reach of the key routes, and keys with the prefix are rejected from clients and hidden from scans.
+const idempotencyPrefix = "_idempotency/"
+
+// idempotencyRecord is stored as the value of an idempotency key. The key is empty while the request that claimed
+// the idempotency key is still being handled.
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"` // A hash of the request, so that reuse with a different request is caught
+	Key         string `json:"key"`         // The key that was created
+}
+
+// fingerprint returns a hash of a post request
+func (r postRequest) fingerprint() string {
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyRecordKey returns the key that the record of an idempotency key is stored under. Idempotency keys are
+// hashed so that the stored key has a fixed length regardless of the limits on keys.
+func idempotencyRecordKey(idempotencyKey string) string {
+	sum := sha256.Sum256([]byte(idempotencyKey))
+	return idempotencyPrefix + hex.EncodeToString(sum[:])
+}
+
+// internalPrefixes are the namespaces that the handler manages itself
+var internalPrefixes = []string{idempotencyPrefix, registryPrefix, schedulePrefix, rateLimitPrefix}
+
+// isInternalKey reports whether a key belongs to a namespace the handler manages itself
+func isInternalKey(key string) bool {
+	return slices.ContainsFunc(internalPrefixes, func(p string) bool { return strings.HasPrefix(key, p) })
+}
+
+// overlapsInternalKeys reports whether a key prefix matches any key in a namespace the handler manages itself, either
+// because it lies within the namespace or because the namespace starts with it
+func overlapsInternalKeys(prefix string) bool {
+	return slices.ContainsFunc(internalPrefixes, func(p string) bool {
+		return strings.HasPrefix(prefix, p) || strings.HasPrefix(p, prefix)
+	})
+}
+
+// claimIdempotencyKey stores a pending record for the idempotency key. If the key was already claimed, the existing
+// record is returned instead along with false. An error is returned if the record could not be stored.
+func (h *Wrapper) claimIdempotencyKey(idempotencyKey string, fingerprint string) (idempotencyRecord, bool, error) {
+	ttl := int64(h.s.idempotencyTTL.Seconds())
+	pending, _ := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+	data := struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: idempotencyRecordKey(idempotencyKey), Value: string(pending), Ttl: &ttl}
+	set, _, err := h.db.Create(data)
+	if err != nil || set {
+		return idempotencyRecord{}, set, err
+	}
+
+	// The record may have expired between the failed create and this read, in which case it is treated as pending
+	var existing idempotencyRecord
+	entry, loaded := h.db.GetEntry(data.Key)
+	if loaded {
+		_ = json.Unmarshal([]byte(entry.Value), &existing)
+	}
+	return existing, false, nil
+}
+
+// completeIdempotencyKey records the key created by the request that claimed the idempotency key
+func (h *Wrapper) completeIdempotencyKey(idempotencyKey string, fingerprint string, key string) {
+	ttl := int64(h.s.idempotencyTTL.Seconds())
+	done, _ := json.Marshal(idempotencyRecord{Fingerprint: fingerprint, Key: key})
+	h.db.Put(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: idempotencyRecordKey(idempotencyKey), Value: string(done), Ttl: &ttl})
+}
+
+// releaseIdempotencyKey forgets a claim whose request failed so that it can be retried
+func (h *Wrapper) releaseIdempotencyKey(idempotencyKey string) {
+	h.db.Delete(idempotencyRecordKey(idempotencyKey))
+}
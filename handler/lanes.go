@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The lanes that write and admin requests wait in for a write slot
+const (
+	LanePriority = "priority" // Admin requests and writes applied from another instance, e.g. by a mirror
+	LaneClient   = "client"   // Every other write
+)
+
+// WritePriorityHeader asks for a write to wait in the priority lane. Its only value is "high", and it is only honored
+// for requests that carry the admin token, if one is required.
+const WritePriorityHeader = "Write-Priority"
+
+// DefaultPriorityWeight is how many priority requests are admitted for every waiting client write
+const DefaultPriorityWeight = 4
+
+// WithWriteLanes lets at most limit write and admin requests run at once. The rest wait for a slot in one of two
+// lanes: the priority lane, for admin requests and writes sent with a Write-Priority: high header, and the client lane
+// for every other write. Waiting priority requests are admitted first, but a waiting client write is admitted after
+// every weight priority requests so that clients are slowed down rather than starved. This keeps replication and admin
+// operations responsive under a flood of client writes. Requests give up waiting at the deadline of their route class.
+// A limit of zero, the default, admits every request at once.
+func WithWriteLanes(limit int, weight int) Options {
+	return func(h *Wrapper) {
+		h.s.writeLaneLimit = limit
+		h.s.priorityWeight = max(weight, 1)
+	}
+}
+
+// writeLanes admits write and admin requests up to a limit, from the priority lane before the client lane
+type writeLanes struct {
+	mu      sync.Mutex
+	limit   int
+	weight  int
+	running int                        // Requests admitted and not yet finished
+	streak  int                        // Priority requests admitted in a row while client writes waited
+	waiting map[string][]chan struct{} // The requests waiting in each lane, oldest first. Closed once admitted.
+	depth   *prometheus.GaugeVec       // The number of requests waiting in each lane
+}
+
+func newWriteLanes(limit int, weight int, depth *prometheus.GaugeVec) *writeLanes {
+	return &writeLanes{limit: limit, weight: weight, waiting: map[string][]chan struct{}{}, depth: depth}
+}
+
+// enqueue admits a request of the lane if there is a free slot and nothing is waiting, and otherwise queues it,
+// returning the channel that is closed once it is admitted
+func (l *writeLanes) enqueue(lane string) (chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running < l.limit && len(l.waiting[LanePriority]) == 0 && len(l.waiting[LaneClient]) == 0 {
+		l.running++
+		return nil, true
+	}
+	admit := make(chan struct{})
+	l.waiting[lane] = append(l.waiting[lane], admit)
+	l.depth.WithLabelValues(lane).Set(float64(len(l.waiting[lane])))
+	return admit, false
+}
+
+// abandon removes a request that gave up waiting from its lane. It reports false if the request was admitted in the
+// meantime, in which case its slot must be released.
+func (l *writeLanes) abandon(lane string, admit chan struct{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := slices.Index(l.waiting[lane], admit)
+	if n < 0 {
+		return false
+	}
+	l.waiting[lane] = slices.Delete(l.waiting[lane], n, n+1)
+	l.depth.WithLabelValues(lane).Set(float64(len(l.waiting[lane])))
+	return true
+}
+
+// release hands the slot of a finished request to the next waiting request, or frees it if none is waiting
+func (l *writeLanes) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lane := LanePriority
+	switch {
+	case len(l.waiting[LanePriority]) == 0 && len(l.waiting[LaneClient]) == 0:
+		l.running--
+		return
+	case len(l.waiting[LanePriority]) == 0, len(l.waiting[LaneClient]) > 0 && l.streak >= l.weight:
+		lane = LaneClient
+	}
+	if lane == LanePriority && len(l.waiting[LaneClient]) > 0 {
+		l.streak++
+	} else {
+		l.streak = 0
+	}
+
+	admit := l.waiting[lane][0]
+	l.waiting[lane] = l.waiting[lane][1:]
+	l.depth.WithLabelValues(lane).Set(float64(len(l.waiting[lane])))
+	close(admit)
+}
+
+// writeLane returns the lane of a request, or an empty string for requests that do not need a write slot
+func (h *Wrapper) writeLane(r *http.Request, class string) string {
+	switch {
+	case class == RouteAdmin:
+		return LanePriority
+	case class != RouteWrite:
+		return ""
+	case r.Header.Get(WritePriorityHeader) == "high" && h.authorizedAdmin(r):
+		return LanePriority
+	default:
+		return LaneClient
+	}
+}
+
+// laneMiddleware holds write and admin requests in their lane until a write slot is free
+func (h *Wrapper) laneMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.lanes == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lane := h.writeLane(r, routeClass(r))
+		if lane == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if admit, ok := h.lanes.enqueue(lane); !ok {
+			select {
+			case <-admit:
+			case <-r.Context().Done():
+				if h.lanes.abandon(lane, admit) {
+					writeJSONError(w, http.StatusServiceUnavailable, CodeWriteQueueTimeout, "The request gave up waiting for a write slot")
+					return
+				}
+			}
+		}
+		defer h.lanes.release()
+		next.ServeHTTP(w, r)
+	})
+}
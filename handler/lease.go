@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type acquireLeaseRequest struct {
+	Name string `json:"name" validate:"required,dbkey"`
+	Ttl  int64  `json:"ttl" validate:"min=1,dbttl"` // How long the lease lasts without being renewed, in seconds
+}
+
+type leaseIDRequest struct {
+	ID string `json:"id" validate:"required"`
+}
+
+type leaseResponse struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+type releaseLeaseResponse struct {
+	Name    string `json:"name"`
+	Deleted int    `json:"deleted"` // The number of keys written under the lease that were deleted
+}
+
+// acquireLeaseHandler acquires a named lease for a ttl, e.g. for a worker to register itself or to elect a leader.
+// The response holds the id of the lease, which the holder uses to renew it, release it and write keys under it.
+func (h *Wrapper) acquireLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	var rData acquireLeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing lease request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing lease request: %v", err))
+		return
+	}
+
+	id, ok := h.db.AcquireLease(rData.Name, h.clampTTL(rData.Ttl))
+	if !ok {
+		writeJSONError(w, http.StatusConflict, CodeLeaseHeld, "Lease "+rData.Name+" is held by another client")
+		return
+	}
+	writeJSON(w, http.StatusCreated, leaseResponse{Name: rData.Name, ID: id})
+}
+
+// decodeLeaseID decodes the id of a lease from the request body, writing a 400 and returning false if it is invalid
+func (h *Wrapper) decodeLeaseID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var rData leaseIDRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing lease request: %v", err))
+		return "", false
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing lease request: %v", err))
+		return "", false
+	}
+	return rData.ID, true
+}
+
+// renewLeaseHandler is the heartbeat of a lease holder. It extends the lease and every key written under it by the
+// lease's ttl. A 404 means the lease was lost, e.g. because it expired, and its keys are gone.
+func (h *Wrapper) renewLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	id, ok := h.decodeLeaseID(w, r)
+	if !ok {
+		return
+	}
+
+	if !h.db.RenewLease(name, id) {
+		writeJSONError(w, http.StatusNotFound, CodeLeaseNotFound, "Lease not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, leaseResponse{Name: name, ID: id})
+}
+
+// releaseLeaseHandler gives up a lease, deleting every key written under it
+func (h *Wrapper) releaseLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	id, ok := h.decodeLeaseID(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, ok := h.db.ReleaseLease(name, id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, CodeLeaseNotFound, "Lease not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, releaseLeaseResponse{Name: name, Deleted: deleted})
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"strings"
+)
+
+// redactedValue replaces the values of the redacted fields of logged request bodies
+const redactedValue = "[REDACTED]"
+
+// WithLogRedaction replaces the values of the fields with the names anywhere in a logged request body, e.g. password
+// or token, so that secrets sent by clients do not end up in the logs. Names are matched without regard to case. The
+// request itself is left unchanged.
+func WithLogRedaction(fields ...string) Options {
+	return func(h *Wrapper) {
+		if h.s.logRedact == nil {
+			h.s.logRedact = map[string]bool{}
+		}
+		for _, field := range fields {
+			h.s.logRedact[strings.ToLower(field)] = true
+		}
+	}
+}
+
+// WithLogBodyLimit logs request bodies longer than n bytes as a string cut off after n bytes, along with their length,
+// instead of in full. Zero, the default, logs every body in full.
+func WithLogBodyLimit(n int) Options {
+	return func(h *Wrapper) {
+		h.s.logBodyLimit = n
+	}
+}
+
+// WithLogSampling logs only a fraction of the successful requests of the route class, between 0 for none and 1 for
+// all, to make logging busy routes affordable. Failed requests are always logged, and admin requests are always audit
+// logged. Streams, /readyz and /metrics have no class and are always logged.
+func WithLogSampling(class string, rate float64) Options {
+	return func(h *Wrapper) {
+		if h.s.logSampleRates == nil {
+			h.s.logSampleRates = map[string]float64{}
+		}
+		h.s.logSampleRates[class] = min(max(rate, 0), 1)
+	}
+}
+
+// sampleLog reports whether the incoming request is logged under the sampling rate of its class
+func (h *Wrapper) sampleLog(class string) bool {
+	rate, ok := h.s.logSampleRates[class]
+	return !ok || rate >= 1 || rate > rand.Float64()
+}
+
+// redact replaces the values of the redacted fields anywhere in a decoded JSON body
+func (h *Wrapper) redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for field, value := range v {
+			if h.s.logRedact[strings.ToLower(field)] {
+				v[field] = redactedValue
+			} else {
+				v[field] = h.redact(value)
+			}
+		}
+	case []any:
+		for n, value := range v {
+			v[n] = h.redact(value)
+		}
+	}
+	return v
+}
+
+// logBody returns the attributes a decoded request body of size bytes is logged with, redacted and truncated
+func (h *Wrapper) logBody(body any, size int) []any {
+	if len(h.s.logRedact) > 0 {
+		body = h.redact(body)
+	}
+	if h.s.logBodyLimit <= 0 || size <= h.s.logBodyLimit {
+		return []any{"Body", body}
+	}
+
+	// The redacted body is encoded again so that redacted values cannot be cut in half
+	b, err := json.Marshal(body)
+	if err != nil {
+		return []any{"bodyBytes", size}
+	}
+	cut := strings.ToValidUTF8(string(b[:min(h.s.logBodyLimit, len(b))]), "")
+	return []any{"Body", cut, "bodyBytes", size, "bodyTruncated", true}
+}
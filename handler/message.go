@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"path"
+)
+
+// publishBodyOverhead is the allowance for the JSON around a message in a publish request body. The body may also be
+// up to twice the message limit so that escaped messages are still decoded and measured.
+const publishBodyOverhead = 1024
+
+// MessageValidator checks a message published to a channel, returning why it is rejected, e.g. because it does not
+// match the schema of the channel
+type MessageValidator func(channel string, message string) error
+
+// messageValidator is a validator that applies to the channels matching a pattern
+type messageValidator struct {
+	pattern  string
+	validate MessageValidator
+}
+
+// WithMessageValidator checks the messages published to channels matching the pattern with v. Patterns use the syntax
+// of path.Match, so "orders.*" matches every channel starting with "orders.". A message that is rejected by any
+// matching validator receives a 422 and is not delivered.
+func WithMessageValidator(pattern string, v MessageValidator) Options {
+	return func(h *Wrapper) {
+		h.s.messageValidators = append(h.s.messageValidators, messageValidator{pattern: pattern, validate: v})
+	}
+}
+
+// validateMessage runs the validators of every pattern the channel matches
+func (h *Wrapper) validateMessage(channel string, message string) error {
+	for _, v := range h.s.messageValidators {
+		if ok, _ := path.Match(v.pattern, channel); !ok {
+			continue
+		}
+		if err := v.validate(channel, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isTooLarge reports whether a validation error is only due to the message length
+func isTooLarge(err error) bool {
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return false
+	}
+	for _, e := range errs {
+		if e.Tag() != "dbmessage" {
+			return false
+		}
+	}
+	return true
+}
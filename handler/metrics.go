@@ -4,16 +4,64 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
+	"time"
 )
 
+// mirrorStats describes the mirror target that writes are forwarded to. It is an alias of an unnamed struct so that
+// the database can report it without importing this package.
+type mirrorStats = struct {
+	Enabled bool          // Whether writes are forwarded to a mirror target
+	Pending int           // Writes waiting to be applied
+	Applied uint64        // Writes applied to the target
+	Failed  uint64        // Writes rejected by the target or given up on
+	Dropped uint64        // Writes not queued because the queue was full
+	Lag     time.Duration // The age of the oldest write waiting to be applied
+}
+
+// persistenceStats describes the outcome of one kind of persistence, the AOF syncs or the snapshots. Like mirrorStats
+// it is an alias of an unnamed struct.
+type persistenceStats = struct {
+	Enabled         bool          // Whether this kind of persistence is enabled
+	LastSuccess     time.Time     // When the last successful attempt finished. Zero if none has.
+	LastDuration    time.Duration // How long the last successful attempt took
+	Failures        int           // Attempts that failed since the last success
+	Failing         bool          // Whether the attempts have failed for the alert periods
+	RejectingWrites bool          // Whether writes are rejected because the attempts are failing
+	FailedWrites    uint64        // Writes rejected by the reject persistence failure policy
+	FreeDiskBytes   uint64        // The free disk space found before the last attempt. Zero if it was not checked.
+	StalledWrites   uint64        // Writes that waited for the persistence to release the database
+	StallTime       time.Duration // The total time writes waited
+	RejectedWrites  uint64        // Writes failed fast by the fail write stall policy
+	BufferedWrites  uint64        // Puts buffered by the buffer write stall policy
+}
+
+// persistenceKinds are the kinds of persistence reported by the metrics, as named by the database
+var persistenceKinds = []string{"aof", "snapshot"}
+
 type metrics struct {
 	dbHttpRequestCounter *prometheus.CounterVec   // Requests labeled by uri, method, and status.
 	dbLatency            *prometheus.HistogramVec // Latency labeled by uri, method, and status.
 	dbSubscriptions      prometheus.Gauge         // Number of active subscriptions
 	dbPublishedMessages  prometheus.Counter       // Number of cumulative published messages.
+	dbLaggingSubscribers prometheus.Gauge         // Number of subscribers whose buffer is full
+	dbDroppedMessages    prometheus.Counter       // Number of messages dropped for subscribers whose buffer was full
+
+	dbNamespaceRequests   *prometheus.CounterVec // Key operations labeled by namespace, for namespaces with a quota.
+	dbNamespaceRejections *prometheus.CounterVec // Rejected key operations labeled by namespace and reason.
+	dbWebhookDeliveries   *prometheus.CounterVec // Webhook deliveries labeled by result.
+	dbOriginFetches       *prometheus.CounterVec // Origin fetches labeled by result.
+	dbCoalescedRequests   *prometheus.CounterVec // Reads served by an identical concurrent read, labeled by operation.
+	dbRouteTimeouts       *prometheus.CounterVec // Requests that exceeded their deadline, labeled by route class.
+	dbCircuitRejections   *prometheus.CounterVec // Requests rejected by an open circuit, labeled by route class.
+	dbClampedTTLs         *prometheus.CounterVec // Ttls clamped to the ttl bounds, labeled by the bound.
+	dbWriteQueueDepth     *prometheus.GaugeVec   // Requests waiting for a write slot, labeled by lane.
 }
 
-func newPromHandler() (http.Handler, *metrics) {
+// newPromHandler registers the metrics. The mirror metrics are read from mirror when they are scraped, and are only
+// registered when writes are forwarded to a mirror target. The persistence metrics are likewise read from persistence
+// and registered for each kind of persistence that is enabled, labelled by kind. The compaction metrics are read from
+// compactions and always registered, since the database can be compacted through the admin API.
+func newPromHandler(mirror func() mirrorStats, persistence func(kind string) persistenceStats, compactions func() compactionStats) (http.Handler, *metrics) {
 	m := &metrics{
 		dbHttpRequestCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "db_http_requests_total",
@@ -32,6 +80,50 @@ func newPromHandler() (http.Handler, *metrics) {
 			Name: "db_published_messages",
 			Help: "Cumulative number of published messages",
 		}),
+		dbLaggingSubscribers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "db_lagging_subscribers",
+			Help: "Number of subscribers that are dropping messages because their buffer is full",
+		}),
+		dbDroppedMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "db_subscriber_dropped_messages_total",
+			Help: "Total number of messages dropped for subscribers whose buffer was full",
+		}),
+		dbNamespaceRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_namespace_requests_total",
+			Help: "Total number of key operations on namespaces with a quota, labelled by namespace.",
+		}, []string{"namespace"}),
+		dbNamespaceRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_namespace_rejections_total",
+			Help: "Total number of key operations rejected by a namespace quota, labelled by namespace and reason.",
+		}, []string{"namespace", "reason"}),
+		dbWebhookDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_webhook_deliveries_total",
+			Help: "Total number of webhook deliveries, labelled by result (delivered, failed or dropped).",
+		}, []string{"result"}),
+		dbOriginFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_origin_fetches_total",
+			Help: "Total number of fetches from the origin, labelled by result (found, not_found or failed), and of requests that shared a fetch (coalesced).",
+		}, []string{"result"}),
+		dbCoalescedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_coalesced_requests_total",
+			Help: "Total number of reads served by the result of an identical concurrent read, labelled by operation (get or ttl).",
+		}, []string{"operation"}),
+		dbRouteTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_route_timeouts_total",
+			Help: "Total number of requests answered with a 504 because they exceeded their deadline, labelled by route class.",
+		}, []string{"class"}),
+		dbCircuitRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_circuit_rejections_total",
+			Help: "Total number of requests rejected with a 503 by an open circuit breaker, labelled by route class.",
+		}, []string{"class"}),
+		dbClampedTTLs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_clamped_ttls_total",
+			Help: "Total number of ttls clamped to the ttl bounds, labelled by the bound, min or max.",
+		}, []string{"bound"}),
+		dbWriteQueueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "db_write_queue_depth",
+			Help: "Number of write and admin requests waiting for a write slot, labelled by lane (priority or client).",
+		}, []string{"lane"}),
 	}
 
 	reg := prometheus.NewRegistry()
@@ -39,6 +131,116 @@ func newPromHandler() (http.Handler, *metrics) {
 	reg.MustRegister(m.dbLatency)
 	reg.MustRegister(m.dbSubscriptions)
 	reg.MustRegister(m.dbPublishedMessages)
+	reg.MustRegister(m.dbLaggingSubscribers)
+	reg.MustRegister(m.dbDroppedMessages)
+	reg.MustRegister(m.dbNamespaceRequests)
+	reg.MustRegister(m.dbNamespaceRejections)
+	reg.MustRegister(m.dbWebhookDeliveries)
+	reg.MustRegister(m.dbOriginFetches)
+	reg.MustRegister(m.dbCoalescedRequests)
+	reg.MustRegister(m.dbRouteTimeouts)
+	reg.MustRegister(m.dbCircuitRejections)
+	reg.MustRegister(m.dbClampedTTLs)
+	reg.MustRegister(m.dbWriteQueueDepth)
+	reg.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "db_compactions_total",
+			Help: "Total number of database compactions, whether triggered by an admin or by deleted keys",
+		}, func() float64 { return float64(compactions().Runs) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "db_compaction_reclaimed_bytes_total",
+			Help: "Total number of heap bytes freed by database compactions",
+		}, func() float64 { return float64(compactions().Reclaimed) }),
+	)
+	if mirror().Enabled {
+		reg.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "db_mirror_pending",
+				Help: "Number of writes waiting to be forwarded to the mirror target",
+			}, func() float64 { return float64(mirror().Pending) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "db_mirror_lag_seconds",
+				Help: "Age in seconds of the oldest write waiting to be forwarded to the mirror target",
+			}, func() float64 { return mirror().Lag.Seconds() }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "db_mirror_applied_total",
+				Help: "Total number of writes applied to the mirror target",
+			}, func() float64 { return float64(mirror().Applied) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "db_mirror_failed_total",
+				Help: "Total number of writes rejected by the mirror target or given up on after retrying",
+			}, func() float64 { return float64(mirror().Failed) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "db_mirror_dropped_total",
+				Help: "Total number of writes dropped because the mirror queue was full",
+			}, func() float64 { return float64(mirror().Dropped) }),
+		)
+	}
+
+	for _, kind := range persistenceKinds {
+		if !persistence(kind).Enabled {
+			continue
+		}
+		labels := prometheus.Labels{"kind": kind}
+		reg.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "db_persistence_last_success_timestamp_seconds",
+				Help:        "Unix time of the last successful persistence, labelled by kind (aof or snapshot). Zero if none has succeeded.",
+				ConstLabels: labels,
+			}, func() float64 {
+				if t := persistence(kind).LastSuccess; !t.IsZero() {
+					return float64(t.UnixMilli()) / 1000
+				}
+				return 0
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "db_persistence_last_duration_seconds",
+				Help:        "How long the last successful persistence took in seconds, labelled by kind (aof or snapshot)",
+				ConstLabels: labels,
+			}, func() float64 { return persistence(kind).LastDuration.Seconds() }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "db_persistence_consecutive_failures",
+				Help:        "Number of persistence attempts that failed since the last success, labelled by kind (aof or snapshot)",
+				ConstLabels: labels,
+			}, func() float64 { return float64(persistence(kind).Failures) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "db_persistence_failing",
+				Help:        "1 while persistence has failed for the alert periods and 0 otherwise, labelled by kind (aof or snapshot)",
+				ConstLabels: labels,
+			}, func() float64 {
+				if persistence(kind).Failing {
+					return 1
+				}
+				return 0
+			}),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "db_persistence_failed_writes_total",
+				Help:        "Total number of writes rejected by the reject persistence failure policy, labelled by the kind (aof or snapshot) that was failing",
+				ConstLabels: labels,
+			}, func() float64 { return float64(persistence(kind).FailedWrites) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "db_persistence_disk_free_bytes",
+				Help:        "Free disk space in bytes found before the last persistence attempt, labelled by kind (aof or snapshot)",
+				ConstLabels: labels,
+			}, func() float64 { return float64(persistence(kind).FreeDiskBytes) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "db_persistence_write_stall_seconds_total",
+				Help:        "Total time in seconds writes waited for persistence to release the database, labelled by kind (aof or snapshot)",
+				ConstLabels: labels,
+			}, func() float64 { return persistence(kind).StallTime.Seconds() }),
+		)
+		for outcome, count := range map[string]func(s persistenceStats) uint64{
+			"waited":   func(s persistenceStats) uint64 { return s.StalledWrites },
+			"rejected": func(s persistenceStats) uint64 { return s.RejectedWrites },
+			"buffered": func(s persistenceStats) uint64 { return s.BufferedWrites },
+		} {
+			reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "db_persistence_stalled_writes_total",
+				Help:        "Total number of writes made while persistence held the database, labelled by kind (aof or snapshot) and outcome (waited, rejected or buffered)",
+				ConstLabels: prometheus.Labels{"kind": kind, "outcome": outcome},
+			}, func() float64 { return float64(count(persistence(kind))) }))
+		}
+	}
 
 	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,43 +20,73 @@ type statusResponseWriter struct {
 	e          string
 }
 
+// statusWriterPool recycles the status wrappers created for every request
+var statusWriterPool = sync.Pool{
+	New: func() any {
+		return new(statusResponseWriter)
+	},
+}
+
+// getStatusWriter wraps w in a pooled status wrapper
+func getStatusWriter(w http.ResponseWriter) *statusResponseWriter {
+	sw := statusWriterPool.Get().(*statusResponseWriter)
+	sw.ResponseWriter = w
+	sw.statusCode = http.StatusOK
+	sw.e = ""
+	return sw
+}
+
+// putStatusWriter returns a status wrapper to the pool. It must not be used afterward.
+func putStatusWriter(sw *statusResponseWriter) {
+	sw.ResponseWriter = nil
+	statusWriterPool.Put(sw)
+}
+
 // Flush is necessary here for the subscribe functionality to work
 func (w *statusResponseWriter) Flush() {
 	w.ResponseWriter.(http.Flusher).Flush()
 }
 
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // WriteHeader enables the collection of status codes
 func (w *statusResponseWriter) WriteHeader(code int) {
 	w.statusCode = code
 	w.ResponseWriter.WriteHeader(code)
 }
 
-// loggingMiddleware logs all incoming requests
+// loggingMiddleware logs incoming requests, as sampled for their route class, and every failed request. Logged bodies
+// are redacted and truncated as configured.
 func (h *Wrapper) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get body data
-		if r.Body != nil && r.ContentLength != 0 {
-			var rData map[string]any
+		sampled := h.sampleLog(routeClass(r))
+
+		// Get body data. Binary bodies, such as Redis files being imported, are neither parsed nor logged.
+		if r.Body != nil && r.ContentLength != 0 && r.Header.Get("Content-Type") != RedisContentType {
+			var rData any
 			bodyBytes, err := io.ReadAll(r.Body)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeJSONError(w, http.StatusInternalServerError, CodeInternal, err.Error())
 				return
 			}
 
 			// Unmarshal request body
 			if err = json.Unmarshal(bodyBytes, &rData); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				writeJSONError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
 				return
 			} else {
 				// Get body data to request
 				r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-				h.logger.Info(
-					"incoming request",
-					"method", r.Method,
-					"URI", r.RequestURI,
-					"Body", rData)
+				if sampled {
+					h.logger.Info(
+						"incoming request",
+						append([]any{"method", r.Method, "URI", r.RequestURI}, h.logBody(rData, len(bodyBytes))...)...)
+				}
 			}
-		} else {
+		} else if sampled {
 			h.logger.Info(
 				"incoming request",
 				"method", r.Method,
@@ -72,28 +105,68 @@ func (h *Wrapper) loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// isStream reports whether a request path is a long-lived event stream, which counts towards the subscription gauge
+func isStream(path string) bool {
+	return strings.Contains(path, "subscribe") || path == "/v1/events" || path == "/v1/changes" ||
+		(strings.HasPrefix(path, "/v1/services/") && strings.HasSuffix(path, "/watch"))
+}
+
 // prometheusMiddleware handles all prometheus metric updates.
 func (h *Wrapper) prometheusMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sw := &statusResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		sw := getStatusWriter(w)
+		defer putStatusWriter(sw)
 
 		var url string
-		rawURL := r.URL.String()
+		rawURL := r.URL.Path
+		extraPath, extra := h.isExtraRoute(r)
 		switch {
+		case extra:
+			url = extraPath
+		case strings.HasPrefix(rawURL, "/v1/leases"):
+			url = "/v1/leases"
+		case strings.HasPrefix(rawURL, "/v1/bitmaps/"):
+			url = "/v1/bitmaps/"
+		case strings.HasPrefix(rawURL, "/v1/hyperloglogs/"):
+			url = "/v1/hyperloglogs/"
+		case strings.HasPrefix(rawURL, "/v1/geo/"):
+			url = "/v1/geo/"
+		case strings.HasPrefix(rawURL, "/v1/ratelimit/"):
+			url = "/v1/ratelimit/"
+		case strings.HasPrefix(rawURL, "/v1/services/"):
+			url = "/v1/services/"
+		case strings.HasPrefix(rawURL, "/v1/admin/webhooks"):
+			url = "/v1/admin/webhooks"
+		case strings.HasPrefix(rawURL, "/v1/admin/schedules"):
+			url = "/v1/admin/schedules"
 		case strings.Contains(rawURL, "publish"):
 			url = "/v1/publish/"
 		case strings.Contains(rawURL, "subscribe"):
 			url = "/v1/subscribe/"
+		case rawURL == "/v1/ttl/batch", rawURL == "/v1/admin/expire-prefix", rawURL == "/v1/admin/info", rawURL == "/v1/admin/config",
+			rawURL == "/v1/admin/ttl-histogram", rawURL == "/v1/export", rawURL == "/v1/events", rawURL == "/v1/changes", rawURL == "/v1/search",
+			rawURL == "/v1/admin/import/redis", rawURL == "/v1/admin/export/redis", rawURL == "/v1/admin/compact":
+			url = rawURL
+		case strings.HasPrefix(rawURL, "/v1/keys/") && strings.HasSuffix(rawURL, "/touch"):
+			url = "/v1/keys/touch"
+		case strings.HasPrefix(rawURL, "/v1/keys/") && strings.HasSuffix(rawURL, "/history"):
+			url = "/v1/keys/history"
+		case strings.HasPrefix(rawURL, "/v1/keys/") && strings.HasSuffix(rawURL, "/restore"):
+			url = "/v1/keys/restore"
+		case strings.HasPrefix(rawURL, "/v1/keys/") && strings.HasSuffix(rawURL, "/stats"):
+			url = "/v1/keys/stats"
 		case strings.Contains(rawURL, "ttl"):
 			url = "/v1/ttl/"
 		case rawURL == "/v1/keys":
 			url = "/v1/keys"
+		case rawURL == "/v1/openapi.json", rawURL == "/docs", rawURL == "/readyz":
+			url = rawURL
 		default:
 			url = "/v1/keys/"
 		}
 
 		// Subscription gauge
-		if strings.Contains(r.URL.Path, "subscribe") {
+		if isStream(r.URL.Path) {
 			h.m.dbSubscriptions.Inc()
 		}
 
@@ -107,7 +180,7 @@ func (h *Wrapper) prometheusMiddleware(next http.Handler) http.Handler {
 		requestCounter, err := h.m.dbHttpRequestCounter.GetMetricWithLabelValues(
 			r.Method,
 			url,
-			fmt.Sprintf("%v", sw.statusCode),
+			strconv.Itoa(sw.statusCode),
 		)
 
 		if err == nil {
@@ -120,7 +193,7 @@ func (h *Wrapper) prometheusMiddleware(next http.Handler) http.Handler {
 		latency, err := h.m.dbLatency.GetMetricWithLabelValues(
 			r.Method,
 			url,
-			fmt.Sprintf("%v", sw.statusCode),
+			strconv.Itoa(sw.statusCode),
 		)
 
 		if err == nil {
@@ -136,8 +209,50 @@ func (h *Wrapper) prometheusMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Subscription gauge
-		if strings.Contains(r.URL.Path, "subscribe") {
+		if isStream(r.URL.Path) {
 			h.m.dbSubscriptions.Dec()
 		}
 	})
 }
+
+// recoveryMiddleware recovers from panics in handlers so that a single bad request returns a 500 instead of crashing
+// the server. The panic hook is then called to attempt a final persistence pass.
+func (h *Wrapper) recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+
+			// ErrAbortHandler is the sanctioned way to abort a response so let the server handle it
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			h.logger.Error("recovered from panic in handler",
+				"method", r.Method,
+				"URI", r.RequestURI,
+				"panic", fmt.Sprint(rec),
+				"stack", string(debug.Stack()))
+			writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Internal server error")
+
+			if h.s.onPanic != nil {
+				h.runPanicHook()
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runPanicHook calls the panic hook, guarding against the hook itself panicking
+func (h *Wrapper) runPanicHook() {
+	defer func() {
+		if rec := recover(); rec != nil {
+			h.logger.Error("panic in panic hook", "panic", fmt.Sprint(rec))
+		}
+	}()
+
+	h.s.onPanic()
+}
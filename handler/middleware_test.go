@@ -62,6 +62,134 @@ func TestLoggingMiddleware(t *testing.T) {
 	}
 }
 
+func TestLoggingMiddleware_redaction(t *testing.T) {
+	body := `{"key":"test","auth":{"Password":"hunter2"},"items":[{"token":"t1"},{"name":"n"}]}`
+	tests := []struct {
+		name     string
+		opts     []Options
+		method   string
+		status   int
+		body     string
+		messages []string
+		logged   any // The body attribute of the incoming request log, if any
+		checks   map[string]any
+	}{
+		{
+			name:     "Redacted fields",
+			opts:     []Options{WithLogRedaction("password", "TOKEN")},
+			method:   "POST",
+			status:   http.StatusOK,
+			body:     body,
+			messages: []string{"incoming request"},
+			logged: map[string]any{
+				"key":   "test",
+				"auth":  map[string]any{"Password": redactedValue},
+				"items": []any{map[string]any{"token": redactedValue}, map[string]any{"name": "n"}},
+			},
+		},
+		{
+			name:     "Truncated body",
+			opts:     []Options{WithLogRedaction("password"), WithLogBodyLimit(20)},
+			method:   "POST",
+			status:   http.StatusOK,
+			body:     body,
+			messages: []string{"incoming request"},
+			logged:   `{"auth":{"Password":`,
+			checks:   map[string]any{"bodyBytes": float64(len(body)), "bodyTruncated": true},
+		},
+		{
+			name:     "Body within the limit",
+			opts:     []Options{WithLogBodyLimit(len(body))},
+			method:   "POST",
+			status:   http.StatusOK,
+			body:     `{"key":"test"}`,
+			messages: []string{"incoming request"},
+			logged:   map[string]any{"key": "test"},
+		},
+		{
+			name:   "Sampled out",
+			opts:   []Options{WithLogSampling(RouteRead, 0)},
+			method: "GET",
+			status: http.StatusOK,
+		},
+		{
+			name:     "Failure of a sampled out request",
+			opts:     []Options{WithLogSampling(RouteRead, 0)},
+			method:   "GET",
+			status:   http.StatusInternalServerError,
+			messages: []string{"request failed"},
+		},
+		{
+			name:     "Other class",
+			opts:     []Options{WithLogSampling(RouteRead, 0)},
+			method:   "POST",
+			status:   http.StatusOK,
+			body:     `{"key":"test"}`,
+			messages: []string{"incoming request"},
+			logged:   map[string]any{"key": "test"},
+		},
+		{
+			name:     "Sampled in",
+			opts:     []Options{WithLogSampling(RouteRead, 1)},
+			method:   "GET",
+			status:   http.StatusOK,
+			messages: []string{"incoming request"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logBuffer bytes.Buffer
+			wrapper := Wrapper{logger: slog.New(slog.NewJSONHandler(&logBuffer, nil))}
+			for _, o := range tt.opts {
+				o(&wrapper)
+			}
+
+			router := mux.NewRouter()
+			router.Use(wrapper.loggingMiddleware)
+			router.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
+				// The handler receives the body as it was sent
+				if b, _ := io.ReadAll(r.Body); string(b) != tt.body {
+					t.Errorf("handler body = %s; want %s", b, tt.body)
+				}
+				w.WriteHeader(tt.status)
+			})
+
+			var r *http.Request
+			if tt.body != "" {
+				r = httptest.NewRequest(tt.method, "/test", strings.NewReader(tt.body))
+			} else {
+				r = httptest.NewRequest(tt.method, "/test", nil)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), r)
+
+			var messages []string
+			dec := json.NewDecoder(&logBuffer)
+			for dec.More() {
+				var logLine map[string]any
+				if err := dec.Decode(&logLine); err != nil {
+					t.Fatalf("Error unmarshalling log: %v", err)
+				}
+				messages = append(messages, logLine["msg"].(string))
+				if logLine["msg"] != "incoming request" {
+					continue
+				}
+				if !reflect.DeepEqual(logLine["Body"], tt.logged) {
+					t.Errorf("logged body = %#v; want %#v", logLine["Body"], tt.logged)
+				}
+				for k, want := range tt.checks {
+					if logLine[k] != want {
+						t.Errorf("log %v = %v; want %v", k, logLine[k], want)
+					}
+				}
+			}
+			if !reflect.DeepEqual(messages, tt.messages) {
+				t.Errorf("log messages = %v; want %v", messages, tt.messages)
+			}
+		})
+	}
+}
+
 func TestPrometheusMiddleware(t *testing.T) {
 	requests := []struct {
 		method string
@@ -200,3 +328,86 @@ func TestPrometheusMiddleware(t *testing.T) {
 		}
 	})
 }
+
+func TestWrapper_extensions(t *testing.T) {
+	// Each middleware records that it ran, and the second rejects requests marked as blocked
+	record := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Middleware", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	block := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Block") != "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, "hello "+mux.Vars(r)["name"])
+	})
+
+	h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler),
+		WithMiddleware(record("first"), block),
+		WithMiddleware(record("second")),
+		WithRoute("GET", "/v1/hello/{name}", hello),
+		WithRoute("GET", "/greet/{name}", hello),
+		WithRoute("POST", "/v1/admin/hello/{name}", hello),
+		WithRoute("GET", "/readyz", hello),
+		WithAdminToken("secret"))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     map[string]string
+		status     int
+		body       string // A string the response contains
+		version    string // The API-Version header of the response
+		middleware []string
+	}{
+		{name: "Versioned extra route", method: "GET", path: "/v1/hello/abc", status: http.StatusOK, body: "hello abc", version: "v1", middleware: []string{"first", "second"}},
+		{name: "Negotiated extra route", method: "GET", path: "/hello/abc", header: map[string]string{APIVersionHeader: "v1"}, status: http.StatusOK, body: "hello abc", version: "v1", middleware: []string{"first", "second"}},
+		{name: "Unversioned extra route", method: "GET", path: "/greet/abc", status: http.StatusOK, body: "hello abc", middleware: []string{"first", "second"}},
+		{name: "Built-in route", method: "GET", path: "/v1/openapi.json", status: http.StatusOK, body: "openapi", version: "v1", middleware: []string{"first", "second"}},
+		{name: "Built-in route takes precedence", method: "GET", path: "/readyz", status: http.StatusOK, body: "ready", middleware: []string{"first", "second"}},
+		{name: "Rejected by middleware", method: "GET", path: "/v1/hello/abc", header: map[string]string{"X-Block": "true"}, status: http.StatusForbidden, middleware: []string{"first"}},
+		{name: "Extra admin route without token", method: "POST", path: "/v1/admin/hello/abc", status: http.StatusUnauthorized},
+		{name: "Extra admin route", method: "POST", path: "/v1/admin/hello/abc", header: map[string]string{"Authorization": "Bearer secret"}, status: http.StatusOK, body: "hello abc", version: "v1", middleware: []string{"first", "second"}},
+		{name: "Extra route method not allowed", method: "PUT", path: "/greet/abc", status: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("response body = %v; want it to contain %v", w.Body.String(), tt.body)
+			}
+			if got := w.Header().Get(APIVersionHeader); got != tt.version {
+				t.Errorf("%v = %q; want %q", APIVersionHeader, got, tt.version)
+			}
+			if got := w.Header().Values("X-Middleware"); !reflect.DeepEqual(got, tt.middleware) {
+				t.Errorf("middleware ran = %v; want %v", got, tt.middleware)
+			}
+		})
+	}
+
+	// Extra routes are measured under their own path rather than as keys
+	if got := testutil.ToFloat64(h.m.dbHttpRequestCounter.WithLabelValues("GET", "/v1/hello/{name}", "200")); got != 2 {
+		t.Errorf("requests to /v1/hello/{name} = %v; want 2", got)
+	}
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the hand-maintained OpenAPI document for the routes registered in NewHandler. The handler tests
+// check that the two stay in sync.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUI renders the OpenAPI document using Swagger UI from a CDN
+const swaggerUI = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<title>InMemoryDB API</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+	<script>
+		window.ui = SwaggerUIBundle({url: "/v1/openapi.json", dom_id: "#swagger-ui"});
+	</script>
+</body>
+</html>
+`
+
+// openAPIHandler serves the OpenAPI document
+func (h *Wrapper) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(openAPISpec)
+	if err != nil {
+		return
+	}
+}
+
+// docsHandler serves Swagger UI for the OpenAPI document
+func (h *Wrapper) docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte(swaggerUI))
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI_inSync(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	// Collect every method and path registered on the router. Routes without methods only serve GET.
+	routes := map[string][]string{}
+	h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler))
+	err := h.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+		for _, m := range methods {
+			routes[path] = append(routes[path], strings.ToLower(m))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, methods := range routes {
+		if path == chaosPath { // Only served by builds with the chaos tag
+			continue
+		}
+		for _, m := range methods {
+			if _, ok := spec.Paths[path][m]; !ok {
+				t.Errorf("route %v %v is missing from openapi.json", strings.ToUpper(m), path)
+			}
+		}
+	}
+
+	for path, operations := range spec.Paths {
+		for m := range operations {
+			if m == "parameters" {
+				continue
+			}
+			if !slices.Contains(routes[path], m) {
+				t.Errorf("openapi.json documents %v %v but no such route is registered", strings.ToUpper(m), path)
+			}
+		}
+	}
+}
+
+func TestOpenAPI_handlers(t *testing.T) {
+	tests := []struct {
+		path        string
+		contentType string
+		contains    string
+	}{
+		{path: "/v1/openapi.json", contentType: "application/json", contains: `"openapi": "3.0.3"`},
+		{path: "/docs", contentType: "text/html; charset=utf-8", contains: "/v1/openapi.json"},
+	}
+
+	h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler))
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != http.StatusOK {
+				t.Errorf("response code = %v; want %v", w.Code, http.StatusOK)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("content type = %v; want %v", ct, tt.contentType)
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("response body does not contain %v", tt.contains)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultOriginTimeout is how long a fetch from the origin may take
+const DefaultOriginTimeout = 10 * time.Second
+
+// Origin fetches the value of a key that is not stored, returning false if the origin does not have it either
+type Origin func(ctx context.Context, key string) (value string, found bool, err error)
+
+// origin turns GET /v1/keys/{key} into a read-through cache
+type origin struct {
+	fetch   Origin
+	ttl     *int64             // The ttl fetched values are stored with. Nil stores them without a ttl.
+	flights singleflight.Group // Coalesces concurrent fetches of the same key
+}
+
+// originResult is the outcome of a fetch shared by every request that was waiting for it
+type originResult struct {
+	value string
+	found bool
+}
+
+// WithOrigin makes GET /v1/keys/{key} fetch keys that are not stored from the origin, storing the value with the ttl
+// in seconds before returning it. A ttl of zero stores values without one. Concurrent requests for the same key share
+// a single fetch so that a popular key expiring does not send a stampede of requests to the origin.
+func WithOrigin(fetch Origin, ttl int64) Options {
+	return func(h *Wrapper) {
+		h.origin.fetch = fetch
+		h.origin.ttl = nil
+		if ttl > 0 {
+			h.origin.ttl = &ttl
+		}
+	}
+}
+
+// fetchOrigin fetches a key from the origin, joining a fetch of the same key that is already running. The fetch is
+// not canceled when the request that started it is, since other requests may be waiting for it, but the request stops
+// waiting when its own context is done.
+func (h *Wrapper) fetchOrigin(ctx context.Context, key string) (string, bool, error) {
+	ch := h.origin.flights.DoChan(key, func() (any, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), DefaultOriginTimeout)
+		defer cancel()
+
+		value, found, err := h.origin.fetch(fetchCtx, key)
+		switch {
+		case err != nil:
+			h.m.dbOriginFetches.WithLabelValues("failed").Inc()
+			return nil, err
+		case !found:
+			h.m.dbOriginFetches.WithLabelValues("not_found").Inc()
+			return originResult{}, nil
+		}
+		h.m.dbOriginFetches.WithLabelValues("found").Inc()
+
+		// The value is returned even if it cannot be stored, so that the client is not punished for a limit
+		if len(value) > h.s.maxValueLength {
+			h.logger.Warn("not storing an origin value over the maximum value length", "key", key, "length", len(value))
+			return originResult{value: value, found: true}, nil
+		}
+		_, err = h.db.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: key, Value: value, Ttl: h.origin.ttl})
+		if err != nil {
+			h.logger.Warn("error storing an origin value", "key", key, "error", err)
+		}
+		return originResult{value: value, found: true}, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	case res := <-ch:
+		if res.Shared {
+			h.m.dbOriginFetches.WithLabelValues("coalesced").Inc()
+		}
+		if res.Err != nil {
+			return "", false, fmt.Errorf("error fetching %v from the origin: %w", key, res.Err)
+		}
+		r := res.Val.(originResult)
+		return r.value, r.found, nil
+	}
+}
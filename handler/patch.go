@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// MergePatchContentType is the media type of an RFC 7396 JSON Merge Patch
+const MergePatchContentType = "application/merge-patch+json"
+
+// Errors returned from the update of a patch to leave the stored value unchanged. errNotJSON is also returned when
+// projecting a value that is not JSON.
+var (
+	errNotJSON         = errors.New("the stored value is not a JSON document")
+	errPatchedTooLarge = errors.New("the patched value is over the maximum value length")
+)
+
+// decodeJSON decodes a single JSON document, keeping numbers as they were written so that patching a document does
+// not round its other numbers through float64
+func decodeJSON(data []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON document")
+	}
+	return v, nil
+}
+
+// mergePatch applies an RFC 7396 merge patch to a target document. Members of a patch object replace the members of
+// the target with the same name, recursively for objects, and null members remove them. Any other patch replaces the
+// target entirely.
+func mergePatch(target any, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], value)
+		}
+	}
+	return t
+}
+
+// patchHandler applies a JSON merge patch from the request body to the JSON document stored under the request key
+// and returns the patched document. The patch is applied atomically by the database so concurrent patches to
+// different members of a document are never lost. Members of the patched document are written in sorted order.
+func (h *Wrapper) patchHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != MergePatchContentType {
+		writeJSONError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMedia,
+			"Patches must be sent as "+MergePatchContentType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(h.s.maxValueLength)))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when reading patch request: %v", err))
+		return
+	}
+	patch, err := decodeJSON(body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing patch request: %v", err))
+		return
+	}
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+
+	var patched string
+	found, err := h.db.Update(key, func(value string) (string, error) {
+		target, err := decodeJSON([]byte(value))
+		if err != nil {
+			return "", errNotJSON
+		}
+		b, err := json.Marshal(mergePatch(target, patch))
+		if err != nil {
+			return "", err
+		}
+		patched = string(b)
+		if h.validate.Var(patched, "dbvalue") != nil {
+			return "", errPatchedTooLarge
+		}
+		return patched, nil
+	})
+	switch {
+	case !found:
+		writeJSONError(w, http.StatusNotFound, CodeKeyNotFound, "Key not found")
+	case errors.Is(err, errNotJSON):
+		writeJSONError(w, http.StatusConflict, CodeValueNotJSON, "Cannot patch the value of "+key+": "+err.Error())
+	case errors.Is(err, errPatchedTooLarge):
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, err.Error())
+	case err != nil:
+		h.writeFailed(w, key, err)
+	default:
+		writeJSON(w, http.StatusOK, getResponse{Key: key, Value: patched})
+	}
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errPathNotFound is returned when a projection path does not exist in a document
+var errPathNotFound = errors.New("the path does not exist in the stored value")
+
+// parsePath parses a projection path into member names and array indexes. Paths are a subset of JSONPath that select
+// a single value: an optional $ root followed by .name members, ["name"] members for names with special characters,
+// and [n] indexes, e.g. $.users[0].name. The $ may be left out for dotted paths like users[0].name.
+func parsePath(path string) ([]any, error) {
+	rest, rooted := strings.CutPrefix(path, "$")
+	if !rooted && rest != "" && rest[0] != '[' {
+		rest = "." + rest
+	}
+
+	var segments []any
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			name := rest[1:end]
+			if name == "" || name == "*" {
+				return nil, fmt.Errorf("invalid path %q: expected a member name at %q", path, rest)
+			}
+			segments = append(segments, name)
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("invalid path %q: unterminated [", path)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, inner[1:len(inner)-1])
+			} else if n, err := strconv.Atoi(inner); err == nil && n >= 0 {
+				segments = append(segments, n)
+			} else {
+				return nil, fmt.Errorf("invalid path %q: expected an index or quoted name in [%s]", path, inner)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path %q: unexpected %q", path, rest[0])
+		}
+	}
+	return segments, nil
+}
+
+// project returns the JSON encoding of the value at the path in a JSON document
+func project(value string, path []any) (string, error) {
+	v, err := decodeJSON([]byte(value))
+	if err != nil {
+		return "", errNotJSON
+	}
+
+	for _, segment := range path {
+		switch s := segment.(type) {
+		case string:
+			object, ok := v.(map[string]any)
+			if !ok {
+				return "", errPathNotFound
+			}
+			if v, ok = object[s]; !ok {
+				return "", errPathNotFound
+			}
+		case int:
+			array, ok := v.([]any)
+			if !ok || s >= len(array) {
+				return "", errPathNotFound
+			}
+			v = array[s]
+		}
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -2,14 +2,19 @@ package handler
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -152,3 +157,404 @@ func TestWrapper_pubSub(t *testing.T) {
 		})
 	}
 }
+
+// bridgeTestImplementation records the messages forwarded to it
+type bridgeTestImplementation struct {
+	mu        sync.Mutex
+	forwarded []string
+	err       error
+}
+
+func (b *bridgeTestImplementation) Forward(channel string, message string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.forwarded = append(b.forwarded, channel+": "+message)
+	return b.err
+}
+
+func TestWrapper_bridges(t *testing.T) {
+	working := &bridgeTestImplementation{}
+	failing := &bridgeTestImplementation{err: errors.New("connection lost")}
+	db := &databaseTestImplementation{}
+	db.info.NodeID = "node-1"
+	h := NewHandler(db, slog.New(slog.DiscardHandler), WithBridges(working, failing))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/v1/subscribe/news", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	// A failing bridge does not stop the message from being published locally or forwarded to the other bridges
+	resp2, err := http.Post(ts.URL+"/v1/publish/news", "application/json", strings.NewReader(`{"message":"published"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp2.Body.Close()
+	if resp2.StatusCode != http.StatusOK {
+		t.Errorf("publish status = %v; want %v", resp2.StatusCode, http.StatusOK)
+	}
+	for _, b := range []*bridgeTestImplementation{working, failing} {
+		if len(b.forwarded) != 1 || b.forwarded[0] != "news: published" {
+			t.Errorf("forwarded = %v; want [news: published]", b.forwarded)
+		}
+	}
+
+	// Messages consumed by a bridge reach local subscribers without being forwarded again
+	if sent := h.Deliver("news", "consumed"); sent != 1 {
+		t.Errorf("Deliver sent to %v subscribers; want 1", sent)
+	}
+	if len(working.forwarded) != 1 {
+		t.Errorf("delivered message was forwarded: %v", working.forwarded)
+	}
+	if sent := h.Deliver("empty", "consumed"); sent != 0 {
+		t.Errorf("Deliver to a channel without subscribers sent to %v; want 0", sent)
+	}
+
+	// Messages relayed by a peer reach local subscribers without being forwarded again, unless this instance relayed
+	// them to itself
+	for _, relay := range []struct{ from, message string }{{"node-1", "own"}, {"node-2", "relayed"}} {
+		req, _ := http.NewRequest("POST", ts.URL+"/v1/publish/news", strings.NewReader(`{"message":"`+relay.message+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(RelayHeader, relay.from)
+		resp3, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp3.Body.Close()
+		if resp3.StatusCode != http.StatusOK {
+			t.Errorf("relayed publish status = %v; want %v", resp3.StatusCode, http.StatusOK)
+		}
+	}
+	if len(working.forwarded) != 1 {
+		t.Errorf("relayed message was forwarded: %v", working.forwarded)
+	}
+
+	var messages []string
+	for len(messages) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+			messages = append(messages, m)
+		}
+	}
+	if !slices.Equal(messages, []string{"published", "consumed", "relayed"}) {
+		t.Errorf("subscriber received %v; want [published consumed relayed]", messages)
+	}
+}
+
+func TestWrapper_slowConsumer(t *testing.T) {
+	db := &databaseTestImplementation{}
+	h := NewHandler(db, slog.New(slog.DiscardHandler), WithSlowConsumerTimeout(50*time.Millisecond))
+
+	// A subscriber that never reads keeps up until its buffer is full
+	s := newSubscriber("")
+	h.broker.mu.Lock()
+	h.broker.subscribers++
+	h.subscribe("slow", s)
+	h.broker.mu.Unlock()
+	for i := 0; i < subscriberBuffer; i++ {
+		if sent := h.Deliver("slow", "message"); sent != 1 {
+			t.Fatalf("Deliver %v sent to %v subscribers; want 1", i, sent)
+		}
+	}
+	if lagging := testutil.ToFloat64(h.m.dbLaggingSubscribers); lagging != 0 {
+		t.Errorf("lagging subscribers = %v; want 0", lagging)
+	}
+
+	// Once full it drops messages and counts as lagging, but stays connected until the timeout
+	if sent := h.Deliver("slow", "dropped"); sent != 0 {
+		t.Errorf("Deliver to a full subscriber sent to %v; want 0", sent)
+	}
+	if lagging := testutil.ToFloat64(h.m.dbLaggingSubscribers); lagging != 1 {
+		t.Errorf("lagging subscribers = %v; want 1", lagging)
+	}
+	select {
+	case <-s.kick:
+		t.Fatal("subscriber was disconnected before the timeout")
+	default:
+	}
+
+	// Writing its messages catches the subscriber up again, until its buffer fills up once more
+	s.drain(nil)
+	for range subscriberBuffer {
+		h.Deliver("slow", "message")
+	}
+	if lagging := testutil.ToFloat64(h.m.dbLaggingSubscribers); lagging != 0 {
+		t.Errorf("lagging subscribers after catching up = %v; want 0", lagging)
+	}
+
+	h.Deliver("slow", "dropped")
+	time.Sleep(60 * time.Millisecond)
+	h.Deliver("slow", "dropped")
+	select {
+	case <-s.kick:
+	default:
+		t.Fatal("subscriber lagging past the timeout was not disconnected")
+	}
+	if dropped := s.dropped.Load(); dropped != 3 {
+		t.Errorf("dropped = %v; want 3", dropped)
+	}
+
+	h.broker.mu.Lock()
+	h.unsubscribe("slow", s)
+	h.broker.mu.Unlock()
+	if lagging := testutil.ToFloat64(h.m.dbLaggingSubscribers); lagging != 0 {
+		t.Errorf("lagging subscribers after unsubscribing = %v; want 0", lagging)
+	}
+}
+
+func TestWrapper_consumerGroups(t *testing.T) {
+	db := &databaseTestImplementation{}
+	h := NewHandler(db, slog.New(slog.DiscardHandler))
+
+	plain := newSubscriber("")
+	workers := []*subscriber{newSubscriber(""), newSubscriber("")}
+	audit := newSubscriber("")
+	for _, s := range workers {
+		s.group = "workers"
+	}
+	audit.group = "audit"
+	h.broker.mu.Lock()
+	for _, s := range append([]*subscriber{plain, audit}, workers...) {
+		h.broker.subscribers++
+		h.subscribe("jobs", s)
+	}
+	h.broker.mu.Unlock()
+
+	// Every group and the subscriber without one receive each message once
+	for i := range 4 {
+		if sent := h.Deliver("jobs", fmt.Sprintf("job %d", i)); sent != 3 {
+			t.Fatalf("Deliver %v sent to %v subscribers; want 3", i, sent)
+		}
+	}
+	if plain.pending() != 4 || audit.pending() != 4 {
+		t.Errorf("plain and audit subscribers received %v and %v messages; want 4 each", plain.pending(), audit.pending())
+	}
+
+	// The members of a group share the messages evenly without receiving any twice
+	var received []string
+	for _, s := range workers {
+		if s.pending() != 2 {
+			t.Errorf("worker received %v messages; want 2", s.pending())
+		}
+		received, _ = s.drain(received)
+	}
+	slices.Sort(received)
+	if want := []string{"job 0", "job 1", "job 2", "job 3"}; !slices.Equal(received, want) {
+		t.Errorf("workers received %v; want %v", received, want)
+	}
+
+	// A full member is passed over for the next one, and a message is only dropped once every member is full
+	for range subscriberBuffer {
+		h.offer(workers[0], "backlog")
+	}
+	for i := range subscriberBuffer {
+		h.Deliver("jobs", fmt.Sprintf("job %d", i))
+	}
+	if workers[1].pending() != subscriberBuffer || workers[0].dropped.Load() != 0 {
+		t.Errorf("idle worker received %v messages with %v dropped; want %v and none", workers[1].pending(), workers[0].dropped.Load(), subscriberBuffer)
+	}
+	h.Deliver("jobs", "dropped")
+	if dropped := workers[0].dropped.Load() + workers[1].dropped.Load(); dropped != 1 {
+		t.Errorf("workers dropped %v messages once both were full; want 1", dropped)
+	}
+
+	h.broker.mu.Lock()
+	for _, s := range append([]*subscriber{plain, audit}, workers...) {
+		h.unsubscribe("jobs", s)
+	}
+	h.broker.mu.Unlock()
+	if len(h.broker.channels) != 0 {
+		t.Errorf("broker still has channels %v after every subscriber left", h.broker.channels)
+	}
+}
+
+func TestWrapper_fanOut(t *testing.T) {
+	db := &databaseTestImplementation{}
+	h := NewHandler(db, slog.New(slog.DiscardHandler), WithFanOutWorkers(2))
+
+	// Enough subscribers that the message is offered in batches by the workers
+	subscribers := make([]*subscriber, 3*fanOutBatch+1)
+	h.broker.mu.Lock()
+	for i := range subscribers {
+		subscribers[i] = newSubscriber("")
+		h.broker.subscribers++
+		h.subscribe("wide", subscribers[i])
+	}
+	h.broker.mu.Unlock()
+
+	// A full subscriber only loses its own message
+	for range subscriberBuffer {
+		h.offer(subscribers[0], "backlog")
+	}
+	if sent := h.Deliver("wide", "message"); sent != len(subscribers)-1 {
+		t.Errorf("Deliver sent to %v subscribers; want %v", sent, len(subscribers)-1)
+	}
+	for _, s := range subscribers[1:] {
+		if batch, _ := s.drain(nil); !slices.Equal(batch, []string{"message"}) {
+			t.Fatalf("subscriber received %v; want [message]", batch)
+		}
+	}
+
+	// Subscribers can come and go while messages are being delivered, and those that left refuse them
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			h.Deliver("wide", "message")
+		}
+	}()
+	h.broker.mu.Lock()
+	for _, s := range subscribers[:fanOutBatch] {
+		h.unsubscribe("wide", s)
+	}
+	h.broker.mu.Unlock()
+	wg.Wait()
+	for _, s := range subscribers {
+		s.drain(nil)
+	}
+	if sent := h.Deliver("wide", "message"); sent != len(subscribers)-fanOutBatch {
+		t.Errorf("Deliver after unsubscribing sent to %v subscribers; want %v", sent, len(subscribers)-fanOutBatch)
+	}
+	if _, ok := subscribers[1].drain(nil); ok {
+		t.Error("subscriber that left is still open")
+	}
+}
+
+func TestWrapper_heartbeat(t *testing.T) {
+	db := &databaseTestImplementation{}
+	h := NewHandler(db, slog.New(slog.DiscardHandler), WithHeartbeatInterval(20*time.Millisecond))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/v1/subscribe/quiet", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	// An idle subscription is sent heartbeat comments, which are not messages
+	for range 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != ": heartbeat\n" {
+			t.Fatalf("idle subscription received %q; want a heartbeat", line)
+		}
+		_, _ = reader.ReadString('\n')
+	}
+}
+
+func TestWrapper_messageValidators(t *testing.T) {
+	db := &databaseTestImplementation{}
+	h := NewHandler(db, slog.New(slog.DiscardHandler), WithMessageValidator("orders.*", func(channel string, message string) error {
+		if !strings.HasPrefix(message, "{") {
+			return errors.New("orders must be JSON objects")
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		name    string
+		channel string
+		message string
+		status  int
+		code    string
+	}{
+		{name: "Valid message", channel: "orders.eu", message: `{}`, status: http.StatusOK},
+		{name: "Invalid message", channel: "orders.eu", message: "order", status: http.StatusUnprocessableEntity, code: CodeMessageInvalid},
+		{name: "Channel without a validator", channel: "news", message: "order", status: http.StatusOK},
+		{name: "Too large", channel: "news", message: strings.Repeat("m", DefaultMaxMessageLength+1), status: http.StatusRequestEntityTooLarge, code: CodeMessageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := json.Marshal(publishRequest{Message: tt.message})
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/publish/"+tt.channel, bytes.NewReader(b)))
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response envelope
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+		})
+	}
+}
+
+func TestWrapper_channelACL(t *testing.T) {
+	db := &databaseTestImplementation{}
+	h := NewHandler(db, slog.New(slog.DiscardHandler),
+		WithChannelACL("producer", "orders.*", ChannelPublish),
+		WithChannelACL("consumer", "orders.*", ChannelSubscribe))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+		code   string
+	}{
+		{name: "Publish with permission", method: "POST", path: "/v1/publish/orders.eu", token: "producer", status: http.StatusOK},
+		{name: "Publish without permission", method: "POST", path: "/v1/publish/orders.eu", token: "consumer", status: http.StatusForbidden, code: CodeForbidden},
+		{name: "Publish without a token", method: "POST", path: "/v1/publish/orders.eu", status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "Publish with an unknown token", method: "POST", path: "/v1/publish/orders.eu", token: "other", status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "Subscribe without permission", method: "GET", path: "/v1/subscribe/orders.eu", token: "producer", status: http.StatusForbidden, code: CodeForbidden},
+		{name: "Unrestricted channel", method: "POST", path: "/v1/publish/news", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"message":"hello"}`))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			var response envelope
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != "" && (response.Error == nil || response.Error.Code != tt.code) {
+				t.Errorf("error = %v; want code %v", response.Error, tt.code)
+			}
+		})
+	}
+
+	// A permitted subscriber is let through to the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/v1/subscribe/orders.eu", nil)
+	req.Header.Set("Authorization", "Bearer consumer")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("subscribe status = %v; want %v", resp.StatusCode, http.StatusOK)
+	}
+}
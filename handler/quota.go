@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// namespaceSeparator separates the namespace of a key from the rest of the key, matching the database
+const namespaceSeparator = ":"
+
+// namespaceOf returns the namespace of a key, which is everything before the first separator. Keys without a
+// separator belong to the default namespace, "".
+func namespaceOf(key string) string {
+	namespace, _, found := strings.Cut(key, namespaceSeparator)
+	if !found {
+		return ""
+	}
+	return namespace
+}
+
+// tokenBucket limits operations to a rate, allowing bursts of up to a second's worth of operations
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64   // Tokens added per second
+	tokens float64   // Tokens currently available
+	last   time.Time // When tokens were last added
+}
+
+// newTokenBucket returns a full bucket for the rate
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: max(rate, 1), last: time.Now()}
+}
+
+// allow takes a token if one is available. Otherwise, it returns how long until one will be.
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, max(b.rate, 1))
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// admitNamespace counts an operation on the key towards the metrics and rate limit of its namespace. It writes a 429
+// and returns false if the namespace is over its rate limit. Namespaces without a quota are always admitted.
+func (h *Wrapper) admitNamespace(w http.ResponseWriter, key string) bool {
+	namespace := namespaceOf(key)
+	limiter, ok := h.limiters[namespace]
+	if !ok {
+		return true
+	}
+
+	h.m.dbNamespaceRequests.WithLabelValues(namespace).Inc()
+	if limiter == nil {
+		return true
+	}
+	if ok, wait := limiter.allow(time.Now()); !ok {
+		h.m.dbNamespaceRejections.WithLabelValues(namespace, "rate_limited").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeJSONError(w, http.StatusTooManyRequests, CodeRateLimited, "Namespace "+strconv.Quote(namespace)+" is over its rate limit")
+		return false
+	}
+	return true
+}
+
+// limitError is implemented by database errors for writes rejected for exceeding a limit. Quota reports whether the
+// limit is a namespace quota rather than a limit on the size of a single entry.
+type limitError interface {
+	error
+	Quota() bool
+}
+
+// stallError is implemented by database errors for writes failed fast because persistence holds the database.
+// RetryAfter estimates how long until it is released.
+type stallError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// persistenceError is implemented by database errors for writes rejected because persistence keeps failing.
+// PersistenceKind names the kind of persistence that is failing.
+type persistenceError interface {
+	stallError
+	PersistenceKind() string
+}
+
+// writeFailed writes the response for a write to the key that the database rejected. Writes that would take a
+// namespace over its quota receive a 507, and entries over the database's size limits a 400. Writes stalled by
+// persistence, or rejected while it is failing, receive a 503 with a Retry-After header.
+func (h *Wrapper) writeFailed(w http.ResponseWriter, key string, err error) {
+	var limit limitError
+	var stall stallError
+	var failed persistenceError
+	switch {
+	case errors.As(err, &failed):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(failed.RetryAfter().Seconds()))))
+		writeJSONError(w, http.StatusServiceUnavailable, CodePersistenceFailed, err.Error())
+	case errors.As(err, &stall):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(stall.RetryAfter().Seconds()))))
+		writeJSONError(w, http.StatusServiceUnavailable, CodeWriteStalled, err.Error())
+	case errors.As(err, &limit) && limit.Quota():
+		namespace := namespaceOf(key)
+		if _, ok := h.limiters[namespace]; ok {
+			h.m.dbNamespaceRejections.WithLabelValues(namespace, "quota_exceeded").Inc()
+		}
+		writeJSONError(w, http.StatusInsufficientStorage, CodeQuotaExceeded, err.Error())
+	case errors.As(err, &limit):
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, err.Error())
+	default:
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Algorithms of a rate limiter
+const (
+	RateLimitTokenBucket   = "token_bucket"   // Allows bursts of up to the limit, refilling limit tokens per window
+	RateLimitSlidingWindow = "sliding_window" // Allows up to the limit in any window, weighting the previous window by its overlap
+)
+
+// rateLimitPrefix is the internal namespace that the state of rate limiters is stored under
+const rateLimitPrefix = "_ratelimit/"
+
+// errLimiterConflict is returned from the update of a rate limiter checked with a different algorithm than its state
+var errLimiterConflict = errors.New("the rate limiter was created with a different algorithm")
+
+type rateLimitRequest struct {
+	Algorithm string `json:"algorithm" validate:"oneof=token_bucket sliding_window"`
+	Limit     int    `json:"limit" validate:"required,min=1"`
+	Window    int64  `json:"window" validate:"required,min=1,max=86400"` // In seconds
+	Cost      int    `json:"cost" validate:"min=1,ltefield=Limit"`       // The number of requests being checked
+}
+
+type rateLimitResponse struct {
+	Name       string  `json:"name"`
+	Allowed    bool    `json:"allowed"`
+	Remaining  int     `json:"remaining"`  // How many more requests would be allowed right now
+	RetryAfter float64 `json:"retryAfter"` // Seconds until the request would be allowed, or 0 if it was
+}
+
+// rateLimitState is stored as the value of a rate limiter. Times are unix nanoseconds.
+type rateLimitState struct {
+	Algorithm string  `json:"algorithm"`
+	Tokens    float64 `json:"tokens,omitempty"`   // The tokens in the bucket at Last
+	Last      int64   `json:"last,omitempty"`     // When the tokens were last counted
+	Start     int64   `json:"start,omitempty"`    // When the current window started
+	Current   int     `json:"current,omitempty"`  // The requests allowed in the current window
+	Previous  int     `json:"previous,omitempty"` // The requests allowed in the window before
+}
+
+// take checks a request of the cost against the limiter at now, counting it if it is allowed. It returns whether it is
+// allowed, how many more requests would be, and how long until the request would be allowed if it is not.
+func (s *rateLimitState) take(r rateLimitRequest, now time.Time) (bool, int, time.Duration) {
+	window := time.Duration(r.Window) * time.Second
+	limit, cost := float64(r.Limit), float64(r.Cost)
+
+	if s.Algorithm == RateLimitTokenBucket {
+		rate := limit / window.Seconds()
+		if s.Last == 0 {
+			s.Tokens = limit
+		} else {
+			s.Tokens = min(limit, s.Tokens+time.Duration(now.UnixNano()-s.Last).Seconds()*rate)
+		}
+		s.Last = now.UnixNano()
+		if s.Tokens < cost {
+			return false, int(s.Tokens), time.Duration((cost - s.Tokens) / rate * float64(time.Second))
+		}
+		s.Tokens -= cost
+		return true, int(s.Tokens), 0
+	}
+
+	// Move the windows forward, dropping counts that are more than a window old
+	elapsed := time.Duration(now.UnixNano() - s.Start)
+	switch {
+	case s.Start == 0 || elapsed >= 2*window:
+		s.Start, s.Current, s.Previous = now.UnixNano(), 0, 0
+		elapsed = 0
+	case elapsed >= window:
+		s.Start, s.Current, s.Previous = s.Start+int64(window), 0, s.Current
+		elapsed -= window
+	}
+
+	weight := 1 - elapsed.Seconds()/window.Seconds()
+	estimate := float64(s.Previous)*weight + float64(s.Current)
+	if estimate+cost <= limit {
+		s.Current += r.Cost
+		return true, int(limit - estimate - cost), 0
+	}
+
+	// Wait until enough of the previous window has slid out, or else for the current window to become the previous
+	// one and slide out too
+	if float64(s.Current)+cost <= limit {
+		return false, 0, time.Duration((1-(limit-float64(s.Current)-cost)/float64(s.Previous))*float64(window)) - elapsed
+	}
+	return false, 0, window - elapsed + time.Duration((1-(limit-cost)/float64(s.Current))*float64(window))
+}
+
+// rateLimitHandler checks a request against the named rate limiter and counts it if it is allowed, so that clients
+// sharing the limiter never race on a counter of their own. The limiter is stored in the database, and forgotten once
+// it has been left alone long enough to be full again. Denied requests respond with a Retry-After header.
+func (h *Wrapper) rateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	rData := rateLimitRequest{Algorithm: RateLimitTokenBucket, Cost: 1}
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing rate limit request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing rate limit request: %v", err))
+		return
+	}
+	if err := h.validate.Var(name, "dbkey"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing rate limiter name: %v", err))
+		return
+	}
+
+	// Sliding windows also remember the window before the current one
+	key, ttl := rateLimitPrefix+name, rData.Window
+	if rData.Algorithm == RateLimitSlidingWindow {
+		ttl *= 2
+	}
+
+	var allowed bool
+	var remaining int
+	var wait time.Duration
+	_, err := h.db.UpsertTTL(key, ttl, func(value string, exists bool) (string, error) {
+		state := rateLimitState{Algorithm: rData.Algorithm}
+		if exists {
+			if err := json.Unmarshal([]byte(value), &state); err != nil {
+				return "", err
+			}
+			if state.Algorithm != rData.Algorithm {
+				return "", errLimiterConflict
+			}
+		}
+		allowed, remaining, wait = state.take(rData, time.Now())
+		b, err := json.Marshal(state)
+		return string(b), err
+	})
+	switch {
+	case errors.Is(err, errLimiterConflict):
+		writeJSONError(w, http.StatusConflict, CodeLimiterConflict, "Cannot check "+name+": "+err.Error())
+		return
+	case err != nil:
+		h.writeFailed(w, key, err)
+		return
+	}
+
+	response := rateLimitResponse{Name: name, Allowed: allowed, Remaining: remaining, RetryAfter: wait.Seconds()}
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pthav/InMemoryDB/redisfile"
+)
+
+// RedisContentType is the content type of Redis files, both those imported and the commands of an export
+const RedisContentType = "application/octet-stream"
+
+// redisImportResponse is the outcome of an import of a Redis file
+type redisImportResponse struct {
+	Imported int            `json:"imported"`
+	Skipped  map[string]int `json:"skipped"` // The number of keys and commands that were not imported, by reason
+}
+
+// redisImportHandler puts the string keys of a Redis RDB or AOF, sent as the request body with the RedisContentType
+// content type, into the database. The optional db query parameter picks the Redis database, 0 by default. Keys of
+// other types, commands that are not understood, expired keys and keys that are not valid keys here are skipped and
+// counted in the response. Keys that do not expire in Redis are given the default ttl. The import stops at the first
+// put that fails, keeping the keys put before it.
+func (h *Wrapper) redisImportHandler(w http.ResponseWriter, r *http.Request) {
+	db := 0
+	if s := r.URL.Query().Get("db"); s != "" {
+		var err error
+		if db, err = strconv.Atoi(s); err != nil || db < 0 {
+			writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "Invalid db: "+s)
+			return
+		}
+	}
+
+	result, err := redisfile.Read(r.Body, db)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing redis file: %v", err))
+		return
+	}
+
+	response := redisImportResponse{Skipped: result.Skipped}
+	for _, e := range result.Entries {
+		if err = h.validate.Var(e.Key, "dbkey"); err != nil {
+			response.Skipped["invalid key"]++
+			continue
+		}
+
+		ttl := h.defaultTTL(e.Key)
+		if !e.ExpiresAt.IsZero() {
+			// Round up so that the key never expires before it would have in Redis
+			remaining := max(int64(math.Ceil(time.Until(e.ExpiresAt).Seconds())), 1)
+			ttl = &remaining
+		}
+		if _, err = h.db.Put(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Ttl   *int64 `json:"ttl"`
+		}{Key: e.Key, Value: e.Value, Ttl: ttl}); err != nil {
+			h.writeFailed(w, e.Key, err)
+			return
+		}
+		response.Imported++
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// redisExportHandler streams every entry with the optional prefix as Redis commands, a SET followed by a PEXPIREAT if
+// the key expires, in key order. The response can be loaded as the appendonly file of a Redis server or sent to a
+// running one with redis-cli --pipe. Like an export, each page is a consistent snapshot but the export as a whole is
+// not.
+func (h *Wrapper) redisExportHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", RedisContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	rw := redisfile.NewWriter(w)
+	prefix, cursor := r.URL.Query().Get("prefix"), ""
+	for {
+		if r.Context().Err() != nil {
+			return
+		}
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+		var entries []struct {
+			Key   string
+			Value string
+			Ttl   *int64
+		}
+		entries, cursor = h.db.ScanEntries(prefix, cursor, streamPageSize)
+		now := h.db.Now()
+		for _, e := range entries {
+			if isInternalKey(e.Key) {
+				continue
+			}
+			entry := redisfile.Entry{Key: e.Key, Value: e.Value}
+			if e.Ttl != nil {
+				entry.ExpiresAt = now.Add(time.Duration(*e.Ttl) * time.Second)
+			}
+			if err := rw.Write(entry); err != nil {
+				return
+			}
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil || cursor == "" {
+			return
+		}
+	}
+}
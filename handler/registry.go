@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// registryPrefix is the internal namespace that service instances are registered under, as
+// _registry/<service>/<instance>. Each instance holds a lease with the same name as its key so that it is deregistered
+// when it stops sending heartbeats.
+const registryPrefix = "_registry/"
+
+// registryKey returns the key and lease name of an instance of a service
+func registryKey(service string, id string) string {
+	return registryPrefix + service + "/" + id
+}
+
+type registerRequest struct {
+	ID       string            `json:"id" validate:"required,dbkey"`
+	Address  string            `json:"address" validate:"required,max=1024"`
+	Metadata map[string]string `json:"metadata" validate:"max=64"`
+	Ttl      int64             `json:"ttl" validate:"min=1,dbttl"` // How long the instance stays registered without a heartbeat, in seconds
+}
+
+// instanceRecord is the value stored for a registered instance
+type instanceRecord struct {
+	ID       string            `json:"id"`
+	Address  string            `json:"address"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type registerResponse struct {
+	Service string `json:"service"`
+	ID      string `json:"id"`
+	LeaseID string `json:"leaseId"` // Presented to send heartbeats and to deregister
+}
+
+type instancesResponse struct {
+	Service   string           `json:"service"`
+	Instances []instanceRecord `json:"instances"`
+}
+
+type deregisterResponse struct {
+	Service string `json:"service"`
+	ID      string `json:"id"`
+}
+
+// validateService writes a 400 and returns false if the service name from the path is not a valid key
+func (h *Wrapper) validateService(w http.ResponseWriter, service string) bool {
+	if err := h.validate.Var(service, "dbkey"); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "Invalid service name "+service)
+		return false
+	}
+	return true
+}
+
+// registerHandler registers an instance of a service with its address and metadata for a ttl. The instance stays
+// registered for as long as it sends heartbeats within the ttl, and is deregistered when it stops.
+func (h *Wrapper) registerHandler(w http.ResponseWriter, r *http.Request) {
+	service := mux.Vars(r)["service"]
+	if !h.validateService(w, service) {
+		return
+	}
+
+	var rData registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing register request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing register request: %v", err))
+		return
+	}
+
+	key := registryKey(service, rData.ID)
+	leaseID, ok := h.db.AcquireLease(key, h.clampTTL(rData.Ttl))
+	if !ok {
+		writeJSONError(w, http.StatusConflict, CodeLeaseHeld, "Instance "+rData.ID+" of "+service+" is already registered")
+		return
+	}
+
+	value, _ := json.Marshal(instanceRecord{ID: rData.ID, Address: rData.Address, Metadata: rData.Metadata})
+	if _, _, err := h.db.PutLeased(key, string(value), key, leaseID); err != nil {
+		h.db.ReleaseLease(key, leaseID)
+		h.writeFailed(w, key, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, registerResponse{Service: service, ID: rData.ID, LeaseID: leaseID})
+}
+
+// heartbeatHandler keeps an instance registered for another ttl. A 404 means the instance was deregistered, e.g.
+// because its heartbeats stopped for longer than its ttl, and must register again.
+func (h *Wrapper) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	leaseID, ok := h.decodeLeaseID(w, r)
+	if !ok {
+		return
+	}
+
+	if !h.db.RenewLease(registryKey(vars["service"], vars["id"]), leaseID) {
+		writeJSONError(w, http.StatusNotFound, CodeLeaseNotFound, "Instance not registered")
+		return
+	}
+	writeJSON(w, http.StatusOK, deregisterResponse{Service: vars["service"], ID: vars["id"]})
+}
+
+// deregisterHandler removes an instance of a service, e.g. when it shuts down gracefully
+func (h *Wrapper) deregisterHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	leaseID, ok := h.decodeLeaseID(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok = h.db.ReleaseLease(registryKey(vars["service"], vars["id"]), leaseID); !ok {
+		writeJSONError(w, http.StatusNotFound, CodeLeaseNotFound, "Instance not registered")
+		return
+	}
+	writeJSON(w, http.StatusOK, deregisterResponse{Service: vars["service"], ID: vars["id"]})
+}
+
+// instances returns every registered instance of a service in order of id
+func (h *Wrapper) instances(service string) []instanceRecord {
+	prefix := registryKey(service, "")
+	instances := []instanceRecord{}
+	cursor := ""
+	for {
+		entries, next := h.db.ScanEntries(prefix, cursor, 1000)
+		for _, e := range entries {
+			var instance instanceRecord
+			if json.Unmarshal([]byte(e.Value), &instance) == nil {
+				instances = append(instances, instance)
+			}
+		}
+		if next == "" {
+			return instances
+		}
+		cursor = next
+	}
+}
+
+// instancesHandler lists the healthy instances of a service, which are those that are still sending heartbeats
+func (h *Wrapper) instancesHandler(w http.ResponseWriter, r *http.Request) {
+	service := mux.Vars(r)["service"]
+	if !h.validateService(w, service) {
+		return
+	}
+	writeJSON(w, http.StatusOK, instancesResponse{Service: service, Instances: h.instances(service)})
+}
+
+// watchHandler streams changes to the instances of a service as server-sent events. The stream starts with a
+// registered event for every current instance, followed by a registered event with the instance for every new
+// registration and a deregistered event with the id for every instance that is deregistered or stops sending
+// heartbeats. Heartbeats themselves are not sent. Events may repeat around the start of the stream, so consumers should
+// treat them as idempotent updates to their view of the service.
+func (h *Wrapper) watchHandler(w http.ResponseWriter, r *http.Request) {
+	service := mux.Vars(r)["service"]
+	if !h.validateService(w, service) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, CodeInternal, "Streaming unsupported")
+		return
+	}
+
+	remove, ok := h.addStreamSubscriber(w, r)
+	if !ok {
+		return
+	}
+	defer remove()
+
+	// Subscribe before listing so that no registration is missed in between
+	prefix := registryKey(service, "")
+	events, unsubscribe := h.db.SubscribeEvents(prefix)
+	defer unsubscribe()
+
+	startEventStream(w, flusher)
+
+	send := func(event string, v any) bool {
+		data, _ := json.Marshal(v)
+		_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+		return err == nil
+	}
+	for _, instance := range h.instances(service) {
+		if !send("registered", instance) {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			id := strings.TrimPrefix(e.Key, prefix)
+			switch e.Type {
+			case "created":
+				entry, loaded := h.db.GetEntry(e.Key)
+				var instance instanceRecord
+				if !loaded || json.Unmarshal([]byte(entry.Value), &instance) != nil {
+					continue
+				}
+				ok = send("registered", instance)
+			case "deleted", "expired":
+				ok = send("deregistered", struct {
+					ID string `json:"id"`
+				}{id})
+			}
+			if !ok {
+				return
+			}
+		}
+	}
+}
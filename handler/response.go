@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Machine-readable error codes returned in the error envelope
+const (
+	CodeBadRequest         = "BAD_REQUEST"             // The request body could not be parsed
+	CodeValidationFailed   = "VALIDATION_FAILED"       // The request body was parsed but is invalid
+	CodeKeyNotFound        = "KEY_NOT_FOUND"           // The key does not exist or has expired
+	CodePathNotFound       = "PATH_NOT_FOUND"          // The projection path does not exist in the stored value
+	CodeKeyExists          = "KEY_EXISTS"              // A client-supplied key already exists
+	CodeRouteNotFound      = "ROUTE_NOT_FOUND"         // No route matches the request path
+	CodeMethodNotAllowed   = "METHOD_NOT_ALLOWED"      // The route does not support the request method
+	CodeRateLimited        = "RATE_LIMITED"            // The client has sent too many requests
+	CodeTooManySubscribers = "TOO_MANY_SUBSCRIBERS"    // The subscriber limit has been reached
+	CodeQuotaExceeded      = "QUOTA_EXCEEDED"          // The write would take the namespace of the key over its quota
+	CodePreconditionFailed = "PRECONDITION_FAILED"     // The value of the key does not match the condition of the request
+	CodeLeaseHeld          = "LEASE_HELD"              // The lease is held by another client
+	CodeLeaseNotFound      = "LEASE_NOT_FOUND"         // No lease with the name and id is held, e.g. because it expired
+	CodeLimiterConflict    = "LIMITER_CONFLICT"        // The rate limiter was created with a different algorithm
+	CodeWebhookNotFound    = "WEBHOOK_NOT_FOUND"       // No webhook is registered with the id
+	CodeScheduleNotFound   = "SCHEDULE_NOT_FOUND"      // No schedule is registered with the id
+	CodeNotReady           = "NOT_READY"               // The database is still loading or warming up
+	CodeWriteStalled       = "WRITE_STALLED"           // The write was failed fast while a snapshot holds the database
+	CodePersistenceFailed  = "PERSISTENCE_FAILED"      // The write was rejected because persistence keeps failing
+	CodeOriginFailed       = "ORIGIN_FAILED"           // The key is not stored and fetching it from the origin failed
+	CodeUnauthorized       = "UNAUTHORIZED"            // The request to an admin route or restricted channel does not carry a valid token
+	CodeForbidden          = "FORBIDDEN"               // The token of the request does not permit the operation on the channel
+	CodeTimeout            = "TIMEOUT"                 // The request did not finish within the deadline of its route
+	CodeCircuitOpen        = "CIRCUIT_OPEN"            // Requests of the route have been failing, so they are rejected for a while
+	CodeWriteQueueTimeout  = "WRITE_QUEUE_TIMEOUT"     // The request gave up waiting in its lane for a write slot
+	CodeUnsupportedMedia   = "UNSUPPORTED_MEDIA_TYPE"  // The request body is not in a supported format
+	CodeValueNotJSON       = "VALUE_NOT_JSON"          // The stored value is not a JSON document so it cannot be patched or projected
+	CodeValueNotBitmap     = "VALUE_NOT_BITMAP"        // The stored value is not a base64 encoded bitmap so its bits cannot be read or set
+	CodeValueNotHLL        = "VALUE_NOT_HLL"           // The stored value is not a HyperLogLog so members cannot be added or counted
+	CodeValueNotGeo        = "VALUE_NOT_GEO"           // The stored value is not a geo set so members cannot be added or searched
+	CodeMemberNotFound     = "MEMBER_NOT_FOUND"        // The member is not in the set stored under the key
+	CodeMessageTooLarge    = "MESSAGE_TOO_LARGE"       // The published message is longer than the message limit
+	CodeMessageInvalid     = "MESSAGE_INVALID"         // The published message was rejected by a validator of its channel
+	CodeChangeFeedDisabled = "CHANGE_FEED_DISABLED"    // The database does not retain changes for the change feed
+	CodeChangesTruncated   = "CHANGES_TRUNCATED"       // The changes after the requested sequence number are no longer retained
+	CodeSearchDisabled     = "SEARCH_DISABLED"         // The database does not index values for search
+	CodeHistoryDisabled    = "HISTORY_DISABLED"        // The database does not retain the history of keys
+	CodeVersionNotFound    = "VERSION_NOT_FOUND"       // The version of the key is not retained in its history
+	CodeStatsDisabled      = "STATS_DISABLED"          // The database does not count the reads and writes of keys
+	CodeUnsupportedVersion = "UNSUPPORTED_API_VERSION" // The API-Version header names a version of the API that is not served
+	CodeAPIVersionMismatch = "API_VERSION_MISMATCH"    // The API-Version header names another version than the path of the request
+	CodeInternal           = "INTERNAL_ERROR"          // The server failed to handle the request
+
+	CodeIdempotencyKeyReused     = "IDEMPOTENCY_KEY_REUSED"      // The idempotency key was used with a different request
+	CodeIdempotencyKeyInProgress = "IDEMPOTENCY_KEY_IN_PROGRESS" // A request with the idempotency key is still being handled
+)
+
+// envelope is the shape of every JSON response. Exactly one of data and error is non-null.
+type envelope struct {
+	Data  any       `json:"data"`
+	Error *apiError `json:"error"`
+}
+
+// apiError describes why a request failed
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSON writes data inside of the response envelope
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	// Hot path responses are encoded by hand into a pooled buffer
+	bp := getBuffer()
+	defer putBuffer(bp)
+	b, ok := appendEnvelope(*bp, data)
+	if ok {
+		*bp = b
+		_, _ = w.Write(b)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(envelope{Data: data})
+	if err != nil {
+		return
+	}
+}
+
+// writeJSONError writes an error inside of the response envelope
+func writeJSONError(w http.ResponseWriter, status int, code string, msg string) {
+	switch sw := w.(type) {
+	case *statusResponseWriter:
+		sw.e = msg
+	case *timeoutWriter:
+		sw.setError(msg)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	bp := getBuffer()
+	defer putBuffer(bp)
+	*bp = appendErrorEnvelope(*bp, code, msg)
+	_, _ = w.Write(*bp)
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// schedulePrefix is the internal namespace that schedules are persisted under so that they survive restarts
+const schedulePrefix = "_schedules/"
+
+type scheduleRequest struct {
+	Cron    string           `json:"cron" validate:"required,max=256"`
+	Publish *schedulePublish `json:"publish" validate:"required_without=Put,excluded_with=Put"` // Publish a message on each run
+	Put     *schedulePut     `json:"put" validate:"required_without=Publish"`                   // Write a key on each run
+}
+
+type schedulePublish struct {
+	Channel string `json:"channel" validate:"required"`
+	Message string `json:"message" validate:"required,dbmessage"`
+}
+
+type schedulePut struct {
+	Key   string `json:"key" validate:"required,dbkey"`
+	Value string `json:"value" validate:"required,dbvalue"`
+	Ttl   *int64 `json:"ttl,omitempty" validate:"omitnil,dbttl"`
+}
+
+// scheduleRecord is a schedule as it is persisted
+type scheduleRecord struct {
+	ID      string           `json:"id"`
+	Cron    string           `json:"cron"`
+	Publish *schedulePublish `json:"publish,omitempty"`
+	Put     *schedulePut     `json:"put,omitempty"`
+}
+
+type scheduleResponse struct {
+	scheduleRecord
+	NextRun time.Time `json:"nextRun"`
+}
+
+type schedulesResponse struct {
+	Schedules []scheduleResponse `json:"schedules"`
+}
+
+// schedule is a registered schedule and the next time it runs
+type schedule struct {
+	scheduleRecord
+	cron cronSchedule
+	next time.Time
+}
+
+type scheduler struct {
+	mu        sync.Mutex
+	schedules map[string]*schedule
+	wake      chan struct{} // Signals the scheduler that the schedules changed
+}
+
+// add registers a schedule to run next after now, wakes the scheduler, and returns when the schedule runs next. A
+// schedule that is already registered is kept as it is.
+func (s *scheduler) add(record scheduleRecord, cron cronSchedule, now time.Time) time.Time {
+	s.mu.Lock()
+	if s.schedules == nil {
+		s.schedules = map[string]*schedule{}
+	}
+	sc, ok := s.schedules[record.ID]
+	if !ok {
+		sc = &schedule{scheduleRecord: record, cron: cron, next: cron.next(now)}
+		s.schedules[record.ID] = sc
+	}
+	next := sc.next
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return next
+}
+
+// registerScheduleHandler registers a recurring publication or key write. The schedule is persisted in the database
+// and runs while RunScheduler is running.
+func (h *Wrapper) registerScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var sData scheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&sData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing schedule request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(sData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing schedule request: %v", err))
+		return
+	}
+	if sData.Put != nil && isInternalKey(sData.Put.Key) {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "Key "+sData.Put.Key+" is reserved")
+		return
+	}
+	cron, err := parseCron(sData.Cron)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Invalid cron expression: %v", err))
+		return
+	}
+	if sData.Put != nil && sData.Put.Ttl != nil {
+		*sData.Put.Ttl = h.clampTTL(*sData.Put.Ttl)
+	}
+
+	record := scheduleRecord{ID: uuid.NewString(), Cron: sData.Cron, Publish: sData.Publish, Put: sData.Put}
+	value, _ := json.Marshal(record)
+	key := schedulePrefix + record.ID
+	if _, err = h.db.Put(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl"`
+	}{Key: key, Value: string(value)}); err != nil {
+		h.writeFailed(w, key, err)
+		return
+	}
+
+	next := h.schedules.add(record, cron, time.Now())
+	writeJSON(w, http.StatusCreated, scheduleResponse{scheduleRecord: record, NextRun: next})
+}
+
+// listSchedulesHandler lists the registered schedules ordered by id
+func (h *Wrapper) listSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	h.schedules.mu.Lock()
+	response := schedulesResponse{Schedules: make([]scheduleResponse, 0, len(h.schedules.schedules))}
+	for _, sc := range h.schedules.schedules {
+		response.Schedules = append(response.Schedules, scheduleResponse{scheduleRecord: sc.scheduleRecord, NextRun: sc.next})
+	}
+	h.schedules.mu.Unlock()
+
+	sort.Slice(response.Schedules, func(i, j int) bool { return response.Schedules[i].ID < response.Schedules[j].ID })
+	writeJSON(w, http.StatusOK, response)
+}
+
+// deleteScheduleHandler deletes a schedule so that it no longer runs
+func (h *Wrapper) deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	h.schedules.mu.Lock()
+	sc, ok := h.schedules.schedules[id]
+	delete(h.schedules.schedules, id)
+	h.schedules.mu.Unlock()
+
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, CodeScheduleNotFound, "Schedule "+id+" not found")
+		return
+	}
+	h.db.Delete(schedulePrefix + id)
+	writeJSON(w, http.StatusOK, scheduleResponse{scheduleRecord: sc.scheduleRecord, NextRun: sc.next})
+}
+
+// RunScheduler loads the schedules persisted in the database and runs them until ctx is done. Runs that were missed
+// while the scheduler was not running are skipped rather than caught up.
+func (h *Wrapper) RunScheduler(ctx context.Context) {
+	h.loadSchedules()
+
+	for {
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if next := h.nextScheduleRun(); !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-h.schedules.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		case now := <-fire:
+			h.runDueSchedules(now)
+		}
+	}
+}
+
+// loadSchedules adds the schedules persisted in the database, skipping records that can no longer be parsed
+func (h *Wrapper) loadSchedules() {
+	now := time.Now()
+	cursor := ""
+	for {
+		entries, next := h.db.ScanEntries(schedulePrefix, cursor, streamPageSize)
+		for _, e := range entries {
+			var record scheduleRecord
+			if err := json.Unmarshal([]byte(e.Value), &record); err != nil {
+				h.logger.Warn("skipping a malformed schedule", "key", e.Key, "error", err)
+				continue
+			}
+			cron, err := parseCron(record.Cron)
+			if err != nil {
+				h.logger.Warn("skipping a schedule with an invalid cron expression", "key", e.Key, "error", err)
+				continue
+			}
+			h.schedules.add(record, cron, now)
+		}
+		if next == "" {
+			return
+		}
+		cursor = next
+	}
+}
+
+// nextScheduleRun returns the earliest time a schedule runs, or the zero time if there are none
+func (h *Wrapper) nextScheduleRun() time.Time {
+	h.schedules.mu.Lock()
+	defer h.schedules.mu.Unlock()
+	var next time.Time
+	for _, sc := range h.schedules.schedules {
+		if !sc.next.IsZero() && (next.IsZero() || sc.next.Before(next)) {
+			next = sc.next
+		}
+	}
+	return next
+}
+
+// runDueSchedules runs every schedule that is due at now and moves it to its next run
+func (h *Wrapper) runDueSchedules(now time.Time) {
+	var due []scheduleRecord
+	h.schedules.mu.Lock()
+	for _, sc := range h.schedules.schedules {
+		if !sc.next.IsZero() && !sc.next.After(now) {
+			due = append(due, sc.scheduleRecord)
+			sc.next = sc.cron.next(now)
+		}
+	}
+	h.schedules.mu.Unlock()
+
+	for _, record := range due {
+		switch {
+		case record.Publish != nil:
+			h.Deliver(record.Publish.Channel, record.Publish.Message)
+			h.forward(record.Publish.Channel, record.Publish.Message)
+		case record.Put != nil:
+			_, err := h.db.Put(struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Ttl   *int64 `json:"ttl"`
+			}{Key: record.Put.Key, Value: record.Put.Value, Ttl: record.Put.Ttl})
+			if err != nil {
+				h.logger.Warn("error running a scheduled write", "schedule", record.ID, "key", record.Put.Key, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// DefaultSearchLimit is the number of keys returned by a search when no limit is given
+const DefaultSearchLimit = 10
+
+// searchResult is a key matching a search. Like mirrorStats, it is an alias of an unnamed struct so that the database
+// satisfies the interface without either package importing the other.
+type searchResult = struct {
+	Key   string
+	Score float64 // The relevance of the key. Higher is more relevant.
+}
+
+type searchRequest struct {
+	Query  string `validate:"required"`
+	Prefix string
+	Limit  int `validate:"min=1,max=1000"`
+}
+
+type searchHit struct {
+	Key   string  `json:"key"`
+	Score float64 `json:"score"`
+}
+
+type searchResponse struct {
+	Results []searchHit `json:"results"` // The most relevant first
+}
+
+// searchHandler returns the keys whose values contain the words of the q query parameter, ranked by relevance. The
+// query parameters prefix and limit are optional. Searching needs the database to maintain a search index, and responds
+// with a 501 otherwise.
+func (h *Wrapper) searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	rData := searchRequest{Query: query.Get("q"), Prefix: query.Get("prefix"), Limit: DefaultSearchLimit}
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing search limit: %v", err))
+			return
+		}
+		rData.Limit = limit
+	}
+
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing search request: %v", err))
+		return
+	}
+
+	results, ok := h.db.Search(rData.Query, rData.Prefix, rData.Limit)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, CodeSearchDisabled, "The database does not have a search index")
+		return
+	}
+
+	// Internal keys are left out, so fewer keys than the limit may be returned
+	results = slices.DeleteFunc(results, func(r searchResult) bool { return isInternalKey(r.Key) })
+	hits := make([]searchHit, len(results))
+	for n, result := range results {
+		hits[n] = searchHit{Key: result.Key, Score: result.Score}
+	}
+	writeJSON(w, http.StatusOK, searchResponse{Results: hits})
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+)
+
+// startupSummary describes what was loaded from the startup files. Like compaction, it is an alias of an unnamed
+// struct.
+type startupSummary = struct {
+	Files            []string      // The startup files that were loaded, in the order they were loaded
+	Loaded           int           // Records applied to the database
+	Skipped          int           // Malformed and duplicate records that were ignored
+	Malformed        int           // Records that could not be parsed
+	Duplicates       int           // Records of operations that were already replayed
+	Expired          int           // Records that had already expired and were dropped
+	Duration         time.Duration // How long loading took
+	MalformedRecords []string      // Where the first malformed records are and why they could not be parsed
+}
+
+type startupReportResponse struct {
+	Files            []string `json:"files"`            // The startup files that were loaded, empty without any
+	Loaded           int      `json:"loaded"`           // Records applied to the database
+	Skipped          int      `json:"skipped"`          // Malformed and duplicate records that were ignored
+	Malformed        int      `json:"malformed"`        // Records that could not be parsed, whose data was lost
+	Duplicates       int      `json:"duplicates"`       // Records of operations that were already replayed
+	Expired          int      `json:"expired"`          // Records that had already expired and were dropped
+	Seconds          float64  `json:"seconds"`          // How long loading took
+	MalformedRecords []string `json:"malformedRecords"` // Where the first malformed records are and why
+}
+
+// startupReportHandler reports what was loaded from the startup files when the database started, so that operators
+// can tell whether records were lost to malformed lines during replay
+func (h *Wrapper) startupReportHandler(w http.ResponseWriter, r *http.Request) {
+	s := h.db.GetStartupSummary()
+	resp := startupReportResponse{
+		Files:            s.Files,
+		Loaded:           s.Loaded,
+		Skipped:          s.Skipped,
+		Malformed:        s.Malformed,
+		Duplicates:       s.Duplicates,
+		Expired:          s.Expired,
+		Seconds:          s.Duration.Seconds(),
+		MalformedRecords: s.MalformedRecords,
+	}
+	if resp.Files == nil {
+		resp.Files = []string{}
+	}
+	if resp.MalformedRecords == nil {
+		resp.MalformedRecords = []string{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
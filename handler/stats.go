@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// keyStats is the access statistics of a key. Like change, it is an alias of an unnamed struct so that the database
+// satisfies the interface without either package importing the other.
+type keyStats = struct {
+	Hits       uint64    // Reads of the key
+	Updates    uint64    // Writes of the key, including the one that created it
+	LastAccess time.Time // When the key was last read or written. The zero time if it has not been since it was loaded.
+	Size       int       // The length in bytes of the key and its stored value, which is compressed if it is large
+}
+
+type statsResponse struct {
+	Key        string     `json:"key"`
+	Hits       uint64     `json:"hits"`
+	Updates    uint64     `json:"updates"`
+	LastAccess *time.Time `json:"lastAccess"` // Null if the key has not been read or written since it was loaded
+	Size       int        `json:"size"`
+}
+
+// statsHandler returns how often the request key was read and written, when it was last used and how large it is, so
+// that clients can tell which keys earn their memory. The stats need the database to count them, and respond with a 501
+// otherwise. Getting the stats of a key does not count as a read.
+func (h *Wrapper) statsHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	stats, exists, ok := h.db.KeyStats(key)
+	switch {
+	case !ok:
+		writeJSONError(w, http.StatusNotImplemented, CodeStatsDisabled, "The database does not count the reads and writes of keys")
+	case !exists:
+		writeJSONError(w, http.StatusNotFound, CodeKeyNotFound, "Key not found")
+	default:
+		response := statsResponse{Key: key, Hits: stats.Hits, Updates: stats.Updates, Size: stats.Size}
+		if !stats.LastAccess.IsZero() {
+			lastAccess := stats.LastAccess.UTC()
+			response.LastAccess = &lastAccess
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NDJSONContentType is the content type of streamed responses, which hold one JSON value per line
+const NDJSONContentType = "application/x-ndjson"
+
+// streamPageSize is the number of keys fetched from the database at a time while streaming
+const streamPageSize = 1000
+
+// streamWriteTimeout bounds how long a client may take to read each page of a stream. Streams are exempt from the
+// server's write timeout since they may legitimately run for much longer, so this keeps a stalled client from holding
+// the stream open forever.
+const streamWriteTimeout = 30 * time.Second
+
+// scanLine is a line of a streamed scan
+type scanLine struct {
+	Key string `json:"key"`
+}
+
+// exportLine is a line of an export. The ttl is the number of seconds remaining, or null if the key never expires.
+type exportLine struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Ttl   *int64 `json:"ttl"`
+}
+
+// wantsNDJSON reports whether the request accepts a streamed NDJSON response
+func wantsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == NDJSONContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// streamNDJSON writes pages from next as NDJSON until next returns an empty cursor. Each page is fetched only once the
+// previous page has been flushed to the client, so the server holds a single page at a time and a slow client slows
+// the stream down rather than letting it buffer. The stream stops as soon as the client goes away.
+func streamNDJSON[T any](w http.ResponseWriter, r *http.Request, cursor string, next func(cursor string) ([]T, string)) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", NDJSONContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	for {
+		if r.Context().Err() != nil {
+			return
+		}
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+		var page []T
+		page, cursor = next(cursor)
+		for _, line := range page {
+			if err := enc.Encode(line); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil || cursor == "" {
+			return
+		}
+	}
+}
+
+// streamScan streams every key with the prefix after the cursor, one {"key": ...} object per line
+func (h *Wrapper) streamScan(w http.ResponseWriter, r *http.Request, prefix string, cursor string) {
+	streamNDJSON(w, r, cursor, func(cursor string) ([]scanLine, string) {
+		keys, next := h.db.Scan(prefix, cursor, streamPageSize)
+		lines := make([]scanLine, 0, len(keys))
+		for _, key := range keys {
+			if !isInternalKey(key) {
+				lines = append(lines, scanLine{Key: key})
+			}
+		}
+		return lines, next
+	})
+}
+
+// exportHandler streams every entry with the prefix as NDJSON, one {"key", "value", "ttl"} object per line in key
+// order. The optional query parameters are prefix and cursor, which resumes an interrupted export after the last key
+// received. Each page is a consistent snapshot but the export as a whole is not, so writes made during an export may
+// or may not appear in it. A request whose If-None-Match holds the ETag of the dataset gets a 304 instead.
+func (h *Wrapper) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.checkGeneration(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	streamNDJSON(w, r, query.Get("cursor"), func(cursor string) ([]exportLine, string) {
+		entries, next := h.db.ScanEntries(query.Get("prefix"), cursor, streamPageSize)
+		lines := make([]exportLine, 0, len(entries))
+		for _, e := range entries {
+			if !isInternalKey(e.Key) {
+				lines = append(lines, exportLine{Key: e.Key, Value: e.Value, Ttl: e.Ttl})
+			}
+		}
+		return lines, next
+	})
+}
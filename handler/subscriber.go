@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subscriberBuffer is the number of messages held for a subscriber that has not written them to its client yet
+const subscriberBuffer = 10
+
+// subscriberRetryAfter is how long clients turned away by a subscriber limit are asked to wait before retrying
+const subscriberRetryAfter = 5 * time.Second
+
+// DefaultHeartbeatInterval is how often an idle subscription is sent a heartbeat comment, so that clients can tell a
+// quiet channel from a dead connection
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// slowConsumerWriteTimeout bounds the write of the disconnect event to a slow consumer, whose connection is likely to
+// be backed up
+const slowConsumerWriteTimeout = time.Second
+
+// subscriber is an SSE subscription to a channel. Its messages wait in a ring buffer until the goroutine serving its
+// client writes them, so that publishing never blocks on a subscriber.
+type subscriber struct {
+	mu     sync.Mutex
+	ring   [subscriberBuffer]string // Messages waiting to be written to the client, starting at head
+	head   int
+	n      int           // The number of messages in the ring
+	closed bool          // Whether the subscriber was unsubscribed, after which messages are refused
+	ready  chan struct{} // Signaled when messages are added to an empty ring or the subscriber is closed
+
+	kick      chan struct{} // Closed to disconnect a subscriber that has stayed full for too long
+	kickOnce  sync.Once
+	fullSince atomic.Int64  // When a message was first dropped since the last delivery in Unix nanoseconds, or zero
+	dropped   atomic.Uint64 // Messages dropped because the buffer was full
+
+	ip    string // The client address the subscription counts towards
+	group string // The consumer group the subscriber shares messages with. Empty if it receives every message.
+}
+
+func newSubscriber(ip string) *subscriber {
+	return &subscriber{ready: make(chan struct{}, 1), kick: make(chan struct{}), ip: ip}
+}
+
+// signal wakes the goroutine writing to the client without blocking. The subscriber lock must be held.
+func (s *subscriber) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pending returns the number of messages waiting to be written to the client
+func (s *subscriber) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// drain appends every waiting message to batch, oldest first, and empties the ring. It returns false once the
+// subscriber is closed and there is nothing left to write.
+func (s *subscriber) drain(batch []string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ; s.n > 0; s.n-- {
+		batch = append(batch, s.ring[s.head])
+		s.ring[s.head] = ""
+		s.head = (s.head + 1) % subscriberBuffer
+	}
+	return batch, !s.closed || len(batch) > 0
+}
+
+// consumerGroup is the subscribers of a channel that share its messages, each message going to a single member
+type consumerGroup struct {
+	name    string
+	members []*subscriber
+	next    atomic.Uint64 // Counts the messages offered to the group, which picks the member that is offered the next one
+}
+
+// channelSubscribers is everyone subscribed to a channel. It is replaced rather than modified when the subscribers
+// change, so that publishers can offer a message to them without holding the broker lock.
+type channelSubscribers struct {
+	subscribers []*subscriber    // Those that receive every message
+	groups      []*consumerGroup // The consumer groups, which each receive every message once
+}
+
+// clientIP returns the address a request came from, without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// admitSubscriber counts a subscription from the client of the request towards the subscriber limits, returning the
+// client address that it counts towards. It writes a 503 with a Retry-After header and returns false if the total or
+// the client's limit has been reached. Every subscriber costs a goroutine and a buffer, so the limits bound the memory
+// that subscribers can hold. The caller must hold the broker lock.
+func (h *Wrapper) admitSubscriber(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ip := clientIP(r)
+	var message string
+	switch {
+	case h.s.maxSubscribers > 0 && h.broker.subscribers >= h.s.maxSubscribers:
+		message = "Too many subscribers"
+	case h.s.maxSubscribersPerIP > 0 && h.broker.perIP[ip] >= h.s.maxSubscribersPerIP:
+		message = "Too many subscriptions from " + ip
+	default:
+		h.broker.subscribers++
+		h.broker.perIP[ip]++
+		return ip, true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(subscriberRetryAfter.Seconds()))))
+	writeJSONError(w, http.StatusServiceUnavailable, CodeTooManySubscribers, message)
+	return "", false
+}
+
+// releaseSubscriber frees up the slot of a subscription from the client address. The caller must hold the broker lock.
+func (h *Wrapper) releaseSubscriber(ip string) {
+	h.broker.subscribers--
+	if n := h.broker.perIP[ip] - 1; n > 0 {
+		h.broker.perIP[ip] = n
+	} else {
+		delete(h.broker.perIP, ip)
+	}
+}
+
+// lag returns how long the subscriber has been dropping messages, or zero if it is keeping up
+func (s *subscriber) lag() time.Duration {
+	since := s.fullSince.Load()
+	if since == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - since)
+}
+
+// offer sends a message to a subscriber without blocking, returning whether it was accepted. A subscriber whose buffer
+// is full drops the message and counts as lagging until it accepts another one. Once it has been lagging for longer
+// than the slow consumer timeout it is disconnected.
+func (h *Wrapper) offer(s *subscriber, message string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if h.push(s, message) {
+		return true
+	}
+
+	s.dropped.Add(1)
+	h.m.dbDroppedMessages.Inc()
+	if s.fullSince.CompareAndSwap(0, time.Now().UnixNano()) {
+		h.m.dbLaggingSubscribers.Inc()
+		return false
+	}
+	if h.s.slowConsumerTimeout > 0 && s.lag() >= h.s.slowConsumerTimeout {
+		s.kickOnce.Do(func() { close(s.kick) })
+	}
+	return false
+}
+
+// tryOffer sends a message to a subscriber if its buffer has room, without counting a drop if it does not
+func (h *Wrapper) tryOffer(s *subscriber, message string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed && h.push(s, message)
+}
+
+// push adds a message to the ring of a subscriber if it has room, which ends its lag. The subscriber lock must be held.
+func (h *Wrapper) push(s *subscriber, message string) bool {
+	if s.n == subscriberBuffer {
+		return false
+	}
+	s.ring[(s.head+s.n)%subscriberBuffer] = message
+	s.n++
+	if s.n == 1 {
+		s.signal()
+	}
+	if s.fullSince.Swap(0) != 0 {
+		h.m.dbLaggingSubscribers.Dec()
+	}
+	return true
+}
+
+// offerGroup sends a message to a single member of a consumer group. The members take turns, so that they share the
+// messages evenly, but a member whose buffer is full is passed over for the next one, so that a message is only
+// dropped when every member is full. The drop is then counted against the member whose turn it was.
+func (h *Wrapper) offerGroup(g *consumerGroup, message string) bool {
+	n := uint64(len(g.members))
+	turn := g.next.Add(1) - 1
+	for i := range n {
+		if h.tryOffer(g.members[(turn+i)%n], message) {
+			return true
+		}
+	}
+	return h.offer(g.members[turn%n], message)
+}
+
+// subscribe adds a subscriber to a channel, or to its consumer group on the channel if it has one. The caller must
+// hold the broker lock.
+func (h *Wrapper) subscribe(channel string, s *subscriber) {
+	next := &channelSubscribers{}
+	if c := h.broker.channels[channel]; c != nil {
+		next.subscribers, next.groups = c.subscribers, c.groups
+	}
+
+	if s.group == "" {
+		next.subscribers = append(slices.Clip(next.subscribers), s)
+		h.broker.channels[channel] = next
+		return
+	}
+	i := slices.IndexFunc(next.groups, func(g *consumerGroup) bool { return g.name == s.group })
+	if i < 0 {
+		next.groups = append(slices.Clip(next.groups), &consumerGroup{name: s.group, members: []*subscriber{s}})
+	} else {
+		next.groups = slices.Clone(next.groups)
+		next.groups[i] = &consumerGroup{name: s.group, members: append(slices.Clip(next.groups[i].members), s)}
+	}
+	h.broker.channels[channel] = next
+}
+
+// unsubscribe removes a subscriber from a channel once its client has gone away, and closes it so that messages
+// offered by publishers that still hold the old subscribers are refused. The caller must hold the broker lock.
+func (h *Wrapper) unsubscribe(channel string, s *subscriber) {
+	c := h.broker.channels[channel]
+	next := &channelSubscribers{subscribers: c.subscribers, groups: c.groups}
+	if s.group == "" {
+		next.subscribers = slices.DeleteFunc(slices.Clone(c.subscribers), func(sub *subscriber) bool { return sub == s })
+	} else {
+		next.groups = slices.Clone(c.groups)
+		i := slices.IndexFunc(next.groups, func(g *consumerGroup) bool { return g.name == s.group })
+		members := slices.DeleteFunc(slices.Clone(next.groups[i].members), func(sub *subscriber) bool { return sub == s })
+		if len(members) == 0 {
+			next.groups = slices.Delete(next.groups, i, i+1)
+		} else {
+			next.groups[i] = &consumerGroup{name: s.group, members: members}
+		}
+	}
+	if len(next.subscribers) == 0 && len(next.groups) == 0 {
+		delete(h.broker.channels, channel)
+	} else {
+		h.broker.channels[channel] = next
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	s.signal()
+	if s.fullSince.Swap(0) != 0 {
+		h.m.dbLaggingSubscribers.Dec()
+	}
+	s.mu.Unlock()
+	h.releaseSubscriber(s.ip)
+}
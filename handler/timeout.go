@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The classes of routes that timeouts and circuit breakers are configured for
+const (
+	RouteRead  = "read"  // GET requests for single keys, ttls and documents
+	RouteScan  = "scan"  // Scans, exports and searches, which may walk the whole database
+	RouteWrite = "write" // Requests that change the database, publish or register something
+	RouteAdmin = "admin" // Requests under /v1/admin
+)
+
+// RouteClasses are the valid route classes
+var RouteClasses = []string{RouteRead, RouteScan, RouteWrite, RouteAdmin}
+
+// routeClass returns the class of a request, or an empty string for long-lived streams, which never time out, and for
+// the health and metrics endpoints, which must keep answering while a class is failing
+func routeClass(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case isStream(path), path == "/readyz", path == "/metrics":
+		return ""
+	case strings.HasPrefix(path, "/v1/admin/"):
+		return RouteAdmin
+	case r.Method == "GET" && (path == "/v1/keys" || path == "/v1/export" || path == "/v1/search"):
+		return RouteScan
+	case r.Method == "GET" || r.Method == "HEAD":
+		return RouteRead
+	default:
+		return RouteWrite
+	}
+}
+
+// WithRouteTimeout sets a deadline for requests of the route class. The request context is canceled at the deadline
+// and the client receives a 504, unless the handler has already started its response, in which case the response is
+// cut off. Zero removes the deadline.
+func WithRouteTimeout(class string, d time.Duration) Options {
+	return func(h *Wrapper) {
+		if h.s.routeTimeouts == nil {
+			h.s.routeTimeouts = map[string]time.Duration{}
+		}
+		h.s.routeTimeouts[class] = d
+	}
+}
+
+// WithCircuitBreaker opens the circuit of a route class after threshold consecutive requests of the class fail with a
+// 5xx, including timeouts. Requests of the class are then rejected with a 503 for the cooldown, after which a single
+// request is let through to test whether the class has recovered. Zero disables the breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Options {
+	return func(h *Wrapper) {
+		h.s.breakerThreshold = threshold
+		h.s.breakerCooldown = cooldown
+	}
+}
+
+// breaker is the circuit breaker of a route class
+type breaker struct {
+	mu        sync.Mutex
+	failures  int       // Consecutive failures while closed
+	openUntil time.Time // When the cooldown ends. Zero while closed.
+	probing   bool      // Whether the request testing a half-open circuit is in flight
+}
+
+// allow reports whether a request may go through, and how long to wait before retrying if not. When the cooldown has
+// ended, the first request is let through as a probe and the rest are rejected until it finishes.
+func (b *breaker) allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return true, 0
+	case now.Before(b.openUntil):
+		return false, b.openUntil.Sub(now)
+	case b.probing:
+		return false, time.Second
+	default:
+		b.probing = true
+		return true, 0
+	}
+}
+
+// record counts the outcome of a request that was let through, opening the circuit once there have been threshold
+// consecutive failures or when a probe fails. It reports whether the circuit opened.
+func (b *breaker) record(failed bool, now time.Time, threshold int, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.probing
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return false
+	}
+
+	b.failures++
+	if probe || b.failures >= threshold {
+		b.failures = 0
+		b.openUntil = now.Add(cooldown)
+		return true
+	}
+	return false
+}
+
+// timeoutWriter guards the response of a handler that may still be running after its deadline. The handler gets its
+// own header map, which is copied to the response when it starts writing, and a response it starts after the deadline
+// is discarded in favor of the timeout response, even if the handler returns before the middleware notices.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	ctx    context.Context // The request context with the deadline
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	status      int
+	e           string // The error message written by the handler, for the logging middleware
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(code)
+}
+
+// writeHeaderLocked starts the handler's response unless it has already started or its deadline has passed
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.timedOut || tw.wroteHeader || tw.expired() {
+		return
+	}
+	tw.wroteHeader = true
+	tw.status = code
+	for k, v := range tw.header {
+		tw.w.Header()[k] = v
+	}
+	tw.w.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || (!tw.wroteHeader && tw.expired()) {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(b)
+}
+
+// expired reports whether the deadline has passed
+func (tw *timeoutWriter) expired() bool {
+	return tw.ctx.Err() == context.DeadlineExceeded
+}
+
+// setError records the error message written by the handler
+func (tw *timeoutWriter) setError(msg string) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.e = msg
+}
+
+// Flush flushes the response unless it has timed out
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if f, ok := tw.w.(http.Flusher); ok && !tw.timedOut {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer, e.g. to set write deadlines
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// timeout sends the timeout response if the handler has not started its own, and discards the handler's later writes.
+// It reports whether the timeout response was sent.
+func (tw *timeoutWriter) timeout(class string, d time.Duration) bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		return false
+	}
+	tw.timedOut = true
+	tw.status = http.StatusGatewayTimeout
+	writeJSONError(tw.w, http.StatusGatewayTimeout, CodeTimeout, fmt.Sprintf("Request exceeded the %v deadline for %v requests", d, class))
+	return true
+}
+
+// routeMiddleware enforces the deadline and circuit breaker of each route class
+func (h *Wrapper) routeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := routeClass(r)
+		if class == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		b := h.breakers[class]
+		if b != nil {
+			if ok, wait := b.allow(time.Now()); !ok {
+				h.m.dbCircuitRejections.WithLabelValues(class).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeJSONError(w, http.StatusServiceUnavailable, CodeCircuitOpen, "Too many "+class+" requests have failed, try again later")
+				return
+			}
+		}
+
+		status := http.StatusInternalServerError // A panic counts as a failure
+		defer func() {
+			if b != nil && b.record(status >= 500, time.Now(), h.s.breakerThreshold, h.s.breakerCooldown) {
+				h.logger.Warn("opened the circuit of a route class", "class", class, "cooldown", h.s.breakerCooldown)
+			}
+		}()
+		status = h.serveWithTimeout(w, r, next, class)
+	})
+}
+
+// serveWithTimeout serves the request within the deadline of its class and returns the response status
+func (h *Wrapper) serveWithTimeout(w http.ResponseWriter, r *http.Request, next http.Handler, class string) int {
+	d := h.s.routeTimeouts[class]
+	if d <= 0 {
+		sw, ok := w.(*statusResponseWriter)
+		if !ok {
+			sw = getStatusWriter(w)
+			defer putStatusWriter(sw)
+		}
+		next.ServeHTTP(sw, r)
+		return sw.statusCode
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	tw := &timeoutWriter{w: w, header: http.Header{}, ctx: ctx, status: http.StatusOK}
+	done := make(chan struct{})
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec != http.ErrAbortHandler {
+					rec = fmt.Sprintf("%v\n%s", rec, debug.Stack())
+				}
+				panicked <- rec
+				return
+			}
+			close(done)
+		}()
+		next.ServeHTTP(tw, r.WithContext(ctx))
+	}()
+
+	select {
+	case <-done:
+	case rec := <-panicked:
+		panic(rec) // Let the recovery middleware handle it on this goroutine
+	case <-ctx.Done():
+	}
+
+	if tw.expired() && tw.timeout(class, d) {
+		h.m.dbRouteTimeouts.WithLabelValues(class).Inc()
+		go func() { // The handler may still panic after the request has been answered
+			select {
+			case <-done:
+			case rec := <-panicked:
+				h.logger.Error("recovered from panic in handler after its deadline", "method", r.Method, "URI", r.RequestURI, "panic", fmt.Sprint(rec))
+			}
+		}()
+		return http.StatusGatewayTimeout
+	}
+
+	// Either the handler is done or its response has started, in which case it finishes with the context canceled
+	select {
+	case <-done:
+	case rec := <-panicked:
+		panic(rec)
+	}
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if sw, ok := w.(*statusResponseWriter); ok && tw.e != "" {
+		sw.e = tw.e
+	}
+	return tw.status
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type touchRequest struct {
+	Ttl *int64 `json:"ttl" validate:"omitnil,dbttl"` // The new ttl. Without one the key is given the default ttl.
+}
+
+// touchHandler gives an existing key a new ttl without sending its value, so that heartbeat-style liveness keys can be
+// kept alive cheaply. The body is optional: without a ttl the key is given the default ttl of its namespace, and the
+// request is rejected if there is none. The response is the new ttl of the key, like a GET of its ttl.
+func (h *Wrapper) touchHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	var rData touchRequest
+	if r.Body != nil {
+		err := json.NewDecoder(r.Body).Decode(&rData)
+		if err != nil && !errors.Is(err, io.EOF) {
+			writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing touch request: %v", err))
+			return
+		}
+	}
+	if err := h.validate.Struct(rData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing touch request: %v", err))
+		return
+	}
+
+	ttl := rData.Ttl
+	if ttl != nil {
+		*ttl = h.clampTTL(*ttl)
+	} else if ttl = h.defaultTTL(key); ttl == nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, "A ttl is required for keys without a default ttl")
+		return
+	}
+
+	if !h.admitNamespace(w, key) {
+		return
+	}
+
+	found, err := h.db.Touch(key, *ttl)
+	if err != nil {
+		h.writeFailed(w, key, err)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, CodeKeyNotFound, "Key not found")
+		return
+	}
+
+	response := getTTLResponse{Key: key}
+	response.TTL, response.ExpiresAt = h.expiration(key)
+	writeJSON(w, http.StatusOK, response)
+}
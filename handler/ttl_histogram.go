@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+)
+
+// ttlBucket counts the keys expiring within a duration from now. Like mirrorStats, it is an alias of an unnamed struct
+// so that the database satisfies the interface without either package importing the other.
+type ttlBucket = struct {
+	Within time.Duration // Keys expiring at most this long from now are counted
+	Keys   int
+	Bytes  int64 // The total length of the keys and their stored values
+}
+
+// ttlHistogramBounds are the buckets of the ttl histogram and their names
+var ttlHistogramBounds = []struct {
+	name  string
+	bound time.Duration
+}{
+	{"minute", time.Minute},
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+}
+
+type ttlBucketResponse struct {
+	Within  string `json:"within"`  // minute, hour or day
+	Seconds int64  `json:"seconds"` // The length of the bucket in seconds
+	Keys    int    `json:"keys"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type ttlHistogramResponse struct {
+	Buckets []ttlBucketResponse `json:"buckets"` // Cumulative, so the hour includes the minute
+	Keys    int                 `json:"keys"`    // The number of keys with a ttl
+	Bytes   int64               `json:"bytes"`   // The total length of the keys with a ttl and their stored values
+}
+
+// ttlHistogramHandler returns how many keys expire within the next minute, hour and day, and how many bytes they
+// free, so that operators can anticipate mass expirations and the memory drops that follow
+func (h *Wrapper) ttlHistogramHandler(w http.ResponseWriter, r *http.Request) {
+	bounds := make([]time.Duration, len(ttlHistogramBounds))
+	for n, b := range ttlHistogramBounds {
+		bounds[n] = b.bound
+	}
+
+	histogram := h.db.GetTTLHistogram(bounds)
+	response := ttlHistogramResponse{Buckets: make([]ttlBucketResponse, len(histogram.Buckets)), Keys: histogram.Total.Keys, Bytes: histogram.Total.Bytes}
+	for n, b := range histogram.Buckets {
+		response.Buckets[n] = ttlBucketResponse{
+			Within:  ttlHistogramBounds[n].name,
+			Seconds: int64(b.Within / time.Second),
+			Keys:    b.Keys,
+			Bytes:   b.Bytes,
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
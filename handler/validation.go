@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Default limits applied by the custom validation rules
+const (
+	DefaultMaxKeyLength     = 256      // The default maximum key length in bytes
+	DefaultMaxValueLength   = 1 << 20  // The default maximum value length in bytes
+	DefaultMaxMessageLength = 64 << 10 // The default maximum published message length in bytes
+)
+
+// newValidator returns a validator with the handler's custom rules registered. The rules close over the limits in s
+// so the validator must be created after all options have been applied.
+//   - dbkey checks the maximum key length and the key pattern, if there is one
+//   - dbvalue checks the maximum value length
+//   - dbmessage checks the maximum published message length
+//   - dbttl checks that a ttl in seconds is within the configured bounds, or accepts any ttl if they are clamped
+func newValidator(s settings) *validator.Validate {
+	v := validator.New()
+
+	_ = v.RegisterValidation("dbkey", func(fl validator.FieldLevel) bool {
+		key := fl.Field().String()
+		return len(key) <= s.maxKeyLength && utf8.ValidString(key) && (s.keyPattern == nil || s.keyPattern.MatchString(key))
+	})
+
+	_ = v.RegisterValidation("dbvalue", func(fl validator.FieldLevel) bool {
+		return len(fl.Field().String()) <= s.maxValueLength
+	})
+
+	_ = v.RegisterValidation("dbmessage", func(fl validator.FieldLevel) bool {
+		return len(fl.Field().String()) <= s.maxMessageLength
+	})
+
+	_ = v.RegisterValidation("dbttl", func(fl validator.FieldLevel) bool {
+		ttl := fl.Field().Int()
+		return s.clampTTL || ttl >= s.minTTL && (s.maxTTL == 0 || ttl <= s.maxTTL)
+	})
+
+	return v
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// APIVersionHeader names the API version of a request and of its response. A request to a path without a version
+// prefix, such as /keys/abc, is served by the version the header names, so that clients can pick a version without
+// changing their URLs.
+const APIVersionHeader = "API-Version"
+
+// apiVersion is a group of routes served under the prefix of the version, such as /v1, with middleware of its own. A
+// version whose responses change in breaking ways is added as a new group next to the old one, so that the clients of
+// the old one keep working.
+type apiVersion struct {
+	name       string      // The version as it is written in paths and in the API-Version header, e.g. v1
+	router     *mux.Router // The router of the handler, which the routes of every version are registered on
+	middleware []mux.MiddlewareFunc
+}
+
+// addVersion adds a version served under /name. Its middleware runs after the middleware shared by every route.
+func (h *Wrapper) addVersion(name string, middleware ...mux.MiddlewareFunc) *apiVersion {
+	v := &apiVersion{name: name, router: h.router}
+	v.middleware = append([]mux.MiddlewareFunc{v.versionMiddleware}, middleware...)
+	h.versions = append(h.versions, v)
+	return v
+}
+
+// HandleFunc registers a route of the version with its path within the version, e.g. /keys for /v1/keys. The routes are
+// registered on the router of the handler rather than on a subrouter, which would answer requests with a method that
+// is not allowed as if their route was not found.
+func (v *apiVersion) HandleFunc(path string, f http.HandlerFunc) *mux.Route {
+	var handler http.Handler = f
+	for n := len(v.middleware) - 1; n >= 0; n-- {
+		handler = v.middleware[n].Middleware(handler)
+	}
+	return v.router.Handle("/"+v.name+path, handler)
+}
+
+// APIVersions returns the names of the API versions served, oldest first
+func (h *Wrapper) APIVersions() []string {
+	names := make([]string, len(h.versions))
+	for n, v := range h.versions {
+		names[n] = v.name
+	}
+	return names
+}
+
+// versionName returns the name of the version in an API-Version header, which may leave out the v, e.g. 1 or v1
+func versionName(requested string) string {
+	requested = strings.ToLower(strings.TrimSpace(requested))
+	if !strings.HasPrefix(requested, "v") {
+		requested = "v" + requested
+	}
+	return requested
+}
+
+// version returns the served version named by an API-Version header
+func (h *Wrapper) version(requested string) (*apiVersion, bool) {
+	requested = versionName(requested)
+	n := slices.IndexFunc(h.versions, func(v *apiVersion) bool { return v.name == requested })
+	if n < 0 {
+		return nil, false
+	}
+	return h.versions[n], true
+}
+
+// versionMiddleware names the version on every response of the version, and rejects requests whose API-Version header
+// names another version than their path
+func (v *apiVersion) versionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(APIVersionHeader, v.name)
+		if requested := r.Header.Get(APIVersionHeader); requested != "" && versionName(requested) != v.name {
+			writeJSONError(w, http.StatusBadRequest, CodeAPIVersionMismatch,
+				fmt.Sprintf("%v %v does not match the version %v of the path", APIVersionHeader, requested, v.name))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// negotiateVersion serves a request to a path without a version prefix with the version named by its API-Version
+// header, by adding the prefix of the version to its path. Requests without the header, and requests to paths served
+// outside of the versions, such as /readyz, are left alone. It returns false if the error response was written because
+// the header names a version that is not served.
+func (h *Wrapper) negotiateVersion(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	requested := r.Header.Get(APIVersionHeader)
+	if requested == "" {
+		return r, true
+	}
+	var match mux.RouteMatch
+	if h.router.Match(r, &match); match.MatchErr != mux.ErrNotFound {
+		return r, true
+	}
+
+	v, ok := h.version(requested)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, CodeUnsupportedVersion, fmt.Sprintf("API version %v is not supported, the supported versions are %v",
+			requested, strings.Join(h.APIVersions(), ", ")))
+		return r, false
+	}
+	r = r.Clone(r.Context())
+	r.URL.Path = "/" + v.name + r.URL.Path
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = "/" + v.name + r.URL.RawPath
+	}
+	return r, true
+}
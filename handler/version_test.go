@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWrapper_apiVersions(t *testing.T) {
+	h := NewHandler(&databaseTestImplementation{}, slog.New(slog.DiscardHandler))
+
+	// A second version is served side by side with its own middleware
+	v2 := h.addVersion("v2", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Version-Middleware", "v2")
+			next.ServeHTTP(w, r)
+		})
+	})
+	v2.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, "pong")
+	}).Methods("GET")
+
+	if got, want := h.APIVersions(), []string{"v1", "v2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("APIVersions() = %v; want %v", got, want)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       string // The API-Version header of the request
+		status       int
+		code         string // The error code of the response, if it fails
+		version      string // The API-Version header of the response
+		v2Middleware bool
+	}{
+		{name: "Versioned path", method: "GET", path: "/v1/openapi.json", status: http.StatusOK, version: "v1"},
+		{name: "Matching header", method: "GET", path: "/v1/openapi.json", header: "v1", status: http.StatusOK, version: "v1"},
+		{name: "Negotiated version", method: "GET", path: "/openapi.json", header: "1", status: http.StatusOK, version: "v1"},
+		{name: "Negotiated newer version", method: "GET", path: "/ping", header: "v2", status: http.StatusOK, version: "v2", v2Middleware: true},
+		{name: "Newer version", method: "GET", path: "/v2/ping", status: http.StatusOK, version: "v2", v2Middleware: true},
+		{name: "Route of another version", method: "GET", path: "/v1/ping", status: http.StatusNotFound, code: CodeRouteNotFound},
+		{name: "Unversioned path without header", method: "GET", path: "/openapi.json", status: http.StatusNotFound, code: CodeRouteNotFound},
+		{name: "Unsupported version", method: "GET", path: "/openapi.json", header: "v9", status: http.StatusBadRequest, code: CodeUnsupportedVersion},
+		{name: "Mismatched version", method: "GET", path: "/v1/openapi.json", header: "2", status: http.StatusBadRequest, code: CodeAPIVersionMismatch, version: "v1"},
+		{name: "Negotiated method not allowed", method: "PATCH", path: "/ttl/key", header: "v1", status: http.StatusMethodNotAllowed, code: CodeMethodNotAllowed},
+		{name: "Unversioned route", method: "GET", path: "/docs", header: "v9", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set(APIVersionHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("response code = %v; want %v", w.Code, tt.status)
+			}
+			if got := w.Header().Get(APIVersionHeader); got != tt.version {
+				t.Errorf("%v = %q; want %q", APIVersionHeader, got, tt.version)
+			}
+			if got := w.Header().Get("X-Version-Middleware") != ""; got != tt.v2Middleware {
+				t.Errorf("v2 middleware ran = %v; want %v", got, tt.v2Middleware)
+			}
+			if tt.code != "" {
+				var body struct {
+					Error apiError `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+					t.Fatalf("decoding response: %v", err)
+				}
+				if body.Error.Code != tt.code {
+					t.Errorf("error code = %v; want %v", body.Error.Code, tt.code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	DefaultWebhookAttempts = 5                      // How many times a webhook delivery is attempted before it is dropped
+	DefaultWebhookBackoff  = 500 * time.Millisecond // The wait before the first retry of a webhook delivery, doubling for each later retry
+	DefaultWebhookTimeout  = 10 * time.Second       // How long a webhook endpoint has to respond to a delivery
+	SignatureHeader        = "X-InMemoryDB-Signature"
+	webhookQueueSize       = 256 // Deliveries waiting for a webhook beyond this are dropped
+)
+
+type webhookRequest struct {
+	URL     string   `json:"url" validate:"required,http_url,max=2048"`
+	Secret  string   `json:"secret" validate:"max=256"`                                                                 // Signs deliveries when set
+	Prefix  string   `json:"prefix" validate:"excluded_with=Channel"`                                                   // Only send events for keys with this prefix
+	Types   []string `json:"types" validate:"excluded_with=Channel,dive,oneof=created updated deleted expired evicted"` // Only send these key event types
+	Channel string   `json:"channel"`                                                                                   // Send messages published to this channel instead of key events
+}
+
+type webhookResponse struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Types   []string `json:"types,omitempty"`
+	Channel string   `json:"channel,omitempty"`
+	Signed  bool     `json:"signed"` // Whether deliveries are signed. The secret itself is never returned.
+}
+
+type webhooksResponse struct {
+	Webhooks []webhookResponse `json:"webhooks"`
+}
+
+// webhookPayload is the body POSTed to a webhook. Key events have a key, and published messages a channel and message.
+type webhookPayload struct {
+	Webhook string    `json:"webhook"`
+	Type    string    `json:"type"`
+	Key     string    `json:"key,omitempty"`
+	Channel string    `json:"channel,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// webhook is a registered webhook with the queue of deliveries waiting to be sent to it
+type webhook struct {
+	webhookResponse
+	secret string
+	queue  chan webhookPayload
+	cancel context.CancelFunc // Stops the routines of the webhook when it is deleted
+}
+
+type webhookRegistry struct {
+	mu    sync.RWMutex
+	hooks map[string]*webhook
+}
+
+// registerWebhookHandler registers a webhook and starts delivering matching events to it. Webhooks are kept in memory,
+// so they are lost when the server restarts and must be registered again.
+func (h *Wrapper) registerWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var wData webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&wData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("Error occurred when parsing webhook request: %v", err))
+		return
+	}
+	if err := h.validate.Struct(wData); err != nil {
+		writeJSONError(w, http.StatusBadRequest, CodeValidationFailed, fmt.Sprintf("Validation errors when parsing webhook request: %v", err))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hook := &webhook{
+		webhookResponse: webhookResponse{
+			ID:      uuid.NewString(),
+			URL:     wData.URL,
+			Prefix:  wData.Prefix,
+			Types:   wData.Types,
+			Channel: wData.Channel,
+			Signed:  wData.Secret != "",
+		},
+		secret: wData.Secret,
+		queue:  make(chan webhookPayload, webhookQueueSize),
+		cancel: cancel,
+	}
+
+	h.webhooks.mu.Lock()
+	if h.webhooks.hooks == nil {
+		h.webhooks.hooks = map[string]*webhook{}
+	}
+	h.webhooks.hooks[hook.ID] = hook
+	h.webhooks.mu.Unlock()
+
+	if hook.Channel == "" {
+		// Subscribe before responding so that events after registration are not missed
+		events, unsubscribe := h.db.SubscribeEvents(hook.Prefix)
+		go func() {
+			defer unsubscribe()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e, ok := <-events:
+					if !ok {
+						return
+					}
+					if isInternalKey(e.Key) || (hook.Types != nil && !slices.Contains(hook.Types, e.Type)) {
+						continue
+					}
+					h.enqueueWebhook(hook, webhookPayload{Webhook: hook.ID, Type: e.Type, Key: e.Key, Time: e.Time})
+				}
+			}
+		}()
+	}
+	go h.deliverWebhooks(ctx, hook)
+
+	writeJSON(w, http.StatusCreated, hook.webhookResponse)
+}
+
+// listWebhooksHandler lists the registered webhooks ordered by id
+func (h *Wrapper) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	h.webhooks.mu.RLock()
+	response := webhooksResponse{Webhooks: make([]webhookResponse, 0, len(h.webhooks.hooks))}
+	for _, hook := range h.webhooks.hooks {
+		response.Webhooks = append(response.Webhooks, hook.webhookResponse)
+	}
+	h.webhooks.mu.RUnlock()
+
+	sort.Slice(response.Webhooks, func(i, j int) bool { return response.Webhooks[i].ID < response.Webhooks[j].ID })
+	writeJSON(w, http.StatusOK, response)
+}
+
+// deleteWebhookHandler deletes a webhook. Deliveries waiting to be sent to it are dropped.
+func (h *Wrapper) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	h.webhooks.mu.Lock()
+	hook, ok := h.webhooks.hooks[id]
+	delete(h.webhooks.hooks, id)
+	h.webhooks.mu.Unlock()
+
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, CodeWebhookNotFound, "Webhook "+id+" not found")
+		return
+	}
+	hook.cancel()
+	writeJSON(w, http.StatusOK, hook.webhookResponse)
+}
+
+// publishToWebhooks queues a published message for the webhooks registered for its channel
+func (h *Wrapper) publishToWebhooks(channel string, message string) {
+	h.webhooks.mu.RLock()
+	defer h.webhooks.mu.RUnlock()
+	for _, hook := range h.webhooks.hooks {
+		if hook.Channel == channel {
+			h.enqueueWebhook(hook, webhookPayload{Webhook: hook.ID, Type: "published", Channel: channel, Message: message, Time: time.Now()})
+		}
+	}
+}
+
+// enqueueWebhook queues a delivery without waiting, dropping it if the webhook has fallen too far behind
+func (h *Wrapper) enqueueWebhook(hook *webhook, payload webhookPayload) {
+	select {
+	case hook.queue <- payload:
+	default:
+		h.m.dbWebhookDeliveries.WithLabelValues("dropped").Inc()
+		h.logger.Warn("dropped a webhook delivery because its queue is full", "webhook", hook.ID, "type", payload.Type)
+	}
+}
+
+// deliverWebhooks sends the queued deliveries of a webhook in order until the webhook is deleted
+func (h *Wrapper) deliverWebhooks(ctx context.Context, hook *webhook) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-hook.queue:
+			result := "delivered"
+			if err := h.deliverWebhook(ctx, hook, payload); err != nil {
+				result = "failed"
+				h.logger.Warn("error delivering a webhook", "webhook", hook.ID, "url", hook.URL, "type", payload.Type, "error", err)
+			}
+			h.m.dbWebhookDeliveries.WithLabelValues(result).Inc()
+		}
+	}
+}
+
+// deliverWebhook POSTs a payload to the webhook, retrying with exponential backoff while the endpoint is unreachable,
+// rate limited, or failing with a server error. Other client errors are not retried.
+func (h *Wrapper) deliverWebhook(ctx context.Context, hook *webhook, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	backoff := h.s.webhookBackoff
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = h.sendWebhook(ctx, hook, body)
+		if err == nil || !retry || attempt >= h.s.webhookAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// sendWebhook makes a single delivery attempt, returning whether a failed attempt should be retried
+func (h *Wrapper) sendWebhook(ctx context.Context, hook *webhook, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.secret != "" {
+		req.Header.Set(SignatureHeader, signWebhook(hook.secret, body))
+	}
+
+	resp, err := h.s.webhookClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded with %v", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded with %v", resp.Status)
+	}
+}
+
+// signWebhook returns the signature header value for a body, which is sha256= followed by the hex encoded HMAC-SHA256
+// of the body keyed with the secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
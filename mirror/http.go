@@ -0,0 +1,91 @@
+// Package mirror provides the targets that writes are forwarded to while migrating data between instances: another
+// InMemoryDB over its HTTP API, or Redis over RESP.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+// DefaultTimeout is how long a single write to a target may take
+const DefaultTimeout = 5 * time.Second
+
+// HTTP mirrors writes to another InMemoryDB through its key endpoints. Keys containing a slash cannot be addressed by
+// the key endpoints and are rejected, which includes the keys that the handler keeps for itself. Writes ask for the
+// priority lane of the target, so that they are not starved by its own clients when it limits concurrent writes.
+type HTTP struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTP returns a target for the InMemoryDB server at the http:// or https:// base URL
+func NewHTTP(baseURL string) (*HTTP, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid mirror url scheme %v", u.Scheme)
+	}
+	return &HTTP{baseURL: strings.TrimSuffix(baseURL, "/"), client: &http.Client{Timeout: DefaultTimeout}}, nil
+}
+
+// Put writes the key with PUT /v1/keys/{key}
+func (h *HTTP) Put(ctx context.Context, key string, value string, ttl *int64) error {
+	body, _ := json.Marshal(struct {
+		Value string `json:"value"`
+		Ttl   *int64 `json:"ttl,omitempty"`
+	}{Value: value, Ttl: ttl})
+	return h.do(ctx, "PUT", key, body)
+}
+
+// Delete deletes the key with DELETE /v1/keys/{key}. A key that does not exist on the target counts as deleted.
+func (h *HTTP) Delete(ctx context.Context, key string) error {
+	return h.do(ctx, "DELETE", key, nil)
+}
+
+// Close closes the idle connections to the target
+func (h *HTTP) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// do sends a request for the key. A 404 for a DELETE means the key is already gone. Other client errors except 408 and
+// 429 are wrapped in database.ErrMirrorRejected since retrying them cannot help.
+func (h *HTTP) do(ctx context.Context, method string, key string, body []byte) error {
+	if strings.Contains(key, "/") {
+		return fmt.Errorf("%w: key %q contains a slash", database.ErrMirrorRejected, key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, h.baseURL+"/v1/keys/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Write-Priority", "high")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300, resp.StatusCode == http.StatusNotFound && method == "DELETE":
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %v %v responded with %v", database.ErrMirrorRejected, method, key, resp.Status)
+	default:
+		return fmt.Errorf("%v %v responded with %v", method, key, resp.Status)
+	}
+}
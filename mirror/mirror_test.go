@@ -0,0 +1,213 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+func TestHTTP(t *testing.T) {
+	ttl := int64(30)
+	tests := []struct {
+		name     string
+		status   int
+		delete   bool
+		key      string
+		ttl      *int64
+		expected string // The request the server receives, if any
+		rejected bool
+		err      bool
+	}{
+		{name: "Put", status: http.StatusCreated, key: "a b", expected: `PUT /v1/keys/a%20b {"value":"v"}`},
+		{name: "Put with a ttl", status: http.StatusOK, key: "a", ttl: &ttl, expected: `PUT /v1/keys/a {"value":"v","ttl":30}`},
+		{name: "Delete", status: http.StatusOK, delete: true, key: "a", expected: "DELETE /v1/keys/a "},
+		{name: "Delete a missing key", status: http.StatusNotFound, delete: true, key: "a", expected: "DELETE /v1/keys/a "},
+		{name: "Rejected", status: http.StatusBadRequest, key: "a", expected: `PUT /v1/keys/a {"value":"v"}`, rejected: true, err: true},
+		{name: "Rate limited", status: http.StatusTooManyRequests, key: "a", expected: `PUT /v1/keys/a {"value":"v"}`, err: true},
+		{name: "Server error", status: http.StatusServiceUnavailable, key: "a", expected: `PUT /v1/keys/a {"value":"v"}`, err: true},
+		{name: "Key with a slash", key: "_schedules/a", rejected: true, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				got = r.Method + " " + r.URL.EscapedPath() + " " + string(body)
+				w.WriteHeader(tt.status)
+			}))
+			defer ts.Close()
+
+			h, err := NewHTTP(ts.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.delete {
+				err = h.Delete(context.Background(), tt.key)
+			} else {
+				err = h.Put(context.Background(), tt.key, "v", tt.ttl)
+			}
+			if (err != nil) != tt.err || errors.Is(err, database.ErrMirrorRejected) != tt.rejected {
+				t.Errorf("err = %v; want an error %v and rejected %v", err, tt.err, tt.rejected)
+			}
+			if got != tt.expected {
+				t.Errorf("request = %q; want %q", got, tt.expected)
+			}
+		})
+	}
+
+	if _, err := NewHTTP("redis://localhost"); err == nil {
+		t.Error("NewHTTP(redis://localhost) = nil error; want an error")
+	}
+}
+
+// fakeRedis serves RESP commands, recording them and replying with the reply for the command name or +OK
+type fakeRedis struct {
+	l        net.Listener
+	replies  map[string]string
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, replies map[string]string) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	f := &fakeRedis{l: l, replies: replies}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+		args := make([]string, n)
+		for i := range args {
+			_, _ = r.ReadString('\n')
+			arg, _ := r.ReadString('\n')
+			args[i] = strings.TrimRight(arg, "\r\n")
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.Join(args, " "))
+		reply, ok := f.replies[args[0]]
+		f.mu.Unlock()
+		if !ok {
+			reply = "+OK"
+		}
+		if reply == "close" {
+			return
+		}
+		_, _ = conn.Write([]byte(reply + "\r\n"))
+	}
+}
+
+func (f *fakeRedis) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.commands)
+}
+
+func TestRedis(t *testing.T) {
+	ttl := int64(30)
+	f := newFakeRedis(t, map[string]string{"DEL": ":1"})
+	r, err := DialRedis("redis://user:secret@" + f.l.Addr().String() + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err = r.Put(context.Background(), "a", "hello world", nil); err != nil {
+		t.Errorf("Put() = %v; want nil", err)
+	}
+	if err = r.Put(context.Background(), "b", "2", &ttl); err != nil {
+		t.Errorf("Put() with a ttl = %v; want nil", err)
+	}
+	if err = r.Delete(context.Background(), "a"); err != nil {
+		t.Errorf("Delete() = %v; want nil", err)
+	}
+	expected := []string{"AUTH user secret", "SELECT 2", "SET a hello world", "SET b 2 EX 30", "DEL a"}
+	if got := f.received(); !slices.Equal(got, expected) {
+		t.Errorf("commands = %q; want %q", got, expected)
+	}
+
+	// Reconnect after the connection is lost
+	_ = r.conn.Close()
+	if err = r.Put(context.Background(), "c", "3", nil); err == nil {
+		t.Error("Put() on a closed connection = nil; want an error")
+	}
+	if err = r.Put(context.Background(), "c", "3", nil); err != nil {
+		t.Errorf("Put() after reconnecting = %v; want nil", err)
+	}
+	if got := f.received(); got[len(got)-1] != "SET c 3" {
+		t.Errorf("last command = %q; want SET c 3", got[len(got)-1])
+	}
+}
+
+func TestRedis_errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    string
+		rejected bool
+	}{
+		{name: "Wrong type", reply: "-WRONGTYPE Operation against a key holding the wrong kind of value", rejected: true},
+		{name: "Loading", reply: "-LOADING Redis is loading the dataset in memory"},
+		{name: "Connection closed", reply: "close"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRedis(t, map[string]string{"SET": tt.reply})
+			r, err := DialRedis("redis://" + f.l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			err = r.Put(context.Background(), "a", "1", nil)
+			if err == nil || errors.Is(err, database.ErrMirrorRejected) != tt.rejected {
+				t.Errorf("Put() = %v; want an error with rejected %v", err, tt.rejected)
+			}
+		})
+	}
+
+	t.Run("Authentication failure", func(t *testing.T) {
+		f := newFakeRedis(t, map[string]string{"AUTH": "-WRONGPASS invalid username-password pair"})
+		if _, err := DialRedis("redis://:wrong@" + f.l.Addr().String()); err == nil {
+			t.Error("DialRedis() = nil error; want an error")
+		}
+	})
+
+	for _, rawURL := range []string{"http://localhost", "redis://localhost/x"} {
+		if _, err := DialRedis(rawURL); err == nil {
+			t.Errorf("DialRedis(%v) = nil error; want an error", rawURL)
+		}
+	}
+}
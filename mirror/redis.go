@@ -0,0 +1,186 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pthav/InMemoryDB/database"
+)
+
+// redisTransientErrors are the error prefixes Redis replies with when a command may succeed if it is retried
+var redisTransientErrors = []string{"LOADING", "BUSY", "TRYAGAIN", "MASTERDOWN", "READONLY"}
+
+// Redis mirrors writes to a Redis server over RESP with SET and DEL. The connection is made again after an I/O error
+// so that the next attempt at a write can succeed once the server is reachable.
+type Redis struct {
+	addr     string
+	user     string
+	password string
+	db       int
+
+	mu   sync.Mutex // Guards the connection
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// DialRedis connects to the Redis server at the redis:// URL. Credentials in the URL are sent with AUTH, and a path
+// such as /2 selects the database.
+func DialRedis(rawURL string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("invalid redis url scheme %v", u.Scheme)
+	}
+	r := &Redis{addr: u.Host}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.user = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil || r.db < 0 {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err = r.connect(context.Background()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// connect dials the server, authenticates and selects the database. The mutex must be held.
+func (r *Redis) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: DefaultTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return err
+	}
+	r.conn, r.r = conn, bufio.NewReader(conn)
+
+	switch {
+	case r.password != "" && r.user != "":
+		err = r.command(ctx, "AUTH", r.user, r.password)
+	case r.password != "" || r.user != "":
+		err = r.command(ctx, "AUTH", r.password+r.user)
+	}
+	if err == nil && r.db != 0 {
+		err = r.command(ctx, "SELECT", strconv.Itoa(r.db))
+	}
+	if err != nil {
+		r.close()
+		return fmt.Errorf("error connecting to redis: %w", err)
+	}
+	return nil
+}
+
+// close closes the connection so that the next command reconnects. The mutex must be held.
+func (r *Redis) close() {
+	if r.conn != nil {
+		_ = r.conn.Close()
+		r.conn, r.r = nil, nil
+	}
+}
+
+// Put writes the key with SET, adding EX when the key has a ttl
+func (r *Redis) Put(ctx context.Context, key string, value string, ttl *int64) error {
+	if ttl == nil {
+		return r.do(ctx, "SET", key, value)
+	}
+	return r.do(ctx, "SET", key, value, "EX", strconv.FormatInt(*ttl, 10))
+}
+
+// Delete deletes the key with DEL
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	return r.do(ctx, "DEL", key)
+}
+
+// Close closes the connection
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.close()
+	return nil
+}
+
+// do sends a command, connecting first if the connection was lost
+func (r *Redis) do(ctx context.Context, args ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			return err
+		}
+	}
+	return r.command(ctx, args...)
+}
+
+// command sends a command as an array of bulk strings and reads its reply. Error replies are wrapped in
+// database.ErrMirrorRejected unless retrying may help, and I/O errors close the connection. The mutex must be held.
+func (r *Redis) command(ctx context.Context, args ...string) error {
+	deadline := time.Now().Add(DefaultTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = r.conn.SetDeadline(deadline)
+
+	b := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		b = fmt.Appendf(b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := r.conn.Write(b); err != nil {
+		r.close()
+		return err
+	}
+
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		r.close()
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		r.close()
+		return errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '$':
+		// A bulk string reply, which is only expected from servers that echo the value. Discard it.
+		n, err := strconv.Atoi(line[1:])
+		if err == nil && n >= 0 {
+			_, err = r.r.Discard(n + 2)
+		}
+		if err != nil {
+			r.close()
+		}
+		return err
+	case '-':
+		msg := line[1:]
+		for _, prefix := range redisTransientErrors {
+			if strings.HasPrefix(msg, prefix) {
+				return fmt.Errorf("redis error: %v", msg)
+			}
+		}
+		return fmt.Errorf("%w: redis error: %v", database.ErrMirrorRejected, msg)
+	default:
+		r.close()
+		return fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
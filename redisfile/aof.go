@@ -0,0 +1,285 @@
+package redisfile
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readAOF applies every command of an AOF. A command cut off by the end of the file, as left by a crash, is skipped
+// like Redis does with aof-load-truncated.
+func (rd *reader) readAOF() error {
+	for n := 1; ; n++ {
+		args, err := rd.readCommand()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			rd.skip("truncated command")
+			return nil
+		case err != nil:
+			return fmt.Errorf("command %d: %w", n, err)
+		}
+		if err = rd.apply(args); err != nil {
+			return fmt.Errorf("command %d: %v: %w", n, strings.ToUpper(args[0]), err)
+		}
+	}
+}
+
+// readLine reads a line without its CRLF
+func (rd *reader) readLine() (string, error) {
+	line, err := rd.r.ReadString('\n')
+	if err != nil {
+		if line != "" {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// readCommand reads a command as an AOF holds it, an array of bulk strings. Annotations such as the timestamps of
+// aof-timestamp-enabled are skipped.
+func (rd *reader) readCommand() ([]string, error) {
+	line, err := rd.readLine()
+	for err == nil && strings.HasPrefix(line, "#") {
+		line, err = rd.readLine()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(line, "*"))
+	if !strings.HasPrefix(line, "*") || err != nil || n < 1 {
+		return nil, fmt.Errorf("expected a command, found %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = rd.readLine(); err != nil {
+			return nil, unexpected(err)
+		}
+		l, err := strconv.ParseUint(strings.TrimPrefix(line, "$"), 10, 64)
+		if !strings.HasPrefix(line, "$") || err != nil {
+			return nil, fmt.Errorf("expected a bulk string, found %q", line)
+		}
+		b, err := rd.readBytes(l + 2)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		args[i] = string(b[:l])
+	}
+	return args, nil
+}
+
+// errSyntax is returned for a command whose arguments are not valid
+var errSyntax = errors.New("syntax error")
+
+// apply applies a command to the keyspace. Commands that are not understood are counted as skipped along with the key
+// they name.
+func (rd *reader) apply(args []string) error {
+	name := strings.ToUpper(args[0])
+	if arity, ok := commandArity[name]; ok && len(args) < arity {
+		return errSyntax
+	}
+
+	keys := rd.keys()
+	switch name {
+	case "MULTI", "EXEC":
+	case "SELECT":
+		db, err := strconv.Atoi(args[1])
+		if err != nil || db < 0 {
+			return errSyntax
+		}
+		rd.cur = db
+	case "FLUSHDB":
+		clear(keys)
+	case "FLUSHALL":
+		clear(rd.dbs)
+	case "SWAPDB":
+		a, errA := strconv.Atoi(args[1])
+		b, errB := strconv.Atoi(args[2])
+		if errA != nil || errB != nil {
+			return errSyntax
+		}
+		rd.dbs[a], rd.dbs[b] = rd.dbs[b], rd.dbs[a]
+	case "SET":
+		return rd.set(args[1], args[2], args[3:])
+	case "SETNX":
+		if _, ok := keys[args[1]]; !ok {
+			keys[args[1]] = Entry{Key: args[1], Value: args[2]}
+		}
+	case "SETEX", "PSETEX":
+		t, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errSyntax
+		}
+		unit := time.Second
+		if name == "PSETEX" {
+			unit = time.Millisecond
+		}
+		keys[args[1]] = Entry{Key: args[1], Value: args[3], ExpiresAt: rd.now.Add(time.Duration(t) * unit)}
+	case "MSET":
+		if len(args)%2 == 0 {
+			return errSyntax
+		}
+		for i := 1; i < len(args); i += 2 {
+			keys[args[i]] = Entry{Key: args[i], Value: args[i+1]}
+		}
+	case "GETSET":
+		keys[args[1]] = Entry{Key: args[1], Value: args[2]}
+	case "GETDEL", "DEL", "UNLINK":
+		for _, key := range args[1:] {
+			delete(keys, key)
+		}
+	case "APPEND":
+		e := keys[args[1]]
+		e.Key, e.Value = args[1], e.Value+args[2]
+		keys[args[1]] = e
+	case "SETRANGE":
+		offset, err := strconv.Atoi(args[2])
+		if err != nil || offset < 0 || offset+len(args[3]) > maxStringLength {
+			return errSyntax
+		}
+		e := keys[args[1]]
+		value := []byte(e.Value)
+		if len(value) < offset+len(args[3]) {
+			value = append(value, make([]byte, offset+len(args[3])-len(value))...)
+		}
+		copy(value[offset:], args[3])
+		e.Key, e.Value = args[1], string(value)
+		keys[args[1]] = e
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		by := int64(1)
+		if len(args) > 2 {
+			var err error
+			if by, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+				return errSyntax
+			}
+		}
+		if strings.HasPrefix(name, "DECR") {
+			by = -by
+		}
+		e := keys[args[1]]
+		n, err := strconv.ParseInt(cmp.Or(e.Value, "0"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("value of %q is not an integer", args[1])
+		}
+		e.Key, e.Value = args[1], strconv.FormatInt(n+by, 10)
+		keys[args[1]] = e
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		t, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errSyntax
+		}
+		e, ok := keys[args[1]]
+		if !ok {
+			return nil
+		}
+		switch name {
+		case "EXPIRE":
+			e.ExpiresAt = rd.now.Add(time.Duration(t) * time.Second)
+		case "PEXPIRE":
+			e.ExpiresAt = rd.now.Add(time.Duration(t) * time.Millisecond)
+		case "EXPIREAT":
+			e.ExpiresAt = time.Unix(t, 0)
+		case "PEXPIREAT":
+			e.ExpiresAt = time.UnixMilli(t)
+		}
+		keys[args[1]] = e
+
+		// Redis deletes a key whose expiration is set in the past
+		if !e.ExpiresAt.After(rd.now) {
+			delete(keys, args[1])
+		}
+	case "PERSIST":
+		if e, ok := keys[args[1]]; ok {
+			e.ExpiresAt = time.Time{}
+			keys[args[1]] = e
+		}
+	case "RENAME", "RENAMENX":
+		e, ok := keys[args[1]]
+		if _, exists := keys[args[2]]; !ok || (exists && name == "RENAMENX") {
+			return nil
+		}
+		delete(keys, args[1])
+		e.Key = args[2]
+		keys[args[2]] = e
+	case "MOVE":
+		db, err := strconv.Atoi(args[2])
+		if err != nil || db < 0 {
+			return errSyntax
+		}
+		cur := rd.cur
+		rd.cur = db
+		target := rd.keys()
+		rd.cur = cur
+		e, ok := keys[args[1]]
+		if _, exists := target[args[1]]; !ok || exists {
+			return nil
+		}
+		delete(keys, args[1])
+		target[args[1]] = e
+	default:
+		if len(args) > 1 {
+			delete(keys, args[1])
+		}
+		rd.skip("command " + name)
+	}
+	return nil
+}
+
+// commandArity is the least number of arguments of the commands that are applied, including the command itself
+var commandArity = map[string]int{
+	"SELECT": 2, "SWAPDB": 3, "SET": 3, "SETNX": 3, "SETEX": 4, "PSETEX": 4, "MSET": 3, "GETSET": 3, "GETDEL": 2,
+	"DEL": 2, "UNLINK": 2, "APPEND": 3, "SETRANGE": 4, "INCR": 2, "DECR": 2, "INCRBY": 3, "DECRBY": 3, "EXPIRE": 3,
+	"PEXPIRE": 3, "EXPIREAT": 3, "PEXPIREAT": 3, "PERSIST": 2, "RENAME": 3, "RENAMENX": 3, "MOVE": 3,
+}
+
+// set applies SET with its options
+func (rd *reader) set(key string, value string, options []string) error {
+	keys := rd.keys()
+	old, exists := keys[key]
+	e := Entry{Key: key, Value: value}
+	for i := 0; i < len(options); i++ {
+		option := strings.ToUpper(options[i])
+		switch option {
+		case "NX":
+			if exists {
+				return nil
+			}
+		case "XX":
+			if !exists {
+				return nil
+			}
+		case "GET":
+		case "KEEPTTL":
+			e.ExpiresAt = old.ExpiresAt
+		case "EX", "PX", "EXAT", "PXAT":
+			if i++; i == len(options) {
+				return errSyntax
+			}
+			t, err := strconv.ParseInt(options[i], 10, 64)
+			if err != nil {
+				return errSyntax
+			}
+			switch option {
+			case "EX":
+				e.ExpiresAt = rd.now.Add(time.Duration(t) * time.Second)
+			case "PX":
+				e.ExpiresAt = rd.now.Add(time.Duration(t) * time.Millisecond)
+			case "EXAT":
+				e.ExpiresAt = time.Unix(t, 0)
+			case "PXAT":
+				e.ExpiresAt = time.UnixMilli(t)
+			}
+		default:
+			return errSyntax
+		}
+	}
+	keys[key] = e
+	return nil
+}
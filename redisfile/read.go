@@ -0,0 +1,411 @@
+// Package redisfile converts between the files of Redis and the entries of InMemoryDB. It reads the string keys of
+// Redis RDB and AOF files, and writes entries as the commands of a Redis AOF, so that data can be migrated in both
+// directions. It does not depend on the database so that both the handler and the command line tools can use it.
+package redisfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// maxStringLength is the longest string that is read, which is the largest value Redis allows
+const maxStringLength = 512 << 20
+
+// Entry is a string key and its value
+type Entry struct {
+	Key       string
+	Value     string
+	ExpiresAt time.Time // The zero time if the key never expires
+}
+
+// Result is what was read from a Redis file
+type Result struct {
+	Entries []Entry        // The string keys of the database that have not expired, sorted by key
+	Skipped map[string]int // The number of keys and commands of the database that could not be imported, by reason
+}
+
+// reader reads a Redis file into the keyspace of every database, since commands such as MOVE and SWAPDB move keys
+// between them
+type reader struct {
+	r       *bufio.Reader
+	db      int                      // The database whose keys are read
+	cur     int                      // The database selected by the file
+	dbs     map[int]map[string]Entry // The string keys of every database
+	skipped map[string]int
+	now     time.Time
+}
+
+// Read reads the string keys of database db from an RDB file, an AOF, or an AOF with an RDB preamble. The files of a
+// Redis 7 appendonly directory can be read by concatenating them in the order of their manifest. Keys of other types
+// and commands that are not understood are counted as skipped. A command that is not understood also skips the key it
+// names, since the key is then either of another type or changed in a way that is unknown. Expirations relative to
+// when a command was written, such as those of SETEX, are taken as relative to now. The RDB checksum is not verified.
+func Read(r io.Reader, db int) (Result, error) {
+	rd := &reader{r: bufio.NewReader(r), db: db, dbs: map[int]map[string]Entry{}, skipped: map[string]int{}, now: time.Now()}
+	if magic, err := rd.r.Peek(5); err == nil && string(magic) == "REDIS" {
+		if err = rd.readRDB(); err != nil {
+			return Result{}, fmt.Errorf("reading rdb: %w", err)
+		}
+	}
+	if err := rd.readAOF(); err != nil {
+		return Result{}, fmt.Errorf("reading aof: %w", err)
+	}
+
+	result := Result{Skipped: rd.skipped}
+	for _, key := range slices.Sorted(maps.Keys(rd.dbs[db])) {
+		e := rd.dbs[db][key]
+		if !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(rd.now) {
+			rd.skipped["expired"]++
+			continue
+		}
+		result.Entries = append(result.Entries, e)
+	}
+	return result, nil
+}
+
+// keys returns the keyspace of the selected database
+func (rd *reader) keys() map[string]Entry {
+	if rd.dbs[rd.cur] == nil {
+		rd.dbs[rd.cur] = map[string]Entry{}
+	}
+	return rd.dbs[rd.cur]
+}
+
+// skip counts a key or command of the selected database that could not be imported
+func (rd *reader) skip(reason string) {
+	if rd.cur == rd.db {
+		rd.skipped[reason]++
+	}
+}
+
+// The opcodes of an RDB file. Bytes below rdbOpcodes are instead the type of the key that follows.
+const (
+	rdbOpcodes      = 0xf4
+	rdbSlotInfo     = 0xf4
+	rdbFunction     = 0xf5
+	rdbIdle         = 0xf8
+	rdbFreq         = 0xf9
+	rdbAux          = 0xfa
+	rdbResizeDB     = 0xfb
+	rdbExpireTimeMS = 0xfc
+	rdbExpireTime   = 0xfd
+	rdbSelectDB     = 0xfe
+	rdbEOF          = 0xff
+)
+
+// rdbTypeString is the type of a string key
+const rdbTypeString = 0
+
+// rdbTypes names the types of keys that are skipped, along with the layout of their encoding: "string" for a single
+// string, "strings" for a length and that many strings, "pairs" for twice as many, "zset" and "zset2" for members with
+// their scores, or "quicklist2" for containers. Streams, modules and hashes with field expirations cannot be skipped.
+var rdbTypes = map[byte]struct {
+	name   string
+	layout string
+}{
+	1:  {"list", "strings"},
+	2:  {"set", "strings"},
+	3:  {"zset", "zset"},
+	4:  {"hash", "pairs"},
+	5:  {"zset", "zset2"},
+	9:  {"hash", "string"},
+	10: {"list", "string"},
+	11: {"set", "string"},
+	12: {"zset", "string"},
+	13: {"hash", "string"},
+	14: {"list", "strings"},
+	16: {"hash", "string"},
+	17: {"zset", "string"},
+	18: {"list", "quicklist2"},
+	20: {"set", "string"},
+}
+
+// readRDB reads an RDB file up to and including its checksum
+func (rd *reader) readRDB() error {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(rd.r, header); err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return fmt.Errorf("invalid rdb version %q", header[5:])
+	}
+
+	var expiresAt time.Time
+	for {
+		op, err := rd.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+
+		switch op {
+		case rdbEOF:
+			if version >= 5 {
+				_, err = rd.r.Discard(8)
+			}
+			return unexpected(err)
+		case rdbSelectDB:
+			var db uint64
+			db, err = rd.readLength()
+			rd.cur = int(db)
+		case rdbExpireTime:
+			var b [4]byte
+			_, err = io.ReadFull(rd.r, b[:])
+			expiresAt = time.Unix(int64(binary.LittleEndian.Uint32(b[:])), 0)
+		case rdbExpireTimeMS:
+			var b [8]byte
+			_, err = io.ReadFull(rd.r, b[:])
+			expiresAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(b[:])))
+		case rdbResizeDB:
+			if _, err = rd.readLength(); err == nil {
+				_, err = rd.readLength()
+			}
+		case rdbAux:
+			if _, err = rd.readString(); err == nil {
+				_, err = rd.readString()
+			}
+		case rdbFreq:
+			_, err = rd.r.ReadByte()
+		case rdbIdle:
+			_, err = rd.readLength()
+		case rdbFunction:
+			_, err = rd.readString()
+		case rdbSlotInfo:
+			for range 3 {
+				if _, err = rd.readLength(); err != nil {
+					break
+				}
+			}
+		default:
+			if op >= rdbOpcodes {
+				return fmt.Errorf("unsupported rdb opcode %#x", op)
+			}
+			err = rd.readKey(op, expiresAt)
+			expiresAt = time.Time{}
+		}
+		if err != nil {
+			return unexpected(err)
+		}
+	}
+}
+
+// readKey reads a key with a value of the type, keeping it if it is a string
+func (rd *reader) readKey(valueType byte, expiresAt time.Time) error {
+	key, err := rd.readString()
+	if err != nil {
+		return err
+	}
+	if valueType == rdbTypeString {
+		value, err := rd.readString()
+		if err == nil {
+			rd.keys()[key] = Entry{Key: key, Value: value, ExpiresAt: expiresAt}
+		}
+		return err
+	}
+
+	t, ok := rdbTypes[valueType]
+	if !ok {
+		return fmt.Errorf("unsupported value type %d of key %q", valueType, key)
+	}
+	if err = rd.skipValue(t.layout); err != nil {
+		return err
+	}
+	delete(rd.keys(), key)
+	rd.skip("type " + t.name)
+	return nil
+}
+
+// skipValue reads past a value that is not a string
+func (rd *reader) skipValue(layout string) error {
+	if layout == "string" {
+		_, err := rd.readString()
+		return err
+	}
+
+	n, err := rd.readLength()
+	if err != nil {
+		return err
+	}
+	for range n {
+		switch layout {
+		case "strings":
+			_, err = rd.readString()
+		case "pairs":
+			if _, err = rd.readString(); err == nil {
+				_, err = rd.readString()
+			}
+		case "zset":
+			// A score is a string of up to 252 bytes, or one of the lengths for NaN and infinities
+			if _, err = rd.readString(); err == nil {
+				var l byte
+				if l, err = rd.r.ReadByte(); err == nil && l < 253 {
+					_, err = rd.r.Discard(int(l))
+				}
+			}
+		case "zset2":
+			if _, err = rd.readString(); err == nil {
+				_, err = rd.r.Discard(8)
+			}
+		case "quicklist2":
+			if _, err = rd.readLength(); err == nil {
+				_, err = rd.readString()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLength reads a length, failing if it is the special encoding of a string
+func (rd *reader) readLength() (uint64, error) {
+	n, special, err := rd.readEncodedLength()
+	if err == nil && special {
+		err = errors.New("unexpected string encoding")
+	}
+	return n, err
+}
+
+// readEncodedLength reads a length, returning whether it is instead the special encoding of a string, in which case
+// the length is the encoding
+func (rd *reader) readEncodedLength() (uint64, bool, error) {
+	b, err := rd.r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := rd.r.ReadByte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case 2:
+		var buf [8]byte
+		switch b {
+		case 0x80:
+			_, err = io.ReadFull(rd.r, buf[:4])
+			return uint64(binary.BigEndian.Uint32(buf[:4])), false, err
+		case 0x81:
+			_, err = io.ReadFull(rd.r, buf[:])
+			return binary.BigEndian.Uint64(buf[:]), false, err
+		}
+		return 0, false, fmt.Errorf("invalid length encoding %#x", b)
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+// readString reads a string, which may be encoded as an integer or compressed with LZF
+func (rd *reader) readString() (string, error) {
+	n, special, err := rd.readEncodedLength()
+	if err != nil {
+		return "", err
+	}
+	if !special {
+		b, err := rd.readBytes(n)
+		return string(b), err
+	}
+
+	var buf [4]byte
+	switch n {
+	case 0:
+		_, err = io.ReadFull(rd.r, buf[:1])
+		return strconv.Itoa(int(int8(buf[0]))), err
+	case 1:
+		_, err = io.ReadFull(rd.r, buf[:2])
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf[:2])))), err
+	case 2:
+		_, err = io.ReadFull(rd.r, buf[:])
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf[:])))), err
+	case 3:
+		compressed, err := rd.readLength()
+		if err != nil {
+			return "", err
+		}
+		length, err := rd.readLength()
+		if err != nil {
+			return "", err
+		}
+		b, err := rd.readBytes(compressed)
+		if err != nil {
+			return "", err
+		}
+		if length > maxStringLength {
+			return "", fmt.Errorf("string of %d bytes is too long", length)
+		}
+		b, err = lzfDecompress(b, int(length))
+		return string(b), err
+	}
+	return "", fmt.Errorf("invalid string encoding %d", n)
+}
+
+// readBytes reads n bytes
+func (rd *reader) readBytes(n uint64) ([]byte, error) {
+	if n > maxStringLength {
+		return nil, fmt.Errorf("string of %d bytes is too long", n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(rd.r, b)
+	return b, err
+}
+
+// lzfDecompress decompresses LZF data into n bytes
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	errCorrupt := errors.New("corrupt lzf string")
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		// A run of literal bytes
+		if ctrl < 32 {
+			if i+ctrl+1 > len(in) {
+				return nil, errCorrupt
+			}
+			out = append(out, in[i:i+ctrl+1]...)
+			i += ctrl + 1
+			continue
+		}
+
+		// A reference back into the output, which may overlap what it copies
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errCorrupt
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+length+2 > n {
+			return nil, errCorrupt
+		}
+		for j := range length + 2 {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
+// unexpected turns the end of a file in the middle of a record into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package redisfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rdbString encodes a string with a 6 bit length
+func rdbString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// command encodes a command as an AOF holds it
+func command(args ...string) string {
+	s := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		s += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return s
+}
+
+func TestRead(t *testing.T) {
+	later := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	var expiry [8]byte
+	binary.LittleEndian.PutUint64(expiry[:], uint64(later.UnixMilli()))
+
+	var rdb bytes.Buffer
+	rdb.WriteString("REDIS0011")
+	rdb.Write(append(append([]byte{rdbAux}, rdbString("redis-ver")...), rdbString("7.2.0")...))
+	rdb.Write([]byte{rdbSelectDB, 0, rdbResizeDB, 6, 1})
+	rdb.Write(append(append([]byte{rdbExpireTimeMS}, expiry[:]...), append(append([]byte{rdbTypeString}, rdbString("ttl")...), rdbString("1")...)...))
+	rdb.Write(append(append([]byte{rdbTypeString}, rdbString("plain")...), rdbString("value")...))
+	rdb.Write(append(append([]byte{rdbTypeString}, rdbString("int")...), 0xc0, 0xf6))
+	// "abcabcabc" as a literal run of abc and a reference copying 6 bytes from 3 back
+	rdb.Write(append(append([]byte{rdbTypeString}, rdbString("lzf")...), 0xc3, 6, 9, 2, 'a', 'b', 'c', 0x80, 2))
+	rdb.Write(append(append(append([]byte{1}, rdbString("list")...), 2), append(rdbString("a"), rdbString("b")...)...))
+	rdb.Write(append(append([]byte{16}, rdbString("hash")...), rdbString("listpack")...))
+	rdb.Write(append(append([]byte{rdbSelectDB, 1, rdbTypeString}, rdbString("other")...), rdbString("db")...))
+	rdb.Write(append([]byte{rdbEOF}, make([]byte, 8)...))
+
+	// The commands after the RDB preamble select the database again
+	aof := command("SELECT", "0") +
+		"#TS:1700000000\r\n" +
+		command("SET", "set", "v", "PXAT", strconv.FormatInt(later.UnixMilli(), 10)) +
+		command("DEL", "plain") +
+		command("INCRBY", "int", "20") +
+		command("APPEND", "lzf", "!") +
+		command("HSET", "ttl", "field", "value") +
+		command("SETEX", "gone", "10", "v") +
+		command("EXPIREAT", "gone", "1700000000") +
+		command("MOVE", "set", "1") +
+		command("MULTI") + command("MSET", "m1", "a", "m2", "b") + command("EXEC") +
+		command("RENAME", "m2", "renamed") +
+		command("SET", "cut", "v")[:10]
+
+	result, err := Read(strings.NewReader(rdb.String()+aof), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{
+		{Key: "int", Value: "10"},
+		{Key: "lzf", Value: "abcabcabc!"},
+		{Key: "m1", Value: "a"},
+		{Key: "renamed", Value: "b"},
+	}
+	if !slices.Equal(result.Entries, want) {
+		t.Errorf("entries = %+v; want %+v", result.Entries, want)
+	}
+	wantSkipped := map[string]int{"type list": 1, "type hash": 1, "command HSET": 1, "truncated command": 1}
+	if !maps.Equal(result.Skipped, wantSkipped) {
+		t.Errorf("skipped = %v; want %v", result.Skipped, wantSkipped)
+	}
+
+	// Database 1 holds its own key and the one moved into it
+	result, err = Read(strings.NewReader(rdb.String()+aof), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Entry{{Key: "other", Value: "db"}, {Key: "set", Value: "v", ExpiresAt: later}}
+	if len(result.Entries) != 2 || result.Entries[0] != want[0] || result.Entries[1].Key != "set" || !result.Entries[1].ExpiresAt.Equal(later) {
+		t.Errorf("entries of database 1 = %+v; want %+v", result.Entries, want)
+	}
+
+	for name, file := range map[string]string{
+		"not a command":      "hello\r\n",
+		"bad bulk string":    "*1\r\nSET\r\n",
+		"bad arguments":      command("SETEX", "k", "soon", "v"),
+		"unsupported rdb":    "REDIS0011" + string([]byte{21}) + string(rdbString("stream")),
+		"truncated rdb":      "REDIS0011" + string([]byte{rdbTypeString}),
+		"incr of non number": command("SET", "k", "v") + command("INCR", "k"),
+	} {
+		if _, err = Read(strings.NewReader(file), 0); err == nil {
+			t.Errorf("reading a file with %v succeeded", name)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	later := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	entries := []Entry{
+		{Key: "a", Value: "multi\r\nline"},
+		{Key: "b", Value: "", ExpiresAt: later},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, e := range entries {
+		if err := w.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := command("SET", "a", "multi\r\nline") + command("SET", "b", "") + command("PEXPIREAT", "b", strconv.FormatInt(later.UnixMilli(), 10))
+	if buf.String() != want {
+		t.Errorf("output = %q; want %q", buf.String(), want)
+	}
+
+	// What is written reads back the same
+	result, err := Read(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Entries) != 2 || result.Entries[0] != entries[0] || !result.Entries[1].ExpiresAt.Equal(later) {
+		t.Errorf("entries = %+v; want %+v", result.Entries, entries)
+	}
+}
@@ -0,0 +1,47 @@
+package redisfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Writer writes entries as the commands of a Redis AOF. Its output can be loaded as the appendonly file of a Redis
+// server or sent to a running one with redis-cli --pipe.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a Writer that writes to w. Call Flush once every entry has been written.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Write writes the entry as a SET, followed by a PEXPIREAT if it expires, which every Redis since 2.6 understands
+func (w *Writer) Write(e Entry) error {
+	if err := w.command("SET", e.Key, e.Value); err != nil {
+		return err
+	}
+	if e.ExpiresAt.IsZero() {
+		return nil
+	}
+	return w.command("PEXPIREAT", e.Key, strconv.FormatInt(e.ExpiresAt.UnixMilli(), 10))
+}
+
+// Flush writes any buffered commands to the underlying writer
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// command writes a command as an array of bulk strings
+func (w *Writer) command(args ...string) error {
+	_, err := fmt.Fprintf(w.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return err
+}
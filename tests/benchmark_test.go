@@ -52,10 +52,12 @@ func generatePut() struct {
 }
 
 func generatePost() struct {
+	Key   string `json:"key"`
 	Value string `json:"value"`
 	Ttl   *int64 `json:"ttl"`
 } {
 	data := struct {
+		Key   string `json:"key"`
 		Value string `json:"value"`
 		Ttl   *int64 `json:"ttl"`
 	}{
@@ -83,6 +85,7 @@ type benchmarkHelperStruct struct {
 	pu           *atomic.Int64
 	poSize       int
 	postRequests []struct {
+		Key   string `json:"key"`
 		Value string `json:"value"`
 		Ttl   *int64 `json:"ttl"`
 	}
@@ -151,6 +154,7 @@ func benchmarkHelper() benchmarkHelperStruct {
 
 	b.poSize = 500000
 	b.postRequests = make([]struct {
+		Key   string `json:"key"`
 		Value string `json:"value"`
 		Ttl   *int64 `json:"ttl"`
 	}, b.poSize)
@@ -330,3 +334,58 @@ func BenchmarkHTTP(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkConcurrencyModes compares the database concurrency modes on mixes of reads and writes over existing keys
+func BenchmarkConcurrencyModes(b *testing.B) {
+	discardLogger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	keySize := 10000
+	keys := make([]string, keySize)
+	for i := range keys {
+		keys[i] = randomString(10)
+	}
+
+	mixes := []struct {
+		name        string
+		readPercent int // The percentage of operations that are GETs. The rest are PUTs.
+	}{
+		{name: "read heavy", readPercent: 99},
+		{name: "mixed", readPercent: 90},
+		{name: "write heavy", readPercent: 50},
+	}
+
+	for _, mode := range []string{database.ConcurrencyRWMutex, database.ConcurrencySharded, database.ConcurrencyCOW} {
+		for _, mix := range mixes {
+			mix := mix // Capture for go routines
+			b.Run(mode+"/"+mix.name, func(b *testing.B) {
+				b.ReportAllocs()
+
+				db, _ := database.NewInMemoryDatabase(database.WithLogger(discardLogger), database.WithConcurrencyMode(mode))
+				for _, key := range keys {
+					db.Put(struct {
+						Key   string `json:"key"`
+						Value string `json:"value"`
+						Ttl   *int64 `json:"ttl"`
+					}{Key: key, Value: "value"})
+				}
+
+				var op atomic.Int64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						n := int(op.Add(1))
+						key := keys[n%keySize]
+						if n%100 < mix.readPercent {
+							db.Get(key)
+						} else {
+							db.Put(struct {
+								Key   string `json:"key"`
+								Value string `json:"value"`
+								Ttl   *int64 `json:"ttl"`
+							}{Key: key, Value: "value"})
+						}
+					}
+				})
+			})
+		}
+	}
+}
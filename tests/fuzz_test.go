@@ -40,6 +40,7 @@ func FuzzDBCreate(f *testing.F) {
 		)
 
 		createRequest := struct {
+			Key   string `json:"key"`
 			Value string `json:"value"`
 			Ttl   *int64 `json:"ttl"`
 		}{
@@ -50,7 +51,7 @@ func FuzzDBCreate(f *testing.F) {
 			createRequest.Ttl = &ttl
 		}
 
-		created, key := db.Create(createRequest)
+		created, key, _ := db.Create(createRequest)
 		if !created {
 			t.Skip("Hash collision")
 		}
@@ -113,7 +114,7 @@ func FuzzDBPut(f *testing.F) {
 			putRequest.Ttl = &ttl
 		}
 
-		updated := db.Put(putRequest)
+		updated, _ := db.Put(putRequest)
 		if updated != exists {
 			t.Errorf("Mismatch between exists and update, %v and %v", exists, updated)
 		}
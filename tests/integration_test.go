@@ -6,7 +6,11 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/pthav/InMemoryDB/cmd"
+	"github.com/pthav/InMemoryDB/cmd/endpoint"
 	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -17,38 +21,101 @@ import (
 func execute(t *testing.T, c *cobra.Command, args ...string) (string, error) {
 	t.Helper()
 
+	// Only the output is returned, so that the response to a failed request can still be decoded
 	buf := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
 	c.SetOut(buf)
-	c.SetErr(buf)
+	c.SetErr(stderr)
 	c.SetArgs(args)
 
 	err := c.Execute()
+	if err != nil {
+		t.Log(strings.TrimSpace(stderr.String()))
+	}
 	return strings.TrimSpace(buf.String()), err
 }
 
+// startServer serves a database on a random port and returns its root URL once the server is listening. The server
+// runs until ctx is canceled and wg is done once it has shut down.
+func startServer(t *testing.T, ctx context.Context, wg *sync.WaitGroup, args ...string) string {
+	t.Helper()
+
+	pr, pw := io.Pipe()
+	serverCmd := cmd.NewRootCmd()
+	serverCmd.SetArgs(append(args, "--host", "localhost:0"))
+	serverCmd.SetOut(pw)
+	serverCmd.SetContext(ctx)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := serverCmd.ExecuteContext(ctx)
+		if err != nil {
+			t.Errorf("Error executing server command with context: %v", err)
+		}
+		_ = pw.Close()
+	}()
+
+	// Read the server output until the bound address is printed, then keep draining it
+	address := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			if a, ok := strings.CutPrefix(scanner.Text(), "LISTENING_ON "); ok {
+				address <- a
+			}
+		}
+	}()
+
+	select {
+	case a := <-address:
+		return "http://" + a
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not start listening")
+		return ""
+	}
+}
+
+type httpError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type httpPostData struct {
+	Key string `json:"key"`
+}
+
 type httpPostResponse struct {
-	Status int    `json:"status"`
-	Key    string `json:"key"`
-	Error  string `json:"error"`
+	Status int          `json:"status"`
+	Data   httpPostData `json:"data"`
+	Error  *httpError   `json:"error"`
+}
+
+type httpGetData struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
 type httpGetResponse struct {
-	Status int    `json:"status"`
-	Key    string `json:"key"`
-	Value  string `json:"value"`
-	Error  string `json:"error"`
+	Status int         `json:"status"`
+	Data   httpGetData `json:"data"`
+	Error  *httpError  `json:"error"`
+}
+
+type httpGetTTLData struct {
+	Key string `json:"key"`
+	TTL *int64 `json:"ttl"`
 }
 
 type httpGetTTLResponse struct {
-	Status int    `json:"status"`
-	Key    string `json:"key"`
-	TTL    *int64 `json:"ttl"`
-	Error  string `json:"error"`
+	Status int            `json:"status"`
+	Data   httpGetTTLData `json:"data"`
+	Error  *httpError     `json:"error"`
 }
 
 type statusPlusErrorResponse struct {
-	Status int    `json:"status"`
-	Error  string `json:"error"`
+	Status int        `json:"status"`
+	Error  *httpError `json:"error"`
 }
 
 func TestInMemoryDB_integration_test(t *testing.T) {
@@ -86,7 +153,7 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 				{
 					args:           []string{"endpoint", "get", "-k", "hello"},
 					cliShouldError: false,
-					expected:       httpGetResponse{Status: 200, Key: "hello", Value: "hello"},
+					expected:       httpGetResponse{Status: 200, Data: httpGetData{Key: "hello", Value: "hello"}},
 				},
 			},
 		},
@@ -111,7 +178,7 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 				{
 					args:           []string{"endpoint", "getTTL", "-k", "hello"},
 					cliShouldError: false,
-					expected:       httpGetTTLResponse{Status: 200, Key: "hello", TTL: intToPtr(10)},
+					expected:       httpGetTTLResponse{Status: 200, Data: httpGetTTLData{Key: "hello", TTL: intToPtr(10)}},
 				},
 			},
 		},
@@ -126,7 +193,7 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 				{
 					args:           []string{"endpoint", "getTTL", "-k", "hello"},
 					cliShouldError: false,
-					expected:       httpGetTTLResponse{Status: 200, Key: "hello", TTL: nil},
+					expected:       httpGetTTLResponse{Status: 200, Data: httpGetTTLData{Key: "hello", TTL: nil}},
 				},
 			},
 		},
@@ -146,12 +213,12 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 				{
 					args:           []string{"endpoint", "get", "-k", "hello"},
 					cliShouldError: false,
-					expected:       httpGetResponse{Status: 200, Key: "hello", Value: "update"},
+					expected:       httpGetResponse{Status: 200, Data: httpGetData{Key: "hello", Value: "update"}},
 				},
 				{
 					args:           []string{"endpoint", "getTTL", "-k", "hello"},
 					cliShouldError: false,
-					expected:       httpGetTTLResponse{Status: 200, Key: "hello", TTL: intToPtr(10)},
+					expected:       httpGetTTLResponse{Status: 200, Data: httpGetTTLData{Key: "hello", TTL: intToPtr(10)}},
 				},
 			},
 		},
@@ -209,7 +276,7 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 				{
 					args:           []string{"endpoint", "put", "-k", "hello", "-v", "hello"},
 					cliShouldError: false,
-					expected:       httpGetResponse{Status: 201},
+					expected:       statusPlusErrorResponse{Status: 201},
 				},
 				{
 					args:           []string{"endpoint", "delete", "-k", "hello"},
@@ -280,31 +347,18 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 	for _, tt := range testCases {
 		t.Run(tt.name, func(t *testing.T) {
 			var wg sync.WaitGroup
-			wg.Add(1)
 			dir := t.TempDir()
-			serverStartArgs := []string{"server", "serve",
+			ctx, cancel := context.WithCancel(context.Background())
+			rootURL := startServer(t, ctx, &wg, "server", "serve",
 				"--db-startup-file", "startup.json",
-				"--db-persist", "--db-persist-cycle", "1", "--db-persist-file", dir + "persist.json",
+				"--db-persist", "--db-persist-cycle", "1", "--db-persist-file", dir+"persist.json",
 				"--no-log",
-			}
-			ctx, cancel := context.WithCancel(context.Background())
-			serverCmd := cmd.NewRootCmd()
-			serverCmd.SetArgs(serverStartArgs)
-			serverCmd.SetContext(ctx)
-			go func() {
-				defer wg.Done()
-				err := serverCmd.ExecuteContext(ctx)
-				if err != nil {
-					t.Errorf("Error executing server command with context: %v", err)
-				}
-			}()
-
-			<-time.After(100 * time.Millisecond) // Wait for server to set up
+			)
 
 			for i, op := range tt.operations {
 				<-time.After(op.wait)
 				t.Logf("Running operation %v with args %v", i, op.args)
-				out, err := execute(t, cmd.NewRootCmd(), op.args...)
+				out, err := execute(t, cmd.NewRootCmd(), slices.Concat(op.args, []string{"-u", rootURL})...)
 
 				if op.cliShouldError {
 					if err == nil {
@@ -313,7 +367,8 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 					continue
 				}
 
-				if err != nil {
+				// Error responses fail the command, but they are still output and checked below
+				if code := endpoint.ExitCode(err); err != nil && code != endpoint.ExitClientError && code != endpoint.ExitServerError {
 					t.Errorf("Expected no error from the CLI but got one: %v", err)
 				}
 
@@ -329,14 +384,14 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 						t.Fatalf("Expected status to be %v but got %v", expected.Status, result.Status)
 					}
 
-					if expected.Status >= 400 && result.Error == "" {
+					if expected.Status >= 400 && result.Error == nil {
 						t.Errorf("Expected error to be non empty but it was empty")
 					} else if expected.Status < 400 {
-						if result.Key == "" {
+						if result.Data.Key == "" {
 							t.Errorf("Expected a key in the response but didn't get one")
 						} else {
 							// Make sure it was created with the value
-							out, err := execute(t, cmd.NewRootCmd(), []string{"endpoint", "get", "-k", result.Key}...)
+							out, err := execute(t, cmd.NewRootCmd(), []string{"endpoint", "get", "-k", result.Data.Key, "-u", rootURL}...)
 							if err != nil {
 								t.Fatalf("Expected no error from the CLI but got one: %v", err)
 							}
@@ -347,15 +402,15 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 								t.Fatalf("Error unmarshalling json: %v", err)
 							}
 
-							if res.Status != 200 || res.Key != result.Key || res.Value != op.postValue {
+							if res.Status != 200 || res.Data.Key != result.Data.Key || res.Data.Value != op.postValue {
 								t.Errorf("Expected response to be %v, %v, %v. Instead got %v, %v, %v",
-									200, result.Key, op.postValue, res.Status, res.Key, res.Value,
+									200, result.Data.Key, op.postValue, res.Status, res.Data.Key, res.Data.Value,
 								)
 							}
 
 							// Make sure it was created with the TTL
 							if op.postTTL != 0 {
-								out, err := execute(t, cmd.NewRootCmd(), []string{"endpoint", "getTTL", "-k", result.Key}...)
+								out, err := execute(t, cmd.NewRootCmd(), []string{"endpoint", "getTTL", "-k", result.Data.Key, "-u", rootURL}...)
 								if err != nil {
 									t.Fatalf("Expected no error from the CLI but got one: %v", err)
 								}
@@ -366,9 +421,9 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 									t.Fatalf("Error unmarshalling json: %v", err)
 								}
 
-								if res.Status != 200 || res.Key != result.Key || *res.TTL < op.postTTL-2 {
+								if res.Status != 200 || res.Data.Key != result.Data.Key || *res.Data.TTL < op.postTTL-2 {
 									t.Errorf("Expected response to be %v, %v, %v. Instead got %v, %v, %v",
-										200, result.Key, op.postTTL, res.Status, res.Key, *res.TTL,
+										200, result.Data.Key, op.postTTL, res.Status, res.Data.Key, *res.Data.TTL,
 									)
 								}
 							}
@@ -386,14 +441,14 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 						t.Fatalf("Expected status to be %v but got %v", expected.Status, result.Status)
 					}
 
-					if expected.Status >= 400 && result.Error == "" {
+					if expected.Status >= 400 && result.Error == nil {
 						t.Errorf("Expected error to be non empty but it was empty")
 					} else if expected.Status < 400 {
-						if result.Key != expected.Key {
-							t.Errorf("Expected key to be %v but got %v", expected.Key, result.Key)
+						if result.Data.Key != expected.Data.Key {
+							t.Errorf("Expected key to be %v but got %v", expected.Data.Key, result.Data.Key)
 						}
-						if result.Value != expected.Value {
-							t.Errorf("Expected value to be %v but got %v", expected.Value, result.Value)
+						if result.Data.Value != expected.Data.Value {
+							t.Errorf("Expected value to be %v but got %v", expected.Data.Value, result.Data.Value)
 						}
 					}
 				case statusPlusErrorResponse:
@@ -404,7 +459,7 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 						t.Errorf("Error unmarshalling json: %v", err)
 					}
 
-					if expected.Status >= 400 && result.Error == "" {
+					if expected.Status >= 400 && result.Error == nil {
 						t.Errorf("Expected response to be %v but got %v", op.expected, result)
 					}
 				case httpGetTTLResponse:
@@ -418,17 +473,17 @@ func TestInMemoryDB_integration_test(t *testing.T) {
 						t.Fatalf("Expected status to be %v but got %v", expected.Status, result.Status)
 					}
 
-					if expected.Status >= 400 && result.Error == "" {
+					if expected.Status >= 400 && result.Error == nil {
 						t.Errorf("Expected error to be non empty but it was empty")
 					} else if expected.Status < 400 {
-						if result.Key != expected.Key {
-							t.Errorf("Expected key to be %v but got %v", expected.Key, result.Key)
+						if result.Data.Key != expected.Data.Key {
+							t.Errorf("Expected key to be %v but got %v", expected.Data.Key, result.Data.Key)
 						}
-						if expected.TTL == nil && result.TTL != nil {
-							t.Fatalf("Expected TTL to be nil but got %v", result.TTL)
+						if expected.Data.TTL == nil && result.Data.TTL != nil {
+							t.Fatalf("Expected TTL to be nil but got %v", result.Data.TTL)
 						}
-						if expected.TTL != nil && result.TTL != nil && *result.TTL < *expected.TTL-2 {
-							t.Errorf("Expected value to be %v but got %v", *expected.TTL, *result.TTL)
+						if expected.Data.TTL != nil && result.Data.TTL != nil && *result.Data.TTL < *expected.Data.TTL-2 {
+							t.Errorf("Expected value to be %v but got %v", *expected.Data.TTL, *result.Data.TTL)
 						}
 					}
 				}
@@ -487,25 +542,14 @@ func TestInMemoryDB_integration_pubSub_test(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			var wg sync.WaitGroup
+			var wg, serverWG sync.WaitGroup
 			dir := t.TempDir()
-			serverStartArgs := []string{"server", "serve",
+			ctx, cancel := context.WithCancel(context.Background())
+			rootURL := startServer(t, ctx, &serverWG, "server", "serve",
 				"--db-startup-file", "startup.json",
-				"--db-persist", "--db-persist-cycle", "1", "--db-persist-file", dir + "persist.json",
+				"--db-persist", "--db-persist-cycle", "1", "--db-persist-file", dir+"persist.json",
 				"--no-log",
-			}
-			ctx, cancel := context.WithCancel(context.Background())
-			serverCmd := cmd.NewRootCmd()
-			serverCmd.SetArgs(serverStartArgs)
-			serverCmd.SetContext(ctx)
-			go func() {
-				err := serverCmd.ExecuteContext(ctx)
-				if err != nil {
-					t.Errorf("Error executing server command with context: %v", err)
-				}
-			}()
-
-			<-time.After(100 * time.Millisecond) // Wait for server to set up
+			)
 
 			for i, s := range tt.subscribers {
 				wg.Add(1)
@@ -513,7 +557,7 @@ func TestInMemoryDB_integration_pubSub_test(t *testing.T) {
 					defer wg.Done()
 					t.Logf("Subscriber %v subscribing to channel %v", i, s.channel)
 
-					args := []string{"endpoint", "subscribe", "-c", s.channel, "-t", s.expire}
+					args := []string{"endpoint", "subscribe", "-c", s.channel, "-t", s.expire, "-u", rootURL}
 					output, err := execute(t, cmd.NewRootCmd(), args...)
 					if err != nil {
 						t.Error(err)
@@ -555,7 +599,7 @@ func TestInMemoryDB_integration_pubSub_test(t *testing.T) {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					args := []string{"endpoint", "publish", "-c", p.channel, "-m", p.message}
+					args := []string{"endpoint", "publish", "-c", p.channel, "-m", p.message, "-u", rootURL}
 					<-time.After(p.wait)
 					_, err := execute(t, cmd.NewRootCmd(), args...)
 					if err != nil {
@@ -566,6 +610,261 @@ func TestInMemoryDB_integration_pubSub_test(t *testing.T) {
 
 			wg.Wait()
 			cancel()
+			serverWG.Wait()
 		})
 	}
 }
+
+func TestInMemoryDB_integration_registry_test(t *testing.T) {
+	var serverWG sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		serverWG.Wait()
+	}()
+	rootURL := startServer(t, ctx, &serverWG, "server", "serve", "--no-log")
+	services := rootURL + "/v1/services/api/"
+
+	// send makes a request and decodes the data of the response envelope into data, returning the status code
+	send := func(method string, url string, body string, data any) int {
+		t.Helper()
+		r, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if data != nil {
+			if err = json.NewDecoder(resp.Body).Decode(&struct {
+				Data any `json:"data"`
+			}{data}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	type instance struct {
+		ID       string            `json:"id"`
+		Address  string            `json:"address"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	var registered struct {
+		LeaseID string `json:"leaseId"`
+	}
+	if status := send("POST", services+"instances", `{"id":"a","address":"10.0.0.1:80","metadata":{"zone":"x"},"ttl":30}`, &registered); status != http.StatusCreated {
+		t.Fatalf("register status = %v; want %v", status, http.StatusCreated)
+	}
+	if status := send("POST", services+"instances", `{"id":"a","address":"10.0.0.2:80","ttl":30}`, nil); status != http.StatusConflict {
+		t.Errorf("duplicate register status = %v; want %v", status, http.StatusConflict)
+	}
+
+	// Watch the service, which starts with the current instances
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+	r, _ := http.NewRequestWithContext(watchCtx, "GET", services+"watch", nil)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	stream := bufio.NewScanner(resp.Body)
+	next := func() string {
+		t.Helper()
+		var event, data string
+		for stream.Scan() {
+			line := stream.Text()
+			if line == "" && event != "" {
+				return event + " " + data
+			}
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				event = v
+			}
+			if v, ok := strings.CutPrefix(line, "data: "); ok {
+				data = v
+			}
+		}
+		t.Fatalf("watch ended early: %v", stream.Err())
+		return ""
+	}
+	if e := next(); e != `registered {"id":"a","address":"10.0.0.1:80","metadata":{"zone":"x"}}` {
+		t.Errorf("first event = %v", e)
+	}
+
+	var second struct {
+		LeaseID string `json:"leaseId"`
+	}
+	send("POST", services+"instances", `{"id":"b","address":"10.0.0.2:80","ttl":30}`, &second)
+	if e := next(); e != `registered {"id":"b","address":"10.0.0.2:80"}` {
+		t.Errorf("registration event = %v", e)
+	}
+
+	var list struct {
+		Instances []instance `json:"instances"`
+	}
+	send("GET", services+"instances", "", &list)
+	if len(list.Instances) != 2 || list.Instances[0].ID != "a" || list.Instances[1].ID != "b" {
+		t.Errorf("instances = %+v; want a and b", list.Instances)
+	}
+
+	// Heartbeats keep an instance registered without producing events
+	if status := send("PUT", services+"instances/a", `{"id":"`+registered.LeaseID+`"}`, nil); status != http.StatusOK {
+		t.Errorf("heartbeat status = %v; want %v", status, http.StatusOK)
+	}
+	if status := send("PUT", services+"instances/a", `{"id":"wrong"}`, nil); status != http.StatusNotFound {
+		t.Errorf("heartbeat with the wrong lease status = %v; want %v", status, http.StatusNotFound)
+	}
+
+	if status := send("DELETE", services+"instances/b", `{"id":"`+second.LeaseID+`"}`, nil); status != http.StatusOK {
+		t.Errorf("deregister status = %v; want %v", status, http.StatusOK)
+	}
+	if e := next(); e != `deregistered {"id":"b"}` {
+		t.Errorf("deregistration event = %v", e)
+	}
+
+	// Registry records are internal, so they cannot be reached through the key routes
+	var keys struct {
+		Keys []string `json:"keys"`
+	}
+	send("GET", rootURL+"/v1/keys", "", &keys)
+	if len(keys.Keys) != 0 {
+		t.Errorf("keys = %v; want the registry to be hidden", keys.Keys)
+	}
+}
+
+func TestInMemoryDB_integration_mirror_test(t *testing.T) {
+	var serverWG sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		serverWG.Wait()
+	}()
+	targetURL := startServer(t, ctx, &serverWG, "server", "serve", "--no-log")
+	sourceURL := startServer(t, ctx, &serverWG, "server", "serve", "--no-log", "--mirror-url", targetURL)
+
+	send := func(method string, url string, body string) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Writes to the source reach the target, deletes included
+	for _, req := range []struct{ method, key, body string }{
+		{"PUT", "kept", `{"value":"1","ttl":600}`},
+		{"PUT", "deleted", `{"value":"2"}`},
+		{"DELETE", "deleted", ""},
+		{"PUT", "kept", `{"value":"3","ttl":600}`},
+	} {
+		_ = send(req.method, sourceURL+"/v1/keys/"+req.key, req.body).Body.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := send("GET", targetURL+"/v1/keys/kept", "")
+		var got struct {
+			Data struct {
+				Value string `json:"value"`
+			} `json:"data"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&got)
+		_ = resp.Body.Close()
+		if got.Data.Value == "3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("target value of kept = %q; want 3", got.Data.Value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp := send("GET", targetURL+"/v1/keys/deleted", "")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("target status of deleted = %v; want %v", resp.StatusCode, http.StatusNotFound)
+	}
+	resp = send("GET", targetURL+"/v1/ttl/kept", "")
+	var ttl struct {
+		Data struct {
+			TTL *int64 `json:"ttl"`
+		} `json:"data"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&ttl)
+	_ = resp.Body.Close()
+	if ttl.Data.TTL == nil || *ttl.Data.TTL <= 0 || *ttl.Data.TTL > 600 {
+		t.Errorf("target ttl of kept = %v; want the ttl to be mirrored", ttl.Data.TTL)
+	}
+
+	// The source reports how far the target is behind. The last write is counted just after the target responds.
+	var metrics []byte
+	for deadline = time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp = send("GET", sourceURL+"/metrics", "")
+		metrics, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if strings.Contains(string(metrics), "db_mirror_applied_total 4") || time.Now().After(deadline) {
+			break
+		}
+	}
+	for _, line := range []string{"db_mirror_applied_total 4", "db_mirror_pending 0", "db_mirror_lag_seconds 0"} {
+		if !strings.Contains(string(metrics), line) {
+			t.Errorf("expected the source metrics to contain %q", line)
+		}
+	}
+}
+
+func TestInMemoryDB_integration_peers_test(t *testing.T) {
+	var serverWG sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		serverWG.Wait()
+	}()
+	peerURL := startServer(t, ctx, &serverWG, "server", "serve", "--no-log")
+	rootURL := startServer(t, ctx, &serverWG, "server", "serve", "--no-log", "--peers", peerURL)
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", peerURL+"/v1/subscribe/news", nil)
+	sub, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Body.Close()
+	reader := bufio.NewReader(sub.Body)
+
+	// A message published on one instance reaches the subscribers of its peer
+	resp, err := http.Post(rootURL+"/v1/publish/news", "application/json", strings.NewReader(`{"message":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if m, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+				received <- m
+				return
+			}
+		}
+	}()
+	select {
+	case m := <-received:
+		if m != "hello" {
+			t.Errorf("peer subscriber received %q; want hello", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message was not relayed to the peer")
+	}
+}